@@ -0,0 +1,57 @@
+// Command fixtures provisions a source database shaped like a Xata branch
+// (see package fixtures). The database must be named with --dsn; it is
+// never taken from the environment, so the fixtures cannot land on the
+// source a migration is configured for.
+//
+//	go run ./cmd/fixtures --dsn postgres://localhost/xata_fixture --rows 1000
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/fixtures"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "fixtures: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	dsn := flag.String("dsn", "", "Database to provision (required)")
+	rows := flag.Int("rows", 100, "Users to create; teams get a fifth as many, order items three times as many")
+	reset := flag.Bool("reset", false, "Drop the fixture tables, their sequence and the xata_private schema first; only on a database marked as a fixture database")
+	printSQL := flag.Bool("print", false, "Print the SQL instead of running it")
+	flag.Parse()
+
+	if *rows < 1 {
+		return fmt.Errorf("--rows must be at least 1")
+	}
+	if *printSQL {
+		fmt.Print(fixtures.Script(*rows, *reset))
+		return nil
+	}
+	if *dsn == "" {
+		return fmt.Errorf("no database to provision; pass --dsn")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, *dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if err := fixtures.Provision(ctx, conn, *rows, *reset); err != nil {
+		return err
+	}
+	fmt.Printf("Created %d users, %d teams and %d order items.\n", fixtures.Users(*rows), fixtures.Teams(*rows), fixtures.OrderItems(*rows))
+	return nil
+}
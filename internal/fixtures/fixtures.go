@@ -0,0 +1,87 @@
+// Package fixtures provisions a source database shaped like a Xata branch,
+// for developing and testing the migration tool without one: record ids
+// with defaults from the private schema, the version and timestamp
+// columns, link columns, arrays, jsonb and file columns, a sequence, and a
+// few pathological names. The fixtures command and the integration tests
+// of package migrate use it.
+package fixtures
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Marker is the comment on the xata_private schema of a fixture database.
+// Reset refuses to drop anything without it, so it cannot wipe a real
+// branch, whose private schema carries no such comment.
+const Marker = "migration-tool fixtures"
+
+// Users, Teams and OrderItems are the rows Provision creates for rows users.
+func Users(rows int) int      { return rows }
+func Teams(rows int) int      { return max(rows/5, 1) }
+func OrderItems(rows int) int { return rows * 3 }
+
+// Script returns the SQL that creates the fixtures with rows users, after
+// dropping the earlier ones with reset.
+func Script(rows int, reset bool) string {
+	script := schemaSQL + seedSQL(rows)
+	if reset {
+		script = resetSQL + script
+	}
+	return script
+}
+
+// Provision creates the fixtures with rows users on conn. Existing fixture
+// tables are an error, unless reset is set and the database carries
+// Marker; they are then dropped first.
+func Provision(ctx context.Context, conn *pgx.Conn, rows int, reset bool) error {
+	if rows < 1 {
+		return fmt.Errorf("rows must be at least 1")
+	}
+	var existing []string
+	for _, name := range tables {
+		var found bool
+		if err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", `public."`+name+`"`).Scan(&found); err != nil {
+			return fmt.Errorf("failed to look up %s: %w", name, err)
+		}
+		if found {
+			existing = append(existing, name)
+		}
+	}
+	private, marked, err := marker(ctx, conn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case reset && (private || len(existing) > 0) && !marked:
+		return fmt.Errorf("refusing to reset a database that is not marked as a fixture database (schema xata_private lacks the comment %q)", Marker)
+	case !reset && len(existing) > 0:
+		return fmt.Errorf("%d fixture table(s) already exist, e.g. %s; reset to recreate them", len(existing), existing[0])
+	case !reset && private:
+		return fmt.Errorf("schema xata_private already exists; reset to recreate it")
+	}
+
+	// With no arguments the script runs over the simple protocol, in one
+	// implicit transaction
+	if _, err := conn.Exec(ctx, Script(rows, reset)); err != nil {
+		return fmt.Errorf("failed to provision the fixtures: %w", err)
+	}
+	return nil
+}
+
+// marker reports whether the xata_private schema exists and whether it
+// carries Marker.
+func marker(ctx context.Context, conn *pgx.Conn) (exists, marked bool, err error) {
+	var comment *string
+	err = conn.QueryRow(ctx, "SELECT obj_description(oid, 'pg_namespace') FROM pg_namespace WHERE nspname = 'xata_private'").Scan(&comment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to look up schema xata_private: %w", err)
+	}
+	return true, comment != nil && *comment == Marker, nil
+}
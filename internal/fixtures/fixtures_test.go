@@ -0,0 +1,83 @@
+package fixtures
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestScript(t *testing.T) {
+	plain := Script(10, false)
+	if strings.Contains(plain, "DROP ") {
+		t.Error("the script without reset drops objects")
+	}
+	if !strings.Contains(plain, "COMMENT ON SCHEMA xata_private IS '"+Marker+"'") {
+		t.Error("the script does not mark the database as a fixture database")
+	}
+	if !strings.Contains(plain, "generate_series(1, 10)") {
+		t.Error("the script does not create the requested rows")
+	}
+	if reset := Script(10, true); !strings.HasPrefix(reset, resetSQL) {
+		t.Error("the script with reset does not drop the fixtures first")
+	}
+}
+
+func TestRowCounts(t *testing.T) {
+	for _, tt := range []struct{ rows, users, teams, items int }{
+		{1, 1, 1, 3},
+		{4, 4, 1, 12},
+		{100, 100, 20, 300},
+	} {
+		if Users(tt.rows) != tt.users || Teams(tt.rows) != tt.teams || OrderItems(tt.rows) != tt.items {
+			t.Errorf("%d rows: got %d/%d/%d, want %d/%d/%d", tt.rows,
+				Users(tt.rows), Teams(tt.rows), OrderItems(tt.rows), tt.users, tt.teams, tt.items)
+		}
+	}
+}
+
+// TestResetRequiresMarker runs against the scratch destination of the
+// integration tests of package migrate.
+func TestResetRequiresMarker(t *testing.T) {
+	url := os.Getenv("MIGRATION_TOOL_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("set MIGRATION_TOOL_TEST_DATABASE_URL to run against a database")
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	cleanup := func() {
+		if _, err := conn.Exec(ctx, resetSQL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA xata_private"); err != nil {
+		t.Fatal(err)
+	}
+	err = Provision(ctx, conn, 5, true)
+	if err == nil || !strings.Contains(err.Error(), "not marked as a fixture database") {
+		t.Fatalf("reset of an unmarked database: err = %v", err)
+	}
+	if _, err := conn.Exec(ctx, "DROP SCHEMA xata_private"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Provision(ctx, conn, 5, false); err != nil {
+		t.Fatalf("provisioning an empty database: %v", err)
+	}
+	if err := Provision(ctx, conn, 5, false); err == nil {
+		t.Fatal("provisioning over existing fixtures succeeded without reset")
+	}
+	if err := Provision(ctx, conn, 5, true); err != nil {
+		t.Fatalf("reset of a fixture database: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package fixtures
+
+import "fmt"
+
+// tables are the tables the fixtures create in public.
+var tables = []string{"Order Items", "teams", "users"}
+
+// resetSQL drops everything the fixtures create.
+const resetSQL = `
+DROP TABLE IF EXISTS public."Order Items", public.teams, public.users CASCADE;
+DROP SEQUENCE IF EXISTS public.invoice_number_seq;
+DROP SCHEMA IF EXISTS xata_private CASCADE;
+`
+
+// schemaSQL recreates what a Xata branch exposes through its Postgres
+// endpoint: text record ids drawn from a function in the private schema,
+// the version and timestamp columns kept up to date by a trigger, and a
+// unique and a length check on every xata_id. Link columns are text
+// foreign keys onto xata_id, file columns jsonb objects.
+const schemaSQL = `
+CREATE SCHEMA xata_private;
+COMMENT ON SCHEMA xata_private IS 'migration-tool fixtures';
+
+CREATE FUNCTION xata_private.xid() RETURNS text
+LANGUAGE sql VOLATILE AS $$
+	SELECT substr(md5(random()::text || clock_timestamp()::text), 1, 20)
+$$;
+
+CREATE FUNCTION xata_private.maintain_metadata_trigger() RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+	NEW.xata_updatedat := now();
+	NEW.xata_version := OLD.xata_version + 1;
+	RETURN NEW;
+END
+$$;
+
+CREATE SEQUENCE public.invoice_number_seq START 1000;
+
+CREATE TABLE public.users (
+	xata_id text DEFAULT ('rec_'::text || xata_private.xid()) NOT NULL,
+	xata_version integer DEFAULT 0 NOT NULL,
+	xata_createdat timestamptz DEFAULT now() NOT NULL,
+	xata_updatedat timestamptz DEFAULT now() NOT NULL,
+	name text,
+	email text,
+	tags text[],
+	settings jsonb,
+	avatar jsonb,
+	xata jsonb,
+	CONSTRAINT users_pkey PRIMARY KEY (xata_id),
+	CONSTRAINT _pgroll_new_users_xata_id_key UNIQUE (xata_id),
+	CONSTRAINT xata_id_length_users CHECK (length(xata_id) < 256),
+	CONSTRAINT users_email_unique UNIQUE (email)
+);
+
+CREATE TABLE public.teams (
+	xata_id text DEFAULT ('rec_'::text || xata_private.xid()) NOT NULL,
+	xata_version integer DEFAULT 0 NOT NULL,
+	xata_createdat timestamptz DEFAULT now() NOT NULL,
+	xata_updatedat timestamptz DEFAULT now() NOT NULL,
+	name text NOT NULL,
+	owner text,
+	members text[] DEFAULT '{}'::text[],
+	scores integer[],
+	CONSTRAINT teams_pkey PRIMARY KEY (xata_id),
+	CONSTRAINT _pgroll_new_teams_xata_id_key UNIQUE (xata_id),
+	CONSTRAINT xata_id_length_teams CHECK (length(xata_id) < 256),
+	CONSTRAINT owner_link FOREIGN KEY (owner) REFERENCES public.users (xata_id) ON DELETE SET NULL
+);
+
+CREATE TABLE public."Order Items" (
+	xata_id text DEFAULT ('rec_'::text || xata_private.xid()) NOT NULL,
+	xata_version integer DEFAULT 0 NOT NULL,
+	xata_createdat timestamptz DEFAULT now() NOT NULL,
+	xata_updatedat timestamptz DEFAULT now() NOT NULL,
+	invoice_number bigint DEFAULT nextval('public.invoice_number_seq'::regclass) NOT NULL,
+	"user" text,
+	team text,
+	"select" integer,
+	"Quantity" numeric(12,3),
+	"café" text,
+	"quote""d" text,
+	last_login_at_with_a_name_long_enough_to_reach_postgres_limit_x timestamptz,
+	receipt jsonb,
+	CONSTRAINT "Order Items_pkey" PRIMARY KEY (xata_id),
+	CONSTRAINT "_pgroll_new_Order Items_xata_id_key" UNIQUE (xata_id),
+	CONSTRAINT "xata_id_length_Order Items" CHECK (length(xata_id) < 256),
+	CONSTRAINT user_link FOREIGN KEY ("user") REFERENCES public.users (xata_id) ON DELETE SET NULL,
+	CONSTRAINT team_link FOREIGN KEY (team) REFERENCES public.teams (xata_id) ON DELETE SET NULL
+);
+ALTER SEQUENCE public.invoice_number_seq OWNED BY public."Order Items".invoice_number;
+
+CREATE INDEX "Order Items_user_idx" ON public."Order Items" ("user");
+CREATE INDEX users_tags_idx ON public.users USING gin (tags);
+
+CREATE TRIGGER xata_maintain_metadata_trigger BEFORE UPDATE ON public.users
+	FOR EACH ROW EXECUTE FUNCTION xata_private.maintain_metadata_trigger();
+CREATE TRIGGER xata_maintain_metadata_trigger BEFORE UPDATE ON public.teams
+	FOR EACH ROW EXECUTE FUNCTION xata_private.maintain_metadata_trigger();
+CREATE TRIGGER xata_maintain_metadata_trigger BEFORE UPDATE ON public."Order Items"
+	FOR EACH ROW EXECUTE FUNCTION xata_private.maintain_metadata_trigger();
+
+COMMENT ON TABLE public."Order Items" IS 'Line items, named like a table created in the Xata UI';
+`
+
+// seedSQL fills the tables with records of deterministic ids, so links
+// point at existing rows: rec_u and the user's number padded to 19 digits,
+// rec_t for teams and rec_o for order items. The legacy xata object column
+// is filled too, for the metadata handling to leave out. NULLs, empty
+// arrays, unicode and control characters turn up every few rows.
+func seedSQL(rows int) string {
+	return fmt.Sprintf(`
+INSERT INTO public.users (xata_id, xata_version, name, email, tags, settings, avatar, xata)
+SELECT 'rec_u' || lpad(i::text, 19, '0'),
+	i %% 3,
+	CASE WHEN i %% 10 = 0 THEN NULL WHEN i %% 7 = 0 THEN 'Zoë “Tab”' || E'\t' || i ELSE 'User ' || i END,
+	'user' || i || '@example.com',
+	CASE WHEN i %% 5 = 0 THEN '{}'::text[] ELSE ARRAY['tag' || i %% 4, 'tag' || i %% 6] END,
+	jsonb_build_object('theme', CASE WHEN i %% 2 = 0 THEN 'dark' ELSE 'light' END, 'notifications', i %% 3 = 0, 'note', 'café'),
+	CASE WHEN i %% 4 = 0 THEN NULL ELSE jsonb_build_object(
+		'name', 'avatar' || i || '.png', 'mediaType', 'image/png', 'size', 1024 + i,
+		'version', 1, 'enablePublicUrl', i %% 2 = 0, 'url', 'https://eu-west-1.storage.xata.sh/' || md5(i::text)) END,
+	jsonb_build_object('version', i %% 3, 'createdAt', now(), 'updatedAt', now())
+FROM generate_series(1, %[1]d) AS i;
+
+INSERT INTO public.teams (xata_id, name, owner, members, scores)
+SELECT 'rec_t' || lpad(i::text, 19, '0'),
+	'Team ' || i,
+	CASE WHEN i %% 6 = 0 THEN NULL ELSE 'rec_u' || lpad((1 + i %% %[1]d)::text, 19, '0') END,
+	ARRAY['rec_u' || lpad((1 + (i * 7) %% %[1]d)::text, 19, '0')],
+	CASE WHEN i %% 3 = 0 THEN NULL ELSE ARRAY[i, i * 2, NULL] END
+FROM generate_series(1, greatest(%[1]d / 5, 1)) AS i;
+
+INSERT INTO public."Order Items" (xata_id, "user", team, "select", "Quantity", "café", "quote""d",
+	last_login_at_with_a_name_long_enough_to_reach_postgres_limit_x, receipt)
+SELECT 'rec_o' || lpad(i::text, 19, '0'),
+	CASE WHEN i %% 9 = 0 THEN NULL ELSE 'rec_u' || lpad((1 + i %% %[1]d)::text, 19, '0') END,
+	'rec_t' || lpad((1 + i %% greatest(%[1]d / 5, 1))::text, 19, '0'),
+	i %% 100,
+	round((i * 1.375)::numeric, 3),
+	CASE WHEN i %% 2 = 0 THEN 'crème brûlée' ELSE '日本語' END,
+	'say "hi"' || E'\n' || 'and ''bye''',
+	CASE WHEN i %% 3 = 0 THEN NULL ELSE timestamptz '2024-01-01 00:00:00+00' + i * interval '1 hour' END,
+	CASE WHEN i %% 2 = 0 THEN NULL ELSE jsonb_build_object('name', 'receipt-' || i || '.pdf', 'mediaType', 'application/pdf', 'size', 20480 + i) END
+FROM generate_series(1, %[1]d * 3) AS i;
+
+ANALYZE public.users, public.teams, public."Order Items";
+`, rows)
+}
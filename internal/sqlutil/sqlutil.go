@@ -0,0 +1,287 @@
+// Package sqlutil assembles SQL fragments (quoted identifiers and literals,
+// column lists, SELECT, COPY and DDL statements) for the migration tool.
+package sqlutil
+
+import (
+	"strconv"
+	"strings"
+)
+
+// QuoteIdent quotes a single identifier, doubling any embedded double quotes.
+// Every identifier is quoted, so mixed case, unicode and reserved words
+// ("user", "order") are preserved exactly.
+func QuoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QualifiedIdent quotes each part and joins them with dots, e.g.
+// QualifiedIdent("public", "users") returns "public"."users".
+func QualifiedIdent(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, p := range parts {
+		quoted[i] = QuoteIdent(p)
+	}
+	return strings.Join(quoted, ".")
+}
+
+// QuoteLiteral quotes a string literal. Backslashes switch to the E'...' form so
+// the result is correct whatever standard_conforming_strings is set to.
+func QuoteLiteral(s string) string {
+	s = strings.ReplaceAll(s, `'`, `''`)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.ReplaceAll(s, `\`, `\\`) + `'`
+	}
+	return `'` + s + `'`
+}
+
+// ColumnList quotes the names and joins them with ", ".
+func ColumnList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = QuoteIdent(n)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Only returns the FROM target for reading a table's own rows, excluding any
+// inheritance children.
+func Only(table string) string {
+	return "ONLY " + table
+}
+
+// Select builds SELECT <columns> FROM <from>. from must already be quoted
+// (see QuoteIdent, QualifiedIdent and Only).
+func Select(columns []string, from string) string {
+	return "SELECT " + ColumnList(columns) + " FROM " + from
+}
+
+// CountRows builds SELECT count(*) FROM <from>.
+func CountRows(from string) string {
+	return "SELECT count(*) FROM " + from
+}
+
+// CopyTo builds COPY <table> (<columns>) TO STDOUT WITH (<options>).
+func CopyTo(table string, columns []string, options string) string {
+	return "COPY " + table + " (" + ColumnList(columns) + ") TO STDOUT WITH (" + options + ")"
+}
+
+// CopyFrom builds COPY <table> (<columns>) FROM STDIN WITH (<options>).
+func CopyFrom(table string, columns []string, options string) string {
+	return "COPY " + table + " (" + ColumnList(columns) + ") FROM STDIN WITH (" + options + ")"
+}
+
+// ColumnDef is one column definition inside CREATE TABLE.
+type ColumnDef struct {
+	Name string
+	Type string
+	// Collation is the quoted name of a COLLATE clause; empty means the
+	// default of the type
+	Collation string
+	NotNull   bool
+	// Default is a raw SQL expression; empty means no DEFAULT clause.
+	Default string
+	// Generated is the raw expression of a GENERATED ALWAYS AS column,
+	// stored unless Virtual; it takes the place of Default.
+	Generated string
+	Virtual   bool
+	// Identity is ALWAYS or BY DEFAULT for an identity column
+	Identity string
+}
+
+// SQL renders the column definition.
+func (c ColumnDef) SQL() string {
+	var b strings.Builder
+	b.WriteString(QuoteIdent(c.Name))
+	b.WriteString(" ")
+	b.WriteString(c.Type)
+	if c.Collation != "" {
+		b.WriteString(" COLLATE ")
+		b.WriteString(c.Collation)
+	}
+	if c.Generated != "" {
+		b.WriteString(" GENERATED ALWAYS AS (")
+		b.WriteString(c.Generated)
+		if c.Virtual {
+			b.WriteString(") VIRTUAL")
+		} else {
+			b.WriteString(") STORED")
+		}
+	}
+	if c.Identity != "" {
+		b.WriteString(" GENERATED " + c.Identity + " AS IDENTITY")
+	}
+	if c.NotNull {
+		b.WriteString(" NOT NULL")
+	}
+	if c.Default != "" {
+		b.WriteString(" DEFAULT ")
+		b.WriteString(c.Default)
+	}
+	return b.String()
+}
+
+// PrimaryKey builds a PRIMARY KEY (<columns>) table constraint.
+func PrimaryKey(columns []string) string {
+	return "PRIMARY KEY (" + ColumnList(columns) + ")"
+}
+
+// NamedConstraint builds a CONSTRAINT <name> <def> table constraint. def is
+// a raw constraint definition as returned by pg_get_constraintdef.
+func NamedConstraint(name, def string) string {
+	return "CONSTRAINT " + QuoteIdent(name) + " " + def
+}
+
+// CreateTable builds CREATE TABLE <table> (<columns>, <constraints>) with an
+// optional INHERITS clause. table and inherits must already be quoted;
+// constraints are raw table-constraint clauses.
+func CreateTable(table string, columns []ColumnDef, constraints []string, inherits []string) string {
+	defs := make([]string, 0, len(columns)+len(constraints))
+	for _, c := range columns {
+		defs = append(defs, c.SQL())
+	}
+	defs = append(defs, constraints...)
+
+	sql := "CREATE TABLE " + table + " (" + strings.Join(defs, ", ") + ")"
+	if len(inherits) > 0 {
+		sql += " INHERITS (" + strings.Join(inherits, ", ") + ")"
+	}
+	return sql
+}
+
+// PartitionByRange is the PARTITION BY RANGE (<column>) clause appended to
+// CreateTable for a partitioned parent.
+func PartitionByRange(column string) string {
+	return " PARTITION BY RANGE (" + QuoteIdent(column) + ")"
+}
+
+// CreatePartition builds CREATE TABLE <name> PARTITION OF <parent> FOR VALUES
+// FROM (<from>) TO (<to>). name and parent must already be quoted; from and
+// to are raw bound expressions (see QuoteLiteral).
+func CreatePartition(name, parent, from, to string) string {
+	return "CREATE TABLE " + name + " PARTITION OF " + parent + " FOR VALUES FROM (" + from + ") TO (" + to + ")"
+}
+
+// PartitionOf builds CREATE TABLE <name> PARTITION OF <parent> with the
+// partition's own constraints, if any, and its raw bound, e.g. FOR VALUES IN
+// ('a') or DEFAULT, as pg_get_expr prints it. name and parent must already be
+// quoted.
+func PartitionOf(name, parent string, constraints []string, bound string) string {
+	sql := "CREATE TABLE " + name + " PARTITION OF " + parent
+	if len(constraints) > 0 {
+		sql += " (" + strings.Join(constraints, ", ") + ")"
+	}
+	return sql + " " + bound
+}
+
+// CreateDefaultPartition builds CREATE TABLE <name> PARTITION OF <parent>
+// DEFAULT.
+func CreateDefaultPartition(name, parent string) string {
+	return "CREATE TABLE " + name + " PARTITION OF " + parent + " DEFAULT"
+}
+
+// DropConstraint builds ALTER TABLE <table> DROP CONSTRAINT <name>. table
+// must already be quoted.
+func DropConstraint(table, name string) string {
+	return "ALTER TABLE " + table + " DROP CONSTRAINT " + QuoteIdent(name)
+}
+
+// AddConstraint builds ALTER TABLE <table> ADD CONSTRAINT <name> <def>,
+// optionally NOT VALID so existing rows are not checked. def is a raw
+// constraint definition as returned by pg_get_constraintdef.
+func AddConstraint(table, name, def string, notValid bool) string {
+	sql := "ALTER TABLE " + table + " ADD CONSTRAINT " + QuoteIdent(name) + " " + def
+	if notValid {
+		sql += " NOT VALID"
+	}
+	return sql
+}
+
+// ValidateConstraint builds ALTER TABLE <table> VALIDATE CONSTRAINT <name>.
+func ValidateConstraint(table, name string) string {
+	return "ALTER TABLE " + table + " VALIDATE CONSTRAINT " + QuoteIdent(name)
+}
+
+// CommentOn builds COMMENT ON <kind> <object> IS '<comment>'. object must
+// already be quoted; the comment may hold quotes and line breaks.
+func CommentOn(kind, object, comment string) string {
+	return "COMMENT ON " + kind + " " + object + " IS " + QuoteLiteral(comment)
+}
+
+// DropTable builds DROP TABLE IF EXISTS <table>, optionally with CASCADE.
+func DropTable(table string, cascade bool) string {
+	sql := "DROP TABLE IF EXISTS " + table
+	if cascade {
+		sql += " CASCADE"
+	}
+	return sql
+}
+
+// Truncate builds TRUNCATE <table>. table must already be quoted and may be
+// wrapped in Only.
+func Truncate(table string) string {
+	return "TRUNCATE " + table
+}
+
+// overridingSystemValue lets the inserts below write GENERATED ALWAYS AS
+// IDENTITY columns, as COPY does; it has no effect on other tables.
+const overridingSystemValue = " OVERRIDING SYSTEM VALUE"
+
+// InsertSelect builds INSERT INTO <table> (<columns>) SELECT <columns> FROM
+// <from>. Naming every column keeps destination defaults from firing, and
+// identity columns take the given values.
+func InsertSelect(table string, columns []string, from string) string {
+	cols := ColumnList(columns)
+	return "INSERT INTO " + table + " (" + cols + ")" + overridingSystemValue + " SELECT " + cols + " FROM " + from
+}
+
+// InsertSelectExprs is InsertSelect with an expression per column, e.g. to
+// transform a staged value.
+func InsertSelectExprs(table string, columns, exprs []string, from string) string {
+	return "INSERT INTO " + table + " (" + ColumnList(columns) + ")" + overridingSystemValue + " SELECT " + strings.Join(exprs, ", ") + " FROM " + from
+}
+
+// InsertValues builds INSERT INTO <table> (<columns>) VALUES with rows
+// rows of numbered parameters, $1 to $rows*len(columns), row by row.
+func InsertValues(table string, columns []string, rows int) string {
+	var b strings.Builder
+	b.WriteString("INSERT INTO " + table + " (" + ColumnList(columns) + ")" + overridingSystemValue + " VALUES ")
+	n := 0
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := range columns {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// OnConflictDoUpdate builds ON CONFLICT (<conflict>) DO UPDATE SET col =
+// EXCLUDED.col for each update column, or DO NOTHING when there are none.
+func OnConflictDoUpdate(conflict, update []string) string {
+	return doUpdate("ON CONFLICT ("+ColumnList(conflict)+")", update)
+}
+
+// OnConstraintDoUpdate is OnConflictDoUpdate with ON CONFLICT ON CONSTRAINT
+// <constraint> as the conflict target.
+func OnConstraintDoUpdate(constraint string, update []string) string {
+	return doUpdate("ON CONFLICT ON CONSTRAINT "+QuoteIdent(constraint), update)
+}
+
+func doUpdate(sql string, update []string) string {
+	if len(update) == 0 {
+		return sql + " DO NOTHING"
+	}
+	sets := make([]string, len(update))
+	for i, c := range update {
+		sets[i] = QuoteIdent(c) + " = EXCLUDED." + QuoteIdent(c)
+	}
+	return sql + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
@@ -0,0 +1,164 @@
+package sqlutil
+
+import "testing"
+
+func TestQuoteIdent(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"users", `"users"`},
+		{"Order Items", `"Order Items"`},
+		{"MixedCase", `"MixedCase"`},
+		{"user", `"user"`},
+		{"order", `"order"`},
+		{"select", `"select"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{`"`, `""""`},
+		{"naïve_café", `"naïve_café"`},
+		{"表", `"表"`},
+		{"emoji_🚀", `"emoji_🚀"`},
+		{"a.b", `"a.b"`},
+		{"", `""`},
+	} {
+		if got := QuoteIdent(tt.name); got != tt.want {
+			t.Errorf("QuoteIdent(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQualifiedIdent(t *testing.T) {
+	for _, tt := range []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"users"}, `"users"`},
+		{[]string{"public", "users"}, `"public"."users"`},
+		{[]string{"Sales", "order"}, `"Sales"."order"`},
+		{[]string{`we"ird`, "tâble"}, `"we""ird"."tâble"`},
+	} {
+		if got := QualifiedIdent(tt.parts...); got != tt.want {
+			t.Errorf("QualifiedIdent(%q) = %s, want %s", tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	for _, tt := range []struct{ s, want string }{
+		{"plain", `'plain'`},
+		{"", `''`},
+		{"it's", `'it''s'`},
+		{"''", `''''''`},
+		{`C:\temp`, `E'C:\\temp'`},
+		{`it's C:\`, `E'it''s C:\\'`},
+		{"línea\nnueva", "'línea\nnueva'"},
+		{"日本語", `'日本語'`},
+	} {
+		if got := QuoteLiteral(tt.s); got != tt.want {
+			t.Errorf("QuoteLiteral(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestColumnList(t *testing.T) {
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"id"}, `"id"`},
+		{[]string{"id", "user", "Created At", `x"y`}, `"id", "user", "Created At", "x""y"`},
+	} {
+		if got := ColumnList(tt.names); got != tt.want {
+			t.Errorf("ColumnList(%q) = %s, want %s", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	users := QuoteIdent("user")
+	for _, tt := range []struct{ name, got, want string }{
+		{"select", Select([]string{"id", "group"}, Only(users)), `SELECT "id", "group" FROM ONLY "user"`},
+		{"count", CountRows(QualifiedIdent("sales", "Order")), `SELECT count(*) FROM "sales"."Order"`},
+		{"copy to", CopyTo(users, []string{"id"}, "FORMAT csv"), `COPY "user" ("id") TO STDOUT WITH (FORMAT csv)`},
+		{"copy from", CopyFrom(users, []string{"id", "näme"}, "FORMAT csv, FREEZE"), `COPY "user" ("id", "näme") FROM STDIN WITH (FORMAT csv, FREEZE)`},
+		{"primary key", PrimaryKey([]string{"tenant", "id"}), `PRIMARY KEY ("tenant", "id")`},
+		{"named constraint", NamedConstraint("check", "CHECK ((n > 0))"), `CONSTRAINT "check" CHECK ((n > 0))`},
+		{"partition by", PartitionByRange("created at"), ` PARTITION BY RANGE ("created at")`},
+		{"partition", CreatePartition(`"p1"`, users, "'2024-01-01'", "'2025-01-01'"), `CREATE TABLE "p1" PARTITION OF "user" FOR VALUES FROM ('2024-01-01') TO ('2025-01-01')`},
+		{"partition of", PartitionOf(`"p_a"`, users, nil, "FOR VALUES IN ('a')"), `CREATE TABLE "p_a" PARTITION OF "user" FOR VALUES IN ('a')`},
+		{"partition of with constraints", PartitionOf(`"p_a"`, users, []string{`PRIMARY KEY ("id")`}, "DEFAULT"), `CREATE TABLE "p_a" PARTITION OF "user" (PRIMARY KEY ("id")) DEFAULT`},
+		{"default partition", CreateDefaultPartition(`"p_default"`, users), `CREATE TABLE "p_default" PARTITION OF "user" DEFAULT`},
+		{"drop constraint", DropConstraint(users, "user_pkey"), `ALTER TABLE "user" DROP CONSTRAINT "user_pkey"`},
+		{"add constraint", AddConstraint(users, "fk", "FOREIGN KEY (a) REFERENCES b(id)", false), `ALTER TABLE "user" ADD CONSTRAINT "fk" FOREIGN KEY (a) REFERENCES b(id)`},
+		{"add constraint not valid", AddConstraint(users, "fk", "FOREIGN KEY (a) REFERENCES b(id)", true), `ALTER TABLE "user" ADD CONSTRAINT "fk" FOREIGN KEY (a) REFERENCES b(id) NOT VALID`},
+		{"validate", ValidateConstraint(users, "fk"), `ALTER TABLE "user" VALIDATE CONSTRAINT "fk"`},
+		{"comment", CommentOn("TABLE", users, "the user's\ntable"), "COMMENT ON TABLE \"user\" IS 'the user''s\ntable'"},
+		{"drop", DropTable(users, false), `DROP TABLE IF EXISTS "user"`},
+		{"drop cascade", DropTable(users, true), `DROP TABLE IF EXISTS "user" CASCADE`},
+		{"truncate", Truncate(Only(users)), `TRUNCATE ONLY "user"`},
+		{"insert select", InsertSelect(users, []string{"id", "name"}, `"staging"`), `INSERT INTO "user" ("id", "name") OVERRIDING SYSTEM VALUE SELECT "id", "name" FROM "staging"`},
+		{"insert select exprs", InsertSelectExprs(users, []string{"id"}, []string{"id::uuid"}, `"staging"`), `INSERT INTO "user" ("id") OVERRIDING SYSTEM VALUE SELECT id::uuid FROM "staging"`},
+		{"insert values", InsertValues(users, []string{"id", "name"}, 2), `INSERT INTO "user" ("id", "name") OVERRIDING SYSTEM VALUE VALUES ($1, $2), ($3, $4)`},
+		{"on conflict", OnConflictDoUpdate([]string{"id"}, []string{"name", "order"}), `ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "order" = EXCLUDED."order"`},
+		{"on conflict do nothing", OnConflictDoUpdate([]string{"id"}, nil), `ON CONFLICT ("id") DO NOTHING`},
+		{"on constraint", OnConstraintDoUpdate("user_pkey", []string{"name"}), `ON CONFLICT ON CONSTRAINT "user_pkey" DO UPDATE SET "name" = EXCLUDED."name"`},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestColumnDefSQL(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		def  ColumnDef
+		want string
+	}{
+		{"plain", ColumnDef{Name: "id", Type: "integer"}, `"id" integer`},
+		{"reserved word", ColumnDef{Name: "default", Type: "text", NotNull: true}, `"default" text NOT NULL`},
+		{"unicode", ColumnDef{Name: "prénom", Type: "text", Collation: `"und-x-icu"`}, `"prénom" text COLLATE "und-x-icu"`},
+		{"default", ColumnDef{Name: "n", Type: "bigint", Default: "nextval('n_seq'::regclass)", NotNull: true}, `"n" bigint NOT NULL DEFAULT nextval('n_seq'::regclass)`},
+		{"stored", ColumnDef{Name: "total", Type: "numeric", Generated: "price * qty"}, `"total" numeric GENERATED ALWAYS AS (price * qty) STORED`},
+		{"virtual", ColumnDef{Name: "total", Type: "numeric", Generated: "price * qty", Virtual: true}, `"total" numeric GENERATED ALWAYS AS (price * qty) VIRTUAL`},
+		{"identity", ColumnDef{Name: "id", Type: "bigint", Identity: "BY DEFAULT", NotNull: true}, `"id" bigint GENERATED BY DEFAULT AS IDENTITY NOT NULL`},
+	} {
+		if got := tt.def.SQL(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		table       string
+		columns     []ColumnDef
+		constraints []string
+		inherits    []string
+		want        string
+	}{
+		{
+			name:    "columns only",
+			table:   QuoteIdent("order"),
+			columns: []ColumnDef{{Name: "id", Type: "integer"}},
+			want:    `CREATE TABLE "order" ("id" integer)`,
+		},
+		{
+			name:        "with constraints",
+			table:       QualifiedIdent("sales", "Order Items"),
+			columns:     []ColumnDef{{Name: "id", Type: "integer", NotNull: true}, {Name: "note", Type: "text"}},
+			constraints: []string{PrimaryKey([]string{"id"})},
+			want:        `CREATE TABLE "sales"."Order Items" ("id" integer NOT NULL, "note" text, PRIMARY KEY ("id"))`,
+		},
+		{
+			name:     "inherits",
+			table:    QuoteIdent("child"),
+			columns:  []ColumnDef{{Name: "extra", Type: "text"}},
+			inherits: []string{QuoteIdent("parent"), QualifiedIdent("other", "base")},
+			want:     `CREATE TABLE "child" ("extra" text) INHERITS ("parent", "other"."base")`,
+		},
+	} {
+		if got := CreateTable(tt.table, tt.columns, tt.constraints, tt.inherits); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Thresholds of the bloat advice. Small tables and indexes are left alone,
+// whatever their ratios; rewriting them gains nothing worth a lock.
+const (
+	// bloatDeadRatio of dead tuples makes a table a VACUUM FULL candidate
+	bloatDeadRatio = 0.2
+	// bloatIndexRatio of an index's size over its estimate makes it a
+	// REINDEX candidate
+	bloatIndexRatio = 2.0
+	bloatMinBytes   = 8 << 20
+	// btreeFillFactor is the default fill of btree leaf pages; btreeTupleBytes
+	// the index tuple header and line pointer added to each key
+	btreeFillFactor = 0.9
+	btreeTupleBytes = 16
+	pageBytes       = 8192
+)
+
+// Advice of a BloatReport
+const (
+	adviceVacuumFull = "vacuum_full"
+	adviceReindex    = "reindex"
+)
+
+// BloatReport is the bloat of one destination table kept and synced by the
+// run, read after its load.
+type BloatReport struct {
+	Table      string  `json:"table"`
+	LiveTuples int64   `json:"live_tuples"`
+	DeadTuples int64   `json:"dead_tuples"`
+	DeadRatio  float64 `json:"dead_ratio"`
+	TableBytes int64   `json:"table_bytes"`
+	// Indexes are the btree indexes a fresh estimate could be made for
+	Indexes []IndexBloat `json:"indexes,omitempty"`
+	// Advice is vacuum_full and, for the indexes listed in Reindex, reindex
+	Advice  []string `json:"advice,omitempty"`
+	Reindex []string `json:"reindex,omitempty"`
+	// Vacuumed is set once --vacuum-after-sync ran VACUUM ANALYZE on it
+	Vacuumed bool `json:"vacuumed,omitempty"`
+}
+
+// IndexBloat compares the size of an index with that of a freshly built one.
+type IndexBloat struct {
+	Name           string `json:"name"`
+	Bytes          int64  `json:"bytes"`
+	EstimatedBytes int64  `json:"estimated_bytes"`
+}
+
+// syncedTables returns the tables of the run that were loaded into their
+// existing destination table in this session, by --data-only, a
+// differential or incremental sync, a merge or --mode sync. Recreated tables
+// start out without bloat.
+func syncedTables(state *MigrationState, opts Options) []Table {
+	var out []Table
+	for _, t := range loadedTables(state.Tables, state.Report) {
+		if state.Keep[t.Name] && (opts.DataOnly || state.DiffPlan[t.Name] || state.Merge[t.Name] || state.Incremental[t.Name] != nil) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// checkBloat reads the dead tuples of every synced table and the sizes of
+// its indexes against a fresh estimate, advises VACUUM FULL or REINDEX where
+// they are far off, and with vacuum runs VACUUM ANALYZE on the tables with
+// dead tuples. It runs after ANALYZE, which the estimates depend on.
+func checkBloat(ctx context.Context, dest Querier, tables []Table, vacuum bool, report *Report) ([]BloatReport, error) {
+	var out []BloatReport
+	for _, t := range tables {
+		br := BloatReport{Table: t.qualifiedDestName()}
+		err := dest.QueryRow(ctx, `
+			SELECT COALESCE(s.n_live_tup, 0), COALESCE(s.n_dead_tup, 0), pg_relation_size(c.oid)
+			FROM pg_class c
+			LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+			WHERE c.oid = to_regclass($1)
+		`, destIdent(t)).Scan(&br.LiveTuples, &br.DeadTuples, &br.TableBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the bloat of %s: %w", t.qualifiedDestName(), err)
+		}
+		if total := br.LiveTuples + br.DeadTuples; total > 0 {
+			br.DeadRatio = float64(br.DeadTuples) / float64(total)
+		}
+		if br.DeadRatio >= bloatDeadRatio && br.TableBytes >= bloatMinBytes {
+			br.Advice = append(br.Advice, adviceVacuumFull)
+		}
+
+		if br.Indexes, err = indexBloat(ctx, dest, t); err != nil {
+			return nil, err
+		}
+		for _, ib := range br.Indexes {
+			if ib.Bytes >= bloatMinBytes && float64(ib.Bytes) >= bloatIndexRatio*float64(ib.EstimatedBytes) {
+				br.Reindex = append(br.Reindex, ib.Name)
+			}
+		}
+		if len(br.Reindex) > 0 {
+			br.Advice = append(br.Advice, adviceReindex)
+		}
+		for _, a := range br.Advice {
+			switch a {
+			case adviceVacuumFull:
+				report.warnTable(warnBloat, t.Name, "%s has %.0f%% dead tuples (%s); consider VACUUM FULL", br.Table, 100*br.DeadRatio, formatBytes(br.TableBytes))
+			case adviceReindex:
+				report.warnTable(warnBloat, t.Name, "%d index(es) of %s are at least %.0fx their fresh size; consider REINDEX", len(br.Reindex), br.Table, bloatIndexRatio)
+			}
+		}
+
+		if vacuum && br.DeadTuples > 0 {
+			if _, err := dest.Exec(ctx, "VACUUM (ANALYZE) "+destIdent(t)); err != nil {
+				report.warnTable(warnBloat, t.Name, "failed to vacuum %s: %v", br.Table, err)
+			} else {
+				br.Vacuumed = true
+			}
+		}
+		out = append(out, br)
+	}
+	return out, nil
+}
+
+// indexBloat returns the btree indexes of t with their size and the size
+// of the same index built fresh: every row's key, by the columns' average
+// width from pg_stats, plus the tuple overhead, on pages filled to the
+// default fillfactor. Expression indexes and tables without statistics
+// have no estimate and are left out.
+func indexBloat(ctx context.Context, dest Querier, t Table) ([]IndexBloat, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT ic.relname, pg_relation_size(ic.oid), c.reltuples::float8,
+			(SELECT sum(st.avg_width)::float8
+			 FROM unnest(i.indkey::int2[]) AS k(attnum)
+			 JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+			 JOIN pg_stats st ON st.schemaname = n.nspname AND st.tablename = c.relname AND st.attname = a.attname)
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_am am ON am.oid = ic.relam
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE i.indrelid = to_regclass($1)
+		  AND am.amname = 'btree'
+		  AND NOT 0 = ANY(i.indkey::int2[])
+		  AND i.indpred IS NULL
+		ORDER BY ic.relname
+	`, destIdent(t))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the indexes of %s: %w", t.qualifiedDestName(), err)
+	}
+	var out []IndexBloat
+	var ib IndexBloat
+	var tuples float64
+	var width *float64
+	_, err = pgx.ForEachRow(rows, []any{&ib.Name, &ib.Bytes, &tuples, &width}, func() error {
+		if width == nil || tuples < 0 {
+			return nil
+		}
+		// The metapage and the root page come with every index
+		pages := math.Ceil(tuples*(*width+btreeTupleBytes)/(pageBytes*btreeFillFactor)) + 2
+		ib.EstimatedBytes = int64(pages) * pageBytes
+		out = append(out, ib)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the indexes of %s: %w", t.qualifiedDestName(), err)
+	}
+	return out, nil
+}
+
+// printBloat prints the advice of the bloat check.
+func printBloat(reports []BloatReport) {
+	var advised, vacuumed int
+	for _, br := range reports {
+		if br.Vacuumed {
+			vacuumed++
+		}
+		if len(br.Advice) == 0 {
+			continue
+		}
+		advised++
+		fmt.Printf("  %s: %d dead tuples (%.0f%%), %s", br.Table, br.DeadTuples, 100*br.DeadRatio, formatBytes(br.TableBytes))
+		if slices.Contains(br.Advice, adviceVacuumFull) {
+			fmt.Print("; VACUUM FULL candidate")
+		}
+		if len(br.Reindex) > 0 {
+			fmt.Printf("; REINDEX candidates: %s", strings.Join(br.Reindex, ", "))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Checked the bloat of %d synced table(s): %d with advice, %d vacuumed.\n", len(reports), advised, vacuumed)
+}
@@ -0,0 +1,149 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CascadeObject is a destination object that DROP TABLE ... CASCADE of a
+// recreated table removes along with it.
+type CascadeObject struct {
+	// Object describes it as pg_describe_object does, e.g. "view
+	// reporting.active_users"
+	Object string `json:"object"`
+	// Kind is its pg_identify_object type, or "foreign key"
+	Kind string `json:"kind"`
+	// Relation is the table or view it belongs to, as schema.name; empty
+	// for objects outside any relation, like functions
+	Relation string `json:"relation,omitempty"`
+	// DependsOn is the object its removal follows from
+	DependsOn string `json:"depends_on"`
+}
+
+// cascadeDependents returns what dropping tables with CASCADE would remove
+// on the destination besides the tables themselves: the objects depending on
+// them or their row types, and, since a dropped view takes its dependents
+// too, the objects depending on those views. Tables missing on the
+// destination have none.
+func cascadeDependents(ctx context.Context, dest Querier, tables []Table) ([]CascadeObject, error) {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = destIdent(t)
+	}
+	rows, err := dest.Query(ctx, `
+		WITH RECURSIVE dropped AS (
+			SELECT c.oid, c.reltype
+			FROM unnest($1::text[]) AS name
+			JOIN pg_class c ON c.oid = to_regclass(name)
+		), deps AS (
+			SELECT d.classid, d.objid, d.objsubid, d.refclassid, d.refobjid
+			FROM pg_depend d
+			WHERE d.deptype = 'n'
+			  AND ((d.refclassid = 'pg_class'::regclass AND d.refobjid IN (SELECT oid FROM dropped))
+			    OR (d.refclassid = 'pg_type'::regclass AND d.refobjid IN (SELECT reltype FROM dropped)))
+			UNION
+			SELECT d.classid, d.objid, d.objsubid, d.refclassid, d.refobjid
+			FROM deps
+			JOIN pg_rewrite r ON deps.classid = 'pg_rewrite'::regclass AND r.oid = deps.objid AND r.rulename = '_RETURN'
+			JOIN pg_depend d ON d.refclassid = 'pg_class'::regclass AND d.refobjid = r.ev_class AND d.deptype = 'n'
+		)
+		SELECT DISTINCT
+			CASE WHEN r.rulename = '_RETURN' THEN pg_describe_object('pg_class'::regclass, r.ev_class, 0)
+			     ELSE pg_describe_object(deps.classid, deps.objid, deps.objsubid) END,
+			CASE WHEN con.contype = 'f' THEN 'foreign key'
+			     WHEN r.rulename = '_RETURN' THEN (pg_identify_object('pg_class'::regclass, r.ev_class, 0)).type
+			     ELSE (pg_identify_object(deps.classid, deps.objid, deps.objsubid)).type END,
+			COALESCE(n.nspname || '.' || owner.relname, ''),
+			pg_describe_object(deps.refclassid, deps.refobjid, 0)
+		FROM deps
+		LEFT JOIN pg_rewrite r ON deps.classid = 'pg_rewrite'::regclass AND r.oid = deps.objid
+		LEFT JOIN pg_constraint con ON deps.classid = 'pg_constraint'::regclass AND con.oid = deps.objid
+		LEFT JOIN pg_attrdef ad ON deps.classid = 'pg_attrdef'::regclass AND ad.oid = deps.objid
+		LEFT JOIN pg_trigger tg ON deps.classid = 'pg_trigger'::regclass AND tg.oid = deps.objid
+		LEFT JOIN pg_policy pol ON deps.classid = 'pg_policy'::regclass AND pol.oid = deps.objid
+		LEFT JOIN pg_class owner ON owner.oid = COALESCE(r.ev_class, NULLIF(con.conrelid, 0), ad.adrelid, tg.tgrelid, pol.polrelid,
+			CASE WHEN deps.classid = 'pg_class'::regclass THEN deps.objid END)
+		LEFT JOIN pg_namespace n ON n.oid = owner.relnamespace
+		WHERE owner.oid IS NULL OR owner.oid NOT IN (SELECT oid FROM dropped)
+		ORDER BY 1, 4
+	`, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the dependents of the dropped tables: %w", err)
+	}
+	out, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (CascadeObject, error) {
+		var o CascadeObject
+		err := row.Scan(&o.Object, &o.Kind, &o.Relation, &o.DependsOn)
+		return o, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the dependents of the dropped tables: %w", err)
+	}
+	return out, nil
+}
+
+// foreignCascades returns the objects of dependents the run does not bring
+// back: foreign keys on the run's tables are created again by the
+// constraints phase, and with --only those on other tables are restored
+// after detaching. Materialized views the run recreates are left out too.
+func foreignCascades(dependents []CascadeObject, state *MigrationState, opts Options) []CascadeObject {
+	run := make(map[string]bool, len(state.Tables))
+	for _, t := range state.Tables {
+		run[t.qualifiedDestName()] = true
+	}
+	matviews := make(map[string]bool, len(state.matViews))
+	for _, mv := range state.matViews {
+		matviews[mv.Schema+"."+mv.Name] = true
+	}
+	var out []CascadeObject
+	for _, o := range dependents {
+		if o.Kind == "foreign key" && (run[o.Relation] || len(opts.Only) > 0) {
+			continue
+		}
+		if o.Kind == "materialized view" && matviews[o.Relation] {
+			continue
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// checkCascadeDrops lists the destination objects outside the migration that
+// dropping the recreated tables would remove, and stops the run unless
+// --allow-cascade-drops is given.
+func checkCascadeDrops(ctx context.Context, dest Querier, state *MigrationState, keep map[string]bool, opts Options) error {
+	var dropped []Table
+	for _, t := range state.Tables {
+		if !keep[t.Name] {
+			dropped = append(dropped, t)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	dependents, err := cascadeDependents(ctx, dest, dropped)
+	if err != nil {
+		return err
+	}
+	foreign := foreignCascades(dependents, state, opts)
+	if len(foreign) == 0 {
+		return nil
+	}
+
+	report := state.Report
+	report.CascadePreview = foreign
+	fmt.Printf("  Dropping the recreated tables would also drop %d object(s) outside the migration:\n", len(foreign))
+	for i, o := range foreign {
+		if opts.PlanLimit > 0 && i == opts.PlanLimit {
+			fmt.Printf("    ... and %d more (listed under cascade_preview in the report)\n", len(foreign)-i)
+			break
+		}
+		fmt.Printf("    %s (depends on %s)\n", o.Object, o.DependsOn)
+	}
+	if !opts.AllowCascadeDrops {
+		return fmt.Errorf("dropping the recreated tables would also drop %d object(s) outside the migration; remove them first or pass --allow-cascade-drops", len(foreign))
+	}
+	report.warn(warnCascadeDrop, "dropping the recreated tables also drops %d object(s) outside the migration (allowed by --allow-cascade-drops)", len(foreign))
+	return nil
+}
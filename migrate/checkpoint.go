@@ -0,0 +1,302 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCheckpointPath = ".farewall-state.json"
+
+// Checkpoint records per-table progress so an interrupted run can be resumed
+// with --resume without redoing (or re-dropping) tables that already finished.
+type Checkpoint struct {
+	// Format is checkpointFormat; see formats.go
+	Format int                         `json:"format"`
+	RunID  string                      `json:"run_id"`
+	Tables map[string]*TableCheckpoint `json:"tables"`
+	// Schemas are the source schemas of the run, which decide the keys of
+	// Tables (see sourceTableKey)
+	Schemas []string `json:"schemas,omitempty"`
+	// SchemaHash is the sha256 of the source tables as first introspected
+	// (see schemaHash); a resume refuses to continue when it changed
+	SchemaHash string `json:"schema_hash,omitempty"`
+	// Watermarks are the last updated-at values of tables copied with
+	// --incremental, kept from one run to the next
+	Watermarks map[string]*Watermark `json:"watermarks,omitempty"`
+	// TempObjects lists temporary objects (schema.name) of the run that
+	// have not been dropped yet; see the cleanup subcommand.
+	TempObjects []string `json:"temp_objects,omitempty"`
+
+	path string
+	// mu serializes saves, and range updates, of parallel split_by copies
+	mu sync.Mutex
+}
+
+type TableCheckpoint struct {
+	RowsCopied  int64     `json:"rows_copied"`
+	BytesCopied int64     `json:"bytes_copied"`
+	Completed   bool      `json:"completed"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// SequencesSynced is set once the SERIAL sequences of the table were
+	// set to the copied maximum; checkpoints of older versions lack it
+	SequencesSynced bool `json:"sequences_synced,omitempty"`
+
+	Split *SplitCheckpoint `json:"split,omitempty"`
+	// Keyset is set for a table copied in chunks by its key (see
+	// copyTableKeyset)
+	Keyset *KeysetCheckpoint `json:"keyset,omitempty"`
+}
+
+// SplitCheckpoint records the ranges of a table copied with split_by, so a
+// resumed run reuses the same boundaries and only redoes unfinished ranges.
+type SplitCheckpoint struct {
+	Column   string             `json:"column"`
+	Interval string             `json:"interval"`
+	Chunks   int                `json:"chunks,omitempty"`
+	Slices   int                `json:"slices,omitempty"`
+	Ranges   []*RangeCheckpoint `json:"ranges"`
+}
+
+// RangeCheckpoint is one range of a split table. A nil bound is open; Null
+// selects the rows whose split column is NULL, and Hash one hash chunk of a
+// table split into chunks.
+type RangeCheckpoint struct {
+	Lo          *string    `json:"lo"`
+	Hi          *string    `json:"hi"`
+	Null        bool       `json:"null,omitempty"`
+	Hash        *HashChunk `json:"hash,omitempty"`
+	RowsCopied  int64      `json:"rows_copied"`
+	BytesCopied int64      `json:"bytes_copied"`
+	Completed   bool       `json:"completed"`
+}
+
+// HashChunk selects the rows whose split column hashes to Chunk modulo Of.
+type HashChunk struct {
+	Chunk int `json:"chunk"`
+	Of    int `json:"of"`
+}
+
+func newCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{Format: checkpointFormat, Tables: map[string]*TableCheckpoint{}, path: path}
+}
+
+// loadCheckpoint reads the checkpoint at path. A missing file yields an empty
+// checkpoint so --resume on a first run simply behaves like a fresh run; one
+// of an older format is migrated, one of a newer format refused.
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	cp := newCheckpoint(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+	format, err := fileFormat(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w; remove it to start fresh", path, err)
+	}
+	if format > checkpointFormat {
+		return nil, &FormatError{Kind: "checkpoint", Path: path, Format: format, Max: checkpointFormat,
+			Advice: "finish the run with the version that wrote it, or remove the file to start fresh"}
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w; remove it to start fresh", path, err)
+	}
+	if cp.Tables == nil {
+		cp.Tables = map[string]*TableCheckpoint{}
+	}
+	migrateCheckpoint(cp, format)
+	return cp, nil
+}
+
+// checkSchemas fails when the checkpoint has progress recorded for other
+// source schemas than schemas, since its tables would then be matched
+// against the wrong ones, and records schemas otherwise.
+func (c *Checkpoint) checkSchemas(schemas []string) error {
+	if len(c.Tables) > 0 && len(c.Schemas) > 0 && !sameSchemas(c.Schemas, schemas) {
+		return fmt.Errorf("checkpoint %s was written for --schemas %s; resume with those schemas, or remove the file to start fresh",
+			c.path, strings.Join(c.Schemas, ","))
+	}
+	c.Schemas = schemas
+	return nil
+}
+
+// checkSchemaHash fails when the checkpoint has progress recorded for a
+// source schema other than the one hashed to hash, since the recorded
+// tables, ranges and chunks may no longer fit it, and records hash otherwise.
+// A checkpoint of an older version, without a hash, takes the current one.
+func (c *Checkpoint) checkSchemaHash(hash string) error {
+	if len(c.Tables) > 0 && c.SchemaHash != "" && c.SchemaHash != hash {
+		return fmt.Errorf("the source schema changed since checkpoint %s was written (schema hash %s, now %s); remove the file to start fresh",
+			c.path, shortHash(c.SchemaHash), shortHash(hash))
+	}
+	c.SchemaHash = hash
+	return nil
+}
+
+// schemaHash hashes the tables, columns and keys of the source as
+// introspected, before the run's options rename or narrow them.
+func schemaHash(tables []Table) (string, error) {
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash the source schema: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func shortHash(hash string) string {
+	return hash[:min(len(hash), 12)]
+}
+
+func sameSchemas(a, b []string) bool {
+	return slices.Equal(slices.Sorted(slices.Values(a)), slices.Sorted(slices.Values(b)))
+}
+
+func (c *Checkpoint) table(name string) *TableCheckpoint {
+	tc, ok := c.Tables[name]
+	if !ok {
+		tc = &TableCheckpoint{}
+		c.Tables[name] = tc
+	}
+	return tc
+}
+
+func (c *Checkpoint) completed(name string) bool {
+	tc, ok := c.Tables[name]
+	return ok && tc.Completed
+}
+
+// partial reports whether some ranges of a split table, or chunks of one
+// copied by key, were copied by an earlier run, in which case the table must
+// be kept rather than recreated.
+func (c *Checkpoint) partial(name string) bool {
+	tc, ok := c.Tables[name]
+	if !ok || tc.Completed {
+		return false
+	}
+	if tc.Keyset != nil && tc.Keyset.Chunks > 0 {
+		return true
+	}
+	if tc.Split == nil {
+		return false
+	}
+	for _, r := range tc.Split.Ranges {
+		if r.Completed {
+			return true
+		}
+	}
+	return false
+}
+
+// splitProgress sums the rows and bytes of the completed ranges of a split
+// table, or of the chunks of one copied by key.
+func (c *Checkpoint) splitProgress(name string) RangeCheckpoint {
+	var sum RangeCheckpoint
+	if tc, ok := c.Tables[name]; ok && !tc.Completed && tc.Keyset != nil {
+		sum.RowsCopied, sum.BytesCopied = tc.Keyset.RowsCopied, tc.Keyset.BytesCopied
+	}
+	if tc, ok := c.Tables[name]; ok && tc.Split != nil {
+		for _, r := range tc.Split.Ranges {
+			if r.Completed {
+				sum.RowsCopied += r.RowsCopied
+				sum.BytesCopied += r.BytesCopied
+			}
+		}
+	}
+	return sum
+}
+
+// reset forgets all progress of a table, e.g. because it is about to be
+// dropped.
+func (c *Checkpoint) reset(name string) {
+	if tc, ok := c.Tables[name]; ok {
+		tc.Completed = false
+		tc.SequencesSynced = false
+		tc.Split = nil
+		tc.Keyset = nil
+	}
+}
+
+func (c *Checkpoint) markRange(r *RangeCheckpoint, rows, bytes int64) error {
+	c.mu.Lock()
+	r.RowsCopied = rows
+	r.BytesCopied = bytes
+	r.Completed = true
+	c.mu.Unlock()
+	return c.save()
+}
+
+// markChunk records a chunk of a table copied by key, up to and including
+// last; nil, for the last chunk, leaves the table to be completed by the
+// caller.
+func (c *Checkpoint) markChunk(ks *KeysetCheckpoint, last *string, rows, bytes int64) error {
+	c.mu.Lock()
+	if last != nil {
+		ks.LastKey = last
+	}
+	ks.Chunks++
+	ks.RowsCopied += rows
+	ks.BytesCopied += bytes
+	c.mu.Unlock()
+	return c.save()
+}
+
+// markCompleted records a table as copied. Callers set its sequences first
+// (see resetSequences), so they count as synced with it.
+func (c *Checkpoint) markCompleted(name string, rows, bytes int64) error {
+	tc := c.table(name)
+	tc.RowsCopied = rows
+	tc.BytesCopied = bytes
+	tc.Completed = true
+	tc.SequencesSynced = true
+	tc.UpdatedAt = utcNow()
+	return c.save()
+}
+
+// markSequencesSynced records that the sequences of a table completed
+// earlier were set.
+func (c *Checkpoint) markSequencesSynced(name string) error {
+	tc := c.table(name)
+	tc.SequencesSynced = true
+	tc.UpdatedAt = utcNow()
+	return c.save()
+}
+
+// save writes the checkpoint atomically (temp file + rename) so a crash while
+// saving never leaves a truncated file behind.
+func (c *Checkpoint) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// checkConstraint is a CHECK constraint of a source table, created with the
+// table by tableDDL.
+type checkConstraint struct {
+	Name string
+	// Definition is pg_get_constraintdef, e.g. CHECK ((price > 0))
+	Definition string
+	// Columns are the columns the expression refers to
+	Columns []string
+	// Inherited checks come from a parent, which declares them
+	Inherited bool
+	// Validated is false for checks added NOT VALID, which existing rows
+	// may violate
+	Validated bool
+}
+
+// referencesXataInternals reports whether expr calls or casts to objects of
+// Xata's private schemas, which do not exist on the destination.
+func referencesXataInternals(expr string) bool {
+	return strings.Contains(expr, "xata_private") || strings.Contains(expr, "::xata_")
+}
+
+// introspectChecks adds the CHECK constraints of the source schemas of
+// tables to them. NOT NULL is part of the column definition and not read
+// here.
+func introspectChecks(ctx context.Context, conn Querier, tables []Table) error {
+	rows, err := conn.Query(ctx, `
+		SELECT `+sourceKeySQL+`, con.conname, pg_get_constraintdef(con.oid),
+			ARRAY(
+				SELECT a.attname::text
+				FROM pg_attribute a
+				WHERE a.attrelid = con.conrelid AND a.attnum = ANY(con.conkey) AND NOT a.attisdropped
+				ORDER BY a.attnum
+			),
+			NOT con.conislocal, con.convalidated
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'c'
+		  AND n.nspname = ANY($1)
+		ORDER BY c.relname, con.conname
+	`, tableSchemas(tables))
+	if err != nil {
+		return fmt.Errorf("failed to get check constraints: %w", err)
+	}
+	defer rows.Close()
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+	for rows.Next() {
+		var table string
+		var ck checkConstraint
+		if err := rows.Scan(&table, &ck.Name, &ck.Definition, &ck.Columns, &ck.Inherited, &ck.Validated); err != nil {
+			return err
+		}
+		if t, ok := byName[table]; ok {
+			t.Checks = append(t.Checks, ck)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get check constraints: %w", err)
+	}
+	return nil
+}
+
+// checkSkipReason returns why ck cannot be created on the destination table
+// t, or "" when it can. Like an index definition, the expression names
+// source columns.
+func checkSkipReason(t Table, ck checkConstraint) string {
+	if !ck.Validated {
+		return "it is NOT VALID on the source, so copied rows may violate it"
+	}
+	if missing := missingColumns(t, ck.Columns); len(missing) > 0 {
+		return fmt.Sprintf("column(s) %s are not copied", strings.Join(missing, ", "))
+	}
+	for _, name := range ck.Columns {
+		switch c, _ := t.column(name); {
+		case c.Encrypt != "":
+			return fmt.Sprintf("column %s is encrypted", name)
+		case c.SourceExpr != "":
+			return fmt.Sprintf("column %s is converted", name)
+		case c.UUIDKey != nil:
+			return fmt.Sprintf("column %s is converted to uuid", name)
+		}
+	}
+	if dest := t.destColumns(ck.Columns); !slices.Equal(dest, ck.Columns) {
+		return "it uses renamed columns"
+	}
+	return ""
+}
+
+// applyChecks leaves out the check constraints that cannot be created on the
+// destination, with a warning for each. A check referring to Xata internals
+// fails the run unless skipXata, so it is not lost unnoticed.
+func applyChecks(tables []Table, skipXata bool, report *Report) error {
+	for i := range tables {
+		t := &tables[i]
+		var checks []checkConstraint
+		for _, ck := range t.Checks {
+			reason := checkSkipReason(*t, ck)
+			if referencesXataInternals(ck.Definition) {
+				if !skipXata {
+					return fmt.Errorf("check constraint %s on %s refers to Xata internals (%s); use --skip-xata-checks to leave such checks out", ck.Name, t.Name, ck.Definition)
+				}
+				reason = "it refers to Xata internals"
+			}
+			if reason != "" {
+				// The parent's warning covers its children
+				if !ck.Inherited {
+					report.warnTable(warnCheckSkipped, t.Name, "check constraint %s on %s was not created: %s", ck.Name, t.Name, reason)
+				}
+				continue
+			}
+			checks = append(checks, ck)
+		}
+		t.Checks = checks
+	}
+	return nil
+}
@@ -0,0 +1,1395 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/joho/godotenv"
+	"github.com/schollz/progressbar/v3"
+
+	"migration-tool/internal/sqlutil"
+)
+
+type Options struct {
+	Resume         bool
+	CheckpointPath string
+	ReportPath     string
+	CopyMethod     string
+	ConfigPath     string
+	// EncryptionKey encrypts the columns the config encrypts; it is read
+	// from encryptionKeyVar
+	EncryptionKey string
+
+	SchemaSnapshotPath string
+	FlattenInheritance bool
+	FlattenDomains     bool
+	SkipExtensions     bool
+	KeepXataMetadata   bool
+	SkipXataChecks     bool
+	FoldIdentifiers    bool
+	CollisionSuffix    bool
+	Freeze             bool
+	VerifyChunks       bool
+	// ChunkMismatchRetries caps the copies of a range after a mismatch
+	ChunkMismatchRetries int
+	OrderedCopy          bool
+	Differential         bool
+	DeleteExtraneous     bool
+	DataOnly             bool
+	Upsert               bool
+	// DestSchemaFile creates the destination tables of --data-only from
+	// this SQL file when none of them exists yet
+	DestSchemaFile string
+
+	AllowEncodingMismatch bool
+	AllowExistingObjects  bool
+	AllowCascadeDrops     bool
+	LockSourceSchema      bool
+	SourceLockTimeout     time.Duration
+	// ConsistentSnapshot reads every table, and every range of a split or
+	// sliced one, in one exported snapshot of the source
+	ConsistentSnapshot  bool
+	DisableDestTriggers bool
+	RefreshMatViews     bool
+	IncludeFunctions    bool
+	IncludeTriggers     bool
+	// SkipRLS leaves row-level security and policies out
+	SkipRLS       bool
+	IncludeGrants bool
+	// IncludeOwnership gives the tables the owners of the source tables
+	IncludeOwnership   bool
+	PartitionOutliers  string
+	OnFKViolation      string
+	OnMissingRef       string
+	OnFailure          string
+	RetryWarnThreshold int
+	SourceEndpoint     string
+	// SourceConnectionLimit caps the source connections of the run (0 for
+	// no limit; see sourceLimiter)
+	SourceConnectionLimit int
+	MaxReadBytes          int64
+	MaxWALRate            int64
+	// DestPooler is auto, none or pgbouncer; DestBypassPort reaches the
+	// destination server past the pooler (see connectDestination)
+	DestPooler     string
+	DestBypassPort int
+	// CursorRowWidth reads tables with wider average rows through a
+	// cursor, CursorFetchSize rows at a time
+	CursorRowWidth  int64
+	CursorFetchSize int
+	// FetchTarget adapts the rows per FETCH of cursor reads toward this wall
+	// time per batch, within FetchMinRows and FetchMaxRows (see fetchSizer)
+	FetchTarget  time.Duration
+	FetchMinRows int
+	FetchMaxRows int
+	// ChunkSize is the rows per chunk of large tables copied by key (see
+	// copyTableKeyset), 0 to copy every table with one query
+	ChunkSize int
+	// Workers is the number of key slices of a large table copied at once
+	// (see sliceSplit)
+	Workers int
+	// Debug logs the decisions of the copy in detail (see debugf)
+	Debug bool
+	// TUI shows the copy in a terminal UI (see tuiReporter)
+	TUI bool
+	// StatusAddr is where the metrics are served (see statusServer)
+	StatusAddr string
+	DryRun     bool
+	// DDLOut records the schema statements of a dry run to this file
+	DDLOut string
+	// Retries reruns a failed run this many times, resuming from the
+	// checkpoint after RetryBackoff (doubled per attempt)
+	Retries      int
+	RetryBackoff time.Duration
+	// MaxRetries retries the copy of a table, or its current key chunk,
+	// this many times after a transient failure
+	MaxRetries int
+	// JournalPath is the run's journal, {run_id} replaced; empty for none
+	JournalPath string
+	// SkipBloatCheck leaves out the bloat advice for synced tables, and
+	// VacuumAfterSync runs VACUUM ANALYZE on those with dead tuples
+	SkipBloatCheck  bool
+	VacuumAfterSync bool
+	// Mode is recreate, dropping and creating every table, or sync,
+	// upserting into the tables that already exist on the destination
+	Mode string
+	// Incremental reads only the rows changed since the last run, by
+	// IncrementalColumn or a default updated-at column
+	Incremental       bool
+	IncrementalColumn string
+
+	// Only restricts the run to these tables
+	Only stringList
+	// Exclude leaves these tables out of the run
+	Exclude stringList
+	// RoleMap renames source roles for --include-grants, as old=new
+	RoleMap stringList
+	// TablePrefixes restricts the run to tables whose names start with one
+	// of them, before anything else is read about the tables
+	TablePrefixes stringList
+	// Schemas are the source schemas read, public when empty
+	Schemas schemaList
+	// SchemaMap creates the tables of a source schema in another schema of
+	// the destination; schema_routes still take precedence
+	SchemaMap schemaMap
+	// PlanLimit caps the tables listed by the plan output (0 for all)
+	PlanLimit int
+
+	Config *Config
+
+	// Reporter, when set, follows the copy table by table (see
+	// ProgressReporter)
+	Reporter ProgressReporter
+	// tui and status are the --tui and the --status-addr server of the
+	// command line, which the runs of a config file share
+	tui    *tuiReporter
+	status *statusServer
+}
+
+// Main runs the migration-tool command line: a subcommand named by the first
+// argument, or else a migration configured by the flags.
+func Main() {
+	setupLogging()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "verify-schema":
+			os.Exit(runVerifySchema(os.Args[2:]))
+		case "cleanup":
+			os.Exit(runCleanup(os.Args[2:]))
+		case "drift":
+			os.Exit(runDrift(os.Args[2:]))
+		case "fix-sequences":
+			os.Exit(runFixSequences(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "journal":
+			os.Exit(runJournal(os.Args[2:]))
+		}
+	}
+
+	var opts Options
+	var env envSettings
+	var migrationName string
+	var failFast bool
+	env.register(flag.CommandLine)
+	opts.register(flag.CommandLine)
+	flag.StringVar(&migrationName, "migration", "", "Run only this migration of a config file that declares several")
+	flag.BoolVar(&failFast, "fail-fast", false, "Stop after the first failed migration of a config file that declares several")
+	flag.Parse()
+
+	cfg, err := loadConfig(opts.ConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Config = cfg
+
+	ctx := context.Background()
+	if len(cfg.Migrations) > 0 {
+		var tui *tuiReporter
+		if opts.TUI {
+			tui = startTUI()
+		}
+		status := mustStartStatus(opts.StatusAddr)
+		opts.tui, opts.status = tui, status
+		code := runMigrations(ctx, opts, env, migrationName, failFast)
+		status.stop()
+		tui.stop()
+		os.Exit(code)
+	}
+	if migrationName != "" {
+		log.Fatal("--migration requires a config file that declares migrations")
+	}
+
+	if err := opts.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var tui *tuiReporter
+	if opts.TUI {
+		tui = startTUI()
+	}
+	status := mustStartStatus(opts.StatusAddr)
+	opts.tui, opts.status = tui, status
+	report, err := runMigration(ctx, opts, &env)
+	status.stop()
+	tui.stop()
+	if opts.ReportPath != "" {
+		if werr := report.write(opts.ReportPath); werr != nil {
+			log.Printf("Warning: %v", werr)
+		}
+	}
+	if err != nil {
+		log.Printf("Migration failed: %v", err)
+		os.Exit(exitCode(err))
+	}
+
+	if opts.DryRun {
+		fmt.Println("Dry run finished; nothing was written to the destination.")
+		return
+	}
+	if len(opts.Only) > 0 {
+		fmt.Printf("Partial migration of %s completed successfully; other tables were not touched.\n", strings.Join(opts.Only, ", "))
+		return
+	}
+	fmt.Println("Migration completed successfully!")
+}
+
+// register defines the flags of a migration on fs, with their defaults.
+func (opts *Options) register(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.Resume, "resume", false, "Resume a previous run, skipping tables recorded as completed in the checkpoint")
+	fs.StringVar(&opts.CheckpointPath, "checkpoint", defaultCheckpointPath, "Path of the checkpoint file")
+	fs.StringVar(&opts.ReportPath, "report", "", "Write a JSON report to this path")
+	fs.StringVar(&opts.CopyMethod, "copy-method", copyMethodAuto, "Data copy method: auto, rows or csv")
+	fs.StringVar(&opts.ConfigPath, "config", "", "Path of a JSON config file with per-table and per-column options")
+	fs.BoolVar(&opts.FlattenInheritance, "flatten-inheritance", false, "Create tables that use INHERITS as independent tables")
+	fs.BoolVar(&opts.SkipExtensions, "skip-extensions", false, "Do not create the source's extensions on the destination, only list them")
+	fs.BoolVar(&opts.FlattenDomains, "flatten-domains", false, "Create columns of domain types with the domain's base type, default and NOT NULL instead of creating the domains (their checks are lost)")
+	fs.BoolVar(&opts.Differential, "differential", false, "Copy only new or changed rows of tables with a primary key, using row hashes stored on the destination")
+	fs.BoolVar(&opts.DeleteExtraneous, "delete-extraneous", false, "With --differential, delete destination rows whose primary key vanished from the source")
+	fs.BoolVar(&opts.Incremental, "incremental", false, "Copy only the rows whose updated-at column is at or past the watermark of the last run, upserting them; tables without the column are copied in full")
+	fs.StringVar(&opts.IncrementalColumn, "incremental-column", "", "With --incremental, the updated-at column (default xata.updatedat, xata_updatedat or updated_at, whichever a table has)")
+	fs.BoolVar(&opts.DataOnly, "data-only", false, "Copy data into the existing destination tables instead of recreating them")
+	fs.StringVar(&opts.DestSchemaFile, "dest-schema-file", "", "With --data-only, run this SQL file on the destination to create its tables when none of them exists yet, then map the source onto them")
+	fs.BoolVar(&opts.Upsert, "upsert", false, "With --data-only, merge rows into the existing tables with INSERT ... ON CONFLICT instead of truncating them")
+	fs.BoolVar(&opts.AllowEncodingMismatch, "allow-encoding-mismatch", false, "Proceed even when the destination encoding cannot represent all source data")
+	fs.StringVar(&opts.OnFKViolation, "on-fk-violation", fkViolationFail, "What to do when rows violate a foreign key about to be created: fail, skip-constraint, not-valid or delete-orphans")
+	fs.StringVar(&opts.OnMissingRef, "on-missing-ref", missingRefSkip, "What to do with foreign keys referencing a table outside the run: skip, not-valid or fail")
+	fs.BoolVar(&opts.AllowExistingObjects, "allow-existing-objects", false, "Proceed even when the destination has tables that are not part of the migration")
+	fs.BoolVar(&opts.AllowCascadeDrops, "allow-cascade-drops", false, "Proceed even when dropping the recreated tables would also drop destination objects outside the migration, such as views")
+	fs.BoolVar(&opts.LockSourceSchema, "lock-source-schema", false, "Hold ACCESS SHARE locks on the source tables and a shared advisory lock for the whole run, so schema changes wait until it is done")
+	fs.DurationVar(&opts.SourceLockTimeout, "source-lock-timeout", 10*time.Second, "With --lock-source-schema, how long to wait for the locks before listing the blocking sessions and stopping")
+	fs.BoolVar(&opts.ConsistentSnapshot, "consistent-snapshot", false, "Read all tables, and the ranges of split and parallel copies, in one snapshot exported from the source, recording its ID in the report")
+	fs.BoolVar(&opts.DisableDestTriggers, "disable-dest-triggers", false, "Disable user triggers and rules of kept destination tables during the copy and re-enable them afterwards, even if it fails")
+	fs.StringVar(&opts.OnFailure, "on-failure", onFailureCleanup, "When creating the tables fails: cleanup (roll back, leaving the destination tables as they were) or keep (leave the tables created so far)")
+	fs.StringVar(&opts.PartitionOutliers, "partition-outliers", partitionOutliersReport, "Source rows outside the partitions declared with partition_by: report (fail before copying) or default (route them to a default partition)")
+	fs.IntVar(&opts.Retries, "retries", 0, "Attempt a failed run this many more times, resuming from the checkpoint so completed tables are skipped")
+	fs.DurationVar(&opts.RetryBackoff, "retry-backoff", 30*time.Second, "With --retries, the wait before the first retry; it doubles for every further one")
+	fs.StringVar(&opts.JournalPath, "journal", defaultJournalPath, "Append the run's events as JSON lines to this file, {run_id} replaced by the run ID (empty for none); see the journal subcommand")
+	fs.IntVar(&opts.MaxRetries, "max-retries", 3, "Retry the copy of a table (or its current key chunk) this many times after a transient failure such as a lost connection, reconnecting first")
+	fs.IntVar(&opts.RetryWarnThreshold, "retry-warn-threshold", 3, "Warn when a table needed more retries than this, even if it succeeded")
+	fs.StringVar(&opts.SourceEndpoint, "source-endpoint", sourceEndpointAuto, "Where table data is read from: auto (replica if "+replicaURLVar+" is set, falling back to the primary), replica or primary")
+	fs.IntVar(&opts.SourceConnectionLimit, "source-connection-limit", defaultSourceConnectionLimit, "Open at most this many connections to the source; parallel split_by workers wait for a free one (0 for no limit)")
+	fs.StringVar(&opts.DestPooler, "dest-pooler", destPoolerAuto, "Pooler in front of the destination: auto (detect transaction pooling), none or pgbouncer")
+	fs.IntVar(&opts.DestBypassPort, "dest-bypass-port", 0, "Port of the destination server past the pooler, for COPY and the destination lock (0 for none: batched INSERTs through the pooler)")
+	fs.Int64Var(&opts.MaxReadBytes, "max-read-bytes", 0, "Stop at the next table boundary once this many bytes were read from the source (0 for no limit)")
+	fs.Int64Var(&opts.MaxWALRate, "max-wal-rate", 0, "Throttle the copy while the destination generates more than this many bytes of WAL per second (0 for no limit)")
+	fs.Int64Var(&opts.CursorRowWidth, "cursor-row-width", 0, "Read tables whose average row is wider than this many bytes through a server-side cursor (0 to always use a single SELECT)")
+	fs.IntVar(&opts.CursorFetchSize, "cursor-fetch-size", 1000, "Rows per FETCH for tables read through a cursor")
+	fs.DurationVar(&opts.FetchTarget, "fetch-target", 0, "Adapt the rows per FETCH of cursor reads toward this wall time per batch, e.g. 10s (0 keeps them fixed)")
+	fs.IntVar(&opts.FetchMinRows, "fetch-min-rows", defaultFetchMinRows, "With --fetch-target, the fewest rows per FETCH")
+	fs.IntVar(&opts.FetchMaxRows, "fetch-max-rows", defaultFetchMaxRows, "With --fetch-target, the most rows per FETCH")
+	fs.IntVar(&opts.ChunkSize, "chunk-size", defaultChunkSize, "Copy tables with more rows than this and a single integer or uuid primary key in chunks of this many rows, each with its own query and COPY (0 to copy every table with one query)")
+	fs.IntVar(&opts.Workers, "workers", 1, "Copy tables with more than --chunk-size rows and a single integer or uuid primary key in this many key slices at once, each on its own connections")
+	fs.BoolVar(&opts.Debug, "debug", false, "Log the decisions of the copy in detail, such as every adapted fetch size")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Print the plan and source read estimates, then stop before writing anything")
+	fs.StringVar(&opts.DDLOut, "ddl-out", "", "With --dry-run, write every statement the schema, constraint and statistics phases would run to this file, in order")
+	fs.Var(&opts.Only, "only", "Migrate only this table, leaving all others untouched (repeatable)")
+	fs.Var(&opts.Exclude, "exclude", "Leave this table out of the run, as if the source lacked it (repeatable)")
+	opts.Schemas = schemaList{defaultSchema}
+	fs.Var(&opts.Schemas, "schemas", "Comma-separated source schemas to migrate; tables outside public are named schema.table in the config")
+	fs.Var(&opts.SchemaMap, "schema-map", "Create the tables of a source schema in another destination schema, as source=dest (repeatable)")
+	fs.Var(&opts.TablePrefixes, "table-prefix", "Migrate only tables whose names start with this prefix, e.g. one tenant's; other tables are not introspected (repeatable)")
+	fs.IntVar(&opts.PlanLimit, "plan-limit", 50, "List at most this many tables in the plan output, the largest first (0 for all); the report lists every table")
+	fs.StringVar(&opts.SchemaSnapshotPath, "schema-snapshot", defaultSchemaSnapshotPath, "Write the migrated schema to this file for verify-schema (empty to disable)")
+	fs.BoolVar(&opts.OrderedCopy, "ordered-copy", false, "Read every table in a stable order: its order_by from the config, or its primary key")
+	fs.BoolVar(&opts.KeepXataMetadata, "keep-xata-metadata", false, "Copy Xata metadata columns (e.g. the xata object column) as jsonb instead of leaving them out")
+	fs.BoolVar(&opts.SkipXataChecks, "skip-xata-checks", false, "Leave out check constraints that refer to Xata internals (e.g. xata_private functions) instead of failing, with a warning for each")
+	fs.BoolVar(&opts.FoldIdentifiers, "fold-identifiers", false, "Create destination tables, columns and foreign keys with lower-case names, as unquoted identifiers would be")
+	fs.BoolVar(&opts.CollisionSuffix, "collision-suffix", false, "Resolve destination name collisions by appending _2, _3, ... instead of failing")
+	fs.BoolVar(&opts.Freeze, "freeze", false, "Load each table in one transaction with TRUNCATE and COPY ... FREEZE, so its rows need no later freezing vacuum")
+	fs.BoolVar(&opts.VerifyChunks, "verify-chunks", false, "Read every split_by range back from the destination after it is copied and compare checksums, copying it again on a mismatch")
+	fs.IntVar(&opts.ChunkMismatchRetries, "chunk-mismatch-retries", 2, "With --verify-chunks, how often a range is copied again after a checksum mismatch before the run fails")
+	fs.BoolVar(&opts.RefreshMatViews, "refresh-matviews", false, "Populate the recreated materialized views with REFRESH MATERIALIZED VIEW after the copy (with --data-only, refresh the existing ones)")
+	fs.BoolVar(&opts.IncludeFunctions, "include-functions", false, "Create the functions and procedures of the source's public schema on the destination before the tables")
+	fs.BoolVar(&opts.IncludeTriggers, "include-triggers", false, "Create the source's user triggers on the migrated tables once the data is copied")
+	fs.StringVar(&opts.Mode, "mode", modeRecreate, "How existing destination tables are loaded: recreate (drop and create them) or sync (keep them and upsert on their primary key, creating only missing tables)")
+	fs.BoolVar(&opts.SkipBloatCheck, "skip-bloat-check", false, "Do not check the tables synced into existing destination tables for dead tuples and bloated indexes")
+	fs.BoolVar(&opts.VacuumAfterSync, "vacuum-after-sync", false, "Run VACUUM ANALYZE on the synced tables that have dead tuples after the bloat check")
+	fs.BoolVar(&opts.SkipRLS, "skip-rls", false, "Do not recreate the row-level security and policies of the source's tables")
+	fs.BoolVar(&opts.IncludeGrants, "include-grants", false, "Grant the source's roles their table privileges, and USAGE and SELECT on the sequences of SERIAL columns of the tables they can insert into")
+	fs.BoolVar(&opts.IncludeOwnership, "include-ownership", false, "With --include-grants, give every table the owner of its source table")
+	fs.Var(&opts.RoleMap, "role-map", "With --include-grants, grant to role new what the source grants to old, as old=new (repeatable)")
+	fs.BoolVar(&opts.TUI, "tui", false, "Show a live table of the copy with the log below, with keys to pause and to skip the current table (needs a terminal of at least 80x20)")
+	fs.StringVar(&opts.StatusAddr, "status-addr", "", "Serve Prometheus metrics of the run on this address, e.g. localhost:9187, at /metrics")
+}
+
+// validate rejects invalid flag values and combinations.
+func (opts Options) validate() error {
+	switch opts.CopyMethod {
+	case copyMethodAuto, copyMethodRows, copyMethodCSV:
+	default:
+		return fmt.Errorf("invalid --copy-method %q (expected auto, rows or csv)", opts.CopyMethod)
+	}
+
+	switch opts.SourceEndpoint {
+	case sourceEndpointAuto, sourceEndpointReplica, sourceEndpointPrimary:
+	default:
+		return fmt.Errorf("invalid --source-endpoint %q (expected auto, replica or primary)", opts.SourceEndpoint)
+	}
+
+	switch opts.DestPooler {
+	case destPoolerAuto, destPoolerNone, destPoolerPgBouncer:
+	default:
+		return fmt.Errorf("invalid --dest-pooler %q (expected auto, none or pgbouncer)", opts.DestPooler)
+	}
+	if opts.DestBypassPort < 0 || opts.DestBypassPort > 65535 {
+		return fmt.Errorf("--dest-bypass-port must be a port number")
+	}
+	if opts.DestBypassPort > 0 && opts.DestPooler == destPoolerNone {
+		return fmt.Errorf("--dest-bypass-port cannot be combined with --dest-pooler none")
+	}
+
+	switch opts.PartitionOutliers {
+	case partitionOutliersReport, partitionOutliersDefault:
+	default:
+		return fmt.Errorf("invalid --partition-outliers %q (expected report or default)", opts.PartitionOutliers)
+	}
+
+	switch opts.OnFailure {
+	case onFailureCleanup, onFailureKeep:
+	default:
+		return fmt.Errorf("invalid --on-failure %q (expected cleanup or keep)", opts.OnFailure)
+	}
+
+	switch opts.OnFKViolation {
+	case fkViolationFail, fkViolationSkip, fkViolationNotValid, fkViolationDeleteOrphans:
+	default:
+		return fmt.Errorf("invalid --on-fk-violation %q (expected fail, skip-constraint, not-valid or delete-orphans)", opts.OnFKViolation)
+	}
+
+	switch opts.OnMissingRef {
+	case missingRefSkip, missingRefNotValid, missingRefFail:
+	default:
+		return fmt.Errorf("invalid --on-missing-ref %q (expected skip, not-valid or fail)", opts.OnMissingRef)
+	}
+
+	switch opts.Mode {
+	case modeRecreate, modeSync:
+	default:
+		return fmt.Errorf("invalid --mode %q (expected recreate or sync)", opts.Mode)
+	}
+	if opts.Mode == modeSync && opts.DataOnly {
+		return fmt.Errorf("--mode sync cannot be combined with --data-only; use --data-only --upsert to upsert into existing tables only")
+	}
+
+	if opts.Incremental && opts.Differential {
+		return fmt.Errorf("--incremental cannot be combined with --differential")
+	}
+	if opts.IncrementalColumn != "" && !opts.Incremental {
+		return fmt.Errorf("--incremental-column requires --incremental")
+	}
+
+	if opts.DeleteExtraneous && !opts.Differential {
+		return fmt.Errorf("--delete-extraneous requires --differential")
+	}
+
+	if opts.Upsert && !opts.DataOnly {
+		return fmt.Errorf("--upsert requires --data-only")
+	}
+	if opts.DestSchemaFile != "" && !opts.DataOnly {
+		return fmt.Errorf("--dest-schema-file requires --data-only")
+	}
+	if opts.DestSchemaFile != "" && opts.DDLOut != "" {
+		return fmt.Errorf("--dest-schema-file cannot be combined with --ddl-out, which does not run it")
+	}
+
+	if opts.LockSourceSchema && opts.SourceLockTimeout <= 0 {
+		return fmt.Errorf("--source-lock-timeout must be positive")
+	}
+
+	if _, err := parseRoleMap(opts.RoleMap); err != nil {
+		return err
+	}
+	if len(opts.RoleMap) > 0 && !opts.IncludeGrants {
+		return fmt.Errorf("--role-map requires --include-grants")
+	}
+	if opts.IncludeOwnership && !opts.IncludeGrants {
+		return fmt.Errorf("--include-ownership requires --include-grants")
+	}
+
+	if opts.DDLOut != "" && !opts.DryRun {
+		return fmt.Errorf("--ddl-out requires --dry-run")
+	}
+
+	if opts.PlanLimit < 0 {
+		return fmt.Errorf("--plan-limit must not be negative")
+	}
+	if slices.Contains(opts.TablePrefixes, "") {
+		return fmt.Errorf("--table-prefix must not be empty")
+	}
+
+	if opts.Retries < 0 {
+		return fmt.Errorf("--retries must not be negative")
+	}
+	if opts.Retries > 0 && opts.RetryBackoff < 0 {
+		return fmt.Errorf("--retry-backoff must not be negative")
+	}
+	if opts.MaxRetries < 0 {
+		return fmt.Errorf("--max-retries must not be negative")
+	}
+
+	if opts.MaxWALRate < 0 {
+		return fmt.Errorf("--max-wal-rate must not be negative")
+	}
+	if opts.SourceConnectionLimit < 0 {
+		return fmt.Errorf("--source-connection-limit must not be negative")
+	}
+	for source := range opts.SchemaMap {
+		if !slices.Contains(opts.Schemas.sourceSchemas(), source) {
+			return fmt.Errorf("--schema-map maps %s, which is not among --schemas", source)
+		}
+	}
+
+	if opts.CursorRowWidth < 0 {
+		return fmt.Errorf("--cursor-row-width must not be negative")
+	}
+	if opts.CursorFetchSize <= 0 {
+		return fmt.Errorf("--cursor-fetch-size must be positive")
+	}
+	if opts.FetchTarget < 0 {
+		return fmt.Errorf("--fetch-target must not be negative")
+	}
+	if opts.FetchMinRows <= 0 || opts.FetchMaxRows < opts.FetchMinRows {
+		return fmt.Errorf("--fetch-min-rows must be positive and at most --fetch-max-rows")
+	}
+	if opts.ChunkSize < 0 {
+		return fmt.Errorf("--chunk-size must not be negative")
+	}
+	if opts.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+
+	if opts.ChunkMismatchRetries < 0 {
+		return fmt.Errorf("--chunk-mismatch-retries must not be negative")
+	}
+
+	if opts.Differential && opts.Config.encrypts() {
+		return fmt.Errorf("--differential cannot be combined with encrypted columns")
+	}
+	if opts.Differential && opts.Config.convertsUUIDKeys() {
+		return fmt.Errorf("--differential cannot be combined with uuid_key")
+	}
+
+	if !opts.Upsert {
+		for name, tc := range opts.Config.Tables {
+			if tc.OnConflict != nil && tc.OnExisting != onExistingMerge {
+				return fmt.Errorf("config: on_conflict of table %s requires --upsert", name)
+			}
+		}
+	}
+	return nil
+}
+
+// runMigration connects to the databases named by env and runs one
+// migration. The returned report is never nil, even when connecting failed.
+//
+// With --retries a failed run is attempted again with --resume after a
+// backoff, so tables completed by earlier attempts are skipped. The report
+// is the one of the last attempt, with the session counters summed over
+// all attempts and every attempt listed under attempts.
+func runMigration(ctx context.Context, opts Options, env *envSettings) (*Report, error) {
+	var attempts []AttemptReport
+	var rows, bytes int64
+	startedAt := utcNow()
+	for n := 1; ; n++ {
+		report := newReport(opts.Resume)
+		report.DryRun = opts.DryRun
+		report.suppressions = opts.Config.suppressions()
+		err := connectAndMigrate(ctx, opts, env, report)
+		report.finish(err)
+		if opts.Retries == 0 {
+			return report, err
+		}
+
+		attempts = append(attempts, report.attempt(n))
+		rows += report.RowsCopiedSession
+		bytes += report.BytesCopiedSession
+		if err == nil || n > opts.Retries || !retryableRun(ctx, err) {
+			report.StartedAt = startedAt
+			report.ElapsedSeconds = elapsedSeconds(startedAt, report.FinishedAt)
+			report.Attempts = attempts
+			report.RowsCopiedSession, report.BytesCopiedSession = rows, bytes
+			if err != nil && n > 1 {
+				err = fmt.Errorf("giving up after %d attempts: %w", n, err)
+				report.Error = err.Error()
+			}
+			return report, err
+		}
+
+		wait := runBackoff(opts.RetryBackoff, n)
+		log.Printf("Attempt %d of %d failed: %v; retrying with --resume in %s", n, opts.Retries+1, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		opts.Resume = true
+	}
+}
+
+func connectAndMigrate(ctx context.Context, opts Options, env *envSettings, report *Report) error {
+	if err := env.load(); err != nil {
+		return err
+	}
+
+	sourceURL, err := env.get(sourceURLVar)
+	if err != nil {
+		return err
+	}
+	replicaURL, err := env.get(replicaURLVar)
+	if err != nil {
+		return err
+	}
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		return err
+	}
+
+	if sourceURL == "" {
+		return fmt.Errorf("%s is not set", env.varName(sourceURLVar))
+	}
+	if destURL == "" {
+		return fmt.Errorf("%s is not set", env.varName(destURLVar))
+	}
+
+	if opts.Config.encrypts() {
+		if opts.EncryptionKey, err = env.get(encryptionKeyVar); err != nil {
+			return err
+		}
+		if opts.EncryptionKey == "" {
+			return fmt.Errorf("%s is not set; the config encrypts columns", env.varName(encryptionKeyVar))
+		}
+		if err := checkEncryptionKey(opts.Config, opts.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Environment: %s\n", env.describe())
+	fmt.Printf("  Source:      %s\n", describeURL(sourceURL))
+	if replicaURL != "" {
+		fmt.Printf("  Replica:     %s\n", describeURL(replicaURL))
+	}
+	fmt.Printf("  Destination: %s\n", describeURL(destURL))
+
+	// The connections opened before the Migrator count against the limit
+	// too; the report gets the counts even when connecting fails
+	slots := newSourceLimiter(opts.SourceConnectionLimit)
+	defer func() { report.SourceConnections = slots.report() }()
+
+	// Connect to Source (Xata)
+	fmt.Println("Connecting to Source (Xata)...")
+	sourceConn, err := connectSource(ctx, sourceURL, slots)
+	if err != nil {
+		return withSentinel(ErrConnect, fmt.Errorf("unable to connect to source database: %w", err))
+	}
+	defer sourceConn.Close(ctx)
+	fmt.Println("Connected to Source.")
+
+	replicaConn, err := connectReplica(ctx, replicaURL, opts.SourceEndpoint, slots)
+	if err != nil {
+		return err
+	}
+	if replicaConn != nil {
+		defer replicaConn.Close(ctx)
+	}
+
+	// Connect to Destination (Postgres)
+	fmt.Println("Connecting to Destination (Postgres)...")
+	dest, err := connectDestination(ctx, destURL, opts, report)
+	if err != nil {
+		return err
+	}
+	defer dest.close(ctx)
+	fmt.Println("Connected to Destination.")
+
+	if err := dest.lock(ctx, report); err != nil {
+		return err
+	}
+
+	// Run migration
+	m := NewMigrator(sourceConn, replicaConn, dest.conn, opts)
+	m.destConn = dest.copyConn()
+	m.setPooler(dest.pooler)
+	return m.Migrate(ctx, report)
+}
+
+func loadEnv() {
+	// Load .env file if it exists
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, relying on environment variables")
+	}
+}
+
+type Column struct {
+	Name       string  `json:"name"`
+	DataType   string  `json:"data_type"`
+	IsNullable string  `json:"is_nullable"`
+	Default    *string `json:"default,omitempty"`
+	// Inherited columns come from an INHERITS parent and are not redeclared
+	Inherited bool `json:"inherited,omitempty"`
+	// Comment is the COMMENT ON COLUMN of the source
+	Comment string `json:"comment,omitempty"`
+	// Generated is the expression of a GENERATED ALWAYS AS column, which is
+	// never copied (see withoutGenerated); GeneratedVirtual is set for the
+	// VIRTUAL ones of PostgreSQL 18
+	Generated        string `json:"generated,omitempty"`
+	GeneratedVirtual bool   `json:"generated_virtual,omitempty"`
+	// Identity is ALWAYS or BY DEFAULT for a GENERATED ... AS IDENTITY
+	// column, whose sequence is set after the copy like a SERIAL one's
+	Identity string `json:"identity,omitempty"`
+	// Collation is the quoted COLLATE name of a column whose collation is
+	// not the default of its type, qualified unless in pg_catalog or public
+	Collation string `json:"collation,omitempty"`
+
+	// Composite is set for columns of a composite (row) type;
+	// CompositeNested when one of its attributes is not of a built-in type
+	// and CompositeArray for arrays of composite types (see
+	// rowCopyComposites)
+	Composite       bool `json:"-"`
+	CompositeNested bool `json:"-"`
+	CompositeArray  bool `json:"-"`
+	// SourceExpr, when set, is read from the source instead of the column
+	// itself (see sourceColumns)
+	SourceExpr string `json:"-"`
+	// DestName is the destination column name when it differs (see naming.go)
+	DestName string `json:"-"`
+	// StrippedDefault is the source default sanitizeColumn dropped for
+	// referring to Xata internals
+	StrippedDefault string `json:"-"`
+	// StatisticsTarget is set by ALTER COLUMN ... SET STATISTICS; nil means
+	// the server default
+	StatisticsTarget *int `json:"-"`
+	// Encrypt is the encryption method of the column, from the config
+	// (see applyEncryption)
+	Encrypt string `json:"-"`
+	// Domain is set for columns of a domain type, to its name
+	Domain string `json:"-"`
+	// TypeSchema and TypeName name the column's type, or the element type
+	// of an array, so a column of a type in a mapped schema can follow it
+	// (see mapObjectSchemas)
+	TypeSchema string `json:"-"`
+	TypeName   string `json:"-"`
+	// UUIDKey translates the text record ids of the column to uuid (see
+	// applyUUIDKeys)
+	UUIDKey *uuidKey `json:"-"`
+}
+
+type Table struct {
+	// Schema is the schema the table was read from, or for a destination
+	// view (see onDestination) the one it is created in
+	Schema     string   `json:"schema,omitempty"`
+	Name       string   `json:"name"`
+	Columns    []Column `json:"columns"`
+	PrimaryKey []string `json:"primary_key,omitempty"`
+	Inherits   []string `json:"inherits,omitempty"`
+	// Comment is the COMMENT ON TABLE of the source
+	Comment string `json:"comment,omitempty"`
+	// PartitionKey is the PARTITION BY clause of a partitioned table, e.g.
+	// RANGE (created_at); PartitionOf and PartitionBound make the table a
+	// partition of another one, with a bound such as FOR VALUES FROM (...)
+	// TO (...) or DEFAULT
+	PartitionKey   string `json:"partition_key,omitempty"`
+	PartitionOf    string `json:"partition_of,omitempty"`
+	PartitionBound string `json:"partition_bound,omitempty"`
+
+	HasChildren bool `json:"-"`
+	// IgnoredColumns are source columns left out because the existing
+	// destination table does not have them (see projectTable).
+	IgnoredColumns []string `json:"-"`
+	// OrderBy is the read order with --ordered-copy; nil means unordered
+	OrderBy []OrderTerm `json:"-"`
+	// Checks are created with the table; Indexes and ForeignKeys once all
+	// data is copied
+	Checks      []checkConstraint `json:"-"`
+	Indexes     []tableIndex      `json:"-"`
+	ForeignKeys []foreignKey      `json:"-"`
+	// Statistics are the extended statistics objects, created after the
+	// load like the foreign keys
+	Statistics []statisticsObject `json:"-"`
+	// DestName is the destination table name when it differs, and
+	// destInherits and destPartitionOf the destination names of Inherits
+	// and PartitionOf (see naming.go)
+	DestName        string `json:"-"`
+	destInherits    []string
+	destPartitionOf string
+	// DestSchema is the destination schema set by schema_routes; empty
+	// means public
+	DestSchema string `json:"-"`
+	// FetchSize reads the rows through a cursor this many at a time; 0
+	// means a single SELECT (see cursorFetchSize). fetchSizer adapts it
+	// with --fetch-target.
+	FetchSize  int `json:"-"`
+	fetchSizer *fetchSizer
+}
+
+func (t Table) column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+func isCharacterType(dataType string) bool {
+	return dataType == "text" || dataType == "citext" ||
+		strings.HasPrefix(dataType, "character")
+}
+
+func isTimeType(dataType string) bool {
+	return dataType == "date" || strings.HasPrefix(dataType, "timestamp")
+}
+
+// createSchemaObjects creates what the tables need before them: the
+// schemas of routed tables and of the other objects, extensions, enum
+// types, domains and functions.
+// All of them are created if missing and otherwise kept or replaced, so
+// unlike the tables they stay when the tables are rolled back.
+func createSchemaObjects(ctx context.Context, conn Querier, state *MigrationState, opts Options) error {
+	tables, keep, report := state.Tables, state.Keep, state.Report
+
+	// Schemas of routed tables are created first; public always exists
+	created := map[string]bool{}
+	for _, t := range tables {
+		if keep[t.Name] || t.DestSchema == "" || created[t.DestSchema] {
+			continue
+		}
+		created[t.DestSchema] = true
+		if _, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+sqlutil.QuoteIdent(t.DestSchema)); err != nil {
+			return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to create schema %s: %w", t.DestSchema, err)}
+		}
+	}
+	for _, schema := range objectSchemas(state) {
+		if schema == defaultSchema || created[schema] {
+			continue
+		}
+		created[schema] = true
+		if _, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+sqlutil.QuoteIdent(schema)); err != nil {
+			return &SchemaError{Err: fmt.Errorf("failed to create schema %s: %w", schema, err)}
+		}
+	}
+	// Column types and defaults may come from extensions
+	if err := createExtensions(ctx, conn, state.extensions, opts, report); err != nil {
+		return err
+	}
+	// Column types must exist before the tables using them
+	if err := createEnums(ctx, conn, state.enums, report); err != nil {
+		return err
+	}
+	// Domains may be over enum types
+	if err := createDomains(ctx, conn, state.domains, report); err != nil {
+		return err
+	}
+	// Composite types may have attributes of enum types and domains
+	if err := createComposites(ctx, conn, state.composites, report); err != nil {
+		return err
+	}
+	// Functions may take and return enum types and domains
+	return createFunctions(ctx, conn, state.functions, report)
+}
+
+// objectSchemas returns the destination schemas of the types, functions
+// and materialized views of state, which may hold no migrated table.
+func objectSchemas(state *MigrationState) []string {
+	var schemas []string
+	for _, e := range state.enums {
+		schemas = append(schemas, e.DestSchema)
+	}
+	for _, d := range state.domains {
+		schemas = append(schemas, d.DestSchema)
+	}
+	for _, ct := range state.composites {
+		schemas = append(schemas, ct.DestSchema)
+	}
+	for _, f := range state.functions {
+		schemas = append(schemas, f.DestSchema)
+	}
+	for _, mv := range state.matViews {
+		schemas = append(schemas, mv.Schema)
+	}
+	return distinctSchemas(schemas)
+}
+
+// createTables drops and recreates the tables that are not kept. It returns
+// the tables created, also when it fails.
+func createTables(ctx context.Context, conn Querier, state *MigrationState, opts Options) ([]string, error) {
+	var created []string
+	for _, t := range state.Tables {
+		// Tables finished by a previous run or synced differentially keep their data
+		if state.Keep[t.Name] {
+			continue
+		}
+
+		// Record what the drop takes along; a recorded script drops nothing
+		if !recording(conn) {
+			dependents, err := cascadeDependents(ctx, conn, []Table{t})
+			if err != nil {
+				return created, &SchemaError{Table: t.Name, Err: err}
+			}
+			state.Report.CascadeDropped = append(state.Report.CascadeDropped, dependents...)
+		}
+
+		// Drop existing table
+		_, err := conn.Exec(ctx, sqlutil.DropTable(destIdent(t), true))
+		if err != nil {
+			return created, &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to drop table %s: %w", t.Name, err)}
+		}
+
+		for _, sql := range tableDDL(t, opts.Config.table(t.Name).PartitionBy, opts.PartitionOutliers) {
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				return created, &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to create table %s: %w", t.Name, err)}
+			}
+		}
+		created = append(created, t.Name)
+	}
+	return created, nil
+}
+
+func copyData(ctx context.Context, sources *sourceEndpoints, dest CopyConn, reconnectDest func(context.Context) (CopyConn, error), tables []Table, opts Options, cp *Checkpoint, report *Report, diffPlan map[string]bool, upserts map[string]*conflictStrategy, incremental map[string]*Watermark, wal *walMonitor) error {
+	tables = withoutGenerated(partitionedLast(tables))
+
+	run := runOf(ctx)
+	// 1. Get row counts up front so overall progress covers the whole run
+	counts := make([]int64, len(tables))
+	var totalRows, priorRows int64
+	for i, t := range tables {
+		if t.PartitionKey != "" {
+			// Its rows are counted with its partitions
+			continue
+		}
+		if tc, ok := cp.Tables[t.Name]; ok && tc.Completed {
+			counts[i] = tc.RowsCopied
+			priorRows += tc.RowsCopied
+		} else {
+			priorRows += cp.splitProgress(t.Name).RowsCopied
+			query, args := sqlutil.CountRows(fromClause(t)), []any(nil)
+			if w := incremental[t.Name]; w != nil {
+				var cond string
+				cond, args = sinceCondition(w)
+				query += " WHERE " + cond
+			}
+			err := sources.primary.QueryRow(ctx, query, args...).Scan(&counts[i])
+			if err != nil {
+				return copyError(t, fmt.Errorf("failed to get count for table %s: %w", t.Name, err))
+			}
+		}
+		totalRows += counts[i]
+	}
+
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.Name
+	}
+	run.reporter.CopyStarted(names, counts)
+
+	overall := newOverallProgress(totalRows, priorRows)
+	overall.wal = wal
+	if priorRows > 0 {
+		fmt.Printf("Resuming: %s\n", overall)
+	}
+
+	var readBytes int64
+	for i, t := range tables {
+		count := counts[i]
+
+		if tc, ok := cp.Tables[t.Name]; ok && tc.Completed {
+			fmt.Printf("Skipping table %s (completed in a previous run)\n", t.Name)
+			// A run of an older version may have stopped before setting them
+			var sequences []SequenceReset
+			if !tc.SequencesSynced {
+				var err error
+				if sequences, err = resetSequences(ctx, dest, t); err != nil {
+					return copyError(t, err)
+				}
+				if err := cp.markSequencesSynced(t.Name); err != nil {
+					return copyError(t, err)
+				}
+			}
+			report.addTable(&TableReport{
+				Name:             t.Name,
+				Status:           tableStatusResumed,
+				RowsCopiedTotal:  tc.RowsCopied,
+				BytesCopiedTotal: tc.BytesCopied,
+				Sequences:        sequences,
+			})
+			continue
+		}
+
+		if opts.MaxReadBytes > 0 && readBytes >= opts.MaxReadBytes {
+			return fmt.Errorf("read %s from the source, reaching --max-read-bytes (%s); stopping before table %s (continue with --resume)",
+				formatBytes(readBytes), formatBytes(opts.MaxReadBytes), t.Name)
+		}
+
+		if t.PartitionKey != "" {
+			fmt.Printf("Skipping table %s (partitioned; its rows were copied with its partitions)\n", t.Name)
+			// Its partitions are in, so the sequences cover all of them
+			sequences, err := resetSequences(ctx, dest, t)
+			if err != nil {
+				return copyError(t, err)
+			}
+			if err := cp.markCompleted(t.Name, 0, 0); err != nil {
+				return copyError(t, err)
+			}
+			report.addTable(&TableReport{Name: t.Name, Status: tableStatusPartitioned, Sequences: sequences})
+			continue
+		}
+
+		if t.PartitionOf != "" {
+			fmt.Printf("Migrating table: %s (partition of %s)\n", t.Name, t.PartitionOf)
+		} else {
+			fmt.Printf("Migrating table: %s\n", t.Name)
+		}
+		run.reporter.TableStarted(t.Name)
+		if len(t.IgnoredColumns) > 0 {
+			fmt.Printf("  Ignoring source columns not on destination: %s\n", strings.Join(t.IgnoredColumns, ", "))
+		}
+
+		if diffPlan[t.Name] {
+			var stats *DifferentialStats
+			var copiedBytes int64
+			endpoint, err := sources.read(t.Name, report, func(src *SourceConn) (err error) {
+				stats, copiedBytes, err = copyTableDifferential(ctx, src, dest, t, opts, cp, wal)
+				return err
+			})
+			if err != nil && skipTable(run, t, report) {
+				continue
+			}
+			if err != nil {
+				return copyError(t, err)
+			}
+			printEndpoint(endpoint)
+			copied := stats.New + stats.Changed
+			readBytes += copiedBytes
+			run.status.read(readBytes)
+			sequences, err := resetSequences(ctx, dest, t)
+			if err != nil {
+				return copyError(t, err)
+			}
+			if err := cp.markCompleted(t.Name, copied, copiedBytes); err != nil {
+				return copyError(t, err)
+			}
+			overall.add(count)
+			fmt.Printf("  %s\n", overall)
+			report.addTable(&TableReport{
+				Name:               t.Name,
+				Status:             tableStatusSynced,
+				Method:             methodDifferential,
+				RowsCopiedSession:  copied,
+				RowsCopiedTotal:    copied,
+				BytesCopiedSession: copiedBytes,
+				BytesCopiedTotal:   copiedBytes,
+				Differential:       stats,
+				IgnoredColumns:     t.IgnoredColumns,
+				SourceEndpoint:     endpoint,
+				Sequences:          sequences,
+			})
+			continue
+		}
+
+		// Record the hash state before copying so the next run can be differential
+		if opts.Differential && differentialEligible(t) {
+			_, err := sources.read(t.Name, report, func(src *SourceConn) error {
+				return rebuildHashState(ctx, src, dest, t, wal)
+			})
+			if err != nil {
+				return copyError(t, err)
+			}
+		}
+
+		// Existing tables are emptied so the copy neither duplicates nor
+		// conflicts with rows of an earlier load
+		if opts.DataOnly && upserts[t.Name] == nil && !cp.partial(t.Name) {
+			if _, err := dest.Exec(ctx, sqlutil.Truncate(destFromClause(t))); err != nil {
+				return copyError(t, fmt.Errorf("failed to truncate %s: %w", t.Name, err))
+			}
+		}
+
+		// The watermark is read before the copy, so rows changed while it
+		// runs are read again by the next run
+		var since, watermark *time.Time
+		var where string
+		var whereArgs []any
+		incrementalCol, hasIncremental := incrementalColumn(t, opts.IncrementalColumn)
+		if opts.Incremental && hasIncremental {
+			_, err := sources.read(t.Name, report, func(src *SourceConn) (err error) {
+				watermark, err = readWatermark(ctx, src, t, incrementalCol)
+				return err
+			})
+			if err != nil {
+				return copyError(t, err)
+			}
+			if w := incremental[t.Name]; w != nil {
+				since = &w.Value
+				where, whereArgs = sinceCondition(w)
+			}
+		}
+
+		if count == 0 {
+			fmt.Println("  Skipping empty table")
+			if err := cp.markCompleted(t.Name, 0, 0); err != nil {
+				return copyError(t, err)
+			}
+			if watermark != nil {
+				if err := cp.setWatermark(t.Name, incrementalCol.Name, *watermark); err != nil {
+					return copyError(t, err)
+				}
+			}
+			report.addTable(&TableReport{Name: t.Name, Status: tableStatusEmpty, IgnoredColumns: t.IgnoredColumns, IncrementalSince: since, Watermark: watermark})
+			continue
+		}
+
+		tableConfig := opts.Config.table(t.Name)
+		pipelines := buildPipelines(t, tableConfig, opts.EncryptionKey)
+		fetchSize, err := cursorFetchSize(ctx, sources.primary, t, tableConfig, opts)
+		if err != nil {
+			return copyError(t, err)
+		}
+		t.FetchSize = fetchSize
+		if t.FetchSize > 0 && opts.FetchTarget > 0 {
+			t.fetchSizer = newFetchSizer(t.Name, t.FetchSize, opts, run)
+			fmt.Printf("  Reading through a cursor, from %d rows per fetch toward %s per batch\n", t.fetchSizer.current(), opts.FetchTarget)
+		} else if t.FetchSize > 0 {
+			fmt.Printf("  Reading through a cursor, %d rows per fetch\n", t.FetchSize)
+		}
+
+		// Work of ranges finished by an earlier run
+		prior := cp.splitProgress(t.Name)
+
+		// Staged and split tables have their own chunking; large tables are
+		// sliced with --workers, or else copied in key chunks
+		var keyset string
+		if upserts[t.Name] == nil && !hasPgcryptoColumns(t) && tableConfig.SplitBy == nil {
+			if sc := tableSlices(t, count, opts, cp); sc != nil {
+				tableConfig.SplitBy = sc
+			} else {
+				keyset = keysetColumn(t, count, opts.ChunkSize, cp)
+			}
+		}
+
+		freeze := opts.Freeze
+		if freeze {
+			if reason := freezeBlocker(t, tableConfig, opts, pipelines, upserts[t.Name] != nil, keyset != "", run.batched); reason != "" {
+				fmt.Printf("  Not using COPY FREEZE: %s\n", reason)
+				freeze = false
+			}
+		}
+
+		var verify *ChunkVerification
+		if opts.VerifyChunks && tableConfig.SplitBy != nil {
+			verify = &ChunkVerification{retries: opts.ChunkMismatchRetries}
+		}
+
+		stats := &RetryStats{}
+		run.status.watchRetries(t.Name, stats)
+		var copied, copiedBytes int64
+		method := copyMethodRows
+		var endpoint string
+		for attempt := 1; ; attempt++ {
+			var rows, bytes int64
+			endpoint, err = sources.read(t.Name, report, func(source *SourceConn) (err error) {
+				if cs := upserts[t.Name]; cs != nil || hasPgcryptoColumns(t) {
+					method = methodStaged
+					if cs != nil {
+						method = methodUpsert
+					}
+					rows, bytes, err = copyTableStaged(ctx, source, dest, t, count, where, whereArgs, pipelines, cs, opts.EncryptionKey, cp, wal)
+				} else if tableConfig.SplitBy != nil {
+					rows, bytes, err = copyTableSplit(ctx, source, dest, t, count, tableConfig.SplitBy, cp, pipelines, stats, verify, wal)
+				} else if keyset != "" {
+					method = methodKeyset
+					rows, bytes, err = copyTableKeyset(ctx, source, dest, t, keyset, max(opts.ChunkSize, 1), count, cp, pipelines, wal)
+				} else if pipelines == nil && t.FetchSize == 0 && !run.batched && useCSVPassthrough(opts.CopyMethod, t, tableConfig) {
+					method = copyMethodCSV
+					rows, bytes, err = copyTableCSV(ctx, source, dest, t, freeze, wal)
+				} else {
+					rows, bytes, err = copyTableRows(ctx, source, dest, t, count, pipelines, wal)
+				}
+				return err
+			})
+			// A failed COPY writes nothing, but the chunks a keyset copy
+			// finished are checkpointed and stay
+			if err == nil || method == methodKeyset {
+				copied += rows
+				copiedBytes += bytes
+			}
+			if err == nil || !retriedCopy(method) || !isTransient(err) || attempt > opts.MaxRetries || ctx.Err() != nil || run.control.skipRequested() {
+				break
+			}
+			if dest, err = retryTable(ctx, t, attempt, opts.MaxRetries, err, sources, dest, reconnectDest, stats); err != nil {
+				break
+			}
+		}
+		if err != nil && skipTable(run, t, report) {
+			continue
+		}
+		if err != nil {
+			return copyError(t, err)
+		}
+		printEndpoint(endpoint)
+		readBytes += copiedBytes
+		run.status.read(readBytes)
+
+		var order string
+		if opts.OrderedCopy {
+			order = describeOrder(t.OrderBy)
+		}
+
+		normalizations := normalizationCounts(pipelines)
+		for _, n := range normalizations {
+			fmt.Printf("  Normalized %s: %d empty->NULL, %d NULL->empty, %d value->NULL\n",
+				n.Column, n.EmptyToNull, n.NullToEmpty, n.ValueToNull)
+		}
+		transforms := transformCounts(t, pipelines, report)
+		for _, tr := range transforms {
+			fmt.Printf("  Normalized JSON in %s: %d value(s), %d quarantined\n", tr.Column, tr.Normalized, tr.Quarantined)
+		}
+		fetchSizing := t.fetchSizer.report()
+		if fs := fetchSizing; fs != nil {
+			fmt.Printf("  Fetch size went from %d to %d rows (%d to %d over %d batches, %.1fs and %s per batch on average)\n",
+				fs.Initial, fs.Final, fs.Smallest, fs.Largest, fs.Batches, fs.AvgBatchSeconds, formatBytes(fs.AvgBatchBytes))
+		}
+
+		// Set before the table counts as complete, so an interrupted run
+		// sets them on --resume
+		sequences, err := resetSequences(ctx, dest, t)
+		if err != nil {
+			return copyError(t, err)
+		}
+		if err := cp.markCompleted(t.Name, prior.RowsCopied+copied, prior.BytesCopied+copiedBytes); err != nil {
+			return copyError(t, err)
+		}
+		if watermark != nil {
+			if err := cp.setWatermark(t.Name, incrementalCol.Name, *watermark); err != nil {
+				return copyError(t, err)
+			}
+		}
+		if err := reportDefaultPartition(ctx, dest, t, opts, report); err != nil {
+			return copyError(t, err)
+		}
+		if verify != nil && verify.Mismatches > 0 {
+			report.warnTable(warnChunkMismatch, t.Name, "table %s: %d range copies did not match the source and were redone; check the network path", t.Name, verify.Mismatches)
+		}
+		if !stats.empty() {
+			fmt.Printf("  Retries: %d, reconnects: %d, errors: %d (%d transient)\n",
+				stats.Retries, stats.Reconnects, stats.Errors, stats.TransientErrors)
+			if stats.Retries > int64(opts.RetryWarnThreshold) {
+				report.warnTable(warnRetries, t.Name, "table %s needed %d retries (threshold %d) before it succeeded; the next run may fail outright",
+					t.Name, stats.Retries, opts.RetryWarnThreshold)
+			}
+		}
+		overall.add(copied)
+		fmt.Printf("  %s\n", overall)
+		report.addTable(&TableReport{
+			Name:               t.Name,
+			Status:             tableStatusCopied,
+			Method:             method,
+			RowsCopiedSession:  copied,
+			RowsCopiedTotal:    prior.RowsCopied + copied,
+			BytesCopiedSession: copiedBytes,
+			BytesCopiedTotal:   prior.BytesCopied + copiedBytes,
+			Normalizations:     normalizations,
+			Transforms:         transforms,
+			IgnoredColumns:     t.IgnoredColumns,
+			Retries:            stats.orNil(),
+			SourceEndpoint:     endpoint,
+			OrderBy:            order,
+			Frozen:             freeze,
+			ChunkVerification:  verify,
+			FetchSize:          t.FetchSize,
+			FetchSizing:        fetchSizing,
+			Sequences:          sequences,
+			IncrementalSince:   since,
+			Watermark:          watermark,
+		})
+	}
+	if opts.Incremental {
+		printIncremental(report.Tables)
+	}
+	return nil
+}
+
+// skipTable reports whether the copy of t failed because it was skipped
+// with copyControl, and then records the table as skipped. Its checkpoint
+// entry stays incomplete, so --resume copies it again.
+func skipTable(run *runEnv, t Table, report *Report) bool {
+	if !run.control.skipRequested() {
+		return false
+	}
+	run.control.tableDone()
+	report.warnTable(warnTableSkipped, t.Name, "table %s was skipped during the copy and is incomplete; --resume copies it again", t.Name)
+	report.addTable(&TableReport{Name: t.Name, Status: tableStatusSkipped, IgnoredColumns: t.IgnoredColumns})
+	return true
+}
+
+func copyTableRows(ctx context.Context, source *SourceConn, dest CopyConn, t Table, count int64, pipelines []*columnPipeline, wal *walMonitor) (int64, int64, error) {
+	bar := runOf(ctx).newProgressBar(count, "  Copying")
+	copied, copiedBytes, err := copyRows(ctx, source, dest, t, destIdentifier(t), "", nil, bar, pipelines, nil, wal)
+	if err != nil {
+		return 0, 0, err
+	}
+	bar.Finish()
+	fmt.Println()
+	return copied, copiedBytes, nil
+}
+
+// copyRows copies the rows of t matching the optional where condition
+// (with args as its parameters) row by row into the table into. With a
+// non-nil sum, every row written is added to it; a non-nil wal throttles
+// the rows.
+func copyRows(ctx context.Context, source *SourceConn, dest CopyConn, t Table, into pgx.Identifier, where string, args []any, bar *progressbar.ProgressBar, pipelines []*columnPipeline, sum *chunkChecksum, wal *walMonitor) (int64, int64, error) {
+	// Select data
+	// Build column list to ensure order
+	colNames := copyColumns(t)
+	if err := rowCopyComposites(t); err != nil {
+		return 0, 0, err
+	}
+
+	query := rowSelect(t)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if len(t.OrderBy) > 0 {
+		query += orderClause(t.OrderBy)
+	}
+	var rows pgx.Rows
+	var err error
+	if t.FetchSize > 0 {
+		rows, err = source.queryCursor(ctx, query, t.FetchSize, t.fetchSizer, args...)
+	} else {
+		rows, err = source.Query(ctx, query, args...)
+	}
+	if err != nil {
+		return 0, 0, onEndpoint(endpointSource, fmt.Errorf("failed to query rows from %s: %w", t.Name, err))
+	}
+
+	// Wrap rows for progress
+	run := runOf(ctx)
+	pbRows := &ProgressBarRows{Rows: rows, Bar: bar, WAL: wal, control: run.control}
+	var src pgx.CopyFromSource = pbRows
+	if pipelines != nil {
+		src = newPipelineRows(pbRows, t, pipelines)
+	}
+	if sum != nil {
+		src = &checksumRows{CopyFromSource: src, raw: rows, pipelines: pipelines, sum: sum}
+	}
+
+	// Copy to destination
+	copied, err := copyInto(
+		ctx,
+		dest,
+		into,
+		colNames,
+		src,
+	)
+	if err != nil && run.control.skipRequested() {
+		// Ends the SELECT rather than reading the rest of the table
+		source.cancelQuery(ctx)
+		rows.Close()
+		return 0, 0, errTableSkipped
+	}
+	rows.Close() // Close original rows
+	if err != nil {
+		endpoint := endpointDestination
+		if rows.Err() != nil {
+			endpoint = endpointSource
+		}
+		return 0, 0, onEndpoint(endpoint, fmt.Errorf("failed to copy data for table %s: %w", t.Name, err))
+	}
+	return copied, pbRows.Bytes, nil
+}
+
+// copyColumns returns the column list that every write path must name
+// explicitly. Listing each copied column means destination defaults
+// such as DEFAULT now() never fire for migrated rows; the source value is
+// always written as-is, even when it is NULL. The names are destination
+// names.
+func copyColumns(t Table) []string {
+	colNames := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		colNames[i] = c.destName()
+	}
+	return colNames
+}
+
+// sourceColumns returns the expressions read from the source for the
+// columns of copyColumns, in the same order.
+func sourceColumns(t Table) []string {
+	exprs := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		exprs[i] = sqlutil.QuoteIdent(c.Name)
+		if c.SourceExpr != "" {
+			exprs[i] = c.SourceExpr
+		}
+	}
+	return exprs
+}
+
+// sourceSelect builds the SELECT reading the copied columns of t from the
+// source.
+func sourceSelect(t Table) string {
+	exprs := sourceColumns(t)
+	for i, c := range t.Columns {
+		if c.SourceExpr != "" {
+			exprs[i] += " AS " + sqlutil.QuoteIdent(c.Name)
+		}
+	}
+	return "SELECT " + strings.Join(exprs, ", ") + " FROM " + fromClause(t)
+}
+
+// rowSelect is sourceSelect for the row-by-row copy, which reads composite
+// columns in binary (see compositeSend).
+func rowSelect(t Table) string {
+	exprs := sourceColumns(t)
+	for i, c := range t.Columns {
+		if c.SourceExpr != "" || c.Composite {
+			exprs[i] = compositeSend(c, exprs[i]) + " AS " + sqlutil.QuoteIdent(c.Name)
+		}
+	}
+	return "SELECT " + strings.Join(exprs, ", ") + " FROM " + fromClause(t)
+}
+
+type ProgressBarRows struct {
+	pgx.Rows
+	Bar   *progressbar.ProgressBar
+	Bytes int64
+	// WAL throttles the rows to --max-wal-rate
+	WAL *walMonitor
+	// control pauses and skips the copy, if set (see copyControl)
+	control *copyControl
+	// err is set when the copy was skipped
+	err error
+}
+
+func (r *ProgressBarRows) Next() bool {
+	if r.control != nil {
+		if r.err = r.control.wait(); r.err != nil {
+			return false
+		}
+	}
+	r.WAL.throttle(r.Bar)
+	if r.Rows.Next() {
+		r.Bar.Add(1)
+		for _, v := range r.Rows.RawValues() {
+			r.Bytes += int64(len(v))
+		}
+		return true
+	}
+	return false
+}
+
+func (r *ProgressBarRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Rows.Err()
+}
@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Every timestamp the tool writes out (log lines, reports, the checkpoint,
+// schema snapshots, recorded scripts) is UTC. Durations measured within the
+// process use time.Now, whose monotonic reading is not affected by clock
+// changes.
+
+// processStart is the reference for the elapsed time in log lines.
+var processStart = time.Now()
+
+// utcNow is the current time in UTC, for timestamps that are written out.
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatElapsed rounds d to milliseconds below a second and to seconds
+// above.
+func formatElapsed(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// elapsedSeconds is the duration between two report timestamps.
+func elapsedSeconds(start, end time.Time) float64 {
+	return end.Sub(start).Round(time.Millisecond).Seconds()
+}
+
+// localZone describes the host's timezone, e.g. "Europe/Berlin (CEST,
+// UTC+02:00)". It is printed once per run, so local times in other logs
+// can be lined up with the UTC ones.
+func localZone() string {
+	name, offset := time.Now().Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	zone := fmt.Sprintf("%s, UTC%c%02d:%02d", name, sign, offset/3600, offset%3600/60)
+	if loc := time.Local.String(); loc != "Local" {
+		return loc + " (" + zone + ")"
+	}
+	if tz := os.Getenv("TZ"); tz != "" {
+		return tz + " (" + zone + ")"
+	}
+	return zone
+}
+
+// logWriter prefixes every log line with its UTC timestamp and the time
+// elapsed since the process started.
+type logWriter struct {
+	w io.Writer
+}
+
+func (l logWriter) Write(p []byte) (int, error) {
+	line := fmt.Sprintf("%s [+%s] %s", formatTimestamp(utcNow()), formatElapsed(time.Since(processStart)), p)
+	if _, err := io.WriteString(l.w, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func setupLogging() {
+	log.SetFlags(0)
+	log.SetOutput(logWriter{w: os.Stderr})
+}
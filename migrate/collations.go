@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkCollations drops the collations the destination lacks from the
+// columns of tables, with a warning, so that their tables are still created
+// with the default collation instead of failing. Collations are looked up
+// once each.
+func checkCollations(ctx context.Context, dest Querier, tables []Table, report *Report) error {
+	found := map[string]bool{}
+	for i := range tables {
+		t := &tables[i]
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			if c.Collation == "" {
+				continue
+			}
+			ok, seen := found[c.Collation]
+			if !seen {
+				if err := dest.QueryRow(ctx, "SELECT to_regcollation($1) IS NOT NULL", c.Collation).Scan(&ok); err != nil {
+					return fmt.Errorf("failed to look up collation %s on the destination: %w", c.Collation, err)
+				}
+				found[c.Collation] = ok
+			}
+			if !ok {
+				report.warnTable(warnCollationMissing, t.Name, "collation %s of column %s.%s does not exist on the destination; the column gets the default collation",
+					c.Collation, t.Name, c.Name)
+				c.Collation = ""
+			}
+		}
+	}
+	return nil
+}
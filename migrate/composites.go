@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	compositeCreated  = "created"
+	compositeExisting = "existing"
+)
+
+// compositeType is a composite type of a source schema of the run created
+// with CREATE TYPE ... AS, as opposed to the row type every table has. It is
+// created on the destination after the domains and before the tables, in
+// DestSchema (empty for public; see mapObjectSchemas).
+type compositeType struct {
+	Schema     string
+	DestSchema string
+	Name       string
+	Attributes []compositeAttribute
+}
+
+type compositeAttribute struct {
+	Name string
+	// Type is the type as format_type prints it; Domain is set when that is
+	// a domain, to its name
+	Type   string
+	Domain string
+}
+
+// CompositeReport describes one composite type of the create-schema phase.
+type CompositeReport struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Attributes int    `json:"attributes"`
+}
+
+// introspectComposites reads the standalone composite types of schemas in
+// creation order, so a type nested in another one comes first.
+func introspectComposites(ctx context.Context, conn Querier, schemas []string) ([]compositeType, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname::text, t.typname::text,
+			ARRAY(
+				SELECT a.attname::text
+				FROM pg_attribute a
+				WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+				ORDER BY a.attnum
+			),
+			ARRAY(
+				SELECT format_type(a.atttypid, a.atttypmod)
+				FROM pg_attribute a
+				WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+				ORDER BY a.attnum
+			),
+			ARRAY(
+				SELECT CASE WHEN at.typtype = 'd' THEN at.typname::text ELSE '' END
+				FROM pg_attribute a
+				JOIN pg_type at ON at.oid = a.atttypid
+				WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+				ORDER BY a.attnum
+			)
+		FROM pg_type t
+		JOIN pg_class c ON c.oid = t.typrelid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype = 'c'
+		  AND c.relkind = 'c'
+		  AND n.nspname = ANY($1)
+		ORDER BY t.oid
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get composite types: %w", err)
+	}
+	composites, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (compositeType, error) {
+		var ct compositeType
+		var names, types, domains []string
+		if err := r.Scan(&ct.Schema, &ct.Name, &names, &types, &domains); err != nil {
+			return ct, err
+		}
+		for i := range names {
+			ct.Attributes = append(ct.Attributes, compositeAttribute{Name: names[i], Type: types[i], Domain: domains[i]})
+		}
+		return ct, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get composite types: %w", err)
+	}
+	return composites, nil
+}
+
+// createComposites creates the composite types missing on the destination.
+// Like a domain, an existing type is not dropped, since that would drop the
+// columns of kept tables using it; one whose attributes differ from the
+// source's is left with a warning.
+func createComposites(ctx context.Context, conn Querier, composites []compositeType, report *Report) error {
+	if len(composites) == 0 {
+		return nil
+	}
+	var schemas []string
+	for _, ct := range composites {
+		schemas = append(schemas, ct.DestSchema)
+	}
+	existing, err := introspectComposites(ctx, conn, distinctSchemas(schemas))
+	if err != nil {
+		return err
+	}
+	for _, ct := range composites {
+		key := sourceTableKey(ct.Schema, ct.Name)
+		cr := CompositeReport{Name: key, Status: compositeCreated, Attributes: len(ct.Attributes)}
+		if i := slices.IndexFunc(existing, func(e compositeType) bool { return e.Schema == destSchemaName(ct.DestSchema) && e.Name == ct.Name }); i >= 0 {
+			cr.Status = compositeExisting
+			if !slices.EqualFunc(ct.Attributes, existing[i].Attributes, func(a, b compositeAttribute) bool { return a.Name == b.Name && a.Type == b.Type }) {
+				report.warn(warnCompositeMismatch, "composite type %s exists on the destination with other attributes; it is left as it is", key)
+			}
+			report.Composites = append(report.Composites, cr)
+			continue
+		}
+		if _, err := conn.Exec(ctx, objectSearchPath(ct.Schema, ct.DestSchema)+createCompositeSQL(ct)); err != nil {
+			return &SchemaError{Err: fmt.Errorf("failed to create composite type %s: %w", key, err)}
+		}
+		fmt.Printf("  Composite type %s (%d attribute(s))\n", key, len(ct.Attributes))
+		report.Composites = append(report.Composites, cr)
+	}
+	return nil
+}
+
+func createCompositeSQL(ct compositeType) string {
+	attrs := make([]string, len(ct.Attributes))
+	for i, a := range ct.Attributes {
+		attrs[i] = sqlutil.QuoteIdent(a.Name) + " " + a.Type
+	}
+	return "CREATE TYPE " + schemaIdent(ct.DestSchema, ct.Name) + " AS (" + strings.Join(attrs, ", ") + ")"
+}
+
+// flattenCompositeDomains gives the attributes of domain types the domain's
+// base type, for --flatten-domains, which creates no domains.
+func flattenCompositeDomains(composites []compositeType, domains []domainType) {
+	byName := make(map[string]domainType, len(domains))
+	for _, d := range domains {
+		byName[d.Name] = d
+	}
+	for i := range composites {
+		for j := range composites[i].Attributes {
+			a := &composites[i].Attributes[j]
+			if d, ok := byName[a.Domain]; ok {
+				a.Type, a.Domain = rootDomain(byName, d).BaseType, ""
+			}
+		}
+	}
+}
+
+// rowCopyComposites checks that the row-by-row copy can carry the composite
+// columns of t. It reads them as record_send binary, which the destination
+// accepts only when every attribute type has the same OID on both servers:
+// a built-in type. Composites nesting user-defined types, and arrays of
+// composites, would be rejected by the destination with an OID mismatch
+// halfway through the table, so they fail here instead.
+func rowCopyComposites(t Table) error {
+	for _, c := range t.Columns {
+		switch {
+		case c.SourceExpr != "":
+		case c.CompositeArray:
+			return fmt.Errorf("column %s.%s is an array of a composite type, which only the CSV passthrough can copy", t.Name, c.Name)
+		case c.Composite && c.CompositeNested:
+			return fmt.Errorf("column %s.%s has a composite type nesting user-defined types, which only the CSV passthrough can copy", t.Name, c.Name)
+		}
+	}
+	return nil
+}
+
+// compositeSend wraps expr, a composite column, so it is read in binary; in
+// text the destination COPY would take it for binary anyway.
+func compositeSend(c Column, expr string) string {
+	if !c.Composite || c.SourceExpr != "" {
+		return expr
+	}
+	return "record_send(" + expr + ")"
+}
@@ -0,0 +1,489 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Config is the optional JSON file passed with --config. It holds settings
+// that are too fine-grained for flags, keyed by source table and column name.
+type Config struct {
+	Tables map[string]TableConfig `json:"tables"`
+	// SchemaRoutes sends tables to destination schemas other than public
+	SchemaRoutes []SchemaRoute `json:"schema_routes"`
+	// DefaultRewrites replaces column defaults, keyed by table.column; an
+	// empty expression removes the default
+	DefaultRewrites map[string]string `json:"default_rewrites"`
+	// Migrations declares several source -> destination migrations that
+	// are run one after another; see MigrationConfig.
+	Migrations []MigrationConfig `json:"migrations"`
+	// Suppressions hide warnings by code; they apply to every migration
+	Suppressions []Suppression `json:"suppressions"`
+	// SmokeChecks are queries compared on both databases by the verify
+	// phase (see smokechecks.go)
+	SmokeChecks []SmokeCheck `json:"smoke_checks"`
+}
+
+// MigrationConfig is one named migration of a config that declares several.
+// Its connection strings come from its own env files and prefix; options
+// left unset fall back to the command line.
+type MigrationConfig struct {
+	Name      string     `json:"name"`
+	EnvFiles  stringList `json:"env_files"`
+	EnvPrefix string     `json:"env_prefix"`
+	// Only restricts the migration to these tables, like --only
+	Only            []string               `json:"only"`
+	Tables          map[string]TableConfig `json:"tables"`
+	SchemaRoutes    []SchemaRoute          `json:"schema_routes"`
+	DefaultRewrites map[string]string      `json:"default_rewrites"`
+	SmokeChecks     []SmokeCheck           `json:"smoke_checks"`
+
+	DataOnly         *bool  `json:"data_only"`
+	Upsert           *bool  `json:"upsert"`
+	Differential     *bool  `json:"differential"`
+	DeleteExtraneous *bool  `json:"delete_extraneous"`
+	CopyMethod       string `json:"copy_method"`
+	SourceEndpoint   string `json:"source_endpoint"`
+}
+
+type TableConfig struct {
+	Columns map[string]ColumnConfig `json:"columns"`
+	SplitBy *SplitConfig            `json:"split_by"`
+	// PartitionBy creates the destination table as a partitioned parent
+	PartitionBy *PartitionConfig `json:"partition_by"`
+	// OnConflict applies with --upsert
+	OnConflict *OnConflictConfig `json:"on_conflict"`
+	// OrderBy is the read order with --ordered-copy (default the primary key)
+	OrderBy *OrderBy `json:"order_by"`
+	// RenameTo names the destination table; RenameConstraints maps source
+	// foreign key names to destination ones
+	RenameTo          string            `json:"rename_to"`
+	RenameConstraints map[string]string `json:"rename_constraints"`
+	// OnExisting is the policy when the destination table is reserved (see
+	// checkReservedTables): skip, rename or merge
+	OnExisting string `json:"on_existing"`
+	// FetchSize reads the table through a server-side cursor, this many
+	// rows per FETCH
+	FetchSize int `json:"fetch_size"`
+	// UUIDKey converts the text primary key to uuid (see uuidkeys.go)
+	UUIDKey *UUIDKeyConfig `json:"uuid_key"`
+	// Relationships are references without a source foreign key, checked
+	// by verification (see checkReferences)
+	Relationships []RelationshipConfig `json:"relationships"`
+}
+
+// SchemaRoute creates the tables whose source name matches Pattern (see
+// path.Match) in Schema on the destination. The first matching route wins;
+// tables matching none stay in public.
+type SchemaRoute struct {
+	Pattern string `json:"pattern"`
+	Schema  string `json:"schema"`
+}
+
+// PartitionConfig makes the destination table a parent partitioned by range
+// of Column with the declared partitions. Rows are written through the
+// parent, so PostgreSQL routes each one to its partition.
+type PartitionConfig struct {
+	Column     string           `json:"column"`
+	Partitions []PartitionRange `json:"partitions"`
+	// Default names the default partition created with
+	// --partition-outliers default (default <table>_default)
+	Default string `json:"default"`
+}
+
+// PartitionRange is FOR VALUES FROM (From) TO (To); the bounds are literals
+// of the partition column's type.
+type PartitionRange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+const (
+	conflictActionUpdate  = "update"
+	conflictActionNothing = "nothing"
+)
+
+// OnConflictConfig chooses how --upsert resolves rows that collide with
+// existing destination rows.
+type OnConflictConfig struct {
+	// Conflict target: a named primary key or unique constraint, or a column
+	// list backed by a unique index. Neither means the primary key.
+	Constraint string   `json:"constraint"`
+	Columns    []string `json:"columns"`
+
+	// Action is "update" (default) or "nothing". UpdateColumns limits
+	// "update" to these columns instead of every copied non-target column.
+	Action        string   `json:"action"`
+	UpdateColumns []string `json:"update_columns"`
+}
+
+// SplitConfig copies a table in ranges of a timestamp or date column, or in
+// hash chunks of any column, each checkpointed and retried on its own.
+type SplitConfig struct {
+	Column string `json:"column"`
+	// Interval is a PostgreSQL interval such as "1 month"
+	Interval string `json:"interval"`
+	// Chunks splits the table by a hash of the column into that many chunks
+	// instead of by Interval, for keys such as UUIDs without useful ranges
+	Chunks int `json:"chunks"`
+	// Slices splits the table into that many ranges of an integer or uuid
+	// column holding about as many rows each, planned from a sample
+	Slices int `json:"slices"`
+	// Parallel is the number of ranges copied at the same time, each on its
+	// own pair of connections (default 1)
+	Parallel int `json:"parallel"`
+	// Retries is how often a failed range is retried before giving up
+	Retries int `json:"retries"`
+}
+
+type ColumnConfig struct {
+	// Normalization, applied before any other value processing
+	NullifyEmptyStrings bool    `json:"nullify_empty_strings"`
+	EmptyStringIfNull   bool    `json:"empty_string_if_null"`
+	NullIfValue         *string `json:"null_if_value"`
+	// RenameTo names the destination column
+	RenameTo string `json:"rename_to"`
+	// Encrypt stores the column encrypted as bytea: pgcrypto or aes (see
+	// encrypt.go)
+	Encrypt string `json:"encrypt"`
+	// Transform rewrites the values on the way in: json-normalize (see
+	// jsonnormalize.go)
+	Transform string `json:"transform"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if err := validateTableConfigs(cfg.Tables); err != nil {
+		return nil, err
+	}
+	if err := validateSchemaRoutes(cfg.SchemaRoutes); err != nil {
+		return nil, err
+	}
+	if err := validateDefaultRewrites(cfg.DefaultRewrites); err != nil {
+		return nil, err
+	}
+	if err := validateSuppressions(cfg.Suppressions); err != nil {
+		return nil, err
+	}
+	if err := validateSmokeChecks(cfg.SmokeChecks); err != nil {
+		return nil, err
+	}
+	if len(cfg.Migrations) > 0 && len(cfg.Tables) > 0 {
+		return nil, fmt.Errorf("config: tables must be set per migration when migrations are declared")
+	}
+	if len(cfg.Migrations) > 0 && len(cfg.DefaultRewrites) > 0 {
+		return nil, fmt.Errorf("config: default_rewrites must be set per migration when migrations are declared")
+	}
+	if len(cfg.Migrations) > 0 && len(cfg.SmokeChecks) > 0 {
+		return nil, fmt.Errorf("config: smoke_checks must be set per migration when migrations are declared")
+	}
+	seen := map[string]bool{}
+	for _, m := range cfg.Migrations {
+		if m.Name == "" {
+			return nil, fmt.Errorf("config: every migration needs a name")
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("config: duplicate migration %s", m.Name)
+		}
+		seen[m.Name] = true
+		if err := validateTableConfigs(m.Tables); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if err := validateSchemaRoutes(m.SchemaRoutes); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if err := validateDefaultRewrites(m.DefaultRewrites); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if err := validateSmokeChecks(m.SmokeChecks); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// countTrue counts the conditions that hold.
+func countTrue(conds ...bool) int {
+	n := 0
+	for _, c := range conds {
+		if c {
+			n++
+		}
+	}
+	return n
+}
+
+// validateTableConfigs rejects contradictory table settings that can be
+// detected without looking at the schema.
+func validateTableConfigs(tables map[string]TableConfig) error {
+	for tableName, tc := range tables {
+		if sc := tc.SplitBy; sc != nil {
+			if sc.Parallel < 0 || sc.Retries < 0 || sc.Chunks < 0 || sc.Slices < 0 {
+				return fmt.Errorf("config: split_by of table %s has a negative parallel, retries, chunks or slices", tableName)
+			}
+			if sc.Column == "" || countTrue(sc.Interval != "", sc.Chunks > 0, sc.Slices > 0) != 1 {
+				return fmt.Errorf("config: split_by of table %s needs a column and one of interval, chunks or slices", tableName)
+			}
+		}
+		if pc := tc.PartitionBy; pc != nil {
+			if pc.Column == "" || len(pc.Partitions) == 0 {
+				return fmt.Errorf("config: partition_by of table %s needs a column and at least one partition", tableName)
+			}
+			for _, p := range pc.Partitions {
+				if p.Name == "" || p.From == "" || p.To == "" {
+					return fmt.Errorf("config: every partition of table %s needs name, from and to", tableName)
+				}
+			}
+		}
+		if tc.FetchSize < 0 {
+			return fmt.Errorf("config: fetch_size of table %s must not be negative", tableName)
+		}
+		// The server would truncate longer names, which then no longer
+		// match the ones the run reports and checks for collisions
+		if len(tc.RenameTo) > maxIdentifierLength {
+			return fmt.Errorf("config: rename_to of table %s is %d bytes, longer than the %d PostgreSQL allows", tableName, len(tc.RenameTo), maxIdentifierLength)
+		}
+		for fkName, to := range tc.RenameConstraints {
+			if len(to) > maxIdentifierLength {
+				return fmt.Errorf("config: rename_constraints of %s.%s is %d bytes, longer than the %d PostgreSQL allows", tableName, fkName, len(to), maxIdentifierLength)
+			}
+		}
+		if tc.UUIDKey != nil {
+			if err := validateUUIDKey(tableName, tc.UUIDKey); err != nil {
+				return err
+			}
+		}
+		if oc := tc.OnConflict; oc != nil {
+			if oc.Constraint != "" && len(oc.Columns) > 0 {
+				return fmt.Errorf("config: on_conflict of table %s sets both constraint and columns", tableName)
+			}
+			switch oc.Action {
+			case "", conflictActionUpdate:
+			case conflictActionNothing:
+				if len(oc.UpdateColumns) > 0 {
+					return fmt.Errorf("config: on_conflict of table %s sets update_columns with action nothing", tableName)
+				}
+			default:
+				return fmt.Errorf("config: on_conflict of table %s has unknown action %q (expected update or nothing)", tableName, oc.Action)
+			}
+		}
+		for colName, cc := range tc.Columns {
+			if len(cc.RenameTo) > maxIdentifierLength {
+				return fmt.Errorf("config: rename_to of column %s.%s is %d bytes, longer than the %d PostgreSQL allows", tableName, colName, len(cc.RenameTo), maxIdentifierLength)
+			}
+			if cc.NullifyEmptyStrings && cc.EmptyStringIfNull {
+				return fmt.Errorf("config: column %s.%s sets both nullify_empty_strings and empty_string_if_null", tableName, colName)
+			}
+			if cc.EmptyStringIfNull && cc.NullIfValue != nil {
+				return fmt.Errorf("config: column %s.%s sets both empty_string_if_null and null_if_value", tableName, colName)
+			}
+			if err := validateEncryption(tableName, colName, tc, cc); err != nil {
+				return err
+			}
+			switch {
+			case cc.Transform != "" && cc.Transform != transformJSONNormalize:
+				return fmt.Errorf("config: column %s.%s has unknown transform %q (expected %s)", tableName, colName, cc.Transform, transformJSONNormalize)
+			case cc.Transform != "" && cc.Encrypt != "":
+				return fmt.Errorf("config: column %s.%s sets both transform and encrypt", tableName, colName)
+			}
+		}
+	}
+	return nil
+}
+
+func validateSchemaRoutes(routes []SchemaRoute) error {
+	for _, r := range routes {
+		if r.Pattern == "" || r.Schema == "" {
+			return fmt.Errorf("config: every schema route needs pattern and schema")
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("config: schema route pattern %q: %w", r.Pattern, err)
+		}
+		if r.Schema == stateSchema {
+			return fmt.Errorf("config: schema route %q targets %s, which is reserved for the tool's own state", r.Pattern, stateSchema)
+		}
+	}
+	return nil
+}
+
+func (c *Config) table(name string) TableConfig {
+	if c == nil {
+		return TableConfig{}
+	}
+	return c.Tables[name]
+}
+
+func (c *Config) defaultRewrites() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.DefaultRewrites
+}
+
+// routeSchema returns the destination schema of the source table name, or ""
+// for public, and whether a route matched.
+func (c *Config) routeSchema(name string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for _, r := range c.SchemaRoutes {
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			if r.Schema == defaultSchema {
+				return "", true
+			}
+			return r.Schema, true
+		}
+	}
+	return "", false
+}
+
+// validate checks the config against the introspected schema so typos in
+// table or column names fail before anything is written.
+func (c *Config) validate(tables []Table) error {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+	for tableName, tc := range c.Tables {
+		t, ok := byName[tableName]
+		if !ok {
+			return fmt.Errorf("config references unknown table %s", tableName)
+		}
+		for _, r := range tc.Relationships {
+			ref, ok := byName[r.RefTable]
+			switch {
+			case !ok:
+				return fmt.Errorf("config: a relationship of %s references unknown table %s", tableName, r.RefTable)
+			case len(r.Columns) == 0 || len(r.Columns) != len(r.RefColumns):
+				return fmt.Errorf("config: a relationship of %s to %s needs as many columns as ref_columns", tableName, r.RefTable)
+			case len(missingColumns(t, r.Columns)) > 0:
+				return fmt.Errorf("config: a relationship of %s uses unknown column(s) %s", tableName, strings.Join(missingColumns(t, r.Columns), ", "))
+			case len(missingColumns(ref, r.RefColumns)) > 0:
+				return fmt.Errorf("config: a relationship of %s references unknown column(s) %s of %s", tableName, strings.Join(missingColumns(ref, r.RefColumns), ", "), r.RefTable)
+			}
+		}
+		if sc := tc.SplitBy; sc != nil {
+			col, ok := t.column(sc.Column)
+			if !ok {
+				return fmt.Errorf("config: split_by references unknown column %s.%s", tableName, sc.Column)
+			}
+			if col.Generated != "" {
+				return fmt.Errorf("config: split_by on %s.%s: generated columns are not copied", tableName, sc.Column)
+			}
+			if sc.Interval != "" && !isTimeType(col.DataType) {
+				return fmt.Errorf("config: split_by on %s.%s requires a timestamp or date column, got %s", tableName, sc.Column, col.DataType)
+			}
+			if sc.Slices > 0 && !keysetType(col.DataType) {
+				return fmt.Errorf("config: split_by slices on %s.%s require an integer or uuid column, got %s", tableName, sc.Column, col.DataType)
+			}
+			// The destination values of a converted key hash differently
+			if sc.Chunks > 0 && tc.UUIDKey != nil && slices.Equal(t.PrimaryKey, []string{sc.Column}) {
+				return fmt.Errorf("config: split_by chunks on %s.%s cannot be combined with its uuid_key", tableName, sc.Column)
+			}
+		}
+		if pc := tc.PartitionBy; pc != nil {
+			if _, ok := t.column(pc.Column); !ok {
+				return fmt.Errorf("config: partition_by references unknown column %s.%s", tableName, pc.Column)
+			}
+			if len(t.PrimaryKey) > 0 && !slices.Contains(t.PrimaryKey, pc.Column) {
+				return fmt.Errorf("config: partition_by column %s.%s must be part of the primary key", tableName, pc.Column)
+			}
+			if len(t.Inherits) > 0 || t.HasChildren {
+				return fmt.Errorf("config: partition_by on %s cannot be combined with INHERITS (see --flatten-inheritance)", tableName)
+			}
+			if t.PartitionKey != "" || t.PartitionOf != "" {
+				return fmt.Errorf("config: partition_by on %s: it is already partitioned on the source, which the destination keeps", tableName)
+			}
+		}
+		if ob := tc.OrderBy; ob != nil {
+			for _, ot := range ob.Terms {
+				if _, ok := t.column(ot.Column); !ok {
+					return fmt.Errorf("config: order_by references unknown column %s.%s", tableName, ot.Column)
+				}
+			}
+		}
+		if oc := tc.OnConflict; oc != nil {
+			for _, colName := range append(append([]string{}, oc.Columns...), oc.UpdateColumns...) {
+				if _, ok := t.column(colName); !ok {
+					return fmt.Errorf("config: on_conflict references unknown column %s.%s", tableName, colName)
+				}
+			}
+		}
+		switch tc.OnExisting {
+		case "", onExistingSkip, onExistingMerge:
+		case onExistingRename:
+			if tc.RenameTo == "" {
+				return fmt.Errorf("config: on_existing rename of table %s requires rename_to", tableName)
+			}
+		default:
+			return fmt.Errorf("config: on_existing of table %s must be skip, rename or merge, got %q", tableName, tc.OnExisting)
+		}
+		if tc.UUIDKey != nil {
+			if reason := uuidKeyConflict(t, tc.UUIDKey, c, tables); reason != "" {
+				return fmt.Errorf("config: uuid_key of table %s cannot be applied: %s", tableName, reason)
+			}
+		}
+		for fkName := range tc.RenameConstraints {
+			if !slices.ContainsFunc(t.ForeignKeys, func(fk foreignKey) bool { return fk.Name == fkName }) {
+				return fmt.Errorf("config: rename_constraints references unknown foreign key %s on %s", fkName, tableName)
+			}
+		}
+		for colName, cc := range tc.Columns {
+			col, ok := t.column(colName)
+			if !ok {
+				return fmt.Errorf("config references unknown column %s.%s", tableName, colName)
+			}
+			if col.Generated != "" && (cc.normalizes() || cc.Encrypt != "" || cc.Transform != "") {
+				return fmt.Errorf("config: %s.%s is a generated column, computed on the destination rather than copied", tableName, colName)
+			}
+			if cc.normalizes() && !isCharacterType(col.DataType) {
+				return fmt.Errorf("config: normalization on %s.%s requires a character column, got %s", tableName, colName, col.DataType)
+			}
+			if cc.Transform != "" && !isCharacterType(col.DataType) {
+				return fmt.Errorf("config: transform %s on %s.%s requires a character column, got %s", cc.Transform, tableName, colName, col.DataType)
+			}
+			if cc.Encrypt != "" {
+				if reason := encryptionConflict(t, tc, colName, tables); reason != "" {
+					return fmt.Errorf("config: column %s.%s cannot be encrypted: %s", tableName, colName, reason)
+				}
+			}
+		}
+	}
+	for key := range c.DefaultRewrites {
+		tableName, colName := resolveColumnKey(key, tables)
+		t, ok := byName[tableName]
+		if !ok {
+			return fmt.Errorf("config: default_rewrites references unknown table %s", tableName)
+		}
+		col, ok := t.column(colName)
+		if !ok {
+			return fmt.Errorf("config: default_rewrites references unknown column %s.%s", tableName, colName)
+		}
+		if col.Generated != "" {
+			return fmt.Errorf("config: default_rewrites cannot rewrite generated column %s.%s", tableName, colName)
+		}
+	}
+	return nil
+}
+
+func (cc ColumnConfig) normalizes() bool {
+	return cc.NullifyEmptyStrings || cc.EmptyStringIfNull || cc.NullIfValue != nil
+}
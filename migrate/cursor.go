@@ -0,0 +1,258 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// copyCursor is the name of the cursor a source connection reads
+	// through; a connection copies one table or range at a time.
+	copyCursor = "farewall_copy"
+
+	defaultFetchMinRows = 100
+	defaultFetchMaxRows = 100000
+)
+
+// cursorFetchSize returns the rows per FETCH for reading t through a
+// cursor, or 0 to read it with a single SELECT. The table's fetch_size
+// wins; otherwise a table whose average row, from pg_table_size and
+// reltuples, is wider than --cursor-row-width uses --cursor-fetch-size.
+// Tables never analyzed have no estimate and are read with a SELECT.
+func cursorFetchSize(ctx context.Context, source Querier, t Table, tc TableConfig, opts Options) (int, error) {
+	if tc.FetchSize > 0 {
+		return tc.FetchSize, nil
+	}
+	if opts.CursorRowWidth <= 0 {
+		return 0, nil
+	}
+	var width int64
+	err := source.QueryRow(ctx, `
+		SELECT CASE WHEN c.reltuples > 0 THEN (pg_table_size(c.oid) / c.reltuples)::bigint ELSE 0 END
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2
+	`, t.sourceSchema(), t.baseName()).Scan(&width)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate the row width of %s: %w", t.Name, err)
+	}
+	if width <= opts.CursorRowWidth {
+		return 0, nil
+	}
+	fmt.Printf("  Average row is %s, over --cursor-row-width\n", formatBytes(width))
+	return opts.CursorFetchSize, nil
+}
+
+// queryCursor runs sql, which must be a read-only statement, through a
+// server-side cursor in a read-only transaction, fetching fetchSize rows
+// at a time. At most fetchSize rows are held in memory instead of however
+// many the connection buffers for one streaming SELECT. Like lockShared,
+// the wrapping statements bypass the statement check; none of them can
+// write.
+// With a sizer the rows per FETCH follow it instead of staying at
+// fetchSize. A connection reading a --consistent-snapshot is already in a
+// transaction, so the cursor lives in a savepoint of it instead.
+func (s *SourceConn) queryCursor(ctx context.Context, sql string, fetchSize int, sizer *fetchSizer, args ...any) (pgx.Rows, error) {
+	if !readOnlyStatement(sql) {
+		return nil, errSourceWrite
+	}
+	begin, end := "BEGIN READ ONLY", []string{"ROLLBACK"}
+	if s.snapshot != "" {
+		begin = "SAVEPOINT " + copyCursor
+		end = []string{"ROLLBACK TO SAVEPOINT " + copyCursor, "RELEASE SAVEPOINT " + copyCursor}
+	}
+	r := &cursorRows{ctx: ctx, conn: s.conn, fetchSize: fetchSize, sizer: sizer, end: end}
+	if _, err := s.conn.Exec(ctx, begin); err != nil {
+		return nil, err
+	}
+	if _, err := s.conn.Exec(ctx, "DECLARE "+copyCursor+" NO SCROLL CURSOR FOR "+sql, args...); err != nil {
+		r.rollback()
+		return nil, err
+	}
+	if err := r.fetch(); err != nil {
+		r.rollback()
+		return nil, err
+	}
+	return r, nil
+}
+
+// cursorRows reads the batches of a cursor opened by queryCursor as one
+// result. Close ends the transaction, or rolls back to the savepoint, which
+// also closes the cursor.
+type cursorRows struct {
+	pgx.Rows // the current batch
+
+	ctx  context.Context
+	conn Querier
+	// end are the statements that close the cursor
+	end       []string
+	fetchSize int
+	sizer     *fetchSizer
+	// n counts the rows of the current batch, bytes their size and started
+	// when it was fetched; a short batch is the last
+	n       int
+	bytes   int64
+	started time.Time
+	err     error
+	closed  bool
+}
+
+// fetch starts the next batch.
+func (r *cursorRows) fetch() error {
+	if r.sizer != nil {
+		r.fetchSize = r.sizer.current()
+	}
+	rows, err := r.conn.Query(r.ctx, fmt.Sprintf("FETCH %d FROM %s", r.fetchSize, copyCursor))
+	if err != nil {
+		return err
+	}
+	r.Rows, r.n, r.bytes, r.started = rows, 0, 0, time.Now()
+	return nil
+}
+
+func (r *cursorRows) Next() bool {
+	for r.err == nil {
+		if r.Rows.Next() {
+			r.n++
+			if r.sizer != nil {
+				for _, v := range r.Rows.RawValues() {
+					r.bytes += int64(len(v))
+				}
+			}
+			return true
+		}
+		r.Rows.Close()
+		if r.err = r.Rows.Err(); r.err != nil || r.n < r.fetchSize {
+			return false
+		}
+		if r.sizer != nil {
+			// The batch took as long as it took to be written, too
+			r.sizer.observe(r.fetchSize, r.bytes, time.Since(r.started))
+		}
+		r.err = r.fetch()
+	}
+	return false
+}
+
+func (r *cursorRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Rows.Err()
+}
+
+// Close ends the read-only transaction, even when the copy failed, so the
+// connection can be used for the next table or a retry. Nothing was
+// written, so it rolls back.
+func (r *cursorRows) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.Rows.Close()
+	if err := r.rollback(); err != nil && r.err == nil {
+		r.err = fmt.Errorf("failed to close the source cursor: %w", err)
+	}
+}
+
+func (r *cursorRows) rollback() error {
+	for _, sql := range r.end {
+		if _, err := r.conn.Exec(context.Background(), sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchSizer adapts the rows per FETCH of the cursor reads of one table
+// with --fetch-target: after every full batch the size is scaled by how far
+// the batch's wall time, reading and writing, was from the target, by at
+// most a factor of two either way, and kept within --fetch-min-rows and
+// --fetch-max-rows. The split ranges of a table share one sizer.
+type fetchSizer struct {
+	// run logs the sizes with --debug
+	run      *runEnv
+	table    string
+	target   time.Duration
+	min, max int
+
+	mu      sync.Mutex
+	size    int
+	summary FetchSizing
+	elapsed time.Duration
+	bytes   int64
+}
+
+// FetchSizing summarizes the adapted fetch sizes of one table, so a good
+// fetch_size can be pinned in the config later.
+type FetchSizing struct {
+	TargetSeconds float64 `json:"target_seconds"`
+	Initial       int     `json:"initial"`
+	Final         int     `json:"final"`
+	Smallest      int     `json:"smallest"`
+	Largest       int     `json:"largest"`
+	// Batches counts the full batches measured
+	Batches int `json:"batches"`
+	// AvgBatchSeconds and AvgBatchBytes are the means of those batches
+	AvgBatchSeconds float64 `json:"avg_batch_seconds"`
+	AvgBatchBytes   int64   `json:"avg_batch_bytes"`
+}
+
+func newFetchSizer(table string, initial int, opts Options, run *runEnv) *fetchSizer {
+	size := min(max(initial, opts.FetchMinRows), opts.FetchMaxRows)
+	return &fetchSizer{
+		run:     run,
+		table:   table,
+		target:  opts.FetchTarget,
+		min:     opts.FetchMinRows,
+		max:     opts.FetchMaxRows,
+		size:    size,
+		summary: FetchSizing{TargetSeconds: opts.FetchTarget.Seconds(), Initial: size, Final: size, Smallest: size, Largest: size},
+	}
+}
+
+func (f *fetchSizer) current() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// observe records a full batch of rows fetched with size and sets the size
+// of the next one.
+func (f *fetchSizer) observe(size int, bytes int64, elapsed time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.summary.Batches++
+	f.elapsed += elapsed
+	f.bytes += bytes
+	ratio := 2.0
+	if elapsed > 0 {
+		ratio = min(max(f.target.Seconds()/elapsed.Seconds(), 0.5), 2)
+	}
+	next := min(max(int(float64(size)*ratio), f.min), f.max)
+	f.run.debugf("%s: batch of %d rows (%s) took %s; next fetch %d rows", f.table, size, formatBytes(bytes), elapsed.Round(time.Millisecond), next)
+	f.size = next
+	f.summary.Final = next
+	f.summary.Smallest = min(f.summary.Smallest, next)
+	f.summary.Largest = max(f.summary.Largest, next)
+}
+
+// report returns the summary of the table, nil when no batch was full.
+func (f *fetchSizer) report() *FetchSizing {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.summary.Batches == 0 {
+		return nil
+	}
+	s := f.summary
+	s.AvgBatchSeconds = f.elapsed.Seconds() / float64(s.Batches)
+	s.AvgBatchBytes = f.bytes / int64(s.Batches)
+	return &s
+}
@@ -0,0 +1,87 @@
+package migrate
+
+import "migration-tool/internal/sqlutil"
+
+// tableDDL returns the statements that create t on the destination: the
+// CREATE TABLE itself followed by any partitions. It only renders SQL, so
+// everything that shapes the emitted DDL goes through here and can be
+// checked without a database.
+func tableDDL(t Table, pc *PartitionConfig, outliers string) []string {
+	src, t := t, onDestination(t)
+	if t.PartitionOf != "" {
+		return append([]string{partitionOfDDL(t)}, commentDDL(t)...)
+	}
+	var defs []sqlutil.ColumnDef
+	for _, c := range t.Columns {
+		// Inherited columns are declared by the parent
+		if c.Inherited {
+			continue
+		}
+		def := sqlutil.ColumnDef{Name: c.Name, Type: c.DataType, Collation: c.Collation, NotNull: c.IsNullable == "NO", Generated: c.Generated, Virtual: c.GeneratedVirtual, Identity: c.Identity}
+		if c.Default != nil {
+			def.Default = *c.Default
+		}
+		defs = append(defs, def)
+	}
+
+	var constraints []string
+	if len(t.PrimaryKey) > 0 {
+		constraints = append(constraints, sqlutil.PrimaryKey(t.PrimaryKey))
+	}
+	for _, ck := range t.Checks {
+		// Inherited checks are declared by the parent, like columns
+		if !ck.Inherited {
+			constraints = append(constraints, sqlutil.NamedConstraint(ck.Name, ck.Definition))
+		}
+	}
+
+	parents := make([]string, len(t.Inherits))
+	for i, p := range t.Inherits {
+		// checkSchemaRoutes keeps parents in the schema of the child
+		parents[i] = schemaIdent(t.Schema, p)
+	}
+
+	sql := sqlutil.CreateTable(destIdent(t), defs, constraints, parents)
+	if t.PartitionKey != "" {
+		sql += " PARTITION BY " + t.PartitionKey
+	}
+	stmts := []string{sql}
+	if pc != nil {
+		stmts[0] += sqlutil.PartitionByRange(src.destColumn(pc.Column))
+		stmts = append(stmts, partitionDDL(t, pc, outliers)...)
+	}
+	return append(stmts, commentDDL(t)...)
+}
+
+// partitionOfDDL creates the source partition t, which takes its columns,
+// defaults and primary key from its partitioned table; only the checks of
+// its own are declared.
+func partitionOfDDL(t Table) string {
+	var constraints []string
+	for _, ck := range t.Checks {
+		if !ck.Inherited {
+			constraints = append(constraints, sqlutil.NamedConstraint(ck.Name, ck.Definition))
+		}
+	}
+	// checkSchemaRoutes keeps partitions in the schema of their table
+	sql := sqlutil.PartitionOf(destIdent(t), schemaIdent(t.Schema, t.PartitionOf), constraints, t.PartitionBound)
+	if t.PartitionKey != "" {
+		sql += " PARTITION BY " + t.PartitionKey
+	}
+	return sql
+}
+
+// commentDDL returns the COMMENT ON statements of the destination table t
+// and its columns.
+func commentDDL(t Table) []string {
+	var stmts []string
+	if t.Comment != "" {
+		stmts = append(stmts, sqlutil.CommentOn("TABLE", destIdent(t), t.Comment))
+	}
+	for _, c := range t.Columns {
+		if c.Comment != "" {
+			stmts = append(stmts, sqlutil.CommentOn("COLUMN", destIdent(t)+"."+sqlutil.QuoteIdent(c.Name), c.Comment))
+		}
+	}
+	return stmts
+}
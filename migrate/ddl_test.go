@@ -0,0 +1,213 @@
+package migrate
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/ddl with the DDL emitted now")
+
+func ptr(s string) *string { return &s }
+
+// ddlCase is the source tables of one golden file, with the config and
+// flags that shape their destination DDL.
+type ddlCase struct {
+	name     string
+	tables   []Table
+	cfg      *Config
+	schemas  schemaMap
+	fold     bool
+	enums    []enumType
+	domains  []domainType
+	outliers string
+}
+
+var ddlCases = []ddlCase{
+	{
+		name: "identity",
+		tables: []Table{{Name: "accounts", PrimaryKey: []string{"id"}, Columns: []Column{
+			{Name: "id", DataType: "bigint", IsNullable: "NO", Identity: "ALWAYS"},
+			{Name: "legacy_no", DataType: "integer", IsNullable: "NO", Identity: "BY DEFAULT"},
+			{Name: "name", DataType: "text", IsNullable: "YES"},
+		}}},
+	},
+	{
+		name: "generated",
+		tables: []Table{{Name: "line_items", PrimaryKey: []string{"id"}, Columns: []Column{
+			{Name: "id", DataType: "integer", IsNullable: "NO"},
+			{Name: "price", DataType: "numeric(10,2)", IsNullable: "NO"},
+			{Name: "total", DataType: "numeric", IsNullable: "YES", Generated: "(price * (qty)::numeric)"},
+			{Name: "qty", DataType: "integer", IsNullable: "NO", Default: ptr("1")},
+			{Name: "label", DataType: "text", IsNullable: "YES", Generated: "upper(name)", GeneratedVirtual: true},
+			{Name: "name", DataType: "text", IsNullable: "YES"},
+		}}},
+	},
+	{
+		name: "defaults",
+		tables: []Table{{Name: "events", PrimaryKey: []string{"id"}, Columns: []Column{
+			{Name: "id", DataType: "integer", IsNullable: "NO", Default: ptr("nextval('events_id_seq'::regclass)")},
+			{Name: "big_id", DataType: "bigint", IsNullable: "NO", Default: ptr("nextval('events_big_id_seq'::regclass)")},
+			{Name: "xata_id", DataType: "text", IsNullable: "NO", Default: ptr("('rec_'::text || xata_private.xid())")},
+			{Name: "created_at", DataType: "timestamp with time zone", IsNullable: "NO", Default: ptr("now()")},
+			{Name: "status", DataType: "text", IsNullable: "NO", Default: ptr("'new'::text"), Collation: `"C"`},
+			{Name: "title", DataType: "text", IsNullable: "YES", Collation: `"und-x-icu"`},
+			{Name: "score", DataType: "double precision", IsNullable: "YES", Default: ptr("0.5")},
+		}, Checks: []checkConstraint{{Name: "events_score_check", Definition: "CHECK ((score >= (0)::double precision))"}}}},
+	},
+	{
+		name: "arrays",
+		tables: []Table{{Name: "profiles", PrimaryKey: []string{"id"}, Columns: []Column{
+			{Name: "id", DataType: "uuid", IsNullable: "NO", Default: ptr("gen_random_uuid()")},
+			{Name: "tags", DataType: "text[]", IsNullable: "YES", Default: ptr("'{}'::text[]")},
+			{Name: "scores", DataType: "integer[]", IsNullable: "NO", Default: ptr("ARRAY[0, 0]")},
+			{Name: "grid", DataType: "numeric(4,1)[]", IsNullable: "YES"},
+			{Name: "moods", DataType: "mood[]", IsNullable: "YES", TypeSchema: "public", TypeName: "mood"},
+		}}},
+	},
+	{
+		name: "quoted names",
+		tables: []Table{{Name: "Order Items", PrimaryKey: []string{"Order ID", "select"}, Comment: "the user's orders", Columns: []Column{
+			{Name: "Order ID", DataType: "integer", IsNullable: "NO"},
+			{Name: "select", DataType: "integer", IsNullable: "NO"},
+			{Name: "user", DataType: "text", IsNullable: "YES", Comment: `says "hi"`},
+			{Name: `we"ird`, DataType: "text", IsNullable: "YES"},
+			{Name: "MixedCase", DataType: "text", IsNullable: "YES"},
+			{Name: "prénom", DataType: "text", IsNullable: "YES"},
+		}}},
+	},
+	{
+		name: "partitions",
+		tables: []Table{
+			{Name: "measurements", PrimaryKey: []string{"id", "taken_at"}, PartitionKey: "RANGE (taken_at)", Columns: []Column{
+				{Name: "id", DataType: "bigint", IsNullable: "NO"},
+				{Name: "taken_at", DataType: "date", IsNullable: "NO"},
+				{Name: "value", DataType: "real", IsNullable: "YES"},
+			}},
+			{Name: "measurements_2024", PartitionOf: "measurements", PartitionBound: "FOR VALUES FROM ('2024-01-01') TO ('2025-01-01')", Columns: []Column{
+				{Name: "id", DataType: "bigint", IsNullable: "NO"},
+				{Name: "taken_at", DataType: "date", IsNullable: "NO"},
+				{Name: "value", DataType: "real", IsNullable: "YES"},
+			}, Checks: []checkConstraint{{Name: "positive", Definition: "CHECK ((value > (0)::double precision))"}}},
+			{Name: "logs", PrimaryKey: []string{"id"}, Columns: []Column{
+				{Name: "id", DataType: "bigint", IsNullable: "NO"},
+				{Name: "logged_at", DataType: "timestamp with time zone", IsNullable: "NO"},
+			}},
+		},
+		cfg: &Config{Tables: map[string]TableConfig{"logs": {PartitionBy: &PartitionConfig{Column: "logged_at", Partitions: []PartitionRange{
+			{Name: "logs_2024", From: "2024-01-01", To: "2025-01-01"},
+			{Name: "logs_2025", From: "2025-01-01", To: "2026-01-01"},
+		}}}}},
+		outliers: partitionOutliersDefault,
+	},
+	{
+		name: "inheritance",
+		tables: []Table{
+			{Name: "vehicles", PrimaryKey: []string{"id"}, HasChildren: true, Columns: []Column{
+				{Name: "id", DataType: "integer", IsNullable: "NO"},
+				{Name: "name", DataType: "text", IsNullable: "YES"},
+			}, Checks: []checkConstraint{{Name: "name_set", Definition: "CHECK ((name <> ''::text))"}}},
+			{Name: "cars", Inherits: []string{"vehicles"}, PrimaryKey: []string{"id"}, Columns: []Column{
+				{Name: "id", DataType: "integer", IsNullable: "NO", Inherited: true},
+				{Name: "name", DataType: "text", IsNullable: "YES", Inherited: true},
+				{Name: "doors", DataType: "smallint", IsNullable: "YES"},
+			}, Checks: []checkConstraint{{Name: "name_set", Definition: "CHECK ((name <> ''::text))", Inherited: true}}},
+		},
+	},
+	{
+		name: "rewrites",
+		tables: []Table{
+			{Name: "Users", PrimaryKey: []string{"ID"}, Columns: []Column{
+				{Name: "ID", DataType: "integer", IsNullable: "NO", Default: ptr("nextval('\"Users_ID_seq\"'::regclass)")},
+				{Name: "Email", DataType: "text", IsNullable: "NO"},
+				{Name: "joined", DataType: "timestamp without time zone", IsNullable: "YES", Default: ptr("CURRENT_TIMESTAMP")},
+				{Name: "ref", DataType: "bigint", IsNullable: "NO", Identity: "BY DEFAULT"},
+			}},
+			{Name: "sales.orders", Schema: "sales", PrimaryKey: []string{"id"}, Columns: []Column{
+				{Name: "id", DataType: "bigint", IsNullable: "NO", Default: ptr("nextval('sales.orders_id_seq'::regclass)")},
+				{Name: "amount", DataType: "sales.money_amount", IsNullable: "NO", Domain: "money_amount"},
+				{Name: "stage", DataType: "sales.stage", IsNullable: "YES", TypeSchema: "sales", TypeName: "stage"},
+				{Name: "total", DataType: "numeric", IsNullable: "YES", Generated: "sales.with_tax(amount)"},
+				{Name: "note", DataType: "text", IsNullable: "YES"},
+			}, Checks: []checkConstraint{{Name: "orders_note_check", Definition: "CHECK (sales.valid_note(note))"}}},
+			{Name: "audit_log", PrimaryKey: []string{"id"}, Columns: []Column{
+				{Name: "id", DataType: "bigint", IsNullable: "NO"},
+				{Name: "entry", DataType: "text", IsNullable: "YES"},
+			}},
+		},
+		cfg: &Config{
+			Tables:       map[string]TableConfig{"Users": {RenameTo: "members", Columns: map[string]ColumnConfig{"Email": {RenameTo: "email_address"}}}},
+			SchemaRoutes: []SchemaRoute{{Pattern: "audit_*", Schema: "archive"}},
+			DefaultRewrites: map[string]string{
+				"Users.joined":    "",
+				"Users.ref":       "0",
+				"sales.orders.id": "nextval('sales.order_ids'::regclass)",
+			},
+		},
+		schemas: schemaMap{"sales": "billing"},
+		fold:    true,
+		enums:   []enumType{{Schema: "sales", Name: "stage"}},
+		domains: []domainType{{Schema: "sales", Name: "money_amount", BaseType: "numeric(12,2)", Default: ptr("0"), NotNull: true}},
+	},
+}
+
+// golden renders the DDL of c the way a run would: Xata specifics are
+// sanitized, domains flattened, defaults rewritten and tables and types
+// named and mapped to their destination schemas before any SQL is emitted.
+func (c ddlCase) golden() string {
+	tables := make([]Table, len(c.tables))
+	for i, t := range c.tables {
+		t.Columns = append([]Column(nil), t.Columns...)
+		for j := range t.Columns {
+			sanitizeColumn(&t.Columns[j])
+		}
+		tables[i] = t
+	}
+	report := &Report{}
+	if c.domains != nil {
+		flattenDomains(tables, c.domains, report)
+	}
+	applyDefaultRewrites(tables, c.cfg.defaultRewrites(), report)
+	applyNames(tables, c.cfg, c.schemas, c.fold)
+	mapSchemaReferences(tables, c.schemas)
+	mapObjectSchemas(tables, c.enums, nil, nil, nil, c.schemas)
+
+	var b strings.Builder
+	for _, t := range tables {
+		for _, stmt := range tableDDL(t, c.cfg.table(t.Name).PartitionBy, c.outliers) {
+			b.WriteString(stmt + ";\n")
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// TestTableDDL compares the DDL of every case with its golden file in
+// testdata/ddl. After a deliberate change to the DDL, rewrite them with
+//
+//	go test ./migrate -run TestTableDDL -update
+//
+// and review the diff.
+func TestTableDDL(t *testing.T) {
+	for _, c := range ddlCases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join("testdata", "ddl", strings.ReplaceAll(c.name, " ", "_")+".sql")
+			got := c.golden()
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("DDL differs from %s (run with -update to accept it):\n got:\n%s\nwant:\n%s", path, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	schemaChangeDefaultRewritten = "default_rewritten"
+	schemaChangeDefaultRemoved   = "default_removed"
+)
+
+// splitColumnKey splits a default_rewrites key, table.column, at its first
+// dot; column names may contain dots themselves.
+func splitColumnKey(key string) (table, column string, ok bool) {
+	table, column, ok = strings.Cut(key, ".")
+	return table, column, ok && table != "" && column != ""
+}
+
+// resolveColumnKey splits key like splitColumnKey, except that a table of
+// another schema, keyed schema.table, is matched by its whole name first.
+func resolveColumnKey(key string, tables []Table) (table, column string) {
+	for _, t := range tables {
+		if t.Schema != "" && t.Schema != defaultSchema && strings.HasPrefix(key, t.Name+".") && len(t.Name) > len(table) {
+			table = t.Name
+		}
+	}
+	if table != "" {
+		return table, key[len(table)+1:]
+	}
+	table, column, _ = splitColumnKey(key)
+	return table, column
+}
+
+func validateDefaultRewrites(rewrites map[string]string) error {
+	for key := range rewrites {
+		if _, _, ok := splitColumnKey(key); !ok {
+			return fmt.Errorf("config: default_rewrites key %q must be table.column", key)
+		}
+	}
+	return nil
+}
+
+// applyDefaultRewrites replaces the default of every column named in
+// rewrites with its expression, or removes it for an empty one, and
+// records each change in the report. A sequence default turned into SERIAL
+// by sanitizeColumn goes back to its integer type, and an identity column
+// loses its identity, since the sequence is no longer wanted.
+func applyDefaultRewrites(tables []Table, rewrites map[string]string, report *Report) {
+	if len(rewrites) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(rewrites))
+	for key := range rewrites {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		tableName, colName := resolveColumnKey(key, tables)
+		i := slices.IndexFunc(tables, func(t Table) bool { return t.Name == tableName })
+		if i < 0 {
+			continue
+		}
+		t := &tables[i]
+		j := slices.IndexFunc(t.Columns, func(c Column) bool { return c.Name == colName })
+		if j < 0 {
+			continue
+		}
+		c := &t.Columns[j]
+
+		switch c.DataType {
+		case "SERIAL":
+			c.DataType = "integer"
+		case "BIGSERIAL":
+			c.DataType = "bigint"
+		}
+		c.Identity = ""
+		change := SchemaChange{Table: t.Name, Column: c.Name, DataType: c.DataType, Change: schemaChangeDefaultRewritten}
+		if c.Default != nil {
+			change.SourceDefault = *c.Default
+		}
+		if expr := rewrites[key]; expr != "" {
+			c.Default = &expr
+			change.Default = expr
+			fmt.Printf("  %s.%s: default rewritten to %s\n", t.Name, c.Name, expr)
+		} else {
+			c.Default = nil
+			change.Change = schemaChangeDefaultRemoved
+			fmt.Printf("  %s.%s: default removed\n", t.Name, c.Name)
+		}
+		report.SchemaChanges = append(report.SchemaChanges, change)
+	}
+}
+
+// checkDefaultRewrites has the destination plan every rewritten default as
+// a value of its column's type. EXPLAIN resolves functions, operators and
+// casts without evaluating anything, so a volatile default such as nextval
+// is not advanced.
+func checkDefaultRewrites(ctx context.Context, dest Querier, tables []Table, rewrites map[string]string) error {
+	for _, t := range tables {
+		for _, c := range t.Columns {
+			expr, ok := rewrites[t.Name+"."+c.Name]
+			if !ok || expr == "" {
+				continue
+			}
+			if _, err := dest.Exec(ctx, "EXPLAIN SELECT ("+expr+")::"+c.DataType); err != nil {
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("default_rewrites: %s for %s.%s is not a valid %s default on the destination: %w", expr, t.Name, c.Name, c.DataType, err)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// stateSchema holds the tool's persistent state tables on the destination.
+const stateSchema = "_farewall"
+
+const (
+	hashStatePrefix = "row_hashes_"
+
+	// Temporary object purposes, see tempTableName
+	tempNewHashes = "hashes"
+	tempStaging   = "staging"
+
+	differentialChunkSize = 10000
+)
+
+// DifferentialStats summarizes a differential copy of one table.
+type DifferentialStats struct {
+	New       int64 `json:"new"`
+	Changed   int64 `json:"changed"`
+	Unchanged int64 `json:"unchanged"`
+	Deleted   int64 `json:"deleted"`
+	Vanished  int64 `json:"vanished"`
+}
+
+// hashStateTable is the destination table holding PK -> row hash for the
+// rows of t as of the last run.
+func hashStateTable(t Table) string {
+	return sqlutil.QualifiedIdent(stateSchema, physicalName(hashStatePrefix+t.Name))
+}
+
+// differentialEligible reports whether t can be synced by comparing row
+// hashes. Inheritance hierarchies and partitioned tables are excluded
+// because recreating a parent cascades to its children.
+func differentialEligible(t Table) bool {
+	return len(t.PrimaryKey) > 0 && len(t.Inherits) == 0 && !t.HasChildren && t.PartitionKey == "" && t.PartitionOf == ""
+}
+
+// planDifferential returns the tables that can be synced differentially in
+// this run: eligible tables that already exist on the destination together
+// with their hash state. Everything else is recreated and copied in full.
+func planDifferential(ctx context.Context, dest Querier, tables []Table) (map[string]bool, error) {
+	plan := map[string]bool{}
+	for _, t := range tables {
+		if !differentialEligible(t) {
+			fmt.Printf("  %s: no primary key or uses inheritance, will be fully recopied\n", t.Name)
+			continue
+		}
+		var ok bool
+		err := dest.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL AND to_regclass($2) IS NOT NULL`,
+			destIdent(t), hashStateTable(t)).Scan(&ok)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check differential state for %s: %w", t.Name, err)
+		}
+		if ok {
+			plan[t.Name] = true
+		} else {
+			fmt.Printf("  %s: no previous hash state, will be fully copied\n", t.Name)
+		}
+	}
+	return plan, nil
+}
+
+// castType returns the type a text key value must be cast back to.
+func castType(c Column) string {
+	switch c.DataType {
+	case "SERIAL":
+		return "integer"
+	case "BIGSERIAL":
+		return "bigint"
+	}
+	return c.DataType
+}
+
+// sourceHashQuery selects each row's primary key (as text[]) and an md5 of
+// the whole row on the source.
+func sourceHashQuery(t Table) string {
+	keys := make([]string, len(t.PrimaryKey))
+	for i, k := range t.PrimaryKey {
+		keys[i] = sqlutil.QuoteIdent(k) + "::text"
+	}
+	return fmt.Sprintf("SELECT ARRAY[%s]::text[], md5(ROW(%s)::text) FROM %s",
+		strings.Join(keys, ", "), strings.Join(sourceColumns(t), ", "), fromClause(t))
+}
+
+// keyMatch builds "(pk1, pk2) IN (SELECT k1::type1, ... FROM <keys>)" where
+// keyExprs yields the text representation of each key column. columns are
+// the key columns as named on the side the condition runs on.
+func keyMatch(t Table, columns, keyExprs []string, from string) string {
+	casts := make([]string, len(t.PrimaryKey))
+	for i, k := range t.PrimaryKey {
+		c, _ := t.column(k)
+		casts[i] = fmt.Sprintf("%s::%s", keyExprs[i], castType(c))
+	}
+	return fmt.Sprintf("(%s) IN (SELECT %s FROM %s)",
+		sqlutil.ColumnList(columns), strings.Join(casts, ", "), from)
+}
+
+// buildHashes streams the source row hashes of t into target on dest.
+func buildHashes(ctx context.Context, source *SourceConn, dest CopyConn, t Table, target string, wal *walMonitor) error {
+	copyOut := "COPY (" + sourceHashQuery(t) + ") TO STDOUT"
+	copyIn := "COPY " + target + " (pk, hash) FROM STDIN"
+	_, _, srcErr, err := pipeCopy(ctx, source, dest, copyOut, copyIn, io.Discard, wal)
+	if srcErr != nil {
+		return fmt.Errorf("failed to hash rows of %s: %w", t.Name, srcErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store row hashes of %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// rebuildHashState recreates the hash state of t from the source. It runs
+// before a full copy, so rows changed while the copy is running show up as
+// changed on the next differential run instead of being missed.
+func rebuildHashState(ctx context.Context, source *SourceConn, dest CopyConn, t Table, wal *walMonitor) error {
+	state := hashStateTable(t)
+	stmts := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + sqlutil.QuoteIdent(stateSchema),
+		sqlutil.DropTable(state, false),
+		"CREATE TABLE " + state + " (pk text[] PRIMARY KEY, hash text NOT NULL)",
+	}
+	for _, stmt := range stmts {
+		if _, err := dest.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to prepare hash state for %s: %w", t.Name, err)
+		}
+	}
+	return buildHashes(ctx, source, dest, t, state, wal)
+}
+
+// copyTableDifferential copies only the rows of t whose hash changed or whose
+// primary key is new since the last run. The comparison runs on the
+// destination against the stored hash state, so memory use in the tool stays
+// bounded by the chunk size regardless of table size.
+func copyTableDifferential(ctx context.Context, source *SourceConn, dest CopyConn, t Table, opts Options, cp *Checkpoint, wal *walMonitor) (stats *DifferentialStats, copiedBytes int64, err error) {
+	newHashes, err := createTempTable(ctx, dest, cp, tempNewHashes, t.Name, "(pk text[] PRIMARY KEY, hash text NOT NULL)")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if derr := dropTempTable(ctx, dest, cp, tempNewHashes, t.Name); derr != nil && err == nil {
+			err = derr
+		}
+	}()
+	staging, err := createTempTable(ctx, dest, cp, tempStaging, t.Name, "(LIKE "+destIdent(t)+")")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if derr := dropTempTable(ctx, dest, cp, tempStaging, t.Name); derr != nil && err == nil {
+			err = derr
+		}
+	}()
+
+	// 1. Hash the source
+	fmt.Println("  Hashing source rows...")
+	if err := buildHashes(ctx, source, dest, t, newHashes, wal); err != nil {
+		return nil, 0, err
+	}
+	return syncHashed(ctx, source, dest, t, opts, cp, newHashes, staging, wal)
+}
+
+// syncHashed runs the rest of copyTableDifferential once the source hashes
+// are in newHashes: it copies the new and changed rows through staging,
+// deletes vanished ones with --delete-extraneous and stores the new state.
+func syncHashed(ctx context.Context, source *SourceConn, dest CopyConn, t Table, opts Options, cp *Checkpoint, newHashes, staging string, wal *walMonitor) (*DifferentialStats, int64, error) {
+	state := hashStateTable(t)
+
+	// 2. Compare against the previous state
+	stats := &DifferentialStats{}
+	err := dest.QueryRow(ctx, `
+		SELECT
+			count(*) FILTER (WHERE h.pk IS NULL),
+			count(*) FILTER (WHERE h.pk IS NOT NULL AND h.hash <> n.hash),
+			count(*) FILTER (WHERE h.hash = n.hash)
+		FROM `+newHashes+` n
+		LEFT JOIN `+state+` h ON h.pk = n.pk
+	`).Scan(&stats.New, &stats.Changed, &stats.Unchanged)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to compare row hashes of %s: %w", t.Name, err)
+	}
+	err = dest.QueryRow(ctx, `
+		SELECT count(*) FROM `+state+` h
+		WHERE NOT EXISTS (SELECT 1 FROM `+newHashes+` n WHERE n.pk = h.pk)
+	`).Scan(&stats.Vanished)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to compare row hashes of %s: %w", t.Name, err)
+	}
+	fmt.Printf("  %d new, %d changed, %d unchanged, %d vanished\n",
+		stats.New, stats.Changed, stats.Unchanged, stats.Vanished)
+
+	// 3. Copy new and changed rows chunk by chunk through the staging table
+	cols := copyColumns(t)
+	var updateCols []string
+	destKey := t.destColumns(t.PrimaryKey)
+	pkSet := make(map[string]bool, len(destKey))
+	for _, k := range destKey {
+		pkSet[k] = true
+	}
+	for _, c := range cols {
+		if !pkSet[c] {
+			updateCols = append(updateCols, c)
+		}
+	}
+	upsert := sqlutil.InsertSelect(destIdent(t), cols, staging) + " " +
+		sqlutil.OnConflictDoUpdate(destKey, updateCols)
+
+	keyParams := make([]string, len(t.PrimaryKey))
+	keyCols := make([]string, len(t.PrimaryKey))
+	for i := range t.PrimaryKey {
+		keyParams[i] = fmt.Sprintf("$%d::text[]", i+1)
+		keyCols[i] = fmt.Sprintf("k%d", i+1)
+	}
+	if err := rowCopyComposites(t); err != nil {
+		return nil, 0, err
+	}
+	fetch := rowSelect(t) + " WHERE " +
+		keyMatch(t, t.PrimaryKey, keyCols, fmt.Sprintf("unnest(%s) AS k(%s)", strings.Join(keyParams, ", "), strings.Join(keyCols, ", ")))
+	pipelines := buildPipelines(t, opts.Config.table(t.Name), "")
+
+	run := runOf(ctx)
+	bar := run.newProgressBar(stats.New+stats.Changed, "  Syncing")
+	var copiedBytes int64
+	var last []string
+	for {
+		keys, err := changedKeys(ctx, dest, state, newHashes, last)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list changed rows of %s: %w", t.Name, err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		last = keys[len(keys)-1]
+
+		// Transpose keys into one text[] parameter per key column
+		args := make([]any, len(t.PrimaryKey))
+		for i := range t.PrimaryKey {
+			col := make([]string, len(keys))
+			for j, k := range keys {
+				col[j] = k[i]
+			}
+			args[i] = col
+		}
+
+		rows, err := source.Query(ctx, fetch, args...)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query changed rows from %s: %w", t.Name, err)
+		}
+		pbRows := &ProgressBarRows{Rows: rows, Bar: bar, WAL: wal, control: run.control}
+		var src pgx.CopyFromSource = pbRows
+		if pipelines != nil {
+			src = newPipelineRows(pbRows, t, pipelines)
+		}
+		_, err = copyInto(ctx, dest, pgx.Identifier{stateSchema, tempTableName(cp.RunID, tempStaging, t.Name)}, cols, src)
+		rows.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to stage changed rows of %s: %w", t.Name, err)
+		}
+		copiedBytes += pbRows.Bytes
+
+		if _, err := dest.Exec(ctx, upsert); err != nil {
+			return nil, 0, fmt.Errorf("failed to upsert changed rows of %s: %w", t.Name, err)
+		}
+		if _, err := dest.Exec(ctx, "TRUNCATE "+staging); err != nil {
+			return nil, 0, fmt.Errorf("failed to clear staging table for %s: %w", t.Name, err)
+		}
+	}
+	bar.Finish()
+	fmt.Println()
+
+	// 4. Optionally delete rows whose key vanished from the source, then store
+	// the new state. Without deletes, vanished keys stay in the state because
+	// their rows are still on the destination.
+	tx, err := dest.Begin(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to update hash state of %s: %w", t.Name, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if opts.DeleteExtraneous && stats.Vanished > 0 {
+		keyExprs := make([]string, len(t.PrimaryKey))
+		for i := range t.PrimaryKey {
+			keyExprs[i] = fmt.Sprintf("h.pk[%d]", i+1)
+		}
+		vanished := fmt.Sprintf("%s h WHERE NOT EXISTS (SELECT 1 FROM %s n WHERE n.pk = h.pk)", state, newHashes)
+		tag, err := tx.Exec(ctx, "DELETE FROM "+destIdent(t)+" WHERE "+keyMatch(t, destKey, keyExprs, vanished))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to delete vanished rows of %s: %w", t.Name, err)
+		}
+		stats.Deleted = tag.RowsAffected()
+		fmt.Printf("  Deleted %d vanished rows\n", stats.Deleted)
+		if _, err := tx.Exec(ctx, "TRUNCATE "+state); err != nil {
+			return nil, 0, fmt.Errorf("failed to update hash state of %s: %w", t.Name, err)
+		}
+	} else {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+state+" h USING "+newHashes+" n WHERE h.pk = n.pk"); err != nil {
+			return nil, 0, fmt.Errorf("failed to update hash state of %s: %w", t.Name, err)
+		}
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO "+state+" (pk, hash) SELECT pk, hash FROM "+newHashes); err != nil {
+		return nil, 0, fmt.Errorf("failed to update hash state of %s: %w", t.Name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, fmt.Errorf("failed to update hash state of %s: %w", t.Name, err)
+	}
+
+	return stats, copiedBytes, nil
+}
+
+// changedKeys returns the next chunk of new or changed primary keys after
+// last, in key order.
+func changedKeys(ctx context.Context, dest CopyConn, state, newHashes string, last []string) ([][]string, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.pk
+		FROM `+newHashes+` n
+		LEFT JOIN `+state+` h ON h.pk = n.pk
+		WHERE (h.pk IS NULL OR h.hash <> n.hash)
+		  AND ($1::text[] IS NULL OR n.pk > $1::text[])
+		ORDER BY n.pk
+		LIMIT $2
+	`, last, differentialChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]string
+	for rows.Next() {
+		var k []string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
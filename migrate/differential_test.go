@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+func TestSyncHashedWithFakeConnections(t *testing.T) {
+	users := Table{Name: "users", PrimaryKey: []string{"id", "region"}, Columns: []Column{
+		{Name: "id", DataType: "bigint"},
+		{Name: "region", DataType: "text"},
+		{Name: "name", DataType: "text"},
+	}}
+	state := hashStateTable(users)
+
+	for _, tt := range []struct {
+		name             string
+		deleteExtraneous bool
+		wantDeleted      int64
+	}{
+		{name: "keep vanished rows"},
+		{name: "delete extraneous", deleteExtraneous: true, wantDeleted: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+			cp.RunID = "r1"
+			newHashes := sqlutil.QualifiedIdent(stateSchema, tempTableName(cp.RunID, tempNewHashes, users.Name))
+			stagingName := tempTableName(cp.RunID, tempStaging, users.Name)
+			staging := sqlutil.QualifiedIdent(stateSchema, stagingName)
+
+			// two chunks of changed keys, then none
+			dest := &fakeConn{results: []fakeResult{
+				{match: "FILTER (WHERE h.pk IS NULL)", rows: [][]any{{int64(2), int64(1), int64(5)}}},
+				{match: "SELECT count(*) FROM " + state, rows: [][]any{{int64(2)}}},
+				{match: "SELECT n.pk", once: true, rows: [][]any{{[]string{"1", "eu"}}, {[]string{"2", "eu"}}}},
+				{match: "SELECT n.pk", once: true, rows: [][]any{{[]string{"3", "us"}}}},
+				{match: `DELETE FROM "users"`, tag: "DELETE 2"},
+			}}
+			source := &fakeConn{results: []fakeResult{
+				{match: "unnest(", once: true, rows: [][]any{{int64(1), "eu", "Ada"}, {int64(2), "eu", "Bob"}}},
+				{match: "unnest(", once: true, rows: [][]any{{int64(3), "us", "Cy"}}},
+			}}
+
+			opts := Options{DeleteExtraneous: tt.deleteExtraneous}
+			stats, _, err := syncHashed(context.Background(), &SourceConn{conn: source}, dest, users, opts, cp, newHashes, staging, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := DifferentialStats{New: 2, Changed: 1, Unchanged: 5, Vanished: 2, Deleted: tt.wantDeleted}
+			if *stats != want {
+				t.Errorf("stats = %+v, want %+v", *stats, want)
+			}
+
+			// each chunk of keys starts after the last key of the one before
+			var after []any
+			for _, args := range dest.argsOfAll("SELECT n.pk") {
+				after = append(after, args[0])
+			}
+			if wantAfter := []any{[]string(nil), []string{"2", "eu"}, []string{"3", "us"}}; !reflect.DeepEqual(after, wantAfter) {
+				t.Errorf("changed keys read after %v, want %v", after, wantAfter)
+			}
+			// and its rows are fetched with one text[] per key column
+			if got, wantFetch := source.argsOfAll("unnest("), [][]any{
+				{[]string{"1", "2"}, []string{"eu", "eu"}},
+				{[]string{"3"}, []string{"us"}},
+			}; !reflect.DeepEqual(got, wantFetch) {
+				t.Errorf("fetched rows of keys %v, want %v", got, wantFetch)
+			}
+			staged := dest.copied[pgx.Identifier{stateSchema, stagingName}.Sanitize()]
+			if wantStaged := [][]any{{int64(1), "eu", "Ada"}, {int64(2), "eu", "Bob"}, {int64(3), "us", "Cy"}}; !reflect.DeepEqual(staged, wantStaged) {
+				t.Errorf("staged %v, want %v", staged, wantStaged)
+			}
+			if got := statementsOf(dest, `INSERT INTO "users"`); len(got) != 2 || !strings.Contains(got[0], `ON CONFLICT ("id", "region") DO UPDATE`) {
+				t.Errorf("upserts = %q, want one per chunk on the primary key", got)
+			}
+			if got := statementsOf(dest, "TRUNCATE "+staging); len(got) != 2 {
+				t.Errorf("staging cleared %d times, want once per chunk", len(got))
+			}
+
+			deleted := `DELETE FROM "users" WHERE ("id", "region") IN (SELECT h.pk[1]::bigint, h.pk[2]::text FROM ` + state + ` h WHERE NOT EXISTS (SELECT 1 FROM ` + newHashes + ` n WHERE n.pk = h.pk))`
+			wantState := []string{"DELETE FROM " + state + " h USING " + newHashes + " n WHERE h.pk = n.pk"}
+			if tt.deleteExtraneous {
+				wantState = []string{deleted, "TRUNCATE " + state}
+			}
+			wantState = append(wantState, "INSERT INTO "+state+" (pk, hash) SELECT pk, hash FROM "+newHashes, "COMMIT")
+			if got := statementsOf(dest, "DELETE", "TRUNCATE "+state, "INSERT INTO "+state, "COMMIT", "ROLLBACK"); !reflect.DeepEqual(got, wantState) {
+				t.Errorf("state updated with %q, want %q", got, wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	domainCreated   = "created"
+	domainExisting  = "existing"
+	domainFlattened = "flattened"
+
+	schemaChangeDomainFlattened = "domain_flattened"
+)
+
+// domainType is a domain of a source schema of the run, created on the
+// destination after the enum types and before the tables, in DestSchema
+// (empty for public; see mapObjectSchemas).
+type domainType struct {
+	Schema     string
+	DestSchema string
+	Name       string
+	// BaseType is the base type as format_type prints it; BaseDomain is
+	// set when that is another domain
+	BaseType   string
+	BaseDomain string
+	Default    *string
+	NotNull    bool
+	Checks     []domainCheck
+}
+
+type domainCheck struct {
+	Name string
+	// Definition is pg_get_constraintdef, e.g. CHECK ((VALUE ~ '@'::text))
+	Definition string
+}
+
+// DomainReport describes one domain of the create-schema phase.
+type DomainReport struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	BaseType string `json:"base_type"`
+}
+
+// introspectDomains reads the domains of schemas in creation order, so a
+// domain over another one comes after it.
+func introspectDomains(ctx context.Context, conn Querier, schemas []string) ([]domainType, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname::text, t.typname::text, format_type(t.typbasetype, t.typtypmod),
+			CASE WHEN b.typtype = 'd' THEN b.typname::text ELSE '' END,
+			t.typdefault, t.typnotnull,
+			ARRAY(
+				SELECT c.conname::text
+				FROM pg_constraint c
+				WHERE c.contypid = t.oid AND c.contype = 'c'
+				ORDER BY c.conname
+			),
+			ARRAY(
+				SELECT pg_get_constraintdef(c.oid)
+				FROM pg_constraint c
+				WHERE c.contypid = t.oid AND c.contype = 'c'
+				ORDER BY c.conname
+			)
+		FROM pg_type t
+		JOIN pg_type b ON b.oid = t.typbasetype
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype = 'd'
+		  AND n.nspname = ANY($1)
+		ORDER BY t.oid
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domains: %w", err)
+	}
+	domains, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (domainType, error) {
+		var d domainType
+		var names, defs []string
+		if err := r.Scan(&d.Schema, &d.Name, &d.BaseType, &d.BaseDomain, &d.Default, &d.NotNull, &names, &defs); err != nil {
+			return d, err
+		}
+		for i := range names {
+			d.Checks = append(d.Checks, domainCheck{Name: names[i], Definition: defs[i]})
+		}
+		return d, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domains: %w", err)
+	}
+	return domains, nil
+}
+
+// createDomains creates the domains missing on the destination. Like an
+// enum type, an existing domain is not dropped, since that would drop the
+// columns of kept tables using it; one whose base type or checks differ from
+// the source's is left with a warning.
+func createDomains(ctx context.Context, conn Querier, domains []domainType, report *Report) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	var schemas []string
+	for _, d := range domains {
+		schemas = append(schemas, d.DestSchema)
+	}
+	existing, err := introspectDomains(ctx, conn, distinctSchemas(schemas))
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		key := sourceTableKey(d.Schema, d.Name)
+		dr := DomainReport{Name: key, Status: domainCreated, BaseType: d.BaseType}
+		if i := slices.IndexFunc(existing, func(e domainType) bool { return e.Schema == destSchemaName(d.DestSchema) && e.Name == d.Name }); i >= 0 {
+			dr.Status = domainExisting
+			if diff := domainDifference(d, existing[i]); diff != "" {
+				report.warn(warnDomainMismatch, "domain %s exists on the destination with %s; it is left as it is", key, diff)
+			}
+			report.Domains = append(report.Domains, dr)
+			continue
+		}
+		if _, err := conn.Exec(ctx, objectSearchPath(d.Schema, d.DestSchema)+createDomainSQL(d)); err != nil {
+			return &SchemaError{Err: fmt.Errorf("failed to create domain %s: %w", key, err)}
+		}
+		fmt.Printf("  Domain %s (%s)\n", key, d.BaseType)
+		report.Domains = append(report.Domains, dr)
+	}
+	return nil
+}
+
+func createDomainSQL(d domainType) string {
+	var b strings.Builder
+	b.WriteString("CREATE DOMAIN " + schemaIdent(d.DestSchema, d.Name) + " AS " + d.BaseType)
+	if d.Default != nil {
+		b.WriteString(" DEFAULT " + *d.Default)
+	}
+	if d.NotNull {
+		b.WriteString(" NOT NULL")
+	}
+	for _, ck := range d.Checks {
+		b.WriteString(" " + sqlutil.NamedConstraint(ck.Name, ck.Definition))
+	}
+	return b.String()
+}
+
+// domainDifference describes how the destination domain dest differs from
+// the source's d in what it accepts, or returns "".
+func domainDifference(d, dest domainType) string {
+	switch {
+	case dest.BaseType != d.BaseType:
+		return fmt.Sprintf("base type %s instead of %s", dest.BaseType, d.BaseType)
+	case dest.NotNull != d.NotNull:
+		return "another NOT NULL setting"
+	case !slices.Equal(dest.Checks, d.Checks):
+		return "other checks"
+	}
+	return ""
+}
+
+// flattenDomains gives the columns of domain types the domain's base type
+// instead, for --flatten-domains. The domain's default and NOT NULL carry
+// over to the column; its checks are lost, with a warning for each domain
+// that has any.
+func flattenDomains(tables []Table, domains []domainType, report *Report) {
+	byName := make(map[string]domainType, len(domains))
+	for _, d := range domains {
+		byName[d.Name] = d
+	}
+	warned := map[string]bool{}
+	for i := range tables {
+		t := &tables[i]
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			d, ok := byName[c.Domain]
+			if !ok {
+				continue
+			}
+			// Follow domains over domains down to the base type
+			var checks []string
+			for {
+				if c.Default == nil && d.Default != nil {
+					def := *d.Default
+					c.Default = &def
+				}
+				if d.NotNull {
+					c.IsNullable = "NO"
+				}
+				for _, ck := range d.Checks {
+					checks = append(checks, ck.Definition)
+				}
+				base, ok := byName[d.BaseDomain]
+				if !ok {
+					break
+				}
+				d = base
+			}
+			report.SchemaChanges = append(report.SchemaChanges, SchemaChange{
+				Table:    t.Name,
+				Column:   c.Name,
+				Change:   schemaChangeDomainFlattened,
+				DataType: c.DataType,
+			})
+			c.DataType = d.BaseType
+			if len(checks) > 0 && !warned[c.Domain] {
+				warned[c.Domain] = true
+				report.warn(warnDomainFlattened, "domain %s is flattened to %s; its checks are not enforced on the destination: %s", c.Domain, d.BaseType, strings.Join(checks, ", "))
+			}
+		}
+	}
+	for _, d := range domains {
+		report.Domains = append(report.Domains, DomainReport{Name: sourceTableKey(d.Schema, d.Name), Status: domainFlattened, BaseType: rootDomain(byName, d).BaseType})
+	}
+}
+
+// rootDomain follows d's base domains down to the one over a plain type.
+func rootDomain(byName map[string]domainType, d domainType) domainType {
+	for {
+		base, ok := byName[d.BaseDomain]
+		if !ok {
+			return d
+		}
+		d = base
+	}
+}
@@ -0,0 +1,487 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	// Drift methods, from the most to the least informative
+	driftMethodUpdatedAt = "updated_at"
+	driftMethodHash      = "hash"
+	driftMethodCount     = "count"
+
+	defaultDriftHashMaxRows = 100000
+	driftKeyBatch           = 10000
+)
+
+// defaultUpdatedAtColumns are tried in order when --updated-at-column is
+// not given; xata_updatedat is kept by every Xata table.
+var defaultUpdatedAtColumns = []string{"updated_at", "xata_updatedat"}
+
+// DriftOptions configure DriftReport; the embedded VerifyOptions select the
+// tables and connections as for Verify.
+type DriftOptions struct {
+	VerifyOptions
+	// Since is when the last full copy started; rows updated after it have
+	// drifted. Zero when unknown, which leaves only hashes and counts
+	Since time.Time
+	// UpdatedAtColumns are the names of timestamp columns bumped on every
+	// write, tried in order
+	UpdatedAtColumns []string
+	// HashMaxRows is the largest table compared row by row when it has no
+	// updated-at column
+	HashMaxRows int64
+	// RowsPerSecond is the write rate of the last run, for the estimate;
+	// zero for none
+	RowsPerSecond float64
+}
+
+// DriftResult counts the rows that changed on the source since the last
+// full copy, per table, and estimates how long syncing them would take.
+type DriftResult struct {
+	CheckedAt time.Time    `json:"checked_at"`
+	Since     *time.Time   `json:"since,omitempty"`
+	Tables    []TableDrift `json:"tables"`
+	// New, Changed and Deleted sum the tables whose method counts them
+	New     int64 `json:"new"`
+	Changed int64 `json:"changed"`
+	Deleted int64 `json:"deleted"`
+	// Rows are the rows an incremental sync would write or delete
+	Rows             int64    `json:"rows"`
+	RowsPerSecond    float64  `json:"rows_per_second,omitempty"`
+	EstimatedSeconds *float64 `json:"estimated_seconds,omitempty"`
+}
+
+// TableDrift is the drift of one table. New, Changed and Deleted are nil
+// for the count method, which only knows the difference in row counts.
+type TableDrift struct {
+	Name            string `json:"name"`
+	Destination     string `json:"destination"`
+	Method          string `json:"method"`
+	UpdatedAtColumn string `json:"updated_at_column,omitempty"`
+	// Reason says why a table fell back to a less informative method
+	Reason          string `json:"reason,omitempty"`
+	Missing         bool   `json:"missing,omitempty"`
+	SourceRows      int64  `json:"source_rows"`
+	DestinationRows int64  `json:"destination_rows"`
+	New             *int64 `json:"new,omitempty"`
+	Changed         *int64 `json:"changed,omitempty"`
+	Deleted         *int64 `json:"deleted,omitempty"`
+}
+
+// DriftReport compares the source with the destination of an earlier
+// migration without writing to either side, so it can run any number of
+// times before a cutover. Tables with a primary key and an updated-at
+// column are compared by the keys of the rows updated since opts.Since,
+// small tables by a hash of every row, and the rest by row counts.
+func DriftReport(ctx context.Context, opts DriftOptions) (*DriftResult, error) {
+	tables, _, err := verificationTables(ctx, opts.VerifyOptions)
+	if err != nil {
+		return nil, err
+	}
+	destTables, err := introspectSchemas(ctx, opts.Dest, tableSchemas(destinationTables(tables)))
+	if err != nil {
+		return nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	byName := make(map[string]Table, len(destTables))
+	for _, t := range destTables {
+		byName[t.qualifiedName()] = t
+	}
+	if opts.sourceVersion, err = sourceVersion(ctx, opts.VerifyOptions, tables); err != nil {
+		return nil, err
+	}
+
+	result := &DriftResult{CheckedAt: utcNow(), Tables: []TableDrift{}, RowsPerSecond: opts.RowsPerSecond}
+	if !opts.Since.IsZero() {
+		result.Since = &opts.Since
+	}
+	for _, t := range tables {
+		td, err := tableDrift(ctx, opts, t, byName)
+		if err != nil {
+			return nil, err
+		}
+		if td.New != nil {
+			result.New += *td.New
+			result.Changed += *td.Changed
+			result.Deleted += *td.Deleted
+			result.Rows += *td.New + *td.Changed + *td.Deleted
+		} else {
+			result.Rows += abs(td.SourceRows - td.DestinationRows)
+		}
+		result.Tables = append(result.Tables, td)
+	}
+	if opts.RowsPerSecond > 0 {
+		seconds := float64(result.Rows) / opts.RowsPerSecond
+		result.EstimatedSeconds = &seconds
+	}
+	return result, nil
+}
+
+func tableDrift(ctx context.Context, opts DriftOptions, t Table, destTables map[string]Table) (TableDrift, error) {
+	td := TableDrift{Name: t.Name, Destination: t.qualifiedDestName(), Method: driftMethodCount}
+	dt, ok := destTables[t.qualifiedDestName()]
+	if !ok {
+		td.Missing = true
+		if err := opts.Source.QueryRow(ctx, sqlutil.CountRows(fromClause(t))).Scan(&td.SourceRows); err != nil {
+			return td, fmt.Errorf("failed to count rows of %s on the source: %w", t.Name, err)
+		}
+		return td, nil
+	}
+	if err := opts.Source.QueryRow(ctx, sqlutil.CountRows(fromClause(t))).Scan(&td.SourceRows); err != nil {
+		return td, fmt.Errorf("failed to count rows of %s on the source: %w", t.Name, err)
+	}
+	if err := opts.Dest.QueryRow(ctx, sqlutil.CountRows(destFromClause(t))).Scan(&td.DestinationRows); err != nil {
+		return td, fmt.Errorf("failed to count rows of %s on the destination: %w", td.Destination, err)
+	}
+
+	td.Reason = driftKeyProblem(t, dt)
+	if td.Reason != "" {
+		return td, nil
+	}
+	if col := updatedAtColumn(t, opts.UpdatedAtColumns); col != "" && !opts.Since.IsZero() {
+		td.Method, td.UpdatedAtColumn = driftMethodUpdatedAt, col
+		return td, driftByUpdatedAt(ctx, opts, t, &td)
+	}
+	switch {
+	case opts.Since.IsZero():
+		td.Reason = "the time of the last copy is unknown"
+	default:
+		td.Reason = "no updated-at column"
+	}
+	if td.SourceRows > opts.HashMaxRows {
+		td.Reason += fmt.Sprintf(", and more than %d rows to hash", opts.HashMaxRows)
+		return td, nil
+	}
+	td.Method = driftMethodHash
+	return td, driftByHash(ctx, opts, t, dt, &td)
+}
+
+// driftKeyProblem returns why the rows of t cannot be matched with those of
+// the destination table dt by primary key, or "" when they can.
+func driftKeyProblem(t, dt Table) string {
+	if len(t.PrimaryKey) == 0 {
+		return "no primary key"
+	}
+	for _, k := range t.PrimaryKey {
+		c, _ := t.column(k)
+		if c.UUIDKey != nil {
+			return "the primary key is converted to uuid"
+		}
+		if _, ok := dt.column(c.destName()); !ok {
+			return fmt.Sprintf("primary key column %s is missing on the destination", k)
+		}
+	}
+	return ""
+}
+
+// updatedAtColumn returns the first of names that is a timestamp column of
+// t, or "".
+func updatedAtColumn(t Table, names []string) string {
+	for _, name := range names {
+		if c, ok := t.column(name); ok && strings.HasPrefix(c.DataType, "timestamp") {
+			return name
+		}
+	}
+	return ""
+}
+
+// driftKey is the expression identifying a row by its primary key on one
+// side: the key itself for a single column, the text of the key row for
+// several.
+func driftKey(columns []string) string {
+	if len(columns) == 1 {
+		return sqlutil.QuoteIdent(columns[0]) + "::text"
+	}
+	return "ROW(" + sqlutil.ColumnList(columns) + ")::text"
+}
+
+// driftByUpdatedAt reads the keys of the source rows updated since
+// opts.Since and looks them up on the destination: the ones it has are
+// changed, the others new. Rows the destination has beyond the source's
+// without the new ones were deleted.
+func driftByUpdatedAt(ctx context.Context, opts DriftOptions, t Table, td *TableDrift) error {
+	query := "SELECT " + driftKey(t.PrimaryKey) + " FROM " + fromClause(t) + " WHERE " + sqlutil.QuoteIdent(td.UpdatedAtColumn) + " > $1"
+	rows, err := opts.Source.Query(ctx, query, opts.Since)
+	if err != nil {
+		return fmt.Errorf("failed to read updated rows of %s: %w", t.Name, err)
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to read updated rows of %s: %w", t.Name, err)
+	}
+
+	destKeys := t.destColumns(t.PrimaryKey)
+	lookup := "SELECT count(*) FROM " + destFromClause(t) + " WHERE " + driftKey(destKeys) + " = ANY($1::text[])"
+	if len(destKeys) == 1 {
+		// Compared as the key's own type, so the lookup can use its index
+		c, _ := t.column(t.PrimaryKey[0])
+		lookup = "SELECT count(*) FROM " + destFromClause(t) + " WHERE " + sqlutil.QuoteIdent(destKeys[0]) + " = ANY($1::text[]::" + castType(c) + "[])"
+	}
+	var changed int64
+	for batch := range slices.Chunk(keys, driftKeyBatch) {
+		var n int64
+		if err := opts.Dest.QueryRow(ctx, lookup, batch).Scan(&n); err != nil {
+			return fmt.Errorf("failed to look up updated rows of %s on the destination: %w", t.Name, err)
+		}
+		changed += n
+	}
+	added := int64(len(keys)) - changed
+	// Rows deleted on the destination since would count as deleted on the
+	// source; the count never goes below zero either way
+	deleted := max(0, td.DestinationRows-(td.SourceRows-added))
+	td.New, td.Changed, td.Deleted = &added, &changed, &deleted
+	return nil
+}
+
+// driftByHash reads the key and a hash of every row on both sides and
+// compares them, for tables small enough to hold in memory.
+func driftByHash(ctx context.Context, opts DriftOptions, t, dt Table, td *TableDrift) error {
+	checked, _, _ := comparedColumns(opts.VerifyOptions, t, dt)
+	source, err := rowHashes(ctx, opts.Source, driftKey(t.PrimaryKey), sourceColumns(checked), fromClause(t))
+	if err != nil {
+		return fmt.Errorf("failed to hash rows of %s on the source: %w", t.Name, err)
+	}
+	dest, err := rowHashes(ctx, opts.Dest, driftKey(t.destColumns(t.PrimaryKey)), destColumnExprs(checked), destFromClause(t))
+	if err != nil {
+		return fmt.Errorf("failed to hash rows of %s on the destination: %w", td.Destination, err)
+	}
+	var added, changed, deleted int64
+	for key, hash := range source {
+		destHash, ok := dest[key]
+		switch {
+		case !ok:
+			added++
+		case destHash != hash:
+			changed++
+		}
+	}
+	for key := range dest {
+		if _, ok := source[key]; !ok {
+			deleted++
+		}
+	}
+	td.New, td.Changed, td.Deleted = &added, &changed, &deleted
+	return nil
+}
+
+func rowHashes(ctx context.Context, q Querier, key string, exprs []string, from string) (map[string]string, error) {
+	row := "ROW(" + strings.Join(exprs, ", ") + ")::text"
+	if len(exprs) == 0 {
+		row = "''"
+	}
+	rows, err := q.Query(ctx, "SELECT "+key+", md5("+row+") FROM "+from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := map[string]string{}
+	for rows.Next() {
+		var key, hash string
+		if err := rows.Scan(&key, &hash); err != nil {
+			return nil, err
+		}
+		hashes[key] = hash
+	}
+	return hashes, rows.Err()
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (r *DriftResult) print() {
+	width := len("table")
+	for _, td := range r.Tables {
+		width = max(width, len(td.Name))
+	}
+	if r.Since != nil {
+		fmt.Printf("Drift since %s\n", r.Since.Format(time.RFC3339))
+	} else {
+		fmt.Println("Drift since the last copy (time unknown, no updated-at comparison)")
+	}
+	fmt.Printf("%-*s  %-10s  %12s  %12s  %10s  %10s  %10s\n", width, "table", "method", "source", "destination", "new", "changed", "deleted")
+	count := func(n *int64) string {
+		if n == nil {
+			return "-"
+		}
+		return fmt.Sprint(*n)
+	}
+	for _, td := range r.Tables {
+		method := td.Method
+		if td.Missing {
+			method = "missing"
+		}
+		fmt.Printf("%-*s  %-10s  %12d  %12d  %10s  %10s  %10s\n", width, td.Name, method, td.SourceRows, td.DestinationRows, count(td.New), count(td.Changed), count(td.Deleted))
+		if td.Reason != "" {
+			fmt.Printf("%-*s  (%s)\n", width, "", td.Reason)
+		}
+	}
+	fmt.Printf("Total: %d new, %d changed, %d deleted; %d row(s) to sync\n", r.New, r.Changed, r.Deleted, r.Rows)
+	if r.EstimatedSeconds != nil {
+		fmt.Printf("Estimated incremental sync: %s at %.0f rows/s\n", (time.Duration(*r.EstimatedSeconds) * time.Second).Round(time.Second), r.RowsPerSecond)
+	}
+}
+
+// lastRunRate returns the rows per second the run of the report at path
+// copied, or 0 when it copied nothing.
+func lastRunRate(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read report %s: %w", path, err)
+	}
+	var r struct {
+		StartedAt         time.Time `json:"started_at"`
+		FinishedAt        time.Time `json:"finished_at"`
+		RowsCopiedSession int64     `json:"rows_copied_session"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, fmt.Errorf("failed to parse report %s: %w", path, err)
+	}
+	seconds := r.FinishedAt.Sub(r.StartedAt).Seconds()
+	if seconds <= 0 || r.RowsCopiedSession == 0 {
+		return 0, nil
+	}
+	return float64(r.RowsCopiedSession) / seconds, nil
+}
+
+// runDrift implements the drift subcommand, a wrapper around DriftReport.
+// It prints the drift as text, or as JSON with --json, and returns 0, or 2
+// when the report could not be made.
+func runDrift(args []string) int {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	opts := DriftOptions{HashMaxRows: defaultDriftHashMaxRows}
+	var env envSettings
+	env.register(fs)
+	var since, lastReport string
+	var updatedAt stringList
+	var asJSON bool
+	fs.StringVar(&opts.ConfigPath, "config", "", "Config file of the migration, for renames, schema routes and normalizations")
+	fs.Var(&opts.Only, "only", "Report only this table (repeatable)")
+	fs.Var(&opts.Exclude, "exclude", "Leave this table out, as excluded from the migration with --exclude (repeatable)")
+	fs.Var(&opts.Schemas, "schemas", "Comma-separated source schemas, as migrated with --schemas (default public)")
+	fs.Var(&opts.SchemaMap, "schema-map", "Destination schema of a source schema, as migrated with --schema-map (repeatable)")
+	fs.StringVar(&opts.SchemaSnapshotPath, "schema-snapshot", defaultSchemaSnapshotPath, "Schema snapshot of the last run, whose recorded source position gives the time of the last copy")
+	fs.StringVar(&since, "since", "", "Time of the last full copy (RFC 3339), instead of the one in the schema snapshot")
+	fs.Var(&updatedAt, "updated-at-column", "Timestamp column bumped on every write (repeatable, tried in order; default updated_at, xata_updatedat)")
+	fs.Int64Var(&opts.HashMaxRows, "hash-max-rows", defaultDriftHashMaxRows, "Compare tables without an updated-at column row by row up to this many rows")
+	fs.StringVar(&lastReport, "last-report", "", "JSON report of the last run, whose copy rate gives the estimate")
+	fs.BoolVar(&asJSON, "json", false, "Print the drift as JSON")
+	fs.BoolVar(&opts.FlattenInheritance, "flatten-inheritance", false, "Report as migrated with --flatten-inheritance")
+	fs.BoolVar(&opts.KeepXataMetadata, "keep-xata-metadata", false, "Report as migrated with --keep-xata-metadata")
+	fs.BoolVar(&opts.FoldIdentifiers, "fold-identifiers", false, "Report as migrated with --fold-identifiers")
+	fs.BoolVar(&opts.CollisionSuffix, "collision-suffix", false, "Report as migrated with --collision-suffix")
+	fs.Parse(args)
+
+	opts.UpdatedAtColumns = updatedAt
+	if len(opts.UpdatedAtColumns) == 0 {
+		opts.UpdatedAtColumns = defaultUpdatedAtColumns
+	}
+	var err error
+	switch {
+	case since != "":
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			log.Printf("invalid --since %q: %v", since, err)
+			return 2
+		}
+	case opts.SchemaSnapshotPath != "":
+		snap, err := loadSchemaSnapshot(opts.SchemaSnapshotPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Print(err)
+			return 2
+		}
+		// The start of the copy, so rows changed while it ran count too
+		if snap != nil && snap.SourcePosition != nil {
+			opts.Since = snap.SourcePosition.Start.At
+		}
+	}
+	if lastReport != "" {
+		if opts.RowsPerSecond, err = lastRunRate(lastReport); err != nil {
+			log.Print(err)
+			return 2
+		}
+	}
+
+	cfg, err := loadConfig(opts.ConfigPath)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	opts.Config = cfg
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	sourceURL, err := env.get(sourceURLVar)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if sourceURL == "" {
+		log.Printf("%s is not set", env.varName(sourceURLVar))
+		return 2
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 2
+	}
+
+	ctx := context.Background()
+	sourceConn, err := ConnectSource(ctx, sourceURL)
+	if err != nil {
+		log.Printf("Unable to connect to source database: %v", err)
+		return 2
+	}
+	defer sourceConn.Close(ctx)
+	destConfig, err := pgx.ParseConfig(destURL)
+	if err != nil {
+		log.Printf("Invalid %s: %v", env.varName(destURLVar), err)
+		return 2
+	}
+	// Nothing is written to the destination either
+	destConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	destConn, err := pgx.ConnectConfig(ctx, destConfig)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 2
+	}
+	defer destConn.Close(ctx)
+	opts.Source, opts.Dest = sourceConn, destConn
+
+	result, err := DriftReport(ctx, opts)
+	if err != nil {
+		log.Printf("Drift report failed: %v", err)
+		return 2
+	}
+	if !asJSON {
+		result.print()
+		return 0
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Printf("Failed to write result: %v", err)
+		return 2
+	}
+	return 0
+}
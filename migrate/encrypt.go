@@ -0,0 +1,351 @@
+package migrate
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	// encryptPgcrypto encrypts with pgp_sym_encrypt on the destination,
+	// encryptAES with AES-256-GCM in the tool
+	encryptPgcrypto = "pgcrypto"
+	encryptAES      = "aes"
+
+	// encryptionKeyVar holds the key of encrypted columns; like the
+	// connection strings it may come from a credential helper or the
+	// keyring, and takes the --env-prefix
+	encryptionKeyVar = "FAREWALL_ENCRYPTION_KEY"
+
+	schemaChangeEncrypted = "encrypted"
+
+	encryptStatusMatch     = "match"
+	encryptStatusMismatch  = "mismatch"
+	encryptStatusUnchecked = "unchecked"
+)
+
+// encrypts reports whether any column of the config is encrypted.
+func (c *Config) encrypts() bool {
+	return c.encryptsWith("")
+}
+
+// encryptsWith reports whether any column of the config is encrypted with
+// method, or with any method when it is empty.
+func (c *Config) encryptsWith(method string) bool {
+	if c == nil {
+		return false
+	}
+	for _, tc := range c.Tables {
+		for _, cc := range tc.Columns {
+			if cc.Encrypt != "" && (method == "" || cc.Encrypt == method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyEncryption turns every column with encrypt into a bytea column read
+// from the source as text, which is what gets encrypted, and records the
+// change in the report. The source default does not fit bytea and is
+// dropped.
+func applyEncryption(tables []Table, cfg *Config, report *Report) {
+	for i := range tables {
+		t := &tables[i]
+		tc := cfg.table(t.Name)
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			method := tc.Columns[c.Name].Encrypt
+			if method == "" {
+				continue
+			}
+			report.SchemaChanges = append(report.SchemaChanges, SchemaChange{Table: t.Name, Column: c.Name, DataType: c.DataType, Change: schemaChangeEncrypted})
+			c.Encrypt = method
+			if c.SourceExpr != "" {
+				c.SourceExpr = "(" + c.SourceExpr + ")::text"
+			} else {
+				c.SourceExpr = sqlutil.QuoteIdent(c.Name) + "::text"
+			}
+			c.DataType = "bytea"
+			c.Default, c.Collation = nil, ""
+		}
+	}
+}
+
+func hasPgcryptoColumns(t Table) bool {
+	for _, c := range t.Columns {
+		if c.Encrypt == encryptPgcrypto {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPgcrypto fails when a table of the run encrypts with pgcrypto and
+// the destination lacks the extension, before anything is written.
+func checkPgcrypto(ctx context.Context, dest Querier, tables []Table) error {
+	var name string
+	for _, t := range tables {
+		if hasPgcryptoColumns(t) {
+			name = t.Name
+			break
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	var ok bool
+	if err := dest.QueryRow(ctx, `SELECT to_regprocedure('pgp_sym_encrypt(text, text)') IS NOT NULL`).Scan(&ok); err != nil {
+		return fmt.Errorf("failed to look for pgcrypto on the destination: %w", err)
+	}
+	if !ok {
+		return &SchemaError{Table: name, Err: fmt.Errorf("table %s encrypts columns with pgcrypto, which is not installed on the destination (CREATE EXTENSION pgcrypto)", name)}
+	}
+	return nil
+}
+
+// stagingColumns returns the column expressions of the staging table of t:
+// the destination columns, with pgcrypto columns as text, since the values
+// are encrypted when they are moved out of it.
+func stagingColumns(t Table) []string {
+	exprs := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		exprs[i] = sqlutil.QuoteIdent(c.destName())
+		if c.Encrypt == encryptPgcrypto {
+			exprs[i] = "NULL::text AS " + exprs[i]
+		}
+	}
+	return exprs
+}
+
+// stagedValues returns the expressions moving the staged columns of t into
+// the destination table, encrypting pgcrypto columns with the key in $1.
+func stagedValues(t Table) []string {
+	exprs := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		exprs[i] = sqlutil.QuoteIdent(c.destName())
+		if c.Encrypt == encryptPgcrypto {
+			exprs[i] = "pgp_sym_encrypt(" + exprs[i] + ", $1)"
+		}
+	}
+	return exprs
+}
+
+// errAESKey is the error of an aes key that is not 32 bytes. A passphrase
+// is not accepted, since a key derived from it is no stronger than the
+// passphrase.
+var errAESKey = fmt.Errorf("%s must be a random 32-byte key, hex or base64 encoded, for aes columns (e.g. openssl rand -hex 32)", encryptionKeyVar)
+
+// aesKey decodes the AES-256 key from the configured key, 32 bytes in hex
+// or base64.
+func aesKey(key string) ([]byte, error) {
+	if k, err := hex.DecodeString(key); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if k, err := enc.DecodeString(key); err == nil && len(k) == 32 {
+			return k, nil
+		}
+	}
+	return nil, errAESKey
+}
+
+// checkEncryptionKey fails when the config has aes columns and key is not
+// an AES-256 key, before anything is written. pgcrypto takes any
+// passphrase, and derives its key with its own salted string-to-key.
+func checkEncryptionKey(cfg *Config, key string) error {
+	if !cfg.encryptsWith(encryptAES) {
+		return nil
+	}
+	_, err := aesKey(key)
+	return err
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	k, err := aesKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesEncryptor is the valueStage of aes columns. A value is stored as the
+// random nonce followed by the sealed text.
+type aesEncryptor struct {
+	gcm cipher.AEAD
+}
+
+// newAESEncryptor returns the encryptor of key, which checkEncryptionKey
+// accepted.
+func newAESEncryptor(key string) *aesEncryptor {
+	gcm, err := newGCM(key)
+	if err != nil {
+		panic(err)
+	}
+	return &aesEncryptor{gcm: gcm}
+}
+
+func (e *aesEncryptor) apply(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot encrypt a %T value", v)
+	}
+	nonce := make([]byte, e.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return e.gcm.Seal(nonce, nonce, []byte(s), nil), nil
+}
+
+func aesDecrypt(gcm cipher.AEAD, data []byte) ([]byte, error) {
+	n := gcm.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("value is too short")
+	}
+	return gcm.Open(nil, data[:n], data[n:], nil)
+}
+
+// EncryptedColumnVerification compares the decrypted values of an encrypted
+// column with the source values. Checksums are like the row checksums but
+// over the column's non-NULL values as text; Count counts those values.
+type EncryptedColumnVerification struct {
+	Column              string `json:"column"`
+	Method              string `json:"method"`
+	Status              string `json:"status"`
+	SourceCount         int64  `json:"source_count,omitempty"`
+	DestinationCount    int64  `json:"destination_count,omitempty"`
+	SourceChecksum      string `json:"source_checksum,omitempty"`
+	DestinationChecksum string `json:"destination_checksum,omitempty"`
+	// Reason is why the column was not checked
+	Reason string `json:"reason,omitempty"`
+}
+
+// valueChecksumQuery is checksumQuery for the non-NULL values of expr.
+func valueChecksumQuery(expr, from string) string {
+	return "SELECT count(" + expr + "), coalesce(sum(('x' || left(md5(" + expr + "), 16))::bit(64)::bigint), 0)::text FROM " + from
+}
+
+// verifyEncryptedColumn compares the source values of c with its decrypted
+// destination values. pgcrypto columns are decrypted on the destination,
+// aes columns are read and decrypted here.
+func verifyEncryptedColumn(ctx context.Context, opts VerifyOptions, t Table, c Column) (EncryptedColumnVerification, error) {
+	ev := EncryptedColumnVerification{Column: c.Name, Method: c.Encrypt, Status: encryptStatusUnchecked}
+	if opts.EncryptionKey == "" {
+		ev.Reason = encryptionKeyVar + " is not set"
+		return ev, nil
+	}
+	if opts.Config.table(t.Name).Columns[c.Name].normalizes() {
+		ev.Reason = "the column is normalized on the way in"
+		return ev, nil
+	}
+	err := opts.Source.QueryRow(ctx, valueChecksumQuery(c.SourceExpr, fromClause(t))).Scan(&ev.SourceCount, &ev.SourceChecksum)
+	if err != nil {
+		return ev, fmt.Errorf("failed to checksum %s.%s on the source: %w", t.Name, c.Name, err)
+	}
+	col := sqlutil.QuoteIdent(c.destName())
+	if c.Encrypt == encryptPgcrypto {
+		err = opts.Dest.QueryRow(ctx, valueChecksumQuery("pgp_sym_decrypt("+col+", $1)", destFromClause(t)), opts.EncryptionKey).Scan(&ev.DestinationCount, &ev.DestinationChecksum)
+	} else {
+		ev.DestinationCount, ev.DestinationChecksum, err = aesChecksum(ctx, opts.Dest, col, destFromClause(t), opts.EncryptionKey)
+	}
+	if err != nil {
+		return ev, fmt.Errorf("failed to checksum the decrypted %s.%s on the destination: %w", t.Name, c.Name, err)
+	}
+	ev.Status = encryptStatusMatch
+	if ev.SourceCount != ev.DestinationCount || ev.SourceChecksum != ev.DestinationChecksum {
+		ev.Status = encryptStatusMismatch
+	}
+	return ev, nil
+}
+
+// aesChecksum computes valueChecksumQuery over the decrypted values of the
+// aes column col: the first 64 bits of each md5, as a signed integer,
+// summed without overflow like PostgreSQL's numeric sum.
+func aesChecksum(ctx context.Context, dest Querier, col, from, key string) (int64, string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return 0, "", err
+	}
+	rows, err := dest.Query(ctx, "SELECT "+col+" FROM "+from+" WHERE "+col+" IS NOT NULL")
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+	var count int64
+	sum := new(big.Int)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return 0, "", err
+		}
+		plain, err := aesDecrypt(gcm, data)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to decrypt a value (wrong key?): %w", err)
+		}
+		h := md5.Sum(plain)
+		sum.Add(sum, big.NewInt(int64(binary.BigEndian.Uint64(h[:8]))))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+	return count, sum.String(), nil
+}
+
+// validateEncryption rejects encrypt values and combinations the copy does
+// not support, without looking at the schema.
+func validateEncryption(tableName, colName string, tc TableConfig, cc ColumnConfig) error {
+	switch cc.Encrypt {
+	case "", encryptAES:
+	case encryptPgcrypto:
+		if tc.SplitBy != nil {
+			return fmt.Errorf("config: column %s.%s: encrypt pgcrypto cannot be combined with split_by", tableName, colName)
+		}
+	default:
+		return fmt.Errorf("config: column %s.%s has unknown encrypt %q (expected pgcrypto or aes)", tableName, colName, cc.Encrypt)
+	}
+	return nil
+}
+
+// encryptionConflict returns why the column colName of t cannot be
+// encrypted, or "" when it can: keys and the columns the copy selects or
+// matches rows by must keep their values on the destination.
+func encryptionConflict(t Table, tc TableConfig, colName string, tables []Table) string {
+	switch {
+	case slices.Contains(t.PrimaryKey, colName):
+		return "it is part of the primary key"
+	case tc.SplitBy != nil && tc.SplitBy.Column == colName:
+		return "it is the split_by column"
+	case tc.PartitionBy != nil && tc.PartitionBy.Column == colName:
+		return "it is the partition_by column"
+	case tc.OnConflict != nil && slices.Contains(tc.OnConflict.Columns, colName):
+		return "it is an on_conflict column"
+	}
+	for _, other := range tables {
+		for _, fk := range other.ForeignKeys {
+			if other.Name == t.Name && slices.Contains(fk.Columns, colName) ||
+				fk.RefTable == t.Name && slices.Contains(fk.RefColumns, colName) {
+				return "it is part of foreign key " + fk.Name
+			}
+		}
+	}
+	return ""
+}
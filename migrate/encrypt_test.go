@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testAESKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestAESKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, 32)
+	for _, key := range []string{
+		strings.Repeat("ab", 32),
+		strings.Repeat("AB", 32),
+		base64.StdEncoding.EncodeToString(raw),
+		base64.RawURLEncoding.EncodeToString(raw),
+	} {
+		k, err := aesKey(key)
+		if err != nil || !bytes.Equal(k, raw) {
+			t.Errorf("aesKey(%q) = %x, %v; want the 32 bytes", key, k, err)
+		}
+	}
+	for _, key := range []string{
+		"",
+		"correct horse battery staple",
+		strings.Repeat("ab", 16), // 16 bytes
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 24)), // 24 bytes
+		strings.Repeat("z", 64),
+	} {
+		if _, err := aesKey(key); !errors.Is(err, errAESKey) {
+			t.Errorf("aesKey(%q) error = %v, want errAESKey", key, err)
+		}
+	}
+
+	cfg := &Config{Tables: map[string]TableConfig{"users": {Columns: map[string]ColumnConfig{"email": {Encrypt: encryptPgcrypto}}}}}
+	if err := checkEncryptionKey(cfg, "a passphrase"); err != nil {
+		t.Errorf("pgcrypto columns rejected a passphrase: %v", err)
+	}
+	cfg.Tables["users"].Columns["ssn"] = ColumnConfig{Encrypt: encryptAES}
+	if err := checkEncryptionKey(cfg, "a passphrase"); !errors.Is(err, errAESKey) {
+		t.Errorf("aes columns accepted a passphrase: %v", err)
+	}
+}
+
+func TestAESEncryptRoundTrip(t *testing.T) {
+	e := newAESEncryptor(testAESKey)
+	sealed, err := e.apply("123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := sealed.([]byte)
+	again, _ := e.apply("123-45-6789")
+	if bytes.Equal(data, again.([]byte)) {
+		t.Error("two encryptions of a value are the same; the nonce is not random")
+	}
+	if bytes.Contains(data, []byte("123-45-6789")) {
+		t.Error("the value is stored in the clear")
+	}
+
+	gcm, err := newGCM(testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := aesDecrypt(gcm, data)
+	if err != nil || string(plain) != "123-45-6789" {
+		t.Errorf("aesDecrypt = %q, %v; want the value", plain, err)
+	}
+
+	// Another key cannot open it, nor can a tampered value
+	other, _ := newGCM(strings.Repeat("ff", 32))
+	if _, err := aesDecrypt(other, data); err == nil {
+		t.Error("a wrong key decrypted the value")
+	}
+	data[len(data)-1] ^= 1
+	if _, err := aesDecrypt(gcm, data); err == nil {
+		t.Error("a tampered value decrypted")
+	}
+	if _, err := aesDecrypt(gcm, []byte{1, 2, 3}); err == nil {
+		t.Error("a value shorter than the nonce decrypted")
+	}
+
+	// NULL stays NULL, and only text is encrypted
+	if v, err := e.apply(nil); v != nil || err != nil {
+		t.Errorf("apply(nil) = %v, %v; want nil", v, err)
+	}
+	if _, err := e.apply(42); err == nil {
+		t.Error("a non-text value was encrypted")
+	}
+}
@@ -0,0 +1,138 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// enumType is an enum type of a source schema of the run, created on the
+// destination before the tables whose columns use it, in DestSchema (empty
+// for public; see mapObjectSchemas).
+type enumType struct {
+	Schema     string
+	DestSchema string
+	Name       string
+	// Labels are in sort order, which is what comparisons of the type use
+	Labels []string
+}
+
+// EnumReport describes one enum type of the create-schema phase.
+type EnumReport struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Added lists the labels added to an existing type
+	Added []string `json:"added,omitempty"`
+}
+
+const (
+	enumCreated    = "created"
+	enumReconciled = "reconciled"
+	enumUnchanged  = "unchanged"
+)
+
+// introspectEnums reads the enum types of schemas with their labels in
+// sort order.
+func introspectEnums(ctx context.Context, conn Querier, schemas []string) ([]enumType, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname::text, t.typname::text,
+			ARRAY(
+				SELECT e.enumlabel::text
+				FROM pg_enum e
+				WHERE e.enumtypid = t.oid
+				ORDER BY e.enumsortorder
+			)
+		FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype = 'e'
+		  AND n.nspname = ANY($1)
+		ORDER BY n.nspname, t.typname
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get enum types: %w", err)
+	}
+	enums, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (enumType, error) {
+		var e enumType
+		err := r.Scan(&e.Schema, &e.Name, &e.Labels)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get enum types: %w", err)
+	}
+	return enums, nil
+}
+
+// createEnums creates the enum types missing on the destination. Unlike a
+// table, an existing type is not dropped, since that would drop the columns
+// of kept tables using it; labels it lacks are added in their source
+// position instead. Labels cannot be removed or reordered, so a type whose
+// labels end up in another order than on the source is left with a warning.
+func createEnums(ctx context.Context, conn Querier, enums []enumType, report *Report) error {
+	if len(enums) == 0 {
+		return nil
+	}
+	var schemas []string
+	for _, e := range enums {
+		schemas = append(schemas, e.DestSchema)
+	}
+	existing, err := introspectEnums(ctx, conn, distinctSchemas(schemas))
+	if err != nil {
+		return err
+	}
+	for _, e := range enums {
+		name := schemaIdent(e.DestSchema, e.Name)
+		key := sourceTableKey(e.Schema, e.Name)
+		i := slices.IndexFunc(existing, func(d enumType) bool { return d.Schema == destSchemaName(e.DestSchema) && d.Name == e.Name })
+		if i < 0 {
+			labels := make([]string, len(e.Labels))
+			for j, l := range e.Labels {
+				labels[j] = sqlutil.QuoteLiteral(l)
+			}
+			if _, err := conn.Exec(ctx, "CREATE TYPE "+name+" AS ENUM ("+strings.Join(labels, ", ")+")"); err != nil {
+				return &SchemaError{Err: fmt.Errorf("failed to create enum type %s: %w", key, err)}
+			}
+			fmt.Printf("  Enum type %s (%d label(s))\n", key, len(e.Labels))
+			report.Enums = append(report.Enums, EnumReport{Name: key, Status: enumCreated})
+			continue
+		}
+
+		dest := existing[i].Labels
+		er := EnumReport{Name: key, Status: enumUnchanged}
+		for j, l := range e.Labels {
+			if slices.Contains(dest, l) {
+				continue
+			}
+			// The previous source label is on the destination by now
+			stmt := "ALTER TYPE " + name + " ADD VALUE " + sqlutil.QuoteLiteral(l)
+			at := 0
+			switch {
+			case j > 0:
+				at = slices.Index(dest, e.Labels[j-1]) + 1
+				stmt += " AFTER " + sqlutil.QuoteLiteral(e.Labels[j-1])
+			case len(dest) > 0:
+				stmt += " BEFORE " + sqlutil.QuoteLiteral(dest[0])
+			}
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return &SchemaError{Err: fmt.Errorf("failed to add label %s to enum type %s: %w", l, key, err)}
+			}
+			dest = slices.Insert(dest, at, l)
+			er.Added = append(er.Added, l)
+		}
+		if len(er.Added) > 0 {
+			er.Status = enumReconciled
+			fmt.Printf("  Enum type %s: added %s\n", key, strings.Join(er.Added, ", "))
+		}
+		shared := slices.DeleteFunc(slices.Clone(dest), func(l string) bool { return !slices.Contains(e.Labels, l) })
+		if !slices.Equal(shared, e.Labels) {
+			report.warn(warnEnumOrder, "enum type %s orders its labels differently on the destination (%s instead of %s), so comparisons and ORDER BY differ",
+				key, strings.Join(shared, ", "), strings.Join(e.Labels, ", "))
+		}
+		report.Enums = append(report.Enums, er)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/joho/godotenv"
+)
+
+const (
+	sourceURLVar  = "XATA_DATABASE_URL"
+	replicaURLVar = "XATA_REPLICA_URL"
+	destURLVar    = "DATABASE_URL"
+)
+
+// knownURLVars lists every connection variable, used to tell a prefixed
+// variant ("STAGING_DATABASE_URL") from another variable that merely shares
+// the suffix ("XATA_DATABASE_URL").
+var knownURLVars = []string{sourceURLVar, replicaURLVar, destURLVar}
+
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// schemaList is the comma-separated value of --schemas.
+type schemaList []string
+
+func (s *schemaList) String() string { return strings.Join(*s, ",") }
+
+func (s *schemaList) Set(v string) error {
+	*s = nil
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return fmt.Errorf("empty schema name in %q", v)
+		case slices.Contains(*s, name):
+			return fmt.Errorf("schema %s is listed twice", name)
+		}
+		*s = append(*s, name)
+	}
+	return nil
+}
+
+// sourceSchemas returns s, or public when it is empty.
+func (s schemaList) sourceSchemas() []string {
+	if len(s) == 0 {
+		return []string{defaultSchema}
+	}
+	return s
+}
+
+// schemaMap is the value of the repeatable --schema-map source=dest, keyed
+// by source schema.
+type schemaMap map[string]string
+
+func (m *schemaMap) String() string {
+	pairs := make([]string, 0, len(*m))
+	for source, dest := range *m {
+		pairs = append(pairs, source+"="+dest)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *schemaMap) Set(v string) error {
+	source, dest, ok := strings.Cut(v, "=")
+	source, dest = strings.TrimSpace(source), strings.TrimSpace(dest)
+	switch {
+	case !ok || source == "" || dest == "":
+		return fmt.Errorf("%q must be source=dest", v)
+	case dest == stateSchema:
+		return fmt.Errorf("%s is reserved for the tool's own state", stateSchema)
+	}
+	if _, dup := (*m)[source]; dup {
+		return fmt.Errorf("schema %s is mapped twice", source)
+	}
+	if *m == nil {
+		*m = schemaMap{}
+	}
+	(*m)[source] = dest
+	return nil
+}
+
+// destination returns the destination schema of the tables of the source
+// schema, empty for public: the mapped one, or else the same name.
+func (m schemaMap) destination(source string) string {
+	dest, ok := m[source]
+	if !ok {
+		dest = source
+	}
+	if dest == defaultSchema {
+		return ""
+	}
+	return dest
+}
+
+// envSettings controls where connection settings come from: one or more env
+// files and an optional variable prefix selecting an environment.
+type envSettings struct {
+	files  stringList
+	prefix string
+
+	// Secret sources that take precedence over plain variables
+	keyringService string
+	helpers        stringList
+
+	// loaded lists the variables load took from env files
+	loaded []string
+}
+
+func (e *envSettings) register(fs *flag.FlagSet) {
+	fs.Var(&e.files, "env-file", "Load variables from this file (repeatable, later files override earlier ones; default .env)")
+	fs.StringVar(&e.prefix, "env-prefix", "", "Read prefixed variables, e.g. STAGING_ reads STAGING_XATA_DATABASE_URL and STAGING_DATABASE_URL")
+	fs.StringVar(&e.keyringService, "keyring-service", "", "Read connection strings from this OS keyring service (the account is the variable name, including any prefix)")
+	fs.Var(&e.helpers, "credential-helper", `Run a command and use its stdout as a connection string, e.g. DATABASE_URL="op read op://prod/db/url" (repeatable)`)
+}
+
+// load applies the env files. Variables already present in the process
+// environment always win over files.
+func (e *envSettings) load() error {
+	if err := e.validateHelpers(); err != nil {
+		return err
+	}
+	if len(e.files) == 0 {
+		loadEnv()
+		return nil
+	}
+	merged := map[string]string{}
+	for _, f := range e.files {
+		vars, err := godotenv.Read(f)
+		if err != nil {
+			return fmt.Errorf("failed to read env file %s: %w", f, err)
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+	}
+	for k, v := range merged {
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, v)
+			e.loaded = append(e.loaded, k)
+		}
+	}
+	return nil
+}
+
+// unload removes the variables taken from env files again, so the next
+// migration of a config with several starts from the process environment.
+func (e *envSettings) unload() {
+	for _, k := range e.loaded {
+		os.Unsetenv(k)
+	}
+	e.loaded = nil
+}
+
+// get returns the value of a connection variable for the active environment.
+// A credential helper configured for the variable wins, then the keyring, then
+// the (possibly prefixed) environment variable. The variable lookup refuses to silently mix environments: with a prefix the unprefixed
+// variable is never used as a fallback, and without one it errors when only
+// prefixed variants exist, unless the variable is optional (see
+// optionalVars) and simply left unset.
+func (e *envSettings) get(name string) (string, error) {
+	if v, ok, err := e.secret(name); ok || err != nil {
+		return v, err
+	}
+
+	if e.prefix == "" {
+		v := os.Getenv(name)
+		if v == "" && !optionalVars[name] {
+			if variants := prefixedVariants(name); len(variants) > 0 {
+				return "", fmt.Errorf("%s is not set but %s %s; pass --env-prefix to select an environment",
+					name, strings.Join(variants, ", "), pluralIs(len(variants)))
+			}
+		}
+		return v, nil
+	}
+
+	v := os.Getenv(e.prefix + name)
+	if v == "" && os.Getenv(name) != "" {
+		return "", fmt.Errorf("%s%s is not set but unprefixed %s is; refusing to mix environments", e.prefix, name, name)
+	}
+	return v, nil
+}
+
+func (e *envSettings) varName(name string) string {
+	return e.prefix + name
+}
+
+func (e *envSettings) describe() string {
+	env := "default (no prefix)"
+	if e.prefix != "" {
+		env = "prefix " + e.prefix
+	}
+	files := ".env"
+	if len(e.files) > 0 {
+		files = strings.Join(e.files, ", ")
+	}
+	s := fmt.Sprintf("%s, env files: %s", env, files)
+	if e.keyringService != "" {
+		s += ", keyring service: " + e.keyringService
+	}
+	if len(e.helpers) > 0 {
+		s += fmt.Sprintf(", %d credential helper(s)", len(e.helpers))
+	}
+	return s
+}
+
+func prefixedVariants(name string) []string {
+	var variants []string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if k == name || v == "" || !strings.HasSuffix(k, "_"+name) {
+			continue
+		}
+		if shadowedByLongerVar(k, name) {
+			continue
+		}
+		variants = append(variants, k)
+	}
+	sort.Strings(variants)
+	return variants
+}
+
+func shadowedByLongerVar(key, name string) bool {
+	for _, other := range knownURLVars {
+		if other != name && strings.HasSuffix(other, name) && strings.HasSuffix(key, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func pluralIs(n int) string {
+	if n == 1 {
+		return "is"
+	}
+	return "are"
+}
+
+// describeURL returns host, port and database of a connection string with
+// credentials removed, for pre-flight output.
+func describeURL(url string) string {
+	cfg, err := pgx.ParseConfig(url)
+	if err != nil {
+		return "(unparseable connection string)"
+	}
+	return fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.Database)
+}
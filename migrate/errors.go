@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error categories. Every error returned by Migrate wraps at most one of them
+// (a connection lost during the copy is both a CopyError and ErrConnect);
+// classifyError decides which one a caller sees first.
+var (
+	// ErrConnect marks failures to connect to the source, replica or
+	// destination
+	ErrConnect = errors.New("connection failed")
+	// ErrIntrospection marks failures to read a database's schema
+	ErrIntrospection = errors.New("introspection failed")
+)
+
+// sentinelError attaches a sentinel to err without changing its message.
+type sentinelError struct {
+	sentinel error
+	err      error
+}
+
+func (e *sentinelError) Error() string   { return e.err.Error() }
+func (e *sentinelError) Unwrap() []error { return []error{e.sentinel, e.err} }
+
+func withSentinel(sentinel, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sentinelError{sentinel: sentinel, err: err}
+}
+
+// SchemaError is a problem with the schema or the plan: a table that cannot
+// be created, a name collision, an upsert target missing on the
+// destination. Table is empty when no single table is to blame.
+type SchemaError struct {
+	Table string
+	Err   error
+}
+
+func (e *SchemaError) Error() string { return e.Err.Error() }
+func (e *SchemaError) Unwrap() error { return e.Err }
+
+// CopyError is a failure while copying the rows of Table. RowPK holds the
+// primary key of the row being written when the failure is tied to one.
+type CopyError struct {
+	Table string
+	Phase Phase
+	RowPK []string
+	Err   error
+}
+
+func (e *CopyError) Error() string {
+	if len(e.RowPK) > 0 {
+		return fmt.Sprintf("%v (row with primary key (%s))", e.Err, strings.Join(e.RowPK, ", "))
+	}
+	return e.Err.Error()
+}
+
+func (e *CopyError) Unwrap() error { return e.Err }
+
+// VerificationError means data or schema on the destination did not check
+// out: a range that kept failing --verify-chunks, or rows violating a
+// foreign key.
+type VerificationError struct {
+	Table string
+	Err   error
+}
+
+func (e *VerificationError) Error() string { return e.Err.Error() }
+func (e *VerificationError) Unwrap() error { return e.Err }
+
+// rowError is returned while the row with primary key pk is processed.
+type rowError struct {
+	pk  []string
+	err error
+}
+
+func (e *rowError) Error() string { return e.err.Error() }
+func (e *rowError) Unwrap() error { return e.err }
+
+func copyError(t Table, err error) error {
+	ce := &CopyError{Table: t.Name, Phase: PhaseCopy, Err: err}
+	var re *rowError
+	if errors.As(err, &re) {
+		ce.RowPK = re.pk
+	}
+	return ce
+}
+
+// Error kinds as reported in error_kind, and the exit codes they map to.
+const (
+	errorKindConnect       = "connect"
+	errorKindIntrospection = "introspection"
+	errorKindSchema        = "schema"
+	errorKindCopy          = "copy"
+	errorKindVerification  = "verification"
+	errorKindOther         = "other"
+)
+
+var exitCodes = map[string]int{
+	errorKindOther:         1,
+	errorKindConnect:       3,
+	errorKindIntrospection: 4,
+	errorKindSchema:        5,
+	errorKindCopy:          6,
+	errorKindVerification:  7,
+}
+
+// classifyError returns the kind of err, checking the most specific
+// categories first.
+func classifyError(err error) string {
+	var ve *VerificationError
+	var se *SchemaError
+	var ce *CopyError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &ve):
+		return errorKindVerification
+	case errors.Is(err, ErrConnect):
+		return errorKindConnect
+	case errors.Is(err, ErrIntrospection):
+		return errorKindIntrospection
+	case errors.As(err, &se):
+		return errorKindSchema
+	case errors.As(err, &ce):
+		return errorKindCopy
+	}
+	return errorKindOther
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[classifyError(err)]
+}
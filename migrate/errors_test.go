@@ -0,0 +1,109 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	boom := errors.New("boom")
+	for _, tt := range []struct {
+		name string
+		err  error
+		kind string
+		code int
+	}{
+		{"nil", nil, "", 0},
+		{"plain", boom, errorKindOther, 1},
+		{"connect", withSentinel(ErrConnect, boom), errorKindConnect, 3},
+		{"wrapped connect", fmt.Errorf("source: %w", withSentinel(ErrConnect, boom)), errorKindConnect, 3},
+		{"introspection", withSentinel(ErrIntrospection, boom), errorKindIntrospection, 4},
+		{"schema", &SchemaError{Table: "users", Err: boom}, errorKindSchema, 5},
+		{"copy", &CopyError{Table: "users", Phase: PhaseCopy, Err: boom}, errorKindCopy, 6},
+		{"connection lost during the copy", &CopyError{Table: "users", Err: withSentinel(ErrConnect, boom)}, errorKindConnect, 3},
+		{"verification", &VerificationError{Table: "users", Err: boom}, errorKindVerification, 7},
+		{"verification over schema", &VerificationError{Err: &SchemaError{Err: boom}}, errorKindVerification, 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classifyError(tt.err); kind != tt.kind {
+				t.Errorf("classifyError = %q, want %q", kind, tt.kind)
+			}
+			if code := exitCode(tt.err); code != tt.code {
+				t.Errorf("exitCode = %d, want %d", code, tt.code)
+			}
+			if tt.err != nil && !errors.Is(tt.err, boom) {
+				t.Errorf("%v does not wrap the cause", tt.err)
+			}
+		})
+	}
+}
+
+func TestCopyErrorRowPK(t *testing.T) {
+	err := copyError(Table{Name: "users"}, fmt.Errorf("failed to copy: %w", &rowError{pk: []string{"7"}, err: errors.New("invalid input")}))
+	var ce *CopyError
+	if !errors.As(err, &ce) || ce.Table != "users" || ce.Phase != PhaseCopy || !slices.Equal(ce.RowPK, []string{"7"}) {
+		t.Fatalf("copyError = %#v, want a CopyError for row 7 of users", err)
+	}
+	if want := "failed to copy: invalid input (row with primary key (7))"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestReportErrorKind(t *testing.T) {
+	r := newReport(false)
+	r.finish(&SchemaError{Table: "users", Err: errors.New("name collision")})
+	if r.Status != "failed" || r.Error != "name collision" || r.ErrorKind != errorKindSchema {
+		t.Errorf("report = %s %q %s, want a failed schema error", r.Status, r.Error, r.ErrorKind)
+	}
+	r = newReport(false)
+	r.finish(nil)
+	if r.Status != "succeeded" || r.ErrorKind != "" {
+		t.Errorf("report = %s %s, want succeeded without a kind", r.Status, r.ErrorKind)
+	}
+}
+
+func settingsResult() fakeResult {
+	return fakeResult{match: "pg_database", rows: [][]any{{"UTF8", "en_US.UTF-8", "en_US.UTF-8"}}}
+}
+
+func TestPhaseErrorKinds(t *testing.T) {
+	ctx := context.Background()
+	newState := func(t *testing.T) *MigrationState {
+		return &MigrationState{
+			Checkpoint: newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json")),
+			Report:     newReport(false),
+		}
+	}
+
+	t.Run("introspection", func(t *testing.T) {
+		source := &fakeConn{results: []fakeResult{settingsResult(), {match: "pg_tables", err: errors.New("permission denied")}}}
+		dest := &fakeConn{results: []fakeResult{settingsResult()}}
+		m := NewMigrator(&SourceConn{conn: source}, nil, dest, Options{})
+		err := m.Introspect(ctx, newState(t))
+		if !errors.Is(err, ErrIntrospection) || classifyError(err) != errorKindIntrospection {
+			t.Fatalf("Introspect error = %v (%s), want ErrIntrospection", err, classifyError(err))
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		source := &fakeConn{results: []fakeResult{
+			{match: "txid_current_snapshot()", rows: [][]any{{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "10:10:"}}},
+			{match: "SELECT count(*)", rows: [][]any{{int64(1)}}},
+			{match: `SELECT "id" FROM`, err: errors.New("canceling statement due to conflict with recovery")},
+		}}
+		m := NewMigrator(&SourceConn{conn: source}, nil, &fakeConn{}, Options{CopyMethod: copyMethodRows})
+		state := newState(t)
+		state.Tables = []Table{{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}}}}
+		state.AllTables = state.Tables
+		err := m.Copy(ctx, state)
+		var ce *CopyError
+		if !errors.As(err, &ce) || ce.Table != "users" || classifyError(err) != errorKindCopy {
+			t.Fatalf("Copy error = %v (%s), want a CopyError for users", err, classifyError(err))
+		}
+	})
+}
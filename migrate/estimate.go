@@ -0,0 +1,97 @@
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type TableEstimate struct {
+	Name  string `json:"name"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ReadEstimate is what a run is expected to read from the source, based on
+// planner statistics rather than exact counts, so it is cheap to compute
+// even for large tables.
+type ReadEstimate struct {
+	Rows   int64           `json:"rows"`
+	Bytes  int64           `json:"bytes"`
+	Tables []TableEstimate `json:"tables"`
+}
+
+// estimateReads sums reltuples and pg_total_relation_size of the tables
+// that still have to be copied.
+func estimateReads(ctx context.Context, source Querier, tables []Table, cp *Checkpoint) (*ReadEstimate, error) {
+	var names []string
+	for _, t := range tables {
+		if !cp.completed(t.Name) {
+			names = append(names, t.Name)
+		}
+	}
+	rows, err := source.Query(ctx, `
+		SELECT `+sourceKeySQL+`, GREATEST(c.reltuples, 0)::bigint, pg_total_relation_size(c.oid)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($2) AND `+sourceKeySQL+` = ANY($1)
+		ORDER BY 1
+	`, names, tableSchemas(tables))
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate source reads: %w", err)
+	}
+	tableEstimates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (TableEstimate, error) {
+		var te TableEstimate
+		err := row.Scan(&te.Name, &te.Rows, &te.Bytes)
+		return te, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate source reads: %w", err)
+	}
+
+	est := &ReadEstimate{Tables: tableEstimates}
+	for _, te := range tableEstimates {
+		est.Rows += te.Rows
+		est.Bytes += te.Bytes
+	}
+	return est, nil
+}
+
+// print lists the estimate per table. With more than limit tables (0 for no
+// limit) only the limit largest are listed, and the others summed up; the
+// report has all of them.
+func (e *ReadEstimate) print(limit int) {
+	fmt.Println("Estimated source reads:")
+	listed := e.Tables
+	if limit > 0 && len(listed) > limit {
+		listed = slices.Clone(listed)
+		slices.SortStableFunc(listed, func(a, b TableEstimate) int { return cmp.Compare(b.Bytes, a.Bytes) })
+		listed = listed[:limit]
+	}
+	var rows, bytes int64
+	for _, te := range listed {
+		fmt.Printf("  %-40s ~%d rows, %s\n", te.Name, te.Rows, formatBytes(te.Bytes))
+		rows += te.Rows
+		bytes += te.Bytes
+	}
+	if rest := len(e.Tables) - len(listed); rest > 0 {
+		fmt.Printf("  %-40s ~%d rows, %s\n", fmt.Sprintf("(%d smaller tables)", rest), e.Rows-rows, formatBytes(e.Bytes-bytes))
+	}
+	fmt.Printf("  %-40s ~%d rows, %s\n", "TOTAL", e.Rows, formatBytes(e.Bytes))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// exportManifestKey is the object, under the run's prefix, written last
+const exportManifestKey = "manifest.json"
+
+// ExportManifest lists the objects of an export. It is written after all of
+// them, so an export without one did not finish.
+type ExportManifest struct {
+	RunID      string        `json:"run_id"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Schemas    []string      `json:"schemas"`
+	Tables     []ExportTable `json:"tables"`
+}
+
+// ExportTable is one table written as a CSV object with a header row.
+type ExportTable struct {
+	Table string `json:"table"`
+	// Key names the object, next to the manifest
+	Key     string   `json:"key"`
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+	Bytes   int64    `json:"bytes"`
+	// SHA256 is the hex digest of the object, checked by import
+	SHA256 string `json:"sha256"`
+}
+
+// hashingWriter counts and hashes the bytes written through it.
+type hashingWriter struct {
+	w   io.Writer
+	sum hash.Hash
+	n   int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, sum: sha256.New()}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.sum.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+func (h *hashingWriter) digest() string { return hex.EncodeToString(h.sum.Sum(nil)) }
+
+// exportTables writes every table as CSV to store under runID, one
+// object per table streamed straight from COPY ... TO STDOUT, then the
+// manifest.
+func exportTables(ctx context.Context, source *SourceConn, store objectStore, runID string, schemas []string, tables []Table) (*ExportManifest, error) {
+	manifest := &ExportManifest{RunID: runID, StartedAt: utcNow(), Schemas: schemas}
+	for _, t := range tables {
+		// Keys in the manifest are relative to it
+		name := t.Name + ".csv"
+		key := path.Join(runID, name)
+		cols := make([]string, len(t.Columns))
+		for i, c := range t.Columns {
+			cols[i] = c.Name
+		}
+		w, err := store.create(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", store.location(key), err)
+		}
+		out := newHashingWriter(w)
+		// COPY table TO never includes rows of inheritance children, which
+		// are exported on their own
+		tag, err := source.CopyTo(ctx, out, sqlutil.CopyTo(sourceIdent(t), cols, "FORMAT csv, HEADER"))
+		if err != nil {
+			w.abort()
+			return nil, fmt.Errorf("failed to export %s: %w", t.Name, err)
+		}
+		if err := w.commit(); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", store.location(key), err)
+		}
+		fmt.Printf("  %s: %d rows, %s\n", t.Name, tag.RowsAffected(), formatBytes(out.n))
+		manifest.Tables = append(manifest.Tables, ExportTable{Table: t.Name, Key: name, Columns: cols, Rows: tag.RowsAffected(), Bytes: out.n, SHA256: out.digest()})
+	}
+
+	manifest.FinishedAt = utcNow()
+	key := path.Join(runID, exportManifestKey)
+	w, err := store.create(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", store.location(key), err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("failed to write %s: %w", store.location(key), err)
+	}
+	if err := w.commit(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", store.location(key), err)
+	}
+	return manifest, nil
+}
+
+// runExport implements the export subcommand, which writes the source tables
+// as CSV files instead of migrating them.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var env envSettings
+	env.register(fs)
+	var schemas schemaList
+	var exclude stringList
+	var storeOpts storeOptions
+	storeOpts.register(fs)
+	to := fs.String("to", "", "Directory (or file:// URL), s3://bucket/prefix or gs://bucket/prefix to write the export to; each run writes under a prefix named after its run ID")
+	fs.Var(&schemas, "schemas", "Comma-separated source schemas to export (default public)")
+	fs.Var(&exclude, "exclude", "Leave this table out (repeatable)")
+	fs.Parse(args)
+
+	if *to == "" {
+		log.Print("--to is required")
+		return 2
+	}
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	store, err := openStore(*to, storeOpts)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	sourceURL, err := env.get(sourceURLVar)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if sourceURL == "" {
+		log.Printf("%s is not set", env.varName(sourceURLVar))
+		return 1
+	}
+
+	ctx := context.Background()
+	source, err := ConnectSource(ctx, sourceURL)
+	if err != nil {
+		log.Printf("Unable to connect to source database: %v", err)
+		return 1
+	}
+	defer source.Close(ctx)
+
+	tables, err := introspectSource(ctx, source, schemas.sourceSchemas(), nil)
+	if err != nil {
+		log.Printf("Failed to introspect source: %v", err)
+		return 1
+	}
+	if len(exclude) > 0 {
+		if tables, err = excludeTables(tables, exclude); err != nil {
+			log.Print(err)
+			return 2
+		}
+	}
+
+	runID := newRunID()
+	fmt.Printf("Exporting %d table(s) as run %s...\n", len(tables), runID)
+	manifest, err := exportTables(ctx, source, store, runID, schemas.sourceSchemas(), tables)
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		return 1
+	}
+	fmt.Printf("Wrote %d table(s) and %s\n", len(manifest.Tables), store.location(path.Join(runID, exportManifestKey)))
+	return 0
+}
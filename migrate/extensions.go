@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	extensionCreated  = "created"
+	extensionExisting = "existing"
+	extensionSkipped  = "skipped"
+	extensionFailed   = "failed"
+)
+
+// extension is an extension installed on the source, created on the
+// destination before the schema.
+type extension struct {
+	Name   string
+	Schema string
+}
+
+// ExtensionReport describes one extension of the create-schema phase.
+type ExtensionReport struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+	Status string `json:"status"`
+	// Reason is the error of a failed CREATE EXTENSION
+	Reason string `json:"reason,omitempty"`
+}
+
+// introspectExtensions reads the extensions of the source, leaving out
+// plpgsql, which every database has, and Xata's own, which other servers do
+// not offer.
+func introspectExtensions(ctx context.Context, conn Querier) ([]extension, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT e.extname::text, n.nspname::text
+		FROM pg_extension e
+		JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname <> 'plpgsql'
+		ORDER BY e.extname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get extensions: %w", err)
+	}
+	exts, err := pgx.CollectRows(rows, pgx.RowToStructByPos[extension])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get extensions: %w", err)
+	}
+	return slices.DeleteFunc(exts, func(e extension) bool {
+		return strings.HasPrefix(e.Name, "xata") || strings.HasPrefix(e.Schema, "xata")
+	}), nil
+}
+
+// createsExtension reports whether the create-schema phase will try to
+// create name.
+func createsExtension(exts []extension, opts Options, name string) bool {
+	return !opts.DataOnly && !opts.SkipExtensions && slices.ContainsFunc(exts, func(e extension) bool { return e.Name == name })
+}
+
+// createExtensions runs CREATE EXTENSION IF NOT EXISTS for every extension
+// of the source missing on the destination, in the source's schema. Managed
+// servers often allow only some extensions, so one that cannot be created
+// produces a warning rather than failing the run; the statements needing it
+// fail later on their own. With --skip-extensions nothing is created and the
+// extensions are only listed.
+func createExtensions(ctx context.Context, conn Querier, exts []extension, opts Options, report *Report) error {
+	if len(exts) == 0 {
+		return nil
+	}
+	if opts.SkipExtensions {
+		names := make([]string, len(exts))
+		for i, e := range exts {
+			names[i] = e.Name
+			report.Extensions = append(report.Extensions, ExtensionReport{Name: e.Name, Schema: e.Schema, Status: extensionSkipped})
+		}
+		fmt.Printf("  Extensions skipped (--skip-extensions): %s\n", strings.Join(names, ", "))
+		return nil
+	}
+
+	rows, err := conn.Query(ctx, `SELECT extname::text FROM pg_extension`)
+	if err != nil {
+		return fmt.Errorf("failed to list destination extensions: %w", err)
+	}
+	installed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list destination extensions: %w", err)
+	}
+	for _, e := range exts {
+		er := ExtensionReport{Name: e.Name, Schema: e.Schema, Status: extensionExisting}
+		if slices.Contains(installed, e.Name) {
+			fmt.Printf("  Extension %s already exists\n", e.Name)
+			report.Extensions = append(report.Extensions, er)
+			continue
+		}
+		stmts := []string{"CREATE EXTENSION IF NOT EXISTS " + sqlutil.QuoteIdent(e.Name) + " WITH SCHEMA " + sqlutil.QuoteIdent(e.Schema)}
+		if e.Schema != defaultSchema {
+			stmts = slices.Insert(stmts, 0, "CREATE SCHEMA IF NOT EXISTS "+sqlutil.QuoteIdent(e.Schema))
+		}
+		er.Status = extensionCreated
+		for _, stmt := range stmts {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				er.Status, er.Reason = extensionFailed, err.Error()
+				break
+			}
+		}
+		if er.Status == extensionFailed {
+			report.warn(warnExtensionFailed, "extension %s could not be created on the destination, so objects using it will fail: %s", e.Name, er.Reason)
+		} else {
+			fmt.Printf("  Extension %s created in %s\n", e.Name, e.Schema)
+		}
+		report.Extensions = append(report.Extensions, er)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeConn is a scripted connection for tests: a statement gets the result
+// of the first fakeResult whose match it contains, else no rows. It
+// satisfies CopyConn and sourceDriver; statements are kept with their
+// arguments, and rows written with CopyFrom by table. Statements of its
+// transactions run on it, followed by COMMIT or ROLLBACK.
+type fakeConn struct {
+	results []fakeResult
+
+	mu      sync.Mutex
+	queries []string
+	args    [][]any
+	copied  map[string][][]any
+}
+
+type fakeResult struct {
+	match string
+	rows  [][]any
+	err   error
+	// tag is the command tag of Exec, such as "DELETE 2"
+	tag string
+	// once results serve only the first statement they match, so
+	// successive runs of one statement can get different rows
+	once bool
+}
+
+func (c *fakeConn) result(sql string, args []any) fakeResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, sql)
+	c.args = append(c.args, args)
+	for i, r := range c.results {
+		if strings.Contains(sql, r.match) {
+			if r.once {
+				c.results = slices.Delete(slices.Clone(c.results), i, i+1)
+			}
+			return r
+		}
+	}
+	return fakeResult{}
+}
+
+// argsOfAll returns the arguments of every statement containing s.
+func (c *fakeConn) argsOfAll(s string) [][]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out [][]any
+	for i, q := range c.queries {
+		if strings.Contains(q, s) {
+			out = append(out, c.args[i])
+		}
+	}
+	return out
+}
+
+// argsOf returns the arguments of the first statement containing s.
+func (c *fakeConn) argsOf(s string) []any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, q := range c.queries {
+		if strings.Contains(q, s) {
+			return c.args[i]
+		}
+	}
+	return nil
+}
+
+// ran reports whether a statement containing s was run.
+func (c *fakeConn) ran(s string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, q := range c.queries {
+		if strings.Contains(q, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	r := c.result(sql, args)
+	return pgconn.NewCommandTag(r.tag), r.err
+}
+
+func (c *fakeConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	r := c.result(sql, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{rows: r.rows}, nil
+}
+
+func (c *fakeConn) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	r := c.result(sql, args)
+	if r.err != nil {
+		return errRow{r.err}
+	}
+	if len(r.rows) == 0 {
+		return errRow{pgx.ErrNoRows}
+	}
+	return &fakeRows{rows: r.rows[:1]}
+}
+
+func (c *fakeConn) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	var n int64
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return n, err
+		}
+		c.mu.Lock()
+		if c.copied == nil {
+			c.copied = map[string][][]any{}
+		}
+		c.copied[table.Sanitize()] = append(c.copied[table.Sanitize()], values)
+		c.mu.Unlock()
+		n++
+	}
+	return n, src.Err()
+}
+
+func (c *fakeConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	return &fakeTx{fakeConn: c}, nil
+}
+
+func (c *fakeConn) PgConn() *pgconn.PgConn          { return nil }
+func (c *fakeConn) Config() *pgx.ConnConfig         { return nil }
+func (c *fakeConn) IsClosed() bool                  { return false }
+func (c *fakeConn) Close(ctx context.Context) error { return nil }
+
+// fakeTx is a transaction of a fakeConn. Nested transactions, batches and
+// prepared statements are not supported.
+type fakeTx struct {
+	*fakeConn
+	done bool
+}
+
+func (tx *fakeTx) end(sql string) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	_, err := tx.fakeConn.Exec(context.Background(), sql)
+	return err
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error   { return tx.end("COMMIT") }
+func (tx *fakeTx) Rollback(ctx context.Context) error { return tx.end("ROLLBACK") }
+func (tx *fakeTx) Conn() *pgx.Conn                    { return nil }
+func (tx *fakeTx) LargeObjects() pgx.LargeObjects     { return pgx.LargeObjects{} }
+
+func (tx *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return nil, errors.New("fakeTx: nested transactions are not supported")
+}
+
+func (tx *fakeTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	panic("fakeTx: batches are not supported")
+}
+
+func (tx *fakeTx) Prepare(ctx context.Context, name, sql string) (*pgconn.StatementDescription, error) {
+	return nil, errors.New("fakeTx: prepared statements are not supported")
+}
+
+// fakeRows serves rows of Go values; Scan assigns them to pointers of
+// their type, or of a type they convert to. As the result of QueryRow it
+// scans its first row without Next.
+type fakeRows struct {
+	rows [][]any
+	i    int
+}
+
+func (r *fakeRows) Close()                                       {}
+func (r *fakeRows) Err() error                                   { return nil }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *fakeRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *fakeRows) Next() bool {
+	if r.i >= len(r.rows) {
+		return false
+	}
+	r.i++
+	return true
+}
+
+func (r *fakeRows) current() []any {
+	if r.i == 0 {
+		return r.rows[0]
+	}
+	return r.rows[r.i-1]
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	values := r.current()
+	if len(dest) != len(values) {
+		return fmt.Errorf("fakeRows: %d values scanned into %d destinations", len(values), len(dest))
+	}
+	for i, d := range dest {
+		target := reflect.ValueOf(d).Elem()
+		if values[i] == nil {
+			target.SetZero()
+			continue
+		}
+		v := reflect.ValueOf(values[i])
+		switch {
+		case v.Type().AssignableTo(target.Type()):
+			target.Set(v)
+		case v.Type().ConvertibleTo(target.Type()):
+			target.Set(v.Convert(target.Type()))
+		default:
+			return fmt.Errorf("fakeRows: cannot scan %T into %T", values[i], d)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRows) Values() ([]any, error) { return r.current(), nil }
+
+func (r *fakeRows) RawValues() [][]byte {
+	raw := make([][]byte, len(r.current()))
+	for i, v := range r.current() {
+		if v != nil {
+			raw[i] = []byte(fmt.Sprint(v))
+		}
+	}
+	return raw
+}
@@ -0,0 +1,479 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	fkViolationFail          = "fail"
+	fkViolationSkip          = "skip-constraint"
+	fkViolationNotValid      = "not-valid"
+	fkViolationDeleteOrphans = "delete-orphans"
+
+	constraintValidated = "validated"
+	constraintNotValid  = "not_valid"
+	constraintSkipped   = "skipped"
+	constraintViolated  = "violated"
+	// constraintRecorded keys were written to --ddl-out without a check
+	constraintRecorded = "recorded"
+
+	// --on-missing-ref modes, for keys referencing a table outside the run
+	missingRefSkip     = "skip"
+	missingRefNotValid = "not-valid"
+	missingRefFail     = "fail"
+
+	// orphanBatchSize is the number of orphaned rows deleted per statement
+	orphanBatchSize = 10000
+	orphanSamples   = 5
+)
+
+// foreignKey is a foreign key of a source table to be created on the
+// destination, or a destination foreign key detached during a partial run.
+type foreignKey struct {
+	Table      string   `json:"table"`
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+	Definition string   `json:"definition"`
+	// OnDelete and OnUpdate are the referential actions, also part of
+	// Definition
+	OnDelete string `json:"on_delete"`
+	OnUpdate string `json:"on_update"`
+	// Schema and RefSchema are the schemas of the two tables on the
+	// destination; empty means public
+	Schema    string `json:"schema,omitempty"`
+	RefSchema string `json:"ref_schema,omitempty"`
+
+	// partitioned and refPartitioned are set when the table is partitioned
+	// on the destination; other tables are read with ONLY, as a foreign
+	// key never covers INHERITS children.
+	partitioned, refPartitioned bool
+	// destName is the destination constraint name when it differs
+	destName string
+}
+
+// fkActions maps pg_constraint.confdeltype and confupdtype to their SQL.
+var fkActions = map[string]string{
+	"a": "NO ACTION",
+	"r": "RESTRICT",
+	"c": "CASCADE",
+	"n": "SET NULL",
+	"d": "SET DEFAULT",
+}
+
+// setActions sets OnDelete and OnUpdate from the pg_constraint codes.
+func (fk *foreignKey) setActions(onDelete, onUpdate string) {
+	fk.OnDelete, fk.OnUpdate = fkActions[onDelete], fkActions[onUpdate]
+}
+
+func (fk foreignKey) destConstraint() string {
+	if fk.destName != "" {
+		return fk.destName
+	}
+	return fk.Name
+}
+
+func (fk foreignKey) tableIdent() string    { return schemaIdent(fk.Schema, fk.Table) }
+func (fk foreignKey) refTableIdent() string { return schemaIdent(fk.RefSchema, fk.RefTable) }
+
+// qualifiedTable is schema.table of the table holding fk.
+func (fk foreignKey) qualifiedTable() string {
+	if fk.Schema == "" {
+		return defaultSchema + "." + fk.Table
+	}
+	return fk.Schema + "." + fk.Table
+}
+
+// qualifiedRefTable is schema.table of the referenced table.
+func (fk foreignKey) qualifiedRefTable() string {
+	if fk.RefSchema == "" {
+		return defaultSchema + "." + fk.RefTable
+	}
+	return fk.RefSchema + "." + fk.RefTable
+}
+
+// ConstraintReport is the outcome of creating one foreign key.
+type ConstraintReport struct {
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Columns, RefTable and RefColumns describe the key on the destination
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+	OnDelete   string   `json:"on_delete,omitempty"`
+	OnUpdate   string   `json:"on_update,omitempty"`
+	// Violations counts rows without a referenced row; SampleKeys holds the
+	// foreign key values of a few of them
+	Violations     int64      `json:"violations,omitempty"`
+	SampleKeys     [][]string `json:"sample_keys,omitempty"`
+	OrphansDeleted int64      `json:"orphans_deleted,omitempty"`
+}
+
+// MissingReference is a foreign key of a migrated table whose referenced
+// table is not part of the run, because --exclude or on_existing skip left
+// it out.
+type MissingReference struct {
+	Table    string   `json:"table"`
+	Name     string   `json:"name"`
+	Columns  []string `json:"columns"`
+	RefTable string   `json:"ref_table"`
+	// Action is the --on-missing-ref mode
+	Action string `json:"action"`
+	// Status is what the constraints phase did: skipped or not_valid
+	Status string `json:"status,omitempty"`
+}
+
+// missingReferences lists the foreign keys of tables that reference a table
+// not among all and prints them with what mode does with them. With fail the
+// list comes with an error naming them.
+func missingReferences(tables, all []Table, mode string) ([]MissingReference, error) {
+	names := make(map[string]bool, len(all))
+	for _, t := range all {
+		names[t.Name] = true
+	}
+	var refs []MissingReference
+	for _, t := range tables {
+		for _, fk := range t.ForeignKeys {
+			if !names[fk.RefTable] {
+				refs = append(refs, MissingReference{Table: t.Name, Name: fk.Name, Columns: fk.Columns, RefTable: fk.RefTable, Action: mode})
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	fmt.Printf("Foreign keys referencing tables outside the run (--on-missing-ref %s):\n", mode)
+	listed := make([]string, len(refs))
+	for i, r := range refs {
+		listed[i] = fmt.Sprintf("%s on %s", r.Name, r.Table)
+		fmt.Printf("  %s on %s (%s) -> %s\n", r.Name, r.Table, strings.Join(r.Columns, ", "), r.RefTable)
+	}
+	if mode == missingRefFail {
+		return refs, fmt.Errorf("foreign key(s) %s reference tables outside the run; migrate those tables too or choose another --on-missing-ref", strings.Join(listed, ", "))
+	}
+	return refs, nil
+}
+
+// setMissingStatus records the outcome of a key listed by
+// missingReferences.
+func setMissingStatus(refs []MissingReference, table, name, status string) {
+	for i := range refs {
+		if refs[i].Table == table && refs[i].Name == name {
+			refs[i].Status = status
+		}
+	}
+}
+
+// relation is the quoted table ident, read with ONLY unless partitioned.
+func relation(ident string, partitioned bool) string {
+	if partitioned {
+		return ident
+	}
+	return sqlutil.Only(ident)
+}
+
+// orphanCondition selects the rows of alias c that violate fk. Following
+// MATCH SIMPLE, a row with any NULL key column satisfies the constraint.
+func (fk foreignKey) orphanCondition() string {
+	var notNull, match []string
+	for i, col := range fk.Columns {
+		notNull = append(notNull, "c."+sqlutil.QuoteIdent(col)+" IS NOT NULL")
+		match = append(match, "p."+sqlutil.QuoteIdent(fk.RefColumns[i])+" = c."+sqlutil.QuoteIdent(col))
+	}
+	return strings.Join(notNull, " AND ") + " AND NOT EXISTS (SELECT 1 FROM " +
+		relation(fk.refTableIdent(), fk.refPartitioned) + " p WHERE " + strings.Join(match, " AND ") + ")"
+}
+
+// countOrphans counts the rows violating fk on the destination and returns
+// the key values of a few of them.
+func countOrphans(ctx context.Context, dest Querier, fk foreignKey) (int64, [][]string, error) {
+	from := relation(fk.tableIdent(), fk.partitioned) + " c WHERE " + fk.orphanCondition()
+	var count int64
+	if err := dest.QueryRow(ctx, "SELECT count(*) FROM "+from).Scan(&count); err != nil {
+		return 0, nil, fmt.Errorf("failed to check foreign key %s on %s: %w", fk.Name, fk.Table, err)
+	}
+	if count == 0 {
+		return 0, nil, nil
+	}
+
+	keys := make([]string, len(fk.Columns))
+	for i, col := range fk.Columns {
+		keys[i] = "c." + sqlutil.QuoteIdent(col) + "::text"
+	}
+	rows, err := dest.Query(ctx, fmt.Sprintf("SELECT ARRAY[%s] FROM %s LIMIT %d", strings.Join(keys, ", "), from, orphanSamples))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to sample rows violating %s on %s: %w", fk.Name, fk.Table, err)
+	}
+	samples, err := pgx.CollectRows(rows, pgx.RowTo[[]string])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to sample rows violating %s on %s: %w", fk.Name, fk.Table, err)
+	}
+	return count, samples, nil
+}
+
+// deleteOrphans deletes the rows violating fk in batches of orphanBatchSize
+// and returns how many were deleted.
+func deleteOrphans(ctx context.Context, dest Querier, fk foreignKey) (int64, error) {
+	table := relation(fk.tableIdent(), fk.partitioned)
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE (tableoid, ctid) IN (SELECT c.tableoid, c.ctid FROM %s c WHERE %s LIMIT %d)",
+		table, table, fk.orphanCondition(), orphanBatchSize)
+	var deleted int64
+	for {
+		tag, err := dest.Exec(ctx, stmt)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete rows violating %s on %s: %w", fk.Name, fk.Table, err)
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < orphanBatchSize {
+			return deleted, nil
+		}
+		fmt.Printf("  Deleted %d orphaned rows of %s so far\n", deleted, fk.Table)
+	}
+}
+
+// addForeignKey checks the data against fk and creates it as configured by
+// --on-fk-violation. The key is added NOT VALID and then validated, which
+// holds a weaker lock on the referenced table. With "fail" a violated key is
+// not created; its report has status violated and the caller decides.
+func addForeignKey(ctx context.Context, dest Querier, fk foreignKey, mode string, report *Report) (ConstraintReport, error) {
+	cr := ConstraintReport{
+		Table:      fk.qualifiedTable(),
+		Name:       fk.Name,
+		Columns:    fk.Columns,
+		RefTable:   fk.qualifiedRefTable(),
+		RefColumns: fk.RefColumns,
+		OnDelete:   fk.OnDelete,
+		OnUpdate:   fk.OnUpdate,
+	}
+	table := fk.tableIdent()
+	def := strings.TrimSuffix(fk.Definition, " NOT VALID")
+	if def != fk.Definition {
+		// Keys that were NOT VALID on the other side stay that way
+		if _, err := dest.Exec(ctx, sqlutil.AddConstraint(table, fk.Name, def, true)); err != nil {
+			return cr, fmt.Errorf("failed to create foreign key %s on %s (%s): %w", fk.Name, fk.Table, fk.Definition, err)
+		}
+		cr.Status = constraintNotValid
+		return cr, nil
+	}
+
+	if recording(dest) {
+		// The data is not there to check; the script adds and validates
+		if _, err := dest.Exec(ctx, sqlutil.AddConstraint(table, fk.Name, def, true)); err != nil {
+			return cr, err
+		}
+		if _, err := dest.Exec(ctx, sqlutil.ValidateConstraint(table, fk.Name)); err != nil {
+			return cr, err
+		}
+		cr.Status = constraintRecorded
+		return cr, nil
+	}
+
+	violations, samples, err := countOrphans(ctx, dest, fk)
+	if err != nil {
+		return cr, err
+	}
+	cr.Violations, cr.SampleKeys = violations, samples
+	notValid := false
+	if violations > 0 {
+		fmt.Printf("  Foreign key %s on %s: %d row(s) without a referenced %s row, e.g. %s\n",
+			fk.Name, fk.Table, violations, fk.RefTable, formatSamples(samples))
+		switch mode {
+		case fkViolationSkip:
+			report.warnTable(warnForeignKeySkipped, fk.Table, "foreign key %s on %s was not created: %d violating row(s)", fk.Name, fk.Table, violations)
+			cr.Status = constraintSkipped
+			return cr, nil
+		case fkViolationNotValid:
+			report.warnTable(warnForeignKeyNotValid, fk.Table, "foreign key %s on %s was created NOT VALID: %d violating row(s)", fk.Name, fk.Table, violations)
+			notValid = true
+		case fkViolationDeleteOrphans:
+			deleted, err := deleteOrphans(ctx, dest, fk)
+			cr.OrphansDeleted = deleted
+			report.addOrphansDeleted(fk.Table, deleted)
+			if err != nil {
+				return cr, err
+			}
+			report.warnTable(warnOrphansDeleted, fk.Table, "deleted %d row(s) of %s violating foreign key %s", deleted, fk.Table, fk.Name)
+		default:
+			cr.Status = constraintViolated
+			return cr, nil
+		}
+	}
+
+	if _, err := dest.Exec(ctx, sqlutil.AddConstraint(table, fk.Name, def, true)); err != nil {
+		return cr, fmt.Errorf("failed to create foreign key %s on %s (%s): %w", fk.Name, fk.Table, fk.Definition, err)
+	}
+	if notValid {
+		cr.Status = constraintNotValid
+		return cr, nil
+	}
+	// Rows may still change between the check and the validation
+	if _, err := dest.Exec(ctx, sqlutil.ValidateConstraint(table, fk.Name)); err != nil {
+		report.warnTable(warnForeignKeyNotValid, fk.Table, "foreign key %s on %s no longer holds and was left NOT VALID: %v", fk.Name, fk.Table, err)
+		cr.Status = constraintNotValid
+		return cr, nil
+	}
+	cr.Status = constraintValidated
+	return cr, nil
+}
+
+func formatSamples(samples [][]string) string {
+	parts := make([]string, len(samples))
+	for i, s := range samples {
+		parts[i] = "(" + strings.Join(s, ", ") + ")"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// destinationForeignKeys returns "schema.table.name" of every foreign key on
+// destination tables outside the system schemas.
+func destinationForeignKeys(ctx context.Context, dest Querier) (map[string]bool, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname || '.' || con.conname
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'f'
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination foreign keys: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination foreign keys: %w", err)
+	}
+	out := make(map[string]bool, len(names))
+	for _, n := range names {
+		out[n] = true
+	}
+	return out, nil
+}
+
+// plannedForeignKeys returns the source foreign keys of tables that are
+// missing on the destination, skipping (with a warning) keys whose columns
+// are not migrated. Keys whose referenced table is not part of the run are
+// skipped too, or with --on-missing-ref not-valid created NOT VALID against
+// the table the destination already has under its destination name.
+func (m *Migrator) plannedForeignKeys(ctx context.Context, tables, all []Table, existing map[string]bool, report *Report) ([]foreignKey, error) {
+	cfg := m.opts.Config
+	byName := make(map[string]Table, len(all))
+	for _, t := range all {
+		byName[t.Name] = t
+	}
+
+	var out []foreignKey
+	for _, t := range tables {
+		for _, fk := range t.ForeignKeys {
+			if existing[t.qualifiedDestName()+"."+fk.destConstraint()] {
+				continue
+			}
+			ref, ok := byName[fk.RefTable]
+			if !ok {
+				if m.opts.OnMissingRef != missingRefNotValid {
+					report.warnTable(warnForeignKeySkipped, t.Name, "foreign key %s on %s references %s, which is not part of the run; not created", fk.Name, t.Name, fk.RefTable)
+					setMissingStatus(report.MissingReferences, t.Name, fk.Name, constraintSkipped)
+					continue
+				}
+				ref = outsideTable(fk, m.opts)
+				var found bool
+				if err := m.dest.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", destIdent(ref)).Scan(&found); err != nil {
+					return nil, fmt.Errorf("failed to look up %s on the destination: %w", ref.qualifiedDestName(), err)
+				}
+				if !found {
+					report.warnTable(warnForeignKeySkipped, t.Name, "foreign key %s on %s references %s, which is not part of the run and not on the destination as %s; not created",
+						fk.Name, t.Name, fk.RefTable, ref.qualifiedDestName())
+					setMissingStatus(report.MissingReferences, t.Name, fk.Name, constraintSkipped)
+					continue
+				}
+				if missing := missingColumns(t, fk.Columns); len(missing) > 0 {
+					report.warnTable(warnForeignKeySkipped, t.Name, "foreign key %s on %s uses column(s) %s that are not copied; not created", fk.Name, t.Name, strings.Join(missing, ", "))
+					setMissingStatus(report.MissingReferences, t.Name, fk.Name, constraintSkipped)
+					continue
+				}
+				report.warnTable(warnForeignKeyNotValid, t.Name, "foreign key %s on %s references %s, which is not part of the run; created NOT VALID", fk.Name, t.Name, fk.RefTable)
+				setMissingStatus(report.MissingReferences, t.Name, fk.Name, constraintNotValid)
+				fk = fk.onDestination(t, ref)
+				// The referenced rows are not the run's to check
+				if !strings.HasSuffix(fk.Definition, " NOT VALID") {
+					fk.Definition += " NOT VALID"
+				}
+				fk.partitioned = cfg.table(t.Name).PartitionBy != nil
+				out = append(out, fk)
+				continue
+			}
+			if missing := missingColumns(t, fk.Columns); len(missing) > 0 {
+				report.warnTable(warnForeignKeySkipped, t.Name, "foreign key %s on %s uses column(s) %s that are not copied; not created", fk.Name, t.Name, strings.Join(missing, ", "))
+				continue
+			}
+			if missing := missingColumns(ref, fk.RefColumns); len(missing) > 0 {
+				report.warnTable(warnForeignKeySkipped, t.Name, "foreign key %s on %s references column(s) %s of %s that are not copied; not created", fk.Name, t.Name, strings.Join(missing, ", "), ref.Name)
+				continue
+			}
+			fk = fk.onDestination(t, ref)
+			fk.partitioned = cfg.table(t.Name).PartitionBy != nil
+			fk.refPartitioned = cfg.table(ref.Name).PartitionBy != nil
+			out = append(out, fk)
+		}
+	}
+	return out, nil
+}
+
+// outsideTable is the table fk references when it is not part of the run,
+// with the destination names a run migrating it would give it and its
+// referenced columns.
+func outsideTable(fk foreignKey, opts Options) Table {
+	ref := Table{Name: fk.RefTable}
+	if schema, _, ok := strings.Cut(fk.RefTable, "."); ok && slices.Contains(opts.Schemas.sourceSchemas(), schema) {
+		ref.Schema = schema
+	}
+	for _, c := range fk.RefColumns {
+		ref.Columns = append(ref.Columns, Column{Name: c})
+	}
+	tables := []Table{ref}
+	applyNames(tables, opts.Config, opts.SchemaMap, opts.FoldIdentifiers)
+	return tables[0]
+}
+
+// onDestination returns fk with the destination names and schemas of t and
+// ref. When a column or the referenced table is renamed or routed to
+// another schema, the definition is rebuilt from its actions, which
+// pg_get_constraintdef renders after the column lists.
+func (fk foreignKey) onDestination(t, ref Table) foreignKey {
+	d := fk
+	d.Table, d.Name, d.destName = t.destName(), fk.destConstraint(), ""
+	d.Columns, d.RefTable, d.RefColumns = t.destColumns(fk.Columns), ref.destName(), ref.destColumns(fk.RefColumns)
+	d.Schema, d.RefSchema = t.DestSchema, ref.DestSchema
+	if slices.Equal(d.Columns, fk.Columns) && d.RefTable == fk.RefTable && slices.Equal(d.RefColumns, fk.RefColumns) && d.RefSchema == "" {
+		return d
+	}
+	i := strings.Index(fk.Definition, " REFERENCES ")
+	if i < 0 {
+		return d
+	}
+	j := strings.Index(fk.Definition[i:], ")")
+	if j < 0 {
+		return d
+	}
+	d.Definition = "FOREIGN KEY (" + sqlutil.ColumnList(d.Columns) + ") REFERENCES " + d.refTableIdent() +
+		"(" + sqlutil.ColumnList(d.RefColumns) + ")" + fk.Definition[i+j+1:]
+	return d
+}
+
+func missingColumns(t Table, columns []string) []string {
+	var missing []string
+	for _, c := range columns {
+		if _, ok := t.column(c); !ok {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The formats of the state files. A file records the format it was written
+// in; files of older formats are migrated forward when they are loaded, and
+// files of newer ones are refused with a FormatError instead of being
+// misread. Files written before the formats were versioned have none and
+// count as format 1.
+const (
+	// Format 2 records the source schemas of the run
+	checkpointFormat = 2
+	// Format 2 only adds the format itself; every field added since format
+	// 1 is optional
+	schemaSnapshotFormat = 2
+)
+
+// FormatError is a state file written in a format this version does not
+// know, by a newer version of the tool.
+type FormatError struct {
+	// Kind is "checkpoint" or "schema snapshot"
+	Kind   string
+	Path   string
+	Format int
+	Max    int
+	// Advice says what to do about it
+	Advice string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("%s from incompatible version: %s has format %d, this version reads formats 1 to %d; %s",
+		e.Kind, e.Path, e.Format, e.Max, e.Advice)
+}
+
+// fileFormat reads the format of a state file, 1 for one without.
+func fileFormat(data []byte) (int, error) {
+	var head struct {
+		Format *int `json:"format"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return 0, err
+	}
+	switch {
+	case head.Format == nil:
+		return 1, nil
+	case *head.Format < 1:
+		return 0, fmt.Errorf("invalid format %d", *head.Format)
+	}
+	return *head.Format, nil
+}
+
+// migrateCheckpoint brings a checkpoint read in format from up to
+// checkpointFormat.
+func migrateCheckpoint(cp *Checkpoint, from int) {
+	if from < 2 {
+		// Before format 2 only the public schema was migrated
+		cp.Schemas = []string{defaultSchema}
+	}
+	cp.Format = checkpointFormat
+}
+
+// migrateSchemaSnapshot brings a schema snapshot read in format from up to
+// schemaSnapshotFormat.
+func migrateSchemaSnapshot(snap *SchemaSnapshot, from int) {
+	snap.Format = schemaSnapshotFormat
+}
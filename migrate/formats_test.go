@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadCheckpointFormats(t *testing.T) {
+	t.Run("format 1", func(t *testing.T) {
+		cp, err := loadCheckpoint(filepath.Join("testdata", "checkpoint-format1.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp.Format != checkpointFormat || !slices.Equal(cp.Schemas, []string{defaultSchema}) {
+			t.Errorf("format %d, schemas %v; want format %d for public", cp.Format, cp.Schemas, checkpointFormat)
+		}
+		if !cp.completed("users") || cp.completed("events") || !cp.partial("events") {
+			t.Errorf("users completed %v, events partial %v; want users done and events half-way", cp.completed("users"), cp.partial("events"))
+		}
+		if split := cp.Tables["events"].Split; split == nil || len(split.Ranges) != 2 || !split.Ranges[0].Completed || split.Ranges[1].Completed {
+			t.Errorf("events split = %+v, want its first of two ranges done", split)
+		}
+		if !slices.Equal(cp.TempObjects, []string{"_farewall._fxl_3f9a2c1d_upsert_users"}) {
+			t.Errorf("temp objects = %v", cp.TempObjects)
+		}
+	})
+
+	t.Run("format 2", func(t *testing.T) {
+		cp, err := loadCheckpoint(filepath.Join("testdata", "checkpoint-format2.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(cp.Schemas, []string{"public", "sales"}) || cp.SchemaHash != "5b7a0f0c1e2d" {
+			t.Errorf("schemas %v, hash %q; want public and sales", cp.Schemas, cp.SchemaHash)
+		}
+		if ks := cp.Tables["sales.orders"].Keyset; ks == nil || ks.LastKey == nil || *ks.LastKey != "40" {
+			t.Errorf("sales.orders keyset = %+v, want last key 40", ks)
+		}
+		if !cp.Tables["users"].SequencesSynced {
+			t.Error("users lost sequences_synced")
+		}
+	})
+
+	t.Run("newer format", func(t *testing.T) {
+		path := filepath.Join("testdata", "checkpoint-format99.json")
+		_, err := loadCheckpoint(path)
+		var fe *FormatError
+		if !errors.As(err, &fe) || fe.Format != 99 || fe.Kind != "checkpoint" {
+			t.Fatalf("err = %v, want a FormatError for format 99", err)
+		}
+		for _, want := range []string{"checkpoint from incompatible version", path, "finish the run with the version that wrote it, or remove the file"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%q does not say %q", err, want)
+			}
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, data := range []string{`{"format": "two"}`, `{"format": 0}`, `{"tables": []}`, `not json`} {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadCheckpoint(path); err == nil || !strings.Contains(err.Error(), "remove it to start fresh") {
+				t.Errorf("%s: err = %v, want a parse error telling to start fresh", data, err)
+			}
+		}
+	})
+
+	// Saving writes the current format, which loads back unchanged
+	t.Run("round trip", func(t *testing.T) {
+		cp, err := loadCheckpoint(filepath.Join("testdata", "checkpoint-format1.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.path = filepath.Join(t.TempDir(), "checkpoint.json")
+		if err := cp.save(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(cp.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format, err := fileFormat(data); err != nil || format != checkpointFormat {
+			t.Errorf("saved format = %d, %v; want %d", format, err, checkpointFormat)
+		}
+	})
+}
+
+func TestLoadSchemaSnapshotFormats(t *testing.T) {
+	snap, err := loadSchemaSnapshot(filepath.Join("testdata", "schema-snapshot-format1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Format != schemaSnapshotFormat || len(snap.Tables) != 1 || len(snap.Tables[0].Columns) != 2 || snap.SourcePosition != nil {
+		t.Errorf("snapshot = %+v, want users with two columns in format %d", snap, schemaSnapshotFormat)
+	}
+	if c := snap.Tables[0].Columns[0]; c.Default == nil || *c.Default != "nextval('users_id_seq'::regclass)" || c.IsNullable != "NO" {
+		t.Errorf("users.id = %+v", c)
+	}
+
+	path := filepath.Join("testdata", "schema-snapshot-format3.json")
+	_, err = loadSchemaSnapshot(path)
+	var fe *FormatError
+	if !errors.As(err, &fe) || fe.Format != 3 || !strings.Contains(err.Error(), "schema snapshot from incompatible version") {
+		t.Errorf("err = %v, want a FormatError for format 3", err)
+	}
+}
@@ -0,0 +1,32 @@
+package migrate
+
+// freezeBlocker returns why t cannot be loaded with COPY FREEZE under
+// --freeze, or "" when it can. FREEZE needs the table truncated in the same
+// transaction as a single COPY, which only the CSV passthrough sends
+// itself; pgx's CopyFrom has no way to add the option. batched is set when
+// the destination pooler takes batched INSERTs (see runEnv).
+func freezeBlocker(t Table, tc TableConfig, opts Options, pipelines []*columnPipeline, upsert, keyset, batched bool) string {
+	switch {
+	case upsert:
+		return "upserts merge into the existing rows"
+	case tc.SplitBy != nil:
+		return "split_by copies each range in its own transaction"
+	case keyset:
+		return "tables copied in key chunks write each chunk with its own COPY"
+	case tc.PartitionBy != nil:
+		return "PostgreSQL does not support COPY FREEZE on partitioned tables"
+	case pipelines != nil:
+		return "column normalization and encryption need the row-by-row copy"
+	case hasPgcryptoColumns(t):
+		return "pgcrypto columns are loaded through a staging table"
+	case t.FetchSize > 0:
+		return "tables read through a cursor use the row-by-row copy"
+	case batched:
+		return "the destination pooler takes batched INSERTs rather than COPY"
+	case opts.CopyMethod == copyMethodRows:
+		return "--copy-method rows cannot request FREEZE"
+	case !useCSVPassthrough(opts.CopyMethod, t, tc):
+		return "converted or transformed columns need the row-by-row copy"
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package migrate
+
+import "testing"
+
+func TestFreezeBlocker(t *testing.T) {
+	plain := Table{Name: "t", Columns: []Column{{Name: "id", DataType: "integer"}, {Name: "name", DataType: "text"}}}
+	with := func(f func(*Table)) Table {
+		t := plain
+		t.Columns = append([]Column(nil), plain.Columns...)
+		f(&t)
+		return t
+	}
+	auto := Options{CopyMethod: copyMethodAuto}
+	for _, tt := range []struct {
+		name      string
+		table     Table
+		tc        TableConfig
+		opts      Options
+		pipelines []*columnPipeline
+		upsert    bool
+		keyset    bool
+		batched   bool
+		want      string
+	}{
+		{name: "plain table", table: plain, opts: auto},
+		{name: "csv", table: plain, opts: Options{CopyMethod: copyMethodCSV}},
+		{name: "upsert", table: plain, opts: auto, upsert: true, want: "upserts merge into the existing rows"},
+		{name: "split", table: plain, tc: TableConfig{SplitBy: &SplitConfig{Column: "id", Chunks: 4}}, opts: auto, want: "split_by copies each range in its own transaction"},
+		{name: "keyset", table: plain, opts: auto, keyset: true, want: "tables copied in key chunks write each chunk with its own COPY"},
+		{name: "partitioned", table: plain, tc: TableConfig{PartitionBy: &PartitionConfig{}}, opts: auto, want: "PostgreSQL does not support COPY FREEZE on partitioned tables"},
+		{name: "normalized", table: plain, opts: auto, pipelines: []*columnPipeline{nil}, want: "column normalization and encryption need the row-by-row copy"},
+		{name: "pgcrypto", table: with(func(t *Table) { t.Columns[1].Encrypt = encryptPgcrypto }), opts: auto, want: "pgcrypto columns are loaded through a staging table"},
+		{name: "cursor", table: with(func(t *Table) { t.FetchSize = 100 }), opts: auto, want: "tables read through a cursor use the row-by-row copy"},
+		{name: "pooler", table: plain, opts: auto, batched: true, want: "the destination pooler takes batched INSERTs rather than COPY"},
+		{name: "rows", table: plain, opts: Options{CopyMethod: copyMethodRows}, want: "--copy-method rows cannot request FREEZE"},
+		{name: "converted column", table: with(func(t *Table) { t.Columns[1].SourceExpr = `"name"::text` }), opts: auto, want: "converted or transformed columns need the row-by-row copy"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freezeBlocker(tt.table, tt.tc, tt.opts, tt.pipelines, tt.upsert, tt.keyset, tt.batched); got != tt.want {
+				t.Errorf("freezeBlocker = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
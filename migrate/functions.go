@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	functionCreated = "created"
+	functionSkipped = "skipped"
+)
+
+// function is a function or procedure of a source schema of the run,
+// created on the destination with --include-functions, in DestSchema
+// (empty for public; see mapObjectSchemas).
+type function struct {
+	Schema     string
+	DestSchema string `db:"-"`
+	Name       string
+	// Arguments are the identity arguments, which tell overloads apart
+	Arguments string
+	// Definition is the CREATE OR REPLACE statement of pg_get_functiondef
+	Definition string
+}
+
+// FunctionReport describes one function of the create-schema phase.
+type FunctionReport struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+	// Reason is why a function was skipped
+	Reason string `json:"reason,omitempty"`
+}
+
+// introspectFunctions reads the functions and procedures of schemas in
+// creation order. Aggregates and window functions have no
+// pg_get_functiondef, and the members of extensions come with the extension.
+func introspectFunctions(ctx context.Context, conn Querier, schemas []string) ([]function, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname::text, p.proname::text, pg_get_function_identity_arguments(p.oid), pg_get_functiondef(p.oid)
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname = ANY($1)
+		  AND p.prokind IN ('f', 'p')
+		  AND NOT EXISTS (
+			SELECT 1
+			FROM pg_depend d
+			WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e'
+		  )
+		ORDER BY p.oid
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get functions: %w", err)
+	}
+	functions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[function])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get functions: %w", err)
+	}
+	return functions, nil
+}
+
+// createFunctions creates the functions before the tables, whose defaults
+// and checks may call them. Function bodies are not checked on creation,
+// as with pg_dump, since SQL functions may read tables that do not exist
+// yet; the SET LOCAL applies to the implicit transaction of the two
+// statements. An existing function of the same signature is replaced.
+// Functions calling Xata internals are skipped with a warning.
+func createFunctions(ctx context.Context, conn Querier, functions []function, report *Report) error {
+	if len(functions) == 0 {
+		return nil
+	}
+	for _, f := range functions {
+		name := sourceTableKey(f.Schema, f.Name)
+		fr := FunctionReport{Name: name, Arguments: f.Arguments, Status: functionCreated}
+		if referencesXataInternals(f.Definition) {
+			fr.Status, fr.Reason = functionSkipped, "it refers to Xata internals"
+			report.warn(warnFunctionSkipped, "function %s(%s) was not created: %s", name, f.Arguments, fr.Reason)
+			report.Functions = append(report.Functions, fr)
+			continue
+		}
+		if _, err := conn.Exec(ctx, "SET LOCAL check_function_bodies = off;\n"+objectSearchPath(f.Schema, f.DestSchema)+f.Definition); err != nil {
+			return &SchemaError{Err: fmt.Errorf("failed to create function %s(%s): %w", name, f.Arguments, err)}
+		}
+		fmt.Printf("  Function %s(%s)\n", name, f.Arguments)
+		report.Functions = append(report.Functions, fr)
+	}
+	return nil
+}
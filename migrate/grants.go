@@ -0,0 +1,389 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	grantGranted     = "granted"
+	grantMissingRole = "missing_role"
+	// grantUnverified is a GRANT that ran but left the role without USAGE,
+	// e.g. because the migration role does not own the sequence
+	grantUnverified = "unverified"
+	// grantFailed is a change of owner the destination refused
+	grantFailed = "failed"
+
+	// publicGrantee is how aclexplode's grantee 0 is granted and checked
+	publicGrantee = "PUBLIC"
+)
+
+// TableGrant is the GRANT of a table's privileges to one role, or with
+// Owner its change of owner.
+type TableGrant struct {
+	Table      string   `json:"table"`
+	Role       string   `json:"role"`
+	Privileges []string `json:"privileges,omitempty"`
+	// GrantOption is set for privileges granted WITH GRANT OPTION
+	GrantOption bool   `json:"grant_option,omitempty"`
+	Owner       bool   `json:"owner,omitempty"`
+	Status      string `json:"status"`
+	// Statement is the statement to run by hand when Status is not granted
+	Statement string `json:"statement,omitempty"`
+	// Reason is the error of a change of owner that failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// tableACL is one row of tablePrivileges.
+type tableACL struct {
+	table       string
+	role        string
+	privileges  []string
+	grantOption bool
+}
+
+// SequenceGrant is one GRANT of the grants phase on the sequence of a SERIAL
+// column.
+type SequenceGrant struct {
+	Table    string `json:"table"`
+	Sequence string `json:"sequence"`
+	Role     string `json:"role"`
+	Status   string `json:"status"`
+	// Statement is the GRANT to run by hand when Status is not granted
+	Statement string `json:"statement,omitempty"`
+}
+
+// parseRoleMap parses the old=new pairs of --role-map.
+func parseRoleMap(pairs []string) (map[string]string, error) {
+	roles := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		from, to, ok := strings.Cut(p, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --role-map %q (expected old=new)", p)
+		}
+		if _, dup := roles[from]; dup {
+			return nil, fmt.Errorf("--role-map maps %s more than once", from)
+		}
+		roles[from] = to
+	}
+	return roles, nil
+}
+
+// Grants grants the roles of the source their privileges on the destination
+// with --include-grants. The recreated tables get the table privileges of
+// the source tables. The sequences SERIAL columns get on the destination
+// are new objects, so roles that can insert into a source table are granted
+// USAGE and SELECT on the sequences of its SERIAL columns, and each grant is
+// checked with has_sequence_privilege, which unlike nextval leaves the
+// sequence alone. With --include-ownership the tables are then given the
+// owners of the source tables.
+func (m *Migrator) Grants(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseGrants, state, m.grants)
+}
+
+func (m *Migrator) grants(ctx context.Context, state *MigrationState) error {
+	if !m.opts.IncludeGrants {
+		return nil
+	}
+	// Validated with the options
+	roleMap, _ := parseRoleMap(m.opts.RoleMap)
+	existing, err := destinationRoles(ctx, m.dest)
+	if err != nil {
+		return err
+	}
+
+	var tables []Table
+	for _, t := range state.Tables {
+		// A kept table keeps the privileges it has on the destination
+		if !state.Keep[t.Name] {
+			tables = append(tables, t)
+		}
+	}
+	if err := m.grantTables(ctx, tables, roleMap, existing, state.Report); err != nil {
+		return err
+	}
+
+	fmt.Println("Granting sequence privileges...")
+	for _, t := range state.Tables {
+		for _, c := range t.Columns {
+			if c.DataType != "SERIAL" && c.DataType != "BIGSERIAL" {
+				continue
+			}
+			grantees, err := sequenceGrantees(ctx, m.source, t, c)
+			if err != nil {
+				return err
+			}
+			if len(grantees) == 0 {
+				continue
+			}
+			var seq *string
+			if err := m.dest.QueryRow(ctx, "SELECT pg_get_serial_sequence($1, $2)", destIdent(t), c.destName()).Scan(&seq); err != nil {
+				return fmt.Errorf("failed to find the sequence of %s.%s: %w", t.Name, c.Name, err)
+			}
+			// A kept table may generate its values differently
+			if seq == nil {
+				continue
+			}
+			for _, grantee := range grantees {
+				role := grantee
+				if to, ok := roleMap[grantee]; ok {
+					role = to
+				}
+				g, err := grantSequence(ctx, m.dest, t.Name, *seq, role, existing)
+				if err != nil {
+					return err
+				}
+				switch g.Status {
+				case grantMissingRole:
+					state.Report.warnTable(warnSequenceGrant, t.Name, "role %s does not exist on the destination; run: %s;", role, g.Statement)
+				case grantUnverified:
+					state.Report.warnTable(warnSequenceGrant, t.Name, "role %s still cannot use sequence %s after the grant; run as its owner: %s;", role, *seq, g.Statement)
+				default:
+					fmt.Printf("  %s: USAGE, SELECT to %s\n", *seq, role)
+				}
+				state.Report.SequenceGrants = append(state.Report.SequenceGrants, g)
+			}
+		}
+	}
+	if m.opts.IncludeOwnership {
+		return m.transferOwnership(ctx, tables, roleMap, existing, state.Report)
+	}
+	return nil
+}
+
+// grantTables grants the privileges the source tables give roles other
+// than their owner, which the migration role as owner of the new tables
+// already has. A role missing on the destination is skipped with a
+// warning.
+func (m *Migrator) grantTables(ctx context.Context, tables []Table, roleMap map[string]string, existing map[string]bool, report *Report) error {
+	acls, err := tablePrivileges(ctx, m.source, tables)
+	if err != nil {
+		return err
+	}
+	if len(acls) == 0 {
+		return nil
+	}
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+	fmt.Println("Granting table privileges...")
+	for _, acl := range acls {
+		t := byName[acl.table]
+		role := mappedRole(roleMap, acl.role)
+		g := TableGrant{Table: t.Name, Role: role, Privileges: acl.privileges, GrantOption: acl.grantOption}
+		g.Statement = "GRANT " + strings.Join(acl.privileges, ", ") + " ON TABLE " + destIdent(t) + " TO " + granteeIdent(role)
+		if acl.grantOption {
+			g.Statement += " WITH GRANT OPTION"
+		}
+		if role != publicGrantee && !existing[role] {
+			g.Status = grantMissingRole
+			report.warnTable(warnTableGrant, t.Name, "role %s does not exist on the destination; run: %s;", role, g.Statement)
+			report.TableGrants = append(report.TableGrants, g)
+			continue
+		}
+		if _, err := m.dest.Exec(ctx, g.Statement); err != nil {
+			return fmt.Errorf("failed to grant %s privileges on %s: %w", role, t.Name, err)
+		}
+		fmt.Printf("  %s: %s to %s\n", t.qualifiedDestName(), strings.Join(acl.privileges, ", "), role)
+		g.Status, g.Statement = grantGranted, ""
+		report.TableGrants = append(report.TableGrants, g)
+	}
+	return nil
+}
+
+// transferOwnership gives every table the owner of its source table. The
+// migration role must be a member of the new owner; a change that fails
+// for that or another reason is left to run by hand, with a warning.
+func (m *Migrator) transferOwnership(ctx context.Context, tables []Table, roleMap map[string]string, existing map[string]bool, report *Report) error {
+	owners, err := tableOwners(ctx, m.source, tables)
+	if err != nil {
+		return err
+	}
+	var current string
+	if err := m.dest.QueryRow(ctx, "SELECT current_user::text").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read the destination role: %w", err)
+	}
+	fmt.Println("Transferring table ownership...")
+	for _, t := range tables {
+		owner, ok := owners[t.Name]
+		if !ok {
+			continue
+		}
+		role := mappedRole(roleMap, owner)
+		if role == current {
+			continue
+		}
+		g := TableGrant{Table: t.Name, Role: role, Owner: true, Statement: "ALTER TABLE " + destIdent(t) + " OWNER TO " + sqlutil.QuoteIdent(role)}
+		switch {
+		case !existing[role]:
+			g.Status = grantMissingRole
+			report.warnTable(warnTableGrant, t.Name, "role %s does not exist on the destination; run: %s;", role, g.Statement)
+		default:
+			if _, err := m.dest.Exec(ctx, g.Statement); err != nil {
+				g.Status, g.Reason = grantFailed, err.Error()
+				report.warnTable(warnTableGrant, t.Name, "table %s could not be given to %s (%v); run as a member of %s: %s;", t.Name, role, err, role, g.Statement)
+				break
+			}
+			fmt.Printf("  %s: owned by %s\n", t.qualifiedDestName(), role)
+			g.Status, g.Statement = grantGranted, ""
+		}
+		report.TableGrants = append(report.TableGrants, g)
+	}
+	return nil
+}
+
+func mappedRole(roleMap map[string]string, role string) string {
+	if to, ok := roleMap[role]; ok {
+		return to
+	}
+	return role
+}
+
+func granteeIdent(role string) string {
+	if role == publicGrantee {
+		return publicGrantee
+	}
+	return sqlutil.QuoteIdent(role)
+}
+
+// tablePrivileges reads the privileges the source tables grant to roles
+// other than their owners, one row per table, grantee and grant option.
+func tablePrivileges(ctx context.Context, source Querier, tables []Table) ([]tableACL, error) {
+	rows, err := source.Query(ctx, `
+		SELECT `+sourceKeySQL+`, coalesce(r.rolname::text, 'PUBLIC'),
+			array_agg(a.privilege_type::text ORDER BY a.privilege_type), a.is_grantable
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN LATERAL aclexplode(c.relacl) a
+		LEFT JOIN pg_roles r ON r.oid = a.grantee
+		WHERE n.nspname = ANY($1)
+		  AND c.relkind IN ('r', 'p')
+		  AND a.grantee <> c.relowner
+		GROUP BY 1, 2, 4
+		ORDER BY 1, 2, 4
+	`, tableSchemas(tables))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table privileges: %w", err)
+	}
+	acls, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (tableACL, error) {
+		var acl tableACL
+		err := row.Scan(&acl.table, &acl.role, &acl.privileges, &acl.grantOption)
+		return acl, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table privileges: %w", err)
+	}
+	names := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		names[t.Name] = true
+	}
+	return slices.DeleteFunc(acls, func(acl tableACL) bool { return !names[acl.table] }), nil
+}
+
+// tableOwners returns the owners of the source tables of the schemas of
+// tables, by table key.
+func tableOwners(ctx context.Context, source Querier, tables []Table) (map[string]string, error) {
+	rows, err := source.Query(ctx, `
+		SELECT `+sourceKeySQL+`, pg_get_userbyid(c.relowner)::text
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($1)
+		  AND c.relkind IN ('r', 'p')
+	`, tableSchemas(tables))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table owners: %w", err)
+	}
+	defer rows.Close()
+	owners := map[string]string{}
+	for rows.Next() {
+		var table, owner string
+		if err := rows.Scan(&table, &owner); err != nil {
+			return nil, fmt.Errorf("failed to read table owners: %w", err)
+		}
+		owners[table] = owner
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read table owners: %w", err)
+	}
+	return owners, nil
+}
+
+// grantSequence grants role USAGE and SELECT on seq and checks that role can
+// use it. A role missing on the destination is not granted anything.
+func grantSequence(ctx context.Context, dest Querier, table, seq, role string, existing map[string]bool) (SequenceGrant, error) {
+	grantee, check := publicGrantee, "public"
+	if role != publicGrantee {
+		grantee, check = sqlutil.QuoteIdent(role), role
+	}
+	g := SequenceGrant{
+		Table:     table,
+		Sequence:  seq,
+		Role:      role,
+		Statement: "GRANT USAGE, SELECT ON SEQUENCE " + seq + " TO " + grantee,
+	}
+	if role != publicGrantee && !existing[role] {
+		g.Status = grantMissingRole
+		return g, nil
+	}
+	if _, err := dest.Exec(ctx, g.Statement); err != nil {
+		return g, fmt.Errorf("failed to grant %s USAGE on sequence %s: %w", role, seq, err)
+	}
+	var ok bool
+	if err := dest.QueryRow(ctx, "SELECT has_sequence_privilege($1, $2, 'USAGE')", check, seq).Scan(&ok); err != nil {
+		return g, fmt.Errorf("failed to check %s's USAGE on sequence %s: %w", role, seq, err)
+	}
+	if !ok {
+		g.Status = grantUnverified
+		return g, nil
+	}
+	g.Status, g.Statement = grantGranted, ""
+	return g, nil
+}
+
+// sequenceGrantees returns the source roles, other than the owner, that can
+// insert into t or use the sequence behind c, which together need the
+// destination sequence. PUBLIC stands for grants to everyone.
+func sequenceGrantees(ctx context.Context, source Querier, t Table, c Column) ([]string, error) {
+	rows, err := source.Query(ctx, `
+		SELECT DISTINCT coalesce(r.rolname::text, 'PUBLIC')
+		FROM pg_class cl
+		CROSS JOIN LATERAL aclexplode(cl.relacl) a
+		LEFT JOIN pg_roles r ON r.oid = a.grantee
+		WHERE cl.oid IN ($1::regclass, pg_get_serial_sequence($1, $2)::regclass)
+		  AND a.grantee <> cl.relowner
+		  AND a.privilege_type = CASE WHEN cl.relkind = 'S' THEN 'USAGE' ELSE 'INSERT' END
+		ORDER BY 1
+	`, schemaIdent(t.Schema, t.Name), c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the grants of %s: %w", t.Name, err)
+	}
+	grantees, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the grants of %s: %w", t.Name, err)
+	}
+	return grantees, nil
+}
+
+// destinationRoles returns the roles of the destination cluster.
+func destinationRoles(ctx context.Context, dest Querier) (map[string]bool, error) {
+	rows, err := dest.Query(ctx, `SELECT rolname::text FROM pg_roles`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination roles: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination roles: %w", err)
+	}
+	out := make(map[string]bool, len(names))
+	for _, name := range names {
+		out[name] = true
+	}
+	return out, nil
+}
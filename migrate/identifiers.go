@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1. The server silently
+// truncates longer names, which can make two generated names collide.
+const maxIdentifierLength = 63
+
+const identifierHashLength = 8
+
+// physicalName returns the destination identifier for a generated logical
+// name. Names that fit are used unchanged; longer ones are cut at a rune
+// boundary and get a short hash of the full name appended, so the result is
+// deterministic and distinct logical names stay distinct.
+func physicalName(logical string) string {
+	if len(logical) <= maxIdentifierLength {
+		return logical
+	}
+	cut := maxIdentifierLength - identifierHashLength - 1
+	for cut > 0 && !utf8.RuneStart(logical[cut]) {
+		cut--
+	}
+	sum := sha256.Sum256([]byte(logical))
+	return logical[:cut] + "_" + hex.EncodeToString(sum[:])[:identifierHashLength]
+}
+
+// suffixedName appends suffix to name, cutting name at a rune boundary so
+// the result still fits in an identifier; the server would otherwise
+// truncate it back to the name the suffix was meant to tell it apart from.
+func suffixedName(name, suffix string) string {
+	cut := min(len(name), maxIdentifierLength-len(suffix))
+	for cut > 0 && cut < len(name) && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + suffix
+}
+
+type IdentifierMapping struct {
+	Schema   string `json:"schema"`
+	Logical  string `json:"logical"`
+	Physical string `json:"physical"`
+}
+
+// generatedNames lists, per schema, the logical names of every object this
+// run may create.
+func generatedNames(tables []Table, opts Options, runID string) map[string][]string {
+	names := map[string][]string{}
+	for _, t := range tables {
+		schema := t.destSchema()
+		names[schema] = append(names[schema], t.destName())
+		if pc := opts.Config.table(t.Name).PartitionBy; pc != nil {
+			for _, p := range pc.Partitions {
+				names[schema] = append(names[schema], p.Name)
+			}
+			if opts.PartitionOutliers == partitionOutliersDefault {
+				names[schema] = append(names[schema], pc.logicalDefaultName(t.destName()))
+			}
+		}
+		if opts.Differential {
+			names[stateSchema] = append(names[stateSchema],
+				hashStatePrefix+t.Name,
+				logicalTempName(runID, tempNewHashes, t.Name),
+				logicalTempName(runID, tempStaging, t.Name))
+		}
+		if opts.Upsert {
+			names[stateSchema] = append(names[stateSchema], logicalTempName(runID, tempUpsert, t.Name))
+		}
+		if k := opts.Config.table(t.Name).UUIDKey; k != nil && k.Mode == uuidKeyRandom {
+			names[stateSchema] = append(names[stateSchema], uuidMapPrefix+t.Name)
+		}
+	}
+	return names
+}
+
+// checkIdentifiers maps every generated name to its physical name, fails
+// when two distinct names end up the same, and records the shortened ones
+// in the report.
+func checkIdentifiers(tables []Table, opts Options, runID string, report *Report) error {
+	byName := generatedNames(tables, opts, runID)
+	schemas := make([]string, 0, len(byName))
+	for schema := range byName {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+
+	for _, schema := range schemas {
+		seen := map[string]string{}
+		for _, logical := range byName[schema] {
+			physical := physicalName(logical)
+			if other, ok := seen[physical]; ok && other != logical {
+				return fmt.Errorf("generated names %s and %s both map to %s.%s; rename one of them", other, logical, schema, physical)
+			}
+			if _, ok := seen[physical]; ok {
+				continue
+			}
+			seen[physical] = logical
+			if physical != logical {
+				report.Identifiers = append(report.Identifiers, IdentifierMapping{Schema: schema, Logical: logical, Physical: physical})
+			}
+		}
+	}
+	for _, m := range report.Identifiers {
+		fmt.Printf("  Shortened %s.%s to %s\n", m.Schema, m.Logical, m.Physical)
+	}
+	return nil
+}
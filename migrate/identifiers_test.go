@@ -0,0 +1,62 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPhysicalName(t *testing.T) {
+	exact := strings.Repeat("a", maxIdentifierLength)
+	if got := physicalName(exact); got != exact {
+		t.Errorf("physicalName of a %d-byte name = %q, want it unchanged", len(exact), got)
+	}
+
+	// é takes bytes 53 and 54, so the cut at 54 would split it
+	straddling := strings.Repeat("a", 53) + "é" + strings.Repeat("b", 20)
+	got := physicalName(straddling)
+	if !utf8.ValidString(got) {
+		t.Errorf("physicalName cut é in half: %q", got)
+	}
+	if !strings.HasPrefix(got, strings.Repeat("a", 53)+"_") || len(got) != 53+1+identifierHashLength {
+		t.Errorf("physicalName = %q, want the 53 bytes before é and the hash", got)
+	}
+	if physicalName(straddling) != got {
+		t.Error("physicalName is not deterministic")
+	}
+
+	prefix := strings.Repeat("p", 60)
+	one, two := physicalName(prefix+"_one_12345"), physicalName(prefix+"_two_12345")
+	if len(prefix+"_one_12345") != 70 || len(one) != maxIdentifierLength || len(two) != maxIdentifierLength {
+		t.Errorf("physical names %q and %q of 70-byte names do not fill an identifier", one, two)
+	}
+	if one == two || one[:54] != two[:54] {
+		t.Errorf("physical names %q and %q, want the same cut told apart by the hash", one, two)
+	}
+}
+
+func TestCheckIdentifiers(t *testing.T) {
+	prefix := strings.Repeat("p", 60)
+	exact := strings.Repeat("e", maxIdentifierLength)
+	straddling := strings.Repeat("a", 53) + "é" + strings.Repeat("b", 20)
+	tables := []Table{{Name: prefix + "_one_12345"}, {Name: prefix + "_two_12345"}, {Name: straddling}, {Name: exact}}
+	report := newReport(false)
+	if err := checkIdentifiers(tables, Options{}, "run", report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Identifiers) != 3 {
+		t.Fatalf("report.Identifiers = %+v, want every name but the 63-byte one", report.Identifiers)
+	}
+	for i, m := range report.Identifiers {
+		if m.Schema != defaultSchema || m.Logical != tables[i].Name || m.Physical != physicalName(tables[i].Name) {
+			t.Errorf("report.Identifiers[%d] = %+v, want %s shortened in %s", i, m, tables[i].Name, defaultSchema)
+		}
+	}
+
+	// a table named like the shortened name of another takes its place
+	long := prefix + "_one_12345"
+	err := checkIdentifiers([]Table{{Name: long}, {Name: physicalName(long)}}, Options{}, "run", newReport(false))
+	if err == nil || !strings.Contains(err.Error(), "both map to public."+physicalName(long)) {
+		t.Errorf("error = %v, want the two names mapping to one", err)
+	}
+}
@@ -0,0 +1,204 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// importHistoryTable records, on the destination, every table an import
+// loaded, so an import run again skips them.
+const importHistoryTable = "import_history"
+
+// importHistory returns the tables of the export runID already imported.
+func importHistory(ctx context.Context, dest *pgx.Conn, runID string) (map[string]bool, error) {
+	history := sqlutil.QualifiedIdent(stateSchema, importHistoryTable)
+	stmts := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + sqlutil.QuoteIdent(stateSchema),
+		"CREATE TABLE IF NOT EXISTS " + history + " (run_id text NOT NULL, table_name text NOT NULL, row_count bigint NOT NULL, sha256 text NOT NULL, imported_at timestamptz NOT NULL DEFAULT now(), PRIMARY KEY (run_id, table_name))",
+	}
+	for _, stmt := range stmts {
+		if _, err := dest.Exec(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("failed to prepare the import history: %w", err)
+		}
+	}
+	rows, err := dest.Query(ctx, "SELECT table_name FROM "+history+" WHERE run_id = $1", runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the import history: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the import history: %w", err)
+	}
+	done := make(map[string]bool, len(names))
+	for _, n := range names {
+		done[n] = true
+	}
+	return done, nil
+}
+
+// importIdent quotes the destination table of name, "table" or
+// "schema.table" as in the manifest.
+func importIdent(name string) string {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return sqlutil.QualifiedIdent(schema, table)
+	}
+	return sqlutil.QualifiedIdent(defaultSchema, name)
+}
+
+// importTable loads one exported table into its existing destination table
+// in a single transaction: it is truncated, loaded with COPY ... FROM STDIN
+// as the object streams in, checked against the manifest's checksum and
+// recorded in the history. Any failure rolls all of it back, so the table is
+// started over cleanly by the next import.
+func importTable(ctx context.Context, dest *pgx.Conn, store objectStore, runID string, et ExportTable) (err error) {
+	r, err := store.open(ctx, et.Key)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", store.location(et.Key), err)
+	}
+	defer r.Close()
+
+	tx, err := dest.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start the import of %s: %w", et.Table, err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+	into := importIdent(et.Table)
+	if _, err := tx.Exec(ctx, sqlutil.Truncate(into)); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", et.Table, err)
+	}
+	sum := sha256.New()
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, io.TeeReader(r, sum), sqlutil.CopyFrom(into, et.Columns, "FORMAT csv, HEADER"))
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", et.Table, err)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != et.SHA256 {
+		return fmt.Errorf("%s does not match the manifest: sha256 %s, expected %s", store.location(et.Key), got, et.SHA256)
+	}
+	if tag.RowsAffected() != et.Rows {
+		return fmt.Errorf("%s has %d rows, the manifest %d", store.location(et.Key), tag.RowsAffected(), et.Rows)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO "+sqlutil.QualifiedIdent(stateSchema, importHistoryTable)+" (run_id, table_name, row_count, sha256) VALUES ($1, $2, $3, $4)",
+		runID, et.Table, et.Rows, et.SHA256); err != nil {
+		return fmt.Errorf("failed to record the import of %s: %w", et.Table, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit the import of %s: %w", et.Table, err)
+	}
+	return nil
+}
+
+// runImport implements the import subcommand, which loads an export into
+// the existing destination tables.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var env envSettings
+	env.register(fs)
+	from := fs.String("from", "", "Directory (or file:// URL), s3://bucket/prefix or gs://bucket/prefix of one export run, holding its manifest.json")
+	maxRetries := fs.Int("max-retries", 3, "Resume a download, or restart the import of a table, this many times after a transient failure such as a lost connection")
+	fs.Parse(args)
+
+	if *from == "" {
+		log.Print("--from is required")
+		return 2
+	}
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	store, err := openStore(*from, storeOptions{ReadRetries: *maxRetries})
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	ctx := context.Background()
+	r, err := store.open(ctx, exportManifestKey)
+	if err != nil {
+		log.Printf("Failed to open the manifest: %v", err)
+		return 1
+	}
+	var manifest ExportManifest
+	err = json.NewDecoder(r).Decode(&manifest)
+	r.Close()
+	if err != nil {
+		log.Printf("Failed to read the manifest: %v", err)
+		return 1
+	}
+	for _, et := range manifest.Tables {
+		if len(et.Columns) == 0 || et.SHA256 == "" {
+			log.Printf("The manifest lacks the columns or checksum of %s; export again with this version", et.Table)
+			return 1
+		}
+	}
+
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 1
+	}
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 1
+	}
+	defer func() { dest.Close(ctx) }()
+
+	done, err := importHistory(ctx, dest, manifest.RunID)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("Importing %d table(s) of run %s...\n", len(manifest.Tables), manifest.RunID)
+	var imported int
+	for _, et := range manifest.Tables {
+		if done[et.Table] {
+			fmt.Printf("  %s: already imported\n", et.Table)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = importTable(ctx, dest, store, manifest.RunID, et)
+			if err == nil || !isTransient(err) || attempt > *maxRetries {
+				break
+			}
+			// The failed attempt was rolled back, so the table starts over
+			wait := runBackoff(tableRetryBackoff, attempt)
+			log.Printf("Import of %s failed (attempt %d of %d): %v; retrying in %s", et.Table, attempt, *maxRetries+1, err, wait)
+			time.Sleep(wait)
+			if dest.IsClosed() {
+				conn, cerr := pgx.Connect(ctx, destURL)
+				if cerr != nil {
+					err = fmt.Errorf("failed to reconnect to the destination: %w", cerr)
+					break
+				}
+				dest = conn
+			}
+		}
+		if err != nil {
+			log.Printf("Import failed: %v", err)
+			return 1
+		}
+		fmt.Printf("  %s: %d rows\n", et.Table, et.Rows)
+		imported++
+	}
+	fmt.Printf("Imported %d table(s), %d already imported.\n", imported, len(manifest.Tables)-imported)
+	return 0
+}
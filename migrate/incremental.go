@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// defaultIncrementalColumns are the updated-at columns --incremental looks
+// for, in order, unless --incremental-column names one.
+var defaultIncrementalColumns = []string{"xata.updatedat", "xata_updatedat", "updated_at"}
+
+// Watermark is the newest updated-at value of a table as of its last
+// complete copy with --incremental. The next run reads the rows from it on.
+type Watermark struct {
+	Column    string    `json:"column"`
+	Value     time.Time `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// incrementalColumn returns the updated-at column of t: the one named by
+// name, or else the first of defaultIncrementalColumns it has. Only
+// timestamp and date columns qualify.
+func incrementalColumn(t Table, name string) (Column, bool) {
+	names := defaultIncrementalColumns
+	if name != "" {
+		names = []string{name}
+	}
+	for _, n := range names {
+		c, ok := t.column(n)
+		if !ok {
+			continue
+		}
+		dataType := strings.ToLower(c.DataType)
+		if strings.HasPrefix(dataType, "timestamp") || dataType == "date" {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// incrementalColumnNames describes the columns incrementalColumn looks for.
+func incrementalColumnNames(name string) string {
+	if name != "" {
+		return name
+	}
+	return strings.Join(defaultIncrementalColumns, " or ")
+}
+
+// planIncremental returns the tables of an --incremental run that are read
+// from their watermark on, with the watermark: those a complete copy
+// recorded one for, on the same column, that still exist on the destination
+// and have a key to upsert on. The others are copied in full; those without
+// an updated-at column are warned about.
+func planIncremental(ctx context.Context, dest Querier, tables []Table, opts Options, cp *Checkpoint, report *Report) (map[string]*Watermark, error) {
+	existing, err := existingTables(ctx, dest, tables)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*Watermark{}
+	var full int
+	for _, t := range tables {
+		c, ok := incrementalColumn(t, opts.IncrementalColumn)
+		if !ok {
+			full++
+			report.warnTable(warnIncrementalFull, t.Name, "table %s has no %s column; --incremental copies it in full", t.Name, incrementalColumnNames(opts.IncrementalColumn))
+			continue
+		}
+		w := cp.Watermarks[t.Name]
+		switch {
+		case w == nil || w.Column != c.Name:
+			full++
+			fmt.Printf("  %s: no watermark on %s yet; copied in full\n", t.Name, c.Name)
+		case !existing[t.Name]:
+			full++
+			fmt.Printf("  %s: missing on the destination; copied in full\n", t.Name)
+		case len(t.PrimaryKey) == 0 && opts.Config.table(t.Name).OnConflict == nil:
+			full++
+			report.warnTable(warnIncrementalFull, t.Name, "table %s has no primary key to upsert its changed rows on; --incremental copies it in full", t.Name)
+		default:
+			out[t.Name] = w
+			fmt.Printf("  %s: rows with %s from %s on\n", t.Name, c.Name, formatTimestamp(w.Value))
+		}
+	}
+	fmt.Printf("  %d table(s) read from their watermark, %d copied in full\n", len(out), full)
+	return out, nil
+}
+
+// sinceCondition is the condition selecting the rows of a table changed
+// since w. Rows at the watermark itself are read again, since more of them
+// may have been committed after it was taken; the upsert makes that
+// harmless.
+func sinceCondition(w *Watermark) (string, []any) {
+	return sqlutil.QuoteIdent(w.Column) + " >= $1", []any{w.Value}
+}
+
+// readWatermark returns the newest value of column c of t on source, or nil
+// for a table without any. It is read before the copy, so rows changed
+// during it are read again by the next run.
+func readWatermark(ctx context.Context, source *SourceConn, t Table, c Column) (*time.Time, error) {
+	var value *time.Time
+	query := "SELECT max(" + sqlutil.QuoteIdent(c.Name) + ") FROM " + fromClause(t)
+	if err := source.QueryRow(ctx, query).Scan(&value); err != nil {
+		return nil, onEndpoint(endpointSource, fmt.Errorf("failed to read the watermark of %s: %w", t.Name, err))
+	}
+	return value, nil
+}
+
+// setWatermark records value as the watermark of a table copied completely.
+func (c *Checkpoint) setWatermark(name, column string, value time.Time) error {
+	c.mu.Lock()
+	if c.Watermarks == nil {
+		c.Watermarks = map[string]*Watermark{}
+	}
+	c.Watermarks[name] = &Watermark{Column: column, Value: value, UpdatedAt: utcNow()}
+	c.mu.Unlock()
+	return c.save()
+}
+
+// printIncremental prints how the tables of an --incremental run were read;
+// rows deleted on the source are never removed by it.
+func printIncremental(reports []*TableReport) {
+	var since, full int
+	for _, tr := range reports {
+		if tr.IncrementalSince != nil {
+			since++
+		} else if slices.Contains([]string{tableStatusCopied, tableStatusEmpty}, tr.Status) {
+			full++
+		}
+	}
+	fmt.Printf("Incremental copy: %d table(s) read from their watermark, %d copied in full.\n", since, full)
+	fmt.Println("  Rows deleted on the source since the last run are still on the destination; --incremental copies no deletes.")
+}
@@ -0,0 +1,358 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	indexCreated = "created"
+	indexExists  = "exists"
+	indexSkipped = "skipped"
+	// indexFailed exclusion constraints could not be created for lack of
+	// operator support on the destination (see missingOperatorSupport)
+	indexFailed = "failed"
+	// indexRecorded indexes were written to --ddl-out
+	indexRecorded = "recorded"
+)
+
+// tableIndex is a secondary index of a source table: any index but the
+// primary key's, which CREATE TABLE already declares. Indexes of unique and
+// exclusion constraints are recreated as the constraint.
+type tableIndex struct {
+	Name string
+	// Definition is pg_get_indexdef, or pg_get_constraintdef for a
+	// constraint's index
+	Definition string
+	Constraint bool
+	Exclusion  bool
+	Unique     bool
+	// Partial indexes have a WHERE clause, expression indexes key on
+	// something other than plain columns; Columns are all the columns the
+	// index refers to, in attnum order
+	Partial    bool
+	Expression bool
+	Columns    []string
+	// Keys are the key columns of a unique constraint, in key order, and
+	// KeyList the same quoted as in Definition, so renamed key columns can
+	// be substituted (see uniqueDefinition)
+	Keys    []string
+	KeyList string
+}
+
+// IndexReport is the outcome of creating one secondary index.
+type IndexReport struct {
+	Table string `json:"table"`
+	// Name is the source name; DestName is set when a collision gave the
+	// index another one on the destination
+	Name       string `json:"name"`
+	DestName   string `json:"dest_name,omitempty"`
+	Unique     bool   `json:"unique,omitempty"`
+	Partial    bool   `json:"partial,omitempty"`
+	Expression bool   `json:"expression,omitempty"`
+	Constraint bool   `json:"constraint,omitempty"`
+	Exclusion  bool   `json:"exclusion,omitempty"`
+	Status     string `json:"status"`
+	// Reason is why an index was skipped or failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// introspectIndexes adds the secondary indexes of the source schemas of
+// tables to them. Invalid indexes, left by a failed CREATE INDEX CONCURRENTLY, and
+// partitions' indexes attached to their parent's are left out.
+func introspectIndexes(ctx context.Context, conn Querier, tables []Table) error {
+	rows, err := conn.Query(ctx, `
+		SELECT `+sourceKeySQL+`, ic.relname,
+			coalesce(pg_get_constraintdef(con.oid), pg_get_indexdef(i.indexrelid)),
+			con.oid IS NOT NULL, coalesce(con.contype = 'x', false), i.indisunique, i.indpred IS NOT NULL, i.indexprs IS NOT NULL,
+			ARRAY(
+				SELECT a.attname::text
+				FROM pg_attribute a
+				WHERE a.attrelid = i.indrelid
+				  AND (a.attnum = ANY(i.indkey) OR a.attnum IN (
+					SELECT d.refobjsubid FROM pg_depend d
+					WHERE d.classid = 'pg_class'::regclass AND d.objid = i.indexrelid
+					  AND d.refclassid = 'pg_class'::regclass AND d.refobjid = i.indrelid))
+				  AND a.attnum > 0
+				  AND NOT a.attisdropped
+				ORDER BY a.attnum
+			),
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				WHERE con.contype = 'u'
+				ORDER BY k.ord
+			),
+			coalesce((
+				SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY k.ord)
+				FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				WHERE con.contype = 'u'
+			), '')
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_constraint con ON con.conindid = i.indexrelid AND con.conrelid = i.indrelid AND con.contype IN ('u', 'x')
+		WHERE n.nspname = ANY($1)
+		  AND NOT i.indisprimary
+		  AND i.indisvalid
+		  AND NOT EXISTS (SELECT 1 FROM pg_inherits inh WHERE inh.inhrelid = i.indexrelid)
+		ORDER BY c.relname, ic.relname
+	`, tableSchemas(tables))
+	if err != nil {
+		return fmt.Errorf("failed to get indexes: %w", err)
+	}
+	defer rows.Close()
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+	for rows.Next() {
+		var table string
+		var idx tableIndex
+		if err := rows.Scan(&table, &idx.Name, &idx.Definition, &idx.Constraint, &idx.Exclusion, &idx.Unique, &idx.Partial, &idx.Expression, &idx.Columns, &idx.Keys, &idx.KeyList); err != nil {
+			return err
+		}
+		if t, ok := byName[table]; ok {
+			t.Indexes = append(t.Indexes, idx)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get indexes: %w", err)
+	}
+	return nil
+}
+
+// indexDDL returns the statement creating idx on the destination table t
+// under name. pg_get_indexdef names the source table, so everything up to
+// USING is rebuilt; the rest (method, keys, INCLUDE, WITH, WHERE) is kept.
+func indexDDL(t Table, idx tableIndex, name string) string {
+	if idx.Constraint {
+		def := idx.Definition
+		if unique, ok := uniqueDefinition(t, idx); ok {
+			def = unique
+		}
+		return sqlutil.AddConstraint(destIdent(t), name, def, false)
+	}
+	create := "CREATE INDEX "
+	if idx.Unique {
+		create = "CREATE UNIQUE INDEX "
+	}
+	_, rest, _ := strings.Cut(idx.Definition, " USING ")
+	return create + sqlutil.QuoteIdent(name) + " ON " + destIdent(t) + " USING " + rest
+}
+
+// missingOperatorSupport reports whether err is the destination lacking an
+// operator class, operator or access method, as without btree_gist, rather
+// than rows the constraint rejects.
+func missingOperatorSupport(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case "42704", // undefined_object
+		"42883": // undefined_function
+		return true
+	}
+	return false
+}
+
+// uniqueDefinition returns the definition of the unique constraint idx with
+// its key columns under their destination names. It is false for other
+// indexes and for definitions that do not start with the key list, which
+// are used as they are.
+func uniqueDefinition(t Table, idx tableIndex) (string, bool) {
+	if !idx.Constraint || len(idx.Keys) == 0 {
+		return "", false
+	}
+	for _, prefix := range []string{"UNIQUE (", "UNIQUE NULLS NOT DISTINCT ("} {
+		if rest, ok := strings.CutPrefix(idx.Definition, prefix+idx.KeyList+")"); ok {
+			return prefix + sqlutil.ColumnList(t.destColumns(idx.Keys)) + ")" + rest, true
+		}
+	}
+	return "", false
+}
+
+// indexSkipReason returns why idx cannot be created on the destination
+// table t, or "" when it can. The index definition names source columns,
+// so indexes on columns that are not copied or renamed are left out; only
+// the key columns of a unique constraint may be renamed.
+func indexSkipReason(t Table, idx tableIndex) string {
+	if !idx.Constraint && !strings.Contains(idx.Definition, " USING ") {
+		return "unexpected definition " + idx.Definition
+	}
+	if missing := missingColumns(t, idx.Columns); len(missing) > 0 {
+		return fmt.Sprintf("column(s) %s are not copied", strings.Join(missing, ", "))
+	}
+	for _, name := range idx.Columns {
+		if c, _ := t.column(name); c.Encrypt != "" {
+			return fmt.Sprintf("column %s is encrypted", name)
+		}
+	}
+	columns := idx.Columns
+	if _, ok := uniqueDefinition(t, idx); ok {
+		columns = slices.DeleteFunc(slices.Clone(columns), func(c string) bool { return slices.Contains(idx.Keys, c) })
+	}
+	if dest := t.destColumns(columns); !slices.Equal(dest, columns) {
+		return "it uses renamed columns"
+	}
+	return ""
+}
+
+// destinationRelations returns the relations of schemas on the destination,
+// keyed by schema.name, with the schema.table an index belongs to, or ""
+// for other relations.
+func destinationRelations(ctx context.Context, dest Querier, schemas []string) (map[string]string, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname, coalesce(tn.nspname || '.' || t.relname, '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_index i ON i.indexrelid = c.oid
+		LEFT JOIN pg_class t ON t.oid = i.indrelid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		WHERE n.nspname = ANY($1)
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination relations: %w", err)
+	}
+	type relation struct{ name, table string }
+	rels, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (relation, error) {
+		var r relation
+		err := row.Scan(&r.name, &r.table)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination relations: %w", err)
+	}
+	out := make(map[string]string, len(rels))
+	for _, r := range rels {
+		out[r.name] = r.table
+	}
+	return out, nil
+}
+
+// plannedIndex marks the names in destinationRelations given to indexes
+// by this run.
+const plannedIndex = "\x00planned"
+
+// indexName returns the destination name of the index name on the table
+// qualified as table in schema, and whether the index is already there,
+// as on a resumed run: a relation of that name that is an index of the
+// same table. Any other relation of that name makes it take the first free
+// suffix _2, _3, ..., so the name is the same on every run.
+func indexName(relations map[string]string, schema, table, name string) (string, bool) {
+	for n := 1; ; n++ {
+		candidate := physicalName(name)
+		if n > 1 {
+			candidate = suffixedName(name, fmt.Sprintf("_%d", n))
+		}
+		owner, taken := relations[schema+"."+candidate]
+		if !taken {
+			relations[schema+"."+candidate] = plannedIndex
+			return candidate, false
+		}
+		if owner == table {
+			relations[schema+"."+candidate] = plannedIndex
+			return candidate, true
+		}
+	}
+}
+
+// Indexes creates the secondary indexes of every recreated table, once its
+// data is loaded, so the copy does not maintain them row by row.
+func (m *Migrator) Indexes(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseIndexes, state, m.indexes)
+}
+
+func (m *Migrator) indexes(ctx context.Context, state *MigrationState) error {
+	// --data-only leaves the destination definitions alone
+	if m.opts.DataOnly {
+		return nil
+	}
+	var tables []Table
+	for _, t := range state.Tables {
+		if !state.Keep[t.Name] && len(t.Indexes) > 0 {
+			tables = append(tables, t)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	relations, err := destinationRelations(ctx, m.dest, tableSchemas(tables))
+	if err != nil {
+		return err
+	}
+	if m.recorder != nil {
+		// The recorded DROP ... CASCADE removes the indexes of every
+		// recreated table, as it would in a real run
+		for _, t := range tables {
+			for name, owner := range relations {
+				if owner == t.qualifiedDestName() {
+					delete(relations, name)
+				}
+			}
+		}
+	}
+
+	fmt.Println("Creating indexes...")
+	var created int
+	for _, t := range tables {
+		for _, idx := range t.Indexes {
+			ir := IndexReport{
+				Table:      t.qualifiedDestName(),
+				Name:       idx.Name,
+				Unique:     idx.Unique,
+				Partial:    idx.Partial,
+				Expression: idx.Expression,
+				Constraint: idx.Constraint,
+				Exclusion:  idx.Exclusion,
+			}
+			if reason := indexSkipReason(t, idx); reason != "" {
+				state.Report.warnTable(warnIndexSkipped, t.Name, "index %s on %s was not created: %s", idx.Name, t.Name, reason)
+				ir.Status, ir.Reason = indexSkipped, reason
+				state.Report.Indexes = append(state.Report.Indexes, ir)
+				continue
+			}
+			name, exists := indexName(relations, t.destSchema(), t.qualifiedDestName(), idx.Name)
+			if name != idx.Name {
+				ir.DestName = name
+				fmt.Printf("  Index %s on %s: the name is taken on the destination, creating it as %s\n", idx.Name, t.Name, name)
+			}
+			if exists {
+				ir.Status = indexExists
+				state.Report.Indexes = append(state.Report.Indexes, ir)
+				continue
+			}
+			stmt := indexDDL(t, idx, name)
+			if _, err := m.dest.Exec(ctx, stmt); err != nil {
+				if idx.Exclusion && missingOperatorSupport(err) {
+					state.Report.warnTable(warnExclusionFailed, t.Name, "exclusion constraint %s on %s was not created, the destination lacks what it needs: %v", name, t.Name, err)
+					ir.Status, ir.Reason = indexFailed, err.Error()
+					state.Report.Indexes = append(state.Report.Indexes, ir)
+					continue
+				}
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to create index %s on %s (%s): %w", name, t.Name, stmt, err)}
+			}
+			ir.Status = indexCreated
+			if recording(m.dest) {
+				ir.Status = indexRecorded
+			}
+			state.Report.Indexes = append(state.Report.Indexes, ir)
+			created++
+		}
+	}
+	fmt.Printf("Created %d index(es).\n", created)
+	return nil
+}
@@ -0,0 +1,37 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexNameSuffixFits(t *testing.T) {
+	long := strings.Repeat("a", 59) + "_idx" // 63 bytes, the longest name
+	relations := map[string]string{
+		"public." + long: "public.other",
+	}
+	name, exists := indexName(relations, "public", "public.users", long)
+	if exists {
+		t.Fatal("an index of another table was taken for this one")
+	}
+	if len(name) > maxIdentifierLength {
+		t.Fatalf("name %q is %d bytes, the server would truncate it", name, len(name))
+	}
+	if name == long || !strings.HasSuffix(name, "_2") || !strings.HasPrefix(long, strings.TrimSuffix(name, "_2")) {
+		t.Errorf("name = %q, want the source name cut to fit _2", name)
+	}
+
+	// The next run picks the same name, and finds the index there
+	again := map[string]string{"public." + long: "public.other", "public." + name: "public.users"}
+	if got, exists := indexName(again, "public", "public.users", long); got != name || !exists {
+		t.Errorf("resumed indexName = %q, %v; want %q, true", got, exists, name)
+	}
+
+	// A cut never splits a rune
+	multibyte := strings.Repeat("a", 60) + "é" // 62 bytes
+	relations = map[string]string{"public." + multibyte: "public.other"}
+	name, _ = indexName(relations, "public", "public.users", multibyte)
+	if name != strings.Repeat("a", 60)+"_2" {
+		t.Errorf("name = %q, want the rune dropped whole", name)
+	}
+}
@@ -0,0 +1,125 @@
+package migrate
+
+import (
+	"slices"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// parents returns the INHERITS parents of t and the table it is a partition
+// of.
+func (t Table) parents() []string {
+	if t.PartitionOf == "" {
+		return t.Inherits
+	}
+	return append(slices.Clip(t.Inherits), t.PartitionOf)
+}
+
+// orderByInheritance returns tables with every inheritance parent and
+// partitioned table ahead of its children, otherwise keeping the original
+// order. CREATE TABLE ... INHERITS and ... PARTITION OF need the parent to
+// exist first.
+func orderByInheritance(tables []Table) []Table {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+
+	ordered := make([]Table, 0, len(tables))
+	visited := make(map[string]bool, len(tables))
+	var visit func(t Table)
+	visit = func(t Table) {
+		if visited[t.Name] {
+			return
+		}
+		visited[t.Name] = true
+		for _, parent := range t.parents() {
+			if p, ok := byName[parent]; ok {
+				visit(p)
+			}
+		}
+		ordered = append(ordered, t)
+	}
+	for _, t := range tables {
+		visit(t)
+	}
+	return ordered
+}
+
+// invalidateInheritedChildren forgets the progress of every table that
+// inherits (directly or not) from a table about to be recreated, because
+// DROP TABLE ... CASCADE on the parent also drops its children. Dropping a
+// partitioned table drops its partitions the same way.
+func invalidateInheritedChildren(tables []Table, cp *Checkpoint) {
+	kept := func(name string) bool { return cp.completed(name) || cp.partial(name) }
+	changed := true
+	for changed {
+		changed = false
+		for _, t := range tables {
+			if !kept(t.Name) {
+				continue
+			}
+			for _, parent := range t.parents() {
+				if !kept(parent) {
+					cp.reset(t.Name)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// partitionedLast moves the partitioned tables of tables behind all others.
+// They hold no rows themselves, but their sequences are set from the rows of
+// their partitions, which must be copied first.
+func partitionedLast(tables []Table) []Table {
+	out := make([]Table, 0, len(tables))
+	var partitioned []Table
+	for _, t := range tables {
+		if t.PartitionKey != "" {
+			partitioned = append(partitioned, t)
+			continue
+		}
+		out = append(out, t)
+	}
+	return append(out, partitioned...)
+}
+
+// withoutGenerated returns tables without their generated columns, which the
+// destination computes itself and refuses values for. Every copy path reads
+// and writes the remaining columns by name, so their positions do not matter.
+func withoutGenerated(tables []Table) []Table {
+	out := make([]Table, len(tables))
+	for i, t := range tables {
+		if slices.ContainsFunc(t.Columns, func(c Column) bool { return c.Generated != "" }) {
+			t.Columns = slices.DeleteFunc(slices.Clone(t.Columns), func(c Column) bool { return c.Generated != "" })
+		}
+		out[i] = t
+	}
+	return out
+}
+
+// fromClause returns the FROM target for reading a table's own rows. Parents
+// of an inheritance hierarchy are read with ONLY so child rows, which are
+// copied with the child table, aren't copied twice.
+func fromClause(t Table) string {
+	if t.HasChildren {
+		return sqlutil.Only(sourceIdent(t))
+	}
+	return sourceIdent(t)
+}
+
+// flattenInheritance turns every table into an independent table with all its
+// columns, dropping the INHERITS relationships.
+func flattenInheritance(tables []Table) {
+	for i := range tables {
+		tables[i].Inherits = nil
+		for j := range tables[i].Columns {
+			tables[i].Columns[j].Inherited = false
+		}
+		for j := range tables[i].Checks {
+			tables[i].Checks[j].Inherited = false
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrderByInheritance(t *testing.T) {
+	tables := []Table{
+		{Name: "sports_cars", Inherits: []string{"cars"}},
+		{Name: "cars", Inherits: []string{"vehicles"}, HasChildren: true},
+		{Name: "trucks"},
+		{Name: "vehicles", HasChildren: true},
+	}
+	var names []string
+	for _, tb := range orderByInheritance(tables) {
+		names = append(names, tb.Name)
+	}
+	if want := []string{"vehicles", "cars", "sports_cars", "trucks"}; !slices.Equal(names, want) {
+		t.Errorf("order = %v, want %v", names, want)
+	}
+
+	// Parents at either level read only their own rows
+	for _, tt := range []struct {
+		table Table
+		want  string
+	}{
+		{tables[3], `ONLY "vehicles"`},
+		{tables[1], `ONLY "cars"`},
+		{tables[0], `"sports_cars"`},
+	} {
+		if got := fromClause(tt.table); got != tt.want {
+			t.Errorf("fromClause(%s) = %s, want %s", tt.table.Name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/fixtures"
+)
+
+// The integration tests migrate the fixtures between two databases named by
+// prefixed variables, so they never pick up a configured migration:
+//
+//	MIGRATION_TOOL_TEST_XATA_DATABASE_URL  the source, provisioned with the
+//	                                       fixtures (reset on every run, so it
+//	                                       must be a fixture database or empty)
+//	MIGRATION_TOOL_TEST_DATABASE_URL       the destination, overwritten
+//
+// Without both they are skipped.
+const integrationPrefix = "MIGRATION_TOOL_TEST_"
+
+// integrationRows is the users of the fixtures (see fixtures.Provision):
+// MIGRATION_TOOL_TEST_ROWS, or 500. Benchmarks want millions.
+var integrationRows = 500
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv(integrationPrefix + "ROWS")); err == nil && n > 0 {
+		integrationRows = n
+	}
+}
+
+var provisioned struct {
+	once sync.Once
+	err  error
+}
+
+// integrationEnv skips tb unless both databases are set, and provisions the
+// fixtures on the source once per test binary.
+func integrationEnv(tb testing.TB) (env *envSettings, sourceURL, destURL string) {
+	tb.Helper()
+	sourceURL = os.Getenv(integrationPrefix + sourceURLVar)
+	destURL = os.Getenv(integrationPrefix + destURLVar)
+	if sourceURL == "" || destURL == "" {
+		tb.Skipf("set %s%s and %s%s to run the integration tests", integrationPrefix, sourceURLVar, integrationPrefix, destURLVar)
+	}
+	provisioned.once.Do(func() {
+		ctx := context.Background()
+		conn, err := pgx.Connect(ctx, sourceURL)
+		if err != nil {
+			provisioned.err = err
+			return
+		}
+		defer conn.Close(ctx)
+		provisioned.err = fixtures.Provision(ctx, conn, integrationRows, true)
+	})
+	if provisioned.err != nil {
+		tb.Fatalf("failed to provision the fixtures: %v", provisioned.err)
+	}
+	return &envSettings{prefix: integrationPrefix}, sourceURL, destURL
+}
+
+// testOptions returns the options of a migration run with args, with its
+// checkpoint in a temporary directory and no snapshot or journal.
+func testOptions(tb testing.TB, args ...string) Options {
+	tb.Helper()
+	var opts Options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.register(fs)
+	dir := tb.TempDir()
+	base := []string{"--checkpoint", filepath.Join(dir, "checkpoint.json"), "--schema-snapshot", "", "--journal", ""}
+	if err := fs.Parse(append(base, args...)); err != nil {
+		tb.Fatal(err)
+	}
+	opts.Config = &Config{}
+	if err := opts.validate(); err != nil {
+		tb.Fatal(err)
+	}
+	return opts
+}
+
+func TestMigrateFixtures(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+
+	for _, method := range []string{copyMethodRows, copyMethodCSV} {
+		t.Run(method, func(t *testing.T) {
+			opts := testOptions(t, "--copy-method", method)
+			report, err := runMigration(ctx, opts, env)
+			if err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			want := map[string]int64{
+				"users":       int64(fixtures.Users(integrationRows)),
+				"teams":       int64(fixtures.Teams(integrationRows)),
+				"Order Items": int64(fixtures.OrderItems(integrationRows)),
+			}
+			for _, tr := range report.Tables {
+				if n, ok := want[tr.Name]; ok && tr.RowsCopiedTotal != n {
+					t.Errorf("%s: copied %d rows, want %d", tr.Name, tr.RowsCopiedTotal, n)
+				}
+				delete(want, tr.Name)
+			}
+			if len(want) > 0 {
+				t.Errorf("tables not in the report: %v", want)
+			}
+
+			source, err := ConnectSource(ctx, sourceURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close(ctx)
+			dest, err := pgx.Connect(ctx, destURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dest.Close(ctx)
+			result, err := Verify(ctx, VerifyOptions{Options: opts, Source: source, Dest: dest, Checksums: true})
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !result.Match {
+				t.Errorf("the destination does not match the source: %+v", result.Tables)
+			}
+		})
+	}
+}
+
+// TestMigrateDroppedColumns migrates a table whose columns have attnum
+// gaps, including one left by a dropped column of the old primary key.
+func TestMigrateDroppedColumns(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS gaps"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+
+	if _, err := source.Exec(ctx, `
+		CREATE TABLE gaps (legacy_id integer PRIMARY KEY, note text, id integer NOT NULL, name text);
+		INSERT INTO gaps SELECT g, 'x', g * 10, 'name ' || g FROM generate_series(1, 50) g;
+		ALTER TABLE gaps DROP COLUMN legacy_id;
+		ALTER TABLE gaps ADD PRIMARY KEY (id);
+		ALTER TABLE gaps DROP COLUMN note;
+		ALTER TABLE gaps ADD COLUMN tag text DEFAULT 'new';
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{copyMethodRows, copyMethodCSV} {
+		t.Run(method, func(t *testing.T) {
+			opts := testOptions(t, "--copy-method", method, "--only", "gaps")
+			if _, err := runMigration(ctx, opts, env); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+
+			// The destination table is created fresh, without the gaps
+			var columns []string
+			var maxAttnum int
+			if err := dest.QueryRow(ctx, `
+				SELECT array_agg(attname::text ORDER BY attnum), max(attnum)
+				FROM pg_attribute
+				WHERE attrelid = 'gaps'::regclass AND attnum > 0
+			`).Scan(&columns, &maxAttnum); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"id", "name", "tag"}; !slices.Equal(columns, want) || maxAttnum != len(want) {
+				t.Errorf("destination columns = %v (max attnum %d), want %v", columns, maxAttnum, want)
+			}
+			var key []string
+			if err := dest.QueryRow(ctx, `
+				SELECT array_agg(a.attname::text)
+				FROM pg_index i
+				JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+				WHERE i.indrelid = 'gaps'::regclass AND i.indisprimary
+			`).Scan(&key); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(key, []string{"id"}) {
+				t.Errorf("destination primary key = %v, want [id]", key)
+			}
+
+			var bad int
+			if err := dest.QueryRow(ctx, `
+				SELECT count(*) FROM gaps
+				WHERE name IS DISTINCT FROM 'name ' || (id / 10) OR tag IS DISTINCT FROM 'new'
+			`).Scan(&bad); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			if err := dest.QueryRow(ctx, "SELECT count(*) FROM gaps").Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 50 || bad != 0 {
+				t.Errorf("copied %d rows, %d of them wrong; want 50 right ones", n, bad)
+			}
+		})
+	}
+}
+
+// TestMigrateKeepsSourceTimestamps migrates a created_at column defaulting
+// to now() down every write path, and checks that the source timestamps
+// arrive unchanged instead of the destination default.
+func TestMigrateKeepsSourceTimestamps(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS stamped"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+
+	if _, err := source.Exec(ctx, `
+		CREATE TABLE stamped (id integer PRIMARY KEY, created_at timestamptz NOT NULL DEFAULT now(), note text);
+		INSERT INTO stamped SELECT g, timestamptz '2019-03-04 05:06:07+00' + g * interval '1 hour', 'row ' || g FROM generate_series(1, 50) g;
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"copy", []string{"--copy-method", copyMethodRows}},
+		{"csv", []string{"--copy-method", copyMethodCSV}},
+		{"insert", []string{"--dest-pooler", destPoolerPgBouncer}},
+		{"truncate", []string{"--data-only"}},
+		{"upsert", []string{"--data-only", "--upsert"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Rows left by the previous run carry other timestamps, which an
+			// upsert must overwrite
+			if i > 0 {
+				if _, err := dest.Exec(ctx, "UPDATE stamped SET created_at = now()"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := testOptions(t, append(tt.args, "--only", "stamped")...)
+			if _, err := runMigration(ctx, opts, env); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			var n, bad int
+			if err := dest.QueryRow(ctx, `
+				SELECT count(*), count(*) FILTER (WHERE created_at IS DISTINCT FROM timestamptz '2019-03-04 05:06:07+00' + id * interval '1 hour')
+				FROM stamped
+			`).Scan(&n, &bad); err != nil {
+				t.Fatal(err)
+			}
+			if n != 50 || bad != 0 {
+				t.Errorf("copied %d rows, %d of them with another created_at; want 50 with the source timestamps", n, bad)
+			}
+		})
+	}
+}
+
+// TestMigrateInheritance migrates a two-level INHERITS hierarchy, recreated
+// and flattened, and checks that every row lands in its own table once.
+func TestMigrateInheritance(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS vehicles CASCADE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+
+	if _, err := source.Exec(ctx, `
+		CREATE TABLE vehicles (id integer PRIMARY KEY, name text);
+		CREATE TABLE cars (doors integer, PRIMARY KEY (id)) INHERITS (vehicles);
+		CREATE TABLE sports_cars (top_speed integer, PRIMARY KEY (id)) INHERITS (cars);
+		INSERT INTO vehicles SELECT g, 'vehicle ' || g FROM generate_series(1, 10) g;
+		INSERT INTO cars SELECT g, 'car ' || g, 4 FROM generate_series(11, 30) g;
+		INSERT INTO sports_cars SELECT g, 'sports car ' || g, 2, 300 FROM generate_series(31, 60) g;
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func(conn *pgx.Conn) (own, all []int) {
+		t.Helper()
+		for _, table := range []string{"vehicles", "cars", "sports_cars"} {
+			var o, a int
+			if err := conn.QueryRow(ctx, "SELECT (SELECT count(*) FROM ONLY "+table+"), (SELECT count(*) FROM "+table+")").Scan(&o, &a); err != nil {
+				t.Fatal(err)
+			}
+			own, all = append(own, o), append(all, a)
+		}
+		return own, all
+	}
+	sourceOwn, sourceAll := counts(source)
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// all is the rows read without ONLY: the hierarchy's, or each
+		// table's own once flattened
+		all []int
+	}{
+		{"inherits", nil, sourceAll},
+		{"flattened", []string{"--flatten-inheritance"}, sourceOwn},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(tt.args, "--only", "vehicles", "--only", "cars", "--only", "sports_cars")
+			if _, err := runMigration(ctx, testOptions(t, args...), env); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			own, all := counts(dest)
+			if !slices.Equal(own, sourceOwn) || !slices.Equal(all, tt.all) {
+				t.Errorf("destination rows = %v own, %v in all; want %v own, %v in all", own, all, sourceOwn, tt.all)
+			}
+		})
+	}
+}
+
+// TestMigrateLeavesNoTempObjects runs the loads that stage rows in
+// temporary tables and checks that none is left on the destination or in
+// the checkpoint once they succeed.
+func TestMigrateLeavesNoTempObjects(t *testing.T) {
+	env, _, destURL := integrationEnv(t)
+	ctx := context.Background()
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"full", nil},
+		{"differential", []string{"--differential"}},
+		{"upsert", []string{"--data-only", "--upsert"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions(t, tt.args...)
+			if _, err := runMigration(ctx, opts, env); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			leftovers, err := findLeftovers(ctx, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leftovers) > 0 {
+				t.Errorf("temporary objects left on the destination: %+v", leftovers)
+			}
+			cp, err := loadCheckpoint(opts.CheckpointPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cp.TempObjects) > 0 {
+				t.Errorf("temporary objects left in the checkpoint: %v", cp.TempObjects)
+			}
+		})
+	}
+}
+
+// TestMigrateFreeze loads with --freeze, into new tables and into existing
+// ones with --data-only, and checks which tables were frozen and that the
+// split table falling back to its own transactions still loads in full.
+func TestMigrateFreeze(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS frozen_load, split_load"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+
+	if _, err := source.Exec(ctx, `
+		CREATE TABLE frozen_load (id integer PRIMARY KEY, note text);
+		CREATE TABLE split_load (id integer PRIMARY KEY, note text);
+		INSERT INTO frozen_load SELECT g, 'row ' || g FROM generate_series(1, 200) g;
+		INSERT INTO split_load SELECT g, 'row ' || g FROM generate_series(1, 200) g;
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"created", nil},
+		{"truncated", []string{"--data-only"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(tt.args, "--freeze", "--copy-method", copyMethodCSV, "--only", "frozen_load", "--only", "split_load")
+			opts := testOptions(t, args...)
+			opts.Config.Tables = map[string]TableConfig{"split_load": {SplitBy: &SplitConfig{Column: "id", Chunks: 4}}}
+			report, err := runMigration(ctx, opts, env)
+			if err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			frozen := map[string]bool{}
+			for _, tr := range report.Tables {
+				frozen[tr.Name] = tr.Frozen
+				if tr.RowsCopiedTotal != 200 {
+					t.Errorf("%s: copied %d rows, want 200", tr.Name, tr.RowsCopiedTotal)
+				}
+			}
+			if !frozen["frozen_load"] || frozen["split_load"] {
+				t.Errorf("frozen tables = %v, want frozen_load only", frozen)
+			}
+			for _, table := range []string{"frozen_load", "split_load"} {
+				var n int
+				if err := dest.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				if n != 200 {
+					t.Errorf("%s has %d rows, want 200", table, n)
+				}
+			}
+		})
+	}
+}
+
+// TestMigrateGeneratedColumn migrates a table with a stored generated
+// column between ordinary ones, which the destination recomputes.
+func TestMigrateGeneratedColumn(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS priced"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+
+	if _, err := source.Exec(ctx, `
+		CREATE TABLE priced (id integer PRIMARY KEY, price numeric NOT NULL, total numeric GENERATED ALWAYS AS (price * qty) STORED, qty integer NOT NULL, note text);
+		INSERT INTO priced (id, price, qty, note) SELECT g, g * 1.5, g % 7, 'row ' || g FROM generate_series(1, 50) g;
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{copyMethodRows, copyMethodCSV} {
+		t.Run(method, func(t *testing.T) {
+			opts := testOptions(t, "--copy-method", method, "--only", "priced")
+			if _, err := runMigration(ctx, opts, env); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			var generated string
+			if err := dest.QueryRow(ctx, `
+				SELECT attgenerated::text FROM pg_attribute
+				WHERE attrelid = 'priced'::regclass AND attname = 'total'
+			`).Scan(&generated); err != nil {
+				t.Fatal(err)
+			}
+			if generated != "s" {
+				t.Errorf("total is not a stored generated column (attgenerated %q)", generated)
+			}
+			var n, bad int
+			if err := dest.QueryRow(ctx, `
+				SELECT count(*), count(*) FILTER (WHERE price <> id * 1.5 OR qty <> id % 7 OR total <> price * qty OR note <> 'row ' || id)
+				FROM priced
+			`).Scan(&n, &bad); err != nil {
+				t.Fatal(err)
+			}
+			if n != 50 || bad != 0 {
+				t.Errorf("copied %d rows, %d of them wrong; want 50 right ones", n, bad)
+			}
+		})
+	}
+}
+
+// insertOnStart inserts rows into the source when table starts copying,
+// after the copy phase began.
+type insertOnStart struct {
+	nopReporter
+	t      *testing.T
+	source *pgx.Conn
+	table  string
+	sql    string
+}
+
+func (r insertOnStart) TableStarted(table string) {
+	if table != r.table {
+		return
+	}
+	if _, err := r.source.Exec(context.Background(), r.sql); err != nil {
+		r.t.Error(err)
+	}
+}
+
+// TestMigrateConsistentSnapshot writes to the source while a table split
+// across parallel workers is copied: with --consistent-snapshot every
+// worker reads the snapshot exported before, without the rows written.
+func TestMigrateConsistentSnapshot(t *testing.T) {
+	env, sourceURL, destURL := integrationEnv(t)
+	ctx := context.Background()
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(ctx)
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close(ctx)
+	drop := func() {
+		for _, conn := range []*pgx.Conn{source, dest} {
+			if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS snapshot_load"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(drop)
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"snapshot", []string{"--consistent-snapshot"}, 200},
+		{"per table", nil, 300},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			drop()
+			if _, err := source.Exec(ctx, `
+				CREATE TABLE snapshot_load (id integer PRIMARY KEY, note text);
+				INSERT INTO snapshot_load SELECT g, 'row ' || g FROM generate_series(1, 200) g;
+			`); err != nil {
+				t.Fatal(err)
+			}
+			opts := testOptions(t, append(tt.args, "--only", "snapshot_load")...)
+			opts.Reporter = insertOnStart{t: t, source: source, table: "snapshot_load",
+				sql: "INSERT INTO snapshot_load SELECT g, 'late ' || g FROM generate_series(201, 300) g"}
+			opts.Config.Tables = map[string]TableConfig{"snapshot_load": {SplitBy: &SplitConfig{Column: "id", Chunks: 4, Parallel: 4}}}
+			report, err := runMigration(ctx, opts, env)
+			if err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			var n int
+			if err := dest.QueryRow(ctx, "SELECT count(*) FROM snapshot_load").Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("copied %d rows, want %d", n, tt.want)
+			}
+			start := report.SourcePosition.Start
+			if exported := start.SnapshotID != ""; exported != (tt.want == 200) {
+				t.Errorf("start position = %+v, snapshot exported %v", start, exported)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// introspectSource reads the source tables of schemas, --schemas, whose
+// names start with one of prefixes, or all of them when there are none. The
+// catalog queries only return the selected tables, so a schema with
+// thousands of tenants costs no more than the tenants of the run. Tables
+// outside public are named schema.table (see sourceTableKey), and foreign
+// keys between the schemas are kept.
+func introspectSource(ctx context.Context, conn Querier, schemas, prefixes []string) ([]Table, error) {
+	var out []Table
+	for _, schema := range schemas {
+		tables, err := introspectSchemaIn(ctx, conn, schema, prefixes, schemas)
+		if err != nil {
+			if len(schemas) > 1 {
+				return nil, fmt.Errorf("schema %s: %w", schema, err)
+			}
+			return nil, err
+		}
+		qualifyTables(tables, schema)
+		out = append(out, tables...)
+	}
+	return out, nil
+}
+
+// prefixPatterns returns LIKE patterns matching names that start with one of
+// prefixes. It never returns nil, which would be sent as NULL.
+func prefixPatterns(prefixes []string) []string {
+	patterns := make([]string, 0, len(prefixes))
+	escape := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	for _, p := range prefixes {
+		patterns = append(patterns, escape.Replace(p)+"%")
+	}
+	return patterns
+}
+
+// hasPrefix reports whether name starts with one of prefixes, or prefixes
+// is empty.
+func hasPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// introspectSchemas reads every schema in schemas, for destinations whose
+// tables are routed to several of them.
+func introspectSchemas(ctx context.Context, conn Querier, schemas []string) ([]Table, error) {
+	var out []Table
+	for _, schema := range schemas {
+		tables, err := introspectSchemaIn(ctx, conn, schema, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", schema, err)
+		}
+		out = append(out, tables...)
+	}
+	return out, nil
+}
+
+// introspectSchemaIn reads tables, columns and primary keys of schema with
+// one catalog query each, regardless of how many tables the schema has.
+// With prefixes, only tables whose names start with one of them are read.
+// Foreign keys may also reference tables of refSchemas, which then set
+// their RefSchema.
+func introspectSchemaIn(ctx context.Context, conn Querier, schema string, prefixes, refSchemas []string) ([]Table, error) {
+	patterns := prefixPatterns(prefixes)
+
+	// 1. Get Tables
+	rows, err := conn.Query(ctx, `
+		SELECT tablename,
+			coalesce(obj_description(format('%I.%I', schemaname, tablename)::regclass, 'pg_class'), '')
+		FROM pg_catalog.pg_tables
+		WHERE schemaname = $1
+		  AND (cardinality($2::text[]) = 0 OR tablename LIKE ANY($2))
+		ORDER BY tablename
+	`, schema, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []Table
+	for rows.Next() {
+		t := Table{Schema: schema}
+		if err := rows.Scan(&t.Name, &t.Comment); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+
+	// 2. Get Columns for every table
+	// Use pg_catalog to get the correct type definition (e.g. text[] instead of ARRAY)
+	// attnum only orders the columns: dropped columns leave gaps in it, so
+	// nothing downstream may take it for a position in Columns
+	cRows, err := conn.Query(ctx, `
+		SELECT
+			c.relname,
+			a.attname,
+			format_type(a.atttypid, a.atttypmod),
+			a.attnotnull,
+			pg_get_expr(d.adbin, d.adrelid),
+			a.attislocal,
+			ty.typtype = 'c',
+			ty.typtype = 'c' AND EXISTS (
+				SELECT 1 FROM pg_attribute ca
+				WHERE ca.attrelid = ty.typrelid AND ca.attnum > 0 AND NOT ca.attisdropped
+				  AND ca.atttypid >= 16384
+			),
+			coalesce(el.typtype = 'c', false),
+			NULLIF(a.attstattarget, -1)::int,
+			CASE WHEN ty.typtype = 'd' THEN ty.typname::text ELSE '' END,
+			coalesce(col_description(a.attrelid, a.attnum), ''),
+			a.attgenerated::text,
+			CASE a.attidentity WHEN 'a' THEN 'ALWAYS' WHEN 'd' THEN 'BY DEFAULT' ELSE '' END,
+			coalesce((
+				SELECT CASE WHEN cn.nspname IN ('pg_catalog', 'public') THEN quote_ident(co.collname)
+					ELSE quote_ident(cn.nspname) || '.' || quote_ident(co.collname) END
+				FROM pg_collation co
+				JOIN pg_namespace cn ON cn.oid = co.collnamespace
+				WHERE co.oid = a.attcollation AND a.attcollation <> ty.typcollation
+			), ''),
+			(SELECT tn.nspname::text FROM pg_namespace tn WHERE tn.oid = coalesce(el.typnamespace, ty.typnamespace)),
+			coalesce(el.typname, ty.typname)::text
+		FROM pg_attribute a
+		JOIN pg_class c ON a.attrelid = c.oid
+		JOIN pg_type ty ON a.atttypid = ty.oid
+		LEFT JOIN pg_type el ON el.oid = ty.typelem AND ty.typcategory = 'A'
+		JOIN pg_namespace n ON c.relnamespace = n.oid
+		LEFT JOIN pg_attrdef d ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+		WHERE n.nspname = $1
+		  AND c.relkind IN ('r', 'p')
+		  AND a.attnum > 0
+		  AND NOT a.attisdropped
+		  AND (cardinality($2::text[]) = 0 OR c.relname LIKE ANY($2))
+		ORDER BY c.relname, a.attnum
+	`, schema, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+
+	for cRows.Next() {
+		var tableName string
+		var c Column
+		var notNull, isLocal bool
+		var generated string
+		if err := cRows.Scan(&tableName, &c.Name, &c.DataType, &notNull, &c.Default, &isLocal, &c.Composite, &c.CompositeNested, &c.CompositeArray, &c.StatisticsTarget, &c.Domain, &c.Comment, &generated, &c.Identity, &c.Collation, &c.TypeSchema, &c.TypeName); err != nil {
+			cRows.Close()
+			return nil, err
+		}
+		// The generation expression is stored like a default
+		if generated != "" && c.Default != nil {
+			c.Generated, c.GeneratedVirtual, c.Default = *c.Default, generated == "v", nil
+		}
+		t, ok := byName[tableName]
+		if !ok {
+			continue
+		}
+
+		if notNull {
+			c.IsNullable = "NO"
+		} else {
+			c.IsNullable = "YES"
+		}
+		c.Inherited = !isLocal
+
+		sanitizeColumn(&c)
+		t.Columns = append(t.Columns, c)
+	}
+	cRows.Close()
+	if err := cRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+
+	// 3. Get Primary Keys for every table, in key order
+	pkRows, err := conn.Query(ctx, `
+		SELECT c.relname, a.attname
+		FROM pg_constraint con
+		JOIN pg_class c ON con.conrelid = c.oid
+		JOIN pg_namespace n ON c.relnamespace = n.oid
+		CROSS JOIN LATERAL unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+		WHERE con.contype = 'p'
+		  AND n.nspname = $1
+		  AND (cardinality($2::text[]) = 0 OR c.relname LIKE ANY($2))
+		ORDER BY c.relname, k.ord
+	`, schema, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get primary keys: %w", err)
+	}
+
+	for pkRows.Next() {
+		var tableName, pkCol string
+		if err := pkRows.Scan(&tableName, &pkCol); err != nil {
+			pkRows.Close()
+			return nil, err
+		}
+		if t, ok := byName[tableName]; ok {
+			t.PrimaryKey = append(t.PrimaryKey, pkCol)
+		}
+	}
+	pkRows.Close()
+	if err := pkRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get primary keys: %w", err)
+	}
+
+	// 4. Get legacy (INHERITS) inheritance; partitions are not included here
+	inhRows, err := conn.Query(ctx, `
+		SELECT c.relname, p.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON i.inhrelid = c.oid
+		JOIN pg_class p ON i.inhparent = p.oid
+		JOIN pg_namespace n ON c.relnamespace = n.oid
+		WHERE n.nspname = $1
+		  AND NOT c.relispartition
+		ORDER BY c.relname, i.inhseqno
+	`, schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inheritance: %w", err)
+	}
+
+	for inhRows.Next() {
+		var child, parent string
+		if err := inhRows.Scan(&child, &parent); err != nil {
+			inhRows.Close()
+			return nil, err
+		}
+		c, ok := byName[child]
+		p, pok := byName[parent]
+		if !ok || !pok {
+			continue
+		}
+		c.Inherits = append(c.Inherits, parent)
+		p.HasChildren = true
+	}
+	inhRows.Close()
+	if err := inhRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get inheritance: %w", err)
+	}
+
+	// 5. Get declarative partitioning: the PARTITION BY of partitioned tables
+	// and the bound of every partition
+	partRows, err := conn.Query(ctx, `
+		SELECT c.relname, coalesce(pg_get_partkeydef(c.oid), ''),
+			coalesce(p.relname::text, ''), coalesce(pg_get_expr(c.relpartbound, c.oid), '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_inherits i ON c.relispartition AND i.inhrelid = c.oid
+		LEFT JOIN pg_class p ON p.oid = i.inhparent
+		WHERE n.nspname = $1
+		  AND c.relkind IN ('r', 'p')
+		  AND (c.relkind = 'p' OR c.relispartition)
+		ORDER BY c.relname
+	`, schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitioning: %w", err)
+	}
+
+	for partRows.Next() {
+		var name, key, parent, bound string
+		if err := partRows.Scan(&name, &key, &parent, &bound); err != nil {
+			partRows.Close()
+			return nil, err
+		}
+		t, ok := byName[name]
+		if !ok {
+			continue
+		}
+		t.PartitionKey = key
+		// A partition whose table is not read is copied as a plain table
+		if _, ok := byName[parent]; ok {
+			t.PartitionOf, t.PartitionBound = parent, bound
+		}
+	}
+	partRows.Close()
+	if err := partRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get partitioning: %w", err)
+	}
+
+	// 6. Get foreign keys between tables of schema, or to refSchemas; keys
+	// cloned onto partitions are represented by their parent's
+	if refSchemas == nil {
+		refSchemas = []string{}
+	}
+	fkRows, err := conn.Query(ctx, `
+		SELECT c.relname, con.conname, r.relname, rn.nspname,
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				ORDER BY k.ord
+			),
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				ORDER BY k.ord
+			),
+			pg_get_constraintdef(con.oid),
+			con.confdeltype::text, con.confupdtype::text
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_class r ON r.oid = con.confrelid
+		JOIN pg_namespace rn ON rn.oid = r.relnamespace
+		WHERE con.contype = 'f'
+		  AND n.nspname = $1
+		  AND (rn.nspname = $1 OR rn.nspname = ANY($2))
+		  AND con.conparentid = 0
+		ORDER BY c.relname, con.conname
+	`, schema, refSchemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get foreign keys: %w", err)
+	}
+
+	for fkRows.Next() {
+		var fk foreignKey
+		var onDelete, onUpdate, refSchema string
+		if err := fkRows.Scan(&fk.Table, &fk.Name, &fk.RefTable, &refSchema, &fk.Columns, &fk.RefColumns, &fk.Definition, &onDelete, &onUpdate); err != nil {
+			fkRows.Close()
+			return nil, err
+		}
+		if refSchema != schema {
+			fk.RefSchema = refSchema
+		}
+		fk.setActions(onDelete, onUpdate)
+		if t, ok := byName[fk.Table]; ok {
+			t.ForeignKeys = append(t.ForeignKeys, fk)
+		}
+	}
+	fkRows.Close()
+	if err := fkRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get foreign keys: %w", err)
+	}
+
+	// Partition columns are also non-local; only INHERITS children keep the flag
+	for i := range tables {
+		if len(tables[i].Inherits) > 0 {
+			continue
+		}
+		for j := range tables[i].Columns {
+			tables[i].Columns[j].Inherited = false
+		}
+	}
+
+	return tables, nil
+}
+
+// warnSchemaGaps warns about what the tables of the run lose or lack on the
+// way to the destination: defaults dropped by sanitizeColumn, and primary
+// keys, without which rows cannot be matched.
+func warnSchemaGaps(tables []Table, report *Report) {
+	for _, t := range tables {
+		for _, c := range t.Columns {
+			if c.StrippedDefault != "" {
+				report.warnTable(warnStrippedDefault, t.Name, "column %s.%s: default %s refers to Xata internals and was dropped", t.Name, c.Name, c.StrippedDefault)
+			}
+		}
+		if len(t.PrimaryKey) == 0 {
+			report.warnTable(warnNoPrimaryKey, t.Name, "table %s has no primary key; --differential copies it in full every time", t.Name)
+		}
+	}
+}
+
+// sanitizeColumn rewrites Xata specifics so the column can be created on a
+// plain PostgreSQL server.
+func sanitizeColumn(c *Column) {
+	// 1. Remove defaults that refer to xata_private schema
+	if c.Default != nil && referencesXataInternals(*c.Default) {
+		c.StrippedDefault = *c.Default
+		c.Default = nil
+	}
+
+	// 2. Handle Sequences (nextval). Identity columns have no default and
+	// keep their identity instead
+	if c.Default != nil && strings.Contains(*c.Default, "nextval(") {
+		// With pg_catalog, format_type should return proper types like 'integer' or 'bigint' or 'text[]'
+		// But we still want to convert auto-incrementing ints to SERIAL for simplicity on destination.
+		if strings.HasPrefix(c.DataType, "integer") || c.DataType == "int4" {
+			c.DataType = "SERIAL"
+			c.Default = nil
+		} else if strings.HasPrefix(c.DataType, "bigint") || c.DataType == "int8" {
+			c.DataType = "BIGSERIAL"
+			c.Default = nil
+		}
+	}
+}
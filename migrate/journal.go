@@ -0,0 +1,396 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/schollz/progressbar/v3"
+)
+
+// defaultJournalPath is where a run writes its journal; {run_id} is
+// replaced by the run ID
+const defaultJournalPath = ".farewall-journal-{run_id}.jsonl"
+
+// Journal event types. copy_started, table_started, table_finished and
+// warning are the calls of the ProgressReporter.
+const (
+	eventRunStarted    = "run_started"
+	eventRunFinished   = "run_finished"
+	eventPhaseStarted  = "phase_started"
+	eventPhaseFinished = "phase_finished"
+	eventCopyStarted   = "copy_started"
+	eventTableStarted  = "table_started"
+	eventTableFinished = "table_finished"
+	eventRetry         = "retry"
+	eventWarning       = "warning"
+	eventStatement     = "statement"
+)
+
+// JournalEvent is one line of the journal.
+type JournalEvent struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	RunID string    `json:"run_id"`
+	Phase Phase     `json:"phase,omitempty"`
+	Table string    `json:"table,omitempty"`
+	// Tables are those of copy_started
+	Tables []string `json:"tables,omitempty"`
+	// Status is succeeded or failed for runs and phases, a table status
+	// for table_finished
+	Status string `json:"status,omitempty"`
+	Rows   int64  `json:"rows,omitempty"`
+	// Category names a destination statement by its leading keywords,
+	// e.g. CREATE INDEX
+	Category string  `json:"category,omitempty"`
+	Seconds  float64 `json:"seconds,omitempty"`
+	Attempt  int     `json:"attempt,omitempty"`
+	Message  string  `json:"message,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// journal appends the events of one run to its file as JSON lines. Every
+// event is written as it happens, so the file survives the process dying.
+type journal struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	runID  string
+	failed bool
+	// run is the run the journal records, and reporter the
+	// ProgressReporter of run it was teed onto
+	run      *runEnv
+	reporter ProgressReporter
+}
+
+// openJournal opens the journal at path, with {run_id} replaced, and makes
+// it receive the events of run until it is closed.
+func openJournal(path, runID string, run *runEnv) (*journal, error) {
+	path = strings.ReplaceAll(path, "{run_id}", runID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal %s: %w", path, err)
+	}
+	j := &journal{f: f, enc: json.NewEncoder(f), runID: runID, run: run, reporter: run.reporter}
+	run.reporter = teeReporter{j.reporter, j}
+	run.journal.Store(j)
+	j.record(JournalEvent{Type: eventRunStarted})
+	return j, nil
+}
+
+// close records the end of the run, with err its outcome, and detaches the
+// journal.
+func (j *journal) close(err error) {
+	e := JournalEvent{Type: eventRunFinished, Status: "succeeded"}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	j.record(e)
+	j.run.journal.Store(nil)
+	j.run.reporter = j.reporter
+	j.f.Close()
+}
+
+func (j *journal) record(e JournalEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.failed {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = utcNow()
+	}
+	e.RunID = j.runID
+	if err := j.enc.Encode(e); err != nil {
+		// The run goes on without its journal
+		log.Printf("Warning: failed to write the journal, no further events are recorded: %v", err)
+		j.failed = true
+	}
+}
+
+func (j *journal) CopyStarted(tables []string, rows []int64) {
+	var total int64
+	for _, n := range rows {
+		total += n
+	}
+	j.record(JournalEvent{Type: eventCopyStarted, Tables: tables, Rows: total})
+}
+
+func (j *journal) TableStarted(table string) {
+	j.record(JournalEvent{Type: eventTableStarted, Table: table})
+}
+
+func (j *journal) BarStarted(*progressbar.ProgressBar, bool) {}
+
+func (j *journal) TableFinished(table, status string, rows int64) {
+	j.record(JournalEvent{Type: eventTableFinished, Table: table, Status: status, Rows: rows})
+}
+
+func (j *journal) Warning(msg string) {
+	j.record(JournalEvent{Type: eventWarning, Message: msg})
+}
+
+// phaseEvent is the phase_finished event of phase, started at start.
+func phaseEvent(phase Phase, start time.Time, err error) JournalEvent {
+	e := JournalEvent{Type: eventPhaseFinished, Phase: phase, Status: "succeeded", Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	return e
+}
+
+// journalTracer records the statements run on a destination connection in
+// the journal. Plain reads are left out; the WAL monitor alone would fill
+// the journal with them.
+type journalTracer struct{}
+
+type traceKey struct{}
+
+type traceStart struct {
+	category string
+	at       time.Time
+}
+
+func (journalTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{category: statementCategory(data.SQL), at: time.Now()})
+}
+
+func (journalTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	traceEnd(ctx, data.CommandTag.RowsAffected(), data.Err)
+}
+
+func (journalTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceCopyFromStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{category: "COPY", at: time.Now()})
+}
+
+func (journalTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	traceEnd(ctx, data.CommandTag.RowsAffected(), data.Err)
+}
+
+func traceEnd(ctx context.Context, rows int64, err error) {
+	start, ok := ctx.Value(traceKey{}).(traceStart)
+	run := runOf(ctx)
+	if !ok || start.category == "" || run.journal.Load() == nil {
+		return
+	}
+	e := JournalEvent{Type: eventStatement, Category: start.category, Rows: rows, Seconds: time.Since(start.at).Seconds()}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	run.record(e)
+}
+
+// statementModifiers are skipped when naming a statement's category
+var statementModifiers = map[string]bool{
+	"OR": true, "REPLACE": true, "UNIQUE": true, "UNLOGGED": true, "TEMP": true, "TEMPORARY": true,
+	"IF": true, "NOT": true, "EXISTS": true, "CONCURRENTLY": true, "ONLY": true,
+}
+
+// statementCategory names sql by its leading keywords, e.g. CREATE INDEX for
+// CREATE UNIQUE INDEX, or "" for plain reads, which are not journaled.
+func statementCategory(sql string) string {
+	words := strings.Fields(strings.ToUpper(sql))
+	if len(words) == 0 {
+		return ""
+	}
+	switch words[0] {
+	case "SELECT", "SHOW", "VALUES", "TABLE":
+		return ""
+	}
+	category := strings.TrimSuffix(words[0], ";")
+	if category != "CREATE" && category != "DROP" && category != "ALTER" {
+		return category
+	}
+	for _, w := range words[1:] {
+		if statementModifiers[w] {
+			continue
+		}
+		category += " " + w
+		if w != "MATERIALIZED" && w != "FOREIGN" {
+			break
+		}
+	}
+	return category
+}
+
+// teeReporter hands every call to both reporters.
+type teeReporter struct {
+	a, b ProgressReporter
+}
+
+func (t teeReporter) CopyStarted(tables []string, rows []int64) {
+	t.a.CopyStarted(tables, rows)
+	t.b.CopyStarted(tables, rows)
+}
+
+func (t teeReporter) TableStarted(table string) {
+	t.a.TableStarted(table)
+	t.b.TableStarted(table)
+}
+
+func (t teeReporter) BarStarted(bar *progressbar.ProgressBar, bytes bool) {
+	t.a.BarStarted(bar, bytes)
+	t.b.BarStarted(bar, bytes)
+}
+
+func (t teeReporter) TableFinished(table, status string, rows int64) {
+	t.a.TableFinished(table, status, rows)
+	t.b.TableFinished(table, status, rows)
+}
+
+func (t teeReporter) Warning(msg string) {
+	t.a.Warning(msg)
+	t.b.Warning(msg)
+}
+
+// journalTable is a table of a summarized journal.
+type journalTable struct {
+	name              string
+	started, finished time.Time
+	status            string
+	rows              int64
+	retries           int
+}
+
+// summarizeJournal prints the timeline of the run recorded in path. A run
+// that has no run_finished event did not end normally; its timeline stops
+// at the last event written.
+func summarizeJournal(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var first, last, finish *JournalEvent
+	var phases []JournalEvent
+	var tables []*journalTable
+	byName := map[string]*journalTable{}
+	var warnings, retries int
+	statements := map[string]int{}
+	failedStatements := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e JournalEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line of a run that died may be cut short
+			log.Printf("Skipping line %d of %s: %v", line, path, err)
+			continue
+		}
+		if first == nil {
+			first = &e
+		}
+		last = &e
+		table := func() *journalTable {
+			t, ok := byName[e.Table]
+			if !ok {
+				t = &journalTable{name: e.Table}
+				byName[e.Table] = t
+				tables = append(tables, t)
+			}
+			return t
+		}
+		switch e.Type {
+		case eventRunFinished:
+			finish = &e
+		case eventPhaseFinished:
+			phases = append(phases, e)
+		case eventTableStarted:
+			table().started = e.Time
+		case eventTableFinished:
+			t := table()
+			t.finished, t.status, t.rows = e.Time, e.Status, e.Rows
+		case eventRetry:
+			retries++
+			if e.Table != "" {
+				table().retries++
+			}
+		case eventWarning:
+			warnings++
+		case eventStatement:
+			statements[e.Category]++
+			if e.Error != "" {
+				failedStatements[e.Category]++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if first == nil {
+		return fmt.Errorf("%s has no events", path)
+	}
+
+	fmt.Printf("Run %s, started %s\n", first.RunID, formatTimestamp(first.Time))
+	if finish != nil {
+		fmt.Printf("Finished %s after %s: %s\n", formatTimestamp(finish.Time), finish.Time.Sub(first.Time).Round(time.Second), finish.Status)
+		if finish.Error != "" {
+			fmt.Printf("  %s\n", finish.Error)
+		}
+	} else {
+		fmt.Printf("Did not finish; the last event, %s, was at %s (%s in)\n", last.Type, formatTimestamp(last.Time), last.Time.Sub(first.Time).Round(time.Second))
+	}
+
+	fmt.Println("\nPhases:")
+	for _, p := range phases {
+		fmt.Printf("  +%-9s %-14s %8.1fs  %s\n", p.Time.Sub(first.Time).Round(time.Second), p.Phase, p.Seconds, p.Status)
+		if p.Error != "" {
+			fmt.Printf("             %s\n", p.Error)
+		}
+	}
+	if len(tables) > 0 {
+		fmt.Println("\nTables:")
+		for _, t := range tables {
+			switch {
+			case t.finished.IsZero():
+				fmt.Printf("  %s: started at +%s, did not finish\n", t.name, t.started.Sub(first.Time).Round(time.Second))
+			case t.started.IsZero():
+				fmt.Printf("  %s: %s, %d rows\n", t.name, t.status, t.rows)
+			default:
+				fmt.Printf("  %s: %s, %d rows in %s\n", t.name, t.status, t.rows, t.finished.Sub(t.started).Round(time.Second))
+			}
+			if t.retries > 0 {
+				fmt.Printf("    retries: %d\n", t.retries)
+			}
+		}
+	}
+	if len(statements) > 0 {
+		fmt.Println("\nDestination statements:")
+		categories := make([]string, 0, len(statements))
+		for c := range statements {
+			categories = append(categories, c)
+		}
+		sort.Strings(categories)
+		for _, c := range categories {
+			if n := failedStatements[c]; n > 0 {
+				fmt.Printf("  %-28s %d (%d failed)\n", c, statements[c], n)
+			} else {
+				fmt.Printf("  %-28s %d\n", c, statements[c])
+			}
+		}
+	}
+	fmt.Printf("\nWarnings: %d, retries: %d\n", warnings, retries)
+	return nil
+}
+
+// runJournal implements the journal subcommand.
+func runJournal(args []string) int {
+	if len(args) != 2 || args[0] != "summarize" {
+		log.Print("usage: journal summarize <journal file>")
+		return 2
+	}
+	if err := summarizeJournal(args[1]); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	// transformJSONNormalize parses a text column holding JSON, such as the
+	// object columns Xata exposes as text, and writes it as jsonb
+	transformJSONNormalize = "json-normalize"
+
+	schemaChangeJSONNormalized = "json_normalized"
+
+	// maxQuarantineSamples caps the quarantined values kept per column
+	maxQuarantineSamples = 100
+
+	// pg_input_is_valid exists from PostgreSQL 16
+	inputIsValidVersion = 160000
+)
+
+// QuarantinedValue is a value of a json-normalize column that is not valid
+// JSON. Its row is still written, with NULL in the column, or JSON null
+// when the column is NOT NULL.
+type QuarantinedValue struct {
+	Column     string   `json:"column"`
+	PrimaryKey []string `json:"primary_key,omitempty"`
+	Value      string   `json:"value"`
+	Error      string   `json:"error"`
+}
+
+// ColumnTransform counts what the transform of one column did in a copy.
+type ColumnTransform struct {
+	Column      string `json:"column"`
+	Transform   string `json:"transform"`
+	Normalized  int64  `json:"normalized"`
+	Quarantined int64  `json:"quarantined,omitempty"`
+	// Samples are the first quarantined values
+	Samples []QuarantinedValue `json:"samples,omitempty"`
+}
+
+// applyTransforms gives json-normalize columns the jsonb type on the
+// destination and records each in the report. The source default, a text
+// expression, does not fit the new type and is dropped.
+func applyTransforms(tables []Table, cfg *Config, report *Report) {
+	for i := range tables {
+		t := &tables[i]
+		tc := cfg.table(t.Name)
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			if tc.Columns[c.Name].Transform != transformJSONNormalize {
+				continue
+			}
+			report.SchemaChanges = append(report.SchemaChanges, SchemaChange{Table: t.Name, Column: c.Name, DataType: c.DataType, Change: schemaChangeJSONNormalized})
+			c.DataType = "jsonb"
+			c.Default, c.Collation = nil, ""
+		}
+	}
+}
+
+// quarantineError is returned by a stage for a value it cannot process. The
+// row is written with value in its place, and the stage records the row
+// (see pipelineRows.Values).
+type quarantineError struct {
+	value any
+	err   error
+}
+
+func (e *quarantineError) Error() string { return e.err.Error() }
+
+// jsonNormalizer parses the JSON text of a column and re-encodes it
+// compactly, with escaped unicode decoded, for the jsonb destination column.
+type jsonNormalizer struct {
+	column string
+	// invalid is written for values that do not parse
+	invalid any
+
+	normalized  atomic.Int64
+	quarantined atomic.Int64
+	mu          sync.Mutex
+	samples     []QuarantinedValue
+}
+
+func newJSONNormalizer(c Column) *jsonNormalizer {
+	n := &jsonNormalizer{column: c.Name}
+	if c.IsNullable == "NO" {
+		n.invalid = json.RawMessage("null")
+	}
+	return n
+}
+
+func (n *jsonNormalizer) apply(v any) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	normalized, err := normalizeJSON(s)
+	if err != nil {
+		return nil, &quarantineError{value: n.invalid, err: err}
+	}
+	n.normalized.Add(1)
+	return json.RawMessage(normalized), nil
+}
+
+func (n *jsonNormalizer) quarantine(pk []string, v any, err error) {
+	n.quarantined.Add(1)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.samples) < maxQuarantineSamples {
+		n.samples = append(n.samples, QuarantinedValue{Column: n.column, PrimaryKey: pk, Value: fmt.Sprint(v), Error: err.Error()})
+	}
+}
+
+// normalizeJSON parses s and encodes it again without insignificant
+// whitespace, keeping numbers as written.
+func normalizeJSON(s string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("invalid JSON: data after the top-level value")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// transformCounts collects the per-column counters of the transforms after
+// a copy, warning about each column with quarantined values.
+func transformCounts(t Table, pipelines []*columnPipeline, report *Report) []ColumnTransform {
+	var out []ColumnTransform
+	for _, p := range pipelines {
+		if p == nil {
+			continue
+		}
+		for _, s := range p.stages {
+			n, ok := s.(*jsonNormalizer)
+			if !ok {
+				continue
+			}
+			ct := ColumnTransform{Column: p.column, Transform: transformJSONNormalize, Normalized: n.normalized.Load(), Quarantined: n.quarantined.Load()}
+			n.mu.Lock()
+			ct.Samples = n.samples
+			n.mu.Unlock()
+			if ct.Quarantined > 0 {
+				report.warnTable(warnJSONQuarantined, t.Name, "column %s.%s: %d value(s) are not valid JSON and were written as null; they are listed under transforms in the report",
+					t.Name, p.column, ct.Quarantined)
+			}
+			out = append(out, ct)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Column < out[j].Column })
+	return out
+}
+
+// jsonVerifyExpr is the source expression verify compares with a
+// json-normalize column: the parsed JSON, so only the content counts and
+// not its spelling. Values that do not parse compare as what the copy wrote
+// for them; before PostgreSQL 16 they make the checksum fail instead.
+func jsonVerifyExpr(c Column, version int) string {
+	col := sqlutil.QuoteIdent(c.Name)
+	if version < inputIsValidVersion {
+		return col + "::jsonb"
+	}
+	invalid := "NULL"
+	if c.IsNullable == "NO" {
+		invalid = "'null'::jsonb"
+	}
+	return "CASE WHEN pg_input_is_valid(" + col + ", 'jsonb') THEN " + col + "::jsonb ELSE " + invalid + " END"
+}
+
+// sourceVersion returns the server version of the source for
+// jsonVerifyExpr, read only when a table has json-normalize columns.
+func sourceVersion(ctx context.Context, opts VerifyOptions, tables []Table) (int, error) {
+	for _, t := range tables {
+		for _, tc := range opts.Config.table(t.Name).Columns {
+			if tc.Transform == transformJSONNormalize {
+				return serverVersion(ctx, opts.Source)
+			}
+		}
+	}
+	return 0, nil
+}
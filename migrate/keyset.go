@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// defaultChunkSize is the rows per chunk of a table copied by key
+const defaultChunkSize = 50000
+
+// KeysetCheckpoint records the chunks of a table copied by its primary key,
+// so a resumed run continues after the last key copied.
+type KeysetCheckpoint struct {
+	Column string `json:"column"`
+	// LastKey is the highest key copied, as text; nil before the first chunk
+	LastKey     *string `json:"last_key"`
+	Chunks      int     `json:"chunks"`
+	RowsCopied  int64   `json:"rows_copied"`
+	BytesCopied int64   `json:"bytes_copied"`
+}
+
+// keysetType reports whether a column of type typ can page a table by key:
+// integers and uuids compare cheaply and have no collation.
+func keysetType(typ string) bool {
+	switch strings.ToLower(typ) {
+	case "smallint", "integer", "bigint", "smallserial", "serial", "bigserial", "uuid":
+		return true
+	}
+	return false
+}
+
+// keysetColumn returns the column t is copied by in chunks of chunkSize
+// rows, or "" to copy it with one query. A table is chunked when its primary
+// key is a single integer or uuid column and it has more than one chunk of
+// rows, and always when an earlier run copied some of its chunks.
+func keysetColumn(t Table, count int64, chunkSize int, cp *Checkpoint) string {
+	if tc, ok := cp.Tables[t.Name]; ok && !tc.Completed && tc.Keyset != nil && tc.Keyset.Chunks > 0 {
+		return tc.Keyset.Column
+	}
+	if chunkSize == 0 || count <= int64(chunkSize) || len(t.PrimaryKey) != 1 {
+		return ""
+	}
+	col, ok := t.column(t.PrimaryKey[0])
+	if !ok || !keysetType(col.DataType) {
+		return ""
+	}
+	return col.Name
+}
+
+// resetStaleKeysets drops the recorded chunks of tables whose primary key
+// changed since, or of every table when --chunk-size is 0; the table is then
+// recreated and copied again.
+func resetStaleKeysets(tables []Table, chunkSize int, cp *Checkpoint) {
+	for _, t := range tables {
+		tc, ok := cp.Tables[t.Name]
+		if !ok || tc.Completed || tc.Keyset == nil {
+			continue
+		}
+		if chunkSize == 0 || len(t.PrimaryKey) != 1 || t.PrimaryKey[0] != tc.Keyset.Column {
+			cp.reset(t.Name)
+		}
+	}
+}
+
+// copyTableKeyset copies a table in chunks of chunkSize rows ordered by
+// column, each read with its own query and written with its own COPY, and
+// records every chunk in the checkpoint. The upper key of a chunk is looked
+// up first, so each query reads a closed key range and needs no ORDER BY or
+// LIMIT of its own; the last chunk is open above and also picks up rows
+// inserted while the copy runs. One progress bar covers all chunks.
+func copyTableKeyset(ctx context.Context, source *SourceConn, dest CopyConn, t Table, column string, chunkSize int, count int64, cp *Checkpoint, pipelines []*columnPipeline, wal *walMonitor) (int64, int64, error) {
+	tc := cp.table(t.Name)
+	if tc.Keyset == nil {
+		tc.Keyset = &KeysetCheckpoint{Column: column}
+	}
+	ks := tc.Keyset
+	if ks.Chunks > 0 {
+		fmt.Printf("  Copying in chunks of %d rows by %s, resuming after %d chunk(s)\n", chunkSize, column, ks.Chunks)
+	} else {
+		fmt.Printf("  Copying in chunks of %d rows by %s\n", chunkSize, column)
+	}
+
+	col, _ := t.column(column)
+	quoted, typ := sqlutil.QuoteIdent(column), castType(col)
+	run := runOf(ctx)
+	bar := run.newProgressBar(count, "  Copying")
+	_ = bar.Add64(min(ks.RowsCopied, count))
+	var rows, bytes int64
+	for {
+		var where string
+		var args []any
+		if ks.LastKey != nil {
+			where = fmt.Sprintf(" WHERE %s > $1::%s", quoted, typ)
+			args = append(args, *ks.LastKey)
+		}
+		var hi *string
+		err := source.QueryRow(ctx, fmt.Sprintf("SELECT %s::text FROM %s%s ORDER BY %s OFFSET %d LIMIT 1",
+			quoted, fromClause(t), where, quoted, chunkSize-1), args...).Scan(&hi)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return rows, bytes, onEndpoint(endpointSource, fmt.Errorf("failed to find the next chunk of %s: %w", t.Name, err))
+		}
+
+		cond := strings.TrimPrefix(where, " WHERE ")
+		if hi != nil {
+			if cond != "" {
+				cond += " AND "
+			}
+			args = append(args, *hi)
+			cond += fmt.Sprintf("%s <= $%d::%s", quoted, len(args), typ)
+		}
+		copied, copiedBytes, err := copyRows(ctx, source, dest, t, destIdentifier(t), cond, args, bar, pipelines, nil, wal)
+		if err != nil {
+			return rows, bytes, err
+		}
+		rows += copied
+		bytes += copiedBytes
+		if err := cp.markChunk(ks, hi, copied, copiedBytes); err != nil {
+			return rows, bytes, err
+		}
+		run.debugf("%s: chunk %d up to %s: %d rows, %s", t.Name, ks.Chunks, keyLabel(hi), copied, formatBytes(copiedBytes))
+		if hi == nil {
+			break
+		}
+	}
+	bar.Finish()
+	fmt.Println()
+	return rows, bytes, nil
+}
+
+func keyLabel(key *string) string {
+	if key == nil {
+		return "+inf"
+	}
+	return *key
+}
@@ -0,0 +1,314 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	matviewCreated   = "created"
+	matviewRefreshed = "refreshed"
+	matviewSkipped   = "skipped"
+)
+
+// materializedView is a materialized view of a source schema of the run,
+// recreated by the matviews phase once the data is copied.
+type materializedView struct {
+	Schema string
+	Name   string
+	// Definition is the stored query, as pg_get_viewdef prints it
+	Definition string
+	// Indexes are CREATE INDEX statements, as pg_get_indexdef prints them
+	Indexes []string
+	// Reads are the relations and columns the query reads
+	Reads []matviewRead
+}
+
+type matviewRead struct {
+	Schema, Relation string
+	// Kind is the relkind: r and p for tables, v for views, m for
+	// materialized views
+	Kind string
+	// Column is empty for a dependency on the whole relation
+	Column string
+}
+
+// MatViewReport describes one materialized view of the matviews phase.
+type MatViewReport struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Indexes int    `json:"indexes,omitempty"`
+	// RefreshSeconds is how long REFRESH MATERIALIZED VIEW took
+	RefreshSeconds float64 `json:"refresh_seconds,omitempty"`
+	// Reason is why a view was skipped
+	Reason string `json:"reason,omitempty"`
+}
+
+// introspectMatViews reads the materialized views of schemas in creation
+// order, so a view reading another one comes after it.
+func introspectMatViews(ctx context.Context, conn Querier, schemas []string) ([]materializedView, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname::text, c.relname, m.definition,
+			ARRAY(
+				SELECT pg_get_indexdef(i.indexrelid)
+				FROM pg_index i
+				WHERE i.indrelid = c.oid
+				ORDER BY i.indexrelid
+			)
+		FROM pg_matviews m
+		JOIN pg_namespace n ON n.nspname = m.schemaname
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = m.matviewname
+		WHERE m.schemaname = ANY($1)
+		ORDER BY c.oid
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get materialized views: %w", err)
+	}
+	views, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (materializedView, error) {
+		var mv materializedView
+		err := r.Scan(&mv.Schema, &mv.Name, &mv.Definition, &mv.Indexes)
+		return mv, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get materialized views: %w", err)
+	}
+	if len(views) == 0 {
+		return nil, nil
+	}
+
+	// The query's rewrite rule depends on every relation and column it reads
+	rows, err = conn.Query(ctx, `
+		SELECT DISTINCT mn.nspname::text, mv.relname, n.nspname, dep.relname, dep.relkind::text, coalesce(a.attname::text, '')
+		FROM pg_class mv
+		JOIN pg_namespace mn ON mn.oid = mv.relnamespace
+		JOIN pg_rewrite r ON r.ev_class = mv.oid
+		JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.objid = r.oid
+			AND d.refclassid = 'pg_class'::regclass AND d.refobjid <> mv.oid
+		JOIN pg_class dep ON dep.oid = d.refobjid
+		JOIN pg_namespace n ON n.oid = dep.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = dep.oid AND a.attnum = d.refobjsubid AND d.refobjsubid > 0 AND NOT a.attisdropped
+		WHERE mv.relkind = 'm'
+		  AND mn.nspname = ANY($1)
+		ORDER BY 1, 2, 3, 4, 6
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get materialized view dependencies: %w", err)
+	}
+	defer rows.Close()
+	byName := make(map[string]*materializedView, len(views))
+	for i := range views {
+		byName[views[i].key()] = &views[i]
+	}
+	for rows.Next() {
+		var schema, name string
+		var read matviewRead
+		if err := rows.Scan(&schema, &name, &read.Schema, &read.Relation, &read.Kind, &read.Column); err != nil {
+			return nil, err
+		}
+		if mv, ok := byName[sourceTableKey(schema, name)]; ok {
+			mv.Reads = append(mv.Reads, read)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get materialized view dependencies: %w", err)
+	}
+	return views, nil
+}
+
+// key is the name of mv in reports, as sourceTableKey names tables.
+func (mv materializedView) key() string {
+	return sourceTableKey(mv.Schema, mv.Name)
+}
+
+// matviewSkipReason returns why mv cannot be created on the destination, or
+// "" when it can. Its stored query names source tables and columns, so
+// every table it reads must be migrated under its own name into its own
+// schema, with the columns it reads copied unchanged; materialized views it
+// reads must have been created before it.
+func matviewSkipReason(mv materializedView, tables []Table, created map[string]bool) string {
+	for _, read := range mv.Reads {
+		key := sourceTableKey(read.Schema, read.Relation)
+		switch read.Kind {
+		case "v":
+			return fmt.Sprintf("it reads view %s, and views are not migrated", key)
+		case "m":
+			if !created[key] {
+				return fmt.Sprintf("it reads materialized view %s, which was not created", key)
+			}
+			continue
+		}
+		t, ok := tableByName(tables, key)
+		switch {
+		case !ok:
+			return fmt.Sprintf("it reads %s, which is not migrated", key)
+		case t.destSchema() != t.sourceSchema() || t.destName() != t.baseName():
+			return fmt.Sprintf("it reads %s, which is renamed or routed to another schema", key)
+		case read.Column == "":
+			continue
+		}
+		c, ok := t.column(read.Column)
+		switch {
+		case !ok:
+			return fmt.Sprintf("it reads column %s.%s, which is not copied", t.Name, read.Column)
+		case c.destName() != c.Name:
+			return fmt.Sprintf("it reads column %s.%s, which is renamed", t.Name, read.Column)
+		case c.Encrypt != "":
+			return fmt.Sprintf("it reads column %s.%s, which is encrypted", t.Name, read.Column)
+		case c.SourceExpr != "":
+			return fmt.Sprintf("it reads column %s.%s, which is converted", t.Name, read.Column)
+		case c.UUIDKey != nil:
+			return fmt.Sprintf("it reads column %s.%s, which is converted to uuid", t.Name, read.Column)
+		}
+	}
+	return ""
+}
+
+// MatViews recreates the source's materialized views with their indexes,
+// WITH NO DATA, and with --refresh-matviews populates them.
+func (m *Migrator) MatViews(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseMatViews, state, m.matViews)
+}
+
+func (m *Migrator) matViews(ctx context.Context, state *MigrationState) error {
+	if len(state.matViews) == 0 {
+		return nil
+	}
+	var views []materializedView
+	reports := map[string]*MatViewReport{}
+	if m.opts.DataOnly {
+		// --data-only leaves the destination definitions alone; the views
+		// that exist there are only refreshed
+		if !m.opts.RefreshMatViews {
+			return nil
+		}
+		existing, err := destinationMatViews(ctx, m.dest, m.opts.Schemas.sourceSchemas())
+		if err != nil {
+			return err
+		}
+		for _, mv := range state.matViews {
+			if existing[mv.key()] {
+				views = append(views, mv)
+			}
+		}
+	} else {
+		var err error
+		if views, err = m.createMatViews(ctx, state, reports); err != nil {
+			return err
+		}
+	}
+
+	if len(views) > 0 && m.opts.RefreshMatViews {
+		fmt.Printf("Refreshing %d materialized view(s)...\n", len(views))
+		for i, mv := range views {
+			key := mv.key()
+			fmt.Printf("Refreshing materialized view: %s\n", key)
+			start := time.Now()
+			if _, err := m.dest.Exec(ctx, "REFRESH MATERIALIZED VIEW "+schemaIdent(mv.Schema, mv.Name)); err != nil {
+				return &SchemaError{Table: key, Err: fmt.Errorf("failed to refresh materialized view %s: %w", key, err)}
+			}
+			elapsed := time.Since(start)
+			fmt.Printf("  Refreshed in %s (%d of %d)\n", formatElapsed(elapsed), i+1, len(views))
+			mr := reports[key]
+			if mr == nil {
+				mr = &MatViewReport{Name: key}
+				reports[key] = mr
+			}
+			mr.Status, mr.RefreshSeconds = matviewRefreshed, elapsed.Seconds()
+		}
+	} else if len(views) > 0 {
+		fmt.Println("The materialized views are not populated; pass --refresh-matviews or run REFRESH MATERIALIZED VIEW once the data is final.")
+	}
+
+	for _, mv := range state.matViews {
+		if mr := reports[mv.key()]; mr != nil {
+			state.Report.MatViews = append(state.Report.MatViews, *mr)
+		}
+	}
+	return nil
+}
+
+// createMatViews drops and recreates every materialized view that can be
+// created, with its indexes, and returns them. Views are dropped in reverse
+// creation order so none is dropped before the views reading it.
+func (m *Migrator) createMatViews(ctx context.Context, state *MigrationState, reports map[string]*MatViewReport) ([]materializedView, error) {
+	fmt.Println("Creating materialized views...")
+	var views []materializedView
+	created := map[string]bool{}
+	for _, mv := range state.matViews {
+		key := mv.key()
+		if reason := matviewSkipReason(mv, state.AllTables, created); reason != "" {
+			state.Report.warnTable(warnMatViewSkipped, key, "materialized view %s was not created: %s", key, reason)
+			reports[key] = &MatViewReport{Name: key, Status: matviewSkipped, Reason: reason}
+			continue
+		}
+		created[key] = true
+		views = append(views, mv)
+	}
+	for _, mv := range slices.Backward(views) {
+		if _, err := m.dest.Exec(ctx, "DROP MATERIALIZED VIEW IF EXISTS "+schemaIdent(mv.Schema, mv.Name)); err != nil {
+			return nil, &SchemaError{Table: mv.key(), Err: fmt.Errorf("failed to drop materialized view %s (objects outside the migration may depend on it): %w", mv.key(), err)}
+		}
+	}
+	for _, mv := range views {
+		key := mv.key()
+		stmt := "CREATE MATERIALIZED VIEW " + schemaIdent(mv.Schema, mv.Name) + " AS " + strings.TrimSuffix(strings.TrimSpace(mv.Definition), ";") + " WITH NO DATA"
+		if _, err := m.dest.Exec(ctx, stmt); err != nil {
+			return nil, &SchemaError{Table: key, Err: fmt.Errorf("failed to create materialized view %s: %w", key, err)}
+		}
+		for _, idx := range mv.Indexes {
+			if _, err := m.dest.Exec(ctx, idx); err != nil {
+				return nil, &SchemaError{Table: key, Err: fmt.Errorf("failed to create index on materialized view %s (%s): %w", key, idx, err)}
+			}
+		}
+		fmt.Printf("  %s (%d index(es))\n", key, len(mv.Indexes))
+		reports[key] = &MatViewReport{Name: key, Status: matviewCreated, Indexes: len(mv.Indexes)}
+	}
+	return views, nil
+}
+
+// recreatedMatViews counts the source's materialized views that exist on the
+// destination, for a summary outside a run.
+func recreatedMatViews(ctx context.Context, source, dest Querier, schemas []string) (int64, error) {
+	views, err := introspectMatViews(ctx, source, schemas)
+	if err != nil {
+		return 0, err
+	}
+	existing, err := destinationMatViews(ctx, dest, schemas)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, mv := range views {
+		if existing[mv.key()] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// destinationMatViews returns the materialized views of schemas on the
+// destination, named as sourceTableKey names tables.
+func destinationMatViews(ctx context.Context, dest Querier, schemas []string) (map[string]bool, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT CASE WHEN schemaname = 'public' THEN matviewname::text ELSE schemaname || '.' || matviewname END
+		FROM pg_matviews
+		WHERE schemaname = ANY($1)
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination materialized views: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination materialized views: %w", err)
+	}
+	out := make(map[string]bool, len(names))
+	for _, name := range names {
+		out[name] = true
+	}
+	return out, nil
+}
@@ -0,0 +1,183 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// destinationLockKey is hashed into the advisory lock a migration holds on
+// its destination for as long as it runs.
+const destinationLockKey = "farewall-xata-lite"
+
+// lockDestination takes a session-level advisory lock on the destination so
+// two migrations never write to the same database at once. The lock is
+// released when the connection closes.
+func lockDestination(ctx context.Context, dest Querier) error {
+	var locked bool
+	if err := dest.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", destinationLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to lock destination: %w", err)
+	}
+	if !locked {
+		return fmt.Errorf("another migration is already running against this destination")
+	}
+	return nil
+}
+
+// CombinedReport is written with --report when the config declares several
+// migrations.
+type CombinedReport struct {
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Status         string    `json:"status"`
+	Migrations     []*Report `json:"migrations"`
+}
+
+const migrationStatusSkipped = "skipped"
+
+func (r *CombinedReport) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	return nil
+}
+
+// runMigrations runs the migrations declared in the config one after
+// another, or only the one named by --migration. A failed migration does not
+// stop the later ones unless failFast is set. It returns the exit code.
+func runMigrations(ctx context.Context, opts Options, env envSettings, name string, failFast bool) int {
+	migrations := opts.Config.Migrations
+	if name != "" {
+		migrations = nil
+		for _, m := range opts.Config.Migrations {
+			if m.Name == name {
+				migrations = append(migrations, m)
+			}
+		}
+		if len(migrations) == 0 {
+			log.Printf("Config declares no migration named %s", name)
+			return 1
+		}
+	}
+
+	combined := &CombinedReport{StartedAt: utcNow()}
+	var failed []string
+	// The exit code is that of the first failed migration
+	code := 0
+	for i, m := range migrations {
+		fmt.Printf("\n=== Migration %s (%d of %d) ===\n", m.Name, i+1, len(migrations))
+		if failFast && len(failed) > 0 {
+			skipped := newReport(opts.Resume)
+			skipped.Migration = m.Name
+			skipped.Status = migrationStatusSkipped
+			combined.Migrations = append(combined.Migrations, skipped)
+			fmt.Println("Skipped (--fail-fast).")
+			continue
+		}
+
+		mopts, menv := m.apply(opts, env)
+		var report *Report
+		err := mopts.validate()
+		if err != nil {
+			report = newReport(mopts.Resume)
+			report.finish(err)
+		} else {
+			report, err = runMigration(ctx, mopts, &menv)
+		}
+		menv.unload()
+		report.Migration = m.Name
+		combined.Migrations = append(combined.Migrations, report)
+
+		if err != nil {
+			log.Printf("Migration %s failed: %v", m.Name, err)
+			failed = append(failed, m.Name)
+			if code == 0 {
+				code = exitCode(err)
+			}
+			continue
+		}
+		fmt.Printf("Migration %s completed successfully.\n", m.Name)
+	}
+
+	combined.FinishedAt = utcNow()
+	combined.ElapsedSeconds = elapsedSeconds(combined.StartedAt, combined.FinishedAt)
+	combined.Status = "succeeded"
+	if len(failed) > 0 {
+		combined.Status = "failed"
+	}
+	if opts.ReportPath != "" {
+		if err := combined.write(opts.ReportPath); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	fmt.Println()
+	if len(failed) > 0 {
+		log.Printf("%d of %d migration(s) failed: %s", len(failed), len(migrations), strings.Join(failed, ", "))
+		return code
+	}
+	fmt.Printf("All %d migration(s) completed successfully!\n", len(migrations))
+	return 0
+}
+
+// apply returns the options and environment of this migration: its own
+// settings where given, the command line otherwise. Checkpoint and schema
+// snapshot always get the migration name, so every destination keeps its
+// own history.
+func (m MigrationConfig) apply(opts Options, env envSettings) (Options, envSettings) {
+	opts.Config = &Config{Tables: m.Tables, SchemaRoutes: m.SchemaRoutes, DefaultRewrites: m.DefaultRewrites, Suppressions: opts.Config.suppressions(), SmokeChecks: m.SmokeChecks}
+	opts.CheckpointPath = pathForMigration(opts.CheckpointPath, m.Name)
+	if opts.SchemaSnapshotPath != "" {
+		opts.SchemaSnapshotPath = pathForMigration(opts.SchemaSnapshotPath, m.Name)
+	}
+	if opts.DDLOut != "" {
+		opts.DDLOut = pathForMigration(opts.DDLOut, m.Name)
+	}
+	if len(m.Only) > 0 {
+		opts.Only = m.Only
+	}
+	if m.DataOnly != nil {
+		opts.DataOnly = *m.DataOnly
+	}
+	if m.Upsert != nil {
+		opts.Upsert = *m.Upsert
+	}
+	if m.Differential != nil {
+		opts.Differential = *m.Differential
+	}
+	if m.DeleteExtraneous != nil {
+		opts.DeleteExtraneous = *m.DeleteExtraneous
+	}
+	if m.CopyMethod != "" {
+		opts.CopyMethod = m.CopyMethod
+	}
+	if m.SourceEndpoint != "" {
+		opts.SourceEndpoint = m.SourceEndpoint
+	}
+
+	if len(m.EnvFiles) > 0 {
+		env.files = m.EnvFiles
+	}
+	if m.EnvPrefix != "" {
+		env.prefix = m.EnvPrefix
+	}
+	env.loaded = nil
+	return opts, env
+}
+
+// pathForMigration inserts the migration name before the extension:
+// .farewall-state.json becomes .farewall-state.shop.json.
+func pathForMigration(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
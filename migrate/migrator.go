@@ -0,0 +1,1045 @@
+// Package migrate is the engine of the migration tool: a Migrator runs the
+// phases of a migration from a Xata source to a PostgreSQL destination, and
+// the verification and export subcommands are built on the same pieces. The
+// migration-tool command is a thin wrapper around Main.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Querier is the part of *pgx.Conn used by every phase except copy, so those
+// phases can be run against a fake.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// CopyConn is the destination connection the copy phase writes through: a
+// Querier that can also COPY, open transactions and be dialled again from
+// its config, which the parallel workers and the WAL monitor do. *pgx.Conn
+// satisfies it; a nil Config means the connection cannot be dialled again.
+type CopyConn interface {
+	Querier
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+	PgConn() *pgconn.PgConn
+	Config() *pgx.ConnConfig
+	IsClosed() bool
+	Close(ctx context.Context) error
+}
+
+// Phase names one step of a migration; see Migrator.
+type Phase string
+
+const (
+	PhaseIntrospect   Phase = "introspect"
+	PhasePlan         Phase = "plan"
+	PhaseCreateSchema Phase = "create-schema"
+	PhaseCopy         Phase = "copy"
+	PhaseIndexes      Phase = "indexes"
+	PhaseConstraints  Phase = "constraints"
+	PhaseStatistics   Phase = "statistics"
+	PhaseMatViews     Phase = "matviews"
+	PhaseTriggers     Phase = "triggers"
+	PhasePolicies     Phase = "policies"
+	PhaseGrants       Phase = "grants"
+	PhaseVerify       Phase = "verify"
+)
+
+// MigrationState is what the phases of one run hand to each other. Hooks may
+// change it, e.g. drop tables from Tables before the copy.
+type MigrationState struct {
+	Checkpoint *Checkpoint
+	Report     *Report
+
+	// AllTables is the introspected source schema; Tables the part of it
+	// this run migrates (narrowed by --only and, for kept destination
+	// tables, to the columns both sides have).
+	AllTables []Table
+	Tables    []Table
+	// matViews are the source's materialized views, recreated by the
+	// matviews phase
+	matViews []materializedView
+	// enums, domains and composites are the source's enum types, domains
+	// and composite types, created before the tables
+	enums      []enumType
+	domains    []domainType
+	composites []compositeType
+	// extensions are the source's extensions, created before anything else
+	extensions []extension
+	// functions are created before the tables with --include-functions,
+	// triggers once the data is in with --include-triggers
+	functions []function
+	triggers  []trigger
+	// policies and rowSecurity are the source's row-level security,
+	// recreated once the data is in unless --skip-rls is given
+	policies    []policy
+	rowSecurity []rowSecurity
+
+	// Keep marks tables whose destination definition is kept rather than
+	// recreated; DiffPlan the ones synced differentially.
+	Keep     map[string]bool
+	DiffPlan map[string]bool
+	// Incremental holds the watermarks of the tables --incremental reads
+	// from their watermark on
+	Incremental map[string]*Watermark
+	// Merge marks tables upserted into a reserved destination table (see
+	// on_existing) or, with --mode sync, into any existing one
+	Merge map[string]bool
+
+	// upserts are the conflict strategies of the tables loaded with
+	// --upsert or merged
+	upserts map[string]*conflictStrategy
+	// detached foreign keys of other tables, restored by the constraints
+	// phase
+	detached []foreignKey
+	// loadHooks are the destination triggers and rules of kept tables,
+	// disabled during the copy with --disable-dest-triggers
+	loadHooks []*LoadHook
+}
+
+// Hook runs before or after a phase. An error stops the migration.
+type Hook func(ctx context.Context, state *MigrationState) error
+
+// Migrator runs a migration as a sequence of phases: introspect, plan,
+// create-schema, copy, indexes, constraints, statistics, matviews, triggers,
+// grants and verify. Migrate runs all of them;
+// embedders can instead call the phase methods one by one on a shared state
+// from NewState, or register hooks around them.
+type Migrator struct {
+	opts Options
+
+	// source and dest serve every phase but copy, which needs the
+	// connections themselves.
+	source, dest Querier
+	sources      *sourceEndpoints
+	destConn     CopyConn
+	// recorder is set while phases are recorded for --ddl-out
+	recorder *sqlRecorder
+	// sourceLock holds the --lock-source-schema locks until Migrate returns
+	sourceLock *SourceConn
+	// replaced are the destination connections opened by reconnectDest,
+	// closed when Migrate returns
+	replaced []CopyConn
+	// env is handed down to the phases in their context (see runEnv)
+	env *runEnv
+	// pooler is the transaction pooler in front of the destination, once
+	// poolerKnown (see setPooler)
+	pooler      *PoolerReport
+	poolerKnown bool
+
+	before, after map[Phase][]Hook
+}
+
+// NewMigrator returns a Migrator reading from source, and from replica as
+// opts.SourceEndpoint says when it is not nil, and writing to dest. Both
+// source connections count against opts.SourceConnectionLimit.
+func NewMigrator(source, replica *SourceConn, dest CopyConn, opts Options) *Migrator {
+	slots := newSourceLimiter(opts.SourceConnectionLimit)
+	if source != nil && source.slots != nil {
+		// Connected by the command line, already counted
+		slots = source.slots
+	}
+	slots.adopt(source)
+	slots.adopt(replica)
+	return &Migrator{
+		opts:     opts,
+		source:   source,
+		dest:     dest,
+		sources:  &sourceEndpoints{primary: source, replica: replica, mode: opts.SourceEndpoint},
+		destConn: dest,
+		env:      newRunEnv(opts, slots),
+	}
+}
+
+// setPooler records the transaction pooler in front of the destination, nil
+// for none. Without a bypass to copy through, the copy writes batched
+// INSERTs.
+func (m *Migrator) setPooler(p *PoolerReport) {
+	m.pooler, m.poolerKnown = p, true
+	m.env.batched = p != nil && !p.Bypass
+}
+
+// checkPooler finds out whether the destination of a Migrator not set up
+// by connectDestination is behind a transaction pooler, as --dest-pooler
+// says.
+func (m *Migrator) checkPooler(ctx context.Context, report *Report) error {
+	if m.poolerKnown {
+		return nil
+	}
+	var detected string
+	switch m.opts.DestPooler {
+	case destPoolerPgBouncer:
+	case destPoolerAuto:
+		var err error
+		if detected, err = detectTransactionPooler(ctx, m.destConn); err != nil {
+			return err
+		}
+		if detected == "" {
+			m.setPooler(nil)
+			return nil
+		}
+	default:
+		m.setPooler(nil)
+		return nil
+	}
+	m.setPooler(&PoolerReport{
+		Pooler:      destPoolerPgBouncer,
+		Detected:    detected,
+		Strategy:    poolerStrategyInsert,
+		Unavailable: []string{"COPY", "CSV passthrough", "COPY FREEZE"},
+	})
+	report.Pooler = m.pooler
+	return nil
+}
+
+// BeforePhase registers a hook that runs before phase.
+func (m *Migrator) BeforePhase(phase Phase, hook Hook) {
+	if m.before == nil {
+		m.before = map[Phase][]Hook{}
+	}
+	m.before[phase] = append(m.before[phase], hook)
+}
+
+// AfterPhase registers a hook that runs after phase succeeded.
+func (m *Migrator) AfterPhase(phase Phase, hook Hook) {
+	if m.after == nil {
+		m.after = map[Phase][]Hook{}
+	}
+	m.after[phase] = append(m.after[phase], hook)
+}
+
+func (m *Migrator) run(ctx context.Context, phase Phase, state *MigrationState, fn func(context.Context, *MigrationState) error) error {
+	ctx = withRun(ctx, m.env)
+	m.env.record(JournalEvent{Type: eventPhaseStarted, Phase: phase})
+	start := time.Now()
+	err := m.runPhase(ctx, phase, state, fn)
+	m.env.record(phaseEvent(phase, start, err))
+	return err
+}
+
+func (m *Migrator) runPhase(ctx context.Context, phase Phase, state *MigrationState, fn func(context.Context, *MigrationState) error) error {
+	if m.recorder != nil {
+		m.recorder.startPhase(phase)
+	}
+	for _, h := range m.before[phase] {
+		if err := h(ctx, state); err != nil {
+			return fmt.Errorf("before %s hook: %w", phase, err)
+		}
+	}
+	if err := fn(ctx, state); err != nil {
+		return err
+	}
+	for _, h := range m.after[phase] {
+		if err := h(ctx, state); err != nil {
+			return fmt.Errorf("after %s hook: %w", phase, err)
+		}
+	}
+	return nil
+}
+
+// Migrate runs all phases. With --dry-run it stops after the plan, or with
+// --ddl-out records the schema phases instead of running them.
+func (m *Migrator) Migrate(ctx context.Context, report *Report) (err error) {
+	state, err := m.NewState(report)
+	if err != nil {
+		return err
+	}
+	defer func() { report.SourceConnections = m.env.slots.report() }()
+	if m.opts.JournalPath != "" {
+		j, err := openJournal(m.opts.JournalPath, state.Checkpoint.RunID, m.env)
+		if err != nil {
+			return err
+		}
+		defer func() { j.close(err) }()
+	}
+	defer m.ReleaseSourceLock()
+	defer m.closeReplaced()
+	// Foreign keys detached for --only are restored even when a later
+	// phase fails, but then left NOT VALID
+	defer func() {
+		if err != nil && len(state.detached) > 0 {
+			if rerr := restoreForeignKeys(ctx, m.dest, state.detached); rerr != nil {
+				report.warn(warnForeignKeyNotValid, "%v", rerr)
+			}
+		}
+	}()
+
+	if err := m.Introspect(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Plan(ctx, state); err != nil {
+		return err
+	}
+	if m.opts.DryRun {
+		if m.opts.DDLOut != "" {
+			return m.recordPhases(ctx, state)
+		}
+		return nil
+	}
+	if err := m.CreateSchema(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Copy(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Indexes(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Constraints(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Statistics(ctx, state); err != nil {
+		return err
+	}
+	if err := m.MatViews(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Triggers(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Policies(ctx, state); err != nil {
+		return err
+	}
+	if err := m.Grants(ctx, state); err != nil {
+		return err
+	}
+	return m.Verify(ctx, state)
+}
+
+// NewState loads the checkpoint (for --resume and --only) and starts a new
+// run ID.
+func (m *Migrator) NewState(report *Report) (*MigrationState, error) {
+	report.attach(m.env)
+	cp := newCheckpoint(m.opts.CheckpointPath)
+	// A partial run keeps the progress recorded for all other tables
+	if m.opts.Resume || len(m.opts.Only) > 0 {
+		var err error
+		cp, err = loadCheckpoint(m.opts.CheckpointPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The watermarks outlive the run that recorded them
+	if m.opts.Incremental && !m.opts.Resume && len(m.opts.Only) == 0 {
+		prev, err := loadCheckpoint(m.opts.CheckpointPath)
+		if err != nil {
+			return nil, err
+		}
+		cp.Watermarks = prev.Watermarks
+	}
+	if err := cp.checkSchemas(m.opts.Schemas.sourceSchemas()); err != nil {
+		return nil, err
+	}
+	if len(cp.TempObjects) > 0 {
+		report.warn(warnTempLeftovers, "run %s left %d temporary object(s) on the destination; run the cleanup subcommand to drop them", cp.RunID, len(cp.TempObjects))
+		cp.TempObjects = nil
+	}
+	cp.RunID = newRunID()
+	report.RunID = cp.RunID
+	fmt.Printf("Run ID: %s, started %s (host timezone %s)\n", cp.RunID, formatTimestamp(report.StartedAt), localZone())
+	return &MigrationState{Checkpoint: cp, Report: report}, nil
+}
+
+// Introspect runs the pre-flight checks and reads the source schema.
+func (m *Migrator) Introspect(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseIntrospect, state, m.introspect)
+}
+
+func (m *Migrator) introspect(ctx context.Context, state *MigrationState) error {
+	opts := m.opts
+	if err := preflight(ctx, m.source, m.dest, opts, state.Report); err != nil {
+		return err
+	}
+
+	if opts.LockSourceSchema && m.sourceLock == nil {
+		if m.sources == nil {
+			return fmt.Errorf("--lock-source-schema needs a source connection")
+		}
+		lock, err := lockSourceSchema(ctx, m.sources.primary, opts.Only, opts.Schemas.sourceSchemas(), opts.SourceLockTimeout)
+		if err != nil {
+			return err
+		}
+		m.sourceLock = lock
+		fmt.Println("Source schema locked.")
+	}
+
+	fmt.Println("Introspecting schema...")
+	tables, err := introspectSource(ctx, m.source, opts.Schemas.sourceSchemas(), opts.TablePrefixes)
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	hash, err := schemaHash(tables)
+	if err != nil {
+		return err
+	}
+	if err := state.Checkpoint.checkSchemaHash(hash); err != nil {
+		return err
+	}
+	if err := introspectStatistics(ctx, m.source, tables); err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	if err := introspectIndexes(ctx, m.source, tables); err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	if err := introspectChecks(ctx, m.source, tables); err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	matviews, err := introspectMatViews(ctx, m.source, opts.Schemas.sourceSchemas())
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	enums, err := introspectEnums(ctx, m.source, opts.Schemas.sourceSchemas())
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	domains, err := introspectDomains(ctx, m.source, opts.Schemas.sourceSchemas())
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	composites, err := introspectComposites(ctx, m.source, opts.Schemas.sourceSchemas())
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	exts, err := introspectExtensions(ctx, m.source)
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	var functions []function
+	if opts.IncludeFunctions {
+		if functions, err = introspectFunctions(ctx, m.source, opts.Schemas.sourceSchemas()); err != nil {
+			return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+		}
+	}
+	var triggers []trigger
+	if opts.IncludeTriggers {
+		if triggers, err = introspectTriggers(ctx, m.source, opts.Schemas.sourceSchemas()); err != nil {
+			return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+		}
+	}
+	var policies []policy
+	var secured []rowSecurity
+	if !opts.SkipRLS {
+		if policies, secured, err = introspectPolicies(ctx, m.source, opts.Schemas.sourceSchemas()); err != nil {
+			return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+		}
+	}
+	if len(opts.TablePrefixes) > 0 {
+		fmt.Printf("Found %d tables starting with %s.\n", len(tables), strings.Join(opts.TablePrefixes, ", "))
+	} else {
+		fmt.Printf("Found %d tables.\n", len(tables))
+	}
+	if len(matviews) > 0 {
+		fmt.Printf("Found %d materialized view(s).\n", len(matviews))
+	}
+
+	if opts.FlattenInheritance {
+		flattenInheritance(tables)
+	}
+	handleXataMetadata(tables, opts.KeepXataMetadata, state.Report)
+	if opts.FlattenDomains {
+		flattenDomains(tables, domains, state.Report)
+		flattenCompositeDomains(composites, domains)
+		domains = nil
+	}
+
+	if err := opts.Config.validate(tables); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if len(opts.Exclude) > 0 {
+		if tables, err = excludeTables(tables, opts.Exclude); err != nil {
+			return &SchemaError{Err: err}
+		}
+		fmt.Printf("Excluded %s.\n", strings.Join(opts.Exclude, ", "))
+	}
+	applyDefaultRewrites(tables, opts.Config.defaultRewrites(), state.Report)
+	applyEncryption(tables, opts.Config, state.Report)
+	applyTransforms(tables, opts.Config, state.Report)
+	applyUUIDKeys(tables, opts.Config, state.Report)
+	applyNames(tables, opts.Config, opts.SchemaMap, opts.FoldIdentifiers)
+	mapSchemaReferences(tables, opts.SchemaMap)
+	mapObjectSchemas(tables, enums, domains, composites, functions, opts.SchemaMap)
+	if err := applyChecks(tables, opts.SkipXataChecks, state.Report); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if err := checkSchemaRoutes(tables); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if err := checkNameCollisions(tables, opts, state.Report); err != nil {
+		return &SchemaError{Err: err}
+	}
+
+	if err := checkDefaultRewrites(ctx, m.dest, tables, opts.Config.defaultRewrites()); err != nil {
+		return err
+	}
+	if err := checkCollations(ctx, m.dest, tables, state.Report); err != nil {
+		return err
+	}
+	// pgcrypto may be among the extensions the run creates
+	if !createsExtension(exts, opts, "pgcrypto") {
+		if err := checkPgcrypto(ctx, m.dest, tables); err != nil {
+			return err
+		}
+	}
+	skip, merge, err := checkReservedTables(ctx, m.dest, tables, opts.Config, state.Report)
+	if err != nil {
+		return err
+	}
+	if err := checkForeignTables(ctx, m.dest, tables, opts, state.Report); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if opts.Mode == modeSync {
+		synced, err := syncTables(ctx, m.dest, tables, skip, state.Report)
+		if err != nil {
+			return err
+		}
+		if merge == nil {
+			merge = map[string]bool{}
+		}
+		for name := range synced {
+			merge[name] = true
+		}
+	}
+	// Skipped tables are left out of the run as if the source lacked them
+	tables = withoutTables(tables, skip)
+	state.AllTables = tables
+	state.Tables = tables
+	state.matViews = matviews
+	state.enums = enums
+	state.domains = domains
+	state.composites = composites
+	state.extensions = exts
+	state.functions = functions
+	state.triggers = triggers
+	state.policies = policies
+	state.rowSecurity = secured
+	state.Merge = merge
+	return nil
+}
+
+// ReleaseSourceLock ends the --lock-source-schema transaction taken by the
+// introspect phase. Migrate calls it when it returns; code running the
+// phases itself calls it once it is done with the source.
+func (m *Migrator) ReleaseSourceLock() {
+	if m.sourceLock != nil {
+		m.sourceLock.Close(context.Background())
+		m.sourceLock = nil
+	}
+}
+
+// Plan selects the tables of the run, checks them, estimates the source
+// reads and decides per table how it is created and loaded.
+func (m *Migrator) Plan(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhasePlan, state, m.plan)
+}
+
+func (m *Migrator) plan(ctx context.Context, state *MigrationState) error {
+	opts, cp, report := m.opts, state.Checkpoint, state.Report
+	tables := state.Tables
+	var err error
+	if len(opts.Only) > 0 {
+		tables, err = selectTables(tables, opts.Only)
+		if err != nil {
+			return err
+		}
+		report.Only = opts.Only
+		fmt.Printf("Partial run: only %s\n", strings.Join(opts.Only, ", "))
+		if !opts.Resume {
+			for _, t := range tables {
+				cp.reset(t.Name)
+			}
+		}
+	}
+	warnSchemaGaps(tables, report)
+	if err := checkEncryptionKey(opts.Config, opts.EncryptionKey); err != nil {
+		return err
+	}
+	if err := checkPartitionOutliers(ctx, m.source, tables, opts, cp); err != nil {
+		return err
+	}
+	if err := checkIdentifiers(tables, opts, cp.RunID, report); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if !opts.DataOnly {
+		// A merged table's definition is not the migration's to change
+		refs, err := missingReferences(withoutTables(tables, state.Merge), state.AllTables, opts.OnMissingRef)
+		report.MissingReferences = refs
+		if err != nil {
+			return &SchemaError{Err: err}
+		}
+	}
+
+	estimate, err := estimateReads(ctx, m.source, tables, cp)
+	if err != nil {
+		return err
+	}
+	report.Estimate = estimate
+	m.env.status.planned(cp.RunID, estimate, opts.MaxReadBytes)
+	estimate.print(opts.PlanLimit)
+	if opts.MaxReadBytes > 0 && estimate.Bytes > opts.MaxReadBytes {
+		report.warn(warnReadLimit, "estimated source reads (%s) exceed --max-read-bytes (%s); the run will stop at a table boundary once the limit is reached",
+			formatBytes(estimate.Bytes), formatBytes(opts.MaxReadBytes))
+	}
+	if opts.DryRun && opts.DDLOut == "" {
+		state.Tables = tables
+		if !opts.DataOnly {
+			if err := checkCascadeDrops(ctx, m.dest, state, keptTables(tables, opts, cp, state.Merge), opts); err != nil {
+				return &SchemaError{Err: err}
+			}
+		}
+		return nil
+	}
+
+	resetStaleSplits(tables, opts, cp)
+	resetStaleKeysets(tables, opts.ChunkSize, cp)
+	tables = orderByInheritance(tables)
+	invalidateInheritedChildren(tables, cp)
+
+	keep := keptTables(tables, opts, cp, state.Merge)
+
+	var diffPlan map[string]bool
+	if opts.Differential {
+		fmt.Println("Planning differential copy...")
+		diffPlan, err = planDifferential(ctx, m.dest, tables)
+		if err != nil {
+			return err
+		}
+		for name := range diffPlan {
+			keep[name] = true
+		}
+	}
+	var incremental map[string]*Watermark
+	if opts.Incremental {
+		fmt.Println("Planning incremental copy...")
+		incremental, err = planIncremental(ctx, m.dest, tables, opts, cp, report)
+		if err != nil {
+			return err
+		}
+		for name := range incremental {
+			keep[name] = true
+		}
+	}
+
+	// Kept tables that still receive data may be narrower than the source
+	project := map[string]bool{}
+	for name := range keep {
+		if !cp.completed(name) {
+			project[name] = true
+		}
+	}
+	if opts.DestSchemaFile != "" {
+		if err := applyDestSchemaFile(ctx, m.dest, opts.DestSchemaFile, tables); err != nil {
+			return err
+		}
+	}
+	if err := projectExisting(ctx, m.dest, tables, project, report); err != nil {
+		return err
+	}
+	// Recreated tables lose their triggers; kept ones fire them per row
+	var loaded []Table
+	for _, t := range tables {
+		if project[t.Name] {
+			loaded = append(loaded, t)
+		}
+	}
+	hooks, err := checkLoadHooks(ctx, m.dest, loaded, opts, report)
+	if err != nil {
+		return err
+	}
+	state.loadHooks = hooks
+
+	if opts.OrderedCopy {
+		fmt.Println("Planning read order...")
+		if err := planOrdering(tables, opts.Config); err != nil {
+			return err
+		}
+	}
+
+	// Merged tables, and the changed rows of incremental ones, are upserted
+	// even without --upsert
+	upsertTables := tables
+	if !opts.Upsert {
+		upsertTables = nil
+		for _, t := range tables {
+			if state.Merge[t.Name] || incremental[t.Name] != nil {
+				upsertTables = append(upsertTables, t)
+			}
+		}
+	}
+	var upserts map[string]*conflictStrategy
+	if len(upsertTables) > 0 {
+		upserts, err = planUpserts(ctx, m.dest, upsertTables, opts.Config, diffPlan)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.Tables, state.Keep, state.DiffPlan, state.upserts, state.Incremental = tables, keep, diffPlan, upserts, incremental
+	if !opts.DataOnly {
+		if err := checkCascadeDrops(ctx, m.dest, state, keep, opts); err != nil {
+			return &SchemaError{Err: err}
+		}
+	}
+	return nil
+}
+
+// keptTables returns the tables kept as they are on the destination: all of
+// them with --data-only, and otherwise those finished or partly copied by an
+// earlier run and the merged ones.
+func keptTables(tables []Table, opts Options, cp *Checkpoint, merge map[string]bool) map[string]bool {
+	keep := map[string]bool{}
+	for _, t := range tables {
+		if opts.DataOnly || cp.completed(t.Name) || cp.partial(t.Name) || merge[t.Name] {
+			keep[t.Name] = true
+		}
+	}
+	return keep
+}
+
+// CreateSchema recreates the tables that are not kept and records the
+// migrated schema for verify-schema. For --only it first detaches foreign
+// keys of other tables that reference the selected ones. With --on-failure
+// cleanup (the default) the detaching and the table statements run in one
+// destination transaction, so a failure rolls them back and leaves the old
+// tables in place instead of a mixture of old and empty new ones.
+func (m *Migrator) CreateSchema(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseCreateSchema, state, m.createSchema)
+}
+
+func (m *Migrator) createSchema(ctx context.Context, state *MigrationState) error {
+	opts := m.opts
+	if !opts.DataOnly {
+		fmt.Println("Creating schema on destination...")
+		if err := createSchemaObjects(ctx, m.dest, state, opts); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	// A dry run executes nothing, so it has nothing to roll back
+	dest := m.dest
+	var tx pgx.Tx
+	if opts.OnFailure == onFailureCleanup && m.recorder == nil && m.destConn != nil {
+		var err error
+		if tx, err = m.destConn.Begin(ctx); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+		dest = tx
+	}
+	var created []string
+	err := func() error {
+		if len(opts.Only) > 0 {
+			fks, err := detachForeignKeys(ctx, dest, state.Tables)
+			if err != nil {
+				return err
+			}
+			state.detached = fks
+		}
+		if opts.DataOnly {
+			return nil
+		}
+		var err error
+		if created, err = createTables(ctx, dest, state, opts); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+		return nil
+	}()
+	if tx != nil {
+		if err == nil {
+			err = tx.Commit(ctx)
+		} else {
+			tx.Rollback(context.WithoutCancel(ctx))
+		}
+		// The rollback restored the detached foreign keys and what the drops
+		// removed too
+		if err != nil {
+			state.detached = nil
+			state.Report.CascadeDropped = nil
+		}
+	}
+	if err != nil {
+		failure := &SchemaFailure{OnFailure: opts.OnFailure, RolledBack: tx != nil}
+		if tx == nil {
+			failure.Created = created
+		}
+		state.Report.SchemaFailure = failure
+		return fmt.Errorf("%w; %s", err, failure.describe())
+	}
+	if !opts.DataOnly {
+		fmt.Println("Schema created.")
+	}
+
+	// A recorded schema does not exist yet
+	if opts.SchemaSnapshotPath != "" && m.recorder == nil {
+		if err := writeSchemaSnapshot(opts.SchemaSnapshotPath, destinationTables(mergeTables(state.AllTables, state.Tables))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy transfers the data of every table in the state.
+func (m *Migrator) Copy(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseCopy, state, m.copy)
+}
+
+func (m *Migrator) copy(ctx context.Context, state *MigrationState) (err error) {
+	if m.sources.primary == nil || m.destConn == nil {
+		return fmt.Errorf("the copy phase needs database connections")
+	}
+	if err := m.checkPooler(ctx, state.Report); err != nil {
+		return err
+	}
+	if m.opts.DisableDestTriggers && len(state.loadHooks) > 0 {
+		// Re-enabled whatever happens to the copy, including cancellation
+		defer func() {
+			if rerr := enableLoadHooks(context.WithoutCancel(ctx), m.dest, state.loadHooks, state.Report); rerr != nil {
+				err = errors.Join(err, rerr)
+			}
+		}()
+		if err := disableLoadHooks(ctx, m.dest, state.loadHooks); err != nil {
+			return err
+		}
+	}
+	if err := prepareUUIDKeys(ctx, m.source, m.destConn, state.AllTables); err != nil {
+		return err
+	}
+	var start *SourcePosition
+	if m.opts.ConsistentSnapshot {
+		if start, err = m.sources.pinSnapshot(ctx); err != nil {
+			return err
+		}
+		// Ended when the copy is done, or failed
+		defer func() {
+			if uerr := m.sources.unpinSnapshot(context.WithoutCancel(ctx)); uerr != nil {
+				err = errors.Join(err, uerr)
+			}
+		}()
+		fmt.Printf("Reading the source in snapshot %s (started %s", start.SnapshotID, start.At.Format(time.RFC3339))
+		if start.LSN != "" {
+			fmt.Printf(", LSN %s", start.LSN)
+		}
+		fmt.Println(")")
+		if m.opts.Resume {
+			warnSnapshotResumed(state.Tables, state.Checkpoint, state.Report)
+		}
+	} else if start, err = readSourcePosition(ctx, m.source); err != nil {
+		return err
+	}
+	state.Report.SourcePosition = &SourceReadPositions{Start: start}
+	fmt.Println("Starting data transfer...")
+	defer state.Report.setDestinations(state.Tables)
+	wal := startWALMonitor(ctx, m.destConn, m.opts.MaxWALRate, state.Report)
+	defer func() { state.Report.WAL = wal.stop() }()
+	if err := copyData(ctx, m.sources, m.destConn, m.reconnectDest, state.Tables, m.opts, state.Checkpoint, state.Report, state.DiffPlan, state.upserts, state.Incremental, wal); err != nil {
+		var ce *CopyError
+		if errors.As(err, &ce) {
+			m.env.reporter.TableFinished(ce.Table, tableStatusFailed, 0)
+		}
+		return fmt.Errorf("failed to copy data: %w", err)
+	}
+	// The end position is read outside the snapshot, which would see the
+	// source as it was at the start
+	if err := m.sources.unpinSnapshot(ctx); err != nil {
+		return err
+	}
+	if state.Report.SourcePosition.End, err = readSourcePosition(ctx, m.source); err != nil {
+		return err
+	}
+	if m.opts.SchemaSnapshotPath != "" && m.recorder == nil {
+		if err := recordSourcePosition(m.opts.SchemaSnapshotPath, state.Report.SourcePosition); err != nil {
+			return err
+		}
+	}
+	return dropUUIDMaps(ctx, m.dest, state.AllTables)
+}
+
+// reconnectDest replaces the lost destination connection of the copy phase,
+// also for the phases after it, and takes the destination lock again, unless
+// the destination is behind a transaction pooler, where no lock is held.
+func (m *Migrator) reconnectDest(ctx context.Context) (CopyConn, error) {
+	old := m.destConn
+	if old.Config() == nil {
+		return old, onEndpoint(endpointDestination, fmt.Errorf("the destination connection cannot be dialled again"))
+	}
+	conn, err := pgx.ConnectConfig(ctx, old.Config())
+	if err != nil {
+		return old, onEndpoint(endpointDestination, withSentinel(ErrConnect, fmt.Errorf("failed to reconnect to the destination: %w", err)))
+	}
+	if !m.env.batched {
+		if err := lockDestination(ctx, conn); err != nil {
+			conn.Close(context.Background())
+			return old, err
+		}
+	}
+	if m.dest == old {
+		m.dest = conn
+	}
+	m.destConn = conn
+	m.replaced = append(m.replaced, conn)
+	return conn, nil
+}
+
+func (m *Migrator) closeReplaced() {
+	for _, conn := range m.replaced {
+		conn.Close(context.Background())
+	}
+	m.replaced = nil
+}
+
+// Constraints creates the source foreign keys missing on the destination
+// and restores the ones detached by the create-schema phase, checking each
+// for violating rows first (see --on-fk-violation).
+func (m *Migrator) Constraints(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseConstraints, state, m.constraints)
+}
+
+func (m *Migrator) constraints(ctx context.Context, state *MigrationState) error {
+	var fks []foreignKey
+	// --data-only leaves the destination definitions alone
+	if !m.opts.DataOnly {
+		existing, err := destinationForeignKeys(ctx, m.dest)
+		if err != nil {
+			return err
+		}
+		if m.recorder != nil {
+			// The recorded DROP ... CASCADE removes the keys of every
+			// recreated table, as it would in a real run
+			for _, t := range state.Tables {
+				if state.Keep[t.Name] {
+					continue
+				}
+				for key := range existing {
+					if strings.HasPrefix(key, t.qualifiedDestName()+".") {
+						delete(existing, key)
+					}
+				}
+			}
+		}
+		// A merged table's definition is not the migration's to change
+		fks, err = m.plannedForeignKeys(ctx, withoutTables(state.Tables, state.Merge), mergeTables(state.AllTables, state.Tables), existing, state.Report)
+		if err != nil {
+			return err
+		}
+	}
+	planned := len(fks)
+	fks = append(fks, state.detached...)
+	if len(fks) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Creating %d foreign key(s)...\n", len(fks))
+	var violated []string
+	// Detached keys that could not be created are left for Migrate to
+	// restore NOT VALID, so they are not lost
+	var unrestored []foreignKey
+	for i, fk := range fks {
+		cr, err := addForeignKey(ctx, m.dest, fk, m.opts.OnFKViolation, state.Report)
+		if err != nil {
+			if i >= planned {
+				state.detached = append(unrestored, fks[i:]...)
+			}
+			return &SchemaError{Table: fk.Table, Err: err}
+		}
+		state.Report.Constraints = append(state.Report.Constraints, cr)
+		if cr.Status == constraintViolated {
+			violated = append(violated, fmt.Sprintf("%s on %s (%d rows)", fk.Name, fk.Table, cr.Violations))
+			if i >= planned {
+				unrestored = append(unrestored, fk)
+			}
+		}
+	}
+	state.detached = unrestored
+
+	var notValidated []string
+	for _, cr := range state.Report.Constraints {
+		if cr.Status != constraintValidated {
+			notValidated = append(notValidated, fmt.Sprintf("%s on %s: %s", cr.Name, cr.Table, cr.Status))
+		}
+	}
+	if len(notValidated) > 0 {
+		fmt.Println("Foreign keys not created validated:")
+		for _, s := range notValidated {
+			fmt.Printf("  %s\n", s)
+		}
+	}
+	if len(violated) > 0 {
+		return &VerificationError{Err: fmt.Errorf("rows violate foreign key(s) %s; fix the data or choose another --on-fk-violation", strings.Join(violated, ", "))}
+	}
+	return nil
+}
+
+// Verify compares the tables recreated by this run with the destination and
+// records differences as warnings. Kept tables are skipped, since their
+// destination definition may legitimately differ. It also records the
+// database summary (see summarizeDatabases) and runs the smoke checks of
+// the config.
+func (m *Migrator) Verify(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseVerify, state, m.verify)
+}
+
+func (m *Migrator) verify(ctx context.Context, state *MigrationState) error {
+	var matviews int64
+	for _, mr := range state.Report.MatViews {
+		if mr.Status != matviewSkipped {
+			matviews++
+		}
+	}
+	summary, err := summarizeDatabases(ctx, m.source, m.dest, state.Tables, state.AllTables, state.Keep, matviews)
+	if err != nil {
+		return err
+	}
+	summary.print()
+	for _, w := range summary.warnings() {
+		state.Report.warn(warnSummaryMismatch, "%s", w)
+	}
+	state.Report.Summary = summary
+	refs, err := checkReferences(ctx, m.dest, withoutTables(state.Tables, state.Merge), mergeTables(state.AllTables, state.Tables), m.opts)
+	if err != nil {
+		return err
+	}
+	printReferences(refs)
+	for _, rc := range refs {
+		if rc.Orphans > 0 {
+			state.Report.warnTable(warnOrphanedReferences, rc.Table, "%d row(s) of %s reference missing rows of %s through %s (constraint %s), e.g. %s",
+				rc.Orphans, rc.Table, rc.RefTable, rc.Name, rc.Constraint, formatSamples(rc.SampleKeys))
+		}
+	}
+	state.Report.References = refs
+	// Failed checks fail the phase once the schema is checked as well
+	smokeErr := runSmokeChecks(ctx, m.source, m.dest, m.opts.Config.smokeChecks(), state.Report)
+
+	var expected []Table
+	for _, t := range state.Tables {
+		if !state.Keep[t.Name] {
+			expected = append(expected, onDestination(t))
+		}
+	}
+	if len(expected) == 0 {
+		return smokeErr
+	}
+	actual, err := introspectSchemas(ctx, m.dest, tableSchemas(expected))
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	diffs := diffSchemas(expected, actual)
+	for _, d := range diffs {
+		name := d.Table
+		if d.Column != "" {
+			name += "." + d.Column
+		}
+		state.Report.warnTable(warnSchemaCheck, d.Table, "schema check: %s on %s (expected %q, got %q)", d.Kind, name, d.Expected, d.Actual)
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("Verified the schema of %d table(s).\n", len(expected))
+	}
+	return smokeErr
+}
@@ -0,0 +1,186 @@
+package migrate
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyPhaseWithFakeConnections(t *testing.T) {
+	source := &fakeConn{results: []fakeResult{
+		{match: "txid_current_snapshot()", rows: [][]any{{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "10:10:"}}},
+		{match: "SELECT count(*)", rows: [][]any{{int64(2)}}},
+		{match: `SELECT "id", "name" FROM`, rows: [][]any{{int64(1), "Ada"}, {int64(2), nil}}},
+	}}
+	dest := &fakeConn{}
+
+	opts := Options{CopyMethod: copyMethodRows}
+	m := NewMigrator(&SourceConn{conn: source}, nil, dest, opts)
+	state := &MigrationState{
+		Checkpoint: newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json")),
+		Report:     newReport(false),
+	}
+	state.Tables = []Table{{
+		Name:    "users",
+		Columns: []Column{{Name: "id", DataType: "bigint"}, {Name: "name", DataType: "text"}},
+	}}
+	state.AllTables = state.Tables
+
+	if err := m.Copy(context.Background(), state); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+
+	rows := dest.copied[`"users"`]
+	if len(rows) != 2 || rows[0][1] != "Ada" || rows[1][1] != nil {
+		t.Fatalf("copied rows = %v, want the two source rows", rows)
+	}
+	if tc := state.Checkpoint.Tables["users"]; tc == nil || !tc.Completed || tc.RowsCopied != 2 {
+		t.Errorf("checkpoint = %+v, want users completed with 2 rows", tc)
+	}
+	if len(state.Report.Tables) != 1 || state.Report.Tables[0].Method != copyMethodRows {
+		t.Errorf("report tables = %+v, want users copied row by row", state.Report.Tables)
+	}
+	if source.ran("INSERT") || source.ran("COPY") {
+		t.Error("the copy wrote to the source")
+	}
+}
+
+// TestCopyKeepsSourceTimestamps copies a table whose created_at defaults to
+// now() down every write path: each one must name created_at and write the
+// source value, so the destination default never fires.
+func TestCopyKeepsSourceTimestamps(t *testing.T) {
+	created := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	now := "now()"
+	table := Table{Name: "events", Columns: []Column{
+		{Name: "id", DataType: "bigint"},
+		{Name: "created_at", DataType: "timestamp with time zone", Default: &now},
+		{Name: "note", DataType: "text"},
+	}}
+	encrypted := table
+	encrypted.Columns = append([]Column(nil), table.Columns...)
+	encrypted.Columns[2].Encrypt = encryptPgcrypto
+
+	for _, tt := range []struct {
+		name    string
+		table   Table
+		opts    Options
+		upserts map[string]*conflictStrategy
+		into    string
+		insert  string
+	}{
+		{name: "copy", table: table, opts: Options{CopyMethod: copyMethodRows}, into: `"events"`},
+		{name: "truncate", table: table, opts: Options{CopyMethod: copyMethodRows, DataOnly: true}, into: `"events"`},
+		{
+			name:    "upsert",
+			table:   table,
+			opts:    Options{CopyMethod: copyMethodRows, DataOnly: true, Upsert: true},
+			upserts: map[string]*conflictStrategy{"events": {columns: []string{"id"}, update: []string{"created_at", "note"}}},
+			into:    `"_farewall"."`,
+			insert:  `INSERT INTO "events" ("id", "created_at", "note") OVERRIDING SYSTEM VALUE SELECT "id", "created_at", "note" FROM`,
+		},
+		{
+			name:   "staging",
+			table:  encrypted,
+			opts:   Options{CopyMethod: copyMethodRows, EncryptionKey: "secret"},
+			into:   `"_farewall"."`,
+			insert: `INSERT INTO "events" ("id", "created_at", "note") OVERRIDING SYSTEM VALUE SELECT "id", "created_at", pgp_sym_encrypt("note", $1) FROM`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fakeConn{results: []fakeResult{
+				{match: "txid_current_snapshot()", rows: [][]any{{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "10:10:"}}},
+				{match: "SELECT count(*)", rows: [][]any{{int64(1)}}},
+				{match: `SELECT "id", "created_at", "note" FROM`, rows: [][]any{{int64(1), created, "first"}}},
+			}}
+			dest := &fakeConn{}
+			m := NewMigrator(&SourceConn{conn: source}, nil, dest, tt.opts)
+			state := &MigrationState{
+				Checkpoint: newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json")),
+				Report:     newReport(false),
+				upserts:    tt.upserts,
+			}
+			state.Tables = []Table{tt.table}
+			state.AllTables = state.Tables
+			if err := m.Copy(context.Background(), state); err != nil {
+				t.Fatalf("Copy: %v", err)
+			}
+
+			var rows [][]any
+			for into, r := range dest.copied {
+				if strings.HasPrefix(into, tt.into) {
+					rows = append(rows, r...)
+				}
+			}
+			if len(rows) != 1 || len(rows[0]) != 3 || rows[0][1] != created {
+				t.Fatalf("rows written to %s = %v, want created_at %v", tt.into, rows, created)
+			}
+			if tt.insert != "" && !dest.ran(tt.insert) {
+				t.Errorf("%s was not run; ran %q", tt.insert, dest.queries)
+			}
+		})
+	}
+}
+
+// TestCopySkipsGeneratedColumn copies a table with a generated column in
+// the middle of its columns: the table is created with it in place, and the
+// copy reads and writes the columns on either side of it by name.
+func TestCopySkipsGeneratedColumn(t *testing.T) {
+	table := Table{Name: "orders", Columns: []Column{
+		{Name: "id", DataType: "bigint"},
+		{Name: "price", DataType: "numeric"},
+		{Name: "qty", DataType: "integer"},
+		{Name: "total", DataType: "numeric", Generated: "price * qty"},
+		{Name: "note", DataType: "text"},
+	}}
+	want := `CREATE TABLE "orders" ("id" bigint, "price" numeric, "qty" integer, "total" numeric GENERATED ALWAYS AS (price * qty) STORED, "note" text)`
+	if ddl := tableDDL(table, nil, ""); ddl[0] != want {
+		t.Errorf("DDL:\n got %s\nwant %s", ddl[0], want)
+	}
+
+	source := &fakeConn{results: []fakeResult{
+		{match: "txid_current_snapshot()", rows: [][]any{{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "10:10:"}}},
+		{match: "SELECT count(*)", rows: [][]any{{int64(1)}}},
+		{match: `SELECT "id", "price", "qty", "note" FROM`, rows: [][]any{{int64(1), "2.50", int32(4), "gift"}}},
+	}}
+	dest := &fakeConn{}
+	m := NewMigrator(&SourceConn{conn: source}, nil, dest, Options{CopyMethod: copyMethodRows})
+	state := &MigrationState{
+		Checkpoint: newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json")),
+		Report:     newReport(false),
+	}
+	state.Tables = []Table{table}
+	state.AllTables = state.Tables
+	if err := m.Copy(context.Background(), state); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if rows := dest.copied[`"orders"`]; len(rows) != 1 || len(rows[0]) != 4 || rows[0][3] != "gift" {
+		t.Errorf("copied rows = %v, want id, price, qty and note", rows)
+	}
+	if len(state.Tables[0].Columns) != 5 {
+		t.Error("the copy dropped the generated column from the table of the state")
+	}
+}
+
+func TestMigratorsKeepTheirOwnRun(t *testing.T) {
+	limited := NewMigrator(&SourceConn{conn: &fakeConn{}}, nil, &fakeConn{}, Options{SourceConnectionLimit: 2, Debug: true, Reporter: nopReporter{}})
+	other := NewMigrator(&SourceConn{conn: &fakeConn{}}, nil, &fakeConn{}, Options{})
+	limited.setPooler(&PoolerReport{})
+
+	if limited.env == other.env || limited.env.slots == other.env.slots || limited.env.control == other.env.control {
+		t.Fatal("the Migrators share their run")
+	}
+	if !limited.env.batched || other.env.batched {
+		t.Errorf("batched = %v, %v; want only the pooled Migrator batched", limited.env.batched, other.env.batched)
+	}
+	if !limited.env.debug || other.env.debug {
+		t.Errorf("debug = %v, %v; want only the --debug Migrator logging", limited.env.debug, other.env.debug)
+	}
+	if limited.env.slots.spare() != 1 || other.env.slots.spare() == 1 {
+		t.Errorf("spare slots = %d, %d; want the limit of 2 on the first Migrator only", limited.env.slots.spare(), other.env.slots.spare())
+	}
+	if runOf(withRun(context.Background(), other.env)) != other.env || runOf(context.Background()) != noRun {
+		t.Error("runOf does not return the run of the context")
+	}
+}
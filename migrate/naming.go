@@ -0,0 +1,722 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	renameKindTable      = "table"
+	renameKindColumn     = "column"
+	renameKindConstraint = "constraint"
+
+	renameReasonConfig    = "rename_to"
+	renameReasonFold      = "fold"
+	renameReasonCollision = "collision_suffix"
+)
+
+// IdentifierRename records a destination object created under another name
+// than it has on the source.
+type IdentifierRename struct {
+	Kind string `json:"kind"`
+	// Table is the source table of a column or constraint
+	Table       string `json:"table,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Reason      string `json:"reason"`
+}
+
+// Table and Column keep their source names, which also key the config,
+// the checkpoint and the report. DestName is set when the destination
+// object is named differently. Tables of other source schemas than public
+// are named schema.table (see sourceTableKey), so tables of the same name
+// in two schemas keep apart.
+
+func (t Table) destName() string {
+	if t.DestName != "" {
+		return t.DestName
+	}
+	return t.baseName()
+}
+
+// sourceTableKey names the source table name of schema: name itself in
+// public, schema.name elsewhere.
+func sourceTableKey(schema, name string) string {
+	if schema == "" || schema == defaultSchema {
+		return name
+	}
+	return schema + "." + name
+}
+
+// sourceKeySQL is sourceTableKey in SQL, for the table c in namespace n.
+const sourceKeySQL = "CASE WHEN n.nspname = 'public' THEN c.relname::text ELSE n.nspname || '.' || c.relname END"
+
+// baseName is the name of t within its schema, without the schema that
+// sourceTableKey adds.
+func (t Table) baseName() string {
+	if t.Schema == "" || t.Schema == defaultSchema {
+		return t.Name
+	}
+	return strings.TrimPrefix(t.Name, t.Schema+".")
+}
+
+func (t Table) sourceSchema() string {
+	if t.Schema == "" {
+		return defaultSchema
+	}
+	return t.Schema
+}
+
+// sourceIdent quotes the source table of t, qualified by its schema unless
+// that is public.
+func sourceIdent(t Table) string {
+	return schemaIdent(t.Schema, t.baseName())
+}
+
+// keyIdent quotes the source table of the key sourceTableKey built, given
+// the source schemas.
+func keyIdent(key string, schemas []string) string {
+	for _, s := range schemas {
+		if s != defaultSchema && strings.HasPrefix(key, s+".") {
+			return sqlutil.QualifiedIdent(s, strings.TrimPrefix(key, s+"."))
+		}
+	}
+	return sqlutil.QuoteIdent(key)
+}
+
+// qualifyTables gives the tables introspected from the source schema their
+// keys, and the same to the tables they name.
+func qualifyTables(tables []Table, schema string) {
+	for i := range tables {
+		t := &tables[i]
+		t.Name = sourceTableKey(schema, t.Name)
+		for j, p := range t.Inherits {
+			t.Inherits[j] = sourceTableKey(schema, p)
+		}
+		if t.PartitionOf != "" {
+			t.PartitionOf = sourceTableKey(schema, t.PartitionOf)
+		}
+		for j := range t.ForeignKeys {
+			fk := &t.ForeignKeys[j]
+			refSchema := schema
+			if fk.RefSchema != "" {
+				refSchema = fk.RefSchema
+			}
+			fk.Table, fk.RefTable, fk.RefSchema = t.Name, sourceTableKey(refSchema, fk.RefTable), ""
+		}
+	}
+}
+
+func (c Column) destName() string {
+	if c.DestName != "" {
+		return c.DestName
+	}
+	return c.Name
+}
+
+// destColumn returns the destination name of the source column name.
+func (t Table) destColumn(name string) string {
+	if c, ok := t.column(name); ok {
+		return c.destName()
+	}
+	return name
+}
+
+func (t Table) destColumns(names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = t.destColumn(n)
+	}
+	return out
+}
+
+// columnByDest looks a column up by its destination name.
+func (t Table) columnByDest(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.destName() == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// defaultSchema holds every table that no schema route sends elsewhere.
+const defaultSchema = "public"
+
+func (t Table) destSchema() string {
+	if t.DestSchema != "" {
+		return t.DestSchema
+	}
+	return defaultSchema
+}
+
+// qualifiedName is schema.name of a table as read, qualifiedDestName that
+// of its destination table. Reports and verification use these.
+func (t Table) qualifiedName() string {
+	if t.Schema == "" {
+		return defaultSchema + "." + t.Name
+	}
+	return t.Schema + "." + t.baseName()
+}
+
+func (t Table) qualifiedDestName() string {
+	return t.destSchema() + "." + t.destName()
+}
+
+// schemaIdent quotes name, qualified by schema unless that is public.
+// Tables in public stay unqualified so the emitted DDL reads as before.
+func schemaIdent(schema, name string) string {
+	if schema == "" || schema == defaultSchema {
+		return sqlutil.QuoteIdent(name)
+	}
+	return sqlutil.QualifiedIdent(schema, name)
+}
+
+func destIdent(t Table) string {
+	return schemaIdent(t.DestSchema, t.destName())
+}
+
+// destIdentifier is destIdent for CopyFrom.
+func destIdentifier(t Table) pgx.Identifier {
+	if t.DestSchema == "" {
+		return pgx.Identifier{t.destName()}
+	}
+	return pgx.Identifier{t.DestSchema, t.destName()}
+}
+
+// tableSchemas returns the schemas of tables, each once, sorted.
+func tableSchemas(tables []Table) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range tables {
+		schema := t.Schema
+		if schema == "" {
+			schema = defaultSchema
+		}
+		if !seen[schema] {
+			seen[schema] = true
+			out = append(out, schema)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// distinctSchemas returns schemas, each once, sorted, with public for an
+// empty name.
+func distinctSchemas(schemas []string) []string {
+	out := make([]string, 0, len(schemas))
+	for _, s := range schemas {
+		if s == "" {
+			s = defaultSchema
+		}
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// destFromClause is fromClause for the destination table of t.
+func destFromClause(t Table) string {
+	if t.HasChildren {
+		return sqlutil.Only(destIdent(t))
+	}
+	return destIdent(t)
+}
+
+// onDestination returns t as it is created on the destination, with every
+// name replaced by its destination name and Schema set to its destination
+// schema.
+func onDestination(t Table) Table {
+	d := t
+	d.Schema, d.Name, d.DestName = t.destSchema(), t.destName(), ""
+	d.Columns = make([]Column, len(t.Columns))
+	for i, c := range t.Columns {
+		c.Name, c.DestName = c.destName(), ""
+		d.Columns[i] = c
+	}
+	d.PrimaryKey = t.destColumns(t.PrimaryKey)
+	if t.destInherits != nil {
+		d.Inherits = t.destInherits
+	}
+	if t.destPartitionOf != "" {
+		d.PartitionOf = t.destPartitionOf
+	}
+	return d
+}
+
+func destinationTables(tables []Table) []Table {
+	out := make([]Table, len(tables))
+	for i, t := range tables {
+		out[i] = onDestination(t)
+	}
+	return out
+}
+
+// foldIdentifier is the name PostgreSQL would give an unquoted identifier.
+func foldIdentifier(name string) string {
+	return strings.ToLower(name)
+}
+
+// applyNames sets the destination names of every table, column and foreign
+// key from rename_to and rename_constraints in the config, then folds the
+// remaining names to lower case with fold. Destination schemas come from
+// schema_routes; a table that no route sends elsewhere goes to the schema
+// its source schema is mapped to, or else to the schema of the same name.
+func applyNames(tables []Table, cfg *Config, schemas schemaMap, fold bool) {
+	name := func(source, renameTo string) string {
+		switch {
+		case renameTo != "":
+			return renameTo
+		case fold:
+			return foldIdentifier(source)
+		}
+		return source
+	}
+
+	for i := range tables {
+		t := &tables[i]
+		tc := cfg.table(t.Name)
+		t.DestName = name(t.baseName(), tc.RenameTo)
+		schema, routed := cfg.routeSchema(t.Name)
+		if !routed {
+			schema = schemas.destination(t.sourceSchema())
+		}
+		t.DestSchema = schema
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			c.DestName = name(c.Name, tc.Columns[c.Name].RenameTo)
+		}
+		for j := range t.ForeignKeys {
+			fk := &t.ForeignKeys[j]
+			fk.destName = name(fk.Name, tc.RenameConstraints[fk.Name])
+		}
+	}
+	resolveInherits(tables)
+}
+
+// mapSchemaReferences rewrites the references to their own schema in the
+// defaults, generated columns, checks and indexes of the tables of a schema
+// mapped with --schema-map, e.g. nextval('sales.orders_id_seq'::regclass).
+// References to other schemas are left alone.
+func mapSchemaReferences(tables []Table, schemas schemaMap) {
+	for i := range tables {
+		t := &tables[i]
+		dest, ok := schemas[t.sourceSchema()]
+		if !ok || dest == t.sourceSchema() {
+			continue
+		}
+		rewrite := schemaQualifier(t.sourceSchema())
+		with := "${1}" + strings.ReplaceAll(sqlutil.QuoteIdent(dest), "$", "$$") + "."
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			if c.Default != nil {
+				d := rewrite.ReplaceAllString(*c.Default, with)
+				c.Default = &d
+			}
+			c.Generated = rewrite.ReplaceAllString(c.Generated, with)
+		}
+		for j := range t.Checks {
+			t.Checks[j].Definition = rewrite.ReplaceAllString(t.Checks[j].Definition, with)
+		}
+		for j := range t.Indexes {
+			t.Indexes[j].Definition = rewrite.ReplaceAllString(t.Indexes[j].Definition, with)
+		}
+	}
+}
+
+// mapObjectSchemas gives the enum types, domains, composite types and
+// functions the destination schema of their source schema, as applyNames
+// does for tables. In a schema mapped elsewhere, references to their own
+// schema are rewritten as mapSchemaReferences does, and the columns of
+// tables using one of these types get it qualified by its new schema.
+func mapObjectSchemas(tables []Table, enums []enumType, domains []domainType, composites []compositeType, functions []function, schemas schemaMap) {
+	rewrite := func(schema, dest, s string) string {
+		if destSchemaName(dest) == schema {
+			return s
+		}
+		return schemaQualifier(schema).ReplaceAllString(s, "${1}"+strings.ReplaceAll(sqlutil.QuoteIdent(destSchemaName(dest)), "$", "$$")+".")
+	}
+	// moved maps the key of each type whose schema changes to its new one
+	moved := map[string]string{}
+	for i := range enums {
+		e := &enums[i]
+		e.DestSchema = schemas.destination(e.Schema)
+		if destSchemaName(e.DestSchema) != e.Schema {
+			moved[sourceTableKey(e.Schema, e.Name)] = e.DestSchema
+		}
+	}
+	for i := range domains {
+		d := &domains[i]
+		d.DestSchema = schemas.destination(d.Schema)
+		d.BaseType = rewrite(d.Schema, d.DestSchema, d.BaseType)
+		if d.Default != nil {
+			def := rewrite(d.Schema, d.DestSchema, *d.Default)
+			d.Default = &def
+		}
+		for j := range d.Checks {
+			d.Checks[j].Definition = rewrite(d.Schema, d.DestSchema, d.Checks[j].Definition)
+		}
+		if destSchemaName(d.DestSchema) != d.Schema {
+			moved[sourceTableKey(d.Schema, d.Name)] = d.DestSchema
+		}
+	}
+	for i := range composites {
+		ct := &composites[i]
+		ct.DestSchema = schemas.destination(ct.Schema)
+		for j := range ct.Attributes {
+			ct.Attributes[j].Type = rewrite(ct.Schema, ct.DestSchema, ct.Attributes[j].Type)
+		}
+		if destSchemaName(ct.DestSchema) != ct.Schema {
+			moved[sourceTableKey(ct.Schema, ct.Name)] = ct.DestSchema
+		}
+	}
+	for i := range functions {
+		f := &functions[i]
+		f.DestSchema = schemas.destination(f.Schema)
+		f.Definition = rewrite(f.Schema, f.DestSchema, f.Definition)
+	}
+	if len(moved) == 0 {
+		return
+	}
+	for i := range tables {
+		for j := range tables[i].Columns {
+			c := &tables[i].Columns[j]
+			dest, ok := moved[sourceTableKey(c.TypeSchema, c.TypeName)]
+			if !ok {
+				continue
+			}
+			// format_type qualifies a type outside the search path only
+			if qualified := rewrite(c.TypeSchema, dest, c.DataType); qualified != c.DataType {
+				c.DataType = qualified
+			} else {
+				c.DataType = sqlutil.QuoteIdent(destSchemaName(dest)) + "." + c.DataType
+			}
+		}
+	}
+}
+
+// destSchemaName is the schema of a DestSchema that is empty for public.
+func destSchemaName(dest string) string {
+	if dest == "" {
+		return defaultSchema
+	}
+	return dest
+}
+
+// objectSearchPath returns the statement that puts dest ahead of public for
+// the creation of an object from schema, when it moves there, so the names
+// its definition leaves unqualified find the types moved with it.
+func objectSearchPath(schema, dest string) string {
+	if destSchemaName(dest) == schema {
+		return ""
+	}
+	return "SET LOCAL search_path = " + sqlutil.QuoteIdent(destSchemaName(dest)) + ", " + defaultSchema + ";\n"
+}
+
+// schemaQualifier matches schema as the qualifier of a name, bare or
+// quoted, keeping the character before it in the first group.
+func schemaQualifier(schema string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^\w$."])(` + regexp.QuoteMeta(schema) + `|` + regexp.QuoteMeta(sqlutil.QuoteIdent(schema)) + `)\.`)
+}
+
+// resolveInherits maps the INHERITS parents of every table, and the table a
+// partition belongs to, to their destination names.
+func resolveInherits(tables []Table) {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+	for i := range tables {
+		t := &tables[i]
+		t.destInherits, t.destPartitionOf = nil, ""
+		if t.PartitionOf != "" {
+			t.destPartitionOf = t.PartitionOf
+			if pt, ok := byName[t.PartitionOf]; ok {
+				t.destPartitionOf = pt.destName()
+			}
+		}
+		if len(t.Inherits) == 0 {
+			continue
+		}
+		t.destInherits = make([]string, len(t.Inherits))
+		for j, p := range t.Inherits {
+			t.destInherits[j] = p
+			if pt, ok := byName[p]; ok {
+				t.destInherits[j] = pt.destName()
+			}
+		}
+	}
+}
+
+// checkSchemaRoutes fails when an INHERITS child and its parent, or a
+// partition and its partitioned table, are routed to different schemas. The
+// child would be created against a parent that does not exist in its schema.
+func checkSchemaRoutes(tables []Table) error {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+	for _, t := range tables {
+		for _, p := range t.Inherits {
+			if pt, ok := byName[p]; ok && pt.destSchema() != t.destSchema() {
+				return fmt.Errorf("schema_routes send %s to %s but its INHERITS parent %s to %s; route them together or use --flatten-inheritance",
+					t.Name, t.destSchema(), p, pt.destSchema())
+			}
+		}
+		if pt, ok := byName[t.PartitionOf]; ok && pt.destSchema() != t.destSchema() {
+			return fmt.Errorf("schema_routes send partition %s to %s but its table %s to %s; route them together",
+				t.Name, t.destSchema(), pt.Name, pt.destSchema())
+		}
+	}
+	return nil
+}
+
+// collision is a destination name claimed by more than one source object.
+type collision struct {
+	kind  string
+	table string
+	name  string
+	// claims are in the order they are served; the first keeps the name
+	claims []nameClaim
+}
+
+// nameClaim is one source object asking for a destination name. Fixed
+// claims, such as configured partitions, cannot be renamed.
+type nameClaim struct {
+	source, dest string
+	fixed        bool
+	set          func(string)
+}
+
+func (c collision) sources() []string {
+	out := make([]string, len(c.claims))
+	for i, cl := range c.claims {
+		out[i] = cl.source
+	}
+	return out
+}
+
+// findCollisions groups claims by destination name and returns the groups
+// with more than one source. Fixed claims come first, then a source already
+// named like its destination, so those keep the name.
+func findCollisions(kind, table string, claims []nameClaim) []collision {
+	byDest := map[string][]nameClaim{}
+	var order []string
+	for _, c := range claims {
+		if _, ok := byDest[c.dest]; !ok {
+			order = append(order, c.dest)
+		}
+		byDest[c.dest] = append(byDest[c.dest], c)
+	}
+	rank := func(c nameClaim) int {
+		switch {
+		case c.fixed:
+			return 0
+		case c.source == c.dest:
+			return 1
+		}
+		return 2
+	}
+	var out []collision
+	for _, dest := range order {
+		group := byDest[dest]
+		if len(group) < 2 {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool { return rank(group[i]) < rank(group[j]) })
+		out = append(out, collision{kind: kind, table: table, name: dest, claims: group})
+	}
+	return out
+}
+
+// resolveCollision gives every claim of c except the first the name with
+// the lowest free _2, _3, ... suffix. It returns false, renaming nothing,
+// when one of them is fixed.
+func resolveCollision(c collision, taken map[string]bool, report *Report) bool {
+	for _, cl := range c.claims[1:] {
+		if cl.fixed {
+			return false
+		}
+	}
+	for _, cl := range c.claims[1:] {
+		suffixed := c.name
+		for n := 2; taken[suffixed]; n++ {
+			suffixed = suffixedName(c.name, "_"+strconv.Itoa(n))
+		}
+		taken[suffixed] = true
+		cl.set(suffixed)
+		report.Renames = append(report.Renames, IdentifierRename{Kind: c.kind, Table: c.table, Source: cl.source, Destination: suffixed, Reason: renameReasonCollision})
+		fmt.Printf("  Renamed %s %s to %s to avoid a collision\n", c.kind, qualified(c.table, cl.source), suffixed)
+	}
+	return true
+}
+
+func qualified(table, name string) string {
+	if table == "" {
+		return name
+	}
+	return table + "." + name
+}
+
+// checkNameCollisions fails when two source tables of one destination
+// schema, two columns of a table or two foreign keys of a table would get
+// the same destination name, for instance "Users" and "users" with
+// --fold-identifiers. Tables share their namespace with the partitions the
+// tool creates. With
+// --collision-suffix they are resolved instead. Every rename is recorded in the report.
+func checkNameCollisions(tables []Table, opts Options, report *Report) error {
+	var all []collision
+	handle := func(kind, table string, claims []nameClaim) {
+		found := findCollisions(kind, table, claims)
+		if !opts.CollisionSuffix {
+			all = append(all, found...)
+			return
+		}
+		taken := map[string]bool{}
+		for _, cl := range claims {
+			taken[cl.dest] = true
+		}
+		for _, c := range found {
+			if !resolveCollision(c, taken, report) {
+				all = append(all, c)
+			}
+		}
+	}
+
+	// Partitions are created in the schema of their parent
+	tableClaims := map[string][]nameClaim{}
+	for i := range tables {
+		t := &tables[i]
+		schema := t.destSchema()
+		tableClaims[schema] = append(tableClaims[schema], nameClaim{source: t.Name, dest: t.destName(), set: func(n string) { t.DestName = n }})
+		if pc := opts.Config.table(t.Name).PartitionBy; pc != nil {
+			for _, p := range pc.Partitions {
+				tableClaims[schema] = append(tableClaims[schema], nameClaim{source: "partition " + p.Name, dest: physicalName(p.Name), fixed: true})
+			}
+		}
+	}
+	schemas := make([]string, 0, len(tableClaims))
+	for schema := range tableClaims {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	for _, schema := range schemas {
+		handle(renameKindTable, "", tableClaims[schema])
+	}
+
+	for i := range tables {
+		t := &tables[i]
+		var columnClaims []nameClaim
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			columnClaims = append(columnClaims, nameClaim{source: c.Name, dest: c.destName(), set: func(n string) { c.DestName = n }})
+		}
+		handle(renameKindColumn, t.Name, columnClaims)
+
+		var fkClaims []nameClaim
+		for j := range t.ForeignKeys {
+			fk := &t.ForeignKeys[j]
+			fkClaims = append(fkClaims, nameClaim{source: fk.Name, dest: fk.destConstraint(), set: func(n string) { fk.destName = n }})
+		}
+		handle(renameKindConstraint, t.Name, fkClaims)
+	}
+	resolveInherits(tables)
+	recordRenames(tables, opts.Config, report)
+
+	if len(all) == 0 {
+		return nil
+	}
+	fmt.Printf("Found %d destination name collision(s):\n", len(all))
+	for _, c := range all {
+		fmt.Printf("  %s %s: %s\n", c.kind, qualified(c.table, c.name), strings.Join(c.sources(), ", "))
+	}
+	fmt.Println("Rename one side of each collision in the config, for example:")
+	fmt.Println(suggestRenames(all))
+	return fmt.Errorf("%d destination name collision(s); set rename_to in the config or pass --collision-suffix", len(all))
+}
+
+// recordRenames adds every table, column and foreign key whose destination
+// name differs from its source name to the report. Collision renames are
+// already there.
+func recordRenames(tables []Table, cfg *Config, report *Report) {
+	resolved := map[string]bool{}
+	for _, r := range report.Renames {
+		resolved[r.Kind+"\x00"+r.Table+"\x00"+r.Source] = true
+	}
+	add := func(kind, table, source, dest, renameTo string) {
+		if source == dest || resolved[kind+"\x00"+table+"\x00"+source] {
+			return
+		}
+		reason := renameReasonFold
+		if renameTo != "" {
+			reason = renameReasonConfig
+		}
+		report.Renames = append(report.Renames, IdentifierRename{Kind: kind, Table: table, Source: source, Destination: dest, Reason: reason})
+	}
+	for _, t := range tables {
+		tc := cfg.table(t.Name)
+		if t.destName() != t.baseName() {
+			add(renameKindTable, "", t.Name, t.destName(), tc.RenameTo)
+		}
+		for _, c := range t.Columns {
+			add(renameKindColumn, t.Name, c.Name, c.destName(), tc.Columns[c.Name].RenameTo)
+		}
+		for _, fk := range t.ForeignKeys {
+			add(renameKindConstraint, t.Name, fk.Name, fk.destConstraint(), tc.RenameConstraints[fk.Name])
+		}
+	}
+}
+
+// suggestRenames renders config entries renaming all but the first source
+// of every collision, ready to merge into the "tables" section.
+func suggestRenames(collisions []collision) string {
+	tables := map[string]map[string]any{}
+	entry := func(name string) map[string]any {
+		if tables[name] == nil {
+			tables[name] = map[string]any{}
+		}
+		return tables[name]
+	}
+	for _, c := range collisions {
+		for i, cl := range c.claims[1:] {
+			if cl.fixed {
+				continue
+			}
+			source, suggested := cl.source, c.name+"_"+strconv.Itoa(i+2)
+			switch c.kind {
+			case renameKindTable:
+				entry(source)["rename_to"] = suggested
+			case renameKindColumn:
+				t := entry(c.table)
+				columns, _ := t["columns"].(map[string]any)
+				if columns == nil {
+					columns = map[string]any{}
+					t["columns"] = columns
+				}
+				columns[source] = map[string]string{"rename_to": suggested}
+			case renameKindConstraint:
+				t := entry(c.table)
+				renames, _ := t["rename_constraints"].(map[string]string)
+				if renames == nil {
+					renames = map[string]string{}
+					t["rename_constraints"] = renames
+				}
+				renames[source] = suggested
+			}
+		}
+	}
+	data, _ := json.MarshalIndent(map[string]any{"tables": tables}, "  ", "  ")
+	return "  " + string(data)
+}
@@ -0,0 +1,50 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveCollisionSuffixFits(t *testing.T) {
+	long := strings.Repeat("x", maxIdentifierLength)
+	var got []string
+	claims := []nameClaim{
+		{source: long, dest: long},
+		{source: strings.ToUpper(long), dest: long, set: func(n string) { got = append(got, n) }},
+		{source: "X" + long[1:], dest: long, set: func(n string) { got = append(got, n) }},
+	}
+	taken := map[string]bool{long: true}
+	report := &Report{}
+	for _, c := range findCollisions(renameKindTable, "", claims) {
+		if !resolveCollision(c, taken, report) {
+			t.Fatal("the collision was not resolved")
+		}
+	}
+	want := []string{long[:61] + "_2", long[:61] + "_3"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("renamed to %q, want %q", got, want)
+	}
+	for _, n := range got {
+		if len(n) > maxIdentifierLength {
+			t.Errorf("%q is %d bytes, the server would truncate it back", n, len(n))
+		}
+	}
+}
+
+func TestRenameToLength(t *testing.T) {
+	long := strings.Repeat("a", maxIdentifierLength+1)
+	for name, tc := range map[string]TableConfig{
+		"table":      {RenameTo: long},
+		"column":     {Columns: map[string]ColumnConfig{"email": {RenameTo: long}}},
+		"constraint": {RenameConstraints: map[string]string{"users_team_fkey": long}},
+	} {
+		err := validateTableConfigs(map[string]TableConfig{"users": tc})
+		if err == nil || !strings.Contains(err.Error(), "longer than the 63") {
+			t.Errorf("%s: error = %v, want the name rejected", name, err)
+		}
+	}
+	fits := TableConfig{RenameTo: long[:maxIdentifierLength], Columns: map[string]ColumnConfig{"email": {RenameTo: long[:maxIdentifierLength]}}}
+	if err := validateTableConfigs(map[string]TableConfig{"users": fits}); err != nil {
+		t.Errorf("a 63-byte rename_to was rejected: %v", err)
+	}
+}
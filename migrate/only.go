@@ -0,0 +1,162 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// selectTables restricts a run to the tables named with --only. Tables that
+// inherit from a selected table, and the partitions of a selected table,
+// must be selected too, because recreating the parent drops them.
+func selectTables(tables []Table, only []string) ([]Table, error) {
+	selected := map[string]bool{}
+	for _, name := range only {
+		selected[name] = true
+	}
+	var out []Table
+	for _, t := range tables {
+		if selected[t.Name] {
+			out = append(out, t)
+			delete(selected, t.Name)
+			continue
+		}
+		for _, parent := range t.Inherits {
+			if slices.Contains(only, parent) {
+				return nil, fmt.Errorf("--only %s would drop its inheritance child %s; select it too or use --flatten-inheritance", parent, t.Name)
+			}
+		}
+		if t.PartitionOf != "" && slices.Contains(only, t.PartitionOf) {
+			return nil, fmt.Errorf("--only %s would drop its partition %s; select it too", t.PartitionOf, t.Name)
+		}
+	}
+	for name := range selected {
+		return nil, fmt.Errorf("--only names unknown table %s", name)
+	}
+	return out, nil
+}
+
+// excludeTables leaves the tables named with --exclude out of the run, as if
+// the source lacked them. A parent cannot go without its partitions or, unless
+// inheritance is flattened, its inheritance children, since they are created
+// from it.
+func excludeTables(tables []Table, exclude []string) ([]Table, error) {
+	excluded := map[string]bool{}
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+	unknown := maps.Clone(excluded)
+	for _, t := range tables {
+		delete(unknown, t.Name)
+		if excluded[t.Name] {
+			continue
+		}
+		for _, parent := range t.Inherits {
+			if excluded[parent] {
+				return nil, fmt.Errorf("--exclude %s would leave out the parent of %s; exclude it too or use --flatten-inheritance", parent, t.Name)
+			}
+		}
+		if excluded[t.PartitionOf] {
+			return nil, fmt.Errorf("--exclude %s would leave out the table of partition %s; exclude it too", t.PartitionOf, t.Name)
+		}
+	}
+	for name := range unknown {
+		return nil, fmt.Errorf("--exclude names unknown table %s", name)
+	}
+	return withoutTables(tables, excluded), nil
+}
+
+// mergeTables returns all with the tables of a partial run replaced by their
+// processed versions, so the schema snapshot still covers every table.
+func mergeTables(all, selected []Table) []Table {
+	byName := make(map[string]Table, len(selected))
+	for _, t := range selected {
+		byName[t.Name] = t
+	}
+	out := make([]Table, len(all))
+	for i, t := range all {
+		if s, ok := byName[t.Name]; ok {
+			t = s
+		}
+		out[i] = t
+	}
+	return out
+}
+
+// detachForeignKeys drops destination foreign keys of tables outside the
+// run that reference a selected table. They would otherwise be dropped by
+// DROP ... CASCADE or make TRUNCATE fail. Their definitions are printed
+// first so they can be restored by hand if the run dies.
+func detachForeignKeys(ctx context.Context, dest Querier, tables []Table) ([]foreignKey, error) {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.qualifiedDestName()
+	}
+	rows, err := dest.Query(ctx, `
+		SELECT sn.nspname, src.relname, con.conname, rn.nspname, ref.relname,
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				ORDER BY k.ord
+			),
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				ORDER BY k.ord
+			),
+			pg_get_constraintdef(con.oid),
+			con.confdeltype::text, con.confupdtype::text,
+			src.relkind = 'p', ref.relkind = 'p'
+		FROM pg_constraint con
+		JOIN pg_class src ON src.oid = con.conrelid
+		JOIN pg_namespace sn ON sn.oid = src.relnamespace
+		JOIN pg_class ref ON ref.oid = con.confrelid
+		JOIN pg_namespace rn ON rn.oid = ref.relnamespace
+		WHERE con.contype = 'f'
+		  AND rn.nspname || '.' || ref.relname = ANY($1)
+		  AND NOT sn.nspname || '.' || src.relname = ANY($1)
+		  AND con.conparentid = 0
+		ORDER BY sn.nspname, src.relname, con.conname
+	`, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dependent foreign keys: %w", err)
+	}
+	fks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (foreignKey, error) {
+		var fk foreignKey
+		var onDelete, onUpdate string
+		err := row.Scan(&fk.Schema, &fk.Table, &fk.Name, &fk.RefSchema, &fk.RefTable, &fk.Columns, &fk.RefColumns, &fk.Definition, &onDelete, &onUpdate, &fk.partitioned, &fk.refPartitioned)
+		fk.setActions(onDelete, onUpdate)
+		return fk, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dependent foreign keys: %w", err)
+	}
+
+	for _, fk := range fks {
+		fmt.Printf("  Detaching foreign key %s on %s: %s\n", fk.Name, fk.qualifiedTable(), fk.Definition)
+		if _, err := dest.Exec(ctx, sqlutil.DropConstraint(fk.tableIdent(), fk.Name)); err != nil {
+			return nil, fmt.Errorf("failed to drop foreign key %s on %s: %w", fk.Name, fk.Table, err)
+		}
+	}
+	return fks, nil
+}
+
+// restoreForeignKeys puts detached foreign keys back as NOT VALID without
+// checking them, for runs that failed before the constraints phase.
+func restoreForeignKeys(ctx context.Context, dest Querier, fks []foreignKey) error {
+	for _, fk := range fks {
+		def := strings.TrimSuffix(fk.Definition, " NOT VALID")
+		if _, err := dest.Exec(ctx, sqlutil.AddConstraint(fk.tableIdent(), fk.Name, def, true)); err != nil {
+			return fmt.Errorf("failed to restore foreign key %s on %s (%s): %w", fk.Name, fk.Table, fk.Definition, err)
+		}
+	}
+	return nil
+}
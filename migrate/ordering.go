@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const orderUnordered = "unordered"
+
+// OrderBy is the order_by setting of a table: either the string "unordered"
+// or a list of columns, each optionally followed by ASC or DESC.
+type OrderBy struct {
+	Unordered bool
+	Terms     []OrderTerm
+}
+
+type OrderTerm struct {
+	Column string
+	Desc   bool
+}
+
+func (o *OrderBy) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s != orderUnordered {
+			return fmt.Errorf("order_by must be a list of columns or %q, got %q", orderUnordered, s)
+		}
+		o.Unordered = true
+		return nil
+	}
+
+	var terms []string
+	if err := json.Unmarshal(data, &terms); err != nil {
+		return err
+	}
+	for _, term := range terms {
+		fields := strings.Fields(term)
+		if len(fields) == 0 || len(fields) > 2 {
+			return fmt.Errorf("invalid order_by term %q (expected column [ASC|DESC])", term)
+		}
+		ot := OrderTerm{Column: fields[0]}
+		if len(fields) == 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "ASC":
+			case "DESC":
+				ot.Desc = true
+			default:
+				return fmt.Errorf("invalid order_by term %q (expected column [ASC|DESC])", term)
+			}
+		}
+		o.Terms = append(o.Terms, ot)
+	}
+	if len(o.Terms) == 0 {
+		return fmt.Errorf("order_by needs at least one column, or %q", orderUnordered)
+	}
+	return nil
+}
+
+// orderOf returns the ORDER BY terms of t for --ordered-copy: the configured
+// order_by, or the primary key. Nil means unordered.
+func orderOf(t Table, ob *OrderBy) []OrderTerm {
+	if ob != nil {
+		return ob.Terms
+	}
+	terms := make([]OrderTerm, len(t.PrimaryKey))
+	for i, k := range t.PrimaryKey {
+		terms[i] = OrderTerm{Column: k}
+	}
+	return terms
+}
+
+// planOrdering resolves the read order of every table for --ordered-copy and
+// checks that its columns are still copied (they may have been left out by
+// projection or as Xata metadata).
+func planOrdering(tables []Table, cfg *Config) error {
+	for i := range tables {
+		t := &tables[i]
+		terms := orderOf(*t, cfg.table(t.Name).OrderBy)
+		for _, ot := range terms {
+			if _, ok := t.column(ot.Column); !ok {
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("table %s: order_by column %s is not copied", t.Name, ot.Column)}
+			}
+		}
+		t.OrderBy = terms
+		fmt.Printf("  %s: %s\n", t.Name, describeOrder(terms))
+	}
+	return nil
+}
+
+func orderClause(terms []OrderTerm) string {
+	parts := make([]string, len(terms))
+	for i, ot := range terms {
+		parts[i] = sqlutil.QuoteIdent(ot.Column)
+		if ot.Desc {
+			parts[i] += " DESC"
+		}
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+// describeOrder is the ordering as reported, e.g. "xata_createdat, xata_id"
+// or "unordered".
+func describeOrder(terms []OrderTerm) string {
+	if len(terms) == 0 {
+		return orderUnordered
+	}
+	parts := make([]string, len(terms))
+	for i, ot := range terms {
+		parts[i] = ot.Column
+		if ot.Desc {
+			parts[i] += " desc"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
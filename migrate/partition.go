@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// Values of --partition-outliers
+const (
+	partitionOutliersReport  = "report"
+	partitionOutliersDefault = "default"
+)
+
+func (pc *PartitionConfig) defaultName(table string) string {
+	return physicalName(pc.logicalDefaultName(table))
+}
+
+func (pc *PartitionConfig) logicalDefaultName(table string) string {
+	if pc.Default != "" {
+		return pc.Default
+	}
+	return table + "_default"
+}
+
+// partitionNames returns the destination partitions the tool creates for t,
+// which belong to the migration like t itself.
+func partitionNames(t Table, pc *PartitionConfig, outliers string) []string {
+	var names []string
+	for _, p := range pc.Partitions {
+		names = append(names, physicalName(p.Name))
+	}
+	if outliers == partitionOutliersDefault {
+		names = append(names, pc.defaultName(t.destName()))
+	}
+	return names
+}
+
+// partitionDDL returns the statements creating the declared partitions (and
+// the default one if requested) of a parent created with
+// sqlutil.PartitionByRange. Partitions go into the schema of the parent.
+func partitionDDL(t Table, pc *PartitionConfig, outliers string) []string {
+	parent := destIdent(t)
+	var stmts []string
+	for _, p := range pc.Partitions {
+		stmts = append(stmts, sqlutil.CreatePartition(schemaIdent(t.DestSchema, physicalName(p.Name)), parent, sqlutil.QuoteLiteral(p.From), sqlutil.QuoteLiteral(p.To)))
+	}
+	if outliers == partitionOutliersDefault {
+		stmts = append(stmts, sqlutil.CreateDefaultPartition(schemaIdent(t.DestSchema, pc.defaultName(t.destName())), parent))
+	}
+	return stmts
+}
+
+// outlierCondition selects the rows of t that fit none of the declared
+// partitions, including rows where the partition column is NULL.
+func outlierCondition(t Table, pc *PartitionConfig) string {
+	col, _ := t.column(pc.Column)
+	quoted := sqlutil.QuoteIdent(pc.Column)
+	typ := castType(col)
+	ranges := make([]string, len(pc.Partitions))
+	for i, p := range pc.Partitions {
+		ranges[i] = fmt.Sprintf("(%s >= %s::%s AND %s < %s::%s)",
+			quoted, sqlutil.QuoteLiteral(p.From), typ, quoted, sqlutil.QuoteLiteral(p.To), typ)
+	}
+	return "(" + strings.Join(ranges, " OR ") + ") IS NOT TRUE"
+}
+
+// checkPartitionOutliers counts, before anything is written, the source rows
+// that no declared partition would accept. Without a default partition they
+// would fail the copy half-way, so the run stops with their count instead.
+func checkPartitionOutliers(ctx context.Context, source Querier, tables []Table, opts Options, cp *Checkpoint) error {
+	if opts.PartitionOutliers != partitionOutliersReport {
+		return nil
+	}
+	for _, t := range tables {
+		pc := opts.Config.table(t.Name).PartitionBy
+		if pc == nil || cp.completed(t.Name) {
+			continue
+		}
+		var outliers int64
+		query := sqlutil.CountRows(fromClause(t)) + " WHERE " + outlierCondition(t, pc)
+		if err := source.QueryRow(ctx, query).Scan(&outliers); err != nil {
+			return fmt.Errorf("failed to check partition bounds of %s: %w", t.Name, err)
+		}
+		if outliers > 0 {
+			return &SchemaError{Table: t.Name, Err: fmt.Errorf("table %s has %d row(s) outside all declared partitions (or with NULL %s); extend the partitions or pass --partition-outliers default", t.Name, outliers, pc.Column)}
+		}
+	}
+	return nil
+}
+
+// reportDefaultPartition warns about rows that landed in the default
+// partition of t, since they usually mean a partition is missing.
+func reportDefaultPartition(ctx context.Context, dest CopyConn, t Table, opts Options, report *Report) error {
+	pc := opts.Config.table(t.Name).PartitionBy
+	if pc == nil || opts.PartitionOutliers != partitionOutliersDefault {
+		return nil
+	}
+	name := pc.defaultName(t.destName())
+	var rows int64
+	if err := dest.QueryRow(ctx, sqlutil.CountRows(schemaIdent(t.DestSchema, name))).Scan(&rows); err != nil {
+		return fmt.Errorf("failed to count rows of default partition %s: %w", name, err)
+	}
+	if rows > 0 {
+		report.warnTable(warnPartitionOutliers, t.Name, "%d row(s) of %s fit no declared partition and were routed to %s", rows, t.Name, name)
+	}
+	return nil
+}
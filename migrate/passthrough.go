@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/schollz/progressbar/v3"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	copyMethodAuto = "auto"
+	copyMethodRows = "rows"
+	copyMethodCSV  = "csv"
+)
+
+// passthroughEligible reports whether a table can be streamed as CSV straight
+// from the source COPY into the destination COPY. That is only safe when every
+// value is written exactly as the source renders it: no column of tc is
+// normalized or transformed, none is encrypted, converted to another type or
+// to uuid, and none is generated.
+func passthroughEligible(t Table, tc TableConfig) bool {
+	if len(t.Columns) == 0 {
+		return false
+	}
+	for _, c := range t.Columns {
+		if cc := tc.Columns[c.Name]; cc.normalizes() || cc.Transform != "" {
+			return false
+		}
+		if c.Encrypt != "" || c.SourceExpr != "" || c.UUIDKey != nil || c.Generated != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func useCSVPassthrough(method string, t Table, tc TableConfig) bool {
+	switch method {
+	case copyMethodCSV:
+		return true
+	case copyMethodRows:
+		return false
+	default:
+		return passthroughEligible(t, tc)
+	}
+}
+
+// copyTableCSV pipes COPY ... TO STDOUT on the source into COPY ... FROM STDIN
+// on the destination without decoding any values in Go. Progress is tracked
+// by bytes since rows are never parsed. With freeze the table is truncated
+// and loaded with COPY ... FREEZE in one destination transaction, so a
+// failure leaves it empty.
+func copyTableCSV(ctx context.Context, source *SourceConn, dest CopyConn, t Table, freeze bool, wal *walMonitor) (rows, n int64, err error) {
+	sourceCols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		sourceCols[i] = c.Name
+	}
+
+	// COPY table TO never includes rows of inheritance children
+	copyOut := sqlutil.CopyTo(sourceIdent(t), sourceCols, "FORMAT csv")
+	if hasSourceExprs(t) || len(t.OrderBy) > 0 {
+		query := sourceSelect(t)
+		if len(t.OrderBy) > 0 {
+			query += orderClause(t.OrderBy)
+		}
+		copyOut = "COPY (" + query + ") TO STDOUT WITH (FORMAT csv)"
+	}
+	copyIn := sqlutil.CopyFrom(destIdent(t), copyColumns(t), "FORMAT csv")
+
+	var tx pgx.Tx
+	if freeze {
+		copyIn = sqlutil.CopyFrom(destIdent(t), copyColumns(t), "FORMAT csv, FREEZE")
+		tx, err = dest.Begin(ctx)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to start the load of %s: %w", t.Name, err)
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback(ctx)
+			}
+		}()
+		// COPY FREEZE needs the table created or truncated in the same
+		// transaction
+		if _, err := tx.Exec(ctx, sqlutil.Truncate(destFromClause(t))); err != nil {
+			return 0, 0, fmt.Errorf("failed to truncate %s: %w", t.Name, err)
+		}
+		fmt.Println("  Loading with COPY FREEZE")
+	}
+
+	bar := runOf(ctx).newBytesBar("  Copying (csv)")
+	rows, n, srcErr, err := pipeCopy(ctx, source, dest, copyOut, copyIn, bar, wal)
+	bar.Finish()
+	fmt.Println()
+
+	if srcErr != nil {
+		return 0, 0, fmt.Errorf("failed to read data from %s: %w", t.Name, srcErr)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to copy data for table %s: %w", t.Name, err)
+	}
+	if tx != nil {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, 0, fmt.Errorf("failed to commit the load of %s: %w", t.Name, err)
+		}
+	}
+	return rows, n, nil
+}
+
+// pipeCopy streams the output of the copyOut statement on source into the
+// copyIn statement on dest, mirroring the bytes to progress. It returns the
+// rows written on the destination, the bytes transferred, and the source and
+// destination errors separately. A non-nil wal throttles the stream.
+func pipeCopy(ctx context.Context, source *SourceConn, dest CopyConn, copyOut, copyIn string, progress io.Writer, wal *walMonitor) (int64, int64, error, error) {
+	control := runOf(ctx).control
+	counter := &countingReader{control: control}
+
+	pr, pw := io.Pipe()
+	outErr := make(chan error, 1)
+	go func() {
+		_, err := source.CopyTo(ctx, pw, copyOut)
+		pw.CloseWithError(err)
+		outErr <- err
+	}()
+
+	bar, _ := progress.(*progressbar.ProgressBar)
+	counter.r = wal.reader(io.TeeReader(pr, progress), bar)
+	tag, err := dest.PgConn().CopyFrom(ctx, counter, copyIn)
+	if err != nil && control.skipRequested() {
+		// Cancelling the source COPY, which is then drained, keeps its
+		// connection; a failed write to the pipe would close it
+		source.cancelQuery(ctx)
+		io.Copy(io.Discard, pr)
+		<-outErr
+		return 0, 0, nil, errTableSkipped
+	}
+	// Unblock the source side if the destination gave up early
+	pr.CloseWithError(err)
+	srcErr := <-outErr
+
+	// When the destination fails first, the source sees that same error from
+	// the closed pipe, so only report a source failure when it differs.
+	if srcErr != nil && !errors.Is(srcErr, err) {
+		return 0, 0, srcErr, nil
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return tag.RowsAffected(), counter.n, nil, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+	// control pauses and skips the copy
+	control *copyControl
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if err := c.control.wait(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPassthroughEligible(t *testing.T) {
+	plain := []Column{{Name: "id", DataType: "integer"}, {Name: "name", DataType: "text"}}
+	with := func(c Column) []Column { return append([]Column{plain[0]}, c) }
+	for _, tt := range []struct {
+		name    string
+		columns []Column
+		tc      TableConfig
+		want    bool
+	}{
+		{"plain columns", plain, TableConfig{}, true},
+		{"no columns", nil, TableConfig{}, false},
+		{"normalized column", plain, TableConfig{Columns: map[string]ColumnConfig{"name": {NullifyEmptyStrings: true}}}, false},
+		{"transformed column", plain, TableConfig{Columns: map[string]ColumnConfig{"name": {Transform: transformJSONNormalize}}}, false},
+		{"rule for a column the table lacks", plain, TableConfig{Columns: map[string]ColumnConfig{"other": {Transform: transformJSONNormalize}}}, true},
+		{"aes column", with(Column{Name: "secret", Encrypt: encryptAES}), TableConfig{}, false},
+		{"pgcrypto column", with(Column{Name: "secret", Encrypt: encryptPgcrypto}), TableConfig{}, false},
+		{"converted column", with(Column{Name: "meta", SourceExpr: `to_jsonb("meta")`}), TableConfig{}, false},
+		{"uuid key", with(Column{Name: "ref", UUIDKey: &uuidKey{}}), TableConfig{}, false},
+		{"generated column", with(Column{Name: "total", Generated: "price * qty"}), TableConfig{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := passthroughEligible(Table{Name: "t", Columns: tt.columns}, tt.tc); got != tt.want {
+				t.Errorf("passthroughEligible = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkCopyMethod migrates the fixtures with each copy method; run it
+// with MIGRATION_TOOL_TEST_ROWS=10000000 for a table the size of the ones
+// the passthrough is meant for:
+//
+//	go test -run '^$' -bench CopyMethod ./migrate
+func BenchmarkCopyMethod(b *testing.B) {
+	env, _, _ := integrationEnv(b)
+	ctx := context.Background()
+	for _, method := range []string{copyMethodRows, copyMethodCSV} {
+		b.Run(method, func(b *testing.B) {
+			var rows int64
+			for b.Loop() {
+				opts := testOptions(b, "--copy-method", method)
+				report, err := runMigration(ctx, opts, env)
+				if err != nil {
+					b.Fatalf("migration failed: %v", err)
+				}
+				for _, tr := range report.Tables {
+					rows += tr.RowsCopiedTotal
+				}
+			}
+			b.ReportMetric(float64(rows)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
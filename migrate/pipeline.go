@@ -0,0 +1,180 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// valueStage rewrites a single column value on the row copy path.
+type valueStage interface {
+	apply(v any) (any, error)
+}
+
+// columnPipeline is the ordered list of stages for one column. Stages always
+// run in the same order: normalization first (on the raw source value), then
+// transforms, then masking, then encryption or UUID translation, so a
+// transform never sees an empty string that normalization was asked to turn
+// into NULL.
+type columnPipeline struct {
+	column string
+	stages []valueStage
+}
+
+// buildPipelines returns one pipeline per column index (nil for columns with
+// nothing to do), or nil when the table needs no value processing at all.
+// key encrypts aes columns.
+func buildPipelines(t Table, tc TableConfig, key string) []*columnPipeline {
+	var pipelines []*columnPipeline
+	for i, c := range t.Columns {
+		cc := tc.Columns[c.Name]
+		var stages []valueStage
+		if cc.normalizes() {
+			stages = append(stages, newNormalizer(cc))
+		}
+		if cc.Transform == transformJSONNormalize {
+			stages = append(stages, newJSONNormalizer(c))
+		}
+		if c.Encrypt == encryptAES {
+			stages = append(stages, newAESEncryptor(key))
+		}
+		if c.UUIDKey != nil {
+			stages = append(stages, c.UUIDKey)
+		}
+		if len(stages) == 0 {
+			continue
+		}
+		if pipelines == nil {
+			pipelines = make([]*columnPipeline, len(t.Columns))
+		}
+		pipelines[i] = &columnPipeline{column: c.Name, stages: stages}
+	}
+	return pipelines
+}
+
+// pipelineRows applies column pipelines to every row before CopyFrom sees it.
+// key holds the indexes of the primary key columns, used to name the row in
+// errors.
+type pipelineRows struct {
+	pgx.CopyFromSource
+	pipelines []*columnPipeline
+	key       []int
+}
+
+func newPipelineRows(src pgx.CopyFromSource, t Table, pipelines []*columnPipeline) *pipelineRows {
+	r := &pipelineRows{CopyFromSource: src, pipelines: pipelines}
+	for _, k := range t.PrimaryKey {
+		for i, c := range t.Columns {
+			if c.Name == k {
+				r.key = append(r.key, i)
+			}
+		}
+	}
+	return r
+}
+
+func (r *pipelineRows) Values() ([]any, error) {
+	values, err := r.CopyFromSource.Values()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range r.pipelines {
+		if p == nil {
+			continue
+		}
+		for _, s := range p.stages {
+			v, err := s.apply(values[i])
+			var qe *quarantineError
+			if errors.As(err, &qe) {
+				if n, ok := s.(*jsonNormalizer); ok {
+					n.quarantine(r.rowKey(values), values[i], qe.err)
+				}
+				v, err = qe.value, nil
+			}
+			if err != nil {
+				return nil, &rowError{pk: r.rowKey(values), err: fmt.Errorf("column %s: %w", p.column, err)}
+			}
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+func (r *pipelineRows) rowKey(values []any) []string {
+	var pk []string
+	for _, i := range r.key {
+		pk = append(pk, fmt.Sprint(values[i]))
+	}
+	return pk
+}
+
+// normalizer implements the nullify_empty_strings, empty_string_if_null and
+// null_if_value column options and counts how often each one fired. The
+// counters are atomic because split_by ranges may be copied in parallel.
+type normalizer struct {
+	cfg ColumnConfig
+
+	emptyToNull atomic.Int64
+	nullToEmpty atomic.Int64
+	valueToNull atomic.Int64
+}
+
+func newNormalizer(cfg ColumnConfig) *normalizer {
+	return &normalizer{cfg: cfg}
+}
+
+func (n *normalizer) apply(v any) (any, error) {
+	if v == nil {
+		if n.cfg.EmptyStringIfNull {
+			n.nullToEmpty.Add(1)
+			return "", nil
+		}
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	if s == "" && n.cfg.NullifyEmptyStrings {
+		n.emptyToNull.Add(1)
+		return nil, nil
+	}
+	if n.cfg.NullIfValue != nil && s == *n.cfg.NullIfValue {
+		n.valueToNull.Add(1)
+		return nil, nil
+	}
+	return v, nil
+}
+
+type ColumnNormalization struct {
+	Column      string `json:"column"`
+	EmptyToNull int64  `json:"empty_to_null,omitempty"`
+	NullToEmpty int64  `json:"null_to_empty,omitempty"`
+	ValueToNull int64  `json:"value_to_null,omitempty"`
+}
+
+// normalizationCounts collects the per-column counters after a copy, sorted by
+// column name for stable output.
+func normalizationCounts(pipelines []*columnPipeline) []ColumnNormalization {
+	var out []ColumnNormalization
+	for _, p := range pipelines {
+		if p == nil {
+			continue
+		}
+		for _, s := range p.stages {
+			if n, ok := s.(*normalizer); ok {
+				out = append(out, ColumnNormalization{
+					Column:      p.column,
+					EmptyToNull: n.emptyToNull.Load(),
+					NullToEmpty: n.nullToEmpty.Load(),
+					ValueToNull: n.valueToNull.Load(),
+				})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Column < out[j].Column })
+	return out
+}
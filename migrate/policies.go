@@ -0,0 +1,240 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	policyCreated  = "created"
+	policyExisting = "existing"
+	policySkipped  = "skipped"
+)
+
+// policy is a row-level security policy of a source table, from pg_policies.
+type policy struct {
+	Table string
+	Name  string
+	// Permissive is PERMISSIVE or RESTRICTIVE
+	Permissive string
+	Roles      []string
+	// Command is ALL, SELECT, INSERT, UPDATE or DELETE
+	Command string
+	// Using and WithCheck are the expressions, nil when absent
+	Using     *string
+	WithCheck *string
+}
+
+// rowSecurity is a source table with row-level security enabled, forced on
+// its owner too with Force.
+type rowSecurity struct {
+	Table string
+	Force bool
+}
+
+// PolicyReport describes one policy of the policies phase.
+type PolicyReport struct {
+	Table string   `json:"table"`
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	// MissingRoles are the roles left out, missing on the destination
+	MissingRoles []string `json:"missing_roles,omitempty"`
+	Status       string   `json:"status"`
+	// Reason is why a policy was skipped
+	Reason string `json:"reason,omitempty"`
+}
+
+// RowSecurityReport is a table given row-level security by the policies
+// phase.
+type RowSecurityReport struct {
+	Table    string `json:"table"`
+	Force    bool   `json:"force,omitempty"`
+	Policies int    `json:"policies"`
+}
+
+// introspectPolicies reads the policies of the tables of schemas and the
+// tables with row-level security enabled, which may have none and then deny
+// every row to roles other than their owner.
+func introspectPolicies(ctx context.Context, conn Querier, schemas []string) ([]policy, []rowSecurity, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT CASE WHEN schemaname = 'public' THEN tablename::text ELSE schemaname || '.' || tablename END,
+			policyname::text, permissive, roles::text[], cmd, qual, with_check
+		FROM pg_policies
+		WHERE schemaname = ANY($1)
+		ORDER BY 1, 2
+	`, schemas)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get policies: %w", err)
+	}
+	policies, err := pgx.CollectRows(rows, pgx.RowToStructByPos[policy])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get policies: %w", err)
+	}
+	rows, err = conn.Query(ctx, `
+		SELECT `+sourceKeySQL+`, c.relforcerowsecurity
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($1)
+		  AND c.relkind IN ('r', 'p')
+		  AND c.relrowsecurity
+		ORDER BY 1
+	`, schemas)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get row security: %w", err)
+	}
+	secured, err := pgx.CollectRows(rows, pgx.RowToStructByPos[rowSecurity])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get row security: %w", err)
+	}
+	return policies, secured, nil
+}
+
+// destinationPolicies returns "schema.table.name" of every policy on the
+// destination.
+func destinationPolicies(ctx context.Context, dest Querier) (map[string]bool, error) {
+	rows, err := dest.Query(ctx, `SELECT schemaname || '.' || tablename || '.' || policyname FROM pg_policies`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination policies: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination policies: %w", err)
+	}
+	out := make(map[string]bool, len(names))
+	for _, n := range names {
+		out[n] = true
+	}
+	return out, nil
+}
+
+// policySkipReason returns why p cannot be created on t on the destination,
+// or "". Its expressions name the source columns.
+func policySkipReason(t Table, p policy) string {
+	for _, c := range t.Columns {
+		if c.destName() != c.Name {
+			return fmt.Sprintf("column %s of its table is renamed", c.Name)
+		}
+	}
+	return ""
+}
+
+// statement is the CREATE POLICY statement of p on t for roles, already
+// mapped to their destination names.
+func (p policy) statement(t Table, roles []string) string {
+	grantees := make([]string, len(roles))
+	for i, r := range roles {
+		grantees[i] = granteeIdent(r)
+	}
+	stmt := "CREATE POLICY " + sqlutil.QuoteIdent(p.Name) + " ON " + destIdent(t) + " AS " + p.Permissive +
+		" FOR " + p.Command + " TO " + strings.Join(grantees, ", ")
+	if p.Using != nil {
+		stmt += " USING (" + *p.Using + ")"
+	}
+	if p.WithCheck != nil {
+		stmt += " WITH CHECK (" + *p.WithCheck + ")"
+	}
+	return stmt
+}
+
+// Policies recreates the row-level security of the migrated tables unless
+// --skip-rls is given: their policies, then ENABLE, and where the source
+// has it FORCE, ROW LEVEL SECURITY. It runs once the data is in, so the
+// copy is never filtered by a policy, and before the grants, while the
+// migration role still owns the tables. Roles the destination
+// lacks are left out of a policy, and a policy left with none is not
+// created, since no role it applies to exists; all of them are listed in
+// one warning at the end.
+func (m *Migrator) Policies(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhasePolicies, state, m.policies)
+}
+
+func (m *Migrator) policies(ctx context.Context, state *MigrationState) error {
+	// --data-only leaves the destination definitions alone
+	if len(state.rowSecurity) == 0 && len(state.policies) == 0 || m.opts.DataOnly {
+		return nil
+	}
+	roleMap, err := parseRoleMap(m.opts.RoleMap)
+	if err != nil {
+		return err
+	}
+	existing, err := destinationRoles(ctx, m.dest)
+	if err != nil {
+		return err
+	}
+	created, err := destinationPolicies(ctx, m.dest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Creating row-level security policies...")
+	counts := map[string]int{}
+	var missing []string
+	for _, p := range state.policies {
+		t, ok := tableByName(state.Tables, p.Table)
+		if !ok {
+			continue
+		}
+		var roles, absent []string
+		for _, r := range p.Roles {
+			switch role := mappedRole(roleMap, r); {
+			case r == "public":
+				roles = append(roles, publicGrantee)
+			case existing[role]:
+				roles = append(roles, role)
+			default:
+				absent = append(absent, role)
+			}
+		}
+		r := PolicyReport{Table: t.Name, Name: p.Name, Roles: roles, MissingRoles: absent, Status: policyCreated}
+		if len(absent) > 0 {
+			missing = append(missing, fmt.Sprintf("%s on %s (%s)", p.Name, t.Name, strings.Join(absent, ", ")))
+		}
+		switch {
+		case len(roles) == 0:
+			r.Status, r.Reason = policySkipped, "none of its roles exists on the destination"
+		case policySkipReason(t, p) != "":
+			r.Status, r.Reason = policySkipped, policySkipReason(t, p)
+			state.Report.warnTable(warnPolicySkipped, t.Name, "policy %s on %s was not created: %s", p.Name, t.Name, r.Reason)
+		case created[t.qualifiedDestName()+"."+p.Name]:
+			// A kept table keeps its policies
+			r.Status = policyExisting
+			counts[t.Name]++
+		default:
+			if _, err := m.dest.Exec(ctx, p.statement(t, roles)); err != nil {
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to create policy %s on %s: %w", p.Name, t.Name, err)}
+			}
+			fmt.Printf("  %s on %s\n", p.Name, t.Name)
+			counts[t.Name]++
+		}
+		state.Report.Policies = append(state.Report.Policies, r)
+	}
+
+	for _, rs := range state.rowSecurity {
+		t, ok := tableByName(state.Tables, rs.Table)
+		if !ok {
+			continue
+		}
+		stmts := []string{"ALTER TABLE " + destIdent(t) + " ENABLE ROW LEVEL SECURITY"}
+		if rs.Force {
+			stmts = append(stmts, "ALTER TABLE "+destIdent(t)+" FORCE ROW LEVEL SECURITY")
+		}
+		for _, stmt := range stmts {
+			if _, err := m.dest.Exec(ctx, stmt); err != nil {
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to enable row-level security on %s: %w", t.Name, err)}
+			}
+		}
+		state.Report.RowSecurity = append(state.Report.RowSecurity, RowSecurityReport{Table: t.Name, Force: rs.Force, Policies: counts[t.Name]})
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		state.Report.warn(warnPolicyRoles, "%d policy(ies) name roles missing on the destination, which were left out (policies without any role were not created): %s",
+			len(missing), strings.Join(missing, "; "))
+	}
+	return nil
+}
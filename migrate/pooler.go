@@ -0,0 +1,286 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// Values of --dest-pooler
+const (
+	destPoolerAuto      = "auto"
+	destPoolerNone      = "none"
+	destPoolerPgBouncer = "pgbouncer"
+
+	// poolerStrategyDirect copies over a connection to --dest-bypass-port,
+	// poolerStrategyInsert writes batched INSERTs through the pooler
+	poolerStrategyDirect = "direct_copy"
+	poolerStrategyInsert = "batched_insert"
+
+	// poolerProbes statements are run to see whether they all land on one
+	// server connection
+	poolerProbes = 3
+
+	// insertBatchRows is the most rows one INSERT of insertBatches writes
+	insertBatchRows = 500
+)
+
+// PoolerReport describes the transaction pooler in front of the destination
+// and how the run works around it.
+type PoolerReport struct {
+	Pooler string `json:"pooler"`
+	// Detected says how the pooler was found; empty when --dest-pooler
+	// named it
+	Detected   string `json:"detected,omitempty"`
+	BypassPort int    `json:"bypass_port,omitempty"`
+	// Bypass is set when the bypass port reached the server behind the
+	// pooler directly
+	Bypass   bool   `json:"bypass"`
+	Strategy string `json:"strategy"`
+	// Unavailable lists what the run does without
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// destEndpoints holds the destination connections of a run.
+type destEndpoints struct {
+	conn *pgx.Conn
+	// direct bypasses the pooler for the copy and the destination lock
+	direct *pgx.Conn
+	pooler *PoolerReport
+}
+
+func (d *destEndpoints) close(ctx context.Context) {
+	d.conn.Close(ctx)
+	if d.direct != nil {
+		d.direct.Close(ctx)
+	}
+}
+
+// copyConn is the connection the copy phase writes through.
+func (d *destEndpoints) copyConn() *pgx.Conn {
+	if d.direct != nil {
+		return d.direct
+	}
+	return d.conn
+}
+
+// lock takes the destination lock. Behind a transaction pooler a
+// session-level advisory lock would be held by whichever server connection
+// ran it, so only the bypass connection can hold it.
+func (d *destEndpoints) lock(ctx context.Context, report *Report) error {
+	if d.pooler != nil && d.direct == nil {
+		report.warn(warnPooler, "the destination is behind a transaction pooler without --dest-bypass-port; concurrent migrations against it are not prevented")
+		return nil
+	}
+	return lockDestination(ctx, d.copyConn())
+}
+
+// connectDestination connects to the destination and, with --dest-pooler
+// pgbouncer or when auto detects a transaction pooler, adapts the run to it:
+// statements use the simple protocol, since prepared statements and other
+// session state do not survive a change of server connection, and the copy
+// goes through --dest-bypass-port when that reaches the same server, or is
+// written with batched INSERTs otherwise.
+func connectDestination(ctx context.Context, url string, opts Options, report *Report) (*destEndpoints, error) {
+	cfg, err := pgx.ParseConfig(url)
+	if err != nil {
+		return nil, withSentinel(ErrConnect, fmt.Errorf("unable to connect to destination database: %w", err))
+	}
+	// Statements are journaled once the run opened its journal
+	cfg.Tracer = journalTracer{}
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, withSentinel(ErrConnect, fmt.Errorf("unable to connect to destination database: %w", err))
+	}
+
+	var detected string
+	switch opts.DestPooler {
+	case destPoolerNone:
+		return &destEndpoints{conn: conn}, nil
+	case destPoolerAuto:
+		detected, err = detectTransactionPooler(ctx, conn)
+		if err != nil || detected == "" {
+			if err != nil {
+				conn.Close(ctx)
+				return nil, err
+			}
+			return &destEndpoints{conn: conn}, nil
+		}
+	}
+
+	conn.Close(ctx)
+	cfg.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	if conn, err = pgx.ConnectConfig(ctx, cfg); err != nil {
+		return nil, withSentinel(ErrConnect, fmt.Errorf("unable to connect to destination database: %w", err))
+	}
+	d := &destEndpoints{conn: conn, pooler: &PoolerReport{
+		Pooler:     destPoolerPgBouncer,
+		Detected:   detected,
+		BypassPort: opts.DestBypassPort,
+		Strategy:   poolerStrategyInsert,
+	}}
+	if opts.DestBypassPort > 0 {
+		direct, err := connectBypass(ctx, conn, cfg, opts.DestBypassPort)
+		if err != nil {
+			report.warn(warnPooler, "destination bypass port %d is not usable, writing with batched INSERTs: %v", opts.DestBypassPort, err)
+		} else {
+			d.direct = direct
+			d.pooler.Bypass, d.pooler.Strategy = true, poolerStrategyDirect
+		}
+	}
+	if d.direct == nil {
+		d.pooler.Unavailable = []string{"COPY", "CSV passthrough", "COPY FREEZE", "the destination lock"}
+	}
+	report.Pooler = d.pooler
+	return d, nil
+}
+
+// detectTransactionPooler returns why conn looks like it goes through a
+// transaction pooler: consecutive statements outside a transaction ran on
+// different server processes. An idle pooler may hand out the same server
+// connection every time, so a quiet one can go unnoticed.
+func detectTransactionPooler(ctx context.Context, conn Querier) (string, error) {
+	var first int32
+	for i := 0; i < poolerProbes; i++ {
+		var pid int32
+		if err := conn.QueryRow(ctx, "SELECT pg_backend_pid()", pgx.QueryExecModeSimpleProtocol).Scan(&pid); err != nil {
+			return "", fmt.Errorf("failed to probe the destination for a pooler: %w", err)
+		}
+		if i == 0 {
+			first = pid
+		} else if pid != first {
+			return fmt.Sprintf("consecutive statements ran on server processes %d and %d", first, pid), nil
+		}
+	}
+	return "", nil
+}
+
+// connectBypass connects to the bypass port of the pooled destination and
+// makes sure it reaches the same database of the same server, unpooled.
+func connectBypass(ctx context.Context, pooled *pgx.Conn, cfg *pgx.ConnConfig, port int) (*pgx.Conn, error) {
+	bypass := cfg.Copy()
+	bypass.Port = uint16(port)
+	bypass.Fallbacks = nil
+	bypass.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	conn, err := pgx.ConnectConfig(ctx, bypass)
+	if err != nil {
+		return nil, err
+	}
+	want, err := serverIdentity(ctx, pooled)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	got, err := serverIdentity(ctx, conn)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	if got != want {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("it reaches %s, not %s", got, want)
+	}
+	if reason, err := detectTransactionPooler(ctx, conn); err != nil || reason != "" {
+		conn.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("it is pooled too: %s", reason)
+	}
+	return conn, nil
+}
+
+// serverIdentity names the database of conn and the server instance by its
+// start time.
+func serverIdentity(ctx context.Context, conn Querier) (string, error) {
+	var id string
+	err := conn.QueryRow(ctx, "SELECT current_database() || ' started ' || pg_postmaster_start_time()::text").Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("failed to identify the destination server: %w", err)
+	}
+	return id, nil
+}
+
+// describe prints the pre-flight lines of the pooler and the strategy.
+func (p *PoolerReport) describe() {
+	how := "--dest-pooler"
+	if p.Detected != "" {
+		how = "detected: " + p.Detected
+	}
+	fmt.Printf("  Destination pooler: %s (%s); statements use the simple protocol\n", p.Pooler, how)
+	if p.Bypass {
+		fmt.Printf("  Copy strategy: COPY through bypass port %d\n", p.BypassPort)
+		return
+	}
+	fmt.Printf("  Copy strategy: batched INSERTs of up to %d rows through the pooler\n", insertBatchRows)
+	for _, what := range p.Unavailable {
+		fmt.Printf("    unavailable: %s\n", what)
+	}
+}
+
+// copyInto writes the rows of src into the table into like CopyFrom, or
+// with insertBatches while the run writes batched INSERTs (see runEnv).
+func copyInto(ctx context.Context, dest CopyConn, into pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	if !runOf(ctx).batched {
+		return dest.CopyFrom(ctx, into, columns, src)
+	}
+	return insertBatches(ctx, dest, into, columns, src)
+}
+
+// insertBatches writes the rows of src with multi-row INSERTs. Outside a
+// transaction it opens one, so that like a COPY a failure writes nothing;
+// the pooler keeps a transaction on one server connection.
+func insertBatches(ctx context.Context, dest CopyConn, into pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	var q Querier = dest
+	if dest.PgConn().TxStatus() == 'I' {
+		tx, err := dest.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback(context.WithoutCancel(ctx))
+		q = tx
+	}
+
+	table := into.Sanitize()
+	var written int64
+	args := make([]any, 0, insertBatchRows*len(columns))
+	flush := func() error {
+		rows := len(args) / len(columns)
+		if rows == 0 {
+			return nil
+		}
+		if _, err := q.Exec(ctx, sqlutil.InsertValues(table, columns, rows), args...); err != nil {
+			return err
+		}
+		written += int64(rows)
+		args = args[:0]
+		return nil
+	}
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, values...)
+		if len(args) == cap(args) {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := src.Err(); err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if tx, ok := q.(pgx.Tx); ok {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+)
+
+// ServerSettings are the database settings that affect how text is stored.
+type ServerSettings struct {
+	Encoding string `json:"server_encoding"`
+	Collate  string `json:"lc_collate"`
+	Ctype    string `json:"lc_ctype"`
+}
+
+type EncodingReport struct {
+	Source      ServerSettings `json:"source"`
+	Destination ServerSettings `json:"destination"`
+}
+
+// readServerSettings reads encoding and locale of the connected database.
+// pg_database is used because lc_collate/lc_ctype are no longer settings on
+// recent PostgreSQL versions.
+func readServerSettings(ctx context.Context, conn Querier) (ServerSettings, error) {
+	var s ServerSettings
+	err := conn.QueryRow(ctx, `
+		SELECT pg_encoding_to_char(encoding), datcollate, datctype
+		FROM pg_database
+		WHERE datname = current_database()
+	`).Scan(&s.Encoding, &s.Collate, &s.Ctype)
+	return s, err
+}
+
+// encodingCanRepresent reports whether text stored in the source encoding is
+// guaranteed to survive in the destination encoding. UTF8 can hold any valid
+// text, but a SQL_ASCII source is unvalidated bytes and may not load.
+func encodingCanRepresent(source, dest string) bool {
+	return source == dest || (dest == "UTF8" && source != "SQL_ASCII")
+}
+
+// preflight runs the checks that must pass before anything is written to the
+// destination.
+func preflight(ctx context.Context, source, dest Querier, opts Options, report *Report) error {
+	fmt.Println("Running pre-flight checks...")
+
+	src, err := readServerSettings(ctx, source)
+	if err != nil {
+		return fmt.Errorf("failed to read source encoding: %w", err)
+	}
+	dst, err := readServerSettings(ctx, dest)
+	if err != nil {
+		return fmt.Errorf("failed to read destination encoding: %w", err)
+	}
+	report.Encoding = &EncodingReport{Source: src, Destination: dst}
+
+	fmt.Printf("  %-12s %-20s %-20s\n", "", "Source", "Destination")
+	fmt.Printf("  %-12s %-20s %-20s\n", "Encoding", src.Encoding, dst.Encoding)
+	fmt.Printf("  %-12s %-20s %-20s\n", "LC_COLLATE", src.Collate, dst.Collate)
+	fmt.Printf("  %-12s %-20s %-20s\n", "LC_CTYPE", src.Ctype, dst.Ctype)
+
+	if src.Collate != dst.Collate {
+		report.warn(warnLocale, "LC_COLLATE differs (source %s, destination %s); sort order of text may change", src.Collate, dst.Collate)
+	}
+	if src.Ctype != dst.Ctype {
+		report.warn(warnLocale, "LC_CTYPE differs (source %s, destination %s); case conversion and character classes may change", src.Ctype, dst.Ctype)
+	}
+	if src.Encoding != dst.Encoding {
+		if !encodingCanRepresent(src.Encoding, dst.Encoding) {
+			if !opts.AllowEncodingMismatch {
+				return fmt.Errorf("destination encoding %s cannot represent all %s source data; use a UTF8 destination or pass --allow-encoding-mismatch", dst.Encoding, src.Encoding)
+			}
+			report.warn(warnEncoding, "destination encoding %s cannot represent all %s source data (allowed by --allow-encoding-mismatch)", dst.Encoding, src.Encoding)
+		} else {
+			report.warn(warnEncoding, "server encoding differs (source %s, destination %s)", src.Encoding, dst.Encoding)
+		}
+	}
+
+	if report.Pooler != nil {
+		report.Pooler.describe()
+	}
+
+	return nil
+}
+
+// checkForeignTables lists destination tables in the destination schemas
+// of the migration that are not part of it, named schema.table outside
+// public. Finding any usually means DATABASE_URL points at the wrong
+// database, so the run stops unless --allow-existing-objects is given.
+// With --table-prefix, tables outside the prefixes belong to other runs and
+// are not counted.
+func checkForeignTables(ctx context.Context, dest Querier, tables []Table, opts Options, report *Report) error {
+	var schemas []string
+	migrated := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		schemas = append(schemas, t.destSchema())
+		migrated[sourceTableKey(t.destSchema(), t.destName())] = true
+		if pc := opts.Config.table(t.Name).PartitionBy; pc != nil {
+			for _, name := range partitionNames(t, pc, opts.PartitionOutliers) {
+				migrated[sourceTableKey(t.destSchema(), name)] = true
+			}
+		}
+	}
+	if len(schemas) == 0 {
+		schemas = []string{defaultSchema}
+	}
+
+	rows, err := dest.Query(ctx, `
+		SELECT schemaname::text, tablename::text
+		FROM pg_tables
+		WHERE schemaname = ANY($1)
+		ORDER BY schemaname, tablename
+	`, distinctSchemas(schemas))
+	if err != nil {
+		return fmt.Errorf("failed to list destination tables: %w", err)
+	}
+	var foreign []string
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list destination tables: %w", err)
+		}
+		if key := sourceTableKey(schema, name); !migrated[key] && hasPrefix(name, opts.TablePrefixes) {
+			foreign = append(foreign, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list destination tables: %w", err)
+	}
+	if len(foreign) == 0 {
+		return nil
+	}
+
+	report.ForeignTables = foreign
+	fmt.Printf("  Destination has %d table(s) that are not part of this migration:\n", len(foreign))
+	for i, name := range foreign {
+		if opts.PlanLimit > 0 && i == opts.PlanLimit {
+			fmt.Printf("    ... and %d more (listed under foreign_tables in the report)\n", len(foreign)-i)
+			break
+		}
+		fmt.Printf("    %s\n", name)
+	}
+	if !opts.AllowExistingObjects {
+		return fmt.Errorf("destination contains %d table(s) not in the migration set; check DATABASE_URL or pass --allow-existing-objects", len(foreign))
+	}
+	report.warn(warnForeignTables, "destination contains %d table(s) not in the migration set (allowed by --allow-existing-objects)", len(foreign))
+	return nil
+}
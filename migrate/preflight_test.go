@@ -0,0 +1,48 @@
+package migrate
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckForeignTables(t *testing.T) {
+	tables := []Table{
+		{Name: "users"},
+		{Name: "sales.orders", Schema: "sales", DestSchema: "xata_sales"},
+	}
+	dest := func() *fakeConn {
+		return &fakeConn{results: []fakeResult{{match: "pg_tables", rows: [][]any{
+			{"public", "stray"},
+			{"public", "users"},
+			{"xata_sales", "old_orders"},
+			{"xata_sales", "orders"},
+		}}}}
+	}
+
+	conn := dest()
+	err := checkForeignTables(context.Background(), conn, tables, Options{}, &Report{})
+	if err == nil || !strings.Contains(err.Error(), "2 table(s) not in the migration set") {
+		t.Fatalf("err = %v, want 2 foreign tables", err)
+	}
+	if args := conn.argsOf("pg_tables"); len(args) != 1 || !slices.Equal(args[0].([]string), []string{"public", "xata_sales"}) {
+		t.Errorf("schemas checked = %v, want public and xata_sales", args)
+	}
+
+	report := &Report{}
+	if err := checkForeignTables(context.Background(), dest(), tables, Options{AllowExistingObjects: true}, report); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"stray", "xata_sales.old_orders"}; !slices.Equal(report.ForeignTables, want) {
+		t.Errorf("ForeignTables = %v, want %v", report.ForeignTables, want)
+	}
+
+	// A run mapped away from public leaves the tables there alone
+	conn = dest()
+	mapped := []Table{{Name: "users", DestSchema: "xata_import"}}
+	_ = checkForeignTables(context.Background(), conn, mapped, Options{AllowExistingObjects: true}, &Report{})
+	if args := conn.argsOf("pg_tables"); len(args) != 1 || !slices.Equal(args[0].([]string), []string{"xata_import"}) {
+		t.Errorf("schemas checked = %v, want xata_import", args)
+	}
+}
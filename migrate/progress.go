@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// newProgressBar, newSilentBar and newBytesBar create the progress bars of
+// the copy and hand them to the reporter of the run.
+func (r *runEnv) newProgressBar(rows int64, desc string) *progressbar.ProgressBar {
+	if r.hideBars {
+		return r.newSilentBar(rows)
+	}
+	bar := progressbar.Default(rows, desc)
+	r.reporter.BarStarted(bar, false)
+	return bar
+}
+
+func (r *runEnv) newSilentBar(rows int64) *progressbar.ProgressBar {
+	bar := progressbar.DefaultSilent(rows)
+	r.reporter.BarStarted(bar, false)
+	return bar
+}
+
+func (r *runEnv) newBytesBar(desc string) *progressbar.ProgressBar {
+	bar := progressbar.DefaultBytes(-1, desc)
+	if r.hideBars {
+		bar = progressbar.DefaultBytesSilent(-1, desc)
+	}
+	r.reporter.BarStarted(bar, true)
+	return bar
+}
+
+// overallProgress tracks progress across all tables. Rows restored from a
+// checkpoint count towards the percentage but not towards the copy rate, so
+// the ETA after --resume is based on what this session has actually done.
+type overallProgress struct {
+	totalRows   int64
+	priorRows   int64
+	sessionRows int64
+	start       time.Time
+	// wal adds the destination WAL generated so far, when monitored
+	wal *walMonitor
+}
+
+func newOverallProgress(totalRows, priorRows int64) *overallProgress {
+	return &overallProgress{totalRows: totalRows, priorRows: priorRows, start: time.Now()}
+}
+
+func (p *overallProgress) add(rows int64) {
+	p.sessionRows += rows
+}
+
+func (p *overallProgress) done() int64 {
+	return p.priorRows + p.sessionRows
+}
+
+func (p *overallProgress) String() string {
+	if p.totalRows == 0 {
+		return "Overall: 100.0%"
+	}
+	done := p.done()
+	pct := float64(done) / float64(p.totalRows) * 100
+	s := fmt.Sprintf("Overall: %.1f%% (%d/%d rows)", pct, done, p.totalRows)
+
+	elapsed := time.Since(p.start)
+	if p.sessionRows > 0 && done < p.totalRows {
+		rate := float64(p.sessionRows) / elapsed.Seconds()
+		eta := time.Duration(float64(p.totalRows-done) / rate * float64(time.Second))
+		s += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return s + p.wal.status()
+}
@@ -0,0 +1,216 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// TableMapping is how the columns of a source table map onto an existing
+// destination table.
+type TableMapping struct {
+	Table       string          `json:"table"`
+	Destination string          `json:"destination"`
+	Columns     []ColumnMapping `json:"columns"`
+	// UnmatchedSource are source columns that are not copied;
+	// UnmatchedDestination are destination columns left to their default
+	UnmatchedSource      []string `json:"unmatched_source,omitempty"`
+	UnmatchedDestination []string `json:"unmatched_destination,omitempty"`
+}
+
+// ColumnMapping is one copied column. Cast is set when the types differ, so
+// the value is read as text and converted by the destination.
+type ColumnMapping struct {
+	Source          string `json:"source"`
+	Destination     string `json:"destination"`
+	SourceType      string `json:"source_type"`
+	DestinationType string `json:"destination_type"`
+	Cast            bool   `json:"cast,omitempty"`
+}
+
+// oneToOne reports whether every column maps onto one of the same name
+// and type, with nothing left over.
+func (m TableMapping) oneToOne() bool {
+	if len(m.UnmatchedSource) > 0 || len(m.UnmatchedDestination) > 0 {
+		return false
+	}
+	for _, c := range m.Columns {
+		if c.Cast || c.Source != c.Destination {
+			return false
+		}
+	}
+	return true
+}
+
+func (m TableMapping) print() {
+	fmt.Printf("  %s -> %s\n", m.Table, m.Destination)
+	for _, c := range m.Columns {
+		switch {
+		case c.Cast:
+			fmt.Printf("    %s -> %s (%s cast to %s)\n", c.Source, c.Destination, c.SourceType, c.DestinationType)
+		default:
+			fmt.Printf("    %s -> %s\n", c.Source, c.Destination)
+		}
+	}
+	for _, name := range m.UnmatchedSource {
+		fmt.Printf("    %s -> (not copied)\n", name)
+	}
+	for _, name := range m.UnmatchedDestination {
+		fmt.Printf("    (none) -> %s (left to its default)\n", name)
+	}
+}
+
+// applyDestSchemaFile runs the SQL file path on the destination when none of
+// the destination tables of tables exists, as on the first run of a
+// migration into a schema kept elsewhere, e.g. by an ORM. Once any exists the
+// file is taken as applied, so resumed and repeated runs leave it alone. The
+// file runs as one simple-protocol batch, which PostgreSQL executes in a
+// single transaction unless the file controls its own.
+func applyDestSchemaFile(ctx context.Context, dest Querier, path string, tables []Table) error {
+	for _, t := range tables {
+		var exists bool
+		if err := dest.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", destIdent(t)).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up %s on the destination: %w", t.qualifiedDestName(), err)
+		}
+		if exists {
+			fmt.Printf("Destination tables exist; not running %s\n", path)
+			return nil
+		}
+	}
+	sql, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read --dest-schema-file: %w", err)
+	}
+	fmt.Printf("Creating the destination tables from %s...\n", path)
+	if _, err := dest.Exec(ctx, string(sql)); err != nil {
+		return &SchemaError{Err: fmt.Errorf("failed to run %s on the destination: %w", path, err)}
+	}
+	return nil
+}
+
+// projectExisting narrows every table in project to the columns that also
+// exist on the destination, for tables whose destination definition is kept
+// rather than recreated. Source columns missing on the destination are
+// recorded in IgnoredColumns and reported as a warning. The mapping of every
+// table is recorded in the report, and printed for those that do not map one
+// to one, before anything is written.
+func projectExisting(ctx context.Context, dest Querier, tables []Table, project map[string]bool, report *Report) error {
+	if len(project) == 0 {
+		return nil
+	}
+	var kept []Table
+	for _, t := range tables {
+		if project[t.Name] {
+			kept = append(kept, onDestination(t))
+		}
+	}
+	destTables, err := introspectSchemas(ctx, dest, tableSchemas(kept))
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	byName := make(map[string]Table, len(destTables))
+	for _, t := range destTables {
+		byName[t.qualifiedName()] = t
+	}
+
+	var mapped []TableMapping
+	for i, t := range tables {
+		if !project[t.Name] {
+			continue
+		}
+		dt, ok := byName[t.qualifiedDestName()]
+		if !ok {
+			return &SchemaError{Table: t.Name, Err: fmt.Errorf("table %s does not exist on the destination", t.qualifiedDestName())}
+		}
+		projected, mapping, err := projectTable(t, dt)
+		if err != nil {
+			return &SchemaError{Table: t.Name, Err: err}
+		}
+		if len(projected.IgnoredColumns) > 0 {
+			report.warnTable(warnIgnoredColumns, t.Name, "table %s: ignoring source column(s) not present on the destination: %s",
+				t.Name, strings.Join(projected.IgnoredColumns, ", "))
+		}
+		tables[i] = projected
+		report.ColumnMappings = append(report.ColumnMappings, mapping)
+		if !mapping.oneToOne() {
+			mapped = append(mapped, mapping)
+		}
+	}
+	if len(mapped) > 0 {
+		fmt.Printf("Column mapping onto existing destination tables (%d of %d do not map one to one):\n", len(mapped), len(project))
+		for _, m := range mapped {
+			m.print()
+		}
+	}
+	return nil
+}
+
+// fillsItself reports whether the server gives the column a value when an
+// insert leaves it out: a default, a generated or identity column, or a
+// serial, whose nextval() default sanitizeColumn turned into the type.
+func (c Column) fillsItself() bool {
+	if c.Default != nil || c.Generated != "" || c.Identity != "" {
+		return true
+	}
+	switch strings.ToUpper(c.DataType) {
+	case "SMALLSERIAL", "SERIAL", "BIGSERIAL":
+		return true
+	}
+	return false
+}
+
+// projectTable returns src restricted to the columns of dst, keeping the
+// source column order, and the mapping. Columns are matched by their
+// destination names. A column whose destination type differs is read as
+// text, which COPY and the row path alike convert to the destination type,
+// so the destination decides whether each value fits. It fails when a
+// destination column that must be filled (NOT NULL without a value of its
+// own, see fillsItself) or a primary key column has no counterpart on the
+// other side.
+func projectTable(src, dst Table) (Table, TableMapping, error) {
+	mapping := TableMapping{Table: src.Name, Destination: dst.qualifiedName()}
+	for _, c := range dst.Columns {
+		if _, ok := src.columnByDest(c.Name); !ok {
+			if c.IsNullable == "NO" && !c.fillsItself() {
+				return Table{}, mapping, fmt.Errorf("table %s: destination column %s is NOT NULL without default and has no source column", src.Name, c.Name)
+			}
+			mapping.UnmatchedDestination = append(mapping.UnmatchedDestination, c.Name)
+		}
+	}
+
+	projected := src
+	projected.Columns = nil
+	projected.IgnoredColumns = nil
+	for _, c := range src.Columns {
+		dc, ok := dst.column(c.destName())
+		if !ok {
+			projected.IgnoredColumns = append(projected.IgnoredColumns, c.Name)
+			continue
+		}
+		cm := ColumnMapping{Source: c.Name, Destination: dc.Name, SourceType: castType(c), DestinationType: castType(dc)}
+		// Converted columns already have the type they are written as
+		if c.SourceExpr == "" && c.UUIDKey == nil && !strings.EqualFold(cm.SourceType, cm.DestinationType) {
+			cm.Cast = true
+			c.SourceExpr = sqlutil.QuoteIdent(c.Name) + "::text"
+			c.DataType = dc.DataType
+		}
+		// Only a column generated on the destination is left to it
+		c.Generated, c.GeneratedVirtual = dc.Generated, dc.GeneratedVirtual
+		c.Identity = dc.Identity
+		mapping.Columns = append(mapping.Columns, cm)
+		projected.Columns = append(projected.Columns, c)
+	}
+	mapping.UnmatchedSource = projected.IgnoredColumns
+	for _, k := range src.PrimaryKey {
+		if _, ok := projected.column(k); !ok {
+			return Table{}, mapping, fmt.Errorf("table %s: primary key column %s does not exist on the destination", src.Name, k)
+		}
+	}
+	if len(projected.Columns) == 0 {
+		return Table{}, mapping, fmt.Errorf("table %s: no source column exists on the destination", src.Name)
+	}
+	return projected, mapping, nil
+}
@@ -0,0 +1,46 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProjectTableDestinationOnlyColumns(t *testing.T) {
+	def := "'none'::text"
+	src := Table{Name: "users", PrimaryKey: []string{"email"}, Columns: []Column{
+		{Name: "email", DataType: "text", IsNullable: "NO"},
+	}}
+	for _, tt := range []struct {
+		name    string
+		column  Column
+		wantErr bool
+	}{
+		{"serial", Column{Name: "id", DataType: "SERIAL", IsNullable: "NO"}, false},
+		{"bigserial", Column{Name: "id", DataType: "BIGSERIAL", IsNullable: "NO"}, false},
+		{"smallserial", Column{Name: "id", DataType: "smallserial", IsNullable: "NO"}, false},
+		{"identity always", Column{Name: "id", DataType: "bigint", IsNullable: "NO", Identity: "ALWAYS"}, false},
+		{"identity by default", Column{Name: "id", DataType: "integer", IsNullable: "NO", Identity: "BY DEFAULT"}, false},
+		{"generated", Column{Name: "lower_email", DataType: "text", IsNullable: "NO", Generated: "lower(email)"}, false},
+		{"default", Column{Name: "note", DataType: "text", IsNullable: "NO", Default: &def}, false},
+		{"nullable", Column{Name: "note", DataType: "text", IsNullable: "YES"}, false},
+		{"plain not null", Column{Name: "note", DataType: "text", IsNullable: "NO"}, true},
+		{"not null integer", Column{Name: "id", DataType: "integer", IsNullable: "NO"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := Table{Name: "users", Columns: []Column{{Name: "email", DataType: "text", IsNullable: "NO"}, tt.column}}
+			projected, mapping, err := projectTable(src, dst)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "NOT NULL without default") {
+					t.Errorf("error = %v, want a NOT NULL column without a source", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(projected.Columns) != 1 || len(mapping.UnmatchedDestination) != 1 || mapping.UnmatchedDestination[0] != tt.column.Name {
+				t.Errorf("projected %+v, unmatched %v; want email copied and %s left to the destination", projected.Columns, mapping.UnmatchedDestination, tt.column.Name)
+			}
+		})
+	}
+}
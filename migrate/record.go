@@ -0,0 +1,121 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sqlRecorder is the destination Querier of a run with --ddl-out. It writes
+// every statement to the script instead of running it, under a marker for
+// the phase that issued it; queries still go to the destination, so phases
+// can look at what is there. Statements are recorded exactly as they would
+// be sent, with every rename and schema route applied.
+type sqlRecorder struct {
+	Querier
+	file   *os.File
+	phase  Phase
+	marked bool
+	count  int
+}
+
+func newSQLRecorder(path string, dest Querier, runID string) (*sqlRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	r := &sqlRecorder{Querier: dest, file: f}
+	if _, err := fmt.Fprintf(f, "-- Recorded by a dry run (run %s) at %s\n", runID, formatTimestamp(utcNow())); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// startPhase sets the phase of the following statements. Its marker is
+// only written once the phase records something.
+func (r *sqlRecorder) startPhase(phase Phase) {
+	r.phase, r.marked = phase, false
+}
+
+func (r *sqlRecorder) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if len(args) > 0 {
+		return pgconn.CommandTag{}, fmt.Errorf("cannot record a statement with parameters: %s", sql)
+	}
+	if !r.marked {
+		if _, err := fmt.Fprintf(r.file, "\n-- phase: %s\n", r.phase); err != nil {
+			return pgconn.CommandTag{}, fmt.Errorf("failed to record statement: %w", err)
+		}
+		r.marked = true
+	}
+	if _, err := fmt.Fprintf(r.file, "%s;\n", sql); err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("failed to record statement: %w", err)
+	}
+	r.count++
+	return pgconn.CommandTag{}, nil
+}
+
+func (r *sqlRecorder) Close() error {
+	return r.file.Close()
+}
+
+// recording reports whether statements on q are recorded rather than run.
+// Checks that need the data to be there, like the foreign key violation
+// count, are skipped then.
+func recording(q Querier) bool {
+	_, ok := q.(*sqlRecorder)
+	return ok
+}
+
+// recordPhases runs the phases that change the destination schema
+// (create-schema, indexes, constraints, statistics) with their statements recorded
+// to --ddl-out, after a dry run's plan.
+func (m *Migrator) recordPhases(ctx context.Context, state *MigrationState) error {
+	rec, err := newSQLRecorder(m.opts.DDLOut, m.dest, state.Checkpoint.RunID)
+	if err != nil {
+		return err
+	}
+	dest := m.dest
+	m.dest, m.recorder = rec, rec
+	defer func() {
+		m.dest, m.recorder = dest, nil
+		// Foreign keys were only detached in the script
+		state.detached = nil
+	}()
+
+	if err := m.CreateSchema(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.Indexes(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.Constraints(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.Statistics(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.MatViews(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.Triggers(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := m.Policies(ctx, state); err != nil {
+		rec.Close()
+		return err
+	}
+	if err := rec.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", m.opts.DDLOut, err)
+	}
+	fmt.Printf("Recorded %d statement(s) to %s\n", rec.count, m.opts.DDLOut)
+	return nil
+}
@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// The constraint of a checked relationship on the destination
+	referenceValid    = "valid"
+	referenceNotValid = "not_valid"
+	referenceMissing  = "missing"
+)
+
+// RelationshipConfig is a reference between tables that the source has no
+// foreign key for, such as a link column, to be checked by verification.
+// Columns name the source columns of the table, RefColumns those of
+// RefTable.
+type RelationshipConfig struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+}
+
+// ReferenceCheck counts the destination rows of one relationship whose
+// referenced row is missing.
+type ReferenceCheck struct {
+	Table      string   `json:"table"`
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+	// Constraint is valid, not_valid or missing on the destination
+	Constraint string `json:"constraint"`
+	// Configured is set for relationships from the config
+	Configured bool  `json:"configured,omitempty"`
+	Orphans    int64 `json:"orphans"`
+	// SampleKeys are the key values of a few orphaned rows
+	SampleKeys [][]string `json:"sample_keys,omitempty"`
+}
+
+// relationships returns the foreign keys of t and its configured
+// relationships, by source names.
+func relationships(t Table, cfg *Config) []foreignKey {
+	out := append([]foreignKey(nil), t.ForeignKeys...)
+	for _, r := range cfg.table(t.Name).Relationships {
+		name := r.Name
+		if name == "" {
+			name = t.baseName() + "_" + strings.Join(r.Columns, "_") + "_ref"
+		}
+		out = append(out, foreignKey{Table: t.Name, Name: name, Columns: r.Columns, RefTable: r.RefTable, RefColumns: r.RefColumns})
+	}
+	return out
+}
+
+// destinationConstraints returns whether each foreign key on the
+// destination, by "schema.table.name", is validated.
+func destinationConstraints(ctx context.Context, dest Querier) (map[string]bool, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname || '.' || con.conname, con.convalidated
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'f'
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination foreign keys: %w", err)
+	}
+	out := map[string]bool{}
+	var name string
+	var validated bool
+	_, err = pgx.ForEachRow(rows, []any{&name, &validated}, func() error {
+		out[name] = validated
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination foreign keys: %w", err)
+	}
+	return out, nil
+}
+
+// checkReferences counts the orphaned rows on the destination of every
+// foreign key and configured relationship of tables whose constraint is not
+// validated there: left NOT VALID, or never created. A relationship to a
+// table outside the run, all being the run's tables, is checked against the
+// destination table a run would have given it, if there is one;
+// relationships on columns that are not copied are left out.
+func checkReferences(ctx context.Context, dest Querier, tables, all []Table, opts Options) ([]ReferenceCheck, error) {
+	constraints, err := destinationConstraints(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]Table, len(all))
+	for _, t := range all {
+		byName[t.Name] = t
+	}
+
+	var out []ReferenceCheck
+	for _, t := range tables {
+		configured := len(t.ForeignKeys)
+		for i, fk := range relationships(t, opts.Config) {
+			if len(missingColumns(t, fk.Columns)) > 0 {
+				continue
+			}
+			ref, ok := byName[fk.RefTable]
+			if !ok {
+				ref = outsideTable(fk, opts)
+				var found bool
+				if err := dest.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", destIdent(ref)).Scan(&found); err != nil {
+					return nil, fmt.Errorf("failed to look up %s on the destination: %w", ref.qualifiedDestName(), err)
+				}
+				if !found {
+					continue
+				}
+			} else if len(missingColumns(ref, fk.RefColumns)) > 0 {
+				continue
+			}
+			d := fk.onDestination(t, ref)
+			d.partitioned = opts.Config.table(t.Name).PartitionBy != nil
+			d.refPartitioned = ok && opts.Config.table(ref.Name).PartitionBy != nil
+
+			rc := ReferenceCheck{Table: t.Name, Name: fk.Name, Columns: fk.Columns, RefTable: fk.RefTable, RefColumns: fk.RefColumns, Constraint: referenceMissing, Configured: i >= configured}
+			if validated, exists := constraints[t.qualifiedDestName()+"."+d.Name]; exists {
+				rc.Constraint = referenceNotValid
+				if validated {
+					// A validated key holds, so it needs no count
+					rc.Constraint = referenceValid
+					out = append(out, rc)
+					continue
+				}
+			}
+			if rc.Orphans, rc.SampleKeys, err = countOrphans(ctx, dest, d); err != nil {
+				return nil, err
+			}
+			out = append(out, rc)
+		}
+	}
+	return out, nil
+}
+
+// printReferences prints the relationships with orphaned rows.
+func printReferences(checks []ReferenceCheck) {
+	var orphaned int
+	for _, rc := range checks {
+		if rc.Orphans > 0 {
+			orphaned++
+			fmt.Printf("  %s on %s -> %s (%s): %d orphaned row(s), e.g. %s\n",
+				rc.Name, rc.Table, rc.RefTable, rc.Constraint, rc.Orphans, formatSamples(rc.SampleKeys))
+		}
+	}
+	fmt.Printf("Checked %d relationship(s), %d with orphaned rows.\n", len(checks), orphaned)
+}
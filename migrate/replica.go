@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Values of --source-endpoint
+const (
+	sourceEndpointAuto    = "auto"
+	sourceEndpointReplica = "replica"
+	sourceEndpointPrimary = "primary"
+)
+
+// sourceEndpoints holds the connections table data can be read from. Schema
+// and row counts always come from the primary; bulk reads prefer the
+// replica when there is one.
+type sourceEndpoints struct {
+	primary *SourceConn
+	replica *SourceConn
+	mode    string
+	// pinned is the connection holding the exported snapshot of
+	// --consistent-snapshot, which every read then uses
+	pinned *SourceConn
+}
+
+// connectReplica opens the replica connection for modes that use it. In auto
+// mode an unreachable replica is logged and the primary is used instead.
+// The connection counts against slots.
+func connectReplica(ctx context.Context, url, mode string, slots *sourceLimiter) (*SourceConn, error) {
+	if mode == sourceEndpointPrimary || url == "" {
+		if mode == sourceEndpointReplica {
+			return nil, fmt.Errorf("--source-endpoint replica requires %s", replicaURLVar)
+		}
+		return nil, nil
+	}
+	fmt.Println("Connecting to Source replica...")
+	conn, err := connectSource(ctx, url, slots)
+	if err != nil {
+		if mode == sourceEndpointReplica {
+			return nil, withSentinel(ErrConnect, fmt.Errorf("unable to connect to source replica: %w", err))
+		}
+		log.Printf("Warning: unable to connect to source replica, reading from the primary: %v", err)
+		return nil, nil
+	}
+	fmt.Println("Connected to Source replica.")
+	return conn, nil
+}
+
+// replicaFallback reports whether a failed read from the replica should be
+// repeated on the primary: the replica went away, refused the connection,
+// or cancelled the query because it lags (snapshot too old, conflict with
+// recovery).
+func replicaFallback(err error) bool {
+	if errorEndpoint(err) == endpointDestination {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "72000" { // snapshot_too_old
+		return true
+	}
+	return isTransient(err)
+}
+
+// read runs fn against the preferred source connection and returns which
+// endpoint served it. In auto mode a replica failure that replicaFallback
+// accepts is retried on the primary; a replica that lost its connection is
+// not tried again for later tables. With a pinned snapshot there is no
+// fallback, since the other endpoint cannot read the snapshot.
+func (s *sourceEndpoints) read(table string, report *Report, fn func(src *SourceConn) error) (string, error) {
+	if s.pinned != nil {
+		endpoint := sourceEndpointPrimary
+		if s.pinned == s.replica {
+			endpoint = sourceEndpointReplica
+		}
+		if s.pinned.snapshot == "" {
+			return endpoint, onEndpoint(endpointSource, errSnapshotLost)
+		}
+		return endpoint, s.pinned.inSavepoint(context.Background(), "farewall_read", func() error { return fn(s.pinned) })
+	}
+	if s.replica != nil {
+		err := fn(s.replica)
+		if err == nil || s.mode == sourceEndpointReplica || !replicaFallback(err) {
+			return sourceEndpointReplica, err
+		}
+		report.warnTable(warnReplicaFallback, table, "table %s: reading from the replica failed (%v); falling back to the primary", table, err)
+		if s.replica.IsClosed() {
+			s.replica = nil
+		}
+	}
+	return sourceEndpointPrimary, fn(s.primary)
+}
+
+// reconnect replaces the source connections that were lost, and reports
+// whether there were any.
+func (s *sourceEndpoints) reconnect(ctx context.Context) (bool, error) {
+	var reconnected bool
+	for _, conn := range []*SourceConn{s.primary, s.replica} {
+		if conn == nil || !conn.IsClosed() {
+			continue
+		}
+		if err := conn.reconnect(ctx); err != nil {
+			return reconnected, onEndpoint(endpointSource, withSentinel(ErrConnect, fmt.Errorf("failed to reconnect to the source: %w", err)))
+		}
+		reconnected = true
+	}
+	return reconnected, nil
+}
+
+func printEndpoint(endpoint string) {
+	if endpoint == sourceEndpointReplica {
+		fmt.Println("  Read from the replica")
+	}
+}
@@ -0,0 +1,318 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Report is the machine-readable summary written with --report.
+type Report struct {
+	// Migration names the migration of a config that declares several
+	Migration      string    `json:"migration,omitempty"`
+	RunID          string    `json:"run_id"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Status         string    `json:"status"`
+	Error          string    `json:"error,omitempty"`
+	// ErrorKind classifies Error, see classifyError
+	ErrorKind string `json:"error_kind,omitempty"`
+	Resumed   bool   `json:"resumed"`
+	// Only is set for partial runs restricted with --only
+	Only []string `json:"only,omitempty"`
+	// Attempts lists every attempt of a run with --retries, the last one
+	// being this report
+	Attempts []AttemptReport `json:"attempts,omitempty"`
+
+	// Session counters cover only this invocation; Total counters include
+	// rows copied by earlier runs that were picked up from the checkpoint.
+	RowsCopiedSession  int64 `json:"rows_copied_session"`
+	RowsCopiedTotal    int64 `json:"rows_copied_total"`
+	BytesCopiedSession int64 `json:"bytes_copied_session"`
+	BytesCopiedTotal   int64 `json:"bytes_copied_total"`
+
+	DryRun        bool            `json:"dry_run,omitempty"`
+	Estimate      *ReadEstimate   `json:"estimate,omitempty"`
+	Encoding      *EncodingReport `json:"encoding,omitempty"`
+	ForeignTables []string        `json:"foreign_tables,omitempty"`
+	// CascadePreview lists the objects outside the migration that dropping
+	// the recreated tables removes, found by the plan
+	CascadePreview []CascadeObject `json:"cascade_preview,omitempty"`
+	// CascadeDropped lists everything the table drops removed besides the
+	// tables, looked up right before each drop
+	CascadeDropped []CascadeObject `json:"cascade_dropped,omitempty"`
+	// Pooler describes the transaction pooler in front of the destination
+	Pooler *PoolerReport `json:"pooler,omitempty"`
+	// ReservedTables lists destination tables the source collided with and
+	// the on_existing policy applied to each
+	ReservedTables []ReservedTable `json:"reserved_tables,omitempty"`
+	// SyncedTables lists the tables --mode sync upserted into their existing
+	// destination table
+	SyncedTables []string `json:"synced_tables,omitempty"`
+	// SchemaChanges lists source columns deliberately left out or converted
+	SchemaChanges []SchemaChange `json:"schema_changes,omitempty"`
+	// Identifiers lists generated names shortened to fit PostgreSQL's limit
+	Identifiers []IdentifierMapping `json:"identifiers,omitempty"`
+	// Renames lists objects created under another name than on the source
+	Renames  []IdentifierRename `json:"renames,omitempty"`
+	Warnings []string           `json:"warnings,omitempty"`
+	// WarningCounts counts every warning by code, SuppressedWarnings those
+	// the config suppressed
+	WarningCounts      map[warningCode]int `json:"warning_counts,omitempty"`
+	SuppressedWarnings map[warningCode]int `json:"suppressed_warnings,omitempty"`
+	suppressions       []Suppression
+	// run receives the warnings and finished tables (see attach)
+	run *runEnv
+	// LoadHooks lists destination triggers and rules that fired, or were
+	// disabled, during the load
+	LoadHooks []*LoadHook `json:"load_hooks,omitempty"`
+	// Summary compares object counts and sizes of both sides at the end
+	// of the run
+	Summary *DatabaseSummary `json:"summary,omitempty"`
+	// SmokeChecks are the results of the config's smoke_checks
+	SmokeChecks []SmokeCheckResult `json:"smoke_checks,omitempty"`
+	// Indexes lists the secondary indexes created by the run
+	Indexes []IndexReport `json:"indexes,omitempty"`
+	// Constraints lists the foreign keys created by the run
+	Constraints []ConstraintReport `json:"constraints,omitempty"`
+	// MissingReferences lists the foreign keys referencing tables outside
+	// the run, found by the plan
+	MissingReferences []MissingReference `json:"missing_references,omitempty"`
+	// References counts the orphaned rows of every relationship whose
+	// constraint is not validated, found by the verify phase
+	References []ReferenceCheck `json:"references,omitempty"`
+	// Extensions lists the source's extensions and what became of them
+	Extensions []ExtensionReport `json:"extensions,omitempty"`
+	// Enums lists the enum types created or reconciled before the tables
+	Enums []EnumReport `json:"enums,omitempty"`
+	// Domains lists the domains created, found or flattened
+	Domains []DomainReport `json:"domains,omitempty"`
+	// Composites lists the composite types created or found
+	Composites []CompositeReport `json:"composites,omitempty"`
+	// ColumnMappings lists how the tables kept on the destination are
+	// filled, column by column
+	ColumnMappings []TableMapping `json:"column_mappings,omitempty"`
+	// Functions lists the functions of --include-functions, Triggers the
+	// triggers of --include-triggers
+	Functions []FunctionReport `json:"functions,omitempty"`
+	Triggers  []TriggerReport  `json:"triggers,omitempty"`
+	// Policies lists the row-level security policies of the policies phase,
+	// RowSecurity the tables it enabled row-level security on
+	Policies    []PolicyReport      `json:"policies,omitempty"`
+	RowSecurity []RowSecurityReport `json:"row_security,omitempty"`
+	// SchemaFailure is set when the create-schema phase failed
+	SchemaFailure *SchemaFailure `json:"schema_failure,omitempty"`
+	// MatViews lists the materialized views of the matviews phase
+	MatViews []MatViewReport `json:"materialized_views,omitempty"`
+	// SequenceGrants lists the sequence grants of --include-grants
+	SequenceGrants []SequenceGrant `json:"sequence_grants,omitempty"`
+	// TableGrants lists the table grants and owner changes of
+	// --include-grants and --include-ownership
+	TableGrants []TableGrant `json:"table_grants,omitempty"`
+	// Statistics summarizes statistics targets, extended statistics and
+	// ANALYZE after the load
+	Statistics *StatisticsReport `json:"statistics,omitempty"`
+	// Bloat lists the dead tuples and index sizes of the synced tables,
+	// with VACUUM FULL and REINDEX advice
+	Bloat []BloatReport `json:"bloat,omitempty"`
+	// WAL summarizes the WAL the destination generated during the copy,
+	// when its position could be read
+	WAL *WALReport `json:"wal,omitempty"`
+	// SourcePosition is where the source stood when the copy started and
+	// finished
+	SourcePosition *SourceReadPositions `json:"source_position,omitempty"`
+	// SourceConnections summarizes the use of --source-connection-limit
+	SourceConnections *SourceConnectionReport `json:"source_connections,omitempty"`
+	// Retries sums the retry statistics of all tables
+	Retries *RetryStats `json:"retries,omitempty"`
+
+	Tables []*TableReport `json:"tables"`
+}
+
+type TableReport struct {
+	Name string `json:"name"`
+	// Destination is the schema-qualified destination table
+	Destination        string `json:"destination,omitempty"`
+	Status             string `json:"status"`
+	Method             string `json:"method,omitempty"`
+	RowsCopiedSession  int64  `json:"rows_copied_session"`
+	RowsCopiedTotal    int64  `json:"rows_copied_total"`
+	BytesCopiedSession int64  `json:"bytes_copied_session"`
+	BytesCopiedTotal   int64  `json:"bytes_copied_total"`
+
+	Normalizations []ColumnNormalization `json:"normalizations,omitempty"`
+	Transforms     []ColumnTransform     `json:"transforms,omitempty"`
+	Differential   *DifferentialStats    `json:"differential,omitempty"`
+	IgnoredColumns []string              `json:"ignored_columns,omitempty"`
+	Retries        *RetryStats           `json:"retries,omitempty"`
+	// SourceEndpoint is "primary" or "replica", see --source-endpoint
+	SourceEndpoint string `json:"source_endpoint,omitempty"`
+	// OrderBy is the read order with --ordered-copy
+	OrderBy string `json:"order_by,omitempty"`
+	// OrphansDeleted counts rows deleted by --on-fk-violation delete-orphans
+	OrphansDeleted int64 `json:"orphans_deleted,omitempty"`
+	// Frozen is set when the table was loaded with COPY FREEZE
+	Frozen bool `json:"frozen,omitempty"`
+	// ChunkVerification counts the ranges checked with --verify-chunks
+	ChunkVerification *ChunkVerification `json:"chunk_verification,omitempty"`
+	// FetchSize is the rows per FETCH when the table was read through a
+	// cursor
+	FetchSize int `json:"fetch_size,omitempty"`
+	// FetchSizing summarizes the fetch sizes adapted with --fetch-target
+	FetchSizing *FetchSizing `json:"fetch_sizing,omitempty"`
+	// Sequences are the SERIAL sequences set to the copied maximum
+	Sequences []SequenceReset `json:"sequences,omitempty"`
+	// IncrementalSince is the watermark an --incremental run read the rows
+	// from, unset for a full copy; Watermark the one recorded for the next
+	IncrementalSince *time.Time `json:"incremental_since,omitempty"`
+	Watermark        *time.Time `json:"watermark,omitempty"`
+}
+
+const (
+	tableStatusCopied  = "copied"
+	tableStatusEmpty   = "empty"
+	tableStatusResumed = "completed_previously"
+	tableStatusSynced  = "synced"
+	// tableStatusPartitioned is a partitioned table, whose rows are those of
+	// its partitions
+	tableStatusPartitioned = "partitioned"
+	// tableStatusSkipped tables were skipped from the --tui
+	tableStatusSkipped = "skipped"
+	// tableStatusOrphansDeleted marks a table outside the run that only lost
+	// rows violating a foreign key
+	tableStatusOrphansDeleted = "orphans_deleted"
+
+	methodDifferential = "differential"
+	methodUpsert       = "upsert"
+	// methodStaged loads through a staging table to encrypt columns with
+	// pgcrypto
+	methodStaged = "staged"
+	// methodKeyset copies chunks of rows by primary key (see
+	// copyTableKeyset)
+	methodKeyset = "keyset"
+)
+
+func newReport(resumed bool) *Report {
+	return &Report{StartedAt: utcNow(), Resumed: resumed}
+}
+
+// attach hands the warnings and finished tables of r to the reporter of
+// run, starting with the warnings recorded so far.
+func (r *Report) attach(run *runEnv) {
+	r.run = run
+	for _, msg := range r.Warnings {
+		run.reporter.Warning(msg)
+	}
+}
+
+// reporter returns the reporter of the run r is attached to.
+func (r *Report) reporter() ProgressReporter {
+	if r.run == nil {
+		return noRun.reporter
+	}
+	return r.run.reporter
+}
+
+// warn prints a warning of code and records it in the report, unless the
+// config suppresses it; a suppressed warning is only counted.
+func (r *Report) warn(code warningCode, format string, args ...any) {
+	r.warnTable(code, "", format, args...)
+}
+
+// warnTable is warn for a warning about the source table table, so that
+// suppressions scoped to table patterns apply to it.
+func (r *Report) warnTable(code warningCode, table, format string, args ...any) {
+	if r.WarningCounts == nil {
+		r.WarningCounts = map[warningCode]int{}
+	}
+	r.WarningCounts[code]++
+	if suppressed(r.suppressions, code, table) {
+		if r.SuppressedWarnings == nil {
+			r.SuppressedWarnings = map[warningCode]int{}
+		}
+		r.SuppressedWarnings[code]++
+		return
+	}
+	msg := string(code) + ": " + fmt.Sprintf(format, args...)
+	log.Printf("Warning %s", msg)
+	r.Warnings = append(r.Warnings, msg)
+	r.reporter().Warning(msg)
+}
+
+func (r *Report) addTable(tr *TableReport) {
+	r.reporter().TableFinished(tr.Name, tr.Status, tr.RowsCopiedTotal)
+	r.Tables = append(r.Tables, tr)
+	r.RowsCopiedSession += tr.RowsCopiedSession
+	r.RowsCopiedTotal += tr.RowsCopiedTotal
+	r.BytesCopiedSession += tr.BytesCopiedSession
+	r.BytesCopiedTotal += tr.BytesCopiedTotal
+	if tr.Retries != nil {
+		if r.Retries == nil {
+			r.Retries = &RetryStats{}
+		}
+		r.Retries.add(tr.Retries)
+	}
+}
+
+// setDestinations fills in the destination of every table report of tables.
+func (r *Report) setDestinations(tables []Table) {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+	for _, tr := range r.Tables {
+		if t, ok := byName[tr.Name]; ok {
+			tr.Destination = t.qualifiedDestName()
+		}
+	}
+}
+
+// addOrphansDeleted records rows of a table deleted for violating a foreign
+// key. Tables outside the run (e.g. referencing a table of an --only run)
+// get an entry of their own.
+func (r *Report) addOrphansDeleted(table string, n int64) {
+	for _, tr := range r.Tables {
+		if tr.Name == table {
+			tr.OrphansDeleted += n
+			return
+		}
+	}
+	r.Tables = append(r.Tables, &TableReport{Name: table, Status: tableStatusOrphansDeleted, OrphansDeleted: n})
+}
+
+func (r *Report) finish(err error) {
+	r.FinishedAt = utcNow()
+	r.ElapsedSeconds = elapsedSeconds(r.StartedAt, r.FinishedAt)
+	if err != nil {
+		r.Status = "failed"
+		r.Error = err.Error()
+		r.ErrorKind = classifyError(err)
+	} else {
+		r.Status = "succeeded"
+	}
+	if n := r.suppressedCount(); n > 0 {
+		fmt.Printf("%d warning(s) suppressed by the config\n", n)
+	}
+}
+
+func (r *Report) suppressedCount() int {
+	n := 0
+	for _, c := range r.SuppressedWarnings {
+		n += c
+	}
+	return n
+}
+
+func (r *Report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	return nil
+}
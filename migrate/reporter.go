@@ -0,0 +1,130 @@
+package migrate
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// These statuses are only reported to the ProgressReporter; a failed table
+// ends the run, and the report records the error instead.
+const (
+	tableStatusPending = "pending"
+	tableStatusCopying = "copying"
+	tableStatusFailed  = "failed"
+)
+
+// ProgressReporter follows the copy phase table by table. The default one
+// does nothing, leaving the console output as it is; --tui installs one
+// that draws a live table (see tuiReporter). Calls come from the copy, in
+// the order the tables are copied; BarStarted may be called from several
+// goroutines for parallel ranges.
+type ProgressReporter interface {
+	// CopyStarted lists the tables of the copy and their row counts
+	CopyStarted(tables []string, rows []int64)
+	TableStarted(table string)
+	// BarStarted hands over each progress bar of the table being copied;
+	// bytes bars count bytes rather than rows
+	BarStarted(bar *progressbar.ProgressBar, bytes bool)
+	// TableFinished reports the table's status (see TableReport.Status,
+	// or tableStatusFailed) and rows copied
+	TableFinished(table, status string, rows int64)
+	Warning(msg string)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) CopyStarted([]string, []int64)             {}
+func (nopReporter) TableStarted(string)                       {}
+func (nopReporter) BarStarted(*progressbar.ProgressBar, bool) {}
+func (nopReporter) TableFinished(string, string, int64)       {}
+func (nopReporter) Warning(string)                            {}
+
+// copyControl pauses the copy and skips the table being copied, on request
+// of the --tui keys. The copy checks it for every row or buffer it sends
+// (see wait), so a paused copy keeps its COPY open like a --max-wal-rate
+// pause.
+type copyControl struct {
+	// active is set while a pause or a skip is requested, so wait costs one
+	// atomic load otherwise
+	active atomic.Bool
+	skip   atomic.Bool
+
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed when the pause ends
+	resumed chan struct{}
+}
+
+// errTableSkipped ends the copy of a table skipped with copyControl.
+var errTableSkipped = errors.New("table skipped on request")
+
+// wait blocks while the copy is paused and returns errTableSkipped once
+// the table is to be skipped.
+func (c *copyControl) wait() error {
+	if !c.active.Load() {
+		return nil
+	}
+	c.mu.Lock()
+	paused, resumed := c.paused, c.resumed
+	c.mu.Unlock()
+	if paused {
+		<-resumed
+	}
+	if c.skip.Load() {
+		return errTableSkipped
+	}
+	return nil
+}
+
+// togglePause pauses or resumes the copy and reports whether it is paused.
+func (c *copyControl) togglePause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		c.resumeLocked()
+		return false
+	}
+	c.paused, c.resumed = true, make(chan struct{})
+	c.active.Store(true)
+	return true
+}
+
+func (c *copyControl) resumeLocked() {
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+	c.active.Store(c.skip.Load())
+}
+
+// requestSkip stops the copy of the current table, resuming a paused copy.
+func (c *copyControl) requestSkip() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skip.Store(true)
+	c.active.Store(true)
+	c.resumeLocked()
+}
+
+// release ends a pause and forgets a skip, when the TUI goes away.
+func (c *copyControl) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skip.Store(false)
+	c.resumeLocked()
+}
+
+func (c *copyControl) skipRequested() bool {
+	return c.skip.Load()
+}
+
+// tableDone forgets a skip once the copy of the table stopped.
+func (c *copyControl) tableDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skip.Store(false)
+	c.active.Store(c.paused)
+}
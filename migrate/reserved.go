@@ -0,0 +1,182 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// on_existing policies for a source table whose destination table is
+// reserved (see findReservedTables)
+const (
+	onExistingSkip   = "skip"
+	onExistingRename = "rename"
+	onExistingMerge  = "merge"
+)
+
+// ReservedTable is a destination table the migration must not drop or
+// truncate: it belongs to an extension, or to a role the migration role is
+// not a member of. Dropping it with CASCADE would take the extension's
+// dependent objects along.
+type ReservedTable struct {
+	// Table is the schema-qualified destination table
+	Table  string `json:"table"`
+	Source string `json:"source"`
+	Owner  string `json:"owner"`
+	// Extension is set for tables that are members of an extension
+	Extension string `json:"extension,omitempty"`
+	// Policy is the on_existing policy applied, if any
+	Policy string `json:"policy,omitempty"`
+}
+
+func (r ReservedTable) reason() string {
+	if r.Extension != "" {
+		return "belongs to extension " + r.Extension
+	}
+	return "is owned by " + r.Owner
+}
+
+// findReservedTables returns the reserved destination tables that tables
+// would be created as, keyed by source table name.
+func findReservedTables(ctx context.Context, dest Querier, tables []Table) (map[string]ReservedTable, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(tables))
+	sources := make(map[string]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.qualifiedDestName()
+		sources[names[i]] = t.Name
+	}
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname, pg_get_userbyid(c.relowner), coalesce(e.extname::text, '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+		LEFT JOIN pg_extension e ON e.oid = d.refobjid
+		WHERE c.relkind IN ('r', 'p')
+		  AND n.nspname || '.' || c.relname = ANY($1)
+		  AND (e.oid IS NOT NULL OR NOT pg_has_role(c.relowner, 'MEMBER'))
+		ORDER BY 1
+	`, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for reserved destination tables: %w", err)
+	}
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ReservedTable, error) {
+		var r ReservedTable
+		err := row.Scan(&r.Table, &r.Owner, &r.Extension)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for reserved destination tables: %w", err)
+	}
+	out := make(map[string]ReservedTable, len(found))
+	for _, r := range found {
+		r.Source = sources[r.Table]
+		out[r.Source] = r
+	}
+	return out, nil
+}
+
+// checkReservedTables stops the run when a table would be created over a
+// reserved destination table without an on_existing policy, and applies
+// the policies of the others: skipped tables are returned in skip, merged
+// ones in merge. A renamed table that still lands on a reserved table is
+// refused too.
+func checkReservedTables(ctx context.Context, dest Querier, tables []Table, cfg *Config, report *Report) (skip, merge map[string]bool, err error) {
+	reserved, err := findReservedTables(ctx, dest, tables)
+	if err != nil || len(reserved) == 0 {
+		return nil, nil, err
+	}
+
+	skip, merge = map[string]bool{}, map[string]bool{}
+	var refused, mergeTables []string
+	fmt.Printf("  %d source table(s) collide with reserved destination tables:\n", len(reserved))
+	for _, t := range tables {
+		r, ok := reserved[t.Name]
+		if !ok {
+			continue
+		}
+		r.Policy = cfg.table(t.Name).OnExisting
+		switch r.Policy {
+		case onExistingSkip:
+			skip[t.Name] = true
+			fmt.Printf("    %s: %s %s; skipped\n", t.Name, r.Table, r.reason())
+		case onExistingMerge:
+			merge[t.Name] = true
+			mergeTables = append(mergeTables, t.Name)
+			fmt.Printf("    %s: %s %s; merged into it\n", t.Name, r.Table, r.reason())
+		case onExistingRename:
+			refused = append(refused, t.Name)
+			fmt.Printf("    %s: renamed to %s, which %s too\n", t.Name, r.Table, r.reason())
+		default:
+			refused = append(refused, t.Name)
+			fmt.Printf("    %s: %s %s\n", t.Name, r.Table, r.reason())
+		}
+		report.ReservedTables = append(report.ReservedTables, r)
+	}
+	if len(refused) > 0 {
+		return nil, nil, &SchemaError{Err: fmt.Errorf("%d source table(s) would replace reserved destination tables: %s; set on_existing (skip, rename with rename_to, or merge) for them in the config",
+			len(refused), strings.Join(refused, ", "))}
+	}
+	if len(mergeTables) > 0 {
+		if err := checkMergeColumns(ctx, dest, tables, merge); err != nil {
+			return nil, nil, err
+		}
+	}
+	return skip, merge, nil
+}
+
+// checkMergeColumns checks that the columns a merged table shares with its
+// reserved destination table have the same types. Source columns missing on
+// the destination are left out of the copy like for any kept table (see
+// projectExisting).
+func checkMergeColumns(ctx context.Context, dest Querier, tables []Table, merge map[string]bool) error {
+	var merged []Table
+	for _, t := range tables {
+		if merge[t.Name] {
+			merged = append(merged, onDestination(t))
+		}
+	}
+	destTables, err := introspectSchemas(ctx, dest, tableSchemas(merged))
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	byName := make(map[string]Table, len(destTables))
+	for _, t := range destTables {
+		byName[t.qualifiedName()] = t
+	}
+	for _, t := range tables {
+		if !merge[t.Name] {
+			continue
+		}
+		dt := byName[t.qualifiedDestName()]
+		var mismatched []string
+		for _, c := range t.Columns {
+			if dc, ok := dt.column(c.destName()); ok && dc.DataType != c.DataType {
+				mismatched = append(mismatched, fmt.Sprintf("%s (%s on the source, %s on the destination)", c.Name, c.DataType, dc.DataType))
+			}
+		}
+		if len(mismatched) > 0 {
+			return &SchemaError{Table: t.Name, Err: fmt.Errorf("table %s cannot be merged into %s: column types differ: %s",
+				t.Name, t.qualifiedDestName(), strings.Join(mismatched, ", "))}
+		}
+	}
+	return nil
+}
+
+// withoutTables returns tables without the ones in names.
+func withoutTables(tables []Table, names map[string]bool) []Table {
+	if len(names) == 0 {
+		return tables
+	}
+	var out []Table
+	for _, t := range tables {
+		if !names[t.Name] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,230 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// tableRetryBackoff is the wait before the first retry of a table's copy
+// with --max-retries; it doubles for every further one.
+const tableRetryBackoff = time.Second
+
+// Endpoints an error can be attributed to
+const (
+	endpointSource      = "source"
+	endpointDestination = "destination"
+)
+
+// endpointError records which connection an error came from.
+type endpointError struct {
+	endpoint string
+	err      error
+}
+
+func (e *endpointError) Error() string { return e.err.Error() }
+func (e *endpointError) Unwrap() error { return e.err }
+
+func onEndpoint(endpoint string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &endpointError{endpoint: endpoint, err: err}
+}
+
+func errorEndpoint(err error) string {
+	var ee *endpointError
+	if errors.As(err, &ee) {
+		return ee.endpoint
+	}
+	return "unknown"
+}
+
+// isTransient reports whether err is the kind of failure that a retry,
+// possibly on a new connection, can be expected to fix.
+func isTransient(err error) bool {
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08: connection exception
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	var storeErr *storageError
+	if errors.As(err, &storeErr) {
+		return storeErr.transient()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retriedCopy reports whether copies of method are retried by
+// --max-retries. Split tables retry their ranges themselves, and staged
+// copies are left to --retries.
+func retriedCopy(method string) bool {
+	switch method {
+	case copyMethodRows, copyMethodCSV, methodKeyset:
+		return true
+	}
+	return false
+}
+
+// retryTable waits before attempt+1 of the copy of t, which failed with
+// err, and replaces the connections that were lost. It returns the
+// destination connection to continue on.
+func retryTable(ctx context.Context, t Table, attempt, maxRetries int, err error, sources *sourceEndpoints, dest CopyConn, reconnectDest func(context.Context) (CopyConn, error), stats *RetryStats) (CopyConn, error) {
+	stats.recordError(err)
+	wait := runBackoff(tableRetryBackoff, attempt)
+	log.Printf("Table %s failed (attempt %d of %d): %v; retrying in %s", t.Name, attempt, maxRetries+1, err, wait)
+	runOf(ctx).record(JournalEvent{Type: eventRetry, Table: t.Name, Attempt: attempt, Error: err.Error()})
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return dest, ctx.Err()
+	}
+	stats.recordRetry()
+	if reconnected, err := sources.reconnect(ctx); err != nil {
+		return dest, err
+	} else if reconnected {
+		stats.recordReconnect()
+	}
+	if dest.IsClosed() {
+		var err error
+		if dest, err = reconnectDest(ctx); err != nil {
+			return dest, err
+		}
+		stats.recordReconnect()
+	}
+	return dest, nil
+}
+
+// RetryStats counts the failed attempts behind a table's copy. A run that
+// only succeeds after many retries tends to predict one that fails.
+type RetryStats struct {
+	Retries          int64            `json:"retries"`
+	Reconnects       int64            `json:"reconnects"`
+	TransientErrors  int64            `json:"transient_errors"`
+	Errors           int64            `json:"errors"`
+	ErrorsByEndpoint map[string]int64 `json:"errors_by_endpoint,omitempty"`
+
+	mu sync.Mutex
+}
+
+func (s *RetryStats) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors++
+	if isTransient(err) {
+		s.TransientErrors++
+	}
+	if s.ErrorsByEndpoint == nil {
+		s.ErrorsByEndpoint = map[string]int64{}
+	}
+	s.ErrorsByEndpoint[errorEndpoint(err)]++
+}
+
+func (s *RetryStats) recordRetry() {
+	s.mu.Lock()
+	s.Retries++
+	s.mu.Unlock()
+}
+
+func (s *RetryStats) recordReconnect() {
+	s.mu.Lock()
+	s.Reconnects++
+	s.mu.Unlock()
+}
+
+func (s *RetryStats) empty() bool {
+	return s.Errors == 0 && s.Retries == 0 && s.Reconnects == 0
+}
+
+// orNil returns nil for stats without any failure, keeping them out of the
+// report.
+func (s *RetryStats) orNil() *RetryStats {
+	if s.empty() {
+		return nil
+	}
+	return s
+}
+
+func (s *RetryStats) add(other *RetryStats) {
+	s.Retries += other.Retries
+	s.Reconnects += other.Reconnects
+	s.TransientErrors += other.TransientErrors
+	s.Errors += other.Errors
+	for k, v := range other.ErrorsByEndpoint {
+		if s.ErrorsByEndpoint == nil {
+			s.ErrorsByEndpoint = map[string]int64{}
+		}
+		s.ErrorsByEndpoint[k] += v
+	}
+}
+
+// AttemptReport is the outcome of one attempt of a run with --retries.
+type AttemptReport struct {
+	Attempt        int       `json:"attempt"`
+	RunID          string    `json:"run_id,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Status         string    `json:"status"`
+	Error          string    `json:"error,omitempty"`
+	ErrorKind      string    `json:"error_kind,omitempty"`
+	// RowsCopied and BytesCopied count what this attempt copied
+	RowsCopied  int64    `json:"rows_copied"`
+	BytesCopied int64    `json:"bytes_copied"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+func (r *Report) attempt(n int) AttemptReport {
+	return AttemptReport{
+		Attempt:        n,
+		RunID:          r.RunID,
+		StartedAt:      r.StartedAt,
+		FinishedAt:     r.FinishedAt,
+		ElapsedSeconds: r.ElapsedSeconds,
+		Status:         r.Status,
+		Error:          r.Error,
+		ErrorKind:      r.ErrorKind,
+		RowsCopied:     r.RowsCopiedSession,
+		BytesCopied:    r.BytesCopiedSession,
+		Warnings:       r.Warnings,
+	}
+}
+
+// retryableRun reports whether a failed run is worth another attempt.
+// Schema errors come from the config or the schema and fail the same way
+// every time.
+func retryableRun(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && classifyError(err) != errorKindSchema
+}
+
+// runBackoff is the wait before attempt n+1: base, doubled for every
+// further attempt, up to maxRunBackoff.
+func runBackoff(base time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxRunBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRunBackoff)
+}
+
+const maxRunBackoff = 30 * time.Minute
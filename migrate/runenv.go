@@ -0,0 +1,84 @@
+package migrate
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// runEnv is what one run shares with the code below its Migrator: where
+// its progress goes, the --tui controls, its source connection slots, how
+// it writes to the destination, and its journal. The Migrator builds it
+// from its Options and hands it down in the context of its phases (see
+// withRun), so Migrators running side by side never see each other's.
+type runEnv struct {
+	reporter ProgressReporter
+	// control pauses the copy and skips tables on request of the --tui
+	control *copyControl
+	// hideBars makes the progress bars silent while the --tui draws the
+	// progress itself
+	hideBars bool
+	slots    *sourceLimiter
+	// batched is set while the destination is behind a transaction pooler
+	// without a usable bypass port; the copy then writes batched INSERTs
+	// instead of COPY (see copyInto)
+	batched bool
+	// debug is set by --debug (see debugf)
+	debug bool
+	// journal is the journal of the run while it is open; the statements
+	// of every connection are recorded to it (see journalTracer)
+	journal atomic.Pointer[journal]
+	// status is the --status-addr server, if any
+	status *statusServer
+}
+
+// noRun is the runEnv of work done outside a Migrator, such as by the
+// verify subcommands: it reports nothing and limits nothing.
+var noRun = &runEnv{reporter: nopReporter{}, control: &copyControl{}, slots: newSourceLimiter(0)}
+
+type runKey struct{}
+
+// withRun returns ctx carrying r.
+func withRun(ctx context.Context, r *runEnv) context.Context {
+	return context.WithValue(ctx, runKey{}, r)
+}
+
+// runOf returns the runEnv ctx carries, or noRun.
+func runOf(ctx context.Context) *runEnv {
+	if r, ok := ctx.Value(runKey{}).(*runEnv); ok {
+		return r
+	}
+	return noRun
+}
+
+// newRunEnv returns the runEnv of a run with opts, counting its source
+// connections against slots.
+func newRunEnv(opts Options, slots *sourceLimiter) *runEnv {
+	r := &runEnv{reporter: nopReporter{}, control: &copyControl{}, slots: slots, debug: opts.Debug, status: opts.status}
+	if opts.Reporter != nil {
+		r.reporter = opts.Reporter
+	}
+	if t := opts.tui; t != nil {
+		r.reporter = teeReporter{r.reporter, t}
+		r.control, r.hideBars = t.control, true
+		t.slots.Store(slots)
+	}
+	if opts.status != nil {
+		r.reporter = teeReporter{r.reporter, opts.status}
+	}
+	return r
+}
+
+// record adds e to the journal of the run, if it has one.
+func (r *runEnv) record(e JournalEvent) {
+	if j := r.journal.Load(); j != nil {
+		j.record(e)
+	}
+}
+
+// debugf logs detail that is only of interest while tuning a run.
+func (r *runEnv) debugf(format string, args ...any) {
+	if r.debug {
+		log.Printf("debug: "+format, args...)
+	}
+}
@@ -0,0 +1,637 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// s3:// locations are written through the S3 REST API, and gs:// ones
+// through the XML API of Cloud Storage, which speaks the same protocol.
+// Requests to S3 are signed with AWS Signature Version 4 and the
+// credentials of the AWS SDK's default chain; requests to Cloud Storage
+// carry an OAuth 2.0 token of the Google Application Default Credentials.
+
+const (
+	// s3PartSize is the size of the parts an object is uploaded in once it
+	// outgrows one; S3 refuses parts below 5 MiB except the last
+	s3PartSize  = 16 << 20
+	gcsEndpoint = "https://storage.googleapis.com"
+	// gcsScope is the OAuth 2.0 scope of the tokens sent to Cloud Storage
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// Values of --sse
+const (
+	sseS3  = "AES256"
+	sseKMS = "aws:kms"
+)
+
+// storeOptions are the upload settings of an export target.
+type storeOptions struct {
+	// SSE is the server-side encryption of s3:// objects, AES256 or aws:kms
+	SSE string
+	// KMSKeyID is the key of aws:kms on S3, or the Cloud KMS key name of
+	// gs:// objects
+	KMSKeyID string
+	// StorageClass is the storage class of new objects, e.g. STANDARD_IA
+	// on S3 or NEARLINE on Cloud Storage
+	StorageClass string
+	// ReadRetries is how many times in a row a read that fails with a
+	// transient error is resumed
+	ReadRetries int
+}
+
+func (o *storeOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.SSE, "sse", "", "Server-side encryption of s3:// objects: AES256 or aws:kms (default the bucket's)")
+	fs.StringVar(&o.KMSKeyID, "sse-kms-key-id", "", "KMS key of --sse aws:kms, or the Cloud KMS key name of gs:// objects")
+	fs.StringVar(&o.StorageClass, "storage-class", "", "Storage class of the objects written to s3:// or gs:// (default the bucket's)")
+}
+
+// headers returns the request headers that apply o to a new object of a
+// store of scheme.
+func (o storeOptions) headers(scheme string) (http.Header, error) {
+	h := http.Header{}
+	if scheme == "gs" {
+		if o.SSE != "" {
+			return nil, fmt.Errorf("--sse applies to s3:// only; gs:// objects are always encrypted, with --sse-kms-key-id naming a Cloud KMS key")
+		}
+		if o.KMSKeyID != "" {
+			h.Set("x-goog-encryption-kms-key-name", o.KMSKeyID)
+		}
+		if o.StorageClass != "" {
+			h.Set("x-goog-storage-class", o.StorageClass)
+		}
+		return h, nil
+	}
+	switch o.SSE {
+	case "", sseS3, sseKMS:
+	default:
+		return nil, fmt.Errorf("--sse must be %s or %s, not %q", sseS3, sseKMS, o.SSE)
+	}
+	if o.KMSKeyID != "" && o.SSE != sseKMS {
+		return nil, fmt.Errorf("--sse-kms-key-id needs --sse %s", sseKMS)
+	}
+	if o.SSE != "" {
+		h.Set("x-amz-server-side-encryption", o.SSE)
+	}
+	if o.KMSKeyID != "" {
+		h.Set("x-amz-server-side-encryption-aws-kms-key-id", o.KMSKeyID)
+	}
+	if o.StorageClass != "" {
+		h.Set("x-amz-storage-class", o.StorageClass)
+	}
+	return h, nil
+}
+
+// storeAuth authorizes the requests of a store.
+type storeAuth interface {
+	// authorize adds the credentials to req, whose body hashes to
+	// payloadHash
+	authorize(req *http.Request, payloadHash string) error
+}
+
+// sigV4Auth signs requests with AWS Signature Version 4.
+type sigV4Auth struct {
+	creds  aws.CredentialsProvider
+	region string
+	signer *v4.Signer
+}
+
+func newSigV4Auth(creds aws.CredentialsProvider, region string) *sigV4Auth {
+	// The path is escaped once, by do: S3 signs it as sent
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	return &sigV4Auth{creds: creds, region: region, signer: signer}
+}
+
+func (a *sigV4Auth) authorize(req *http.Request, payloadHash string) error {
+	return a.sign(req, payloadHash, time.Now().UTC())
+}
+
+func (a *sigV4Auth) sign(req *http.Request, payloadHash string, now time.Time) error {
+	creds, err := a.creds.Retrieve(req.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get the AWS credentials: %w", err)
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	return a.signer.SignHTTP(req.Context(), creds, req, payloadHash, "s3", a.region, now)
+}
+
+// bearerAuth sends the OAuth 2.0 access tokens of a token source, which
+// refreshes them as they expire.
+type bearerAuth struct {
+	tokens oauth2.TokenSource
+}
+
+func (a *bearerAuth) authorize(req *http.Request, _ string) error {
+	token, err := a.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get a Google access token: %w", err)
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+// s3Auth resolves the AWS credentials and region with the default chain of
+// the AWS SDK, as the AWS CLI does: the AWS_* environment variables, the
+// AWS_PROFILE profile of the shared config and credentials files, with its
+// SSO session, credential_process or role to assume, web identity tokens
+// (EKS service accounts), and the ECS and EC2 instance roles. The region
+// defaults to us-east-1.
+func s3Auth(ctx context.Context) (*sigV4Auth, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("no AWS credentials")
+	}
+	// Credentials are checked once up front, so an export without any
+	// fails before it starts
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("no AWS credentials: %w", err)
+	}
+	return newSigV4Auth(cfg.Credentials, firstSet(cfg.Region, "us-east-1")), nil
+}
+
+// gcsAuth finds the Application Default Credentials of Google Cloud: the
+// key file of GOOGLE_APPLICATION_CREDENTIALS, the credentials of gcloud
+// auth application-default login, or the service account of the GCE, GKE
+// or Cloud Run instance.
+func gcsAuth(ctx context.Context) (*bearerAuth, error) {
+	creds, err := google.FindDefaultCredentials(ctx, gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("gs:// locations need Google Application Default Credentials: %w", err)
+	}
+	return &bearerAuth{tokens: creds.TokenSource}, nil
+}
+
+// s3Store keeps objects in a bucket under a key prefix. An object up to
+// s3PartSize is written with one PUT once complete; a larger one becomes a
+// multipart upload, each part sent as soon as it is full, so memory use
+// stays at one part. Until the upload is completed nothing shows under the
+// key.
+type s3Store struct {
+	client *http.Client
+	scheme string
+	// endpoint is the URL of the bucket: virtual-hosted for AWS, with the
+	// bucket as the first path segment otherwise
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	auth     storeAuth
+	// upload holds the headers sent when an object is created
+	upload   http.Header
+	partSize int
+	// readRetries and retryBackoff bound the resumption of failed reads
+	readRetries  int
+	retryBackoff time.Duration
+}
+
+// openS3Store returns the store of s3://bucket/prefix (scheme s3) or
+// gs://bucket/prefix (scheme gs). The region of S3 is that of the AWS
+// configuration (see s3Auth), and AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL
+// picks an S3-compatible service, addressed path-style.
+func openS3Store(scheme, rest string, opts storeOptions) (*s3Store, error) {
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("%s:// location without a bucket", scheme)
+	}
+	upload, err := opts.headers(scheme)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{
+		client:   http.DefaultClient,
+		scheme:   scheme,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		upload:   upload,
+		partSize: s3PartSize,
+
+		readRetries:  opts.ReadRetries,
+		retryBackoff: tableRetryBackoff,
+	}
+
+	endpoint := gcsEndpoint
+	if scheme == "gs" {
+		if s.auth, err = gcsAuth(context.Background()); err != nil {
+			return nil, err
+		}
+	} else {
+		auth, err := s3Auth(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+		endpoint = firstSet(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+		if endpoint == "" && !strings.Contains(bucket, ".") {
+			// Virtual-hosted addressing; dotted bucket names would not
+			// match the certificate of the host
+			s.endpoint = &url.URL{Scheme: "https", Host: bucket + ".s3." + auth.region + ".amazonaws.com"}
+			return s, nil
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + auth.region + ".amazonaws.com"
+		}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	s.endpoint = u
+	return s, nil
+}
+
+// firstSet returns the first of values that is not empty.
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *s3Store) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) location(key string) string {
+	return s.scheme + "://" + s.bucket + "/" + s.objectKey(key)
+}
+
+func (s *s3Store) create(ctx context.Context, key string) (objectWriter, error) {
+	return &s3Object{ctx: ctx, store: s, key: s.objectKey(key)}, nil
+}
+
+func (s *s3Store) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	r := &s3Reader{ctx: ctx, store: s, key: s.objectKey(key)}
+	if err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// s3Reader downloads an object. When the download fails with a transient
+// error, it is resumed with a ranged GET from the byte reached, so the
+// reader sees every byte once; If-Match pins the resumed GETs to the object
+// first read, so one replaced meanwhile fails the read instead of being
+// spliced in. Up to store.readRetries failures in a row are resumed.
+type s3Reader struct {
+	ctx   context.Context
+	store *s3Store
+	key   string
+	body  io.ReadCloser
+	etag  string
+	size  int64
+	// offset is the number of bytes read so far
+	offset   int64
+	failures int
+}
+
+// get sends the GET of the rest of the object, retrying transient failures.
+func (r *s3Reader) get() error {
+	for {
+		header := http.Header{}
+		if r.offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+			if r.etag != "" {
+				header.Set("If-Match", r.etag)
+			}
+		}
+		resp, err := r.store.do(r.ctx, http.MethodGet, r.key, nil, header, nil)
+		if err == nil {
+			if r.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
+				return fmt.Errorf("failed to resume reading %s: the range was ignored", r.store.location(r.key))
+			}
+			if r.offset == 0 {
+				r.etag = resp.Header.Get("ETag")
+				r.size = resp.ContentLength
+			}
+			r.body = resp.Body
+			return nil
+		}
+		if err := r.wait(err); err != nil {
+			return err
+		}
+	}
+}
+
+// wait sleeps before the next attempt after err, or returns err when it is
+// not transient or the retries are used up.
+func (r *s3Reader) wait(err error) error {
+	if !isTransient(err) || r.ctx.Err() != nil || r.failures >= r.store.readRetries {
+		return err
+	}
+	r.failures++
+	wait := runBackoff(r.store.retryBackoff, r.failures)
+	log.Printf("Reading %s failed at byte %d (attempt %d of %d): %v; resuming in %s", r.store.location(r.key), r.offset, r.failures, r.store.readRetries+1, err, wait)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.failures = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.body.Close()
+		if r.offset == r.size {
+			// Everything arrived; only the end of the response was lost
+			r.body = http.NoBody
+			return n, io.EOF
+		}
+		if werr := r.wait(err); werr != nil {
+			return n, fmt.Errorf("failed to read %s at byte %d: %w", r.store.location(r.key), r.offset, werr)
+		}
+		if err := r.get(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *s3Reader) Close() error { return r.body.Close() }
+
+// storageError is an error response of the object storage service.
+type storageError struct {
+	Op       string
+	Location string
+	Status   int
+	Code     string
+	Message  string
+}
+
+func (e *storageError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Op, e.Location, http.StatusText(e.Status))
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// transient reports whether the request may succeed when sent again.
+func (e *storageError) transient() bool {
+	switch e.Code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// do authorizes and sends one request for the object key; query holds the
+// subresources, such as uploadId. A response other than 2xx is returned as
+// a storageError. The caller closes the body of the response.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	if err := s.auth.authorize(req, hex.EncodeToString(sum[:])); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, readStorageError(resp, method, s.scheme+"://"+s.bucket+"/"+key)
+	}
+	return resp, nil
+}
+
+// readStorageError turns an error response into a storageError, with the
+// code and message of its XML body.
+func readStorageError(resp *http.Response, op, location string) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, &body)
+	e := &storageError{Op: op, Location: location, Status: resp.StatusCode, Code: body.Code, Message: body.Message}
+	// A request to the wrong region is refused with the bucket's region
+	if region := resp.Header.Get("x-amz-bucket-region"); region != "" && (e.Code == "PermanentRedirect" || e.Code == "AuthorizationHeaderMalformed") {
+		e.Message += "; the bucket is in " + region + ", set AWS_REGION=" + region
+	}
+	return e
+}
+
+// s3Object is an object being uploaded.
+type s3Object struct {
+	ctx      context.Context
+	store    *s3Store
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (o *s3Object) Write(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := o.store.partSize - len(o.buf)
+		take := min(room, len(p))
+		o.buf = append(o.buf, p[:take]...)
+		p = p[take:]
+		if len(o.buf) == o.store.partSize {
+			// A full part is only sent once more follows, since the last
+			// part of a small object is sent with a plain PUT instead
+			if len(p) == 0 {
+				break
+			}
+			if o.err = o.flush(); o.err != nil {
+				return n - len(p), o.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered bytes as the next part, starting the
+// multipart upload with the first one.
+func (o *s3Object) flush() error {
+	if o.uploadID == "" {
+		resp, err := o.store.do(o.ctx, http.MethodPost, o.key, url.Values{"uploads": {""}}, o.store.upload, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("failed to start the upload of %s: no upload ID in the response", o.store.location(o.key))
+		}
+		o.uploadID = result.UploadID
+	}
+	number := len(o.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {o.uploadID}}
+	resp, err := o.store.do(o.ctx, http.MethodPut, o.key, query, nil, o.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	o.parts = append(o.parts, s3Part{Number: number, ETag: resp.Header.Get("ETag")})
+	o.buf = o.buf[:0]
+	return nil
+}
+
+func (o *s3Object) commit() error {
+	if o.err != nil {
+		o.abort()
+		return o.err
+	}
+	if o.uploadID == "" {
+		resp, err := o.store.do(o.ctx, http.MethodPut, o.key, nil, o.store.upload, o.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(o.buf) > 0 {
+		if err := o.flush(); err != nil {
+			o.abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: o.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := o.store.do(o.ctx, http.MethodPost, o.key, url.Values{"uploadId": {o.uploadID}}, nil, body)
+	if err != nil {
+		o.abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// A completion can fail after the 200 status was sent, with an error
+	// in the body instead of the result
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(data, &result); err == nil && result.XMLName.Local == "Error" {
+		o.abort()
+		return &storageError{Op: http.MethodPost, Location: o.store.location(o.key), Status: http.StatusInternalServerError, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
+
+// abort discards the parts uploaded so far. An upload left by a run that
+// crashed stays listed among the bucket's incomplete multipart uploads,
+// under the run ID of its key, until a lifecycle rule or abort removes it.
+func (o *s3Object) abort() {
+	if o.uploadID == "" {
+		return
+	}
+	resp, err := o.store.do(context.WithoutCancel(o.ctx), http.MethodDelete, o.key, url.Values{"uploadId": {o.uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+	o.uploadID = ""
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires: everything
+// but letters, digits and -._~ (and / with keepSlash).
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query sorted by name, which is both what is sent
+// and what is signed.
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
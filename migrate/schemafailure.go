@@ -0,0 +1,31 @@
+package migrate
+
+import "fmt"
+
+// Values of --on-failure
+const (
+	onFailureCleanup = "cleanup"
+	onFailureKeep    = "keep"
+)
+
+// SchemaFailure records what a failed create-schema phase left on the
+// destination.
+type SchemaFailure struct {
+	OnFailure string `json:"on_failure"`
+	// RolledBack is set when the table statements were rolled back, so
+	// the destination tables are as before the run
+	RolledBack bool `json:"rolled_back"`
+	// Created lists the tables created before the failure and kept
+	Created []string `json:"created,omitempty"`
+}
+
+// describe says what the failure left on the destination, for the error.
+func (f *SchemaFailure) describe() string {
+	switch {
+	case f.RolledBack:
+		return "the tables were rolled back and the destination tables are as before the run"
+	case len(f.Created) == 0:
+		return "no table was created"
+	}
+	return fmt.Sprintf("%d table(s) created before the failure are kept (--on-failure keep) and the tables they replaced are gone; run again to recreate them", len(f.Created))
+}
@@ -0,0 +1,142 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCreateEnumsInTheirSchema(t *testing.T) {
+	dest := &fakeConn{results: []fakeResult{
+		{match: "pg_enum", rows: [][]any{{"public", "mood", []string{"sad", "happy"}}}},
+	}}
+	enums := []enumType{
+		{Schema: "public", Name: "mood", Labels: []string{"sad", "ok", "happy"}},
+		{Schema: "sales", DestSchema: "sales", Name: "mood", Labels: []string{"open", "won"}},
+	}
+	report := &Report{}
+	if err := createEnums(context.Background(), dest, enums, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`ALTER TYPE "mood" ADD VALUE 'ok' AFTER 'sad'`,
+		`CREATE TYPE "sales"."mood" AS ENUM ('open', 'won')`,
+	} {
+		if !dest.ran(stmt) {
+			t.Errorf("%s was not run; ran %q", stmt, dest.queries)
+		}
+	}
+	want := []EnumReport{
+		{Name: "mood", Status: enumReconciled, Added: []string{"ok"}},
+		{Name: "sales.mood", Status: enumCreated},
+	}
+	if len(report.Enums) != len(want) {
+		t.Fatalf("report.Enums = %+v, want %+v", report.Enums, want)
+	}
+	for i, er := range report.Enums {
+		if er.Name != want[i].Name || er.Status != want[i].Status {
+			t.Errorf("report.Enums[%d] = %+v, want %+v", i, er, want[i])
+		}
+	}
+}
+
+func TestMapObjectSchemas(t *testing.T) {
+	tables := []Table{{Name: "users", Columns: []Column{
+		{Name: "mood", DataType: "mood", TypeSchema: "public", TypeName: "mood"},
+		{Name: "moods", DataType: "mood[]", TypeSchema: "public", TypeName: "mood"},
+		{Name: "stage", DataType: "sales.stage", TypeSchema: "sales", TypeName: "stage"},
+		{Name: "tags", DataType: "citext", TypeSchema: "public", TypeName: "citext"},
+		{Name: "id", DataType: "integer", TypeSchema: "pg_catalog", TypeName: "int4"},
+	}}}
+	enums := []enumType{{Schema: "public", Name: "mood"}, {Schema: "sales", Name: "stage"}}
+	domains := []domainType{{Schema: "sales", Name: "amount", BaseType: "numeric", Checks: []domainCheck{{Name: "positive", Definition: "CHECK (sales.positive(VALUE))"}}}}
+	functions := []function{{Schema: "public", Name: "touch", Definition: "CREATE OR REPLACE FUNCTION public.touch()"}}
+	mapObjectSchemas(tables, enums, domains, nil, functions, schemaMap{"public": "xata_import"})
+
+	if enums[0].DestSchema != "xata_import" || enums[1].DestSchema != "sales" || domains[0].DestSchema != "sales" {
+		t.Errorf("destination schemas: enums %q, %q, domain %q", enums[0].DestSchema, enums[1].DestSchema, domains[0].DestSchema)
+	}
+	if want := `CREATE OR REPLACE FUNCTION "xata_import".touch()`; functions[0].Definition != want {
+		t.Errorf("function definition = %q, want %q", functions[0].Definition, want)
+	}
+	if want := "CHECK (sales.positive(VALUE))"; domains[0].Checks[0].Definition != want {
+		t.Errorf("check of an unmapped domain = %q, want %q", domains[0].Checks[0].Definition, want)
+	}
+	for i, want := range []string{`"xata_import".mood`, `"xata_import".mood[]`, "sales.stage", "citext", "integer"} {
+		if got := tables[0].Columns[i].DataType; got != want {
+			t.Errorf("column %s type = %q, want %q", tables[0].Columns[i].Name, got, want)
+		}
+	}
+
+	mapObjectSchemas(tables, enums, domains, nil, functions, schemaMap{"sales": "billing"})
+	if got := tables[0].Columns[2].DataType; got != `"billing".stage` {
+		t.Errorf("column stage type = %q, want \"billing\".stage", got)
+	}
+}
+
+func TestCreateDomainInMappedSchema(t *testing.T) {
+	dest := &fakeConn{}
+	domains := []domainType{{Schema: "public", DestSchema: "xata_import", Name: "mood_or_none", BaseType: "mood"}}
+	if err := createDomains(context.Background(), dest, domains, &Report{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "SET LOCAL search_path = \"xata_import\", public;\nCREATE DOMAIN \"xata_import\".\"mood_or_none\" AS mood"
+	if !dest.ran(want) {
+		t.Errorf("%q was not run; ran %q", want, dest.queries)
+	}
+}
+
+func TestIntrospectMatViewsReads(t *testing.T) {
+	source := &fakeConn{results: []fakeResult{
+		{match: "pg_rewrite", rows: [][]any{
+			{"sales", "totals", "sales", "orders", "r", "amount"},
+			{"public", "totals", "public", "users", "r", ""},
+		}},
+		{match: "pg_matviews", rows: [][]any{
+			{"public", "totals", "SELECT 1", []string{}},
+			{"sales", "totals", "SELECT 2", []string{}},
+		}},
+	}}
+	views, err := introspectMatViews(context.Background(), source, []string{"public", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 2 || views[0].key() != "totals" || views[1].key() != "sales.totals" {
+		t.Fatalf("views = %+v, want totals and sales.totals", views)
+	}
+	if len(views[0].Reads) != 1 || views[0].Reads[0].Relation != "users" {
+		t.Errorf("totals reads %+v, want users", views[0].Reads)
+	}
+	if len(views[1].Reads) != 1 || views[1].Reads[0].Schema != "sales" || views[1].Reads[0].Relation != "orders" {
+		t.Errorf("sales.totals reads %+v, want sales.orders", views[1].Reads)
+	}
+}
+
+func TestMatViewSkipReason(t *testing.T) {
+	orders := Table{Name: "sales.orders", Schema: "sales", DestSchema: "sales", Columns: []Column{{Name: "amount"}}}
+	routed := orders
+	routed.DestSchema = "archive"
+	read := func(schema, relation, kind, column string) materializedView {
+		return materializedView{Schema: "sales", Name: "totals", Reads: []matviewRead{{Schema: schema, Relation: relation, Kind: kind, Column: column}}}
+	}
+	for _, tt := range []struct {
+		name    string
+		mv      materializedView
+		tables  []Table
+		created map[string]bool
+		want    string
+	}{
+		{"table in its own schema", read("sales", "orders", "r", "amount"), []Table{orders}, nil, ""},
+		{"table not migrated", read("billing", "orders", "r", ""), []Table{orders}, nil, "it reads billing.orders, which is not migrated"},
+		{"table routed", read("sales", "orders", "r", ""), []Table{routed}, nil, "it reads sales.orders, which is renamed or routed to another schema"},
+		{"column not copied", read("sales", "orders", "r", "note"), []Table{orders}, nil, "it reads column sales.orders.note, which is not copied"},
+		{"plain view", read("sales", "recent", "v", ""), nil, nil, "it reads view sales.recent, and views are not migrated"},
+		{"matview created", read("sales", "daily", "m", ""), nil, map[string]bool{"sales.daily": true}, ""},
+		{"matview skipped", read("sales", "daily", "m", ""), nil, map[string]bool{"daily": true}, "it reads materialized view sales.daily, which was not created"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matviewSkipReason(tt.mv, tt.tables, tt.created); got != tt.want {
+				t.Errorf("matviewSkipReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
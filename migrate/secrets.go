@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// optionalVars may be unset, from the keyring as from the environment;
+// the run then goes without them.
+var optionalVars = map[string]bool{replicaURLVar: true}
+
+// secret resolves name from a credential helper or the OS keyring. ok is
+// false when neither is configured for the variable, in which case the caller
+// falls back to the environment; so is a variable of optionalVars missing
+// from the keyring.
+func (e *envSettings) secret(name string) (string, bool, error) {
+	if cmd, ok := e.helperFor(name); ok {
+		v, err := runCredentialHelper(name, cmd)
+		return v, true, err
+	}
+
+	if e.keyringService == "" {
+		return "", false, nil
+	}
+	account := e.varName(name)
+	v, err := keyring.Get(e.keyringService, account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		// Plain variables still work for values not stored in the keyring
+		if os.Getenv(account) != "" || optionalVars[name] {
+			return "", false, nil
+		}
+		return "", true, fmt.Errorf("no keyring entry for %s in service %s", account, e.keyringService)
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("failed to read %s from keyring service %s: %w", account, e.keyringService, err)
+	}
+	if strings.TrimSpace(v) == "" {
+		return "", true, fmt.Errorf("keyring entry for %s in service %s is empty", account, e.keyringService)
+	}
+	return strings.TrimSpace(v), true, nil
+}
+
+// helperFor returns the command configured with --credential-helper NAME=CMD.
+// Both the plain and the prefixed variable name are accepted.
+func (e *envSettings) helperFor(name string) (string, bool) {
+	for _, h := range e.helpers {
+		k, cmd, ok := strings.Cut(h, "=")
+		if !ok {
+			continue
+		}
+		if k == name || k == e.varName(name) {
+			return cmd, true
+		}
+	}
+	return "", false
+}
+
+func (e *envSettings) validateHelpers() error {
+	for _, h := range e.helpers {
+		k, cmd, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(cmd) == "" {
+			return fmt.Errorf("invalid --credential-helper %q (expected VARIABLE=COMMAND)", h)
+		}
+		known := false
+		for _, v := range append([]string{encryptionKeyVar}, knownURLVars...) {
+			if k == v || k == e.varName(v) {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("invalid --credential-helper %q: %s is not a connection or key variable", h, k)
+		}
+	}
+	return nil
+}
+
+// runCredentialHelper runs cmd through the shell. Stdin and stderr are passed
+// through so helpers can prompt (e.g. for a password manager unlock); stdout,
+// trimmed, is the value.
+func runCredentialHelper(name, cmd string) (string, error) {
+	var stdout bytes.Buffer
+	c := exec.Command("sh", "-c", cmd)
+	c.Stdin = os.Stdin
+	c.Stdout = &stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("credential helper for %s failed: %w", name, err)
+	}
+	v := strings.TrimSpace(stdout.String())
+	if v == "" {
+		return "", fmt.Errorf("credential helper for %s returned empty output", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,73 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestSecretKeyring(t *testing.T) {
+	keyring.MockInit()
+	if err := keyring.Set("farewall", sourceURLVar, " postgres://source "); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(destURLVar, "")
+	t.Setenv(replicaURLVar, "")
+	e := &envSettings{keyringService: "farewall"}
+
+	v, err := e.get(sourceURLVar)
+	if err != nil || v != "postgres://source" {
+		t.Errorf("get(%s) = %q, %v; want the trimmed keyring entry", sourceURLVar, v, err)
+	}
+
+	// Required: a missing entry without a variable to fall back to fails
+	if _, err := e.get(destURLVar); err == nil || !strings.Contains(err.Error(), "no keyring entry for DATABASE_URL") {
+		t.Errorf("get(%s) error = %v, want a missing keyring entry", destURLVar, err)
+	}
+	t.Setenv(destURLVar, "postgres://dest")
+	if v, err := e.get(destURLVar); err != nil || v != "postgres://dest" {
+		t.Errorf("get(%s) = %q, %v; want the environment fallback", destURLVar, v, err)
+	}
+
+	// Optional: missing everywhere is unset
+	if v, err := e.get(replicaURLVar); err != nil || v != "" {
+		t.Errorf("get(%s) = %q, %v; want it unset", replicaURLVar, v, err)
+	}
+	t.Setenv(replicaURLVar, "postgres://replica")
+	if v, err := e.get(replicaURLVar); err != nil || v != "postgres://replica" {
+		t.Errorf("get(%s) = %q, %v; want the environment fallback", replicaURLVar, v, err)
+	}
+}
+
+func TestSecretPrefixedOptional(t *testing.T) {
+	keyring.MockInit()
+	t.Setenv(replicaURLVar, "")
+	t.Setenv("STAGING_"+replicaURLVar, "postgres://staging-replica")
+	t.Setenv(destURLVar, "")
+	t.Setenv("STAGING_"+destURLVar, "postgres://staging")
+	e := &envSettings{}
+
+	if v, err := e.get(replicaURLVar); err != nil || v != "" {
+		t.Errorf("get(%s) = %q, %v; want it unset", replicaURLVar, v, err)
+	}
+	if _, err := e.get(destURLVar); err == nil || !strings.Contains(err.Error(), "--env-prefix") {
+		t.Errorf("get(%s) error = %v, want a pointer to --env-prefix", destURLVar, err)
+	}
+
+	e.prefix = "STAGING_"
+	if v, err := e.get(replicaURLVar); err != nil || v != "postgres://staging-replica" {
+		t.Errorf("prefixed get(%s) = %q, %v", replicaURLVar, v, err)
+	}
+}
+
+func TestSecretHelper(t *testing.T) {
+	e := &envSettings{helpers: stringList{replicaURLVar + "=echo postgres://helper"}}
+	if v, err := e.get(replicaURLVar); err != nil || v != "postgres://helper" {
+		t.Errorf("get(%s) = %q, %v; want the helper's output", replicaURLVar, v, err)
+	}
+	e.helpers = stringList{replicaURLVar + "=true"}
+	if _, err := e.get(replicaURLVar); err == nil || !strings.Contains(err.Error(), "empty output") {
+		t.Errorf("get(%s) error = %v, want the helper's empty output", replicaURLVar, err)
+	}
+}
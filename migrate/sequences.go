@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// SequenceReset records the sequence of a SERIAL or identity column set
+// after the copy, so the next generated value follows the copied ones.
+type SequenceReset struct {
+	Column   string `json:"column"`
+	Sequence string `json:"sequence"`
+	Value    int64  `json:"value"`
+}
+
+// resetSequences sets the sequence of every SERIAL and BIGSERIAL column of t,
+// the columns sanitizeColumn converted from a nextval default, and of every
+// identity column to the column's maximum on the destination, so the next
+// value is the maximum plus one. The maximum is taken and set on the
+// server, in the column's own type, so bigint values near the end of the
+// range cannot overflow. A sequence is left alone when the table is empty,
+// when the column has no sequence on the destination (a kept table may
+// generate values differently) or when the maximum is below the sequence's
+// minimum, which setval would reject.
+func resetSequences(ctx context.Context, dest Querier, t Table) ([]SequenceReset, error) {
+	var resets []SequenceReset
+	for _, c := range t.Columns {
+		if c.DataType != "SERIAL" && c.DataType != "BIGSERIAL" && c.Identity == "" {
+			continue
+		}
+		r := SequenceReset{Column: c.destName()}
+		err := dest.QueryRow(ctx, `
+			SELECT s.seq::text, setval(s.seq, s.m)
+			FROM (
+				SELECT pg_get_serial_sequence($1, $2)::regclass AS seq,
+					(SELECT max(`+sqlutil.QuoteIdent(c.destName())+`) FROM `+destFromClause(t)+`)::bigint AS m
+			) s
+			WHERE s.seq IS NOT NULL AND s.m IS NOT NULL
+			  AND s.m >= (SELECT seqmin FROM pg_sequence WHERE seqrelid = s.seq)
+		`, destIdent(t), c.destName()).Scan(&r.Sequence, &r.Value)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set the sequence of %s.%s: %w", t.Name, c.Name, err)
+		}
+		fmt.Printf("  Sequence %s set to %d\n", r.Sequence, r.Value)
+		resets = append(resets, r)
+	}
+	return resets, nil
+}
+
+// runFixSequences implements the fix-sequences subcommand: it sets the
+// sequence of every SERIAL and identity column in the destination schemas to
+// the column's maximum, like a run does after each table. It needs neither
+// the source nor a checkpoint, so it also repairs destinations loaded by
+// versions that did not set sequences; a nextval default on the destination
+// is what makes a column SERIAL, as on the source.
+func runFixSequences(args []string) int {
+	fs := flag.NewFlagSet("fix-sequences", flag.ExitOnError)
+	var schemas stringList
+	fs.Var(&schemas, "schema", "Destination schema to fix (repeatable; default public)")
+	var env envSettings
+	env.register(fs)
+	fs.Parse(args)
+	if len(schemas) == 0 {
+		schemas = stringList{defaultSchema}
+	}
+
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 1
+	}
+
+	ctx := context.Background()
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 1
+	}
+	defer dest.Close(ctx)
+
+	tables, err := introspectSchemas(ctx, dest, schemas)
+	if err != nil {
+		log.Printf("Failed to introspect destination: %v", err)
+		return 1
+	}
+	var set int
+	for _, t := range tables {
+		// The introspected names are the destination's own
+		if t.Schema != defaultSchema {
+			t.DestSchema = t.Schema
+		}
+		resets, err := resetSequences(ctx, dest, t)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		set += len(resets)
+	}
+	fmt.Printf("Set %d sequence(s) in %d table(s).\n", set, len(tables))
+	return 0
+}
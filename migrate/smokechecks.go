@@ -0,0 +1,209 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	smokeCheckPassed = "passed"
+	smokeCheckFailed = "failed"
+	// smokeCheckError is a check whose query failed, timed out or returned
+	// too many rows
+	smokeCheckError = "error"
+
+	defaultSmokeCheckTimeout = 30 * time.Second
+	defaultSmokeCheckMaxRows = 100
+)
+
+// SmokeCheck is a query of the config run against both databases once the
+// migration is done, whose results must match. With Expected the source is
+// not queried and the destination must return those rows instead.
+type SmokeCheck struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// DestinationQuery replaces Query on the destination, e.g. for tables
+	// with other names there
+	DestinationQuery string `json:"destination_query"`
+	// Expected are the rows in text form, with null for NULL
+	Expected [][]*string `json:"expected"`
+	// Timeout is a Go duration such as "10s" (default 30s); MaxRows caps
+	// the rows read from each side (default 100)
+	Timeout string `json:"timeout"`
+	MaxRows int    `json:"max_rows"`
+}
+
+// SmokeCheckResult is the outcome of one smoke check of the verify phase.
+type SmokeCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Source and Destination are the rows each side returned
+	Source      [][]*string `json:"source,omitempty"`
+	Destination [][]*string `json:"destination,omitempty"`
+}
+
+func validateSmokeChecks(checks []SmokeCheck) error {
+	seen := map[string]bool{}
+	for _, sc := range checks {
+		switch {
+		case sc.Name == "":
+			return fmt.Errorf("config: every smoke check needs a name")
+		case seen[sc.Name]:
+			return fmt.Errorf("config: duplicate smoke check %s", sc.Name)
+		case sc.Query == "" && sc.DestinationQuery == "":
+			return fmt.Errorf("config: smoke check %s needs a query", sc.Name)
+		case sc.Query == "" && sc.Expected == nil:
+			return fmt.Errorf("config: smoke check %s needs a query for the source, or expected rows", sc.Name)
+		case sc.MaxRows < 0:
+			return fmt.Errorf("config: smoke check %s has a negative max_rows", sc.Name)
+		}
+		seen[sc.Name] = true
+		for _, q := range []string{sc.Query, sc.DestinationQuery} {
+			if q != "" && !readOnlyStatement(q) {
+				return fmt.Errorf("config: smoke check %s must be a SELECT, WITH, VALUES, TABLE or SHOW query", sc.Name)
+			}
+		}
+		if sc.Timeout != "" {
+			if d, err := time.ParseDuration(sc.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("config: smoke check %s has an invalid timeout %q", sc.Name, sc.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) smokeChecks() []SmokeCheck {
+	if c == nil {
+		return nil
+	}
+	return c.SmokeChecks
+}
+
+// runSmokeChecks runs every check, records the results in the report and
+// fails with a VerificationError naming the checks that did not pass.
+func runSmokeChecks(ctx context.Context, source, dest Querier, checks []SmokeCheck, report *Report) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	fmt.Println("Running smoke checks...")
+	var failed []string
+	for _, sc := range checks {
+		r := runSmokeCheck(ctx, source, dest, sc)
+		if r.Status == smokeCheckPassed {
+			fmt.Printf("  %s: passed\n", sc.Name)
+		} else {
+			fmt.Printf("  %s: %s: %s\n", sc.Name, r.Status, r.Reason)
+			failed = append(failed, sc.Name)
+		}
+		report.SmokeChecks = append(report.SmokeChecks, r)
+	}
+	if len(failed) > 0 {
+		return &VerificationError{Err: fmt.Errorf("smoke check(s) did not pass: %s", strings.Join(failed, ", "))}
+	}
+	return nil
+}
+
+func runSmokeCheck(ctx context.Context, source, dest Querier, sc SmokeCheck) SmokeCheckResult {
+	r := SmokeCheckResult{Name: sc.Name, Status: smokeCheckError}
+	timeout := defaultSmokeCheckTimeout
+	if sc.Timeout != "" {
+		// Validated with the config
+		timeout, _ = time.ParseDuration(sc.Timeout)
+	}
+	maxRows := sc.MaxRows
+	if maxRows == 0 {
+		maxRows = defaultSmokeCheckMaxRows
+	}
+	destQuery := sc.DestinationQuery
+	if destQuery == "" {
+		destQuery = sc.Query
+	}
+
+	var err error
+	if r.Destination, err = smokeQuery(ctx, dest, destQuery, timeout, maxRows); err != nil {
+		r.Reason = "destination: " + err.Error()
+		return r
+	}
+	want := sc.Expected
+	if want == nil {
+		if r.Source, err = smokeQuery(ctx, source, sc.Query, timeout, maxRows); err != nil {
+			r.Reason = "source: " + err.Error()
+			return r
+		}
+		want = r.Source
+	}
+	if !slices.EqualFunc(want, r.Destination, func(a, b []*string) bool { return slices.EqualFunc(a, b, equalNullable) }) {
+		r.Status = smokeCheckFailed
+		r.Reason = fmt.Sprintf("expected %s, got %s", formatSmokeRows(want), formatSmokeRows(r.Destination))
+		return r
+	}
+	r.Status = smokeCheckPassed
+	return r
+}
+
+// smokeQuery runs sql with a timeout and returns at most maxRows rows, every
+// value in the server's text form.
+func smokeQuery(ctx context.Context, q Querier, sql string, timeout time.Duration, maxRows int) ([][]*string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rows, err := q.Query(ctx, sql, pgx.QueryResultFormats{pgx.TextFormatCode})
+	if err != nil {
+		return nil, smokeQueryError(ctx, timeout, err)
+	}
+	defer rows.Close()
+	out := [][]*string{}
+	for rows.Next() {
+		if len(out) == maxRows {
+			return nil, fmt.Errorf("returned more than %d rows", maxRows)
+		}
+		raw := rows.RawValues()
+		row := make([]*string, len(raw))
+		for i, v := range raw {
+			if v != nil {
+				s := string(v)
+				row[i] = &s
+			}
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, smokeQueryError(ctx, timeout, err)
+	}
+	return out, nil
+}
+
+func smokeQueryError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+func equalNullable(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func formatSmokeRows(rows [][]*string) string {
+	parts := make([]string, len(rows))
+	for i, row := range rows {
+		values := make([]string, len(row))
+		for j, v := range row {
+			values[j] = "NULL"
+			if v != nil {
+				values[j] = *v
+			}
+		}
+		parts[i] = "(" + strings.Join(values, ", ") + ")"
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,162 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// With --consistent-snapshot the copy reads the source as of one point in
+// time. The connection the copy reads from, the coordinator, opens a
+// REPEATABLE READ READ ONLY transaction and exports its snapshot with
+// pg_export_snapshot(); every worker of a split or sliced table starts its
+// own transaction with SET TRANSACTION SNAPSHOT, so all of them see exactly
+// what the coordinator sees. The coordinator's transaction stays open until
+// the copy is done, which keeps the snapshot importable.
+//
+// A failed statement aborts the transaction it runs in, so every read in a
+// snapshot runs under a savepoint (see inSavepoint), and a failed table or
+// range can be retried in the same snapshot. A lost connection loses the
+// snapshot: the coordinator then stops the copy, a worker imports the
+// snapshot again on its new connection. Reads do not fall back from the
+// replica to the primary, which cannot import a snapshot of the replica.
+
+// snapshotBegin starts the transaction a snapshot is exported from or
+// imported into. Like the cursor and lock statements, it bypasses the
+// statement check, and cannot write.
+const snapshotBegin = "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY"
+
+// errSnapshotLost is the error of reads after the connection holding the
+// exported snapshot was lost, when reading on would mix data of two points
+// in time.
+var errSnapshotLost = errors.New("the connection holding the --consistent-snapshot snapshot was lost; run again with --resume to copy the remaining tables in a new snapshot")
+
+// exportSnapshot opens the snapshot transaction on s and returns the
+// position of the source it reads, with the ID of the exported snapshot.
+func (s *SourceConn) exportSnapshot(ctx context.Context) (*SourcePosition, error) {
+	if _, err := s.conn.Exec(ctx, snapshotBegin); err != nil {
+		return nil, fmt.Errorf("failed to start the snapshot transaction: %w", err)
+	}
+	var p SourcePosition
+	if err := s.conn.QueryRow(ctx, "SELECT pg_export_snapshot(), now(), txid_current_snapshot()::text").Scan(&p.SnapshotID, &p.At, &p.Snapshot); err != nil {
+		s.conn.Exec(context.Background(), "ROLLBACK")
+		return nil, fmt.Errorf("failed to export the source snapshot: %w", err)
+	}
+	p.At = p.At.UTC()
+	// The WAL functions may be restricted, and a failure must not abort the
+	// transaction, so the LSN is read under a savepoint
+	if _, err := s.conn.Exec(ctx, "SAVEPOINT source_lsn"); err != nil {
+		s.conn.Exec(context.Background(), "ROLLBACK")
+		return nil, fmt.Errorf("failed to read the source position: %w", err)
+	}
+	var lsn *string
+	if err := s.conn.QueryRow(ctx, "SELECT ("+sourceLSNExpr+")::text").Scan(&lsn); err != nil {
+		_, err = s.conn.Exec(ctx, "ROLLBACK TO SAVEPOINT source_lsn")
+		if err != nil {
+			s.conn.Exec(context.Background(), "ROLLBACK")
+			return nil, fmt.Errorf("failed to read the source position: %w", err)
+		}
+	} else if lsn != nil {
+		p.LSN = *lsn
+	}
+	s.snapshot = p.SnapshotID
+	return &p, nil
+}
+
+// importSnapshot starts a transaction on s that reads the snapshot id
+// exported by the coordinator.
+func (s *SourceConn) importSnapshot(ctx context.Context, id string) error {
+	if _, err := s.conn.Exec(ctx, snapshotBegin); err != nil {
+		return fmt.Errorf("failed to start the snapshot transaction: %w", err)
+	}
+	if _, err := s.conn.Exec(ctx, "SET TRANSACTION SNAPSHOT "+sqlutil.QuoteLiteral(id)); err != nil {
+		s.conn.Exec(context.Background(), "ROLLBACK")
+		return fmt.Errorf("failed to import source snapshot %s: %w", id, err)
+	}
+	s.snapshot = id
+	return nil
+}
+
+// endSnapshot ends the snapshot transaction of s, if any. It only read, so
+// it rolls back.
+func (s *SourceConn) endSnapshot(ctx context.Context) error {
+	if s.snapshot == "" {
+		return nil
+	}
+	s.snapshot = ""
+	if s.conn.IsClosed() {
+		return nil
+	}
+	if _, err := s.conn.Exec(ctx, "ROLLBACK"); err != nil {
+		return fmt.Errorf("failed to end the source snapshot: %w", err)
+	}
+	return nil
+}
+
+// inSavepoint runs fn under the savepoint name when s reads a snapshot,
+// rolling back to it when fn fails so the transaction, and the snapshot,
+// can still be used.
+func (s *SourceConn) inSavepoint(ctx context.Context, name string, fn func() error) error {
+	if s.snapshot == "" {
+		return fn()
+	}
+	if _, err := s.conn.Exec(ctx, "SAVEPOINT "+name); err != nil {
+		return onEndpoint(endpointSource, fmt.Errorf("failed to set a savepoint in the source snapshot: %w", err))
+	}
+	err := fn()
+	if err != nil {
+		if s.conn.IsClosed() {
+			return err
+		}
+		if _, rerr := s.conn.Exec(context.Background(), "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+			return errors.Join(err, fmt.Errorf("failed to roll back to the savepoint in the source snapshot: %w", rerr))
+		}
+	}
+	if _, rerr := s.conn.Exec(context.Background(), "RELEASE SAVEPOINT "+name); rerr != nil {
+		return errors.Join(err, fmt.Errorf("failed to release the savepoint in the source snapshot: %w", rerr))
+	}
+	return err
+}
+
+// pinSnapshot exports the snapshot of the copy on the endpoint it reads
+// from, the replica if there is one, and makes every read use that
+// connection.
+func (s *sourceEndpoints) pinSnapshot(ctx context.Context) (*SourcePosition, error) {
+	conn := s.primary
+	if s.replica != nil {
+		conn = s.replica
+	}
+	pos, err := conn.exportSnapshot(ctx)
+	if err != nil {
+		return nil, onEndpoint(endpointSource, err)
+	}
+	s.pinned = conn
+	return pos, nil
+}
+
+// warnSnapshotResumed warns when tables, or ranges of them, were copied by
+// an earlier run, in a snapshot of their own.
+func warnSnapshotResumed(tables []Table, cp *Checkpoint, report *Report) {
+	var earlier []string
+	for _, t := range tables {
+		if cp.completed(t.Name) || cp.partial(t.Name) {
+			earlier = append(earlier, t.Name)
+		}
+	}
+	if len(earlier) > 0 {
+		report.warn(warnSnapshotPartial, "--consistent-snapshot: %d table(s) were copied, in full or in part, by an earlier run in another snapshot: %s", len(earlier), strings.Join(earlier, ", "))
+	}
+}
+
+// unpinSnapshot ends the snapshot of pinSnapshot.
+func (s *sourceEndpoints) unpinSnapshot(ctx context.Context) error {
+	if s.pinned == nil {
+		return nil
+	}
+	conn := s.pinned
+	s.pinned = nil
+	return conn.endSnapshot(ctx)
+}
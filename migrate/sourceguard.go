@@ -0,0 +1,191 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errSourceWrite is returned for any statement on the source that is not
+// known to only read.
+var errSourceWrite = errors.New("refusing to run a statement that may write on the source")
+
+// SourceConn is a connection to the Xata source (primary or replica) that
+// can only read. The session is opened read-only on the server, and every
+// statement is checked in Go before it is sent, so no code path can write
+// to the source. There is deliberately no way to turn this off.
+type SourceConn struct {
+	conn sourceDriver
+	// slots is the limiter the connection counts against until closed, if
+	// any
+	slots *sourceLimiter
+	// snapshot is the ID of the exported snapshot the connection's open
+	// transaction reads, with --consistent-snapshot (see snapshot.go)
+	snapshot string
+}
+
+// sourceDriver is the connection under a SourceConn, a *pgx.Conn outside
+// of tests.
+type sourceDriver interface {
+	Querier
+	PgConn() *pgconn.PgConn
+	Config() *pgx.ConnConfig
+	IsClosed() bool
+	Close(ctx context.Context) error
+}
+
+// ConnectSource opens a read-only connection to the source at url. A
+// Migrator counts it against its --source-connection-limit.
+func ConnectSource(ctx context.Context, url string) (*SourceConn, error) {
+	return connectSource(ctx, url, nil)
+}
+
+// connectSource is ConnectSource counting the connection against slots,
+// when not nil.
+func connectSource(ctx context.Context, url string, slots *sourceLimiter) (*SourceConn, error) {
+	cfg, err := pgx.ParseConfig(url)
+	if err != nil {
+		return nil, err
+	}
+	return connectSourceConfig(ctx, cfg, slots)
+}
+
+// connectSourceConfig connects with default_transaction_read_only set at
+// session start, then checks the server really made the session read-only.
+// The connection counts against slots, when not nil, without waiting for a
+// slot.
+func connectSourceConfig(ctx context.Context, cfg *pgx.ConnConfig, slots *sourceLimiter) (*SourceConn, error) {
+	s, err := dialReadOnly(ctx, cfg, slots)
+	if err != nil {
+		return nil, err
+	}
+	if slots != nil {
+		slots.adopt(s)
+	}
+	return s, nil
+}
+
+// connectSourceSlot is connectSourceConfig for the workers of a parallel
+// copy, which have taken a slot with slots.acquire first. The slot is
+// released when connecting fails.
+func connectSourceSlot(ctx context.Context, cfg *pgx.ConnConfig, slots *sourceLimiter) (*SourceConn, error) {
+	s, err := dialReadOnly(ctx, cfg, slots)
+	if err != nil {
+		slots.release()
+		return nil, err
+	}
+	s.slots = slots
+	return s, nil
+}
+
+func dialReadOnly(ctx context.Context, cfg *pgx.ConnConfig, slots *sourceLimiter) (*SourceConn, error) {
+	cfg = cfg.Copy()
+	if cfg.RuntimeParams == nil {
+		cfg.RuntimeParams = map[string]string{}
+	}
+	cfg.RuntimeParams["default_transaction_read_only"] = "on"
+	conn, err := dialSource(ctx, cfg, slots)
+	if err != nil {
+		return nil, err
+	}
+
+	var readOnly string
+	if err := conn.QueryRow(ctx, "SHOW transaction_read_only").Scan(&readOnly); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to check that the source session is read-only: %w", err)
+	}
+	if readOnly != "on" {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("source session is not read-only (transaction_read_only = %s)", readOnly)
+	}
+	return &SourceConn{conn: conn}, nil
+}
+
+// readOnlyStatement reports whether sql starts with a keyword of a statement
+// that cannot write. Anything else, including statements preceded by a
+// comment, is rejected; the server-side read-only session still catches
+// data-modifying CTEs.
+func readOnlyStatement(sql string) bool {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH", "SHOW", "VALUES", "TABLE":
+		return true
+	}
+	return false
+}
+
+func (s *SourceConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if !readOnlyStatement(sql) {
+		return pgconn.CommandTag{}, errSourceWrite
+	}
+	return s.conn.Exec(ctx, sql, args...)
+}
+
+func (s *SourceConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if !readOnlyStatement(sql) {
+		return nil, errSourceWrite
+	}
+	return s.conn.Query(ctx, sql, args...)
+}
+
+func (s *SourceConn) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if !readOnlyStatement(sql) {
+		return errRow{errSourceWrite}
+	}
+	return s.conn.QueryRow(ctx, sql, args...)
+}
+
+// CopyTo runs a COPY ... TO STDOUT statement, writing its output to w.
+func (s *SourceConn) CopyTo(ctx context.Context, w io.Writer, sql string) (pgconn.CommandTag, error) {
+	upper := strings.ToUpper(sql)
+	if !strings.HasPrefix(strings.TrimSpace(upper), "COPY ") || !strings.Contains(upper, " TO STDOUT") {
+		return pgconn.CommandTag{}, errSourceWrite
+	}
+	return s.conn.PgConn().CopyTo(ctx, w, sql)
+}
+
+// cancelQuery asks the server to cancel the statement running on s, which
+// keeps the connection usable, unlike cancelling its context.
+func (s *SourceConn) cancelQuery(ctx context.Context) error {
+	return s.conn.PgConn().CancelRequest(ctx)
+}
+
+// Config returns the connection config, already forcing a read-only session.
+func (s *SourceConn) Config() *pgx.ConnConfig { return s.conn.Config() }
+
+func (s *SourceConn) IsClosed() bool { return s.conn.IsClosed() }
+
+// reconnect replaces a lost connection with a new read-only one of the same
+// config, keeping its slot.
+func (s *SourceConn) reconnect(ctx context.Context) error {
+	cfg := s.conn.Config()
+	s.conn.Close(context.Background())
+	fresh, err := dialReadOnly(ctx, cfg, s.slots)
+	if err != nil {
+		return err
+	}
+	s.conn = fresh.conn
+	// A snapshot does not outlive its transaction
+	s.snapshot = ""
+	return nil
+}
+
+func (s *SourceConn) Close(ctx context.Context) error {
+	if s.slots != nil {
+		s.slots.release()
+		s.slots = nil
+	}
+	return s.conn.Close(ctx)
+}
+
+type errRow struct{ err error }
+
+func (r errRow) Scan(...any) error { return r.err }
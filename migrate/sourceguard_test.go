@@ -0,0 +1,209 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceConnRejectsWrites(t *testing.T) {
+	ctx := context.Background()
+	for _, sql := range []string{
+		"INSERT INTO users (id) VALUES (1)",
+		"update users SET name = 'x'",
+		"DELETE FROM users",
+		"TRUNCATE users",
+		"CREATE TABLE t (id int)",
+		"DROP TABLE users",
+		"ALTER TABLE users ADD COLUMN x int",
+		"COPY users FROM STDIN",
+		"SET default_transaction_read_only = off",
+		"BEGIN READ WRITE",
+		"-- comment\nSELECT 1",
+		"/* SELECT */ DELETE FROM users",
+		"",
+	} {
+		t.Run(sql, func(t *testing.T) {
+			conn := &fakeConn{}
+			s := &SourceConn{conn: conn}
+			if _, err := s.Exec(ctx, sql); !errors.Is(err, errSourceWrite) {
+				t.Errorf("Exec error = %v, want errSourceWrite", err)
+			}
+			if _, err := s.Query(ctx, sql); !errors.Is(err, errSourceWrite) {
+				t.Errorf("Query error = %v, want errSourceWrite", err)
+			}
+			var n int
+			if err := s.QueryRow(ctx, sql).Scan(&n); !errors.Is(err, errSourceWrite) {
+				t.Errorf("QueryRow error = %v, want errSourceWrite", err)
+			}
+			if _, err := s.queryCursor(ctx, sql, 100, nil); !errors.Is(err, errSourceWrite) {
+				t.Errorf("queryCursor error = %v, want errSourceWrite", err)
+			}
+			if len(conn.queries) > 0 {
+				t.Errorf("statements reached the connection: %q", conn.queries)
+			}
+		})
+	}
+}
+
+func TestSourceConnCopyToOnly(t *testing.T) {
+	s := &SourceConn{conn: &fakeConn{}}
+	for _, sql := range []string{
+		"COPY users FROM STDIN",
+		`COPY "users" ("id") FROM STDIN WITH (FORMAT csv)`,
+		"SELECT 1",
+		"INSERT INTO users SELECT * FROM other",
+	} {
+		if _, err := s.CopyTo(context.Background(), io.Discard, sql); !errors.Is(err, errSourceWrite) {
+			t.Errorf("CopyTo(%q) error = %v, want errSourceWrite", sql, err)
+		}
+	}
+
+	// A source can never be handed to the copy path as a destination
+	var source any = s
+	if _, ok := source.(CopyConn); ok {
+		t.Error("SourceConn satisfies CopyConn, so it could be written to with CopyFrom")
+	}
+}
+
+func TestSourceConnPassesReads(t *testing.T) {
+	conn := &fakeConn{results: []fakeResult{{match: "SELECT", rows: [][]any{{int64(3)}}}}}
+	s := &SourceConn{conn: conn}
+	for _, sql := range []string{"SELECT count(*) FROM users", "  with x AS (SELECT 1) SELECT * FROM x", "SHOW server_version", "VALUES (1)", "TABLE users"} {
+		if _, err := s.Exec(context.Background(), sql); err != nil {
+			t.Errorf("Exec(%q) error = %v", sql, err)
+		}
+	}
+	var n int64
+	if err := s.QueryRow(context.Background(), "SELECT count(*) FROM users").Scan(&n); err != nil || n != 3 {
+		t.Errorf("QueryRow = %d, %v; want 3", n, err)
+	}
+}
+
+// statementsOf returns the statements c ran that start with one of
+// prefixes, in order.
+func statementsOf(c *fakeConn, prefixes ...string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for _, q := range c.queries {
+		for _, p := range prefixes {
+			if strings.HasPrefix(q, p) {
+				out = append(out, q)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func TestConsistentSnapshot(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lsn := "0/16B3748"
+	conn := &fakeConn{results: []fakeResult{
+		{match: "pg_export_snapshot()", rows: [][]any{{"00000003-0000001B-1", at, "10:12:11"}}},
+		{match: "pg_current_wal_lsn()", rows: [][]any{{&lsn}}},
+		{match: "FETCH", rows: [][]any{{int64(1)}}},
+	}}
+	sources := &sourceEndpoints{primary: &SourceConn{conn: conn}}
+	pos, err := sources.pinSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.SnapshotID != "00000003-0000001B-1" || pos.LSN != "0/16B3748" || !pos.At.Equal(at) || pos.Snapshot != "10:12:11" {
+		t.Errorf("position = %+v, want the exported snapshot", pos)
+	}
+
+	// Reads use the snapshot's transaction, and a cursor a savepoint of it
+	endpoint, err := sources.read("users", &Report{}, func(src *SourceConn) error {
+		rows, err := src.queryCursor(ctx, "SELECT id FROM users", 100, nil)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		return rows.Err()
+	})
+	if err != nil || endpoint != sourceEndpointPrimary {
+		t.Fatalf("read = %s, %v", endpoint, err)
+	}
+	boom := errors.New("boom")
+	if _, err := sources.read("users", &Report{}, func(*SourceConn) error { return boom }); !errors.Is(err, boom) {
+		t.Fatalf("read error = %v, want boom", err)
+	}
+	if err := sources.unpinSnapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		snapshotBegin,
+		"SAVEPOINT source_lsn",
+		"SAVEPOINT farewall_read",
+		"SAVEPOINT " + copyCursor,
+		"ROLLBACK TO SAVEPOINT " + copyCursor,
+		"RELEASE SAVEPOINT " + copyCursor,
+		"RELEASE SAVEPOINT farewall_read",
+		// The failed read leaves the snapshot usable
+		"SAVEPOINT farewall_read",
+		"ROLLBACK TO SAVEPOINT farewall_read",
+		"RELEASE SAVEPOINT farewall_read",
+		"ROLLBACK",
+	}
+	if got := statementsOf(conn, "BEGIN", "SAVEPOINT", "ROLLBACK", "RELEASE"); !reflect.DeepEqual(got, want) {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+	if sources.pinned != nil || sources.primary.snapshot != "" {
+		t.Error("the snapshot was not ended")
+	}
+}
+
+func TestConsistentSnapshotWithoutLSN(t *testing.T) {
+	conn := &fakeConn{results: []fakeResult{
+		{match: "pg_export_snapshot()", rows: [][]any{{"00000003-0000001B-1", time.Now(), "10:12:11"}}},
+		{match: "pg_current_wal_lsn()", err: errors.New("permission denied for function pg_current_wal_lsn")},
+	}}
+	s := &SourceConn{conn: conn}
+	pos, err := s.exportSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("a restricted LSN failed the export: %v", err)
+	}
+	if pos.LSN != "" || pos.SnapshotID == "" {
+		t.Errorf("position = %+v, want a snapshot without LSN", pos)
+	}
+	if !conn.ran("ROLLBACK TO SAVEPOINT source_lsn") {
+		t.Error("the failed LSN read was not rolled back, aborting the snapshot")
+	}
+}
+
+func TestImportSnapshot(t *testing.T) {
+	conn := &fakeConn{}
+	s := &SourceConn{conn: conn}
+	if err := s.importSnapshot(context.Background(), "00000003-0000001B-1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{snapshotBegin, "SET TRANSACTION SNAPSHOT '00000003-0000001B-1'"}
+	if got := statementsOf(conn, "BEGIN", "SET TRANSACTION"); !reflect.DeepEqual(got, want) {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+
+	// Without its connection the snapshot is gone, and reads stop
+	s.snapshot = ""
+	sources := &sourceEndpoints{primary: s, pinned: s}
+	if _, err := sources.read("users", &Report{}, func(*SourceConn) error { return nil }); !errors.Is(err, errSnapshotLost) {
+		t.Errorf("read error = %v, want errSnapshotLost", err)
+	}
+}
+
+func TestWarnSnapshotResumed(t *testing.T) {
+	cp := newCheckpoint("")
+	cp.table("teams").Completed = true
+	cp.table("events").Split = &SplitCheckpoint{Ranges: []*RangeCheckpoint{{Completed: true}, {}}}
+	report := &Report{}
+	warnSnapshotResumed([]Table{{Name: "users"}, {Name: "teams"}, {Name: "events"}}, cp, report)
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "teams, events") {
+		t.Errorf("warnings = %q, want one naming teams and events", report.Warnings)
+	}
+}
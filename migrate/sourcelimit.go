@@ -0,0 +1,194 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// defaultSourceConnectionLimit stays well under the connection limit of
+	// small Xata branches, which other clients share
+	defaultSourceConnectionLimit = 4
+
+	// A connection refused for too many connections is tried again with a
+	// doubling wait, for up to sourceConnectWait in all
+	sourceConnectBackoff    = time.Second
+	maxSourceConnectBackoff = 30 * time.Second
+	sourceConnectWait       = 10 * time.Minute
+)
+
+// sourceLimiter caps the source connections of the run at
+// --source-connection-limit. The connections held for the whole run (the
+// primary, the replica, the schema lock) are counted but never wait; the
+// workers of a parallel split_by copy wait for a free slot instead, so a
+// table never needs more connections than the limit allows.
+type sourceLimiter struct {
+	mu    sync.Mutex
+	limit int
+	open  int
+	// freed is closed, and replaced, whenever a slot is released
+	freed   chan struct{}
+	waiting int
+
+	peak     int
+	waits    int64
+	waited   time.Duration
+	rejected int64
+}
+
+// SourceConnectionReport summarizes the source connections of a run.
+type SourceConnectionReport struct {
+	Limit int `json:"limit"`
+	Peak  int `json:"peak"`
+	// Waits counts the workers that had to wait for a slot, for
+	// WaitedSeconds in all
+	Waits         int64   `json:"waits"`
+	WaitedSeconds float64 `json:"waited_seconds"`
+	// Rejected counts the connections the source refused for too many
+	// connections and that were tried again
+	Rejected int64 `json:"rejected"`
+}
+
+// newSourceLimiter returns a limiter of limit connections; with 0, as for
+// the verify subcommands, nothing waits.
+func newSourceLimiter(limit int) *sourceLimiter {
+	return &sourceLimiter{limit: limit, freed: make(chan struct{})}
+}
+
+// adopt counts s, opened without a limiter, against l until it is closed.
+func (l *sourceLimiter) adopt(s *SourceConn) {
+	if s == nil || s.slots != nil {
+		return
+	}
+	l.hold()
+	s.slots = l
+}
+
+// hold counts a connection opened without waiting.
+func (l *sourceLimiter) hold() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open++
+	l.peak = max(l.peak, l.open)
+}
+
+// spare returns how many more connections the limit allows right now.
+func (l *sourceLimiter) spare() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return math.MaxInt
+	}
+	return max(0, l.limit-l.open)
+}
+
+// acquire waits for a free slot and takes it. The caller releases it,
+// usually by closing the connection it opens with it.
+func (l *sourceLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.limit == 0 || l.open < l.limit {
+		l.open++
+		l.peak = max(l.peak, l.open)
+		l.mu.Unlock()
+		return nil
+	}
+	l.waiting++
+	l.waits++
+	fmt.Printf("  Waiting for a source connection slot (%d of %d in use, %d waiting)\n", l.open, l.limit, l.waiting)
+	start := time.Now()
+	defer func() {
+		l.waiting--
+		l.waited += time.Since(start)
+		l.mu.Unlock()
+	}()
+	for l.open >= l.limit {
+		freed := l.freed
+		l.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			l.mu.Lock()
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.open++
+	l.peak = max(l.peak, l.open)
+	return nil
+}
+
+func (l *sourceLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// Waiting returns the number of workers waiting for a slot.
+func (l *sourceLimiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+func (l *sourceLimiter) recordRejected() {
+	l.mu.Lock()
+	l.rejected++
+	l.mu.Unlock()
+}
+
+func (l *sourceLimiter) report() *SourceConnectionReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return nil
+	}
+	return &SourceConnectionReport{Limit: l.limit, Peak: l.peak, Waits: l.waits, WaitedSeconds: l.waited.Seconds(), Rejected: l.rejected}
+}
+
+// tooManyConnections reports whether err is the server, or a proxy in front
+// of it, refusing a connection because it has too many.
+func tooManyConnections(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if pgErr.Code == "53300" { // too_many_connections
+			return true
+		}
+		msg := strings.ToLower(pgErr.Message)
+		return strings.Contains(msg, "too many connections") || strings.Contains(msg, "too many clients")
+	}
+	return false
+}
+
+// dialSource connects to the source, waiting and trying again while it
+// refuses connections for having too many.
+func dialSource(ctx context.Context, cfg *pgx.ConnConfig, slots *sourceLimiter) (*pgx.Conn, error) {
+	wait := sourceConnectBackoff
+	deadline := time.Now().Add(sourceConnectWait)
+	for {
+		conn, err := pgx.ConnectConfig(ctx, cfg)
+		if err == nil || !tooManyConnections(err) || time.Now().Add(wait).After(deadline) {
+			return conn, err
+		}
+		if slots != nil {
+			slots.recordRejected()
+		}
+		log.Printf("The source refused a connection for having too many; trying again in %s", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait = min(2*wait, maxSourceConnectBackoff)
+	}
+}
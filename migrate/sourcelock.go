@@ -0,0 +1,140 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sourceSchemaLockKey names the advisory lock held shared on the source
+// with --lock-source-schema. Schema migration tooling can take it
+// exclusively, SELECT pg_advisory_lock(hashtext('farewall-xata-lite:source-schema')),
+// to wait for running migrations and keep new ones from starting.
+const sourceSchemaLockKey = "farewall-xata-lite:source-schema"
+
+// lockBlocker is a session holding or waiting for a lock that conflicts
+// with the source schema lock.
+type lockBlocker struct {
+	PID         int
+	Object      string
+	Mode        string
+	Granted     bool
+	User        string
+	Application string
+	Query       string
+}
+
+func (b lockBlocker) String() string {
+	state := "waiting for"
+	if b.Granted {
+		state = "holding"
+	}
+	return fmt.Sprintf("pid %d (%s, %s) %s %s on %s: %s", b.PID, b.User, b.Application, state, b.Mode, b.Object, b.Query)
+}
+
+// lockShared begins a read-only transaction that holds ACCESS SHARE locks
+// on tables (every table of schemas when empty) and the shared advisory lock
+// sourceSchemaLockKey until the connection is closed. ACCESS SHARE only
+// conflicts with ACCESS EXCLUSIVE, which ALTER TABLE, DROP TABLE and the
+// like need, so reads and writes of the application go on. These statements
+// bypass the statement check of SourceConn; none of them can write.
+func (s *SourceConn) lockShared(ctx context.Context, tables, schemas []string, timeout time.Duration) error {
+	if _, err := s.conn.Exec(ctx, "BEGIN READ ONLY"); err != nil {
+		return err
+	}
+	if _, err := s.conn.Exec(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d", timeout.Milliseconds())); err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		rows, err := s.conn.Query(ctx, `
+			SELECT CASE WHEN schemaname = 'public' THEN tablename::text ELSE schemaname || '.' || tablename END
+			FROM pg_catalog.pg_tables
+			WHERE schemaname = ANY($1)
+			ORDER BY 1
+		`, schemas)
+		if err != nil {
+			return err
+		}
+		if tables, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+			return err
+		}
+	}
+	if len(tables) > 0 {
+		idents := make([]string, len(tables))
+		for i, t := range tables {
+			idents[i] = keyIdent(t, schemas)
+		}
+		if _, err := s.conn.Exec(ctx, "LOCK TABLE "+strings.Join(idents, ", ")+" IN ACCESS SHARE MODE"); err != nil {
+			return err
+		}
+	}
+	_, err := s.conn.Exec(ctx, "SELECT pg_advisory_xact_lock_shared(hashtext($1))", sourceSchemaLockKey)
+	return err
+}
+
+// lockSourceSchema opens a connection to the source that holds the schema
+// lock for the rest of the run; closing it releases the lock. When the
+// locks cannot be had within timeout, the sessions in the way are listed
+// and the run stops before anything is written.
+func lockSourceSchema(ctx context.Context, primary *SourceConn, tables, schemas []string, timeout time.Duration) (*SourceConn, error) {
+	conn, err := connectSourceConfig(ctx, primary.Config(), primary.slots)
+	if err != nil {
+		return nil, withSentinel(ErrConnect, fmt.Errorf("unable to open the source schema lock connection: %w", err))
+	}
+	fmt.Printf("Locking source schema (timeout %s)...\n", timeout)
+	err = conn.lockShared(ctx, tables, schemas, timeout)
+	if err == nil {
+		return conn, nil
+	}
+	conn.Close(context.Background())
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "55P03" { // lock_not_available
+		return nil, fmt.Errorf("failed to lock source schema: %w", err)
+	}
+	blockers, berr := sourceLockBlockers(ctx, primary, tables, schemas)
+	if berr != nil {
+		return nil, fmt.Errorf("could not lock source schema within %s (%v); listing the blocking sessions failed: %w", timeout, err, berr)
+	}
+	fmt.Printf("  Could not lock the source schema within %s; blocked by:\n", timeout)
+	for _, b := range blockers {
+		fmt.Printf("    %s\n", b)
+	}
+	return nil, fmt.Errorf("could not lock source schema within %s: %d session(s) hold or wait for conflicting locks; retry when their schema change is done", timeout, len(blockers))
+}
+
+// sourceLockBlockers lists sessions holding or queued for ACCESS EXCLUSIVE
+// on one of tables (any public table when empty), or for the schema
+// advisory lock exclusively.
+func sourceLockBlockers(ctx context.Context, source *SourceConn, tables, schemas []string) ([]lockBlocker, error) {
+	if tables == nil {
+		tables = []string{}
+	}
+	rows, err := source.Query(ctx, `
+		SELECT l.pid, coalesce(`+sourceKeySQL+`, 'advisory lock'), l.mode, l.granted,
+			coalesce(a.usename::text, ''), coalesce(a.application_name, ''), left(coalesce(a.query, ''), 200)
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		LEFT JOIN pg_class c ON c.oid = l.relation
+		LEFT JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE l.pid <> pg_backend_pid()
+		  AND ((l.locktype = 'relation' AND l.mode = 'AccessExclusiveLock' AND n.nspname = ANY($3)
+		        AND (cardinality($1::text[]) = 0 OR `+sourceKeySQL+` = ANY($1)))
+		    OR (l.locktype = 'advisory' AND l.mode = 'ExclusiveLock' AND l.objsubid = 1
+		        AND ((l.classid::bigint << 32) | l.objid::bigint) = hashtext($2)::bigint))
+		ORDER BY l.granted DESC, l.pid
+	`, tables, sourceSchemaLockKey, schemas)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (lockBlocker, error) {
+		var b lockBlocker
+		err := row.Scan(&b.PID, &b.Object, &b.Mode, &b.Granted, &b.User, &b.Application, &b.Query)
+		return b, err
+	})
+}
@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+)
+
+const defaultMaxSourceDrift = 64 << 20
+
+// sourceLSNExpr is the WAL position of the source, on a standby the last
+// replayed one.
+const sourceLSNExpr = "CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END"
+
+// SourcePosition is where the source stood at one point of the copy, for
+// audits. By default the copy reads every table in a transaction of its
+// own, so no single snapshot covers the data; the positions of the start
+// and the end of the copy bound what was read. With --consistent-snapshot
+// every table is read in the snapshot the start position was exported
+// from, SnapshotID.
+type SourcePosition struct {
+	// At is the start of the transaction that read the position
+	At time.Time `json:"at"`
+	// SnapshotID is the pg_export_snapshot ID the copy read, with
+	// --consistent-snapshot
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	// LSN is empty when the source does not let it be read
+	LSN string `json:"lsn,omitempty"`
+	// Snapshot is txid_current_snapshot, xmin:xmax:running transactions
+	Snapshot string `json:"snapshot"`
+}
+
+// SourceReadPositions are the positions of the source when the copy phase
+// started and when it finished; End is nil when the copy failed.
+type SourceReadPositions struct {
+	Start *SourcePosition `json:"start"`
+	End   *SourcePosition `json:"end,omitempty"`
+}
+
+// latest returns the last position recorded.
+func (p *SourceReadPositions) latest() *SourcePosition {
+	if p.End != nil {
+		return p.End
+	}
+	return p.Start
+}
+
+// SourceDrift compares the current position of the source with the one
+// recorded at the end of the migration.
+type SourceDrift struct {
+	Recorded SourcePosition `json:"recorded"`
+	Current  SourcePosition `json:"current"`
+	// Bytes is the WAL written since, when both LSNs are known
+	Bytes *int64 `json:"bytes,omitempty"`
+	// Transactions is how far the transaction counter moved since
+	Transactions int64 `json:"transactions"`
+	// Advanced is set when Bytes exceeds --max-source-drift
+	Advanced bool `json:"advanced"`
+}
+
+func readSourcePosition(ctx context.Context, source Querier) (*SourcePosition, error) {
+	var p SourcePosition
+	if err := source.QueryRow(ctx, "SELECT now(), txid_current_snapshot()::text").Scan(&p.At, &p.Snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read the source position: %w", err)
+	}
+	p.At = p.At.UTC()
+	// Not fatal: some managed servers restrict the WAL functions
+	var lsn *string
+	if err := source.QueryRow(ctx, "SELECT ("+sourceLSNExpr+")::text").Scan(&lsn); err == nil && lsn != nil {
+		p.LSN = *lsn
+	}
+	return &p, nil
+}
+
+// recordSourcePosition adds the copy's source positions to the schema
+// snapshot, which the create-schema phase wrote before the copy. Without a
+// snapshot, as when only the copy phase runs, there is nothing to add to.
+func recordSourcePosition(path string, pos *SourceReadPositions) error {
+	snap, err := loadSchemaSnapshot(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snap.SourcePosition = pos
+	return saveSchemaSnapshot(path, snap)
+}
+
+// checkSourceDrift compares the source with the position recorded in the
+// schema snapshot and logs a warning when it has advanced by more than
+// maxBytes of WAL since, since rows may then differ for that reason alone.
+func checkSourceDrift(ctx context.Context, source Querier, recorded *SourcePosition, maxBytes int64) (*SourceDrift, error) {
+	current, err := readSourcePosition(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	d := &SourceDrift{Recorded: *recorded, Current: *current}
+	if err := source.QueryRow(ctx, "SELECT txid_snapshot_xmax($1::txid_snapshot) - txid_snapshot_xmax($2::txid_snapshot)",
+		current.Snapshot, recorded.Snapshot).Scan(&d.Transactions); err != nil {
+		return nil, fmt.Errorf("failed to compare source snapshots: %w", err)
+	}
+	if recorded.LSN != "" && current.LSN != "" {
+		var bytes int64
+		if err := source.QueryRow(ctx, "SELECT pg_wal_lsn_diff($1::pg_lsn, $2::pg_lsn)::bigint", current.LSN, recorded.LSN).Scan(&bytes); err != nil {
+			return nil, fmt.Errorf("failed to compare source positions: %w", err)
+		}
+		d.Bytes = &bytes
+		d.Advanced = bytes > maxBytes
+	}
+	if d.Advanced {
+		log.Printf("warning: the source has advanced %s of WAL (%d transactions) past the position recorded at %s; differences may come from later writes",
+			formatBytes(*d.Bytes), d.Transactions, recorded.At.Format(time.RFC3339))
+	}
+	return d, nil
+}
@@ -0,0 +1,495 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/schollz/progressbar/v3"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// sliceRetries is how often a range of a table sliced with --workers is
+// retried, as split_by's retries
+const sliceRetries = 2
+
+// resetStaleSplits drops recorded ranges whose split_by settings, or
+// --workers slices, changed since they were planned; the table is then
+// recreated and copied again.
+func resetStaleSplits(tables []Table, opts Options, cp *Checkpoint) {
+	for _, t := range tables {
+		tc, ok := cp.Tables[t.Name]
+		if !ok || tc.Completed || tc.Split == nil {
+			continue
+		}
+		sc := opts.Config.table(t.Name).SplitBy
+		if sc == nil {
+			sc = sliceSplit(t, opts)
+		}
+		if sc == nil || sc.Column != tc.Split.Column || sc.Interval != tc.Split.Interval || sc.Chunks != tc.Split.Chunks || sc.Slices != tc.Split.Slices {
+			cp.reset(t.Name)
+		}
+	}
+}
+
+// sliceSplit returns the split of a table copied in --workers parallel key
+// slices, or nil when --workers is 1 or the primary key is not a single
+// integer or uuid column. The copy only slices tables with more than
+// --chunk-size rows, or whose slices an earlier run began.
+func sliceSplit(t Table, opts Options) *SplitConfig {
+	if opts.Workers <= 1 || len(t.PrimaryKey) != 1 {
+		return nil
+	}
+	col, ok := t.column(t.PrimaryKey[0])
+	if !ok || !keysetType(col.DataType) {
+		return nil
+	}
+	return &SplitConfig{Column: col.Name, Slices: opts.Workers, Parallel: opts.Workers, Retries: sliceRetries}
+}
+
+// planRanges splits the split column's current [min, max] into ranges of the
+// configured interval. The first range is open below and the last open
+// above, so rows inserted outside the planned bounds before a resume are
+// still copied; a final range picks up the NULLs. A table split into hash
+// chunks needs no planning: every non-NULL value hashes to exactly one chunk.
+func planRanges(ctx context.Context, source *SourceConn, t Table, sc *SplitConfig) ([]*RangeCheckpoint, error) {
+	if sc.Chunks > 0 {
+		ranges := make([]*RangeCheckpoint, 0, sc.Chunks+1)
+		for i := 0; i < sc.Chunks; i++ {
+			ranges = append(ranges, &RangeCheckpoint{Hash: &HashChunk{Chunk: i, Of: sc.Chunks}})
+		}
+		return append(ranges, &RangeCheckpoint{Null: true}), nil
+	}
+	if sc.Slices > 0 {
+		return planSlices(ctx, source, t, sc)
+	}
+	col, _ := t.column(sc.Column)
+	quoted := sqlutil.QuoteIdent(sc.Column)
+	from := fromClause(t)
+	query := fmt.Sprintf(`
+		SELECT b::text FROM (
+			SELECT DISTINCT lo::%[3]s AS b
+			FROM generate_series((SELECT min(%[1]s) FROM %[2]s), (SELECT max(%[1]s) FROM %[2]s), $1::interval) lo
+		) bounds
+		ORDER BY b
+	`, quoted, from, castType(col))
+
+	rows, err := source.Query(ctx, query, sc.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan ranges of %s: %w", t.Name, err)
+	}
+	bounds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan ranges of %s: %w", t.Name, err)
+	}
+
+	ranges := []*RangeCheckpoint{{}}
+	for _, b := range bounds[min(1, len(bounds)):] {
+		ranges[len(ranges)-1].Hi = &b
+		ranges = append(ranges, &RangeCheckpoint{Lo: &b})
+	}
+	return append(ranges, &RangeCheckpoint{Null: true}), nil
+}
+
+// rangeCondition returns the WHERE condition and arguments selecting r.
+func rangeCondition(t Table, column string, r *RangeCheckpoint) (string, []any) {
+	col, _ := t.column(column)
+	return rangeConditionOn(sqlutil.QuoteIdent(column), castType(col), r)
+}
+
+// rangeConditionOn is rangeCondition for the quoted column of type typ.
+func rangeConditionOn(quoted, typ string, r *RangeCheckpoint) (string, []any) {
+	if r.Null {
+		return quoted + " IS NULL", nil
+	}
+	cond := quoted + " IS NOT NULL"
+	if r.Hash != nil {
+		// % keeps the sign of the hash, so negative remainders are shifted
+		// up; the sum stays far from overflowing
+		h := "hashtextextended(" + quoted + "::text, 0)"
+		return cond + " AND (" + h + " % $1::bigint + $1::bigint) % $1::bigint = $2::bigint", []any{int64(r.Hash.Of), int64(r.Hash.Chunk)}
+	}
+	var args []any
+	if r.Lo != nil {
+		args = append(args, *r.Lo)
+		cond += fmt.Sprintf(" AND %s >= $%d::%s", quoted, len(args), typ)
+	}
+	if r.Hi != nil {
+		args = append(args, *r.Hi)
+		cond += fmt.Sprintf(" AND %s < $%d::%s", quoted, len(args), typ)
+	}
+	return cond, args
+}
+
+func (r *RangeCheckpoint) label() string {
+	if r.Null {
+		return "NULL"
+	}
+	if r.Hash != nil {
+		return fmt.Sprintf("hash %d/%d", r.Hash.Chunk, r.Hash.Of)
+	}
+	lo, hi := "-inf", "+inf"
+	if r.Lo != nil {
+		lo = *r.Lo
+	}
+	if r.Hi != nil {
+		hi = *r.Hi
+	}
+	return "[" + lo + ", " + hi + ")"
+}
+
+// tableSlices returns the --workers slices t with count rows is copied in,
+// or nil. Slices an earlier run began are continued, and a table an earlier
+// run began copying in key chunks stays chunked.
+func tableSlices(t Table, count int64, opts Options, cp *Checkpoint) *SplitConfig {
+	sc := sliceSplit(t, opts)
+	if sc == nil {
+		return nil
+	}
+	tc, ok := cp.Tables[t.Name]
+	switch {
+	case ok && !tc.Completed && tc.Split != nil:
+		return sc
+	case ok && !tc.Completed && tc.Keyset != nil && tc.Keyset.Chunks > 0:
+		return nil
+	case count > int64(opts.ChunkSize):
+		return sc
+	}
+	return nil
+}
+
+// sliceSampleRows is about how many rows planSlices samples
+const sliceSampleRows = 100000
+
+// planSlices splits an integer or uuid column into sc.Slices ranges holding
+// about as many rows each. The boundaries are percentiles of a block sample
+// of the table, of about sliceSampleRows rows by the planner's estimate, so
+// planning never sorts the whole table; a skewed sample only makes the
+// slices uneven. Ranges include their lower and exclude their upper bound,
+// with the first open below and the last open above, so every key falls in
+// exactly one. The key is never NULL, so there is no NULL range.
+func planSlices(ctx context.Context, source *SourceConn, t Table, sc *SplitConfig) ([]*RangeCheckpoint, error) {
+	var estimate float64
+	if err := source.QueryRow(ctx, "SELECT reltuples FROM pg_class WHERE oid = $1::regclass", sourceIdent(t)).Scan(&estimate); err != nil {
+		return nil, fmt.Errorf("failed to plan slices of %s: %w", t.Name, err)
+	}
+	percent := 100.0
+	if estimate > sliceSampleRows {
+		percent = 100 * sliceSampleRows / estimate
+	}
+	fractions := make([]float64, sc.Slices-1)
+	for i := range fractions {
+		fractions[i] = float64(i+1) / float64(sc.Slices)
+	}
+	quoted := sqlutil.QuoteIdent(sc.Column)
+	query := fmt.Sprintf(`
+		SELECT b::text FROM (
+			SELECT DISTINCT unnest(percentile_disc($1::float8[]) WITHIN GROUP (ORDER BY %[1]s)) AS b
+			FROM %[2]s TABLESAMPLE SYSTEM ($2)
+		) bounds
+		WHERE b IS NOT NULL
+		ORDER BY b
+	`, quoted, fromClause(t))
+	rows, err := source.Query(ctx, query, fractions, percent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan slices of %s: %w", t.Name, err)
+	}
+	bounds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan slices of %s: %w", t.Name, err)
+	}
+	ranges := []*RangeCheckpoint{{}}
+	for _, b := range bounds {
+		ranges[len(ranges)-1].Hi = &b
+		ranges = append(ranges, &RangeCheckpoint{Lo: &b})
+	}
+	return ranges, nil
+}
+
+// copyTableSplit copies a table range by range, or chunk by chunk, as
+// configured by split_by.
+// Ranges completed by an earlier run are skipped. With a non-nil verify
+// every range is read back and compared after it lands (--verify-chunks).
+// It returns the rows and bytes copied by this invocation.
+func copyTableSplit(ctx context.Context, source *SourceConn, dest CopyConn, t Table, count int64, sc *SplitConfig, cp *Checkpoint, pipelines []*columnPipeline, stats *RetryStats, verify *ChunkVerification, wal *walMonitor) (int64, int64, error) {
+	tc := cp.table(t.Name)
+	if tc.Split == nil {
+		ranges, err := planRanges(ctx, source, t, sc)
+		if err != nil {
+			return 0, 0, err
+		}
+		tc.Split = &SplitCheckpoint{Column: sc.Column, Interval: sc.Interval, Chunks: sc.Chunks, Slices: sc.Slices, Ranges: ranges}
+		if err := cp.save(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var pending []*RangeCheckpoint
+	for _, r := range tc.Split.Ranges {
+		if !r.Completed {
+			pending = append(pending, r)
+		}
+	}
+	by := sc.Interval
+	switch {
+	case sc.Chunks > 0:
+		by = fmt.Sprintf("hash into %d chunks", sc.Chunks)
+	case sc.Slices > 0:
+		by = fmt.Sprintf("%d key slices", sc.Slices)
+	}
+	fmt.Printf("  Split by %s (%s): %d ranges, %d to copy\n", sc.Column, by, len(tc.Split.Ranges), len(pending))
+
+	run := runOf(ctx)
+	workers := max(1, min(sc.Parallel, len(pending)))
+	if workers > 1 && run.slots.spare() == 0 {
+		// The workers would wait for each other forever
+		fmt.Println("  No source connection left under --source-connection-limit; copying the ranges one at a time")
+		workers = 1
+	}
+	var err error
+	if workers == 1 {
+		w := &rangeWorker{source: source, dest: dest, stats: stats, verify: verify, wal: wal}
+		for _, r := range pending {
+			if err = w.copyRangeWithRetry(ctx, t, sc, r, cp, pipelines); err != nil {
+				break
+			}
+		}
+	} else {
+		// One bar for the whole table, started at the ranges already done
+		bar := run.newProgressBar(count, "  Copying")
+		_ = bar.Add64(min(cp.splitProgress(t.Name).RowsCopied, count))
+		err = copyRangesParallel(ctx, source, dest, t, sc, pending, workers, cp, pipelines, stats, verify, wal, bar)
+		bar.Finish()
+		fmt.Println()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rows, bytes int64
+	for _, r := range pending {
+		rows += r.RowsCopied
+		bytes += r.BytesCopied
+	}
+	return rows, bytes, nil
+}
+
+// copyRangesParallel copies ranges on workers connections of their own,
+// stopping at the first range that fails for good. Every worker counts its
+// rows on bar.
+func copyRangesParallel(ctx context.Context, source *SourceConn, dest CopyConn, t Table, sc *SplitConfig, pending []*RangeCheckpoint, workers int, cp *Checkpoint, pipelines []*columnPipeline, stats *RetryStats, verify *ChunkVerification, wal *walMonitor, bar *progressbar.ProgressBar) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slotCtx, allTaken := context.WithCancel(ctx)
+	defer allTaken()
+
+	jobs := make(chan *RangeCheckpoint)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &rangeWorker{owned: true, stats: stats, verify: verify, wal: wal, bar: bar, snapshot: source.snapshot}
+			defer w.close()
+			// A worker still waiting for a source slot once every range
+			// is taken has nothing left to do
+			if err := w.connect(ctx, slotCtx, source.Config(), dest.Config()); err != nil {
+				if slotCtx.Err() == nil || ctx.Err() != nil {
+					fail(err)
+				}
+				return
+			}
+
+			for r := range jobs {
+				if err := w.copyRangeWithRetry(ctx, t, sc, r, cp, pipelines); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, r := range pending {
+		select {
+		case jobs <- r:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	allTaken()
+	wg.Wait()
+	return firstErr
+}
+
+// rangeWorker copies ranges on one pair of connections. Workers of a
+// parallel copy own their connections and reconnect when one was lost;
+// with --consistent-snapshot they read the coordinator's snapshot.
+type rangeWorker struct {
+	source *SourceConn
+	dest   CopyConn
+	owned  bool
+	stats  *RetryStats
+	verify *ChunkVerification
+	wal    *walMonitor
+	// bar is the table's bar shared by the workers of a parallel copy
+	bar *progressbar.ProgressBar
+	// snapshot is the exported snapshot owned connections import
+	snapshot string
+}
+
+// connect opens the worker's connections once a source slot is free;
+// slotCtx ends the wait for it.
+func (w *rangeWorker) connect(ctx, slotCtx context.Context, sourceConfig, destConfig *pgx.ConnConfig) error {
+	if sourceConfig == nil || destConfig == nil {
+		return fmt.Errorf("parallel copies need connections that can be dialled again")
+	}
+	slots := runOf(ctx).slots
+	if err := slots.acquire(slotCtx); err != nil {
+		return err
+	}
+	src, err := connectSourceSlot(ctx, sourceConfig, slots)
+	if err != nil {
+		return onEndpoint(endpointSource, withSentinel(ErrConnect, fmt.Errorf("failed to open source connection: %w", err)))
+	}
+	if w.snapshot != "" {
+		if err := src.importSnapshot(ctx, w.snapshot); err != nil {
+			src.Close(context.Background())
+			return onEndpoint(endpointSource, err)
+		}
+	}
+	dst, err := pgx.ConnectConfig(ctx, destConfig.Copy())
+	if err != nil {
+		src.Close(context.Background())
+		return onEndpoint(endpointDestination, withSentinel(ErrConnect, fmt.Errorf("failed to open destination connection: %w", err)))
+	}
+	w.source, w.dest = src, dst
+	return nil
+}
+
+func (w *rangeWorker) close() {
+	if w.source != nil {
+		w.source.Close(context.Background())
+	}
+	if w.dest != nil {
+		w.dest.Close(context.Background())
+	}
+}
+
+// reconnect replaces lost connections of an owned worker.
+func (w *rangeWorker) reconnect(ctx context.Context) error {
+	if !w.owned || (!w.source.IsClosed() && !w.dest.IsClosed()) {
+		return nil
+	}
+	sourceConfig, destConfig := w.source.Config(), w.dest.Config()
+	w.close()
+	w.stats.recordReconnect()
+	return w.connect(ctx, ctx, sourceConfig, destConfig)
+}
+
+// copyRangeWithRetry copies one range, retrying up to sc.Retries times. A
+// range is a single COPY, so a failed attempt leaves nothing behind and the
+// retry starts from scratch. A verified range has landed by the time it is
+// checked, so it is deleted before it is copied again; checksum mismatches
+// are retried up to their own limit.
+func (w *rangeWorker) copyRangeWithRetry(ctx context.Context, t Table, sc *SplitConfig, r *RangeCheckpoint, cp *Checkpoint, pipelines []*columnPipeline) error {
+	run := runOf(ctx)
+	quiet := w.owned
+	mismatches := 0
+	for attempt := 1; ; attempt++ {
+		var rows, bytes int64
+		err := w.source.inSavepoint(ctx, "farewall_range", func() (err error) {
+			rows, bytes, err = copyRange(ctx, w.source, w.dest, t, sc, r, pipelines, w.bar, w.verify != nil, w.wal)
+			return err
+		})
+		if err == nil {
+			if quiet {
+				run.debugf("%s: range %s: %d rows", t.Name, r.label(), rows)
+			}
+			if w.verify != nil {
+				w.verify.recordVerified()
+			}
+			return cp.markRange(r, rows, bytes)
+		}
+		if errors.Is(err, errChunkMismatch) {
+			w.verify.recordMismatch()
+			mismatches++
+			if mismatches > w.verify.retries {
+				return &VerificationError{Table: t.Name, Err: fmt.Errorf("range %s of %s: %w in %d copies; giving up", r.label(), t.Name, err, mismatches)}
+			}
+			log.Printf("Range %s of %s: %v; copying it again (%d of %d)", r.label(), t.Name, err, mismatches, w.verify.retries)
+			if err := deleteRange(ctx, w.dest, t, sc, r); err != nil {
+				return err
+			}
+			attempt--
+			continue
+		}
+		w.stats.recordError(err)
+		if attempt > sc.Retries || ctx.Err() != nil || run.control.skipRequested() {
+			return fmt.Errorf("range %s of %s failed after %d attempt(s): %w", r.label(), t.Name, attempt, err)
+		}
+		log.Printf("Range %s of %s failed (attempt %d of %d): %v; retrying", r.label(), t.Name, attempt, sc.Retries+1, err)
+		run.record(JournalEvent{Type: eventRetry, Table: t.Name, Attempt: attempt, Message: "range " + r.label(), Error: err.Error()})
+		time.Sleep(time.Duration(attempt) * time.Second)
+		w.stats.recordRetry()
+		if err := w.reconnect(ctx); err != nil {
+			w.stats.recordError(err)
+			return fmt.Errorf("range %s of %s: %w", r.label(), t.Name, err)
+		}
+		// The failure may have come after the range landed
+		if w.verify != nil {
+			if err := deleteRange(ctx, w.dest, t, sc, r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyRange copies one range, on shared, the bar of a parallel copy, or
+// else on a bar of its own.
+func copyRange(ctx context.Context, source *SourceConn, dest CopyConn, t Table, sc *SplitConfig, r *RangeCheckpoint, pipelines []*columnPipeline, shared *progressbar.ProgressBar, verify bool, wal *walMonitor) (int64, int64, error) {
+	cond, args := rangeCondition(t, sc.Column, r)
+
+	bar := shared
+	if bar == nil {
+		var count int64
+		if err := source.QueryRow(ctx, sqlutil.CountRows(fromClause(t))+" WHERE "+cond, args...).Scan(&count); err != nil {
+			return 0, 0, onEndpoint(endpointSource, fmt.Errorf("failed to count range: %w", err))
+		}
+		bar = runOf(ctx).newProgressBar(count, "  "+r.label())
+	}
+	var sum *chunkChecksum
+	if verify {
+		sum = &chunkChecksum{}
+	}
+	copied, bytes, err := copyRows(ctx, source, dest, t, destIdentifier(t), cond, args, bar, pipelines, sum, wal)
+	if err != nil {
+		return 0, 0, err
+	}
+	if shared == nil {
+		bar.Finish()
+		fmt.Println()
+	}
+	if verify {
+		if err := verifyRange(ctx, dest, t, sc, r, *sum); err != nil {
+			return 0, 0, err
+		}
+	}
+	return copied, bytes, nil
+}
@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPlanRangesByInterval(t *testing.T) {
+	events := Table{Name: "events", Columns: []Column{{Name: "id", DataType: "bigint"}, {Name: "created_at", DataType: "timestamp with time zone"}}}
+	sc := &SplitConfig{Column: "created_at", Interval: "1 month"}
+	for _, tt := range []struct {
+		name   string
+		bounds []string
+		want   [][2]string
+	}{
+		// the first bound is the minimum, which the open first range covers
+		{name: "three months", bounds: []string{"2024-01-01", "2024-02-01", "2024-03-01"},
+			want: [][2]string{{"", "2024-02-01"}, {"2024-02-01", "2024-03-01"}, {"2024-03-01", ""}}},
+		{name: "one bound", bounds: []string{"2024-01-01"}, want: [][2]string{{"", ""}}},
+		{name: "empty table", want: [][2]string{{"", ""}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := make([][]any, len(tt.bounds))
+			for i, b := range tt.bounds {
+				rows[i] = []any{b}
+			}
+			source := &fakeConn{results: []fakeResult{{match: "generate_series", rows: rows}}}
+			ranges, err := planRanges(context.Background(), &SourceConn{conn: source}, events, sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if args := source.argsOf("generate_series"); !reflect.DeepEqual(args, []any{"1 month"}) {
+				t.Errorf("planned with %v, want the interval", args)
+			}
+			if len(ranges) != len(tt.want)+1 {
+				t.Fatalf("planned %d ranges, want %d and the NULL range", len(ranges), len(tt.want))
+			}
+			if last := ranges[len(ranges)-1]; !last.Null || last.Lo != nil || last.Hi != nil {
+				t.Errorf("last range = %s, want the NULL range", last.label())
+			}
+			bounded := ranges[:len(ranges)-1]
+			for i, r := range bounded {
+				var lo, hi string
+				if r.Lo != nil {
+					lo = *r.Lo
+				}
+				if r.Hi != nil {
+					hi = *r.Hi
+				}
+				if r.Null || r.Hash != nil || [2]string{lo, hi} != tt.want[i] {
+					t.Errorf("range %d = %s, want [%q, %q)", i, r.label(), tt.want[i][0], tt.want[i][1])
+				}
+				// each range starts where the one before it ends
+				if i > 0 && (r.Lo == nil || bounded[i-1].Hi == nil || *r.Lo != *bounded[i-1].Hi) {
+					t.Errorf("range %d = %s does not start where %s ends", i, r.label(), bounded[i-1].label())
+				}
+			}
+			if bounded[0].Lo != nil || bounded[len(bounded)-1].Hi != nil {
+				t.Errorf("ranges %s to %s are not open at both ends", bounded[0].label(), bounded[len(bounded)-1].label())
+			}
+		})
+	}
+}
+
+func TestPlanRangesByHash(t *testing.T) {
+	source := &fakeConn{}
+	ranges, err := planRanges(context.Background(), &SourceConn{conn: source}, Table{Name: "events"}, &SplitConfig{Column: "id", Chunks: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.queries) != 0 {
+		t.Errorf("hash chunks ran %q, want no planning", source.queries)
+	}
+	want := []string{"hash 0/3", "hash 1/3", "hash 2/3", "NULL"}
+	var got []string
+	for _, r := range ranges {
+		got = append(got, r.label())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ranges = %q, want %q", got, want)
+	}
+}
+
+func TestRangeConditionOn(t *testing.T) {
+	lo, hi := "2024-01-01", "2024-02-01"
+	for _, tt := range []struct {
+		name     string
+		r        *RangeCheckpoint
+		wantCond string
+		wantArgs []any
+	}{
+		{name: "bounded", r: &RangeCheckpoint{Lo: &lo, Hi: &hi},
+			wantCond: `"created_at" IS NOT NULL AND "created_at" >= $1::timestamptz AND "created_at" < $2::timestamptz`, wantArgs: []any{lo, hi}},
+		{name: "open below", r: &RangeCheckpoint{Hi: &hi},
+			wantCond: `"created_at" IS NOT NULL AND "created_at" < $1::timestamptz`, wantArgs: []any{hi}},
+		{name: "open above", r: &RangeCheckpoint{Lo: &lo},
+			wantCond: `"created_at" IS NOT NULL AND "created_at" >= $1::timestamptz`, wantArgs: []any{lo}},
+		{name: "unbounded", r: &RangeCheckpoint{},
+			wantCond: `"created_at" IS NOT NULL`},
+		{name: "null", r: &RangeCheckpoint{Null: true},
+			wantCond: `"created_at" IS NULL`},
+		{name: "hash chunk", r: &RangeCheckpoint{Hash: &HashChunk{Chunk: 2, Of: 8}},
+			wantCond: `"created_at" IS NOT NULL AND (hashtextextended("created_at"::text, 0) % $1::bigint + $1::bigint) % $1::bigint = $2::bigint`, wantArgs: []any{int64(8), int64(2)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, args := rangeConditionOn(`"created_at"`, "timestamptz", tt.r)
+			if cond != tt.wantCond {
+				t.Errorf("condition = %s, want %s", cond, tt.wantCond)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
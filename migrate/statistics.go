@@ -0,0 +1,245 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// statisticsObject is an extended statistics object (CREATE STATISTICS) of a
+// source table. Kinds are the pg_statistic_ext.stxkind letters.
+type statisticsObject struct {
+	Name    string
+	Kinds   []string
+	Columns []string
+	// Target is set by ALTER STATISTICS ... SET STATISTICS
+	Target *int
+}
+
+// statisticsKinds maps stxkind letters to their CREATE STATISTICS keyword
+// and the first server version (server_version_num) that has them.
+// Expression statistics ("e") cannot be rebuilt from column names and are
+// never created.
+var statisticsKinds = map[string]struct {
+	keyword    string
+	minVersion int
+}{
+	"d": {"ndistinct", 100000},
+	"f": {"dependencies", 100000},
+	"m": {"mcv", 120000},
+}
+
+// StatisticsReport summarizes the statistics phase.
+type StatisticsReport struct {
+	ColumnTargets int `json:"column_targets"`
+	Objects       int `json:"objects"`
+	// Skipped lists objects or kinds the destination could not take
+	Skipped  []string `json:"skipped,omitempty"`
+	Analyzed []string `json:"analyzed,omitempty"`
+}
+
+// introspectStatistics adds the extended statistics objects of the source
+// schemas of tables to them.
+func introspectStatistics(ctx context.Context, conn Querier, tables []Table) error {
+	rows, err := conn.Query(ctx, `
+		SELECT `+sourceKeySQL+`, s.stxname, s.stxkind::text[],
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(s.stxkeys::int2[]) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = s.stxrelid AND a.attnum = k.attnum AND NOT a.attisdropped
+				ORDER BY k.ord
+			),
+			NULLIF(s.stxstattarget, -1)::int
+		FROM pg_statistic_ext s
+		JOIN pg_class c ON c.oid = s.stxrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($1)
+		ORDER BY c.relname, s.stxname
+	`, tableSchemas(tables))
+	if err != nil {
+		return fmt.Errorf("failed to get extended statistics: %w", err)
+	}
+	defer rows.Close()
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+	for rows.Next() {
+		var table string
+		var st statisticsObject
+		if err := rows.Scan(&table, &st.Name, &st.Kinds, &st.Columns, &st.Target); err != nil {
+			return err
+		}
+		if t, ok := byName[table]; ok {
+			t.Statistics = append(t.Statistics, st)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get extended statistics: %w", err)
+	}
+	return nil
+}
+
+// statisticsDDL returns the statements setting the column statistics
+// targets of t and creating its extended statistics on a destination
+// running server version version. Kinds or objects the destination does
+// not support are left out and listed in skipped.
+func statisticsDDL(t Table, version int) (stmts, skipped []string) {
+	table := destIdent(t)
+	for _, c := range t.Columns {
+		if c.StatisticsTarget != nil {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET STATISTICS %d", table, sqlutil.QuoteIdent(c.destName()), *c.StatisticsTarget))
+		}
+	}
+
+	for _, st := range t.Statistics {
+		label := fmt.Sprintf("statistics %s on %s", st.Name, t.Name)
+		if slices.Contains(st.Kinds, "e") {
+			skipped = append(skipped, label+": expression statistics are not migrated")
+			continue
+		}
+		if missing := missingColumns(t, st.Columns); len(missing) > 0 {
+			skipped = append(skipped, fmt.Sprintf("%s: column(s) %s are not copied", label, strings.Join(missing, ", ")))
+			continue
+		}
+		var kinds []string
+		for _, k := range st.Kinds {
+			kind, ok := statisticsKinds[k]
+			if !ok {
+				skipped = append(skipped, fmt.Sprintf("%s: unknown kind %s", label, k))
+				continue
+			}
+			if version < kind.minVersion {
+				skipped = append(skipped, fmt.Sprintf("%s: kind %s is not supported by the destination", label, kind.keyword))
+				continue
+			}
+			kinds = append(kinds, kind.keyword)
+		}
+		if len(kinds) == 0 {
+			continue
+		}
+		name := schemaIdent(t.DestSchema, st.Name)
+		stmts = append(stmts, fmt.Sprintf("CREATE STATISTICS IF NOT EXISTS %s (%s) ON %s FROM %s",
+			name, strings.Join(kinds, ", "), sqlutil.ColumnList(t.destColumns(st.Columns)), table))
+		if st.Target != nil {
+			if version < 130000 {
+				skipped = append(skipped, label+": statistics target needs PostgreSQL 13 on the destination")
+				continue
+			}
+			stmts = append(stmts, fmt.Sprintf("ALTER STATISTICS %s SET STATISTICS %d", name, *st.Target))
+		}
+	}
+	return stmts, skipped
+}
+
+// Statistics sets column statistics targets and creates the extended
+// statistics of every recreated table, then analyzes the tables loaded by
+// this run.
+func (m *Migrator) Statistics(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseStatistics, state, m.statistics)
+}
+
+func (m *Migrator) statistics(ctx context.Context, state *MigrationState) error {
+	sr := &StatisticsReport{}
+	// --data-only leaves the destination definitions alone
+	if !m.opts.DataOnly {
+		version, err := serverVersion(ctx, m.dest)
+		if err != nil {
+			return err
+		}
+		for _, t := range state.Tables {
+			if state.Keep[t.Name] {
+				continue
+			}
+			stmts, skipped := statisticsDDL(t, version)
+			for _, s := range skipped {
+				state.Report.warnTable(warnStatisticsSkipped, t.Name, "%s; skipped", s)
+			}
+			sr.Skipped = append(sr.Skipped, skipped...)
+			for _, stmt := range stmts {
+				if _, err := m.dest.Exec(ctx, stmt); err != nil {
+					return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to set statistics of %s (%s): %w", t.Name, stmt, err)}
+				}
+				if strings.HasPrefix(stmt, "CREATE STATISTICS") {
+					sr.Objects++
+				} else if strings.HasPrefix(stmt, "ALTER TABLE") {
+					sr.ColumnTargets++
+				}
+			}
+		}
+	}
+
+	// A recorded run has loaded nothing yet; the script analyzes everything
+	tables := state.Tables
+	if m.recorder == nil {
+		tables = loadedTables(tables, state.Report)
+	}
+	if len(tables) > 0 {
+		fmt.Printf("Analyzing %d table(s)...\n", len(tables))
+		analyzeTables(ctx, m.dest, tables, sr, state.Report)
+	}
+	if sr.ColumnTargets > 0 || sr.Objects > 0 {
+		fmt.Printf("Set %d column statistics target(s) and created %d extended statistics object(s).\n", sr.ColumnTargets, sr.Objects)
+	}
+	state.Report.Statistics = sr
+
+	// Only tables synced into their existing destination table can carry
+	// bloat; the estimates need the ANALYZE above
+	if m.opts.SkipBloatCheck || m.recorder != nil {
+		return nil
+	}
+	if synced := syncedTables(state, m.opts); len(synced) > 0 {
+		fmt.Printf("Checking bloat of %d synced table(s)...\n", len(synced))
+		bloat, err := checkBloat(ctx, m.dest, synced, m.opts.VacuumAfterSync, state.Report)
+		if err != nil {
+			return err
+		}
+		printBloat(bloat)
+		state.Report.Bloat = bloat
+	}
+	return nil
+}
+
+func serverVersion(ctx context.Context, conn Querier) (int, error) {
+	var v string
+	if err := conn.QueryRow(ctx, "SHOW server_version_num").Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to get destination server version: %w", err)
+	}
+	return strconv.Atoi(v)
+}
+
+// loadedTables returns the tables of the run that received data in this
+// session, the ones worth analyzing.
+func loadedTables(tables []Table, report *Report) []Table {
+	resumed := map[string]bool{}
+	for _, tr := range report.Tables {
+		if tr.Status == tableStatusResumed {
+			resumed[tr.Name] = true
+		}
+	}
+	var out []Table
+	for _, t := range tables {
+		if !resumed[t.Name] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// analyzeTables runs ANALYZE on every table, so the planner has statistics
+// right away instead of after the first autovacuum. A failure is only
+// recorded as a warning.
+func analyzeTables(ctx context.Context, dest Querier, tables []Table, sr *StatisticsReport, report *Report) {
+	for _, t := range tables {
+		if _, err := dest.Exec(ctx, "ANALYZE "+destIdent(t)); err != nil {
+			report.warnTable(warnAnalyzeFailed, t.Name, "failed to analyze %s: %v", t.qualifiedDestName(), err)
+			continue
+		}
+		sr.Analyzed = append(sr.Analyzed, t.qualifiedDestName())
+	}
+}
@@ -0,0 +1,327 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// statusServer serves the progress of the process over HTTP with
+// --status-addr: /metrics in the Prometheus text format, and /status as
+// JSON. The runs of the process report to it through their runEnv, and the
+// copy hands it the RetryStats of every table (see watchRetries) and the
+// bytes read (see read), so a request sees them as they change. Counters
+// add up over all runs of the process, e.g. the attempts of --retries and
+// the migrations of a config; /status shows the run in progress.
+type statusServer struct {
+	srv *http.Server
+	ln  net.Listener
+
+	mu       sync.Mutex
+	tables   map[string]*statusTable
+	warnings int64
+
+	// The run in progress: its tables in the order of the copy, the
+	// estimate of its plan and the bytes its finished tables read, which
+	// --max-read-bytes is checked against
+	runID        string
+	order        []string
+	current      *statusTable
+	estimate     *ReadEstimate
+	maxReadBytes int64
+	readBytes    int64
+}
+
+// statusTable is what the server knows of one table.
+type statusTable struct {
+	name   string
+	status string
+	rows   int64
+	// bars are the progress bars of the table being copied
+	bars []tuiBar
+	// retries are the stats of every copy of the table, one per attempt of
+	// the run
+	retries []*RetryStats
+}
+
+// startStatusServer listens on addr and serves the status until stop.
+func startStatusServer(addr string) (*statusServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on --status-addr %s: %w", addr, err)
+	}
+	s := &statusServer{ln: ln, tables: map[string]*statusTable{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.serveMetrics)
+	mux.HandleFunc("GET /status", s.serveStatus)
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Warning: the status server stopped: %v", err)
+		}
+	}()
+	fmt.Printf("Serving the status on http://%s/status and metrics on /metrics\n", ln.Addr())
+	return s, nil
+}
+
+// mustStartStatus starts the server of --status-addr, if set, and exits
+// when it cannot listen.
+func mustStartStatus(addr string) *statusServer {
+	if addr == "" {
+		return nil
+	}
+	s, err := startStatusServer(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// stop shuts the server down.
+func (s *statusServer) stop() {
+	if s == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.srv.Shutdown(ctx)
+}
+
+// watchRetries makes s, if not nil, expose stats, the retry counters of the
+// copy of table.
+func (s *statusServer) watchRetries(table string, stats *RetryStats) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.table(table)
+	st.retries = append(st.retries, stats)
+}
+
+// planned starts the status of the run runID, whose plan estimated est,
+// stopping at limit bytes read with --max-read-bytes (0 for none).
+func (s *statusServer) planned(runID string, est *ReadEstimate, limit int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runID, s.estimate, s.maxReadBytes = runID, est, limit
+	s.order, s.current, s.readBytes = nil, nil, 0
+}
+
+// read records the bytes the tables finished by the run read from the
+// source so far.
+func (s *statusServer) read(total int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.readBytes = total
+	s.mu.Unlock()
+}
+
+// table returns the entry of name, adding it; s.mu is held.
+func (s *statusServer) table(name string) *statusTable {
+	st := s.tables[name]
+	if st == nil {
+		st = &statusTable{name: name, status: tableStatusPending}
+		s.tables[name] = st
+	}
+	return st
+}
+
+func (s *statusServer) CopyStarted(tables []string, rows []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order = tables
+	for _, name := range tables {
+		st := s.table(name)
+		st.status, st.rows, st.bars = tableStatusPending, 0, nil
+	}
+}
+
+func (s *statusServer) TableStarted(table string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = s.table(table)
+	s.current.status = tableStatusCopying
+}
+
+func (s *statusServer) BarStarted(bar *progressbar.ProgressBar, bytes bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		s.current.bars = append(s.current.bars, tuiBar{bar: bar, bytes: bytes})
+	}
+}
+
+func (s *statusServer) TableFinished(table, status string, rows int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.table(table)
+	st.status, st.rows, st.bars = status, rows, nil
+	if s.current == st {
+		s.current = nil
+	}
+}
+
+func (s *statusServer) Warning(string) {
+	s.mu.Lock()
+	s.warnings++
+	s.mu.Unlock()
+}
+
+// retryTotals sums the stats of st; s.mu is held.
+func (st *statusTable) retryTotals() *RetryStats {
+	total := &RetryStats{}
+	for _, stats := range st.retries {
+		stats.mu.Lock()
+		total.add(stats)
+		stats.mu.Unlock()
+	}
+	return total
+}
+
+// serveMetrics writes the counters in the Prometheus text format, one
+// series per table, and per table and endpoint for errors.
+func (s *statusServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tables))
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	totals := make([]*RetryStats, len(names))
+	rows := make([]int64, len(names))
+	for i, name := range names {
+		totals[i] = s.tables[name].retryTotals()
+		rows[i] = s.tables[name].rows
+	}
+	warnings := s.warnings
+	var estimated int64
+	if s.estimate != nil {
+		estimated = s.estimate.Bytes
+	}
+	read, limit := s.readBytes, s.maxReadBytes
+	s.mu.Unlock()
+
+	var b strings.Builder
+	series := func(name, kind, help string, value func(i int) int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i, table := range names {
+			fmt.Fprintf(&b, "%s{table=%s} %d\n", name, promLabel(table), value(i))
+		}
+	}
+	series("farewall_table_retries_total", "counter", "Retries of the copy of a table, or of its ranges, after a transient failure.",
+		func(i int) int64 { return totals[i].Retries })
+	series("farewall_table_reconnects_total", "counter", "Connections opened again for the copy of a table after they were lost.",
+		func(i int) int64 { return totals[i].Reconnects })
+	series("farewall_table_errors_total", "counter", "Failed attempts of the copy of a table.",
+		func(i int) int64 { return totals[i].Errors })
+	series("farewall_table_transient_errors_total", "counter", "Failed attempts of the copy of a table with a transient error.",
+		func(i int) int64 { return totals[i].TransientErrors })
+	series("farewall_table_rows_copied", "gauge", "Rows copied into a finished table, including those of earlier runs.",
+		func(i int) int64 { return rows[i] })
+
+	fmt.Fprintf(&b, "# HELP farewall_endpoint_errors_total Failed attempts of the copy of a table by the connection they came from.\n# TYPE farewall_endpoint_errors_total counter\n")
+	for i, table := range names {
+		endpoints := make([]string, 0, len(totals[i].ErrorsByEndpoint))
+		for e := range totals[i].ErrorsByEndpoint {
+			endpoints = append(endpoints, e)
+		}
+		sort.Strings(endpoints)
+		for _, e := range endpoints {
+			fmt.Fprintf(&b, "farewall_endpoint_errors_total{table=%s,endpoint=%s} %d\n", promLabel(table), promLabel(e), totals[i].ErrorsByEndpoint[e])
+		}
+	}
+	fmt.Fprintf(&b, "# HELP farewall_warnings_total Warnings of the runs of the process.\n# TYPE farewall_warnings_total counter\nfarewall_warnings_total %d\n", warnings)
+	for _, g := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"farewall_source_read_bytes", "Bytes the tables finished by the run read from the source.", read},
+		{"farewall_source_read_estimate_bytes", "Bytes the plan of the run estimated it reads from the source.", estimated},
+		{"farewall_max_read_bytes", "The --max-read-bytes of the run, 0 for no limit.", limit},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
+
+// RunStatus is the JSON of /status.
+type RunStatus struct {
+	RunID string `json:"run_id,omitempty"`
+	// EstimatedRows and EstimatedBytes are the estimate of the plan
+	EstimatedRows  int64 `json:"estimated_rows"`
+	EstimatedBytes int64 `json:"estimated_bytes"`
+	// ReadBytes is what the finished tables read from the source, which
+	// --max-read-bytes (MaxReadBytes, 0 for none) is checked against at
+	// every table boundary
+	ReadBytes    int64        `json:"read_bytes"`
+	MaxReadBytes int64        `json:"max_read_bytes,omitempty"`
+	Current      *TableState  `json:"current_table,omitempty"`
+	Tables       []TableState `json:"tables"`
+	Warnings     int64        `json:"warnings"`
+}
+
+// TableState is one table of /status. Rows and Bytes of the table being
+// copied are the live counts of its progress bars: bytes for a CSV
+// passthrough, rows otherwise.
+type TableState struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes,omitempty"`
+}
+
+func (st *statusTable) state() TableState {
+	ts := TableState{Name: st.name, Status: st.status, Rows: st.rows}
+	for _, b := range st.bars {
+		if b.bytes {
+			// Bytes bars have no total, and count in CurrentBytes
+			ts.Bytes += int64(b.bar.State().CurrentBytes)
+		} else {
+			ts.Rows += b.bar.State().CurrentNum
+		}
+	}
+	return ts
+}
+
+func (s *statusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	rs := RunStatus{RunID: s.runID, ReadBytes: s.readBytes, MaxReadBytes: s.maxReadBytes, Warnings: s.warnings, Tables: []TableState{}}
+	if s.estimate != nil {
+		rs.EstimatedRows, rs.EstimatedBytes = s.estimate.Rows, s.estimate.Bytes
+	}
+	for _, name := range s.order {
+		rs.Tables = append(rs.Tables, s.tables[name].state())
+	}
+	if s.current != nil {
+		cur := s.current.state()
+		rs.Current = &cur
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rs)
+}
+
+// promLabel quotes v as a Prometheus label value.
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
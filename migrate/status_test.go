@@ -0,0 +1,168 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/schollz/progressbar/v3"
+)
+
+func startTestStatus(t *testing.T) *statusServer {
+	t.Helper()
+	s, err := startStatusServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stop)
+	return s
+}
+
+func getStatus(t *testing.T, s *statusServer, path string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + s.ln.Addr().String() + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return string(body)
+}
+
+func TestStatusMetrics(t *testing.T) {
+	s := startTestStatus(t)
+
+	s.CopyStarted([]string{"users", `we"ird`}, []int64{10, 5})
+	s.TableStarted("users")
+	stats := &RetryStats{}
+	s.watchRetries("users", stats)
+	stats.recordError(onEndpoint(endpointSource, &pgconn.PgError{Code: "57P01"}))
+	stats.recordRetry()
+	stats.recordReconnect()
+	stats.recordError(onEndpoint(endpointDestination, errors.New("constraint violated")))
+
+	// Counters are live while the table is copied
+	metrics := getStatus(t, s, "/metrics")
+	for _, want := range []string{
+		"# TYPE farewall_table_retries_total counter\n",
+		`farewall_table_retries_total{table="users"} 1` + "\n",
+		`farewall_table_reconnects_total{table="users"} 1` + "\n",
+		`farewall_table_errors_total{table="users"} 2` + "\n",
+		`farewall_table_transient_errors_total{table="users"} 1` + "\n",
+		`farewall_endpoint_errors_total{table="users",endpoint="destination"} 1` + "\n",
+		`farewall_endpoint_errors_total{table="users",endpoint="source"} 1` + "\n",
+		`farewall_table_retries_total{table="we\"ird"} 0` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+
+	// A second attempt of the run adds to the counters of the first
+	again := &RetryStats{}
+	s.watchRetries("users", again)
+	again.recordRetry()
+	s.TableFinished("users", tableStatusCopied, 10)
+	s.Warning("retries: table users needed 2 retries")
+	metrics = getStatus(t, s, "/metrics")
+	for _, want := range []string{
+		`farewall_table_retries_total{table="users"} 2` + "\n",
+		`farewall_table_rows_copied{table="users"} 10` + "\n",
+		"farewall_warnings_total 1\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestStatusReads(t *testing.T) {
+	s := startTestStatus(t)
+	status := func() RunStatus {
+		var rs RunStatus
+		if err := json.Unmarshal([]byte(getStatus(t, s, "/status")), &rs); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	s.planned("3f9a2c1d", &ReadEstimate{Rows: 1500, Bytes: 9 << 20}, 8<<20)
+	s.CopyStarted([]string{"users", "events"}, []int64{1000, 500})
+	s.TableStarted("users")
+	bar := progressbar.DefaultSilent(1000)
+	s.BarStarted(bar, false)
+	bar.Add(400)
+
+	rs := status()
+	if rs.RunID != "3f9a2c1d" || rs.EstimatedRows != 1500 || rs.EstimatedBytes != 9<<20 || rs.MaxReadBytes != 8<<20 || rs.ReadBytes != 0 {
+		t.Errorf("status = %+v, want the plan's estimate and limit", rs)
+	}
+	if rs.Current == nil || rs.Current.Name != "users" || rs.Current.Rows != 400 {
+		t.Errorf("current table = %+v, want users at 400 rows", rs.Current)
+	}
+	if len(rs.Tables) != 2 || rs.Tables[1] != (TableState{Name: "events", Status: tableStatusPending}) {
+		t.Errorf("tables = %+v, want users and a pending events", rs.Tables)
+	}
+
+	// The running total moves at table boundaries
+	s.read(5 << 20)
+	s.TableFinished("users", tableStatusCopied, 1000)
+	s.TableStarted("events")
+	bytesBar := progressbar.DefaultBytesSilent(-1, "")
+	s.BarStarted(bytesBar, true)
+	bytesBar.Add(4096)
+	rs = status()
+	if rs.ReadBytes != 5<<20 || rs.Tables[0] != (TableState{Name: "users", Status: tableStatusCopied, Rows: 1000}) {
+		t.Errorf("status = %+v, want 5 MiB read and users copied", rs)
+	}
+	if rs.Current == nil || rs.Current.Name != "events" || rs.Current.Bytes != 4096 {
+		t.Errorf("current table = %+v, want events at 4096 bytes", rs.Current)
+	}
+	metrics := getStatus(t, s, "/metrics")
+	for _, want := range []string{
+		"farewall_source_read_bytes 5242880\n",
+		"farewall_source_read_estimate_bytes 9437184\n",
+		"farewall_max_read_bytes 8388608\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+
+	// The next run starts over
+	s.planned("77aa0011", &ReadEstimate{}, 0)
+	if rs = status(); rs.RunID != "77aa0011" || rs.ReadBytes != 0 || rs.Current != nil || len(rs.Tables) != 0 {
+		t.Errorf("status = %+v, want the new run", rs)
+	}
+}
+
+func TestStatusServerStop(t *testing.T) {
+	s, err := startStatusServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := newRunEnv(Options{status: s}, newSourceLimiter(0))
+	if tee, ok := run.reporter.(teeReporter); !ok || tee.b != s || run.status != s {
+		t.Fatal("the run does not report to the server")
+	}
+	s.stop()
+	// Without a server, the copy's calls go nowhere
+	var nilServer *statusServer
+	nilServer.watchRetries("users", &RetryStats{})
+	nilServer.read(1)
+	nilServer.stop()
+
+	if _, err := startStatusServer("256.0.0.1:0"); err == nil {
+		t.Error("an invalid address was accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialSuffix marks a local object still being written
+const partialSuffix = ".partial"
+
+// objectStore is where the export subcommand writes its objects, and the
+// import subcommand reads them. Objects are
+// streamed as they are produced, and an object only appears under its key
+// once it was written completely.
+type objectStore interface {
+	// create opens the object key for writing
+	create(ctx context.Context, key string) (objectWriter, error)
+	// open opens the object key for reading
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+	// location names key for the output
+	location(key string) string
+}
+
+// objectWriter writes one object. commit stores it under its key; abort
+// gives up, leaving whatever was written recognizable as partial.
+type objectWriter interface {
+	io.Writer
+	commit() error
+	abort()
+}
+
+// openStore returns the store of an export target or import source: a local
+// directory, given as a path or a file:// URL, an S3 bucket and prefix as
+// s3://bucket/prefix or a Cloud Storage one as gs://bucket/prefix (see
+// s3store.go). opts apply to the objects created.
+func openStore(target string, opts storeOptions) (objectStore, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		return localStore{dir: target}, nil
+	}
+	switch scheme {
+	case "file":
+		return localStore{dir: rest}, nil
+	case "s3", "gs":
+		return openS3Store(scheme, rest, opts)
+	}
+	return nil, fmt.Errorf("unknown location %q (expected a directory, a file:// URL, s3:// or gs://)", target)
+}
+
+// localStore writes objects as files under dir. An object is written to
+// key.partial and renamed once complete, so files left by a failed run are
+// recognizable by their suffix.
+type localStore struct {
+	dir string
+}
+
+func (s localStore) create(ctx context.Context, key string) (objectWriter, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &localObject{f: f, path: path}, nil
+}
+
+func (s localStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.location(key))
+}
+
+func (s localStore) location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+type localObject struct {
+	f    *os.File
+	path string
+}
+
+func (o *localObject) Write(p []byte) (int, error) { return o.f.Write(p) }
+
+func (o *localObject) abort() { o.f.Close() }
+
+func (o *localObject) commit() error {
+	if err := o.f.Sync(); err != nil {
+		o.f.Close()
+		return err
+	}
+	if err := o.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(o.path+partialSuffix, o.path)
+}
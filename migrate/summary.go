@@ -0,0 +1,306 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	summaryMatch = "match"
+	// summaryExpected differences are explained by what the migration
+	// leaves out; Notes say what
+	summaryExpected = "expected"
+	summaryMismatch = "mismatch"
+	// summaryInfo figures are estimates that are not compared
+	summaryInfo = "info"
+)
+
+// DatabaseSummary compares object counts and sizes of the source and the
+// destination, read from the catalogs, for a one-glance check that the
+// destination looks like the source. Match is false when any count differs
+// in a way the migration does not explain.
+type DatabaseSummary struct {
+	Match   bool            `json:"match"`
+	Metrics []SummaryMetric `json:"metrics"`
+}
+
+// SummaryMetric is one compared figure. Expected is what the destination
+// should have given what the migration leaves out.
+type SummaryMetric struct {
+	Name        string   `json:"name"`
+	Source      int64    `json:"source"`
+	Destination int64    `json:"destination"`
+	Expected    int64    `json:"expected"`
+	Status      string   `json:"status"`
+	Notes       []string `json:"notes,omitempty"`
+}
+
+// relationCounts are the catalog figures of one table.
+type relationCounts struct {
+	columns, rows, bytes, indexes, constraints, checks int64
+}
+
+// tableCounts reads relationCounts of the tables named schema.table on
+// conn, keyed by that name. Constraints are primary keys, unique, foreign
+// key and exclusion constraints; check constraints are counted apart.
+// Rows are the planner's estimate.
+func tableCounts(ctx context.Context, conn Querier, names []string) (map[string]relationCounts, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname,
+			(SELECT count(*) FROM pg_attribute a WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped),
+			GREATEST(c.reltuples, 0)::bigint,
+			pg_total_relation_size(c.oid),
+			(SELECT count(*) FROM pg_index i WHERE i.indrelid = c.oid),
+			(SELECT count(*) FROM pg_constraint con WHERE con.conrelid = c.oid AND con.contype IN ('p', 'u', 'f', 'x')),
+			(SELECT count(*) FROM pg_constraint con WHERE con.conrelid = c.oid AND con.contype = 'c')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+		  AND n.nspname || '.' || c.relname = ANY($1)
+	`, names)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		name string
+		relationCounts
+	}
+	found, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+		var rc row
+		err := r.Scan(&rc.name, &rc.columns, &rc.rows, &rc.bytes, &rc.indexes, &rc.constraints, &rc.checks)
+		return rc, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]relationCounts, len(found))
+	for _, rc := range found {
+		out[rc.name] = rc.relationCounts
+	}
+	return out, nil
+}
+
+// schemaCounts counts the tables (partitions aside) and the views of
+// schemas on conn.
+func schemaCounts(ctx context.Context, conn Querier, schemas []string) (tables, views int64, err error) {
+	err = conn.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE c.relkind IN ('r', 'p') AND NOT c.relispartition),
+			count(*) FILTER (WHERE c.relkind IN ('v', 'm'))
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($1)
+	`, schemas).Scan(&tables, &views)
+	return tables, views, err
+}
+
+// summarizeDatabases compares the source with the destination for tables,
+// the tables of the run, out of all introspected ones, and matviews, the
+// materialized views the run created. What the migration leaves out by
+// design (tables outside the run, plain views, Xata metadata columns, and
+// checks, indexes, foreign keys and materialized views it cannot recreate)
+// is subtracted from the source figures to get the expected ones. Kept
+// tables count with their destination definition.
+func summarizeDatabases(ctx context.Context, source, dest Querier, tables, all []Table, keep map[string]bool, matviews int64) (*DatabaseSummary, error) {
+	sourceNames := make([]string, len(tables))
+	destNames := make([]string, len(tables))
+	for i, t := range tables {
+		sourceNames[i] = t.qualifiedName()
+		destNames[i] = t.qualifiedDestName()
+	}
+	src, err := tableCounts(ctx, source, sourceNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize the source: %w", err)
+	}
+	dst, err := tableCounts(ctx, dest, destNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize the destination: %w", err)
+	}
+	sourceSchemas := tableSchemas(all)
+	if len(sourceSchemas) == 0 {
+		sourceSchemas = []string{defaultSchema}
+	}
+	sourceTables, sourceViews, err := schemaCounts(ctx, source, sourceSchemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize the source: %w", err)
+	}
+	_, destViews, err := schemaCounts(ctx, dest, tableSchemas(destinationTables(tables)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize the destination: %w", err)
+	}
+
+	var (
+		tablesM      = SummaryMetric{Name: "tables", Source: sourceTables, Expected: int64(len(tables))}
+		viewsM       = SummaryMetric{Name: "views", Source: sourceViews, Destination: destViews, Expected: matviews}
+		columnsM     = SummaryMetric{Name: "columns"}
+		rowsM        = SummaryMetric{Name: "estimated_rows"}
+		bytesM       = SummaryMetric{Name: "total_bytes"}
+		indexesM     = SummaryMetric{Name: "indexes"}
+		constraintsM = SummaryMetric{Name: "constraints"}
+		checksM      = SummaryMetric{Name: "check_constraints"}
+
+		kept, leftColumns, leftIndexes, leftKeys, leftChecks int64
+		// destKeys are the destination foreign keys, read for keys to
+		// tables outside the run
+		destKeys map[string]bool
+	)
+	for i, t := range tables {
+		s, d := src[sourceNames[i]], dst[destNames[i]]
+		if _, ok := dst[destNames[i]]; ok {
+			tablesM.Destination++
+		}
+		columnsM.Source += s.columns
+		columnsM.Destination += d.columns
+		rowsM.Source += s.rows
+		rowsM.Destination += d.rows
+		bytesM.Source += s.bytes
+		bytesM.Destination += d.bytes
+		indexesM.Source += s.indexes
+		indexesM.Destination += d.indexes
+		constraintsM.Source += s.constraints
+		constraintsM.Destination += d.constraints
+		checksM.Source += s.checks
+		checksM.Destination += d.checks
+
+		if keep[t.Name] {
+			kept++
+			columnsM.Expected += d.columns
+			indexesM.Expected += d.indexes
+			constraintsM.Expected += d.constraints
+			checksM.Expected += d.checks
+			continue
+		}
+		columnsM.Expected += int64(len(t.Columns))
+		leftColumns += s.columns - int64(len(t.Columns))
+		checksM.Expected += int64(len(t.Checks))
+		leftChecks += s.checks - int64(len(t.Checks))
+		if len(t.PrimaryKey) > 0 {
+			indexesM.Expected++
+			constraintsM.Expected++
+		}
+		for _, idx := range t.Indexes {
+			if indexSkipReason(t, idx) != "" {
+				leftIndexes++
+				continue
+			}
+			indexesM.Expected++
+			if idx.Constraint {
+				constraintsM.Expected++
+			}
+		}
+		for _, fk := range t.ForeignKeys {
+			ref, ok := tableByName(all, fk.RefTable)
+			if !ok {
+				// A key to a table outside the run is created or left out
+				// by --on-missing-ref; either is what the run meant
+				if destKeys == nil {
+					if destKeys, err = destinationForeignKeys(ctx, dest); err != nil {
+						return nil, fmt.Errorf("failed to summarize the destination: %w", err)
+					}
+				}
+				if destKeys[t.qualifiedDestName()+"."+fk.destConstraint()] {
+					constraintsM.Expected++
+				} else {
+					leftKeys++
+				}
+				continue
+			}
+			if !ok || len(missingColumns(t, fk.Columns)) > 0 || len(missingColumns(ref, fk.RefColumns)) > 0 {
+				leftKeys++
+				continue
+			}
+			constraintsM.Expected++
+		}
+	}
+	rowsM.Expected, bytesM.Expected = rowsM.Source, bytesM.Source
+
+	if n := tablesM.Source - tablesM.Expected; n > 0 {
+		tablesM.note("%d source table(s) are not part of this run", n)
+	}
+	if n := viewsM.Source - viewsM.Expected; n > 0 {
+		viewsM.note("%d view(s) are not migrated (plain views, and materialized views that could not be recreated)", n)
+	}
+	if leftColumns > 0 {
+		columnsM.note("%d source column(s) are not copied (Xata metadata columns)", leftColumns)
+	}
+	if leftIndexes > 0 {
+		indexesM.note("%d index(es) use columns that are not copied or renamed", leftIndexes)
+	}
+	if leftKeys > 0 {
+		constraintsM.note("%d foreign key(s) reference tables or columns that are not migrated", leftKeys)
+	}
+	if leftChecks > 0 {
+		checksM.note("%d check constraint(s) could not be recreated (see the warnings of the run)", leftChecks)
+	}
+	if kept > 0 {
+		for _, m := range []*SummaryMetric{&columnsM, &indexesM, &constraintsM, &checksM} {
+			m.note("%d kept table(s) count with their destination definition", kept)
+		}
+	}
+	rowsM.note("planner estimates; the verify subcommand counts exactly")
+	bytesM.note("includes indexes and TOAST; sizes differ with bloat and compression")
+
+	summary := &DatabaseSummary{Match: true}
+	for _, m := range []*SummaryMetric{&tablesM, &viewsM, &columnsM, &rowsM, &bytesM, &indexesM, &constraintsM, &checksM} {
+		switch {
+		case m == &rowsM || m == &bytesM:
+			m.Status = summaryInfo
+		case m.Destination == m.Source:
+			m.Status = summaryMatch
+		case m.Destination == m.Expected:
+			m.Status = summaryExpected
+		default:
+			m.Status = summaryMismatch
+			summary.Match = false
+		}
+		summary.Metrics = append(summary.Metrics, *m)
+	}
+	return summary, nil
+}
+
+func (m *SummaryMetric) note(format string, args ...any) {
+	m.Notes = append(m.Notes, fmt.Sprintf(format, args...))
+}
+
+func tableByName(tables []Table, name string) (Table, bool) {
+	for _, t := range tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Table{}, false
+}
+
+// print writes the metrics side by side, marking differences the
+// migration does not explain.
+func (s *DatabaseSummary) print() {
+	fmt.Println("Source and destination:")
+	fmt.Printf("  %-18s %14s %14s\n", "", "source", "destination")
+	for _, m := range s.Metrics {
+		src, dst := fmt.Sprint(m.Source), fmt.Sprint(m.Destination)
+		if m.Name == "total_bytes" {
+			src, dst = formatBytes(m.Source), formatBytes(m.Destination)
+		}
+		line := fmt.Sprintf("  %-18s %14s %14s", m.Name, src, dst)
+		switch m.Status {
+		case summaryMismatch:
+			line += fmt.Sprintf("  MISMATCH, expected %d", m.Expected)
+		case summaryExpected:
+			line += "  expected: " + strings.Join(m.Notes, "; ")
+		}
+		fmt.Println(line)
+	}
+}
+
+// warnings returns one message per mismatched metric.
+func (s *DatabaseSummary) warnings() []string {
+	var out []string
+	for _, m := range s.Metrics {
+		if m.Status == summaryMismatch {
+			out = append(out, fmt.Sprintf("database summary: %s differ (source %d, destination %d, expected %d)", m.Name, m.Source, m.Destination, m.Expected))
+		}
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Values of --mode
+const (
+	modeRecreate = "recreate"
+	modeSync     = "sync"
+)
+
+// existingTables returns the tables that already exist on the destination.
+func existingTables(ctx context.Context, dest Querier, tables []Table) (map[string]bool, error) {
+	byIdent := make(map[string]string, len(tables))
+	idents := make([]string, len(tables))
+	for i, t := range tables {
+		idents[i] = destIdent(t)
+		byIdent[idents[i]] = t.Name
+	}
+	rows, err := dest.Query(ctx, "SELECT name FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NOT NULL", idents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the destination tables: %w", err)
+	}
+	found, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the destination tables: %w", err)
+	}
+	out := make(map[string]bool, len(found))
+	for _, ident := range found {
+		out[byIdent[ident]] = true
+	}
+	return out, nil
+}
+
+// checkSyncColumns checks that every table synced into its existing
+// destination table has the same columns there, by destination name, with
+// the same types. Unlike a merge, a sync leaves no column out: a column on
+// one side only would mean the two schemas have drifted apart. Every table
+// that does not match is listed before the run stops.
+func checkSyncColumns(ctx context.Context, dest Querier, tables []Table, synced map[string]bool) error {
+	var existing []Table
+	for _, t := range tables {
+		if synced[t.Name] {
+			existing = append(existing, onDestination(t))
+		}
+	}
+	destTables, err := introspectSchemas(ctx, dest, tableSchemas(existing))
+	if err != nil {
+		return withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	byName := make(map[string]Table, len(destTables))
+	for _, t := range destTables {
+		byName[t.qualifiedName()] = t
+	}
+
+	var problems []string
+	for _, t := range tables {
+		if !synced[t.Name] {
+			continue
+		}
+		dt := byName[t.qualifiedDestName()]
+		var missing, extra, mismatched []string
+		for _, c := range t.Columns {
+			dc, ok := dt.column(c.destName())
+			switch {
+			case !ok:
+				missing = append(missing, c.destName())
+			case dc.DataType != c.DataType:
+				mismatched = append(mismatched, fmt.Sprintf("%s (%s on the source, %s on the destination)", c.destName(), c.DataType, dc.DataType))
+			}
+		}
+		for _, c := range dt.Columns {
+			if _, ok := t.columnByDest(c.Name); !ok {
+				extra = append(extra, c.Name)
+			}
+		}
+		var parts []string
+		if len(missing) > 0 {
+			parts = append(parts, "missing on the destination: "+strings.Join(missing, ", "))
+		}
+		if len(extra) > 0 {
+			parts = append(parts, "only on the destination: "+strings.Join(extra, ", "))
+		}
+		if len(mismatched) > 0 {
+			parts = append(parts, "types differ: "+strings.Join(mismatched, ", "))
+		}
+		if len(parts) > 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", t.Name, t.qualifiedDestName(), strings.Join(parts, "; ")))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	fmt.Printf("  %d existing destination table(s) do not match the source:\n", len(problems))
+	for _, p := range problems {
+		fmt.Printf("    %s\n", p)
+	}
+	return &SchemaError{Err: fmt.Errorf("%d table(s) cannot be synced into their existing destination table, since their columns differ; align the schemas, exclude the tables, or use --mode recreate", len(problems))}
+}
+
+// syncTables returns the tables of a --mode sync run that already exist on
+// the destination, leaving out the skipped ones, once their columns are
+// checked. They are loaded like merged tables: kept, and upserted on the
+// destination primary key.
+func syncTables(ctx context.Context, dest Querier, tables []Table, skip map[string]bool, report *Report) (map[string]bool, error) {
+	existing, err := existingTables(ctx, dest, withoutTables(tables, skip))
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	if err := checkSyncColumns(ctx, dest, tables, existing); err != nil {
+		return nil, err
+	}
+	for _, t := range tables {
+		if existing[t.Name] {
+			report.SyncedTables = append(report.SyncedTables, t.Name)
+		}
+	}
+	fmt.Printf("  %d table(s) already exist on the destination and are synced in place\n", len(report.SyncedTables))
+	return existing, nil
+}
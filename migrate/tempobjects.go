@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+// tempPrefix starts the name of every temporary object the tool creates on
+// the destination: _fxl_<runid>_<purpose>_<table>.
+const tempPrefix = "_fxl_"
+
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate run ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// tempTableName returns the unquoted name of a temporary object of this run.
+func tempTableName(runID, purpose, table string) string {
+	return physicalName(logicalTempName(runID, purpose, table))
+}
+
+func logicalTempName(runID, purpose, table string) string {
+	return tempPrefix + runID + "_" + purpose + "_" + table
+}
+
+// createTempTable creates an unlogged table in the state schema and records
+// it in the checkpoint so leftovers can be found after a crash. It returns
+// the quoted, qualified name.
+func createTempTable(ctx context.Context, dest Querier, cp *Checkpoint, purpose, table, definition string) (string, error) {
+	name := tempTableName(cp.RunID, purpose, table)
+	qualified := sqlutil.QualifiedIdent(stateSchema, name)
+	if _, err := dest.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+sqlutil.QuoteIdent(stateSchema)); err != nil {
+		return "", fmt.Errorf("failed to create schema %s: %w", stateSchema, err)
+	}
+
+	cp.TempObjects = append(cp.TempObjects, stateSchema+"."+name)
+	if err := cp.save(); err != nil {
+		return "", err
+	}
+	if _, err := dest.Exec(ctx, "CREATE UNLOGGED TABLE "+qualified+" "+definition); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	return qualified, nil
+}
+
+// dropTempTable drops a temporary table created by createTempTable and
+// removes it from the checkpoint.
+func dropTempTable(ctx context.Context, dest Querier, cp *Checkpoint, purpose, table string) error {
+	name := tempTableName(cp.RunID, purpose, table)
+	if _, err := dest.Exec(ctx, sqlutil.DropTable(sqlutil.QualifiedIdent(stateSchema, name), false)); err != nil {
+		return fmt.Errorf("failed to drop %s: %w", name, err)
+	}
+	key := stateSchema + "." + name
+	for i, o := range cp.TempObjects {
+		if o == key {
+			cp.TempObjects = append(cp.TempObjects[:i], cp.TempObjects[i+1:]...)
+			break
+		}
+	}
+	return cp.save()
+}
+
+type leftoverObject struct {
+	Schema string
+	Name   string
+	RunID  string
+}
+
+// findLeftovers lists tables on the destination whose name marks them as a
+// temporary object of some run.
+func findLeftovers(ctx context.Context, dest *pgx.Conn) ([]leftoverObject, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON c.relnamespace = n.oid
+		WHERE c.relkind IN ('r', 'p')
+		  AND c.relname LIKE '\_fxl\_%'
+		  AND n.nspname NOT LIKE 'pg\_temp\_%'
+		ORDER BY n.nspname, c.relname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temporary objects: %w", err)
+	}
+	defer rows.Close()
+
+	var out []leftoverObject
+	for rows.Next() {
+		var o leftoverObject
+		if err := rows.Scan(&o.Schema, &o.Name); err != nil {
+			return nil, err
+		}
+		rest := strings.TrimPrefix(o.Name, tempPrefix)
+		o.RunID, _, _ = strings.Cut(rest, "_")
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// runCleanup implements the cleanup subcommand, which lists temporary objects
+// left on the destination by earlier (crashed) runs and drops them after
+// confirmation.
+func runCleanup(args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Drop leftovers without asking for confirmation")
+	checkpointPath := fs.String("checkpoint", defaultCheckpointPath, "Checkpoint file that may list temporary objects of the last run")
+	var env envSettings
+	env.register(fs)
+	fs.Parse(args)
+
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 1
+	}
+
+	ctx := context.Background()
+	dest, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 1
+	}
+	defer dest.Close(ctx)
+
+	leftovers, err := findLeftovers(ctx, dest)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if cp, err := loadCheckpoint(*checkpointPath); err == nil && len(cp.TempObjects) > 0 {
+		fmt.Printf("Checkpoint %s records %d temporary object(s) from run %s.\n", *checkpointPath, len(cp.TempObjects), cp.RunID)
+	}
+
+	if len(leftovers) == 0 {
+		fmt.Println("No leftover temporary objects found.")
+		return 0
+	}
+
+	fmt.Println("Leftover temporary objects (make sure no migration is currently running):")
+	for _, o := range leftovers {
+		fmt.Printf("  %s.%s (run %s)\n", o.Schema, o.Name, o.RunID)
+	}
+
+	if !*yes {
+		fmt.Printf("Drop %d object(s)? [y/N] ", len(leftovers))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Aborted.")
+			return 1
+		}
+	}
+
+	for _, o := range leftovers {
+		if _, err := dest.Exec(ctx, sqlutil.DropTable(sqlutil.QualifiedIdent(o.Schema, o.Name), false)); err != nil {
+			log.Printf("Failed to drop %s.%s: %v", o.Schema, o.Name, err)
+			return 1
+		}
+		fmt.Printf("Dropped %s.%s\n", o.Schema, o.Name)
+	}
+	return 0
+}
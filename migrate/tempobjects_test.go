@@ -0,0 +1,54 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStagingTableDropped checks that the staging table of an upsert is
+// dropped and forgotten by the checkpoint, whether the load succeeds or not.
+func TestStagingTableDropped(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		insertErr error
+	}{
+		{"succeeded", nil},
+		{"failed", errors.New("duplicate key value violates unique constraint")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fakeConn{results: []fakeResult{
+				{match: "txid_current_snapshot()", rows: [][]any{{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "10:10:"}}},
+				{match: "SELECT count(*)", rows: [][]any{{int64(1)}}},
+				{match: `SELECT "id" FROM`, rows: [][]any{{int64(1)}}},
+			}}
+			dest := &fakeConn{results: []fakeResult{{match: `INSERT INTO "users"`, err: tt.insertErr}}}
+			m := NewMigrator(&SourceConn{conn: source}, nil, dest, Options{CopyMethod: copyMethodRows, DataOnly: true, Upsert: true})
+			state := &MigrationState{
+				Checkpoint: newCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json")),
+				Report:     newReport(false),
+				upserts:    map[string]*conflictStrategy{"users": {columns: []string{"id"}}},
+			}
+			state.Tables = []Table{{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}}}}
+			state.AllTables = state.Tables
+
+			err := m.Copy(context.Background(), state)
+			if (err != nil) != (tt.insertErr != nil) {
+				t.Fatalf("Copy error = %v, want %v", err, tt.insertErr)
+			}
+			staging := tempTableName(state.Checkpoint.RunID, tempUpsert, "users")
+			if !dest.ran(`CREATE UNLOGGED TABLE "_farewall"."`+staging+`"`) || !dest.ran(`DROP TABLE IF EXISTS "_farewall"."`+staging+`"`) {
+				t.Errorf("staging table %s was not created and dropped; ran %q", staging, dest.queries)
+			}
+			cp, err := loadCheckpoint(state.Checkpoint.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cp.TempObjects) > 0 || len(state.Checkpoint.TempObjects) > 0 {
+				t.Errorf("checkpoint still lists %v", cp.TempObjects)
+			}
+		})
+	}
+}
@@ -0,0 +1 @@
+CREATE TABLE "profiles" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "tags" text[] DEFAULT '{}'::text[], "scores" integer[] NOT NULL DEFAULT ARRAY[0, 0], "grid" numeric(4,1)[], "moods" mood[], PRIMARY KEY ("id"));
@@ -0,0 +1 @@
+CREATE TABLE "events" ("id" SERIAL NOT NULL, "big_id" BIGSERIAL NOT NULL, "xata_id" text NOT NULL, "created_at" timestamp with time zone NOT NULL DEFAULT now(), "status" text COLLATE "C" NOT NULL DEFAULT 'new'::text, "title" text COLLATE "und-x-icu", "score" double precision DEFAULT 0.5, PRIMARY KEY ("id"), CONSTRAINT "events_score_check" CHECK ((score >= (0)::double precision)));
@@ -0,0 +1 @@
+CREATE TABLE "line_items" ("id" integer NOT NULL, "price" numeric(10,2) NOT NULL, "total" numeric GENERATED ALWAYS AS ((price * (qty)::numeric)) STORED, "qty" integer NOT NULL DEFAULT 1, "label" text GENERATED ALWAYS AS (upper(name)) VIRTUAL, "name" text, PRIMARY KEY ("id"));
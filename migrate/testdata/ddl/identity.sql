@@ -0,0 +1 @@
+CREATE TABLE "accounts" ("id" bigint GENERATED ALWAYS AS IDENTITY NOT NULL, "legacy_no" integer GENERATED BY DEFAULT AS IDENTITY NOT NULL, "name" text, PRIMARY KEY ("id"));
@@ -0,0 +1,3 @@
+CREATE TABLE "vehicles" ("id" integer NOT NULL, "name" text, PRIMARY KEY ("id"), CONSTRAINT "name_set" CHECK ((name <> ''::text)));
+
+CREATE TABLE "cars" ("doors" smallint, PRIMARY KEY ("id")) INHERITS ("vehicles");
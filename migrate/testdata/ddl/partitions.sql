@@ -0,0 +1,8 @@
+CREATE TABLE "measurements" ("id" bigint NOT NULL, "taken_at" date NOT NULL, "value" real, PRIMARY KEY ("id", "taken_at")) PARTITION BY RANGE (taken_at);
+
+CREATE TABLE "measurements_2024" PARTITION OF "measurements" (CONSTRAINT "positive" CHECK ((value > (0)::double precision))) FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+
+CREATE TABLE "logs" ("id" bigint NOT NULL, "logged_at" timestamp with time zone NOT NULL, PRIMARY KEY ("id")) PARTITION BY RANGE ("logged_at");
+CREATE TABLE "logs_2024" PARTITION OF "logs" FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+CREATE TABLE "logs_2025" PARTITION OF "logs" FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');
+CREATE TABLE "logs_default" PARTITION OF "logs" DEFAULT;
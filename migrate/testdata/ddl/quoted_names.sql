@@ -0,0 +1,3 @@
+CREATE TABLE "Order Items" ("Order ID" integer NOT NULL, "select" integer NOT NULL, "user" text, "we""ird" text, "MixedCase" text, "prénom" text, PRIMARY KEY ("Order ID", "select"));
+COMMENT ON TABLE "Order Items" IS 'the user''s orders';
+COMMENT ON COLUMN "Order Items"."user" IS 'says "hi"';
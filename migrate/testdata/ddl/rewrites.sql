@@ -0,0 +1,5 @@
+CREATE TABLE "members" ("id" SERIAL NOT NULL, "email_address" text NOT NULL, "joined" timestamp without time zone, "ref" bigint NOT NULL DEFAULT 0, PRIMARY KEY ("id"));
+
+CREATE TABLE "billing"."orders" ("id" bigint NOT NULL DEFAULT nextval('"billing".order_ids'::regclass), "amount" numeric(12,2) NOT NULL DEFAULT 0, "stage" "billing".stage, "total" numeric GENERATED ALWAYS AS ("billing".with_tax(amount)) STORED, "note" text, PRIMARY KEY ("id"), CONSTRAINT "orders_note_check" CHECK ("billing".valid_note(note)));
+
+CREATE TABLE "archive"."audit_log" ("id" bigint NOT NULL, "entry" text, PRIMARY KEY ("id"));
@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	loadHookTrigger = "trigger"
+	loadHookRule    = "rule"
+)
+
+// LoadHook is an enabled user trigger or rule on a destination table that
+// receives data while keeping its definition (--data-only, --differential).
+// Such hooks fire for every copied row; audit triggers in particular can
+// bloat their log tables by millions of rows.
+type LoadHook struct {
+	// Table is the schema-qualified destination table
+	Table string `json:"table"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	// Disabled and Reenabled record --disable-dest-triggers
+	Disabled  bool `json:"disabled,omitempty"`
+	Reenabled bool `json:"reenabled,omitempty"`
+
+	schema, table string
+}
+
+func (h *LoadHook) alter(action string) string {
+	kind := "TRIGGER"
+	if h.Kind == loadHookRule {
+		kind = "RULE"
+	}
+	return fmt.Sprintf("ALTER TABLE %s %s %s %s", schemaIdent(h.schema, h.table), action, kind, sqlutil.QuoteIdent(h.Name))
+}
+
+// findLoadHooks lists the enabled user triggers and rules of the
+// destination tables of tables. Internal triggers, such as those enforcing
+// foreign keys, are left out.
+func findLoadHooks(ctx context.Context, dest Querier, tables []Table) ([]*LoadHook, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.qualifiedDestName()
+	}
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname, c.relname, h.name, h.kind
+		FROM (
+			SELECT tgrelid AS relid, tgname::text AS name, 'trigger' AS kind
+			FROM pg_trigger
+			WHERE NOT tgisinternal AND tgenabled <> 'D'
+			UNION ALL
+			SELECT ev_class, rulename::text, 'rule'
+			FROM pg_rewrite
+			WHERE rulename <> '_RETURN' AND ev_enabled <> 'D'
+		) h
+		JOIN pg_class c ON c.oid = h.relid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname || '.' || c.relname = ANY($1)
+		ORDER BY n.nspname, c.relname, h.kind, h.name
+	`, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination triggers: %w", err)
+	}
+	hooks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*LoadHook, error) {
+		h := &LoadHook{}
+		err := row.Scan(&h.schema, &h.table, &h.Name, &h.Kind)
+		h.Table = h.schema + "." + h.table
+		return h, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination triggers: %w", err)
+	}
+	return hooks, nil
+}
+
+// checkLoadHooks warns about every trigger and rule that will fire during
+// the load, and records them in the report.
+func checkLoadHooks(ctx context.Context, dest Querier, tables []Table, opts Options, report *Report) ([]*LoadHook, error) {
+	hooks, err := findLoadHooks(ctx, dest, tables)
+	if err != nil || len(hooks) == 0 {
+		return nil, err
+	}
+	fmt.Printf("  %d destination trigger(s)/rule(s) will fire for every copied row:\n", len(hooks))
+	for _, h := range hooks {
+		fmt.Printf("    %s %s on %s\n", h.Kind, h.Name, h.Table)
+	}
+	if opts.DisableDestTriggers {
+		fmt.Println("  They are disabled during the load (--disable-dest-triggers).")
+	} else {
+		report.warn(warnLoadHooks, "%d destination trigger(s)/rule(s) will fire during the load; pass --disable-dest-triggers to disable them for its duration", len(hooks))
+	}
+	report.LoadHooks = hooks
+	return hooks, nil
+}
+
+// disableLoadHooks disables hooks for the copy. The ones disabled are
+// marked, so enableLoadHooks restores exactly those, even when disabling
+// stopped half-way.
+func disableLoadHooks(ctx context.Context, dest Querier, hooks []*LoadHook) error {
+	for _, h := range hooks {
+		if _, err := dest.Exec(ctx, h.alter("DISABLE")); err != nil {
+			return fmt.Errorf("failed to disable %s %s on %s: %w", h.Kind, h.Name, h.Table, err)
+		}
+		h.Disabled = true
+		fmt.Printf("  Disabled %s %s on %s\n", h.Kind, h.Name, h.Table)
+	}
+	return nil
+}
+
+// enableLoadHooks re-enables every hook disabled by disableLoadHooks. It
+// keeps going after a failure and returns all of them.
+func enableLoadHooks(ctx context.Context, dest Querier, hooks []*LoadHook, report *Report) error {
+	var errs []error
+	for _, h := range hooks {
+		if !h.Disabled {
+			continue
+		}
+		if _, err := dest.Exec(ctx, h.alter("ENABLE")); err != nil {
+			report.warnTable(warnLoadHooks, h.Table, "%s %s on %s is still DISABLED: %v", h.Kind, h.Name, h.Table, err)
+			errs = append(errs, fmt.Errorf("failed to re-enable %s %s on %s: %w", h.Kind, h.Name, h.Table, err))
+			continue
+		}
+		h.Reenabled = true
+		fmt.Printf("  Re-enabled %s %s on %s\n", h.Kind, h.Name, h.Table)
+	}
+	return errors.Join(errs...)
+}
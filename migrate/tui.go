@@ -0,0 +1,360 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// The --tui needs at least this many columns and lines; below, or when
+// stdout is not a terminal, the run keeps the console output.
+const (
+	tuiMinWidth  = 80
+	tuiMinHeight = 20
+	// tuiLogLines are kept in the log pane; the whole log is printed to
+	// the console when the TUI ends
+	tuiLogLines = 1000
+)
+
+// tuiReporter is the ProgressReporter of --tui: a live table of the tables
+// of the copy above a pane with the log. While it runs, stdout, stderr and
+// the log are captured into that pane, and the progress bars are silent;
+// it polls their counts instead.
+type tuiReporter struct {
+	app     *tview.Application
+	header  *tview.TextView
+	table   *tview.Table
+	logView *tview.TextView
+
+	mu       sync.Mutex
+	tables   []*tuiTable
+	byName   map[string]*tuiTable
+	current  *tuiTable
+	warnings int
+	paused   bool
+
+	// control is the copyControl of the runs shown, and slots the source
+	// connection slots of the run in progress
+	control *copyControl
+	slots   atomic.Pointer[sourceLimiter]
+
+	stdout, stderr *os.File
+	pipe           *os.File
+	// captured is the whole log, printed once the TUI ends
+	captured bytes.Buffer
+	read     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+type tuiTable struct {
+	name     string
+	status   string
+	expected int64
+	rows     int64
+	warnings int
+	bars     []tuiBar
+	started  time.Time
+	finished time.Time
+}
+
+type tuiBar struct {
+	bar   *progressbar.ProgressBar
+	bytes bool
+}
+
+// startTUI starts the --tui, which the runs of the process then report to
+// (see runEnv), or returns nil, after saying why, when the terminal cannot
+// show it.
+func startTUI() *tuiReporter {
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		fmt.Println("--tui needs a terminal; using the console output.")
+		return nil
+	}
+	if w, h, err := term.GetSize(fd); err != nil || w < tuiMinWidth || h < tuiMinHeight {
+		fmt.Printf("--tui needs a terminal of at least %dx%d; using the console output.\n", tuiMinWidth, tuiMinHeight)
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("Warning: --tui could not capture the output, using the console output: %v", err)
+		return nil
+	}
+
+	t := &tuiReporter{
+		app:     tview.NewApplication(),
+		header:  tview.NewTextView(),
+		table:   tview.NewTable().SetFixed(1, 0),
+		logView: tview.NewTextView().SetMaxLines(tuiLogLines),
+		byName:  map[string]*tuiTable{},
+		control: &copyControl{},
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		pipe:    w,
+		read:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	t.table.SetBorder(true).SetTitle(" Tables ")
+	t.logView.SetBorder(true).SetTitle(" Log ")
+	t.logView.SetChangedFunc(func() { t.logView.ScrollToEnd() })
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.header, 1, 0, false).
+		AddItem(t.table, 0, 3, false).
+		AddItem(t.logView, 0, 2, false)
+	t.app.SetRoot(layout, true).SetInputCapture(t.key)
+
+	t.draw()
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(logWriter{w: w})
+
+	go t.capture(r)
+	go func() {
+		if err := t.app.Run(); err != nil {
+			fmt.Fprintf(w, "Warning: the --tui stopped: %v\n", err)
+		}
+		close(t.stopped)
+	}()
+	go t.refresh()
+	return t
+}
+
+// stop ends the TUI, restores the console and prints the captured log, so
+// it stays in the scrollback. A pause or skip still requested is dropped.
+func (t *tuiReporter) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		t.app.Stop()
+		<-t.stopped
+		t.control.release()
+		os.Stdout, os.Stderr = t.stdout, t.stderr
+		log.SetOutput(logWriter{w: t.stderr})
+		t.pipe.Close()
+		<-t.read
+		t.stdout.Write(t.captured.Bytes())
+	})
+}
+
+// capture copies the output written while the TUI runs into the log pane.
+// Of a line a progress bar redrew with \r, only the last text is kept.
+func (t *tuiReporter) capture(r *os.File) {
+	defer close(t.read)
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if i := strings.LastIndexByte(strings.TrimSuffix(line, "\n"), '\r'); i >= 0 {
+				line = line[i+1:]
+			}
+			t.mu.Lock()
+			t.captured.WriteString(line)
+			t.mu.Unlock()
+			io.WriteString(t.logView, tview.Escape(line))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *tuiReporter) refresh() {
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-tick.C:
+			t.app.QueueUpdateDraw(t.draw)
+		}
+	}
+}
+
+// key handles p (pause or resume), s (skip the table being copied) and
+// Ctrl-C, which ends the run as the interrupt would without the TUI.
+func (t *tuiReporter) key(ev *tcell.EventKey) *tcell.EventKey {
+	switch {
+	case ev.Key() == tcell.KeyCtrlC:
+		go func() {
+			t.stop()
+			fmt.Println("Interrupted.")
+			os.Exit(130)
+		}()
+		return nil
+	case ev.Rune() == 'p':
+		paused := t.control.togglePause()
+		t.mu.Lock()
+		t.paused = paused
+		t.mu.Unlock()
+		if paused {
+			fmt.Fprintln(t.pipe, "Copy paused; press p to resume.")
+		} else {
+			fmt.Fprintln(t.pipe, "Copy resumed.")
+		}
+	case ev.Rune() == 's':
+		t.mu.Lock()
+		current := t.current
+		t.mu.Unlock()
+		if current != nil {
+			fmt.Fprintf(t.pipe, "Skipping table %s...\n", current.name)
+			t.control.requestSkip()
+		}
+	}
+	t.draw()
+	return nil
+}
+
+func (t *tuiReporter) CopyStarted(tables []string, rows []int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tables, t.byName, t.current = nil, map[string]*tuiTable{}, nil
+	for i, name := range tables {
+		tt := &tuiTable{name: name, status: tableStatusPending, expected: rows[i]}
+		t.tables = append(t.tables, tt)
+		t.byName[name] = tt
+	}
+}
+
+func (t *tuiReporter) TableStarted(table string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tt := t.byName[table]
+	if tt == nil {
+		tt = &tuiTable{name: table}
+		t.tables = append(t.tables, tt)
+		t.byName[table] = tt
+	}
+	tt.status, tt.started = tableStatusCopying, time.Now()
+	t.current = tt
+}
+
+func (t *tuiReporter) BarStarted(bar *progressbar.ProgressBar, bytes bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.bars = append(t.current.bars, tuiBar{bar: bar, bytes: bytes})
+	}
+}
+
+func (t *tuiReporter) TableFinished(table, status string, rows int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tt := t.byName[table]
+	if tt == nil {
+		// Tables outside the copy phase, e.g. of a dry run
+		return
+	}
+	tt.status, tt.finished = status, time.Now()
+	// A failed or skipped table keeps the partial counts of its bars
+	if rows > 0 || (status != tableStatusFailed && status != tableStatusSkipped) {
+		tt.rows, tt.bars = rows, nil
+	}
+	if t.current == tt {
+		t.current = nil
+	}
+}
+
+func (t *tuiReporter) Warning(string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.warnings++
+	if t.current != nil {
+		t.current.warnings++
+	}
+}
+
+// progress returns the rows and bytes copied so far and the rows per
+// second, or bytes per second when only bytes are counted.
+func (tt *tuiTable) progress() (rows, bytes int64, rate string) {
+	rows = tt.rows
+	for _, b := range tt.bars {
+		if b.bytes {
+			bytes += b.bar.State().CurrentNum
+		} else {
+			rows += b.bar.State().CurrentNum
+		}
+	}
+	if tt.started.IsZero() {
+		return rows, bytes, ""
+	}
+	end := tt.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	secs := end.Sub(tt.started).Seconds()
+	switch {
+	case secs <= 0:
+	case rows > 0:
+		rate = fmt.Sprintf("%.0f rows/s", float64(rows)/secs)
+	case bytes > 0:
+		rate = formatBytes(int64(float64(bytes)/secs)) + "/s"
+	}
+	return rows, bytes, rate
+}
+
+// draw renders the header and the table; it runs on the UI goroutine.
+func (t *tuiReporter) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := "copying"
+	switch {
+	case t.paused:
+		state = "PAUSED"
+	case t.current == nil:
+		state = "idle"
+	}
+	if slots := t.slots.Load(); slots != nil {
+		if n := slots.Waiting(); n > 0 {
+			state += fmt.Sprintf(", %d waiting for a source connection", n)
+		}
+	}
+	t.header.SetText(fmt.Sprintf(" farewall: %s | %d warning(s) | p pause/resume  s skip table  Ctrl-C quit", state, t.warnings))
+
+	t.table.Clear()
+	for i, h := range []string{"Table", "Status", "Rows", "Expected", "Throughput", "Warnings"} {
+		t.table.SetCell(0, i, tview.NewTableCell(h).SetTextColor(tcell.ColorYellow).SetExpansion(1))
+	}
+	for i, tt := range t.tables {
+		rows, bytes, rate := tt.progress()
+		copied := fmt.Sprint(rows)
+		if rows == 0 && bytes > 0 {
+			copied = formatBytes(bytes)
+		}
+		color := tcell.ColorWhite
+		switch tt.status {
+		case tableStatusCopying:
+			color = tcell.ColorAqua
+		case tableStatusFailed:
+			color = tcell.ColorRed
+		case tableStatusSkipped:
+			color = tcell.ColorOrange
+		case tableStatusPending:
+			color = tcell.ColorGray
+		default:
+			color = tcell.ColorGreen
+		}
+		warnings := ""
+		if tt.warnings > 0 {
+			warnings = fmt.Sprint(tt.warnings)
+		}
+		for col, text := range []string{tt.name, tt.status, copied, fmt.Sprint(tt.expected), rate, warnings} {
+			t.table.SetCell(i+1, col, tview.NewTableCell(tview.Escape(text)).SetTextColor(color).SetExpansion(1))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const tempUpsert = "upsert"
+
+// conflictStrategy is the resolved ON CONFLICT clause of one table.
+type conflictStrategy struct {
+	constraint string
+	columns    []string
+	update     []string
+}
+
+func (cs *conflictStrategy) clause() string {
+	if cs.constraint != "" {
+		return sqlutil.OnConstraintDoUpdate(cs.constraint, cs.update)
+	}
+	return sqlutil.OnConflictDoUpdate(cs.columns, cs.update)
+}
+
+func (cs *conflictStrategy) describe() string {
+	target := "(" + strings.Join(cs.columns, ", ") + ")"
+	if cs.constraint != "" {
+		target = "constraint " + cs.constraint + " " + target
+	}
+	if len(cs.update) == 0 {
+		return "on conflict " + target + " do nothing"
+	}
+	return "on conflict " + target + " update " + strings.Join(cs.update, ", ")
+}
+
+// uniqueIndex is a unique index usable as an ON CONFLICT target.
+type uniqueIndex struct {
+	constraint *string
+	primary    bool
+	columns    []string
+}
+
+// destinationUniqueIndexes lists the plain (non-partial, non-expression)
+// unique indexes of every destination table with their key columns, keyed
+// by schema.table.
+func destinationUniqueIndexes(ctx context.Context, dest Querier) (map[string][]uniqueIndex, error) {
+	rows, err := dest.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname, con.conname, i.indisprimary, array_agg(a.attname::text ORDER BY k.ord)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_constraint con ON con.conindid = i.indexrelid AND con.contype IN ('p', 'u')
+		CROSS JOIN LATERAL unnest(i.indkey::int2[]) WITH ORDINALITY AS k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = k.attnum AND NOT a.attisdropped
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND i.indisunique
+		  AND i.indpred IS NULL
+		  AND i.indexprs IS NULL
+		  AND k.ord <= i.indnkeyatts
+		GROUP BY n.nspname, c.relname, i.indexrelid, con.conname, i.indisprimary
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list destination unique indexes: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string][]uniqueIndex{}
+	for rows.Next() {
+		var table string
+		var idx uniqueIndex
+		if err := rows.Scan(&table, &idx.constraint, &idx.primary, &idx.columns); err != nil {
+			return nil, err
+		}
+		out[table] = append(out[table], idx)
+	}
+	return out, rows.Err()
+}
+
+// planUpserts resolves the conflict strategy of every table loaded with
+// --upsert and checks that its target exists as a unique index on the
+// destination, so a wrong target fails before any data is written.
+func planUpserts(ctx context.Context, dest Querier, tables []Table, cfg *Config, skip map[string]bool) (map[string]*conflictStrategy, error) {
+	indexes, err := destinationUniqueIndexes(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := map[string]*conflictStrategy{}
+	for _, t := range tables {
+		if skip[t.Name] {
+			continue
+		}
+		tc := cfg.table(t.Name)
+		if tc.SplitBy != nil {
+			return nil, &SchemaError{Table: t.Name, Err: fmt.Errorf("table %s: split_by is not supported with --upsert", t.Name)}
+		}
+		cs, err := resolveConflict(t, tc.OnConflict, indexes[t.qualifiedDestName()])
+		if err != nil {
+			return nil, &SchemaError{Table: t.Name, Err: err}
+		}
+		plan[t.Name] = cs
+	}
+	return plan, nil
+}
+
+func resolveConflict(t Table, oc *OnConflictConfig, indexes []uniqueIndex) (*conflictStrategy, error) {
+	if oc == nil {
+		oc = &OnConflictConfig{}
+	}
+
+	var match *uniqueIndex
+	for i, idx := range indexes {
+		switch {
+		case oc.Constraint != "":
+			if idx.constraint != nil && *idx.constraint == oc.Constraint {
+				match = &indexes[i]
+			}
+		case len(oc.Columns) > 0:
+			if sameColumns(idx.columns, t.destColumns(oc.Columns)) {
+				match = &indexes[i]
+			}
+		default:
+			if idx.primary {
+				match = &indexes[i]
+			}
+		}
+		if match != nil {
+			break
+		}
+	}
+	switch {
+	case match == nil && oc.Constraint != "":
+		return nil, fmt.Errorf("table %s: destination has no primary key or unique constraint named %s", t.Name, oc.Constraint)
+	case match == nil && len(oc.Columns) > 0:
+		return nil, fmt.Errorf("table %s: destination has no unique index on (%s)", t.Name, strings.Join(oc.Columns, ", "))
+	case match == nil:
+		return nil, fmt.Errorf("table %s has no primary key on the destination; set on_conflict in the config", t.Name)
+	}
+
+	cs := &conflictStrategy{columns: match.columns}
+	if oc.Constraint != "" {
+		cs.constraint = oc.Constraint
+	}
+	for _, c := range cs.columns {
+		if _, ok := t.columnByDest(c); !ok {
+			return nil, fmt.Errorf("table %s: conflict column %s is not copied from the source", t.Name, c)
+		}
+	}
+
+	switch {
+	case oc.Action == conflictActionNothing:
+	case len(oc.UpdateColumns) > 0:
+		cs.update = t.destColumns(oc.UpdateColumns)
+	default:
+		for _, c := range t.Columns {
+			if c.Generated == "" && !slices.Contains(cs.columns, c.destName()) {
+				cs.update = append(cs.update, c.destName())
+			}
+		}
+	}
+	for _, name := range cs.update {
+		c, ok := t.columnByDest(name)
+		if !ok {
+			return nil, fmt.Errorf("table %s: update column %s is not copied from the source", t.Name, name)
+		}
+		if c.Generated != "" {
+			return nil, fmt.Errorf("table %s: update column %s is generated on the destination", t.Name, name)
+		}
+	}
+	return cs, nil
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, c := range b {
+		if !slices.Contains(a, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyTableStaged loads t into an unlogged staging table and moves it into
+// the destination table with one INSERT ... SELECT, which encrypts the
+// pgcrypto columns with key. A non-nil cs merges the rows into the existing
+// ones with ON CONFLICT (--upsert). Only the rows matching the optional
+// where condition, with whereArgs, are read (see --incremental). It returns
+// the rows read from the source and their bytes.
+func copyTableStaged(ctx context.Context, source *SourceConn, dest CopyConn, t Table, count int64, where string, whereArgs []any, pipelines []*columnPipeline, cs *conflictStrategy, key string, cp *Checkpoint, wal *walMonitor) (copied, copiedBytes int64, err error) {
+	cols := copyColumns(t)
+	if cs != nil {
+		fmt.Printf("  Upserting, %s\n", cs.describe())
+	}
+
+	staging, err := createTempTable(ctx, dest, cp, tempUpsert, t.Name,
+		"AS SELECT "+strings.Join(stagingColumns(t), ", ")+" FROM "+destIdent(t)+" WITH NO DATA")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if derr := dropTempTable(ctx, dest, cp, tempUpsert, t.Name); derr != nil && err == nil {
+			err = derr
+		}
+	}()
+
+	bar := runOf(ctx).newProgressBar(count, "  Staging")
+	into := pgx.Identifier{stateSchema, tempTableName(cp.RunID, tempUpsert, t.Name)}
+	copied, copiedBytes, err = copyRows(ctx, source, dest, t, into, where, whereArgs, bar, pipelines, nil, wal)
+	if err != nil {
+		return 0, 0, err
+	}
+	bar.Finish()
+	fmt.Println()
+
+	insert := sqlutil.InsertSelectExprs(destIdent(t), cols, stagedValues(t), staging)
+	var args []any
+	if hasPgcryptoColumns(t) {
+		args = append(args, key)
+	}
+	if cs == nil {
+		if _, err := dest.Exec(ctx, insert, args...); err != nil {
+			return 0, 0, fmt.Errorf("failed to move the staged rows into %s: %w", t.Name, err)
+		}
+		return copied, copiedBytes, nil
+	}
+	tag, err := dest.Exec(ctx, insert+" "+cs.clause(), args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to upsert into %s: %w", t.Name, err)
+	}
+	fmt.Printf("  Merged %d of %d rows\n", tag.RowsAffected(), copied)
+	return copied, copiedBytes, nil
+}
@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveConflict(t *testing.T) {
+	users := Table{Name: "users", Columns: []Column{
+		{Name: "id", DataType: "bigint"},
+		{Name: "email", DataType: "text", DestName: "e_mail"},
+		{Name: "name", DataType: "text"},
+		{Name: "search", DataType: "tsvector", Generated: "to_tsvector('simple', name)"},
+	}}
+	named := func(s string) *string { return &s }
+	pkey := uniqueIndex{constraint: named("users_pkey"), primary: true, columns: []string{"id"}}
+	emailKey := uniqueIndex{constraint: named("users_email_key"), columns: []string{"e_mail"}}
+	nameEmail := uniqueIndex{columns: []string{"name", "e_mail"}}
+	all := []uniqueIndex{emailKey, nameEmail, pkey}
+
+	for _, tt := range []struct {
+		name    string
+		oc      *OnConflictConfig
+		indexes []uniqueIndex
+		want    *conflictStrategy
+		wantErr string
+	}{
+		{name: "primary key, update all", indexes: all,
+			want: &conflictStrategy{columns: []string{"id"}, update: []string{"e_mail", "name"}}},
+		{name: "empty config is the primary key", oc: &OnConflictConfig{}, indexes: all,
+			want: &conflictStrategy{columns: []string{"id"}, update: []string{"e_mail", "name"}}},
+		{name: "named constraint", oc: &OnConflictConfig{Constraint: "users_email_key"}, indexes: all,
+			want: &conflictStrategy{constraint: "users_email_key", columns: []string{"e_mail"}, update: []string{"id", "name"}}},
+		{name: "named primary key", oc: &OnConflictConfig{Constraint: "users_pkey"}, indexes: all,
+			want: &conflictStrategy{constraint: "users_pkey", columns: []string{"id"}, update: []string{"e_mail", "name"}}},
+		{name: "column list in another order", oc: &OnConflictConfig{Columns: []string{"email", "name"}}, indexes: all,
+			want: &conflictStrategy{columns: []string{"name", "e_mail"}, update: []string{"id"}}},
+		{name: "column list of a named constraint", oc: &OnConflictConfig{Columns: []string{"email"}}, indexes: all,
+			want: &conflictStrategy{columns: []string{"e_mail"}, update: []string{"id", "name"}}},
+		{name: "selected update columns", oc: &OnConflictConfig{UpdateColumns: []string{"email"}}, indexes: all,
+			want: &conflictStrategy{columns: []string{"id"}, update: []string{"e_mail"}}},
+		{name: "do nothing", oc: &OnConflictConfig{Action: conflictActionNothing}, indexes: all,
+			want: &conflictStrategy{columns: []string{"id"}}},
+		{name: "do nothing on a constraint", oc: &OnConflictConfig{Constraint: "users_email_key", Action: conflictActionNothing, UpdateColumns: []string{"name"}}, indexes: all,
+			want: &conflictStrategy{constraint: "users_email_key", columns: []string{"e_mail"}}},
+
+		{name: "no unique index", wantErr: "table users has no primary key on the destination"},
+		{name: "no primary key", indexes: []uniqueIndex{emailKey, nameEmail}, wantErr: "table users has no primary key on the destination"},
+		{name: "unknown constraint", oc: &OnConflictConfig{Constraint: "users_name_key"}, indexes: all,
+			wantErr: "destination has no primary key or unique constraint named users_name_key"},
+		{name: "column list without a unique index", oc: &OnConflictConfig{Columns: []string{"name"}}, indexes: all,
+			wantErr: "destination has no unique index on (name)"},
+		{name: "conflict column not copied", indexes: []uniqueIndex{{primary: true, columns: []string{"id", "tenant"}}},
+			wantErr: "conflict column tenant is not copied from the source"},
+		{name: "update column not copied", oc: &OnConflictConfig{UpdateColumns: []string{"nickname"}}, indexes: all,
+			wantErr: "update column nickname is not copied from the source"},
+		{name: "generated update column", oc: &OnConflictConfig{UpdateColumns: []string{"name", "search"}}, indexes: all,
+			wantErr: "update column search is generated on the destination"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveConflict(users, tt.oc, tt.indexes)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveConflict = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	triggerCreated  = "created"
+	triggerExisting = "existing"
+	triggerSkipped  = "skipped"
+)
+
+// trigger is a user trigger on a table of a source schema of the run,
+// created on the destination with --include-triggers once the data is in.
+type trigger struct {
+	// Table is the table's key; see sourceTableKey
+	Table string
+	Name  string
+	// Definition is the CREATE TRIGGER statement of pg_get_triggerdef
+	Definition string
+	// FunctionSchema is the schema of the trigger function
+	FunctionSchema string
+	// Columns are the columns of UPDATE OF
+	Columns []string
+	// Enabled is pg_trigger.tgenabled: O (origin), D (disabled), R
+	// (replica) or A (always)
+	Enabled string
+}
+
+// TriggerReport describes one trigger of the triggers phase.
+type TriggerReport struct {
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Reason is why a trigger was skipped
+	Reason string `json:"reason,omitempty"`
+}
+
+// introspectTriggers reads the user triggers of schemas. Internal
+// ones, such as those enforcing foreign keys, come with their constraint,
+// and the clones on partitions with the trigger of the parent.
+func introspectTriggers(ctx context.Context, conn Querier, schemas []string) ([]trigger, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT `+sourceKeySQL+`, t.tgname::text, pg_get_triggerdef(t.oid), pn.nspname::text,
+			ARRAY(
+				SELECT a.attname::text
+				FROM pg_attribute a
+				WHERE a.attrelid = t.tgrelid AND a.attnum = ANY(t.tgattr) AND NOT a.attisdropped
+				ORDER BY a.attnum
+			),
+			t.tgenabled::text
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_proc p ON p.oid = t.tgfoid
+		JOIN pg_namespace pn ON pn.oid = p.pronamespace
+		WHERE n.nspname = ANY($1)
+		  AND NOT t.tgisinternal
+		  AND NOT EXISTS (
+			SELECT 1
+			FROM pg_depend d
+			WHERE d.classid = 'pg_trigger'::regclass AND d.objid = t.oid AND d.deptype = 'P'
+		  )
+		ORDER BY 1, t.tgname
+	`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get triggers: %w", err)
+	}
+	triggers, err := pgx.CollectRows(rows, pgx.RowToStructByPos[trigger])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get triggers: %w", err)
+	}
+	return triggers, nil
+}
+
+// xataTrigger reports whether tr belongs to Xata, whose triggers maintain
+// its own metadata with functions of its private schemas.
+func xataTrigger(tr trigger) bool {
+	return strings.HasPrefix(tr.FunctionSchema, "xata") || strings.HasPrefix(tr.FunctionSchema, "pgroll") ||
+		referencesXataInternals(tr.Definition)
+}
+
+// triggerSkipReason returns why tr cannot be created on t on the
+// destination, or "". Its definition names the source table and columns.
+func triggerSkipReason(t Table, tr trigger) string {
+	if t.destSchema() != t.sourceSchema() || t.destName() != t.baseName() {
+		return "its table is renamed or routed to another schema"
+	}
+	for _, name := range tr.Columns {
+		c, ok := t.column(name)
+		switch {
+		case !ok:
+			return fmt.Sprintf("column %s is not copied", name)
+		case c.destName() != c.Name:
+			return fmt.Sprintf("column %s is renamed", name)
+		}
+	}
+	return ""
+}
+
+// Triggers creates the source's user triggers on the migrated tables with
+// --include-triggers. It runs after the copy, the constraints and the
+// materialized views, so triggers fire for none of the copied rows, nor for
+// rows --on-fk-violation delete-orphans deletes.
+func (m *Migrator) Triggers(ctx context.Context, state *MigrationState) error {
+	return m.run(ctx, PhaseTriggers, state, m.triggers)
+}
+
+func (m *Migrator) triggers(ctx context.Context, state *MigrationState) error {
+	// --data-only leaves the destination definitions alone
+	if len(state.triggers) == 0 || m.opts.DataOnly {
+		return nil
+	}
+	existing, err := introspectTriggers(ctx, m.dest, m.opts.Schemas.sourceSchemas())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Creating triggers...")
+	for _, tr := range state.triggers {
+		t, ok := tableByName(state.Tables, tr.Table)
+		if !ok {
+			continue
+		}
+		r := TriggerReport{Table: tr.Table, Name: tr.Name, Status: triggerCreated}
+		if xataTrigger(tr) {
+			r.Status, r.Reason = triggerSkipped, "it belongs to Xata"
+			state.Report.Triggers = append(state.Report.Triggers, r)
+			continue
+		}
+		if reason := triggerSkipReason(t, tr); reason != "" {
+			r.Status, r.Reason = triggerSkipped, reason
+			state.Report.warnTable(warnTriggerSkipped, t.Name, "trigger %s on %s was not created: %s", tr.Name, t.Name, reason)
+			state.Report.Triggers = append(state.Report.Triggers, r)
+			continue
+		}
+		// A kept table keeps its triggers
+		if slices.ContainsFunc(existing, func(e trigger) bool { return e.Table == tr.Table && e.Name == tr.Name }) {
+			r.Status = triggerExisting
+			state.Report.Triggers = append(state.Report.Triggers, r)
+			continue
+		}
+		stmts := []string{tr.Definition}
+		mode := map[string]string{"D": "DISABLE", "R": "ENABLE REPLICA", "A": "ENABLE ALWAYS"}[tr.Enabled]
+		if mode != "" {
+			stmts = append(stmts, "ALTER TABLE "+destIdent(t)+" "+mode+" TRIGGER "+sqlutil.QuoteIdent(tr.Name))
+		}
+		for _, stmt := range stmts {
+			if _, err := m.dest.Exec(ctx, stmt); err != nil {
+				return &SchemaError{Table: t.Name, Err: fmt.Errorf("failed to create trigger %s on %s (its function must exist on the destination; see --include-functions): %w", tr.Name, t.Name, err)}
+			}
+		}
+		fmt.Printf("  %s on %s\n", tr.Name, t.Name)
+		state.Report.Triggers = append(state.Report.Triggers, r)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	// uuidKeyV5 derives each UUID from the record id with UUIDv5,
+	// uuidKeyRandom generates new ones and keeps them in a translation table
+	uuidKeyV5     = "uuidv5"
+	uuidKeyRandom = "random"
+
+	// defaultUUIDNamespace is the UUIDv5 namespace unless uuid_key names
+	// another. Changing it would change every derived key.
+	defaultUUIDNamespace = "3b241101-e2bb-4255-8caf-4136c566a962"
+
+	// uuidMapPrefix names the translation tables of random keys in
+	// stateSchema
+	uuidMapPrefix = "uuid_map_"
+
+	schemaChangeUUID = "converted_to_uuid"
+)
+
+// UUIDKeyConfig converts the text primary key of a table, such as Xata's
+// rec_... record ids, to uuid on the destination, together with the columns
+// of other tables holding its ids.
+type UUIDKeyConfig struct {
+	// Mode is uuidv5 or random
+	Mode string `json:"mode"`
+	// Namespace is the UUIDv5 namespace, default defaultUUIDNamespace
+	Namespace string `json:"namespace"`
+	// References are table.column names (source names) of the columns
+	// holding ids of the table, translated alike
+	References []string `json:"references"`
+	// Persist keeps the translation table of random mode after the run,
+	// so later runs reuse its UUIDs
+	Persist bool `json:"persist"`
+}
+
+// uuidKey translates the record ids of one table. The primary key column
+// and its references share it, so they translate alike.
+type uuidKey struct {
+	table     string
+	mode      string
+	namespace [16]byte
+	persist   bool
+	// ids is the translation of random mode, complete before the copy
+	// starts (see prepareUUIDKeys)
+	ids map[string][16]byte
+}
+
+func (k *uuidKey) apply(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("record id of %s is %T, not text", k.table, v)
+	}
+	if k.mode == uuidKeyV5 {
+		return pgtype.UUID{Bytes: uuidV5(k.namespace, s), Valid: true}, nil
+	}
+	id, ok := k.ids[s]
+	if !ok {
+		return nil, fmt.Errorf("record id %q is not in the translation table of %s; it was probably added during the run, so run again with --resume", s, k.table)
+	}
+	return pgtype.UUID{Bytes: id, Valid: true}, nil
+}
+
+// uuidV5 is the name-based UUID of RFC 9562, section 5.5.
+func uuidV5(namespace [16]byte, name string) [16]byte {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return u
+}
+
+func randomUUID() ([16]byte, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return u, err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return u, nil
+}
+
+func parseUUID(s string) ([16]byte, error) {
+	var u [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != len(u) || (len(s) != 32 && len(s) != 36) {
+		return u, fmt.Errorf("invalid UUID %q", s)
+	}
+	copy(u[:], b)
+	return u, nil
+}
+
+func (c *Config) convertsUUIDKeys() bool {
+	if c == nil {
+		return false
+	}
+	for _, tc := range c.Tables {
+		if tc.UUIDKey != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func validateUUIDKey(tableName string, k *UUIDKeyConfig) error {
+	switch k.Mode {
+	case uuidKeyV5:
+		if k.Persist {
+			return fmt.Errorf("config: uuid_key of table %s sets persist, which only applies to mode random", tableName)
+		}
+	case uuidKeyRandom:
+		if k.Namespace != "" {
+			return fmt.Errorf("config: uuid_key of table %s sets a namespace, which only applies to mode uuidv5", tableName)
+		}
+	default:
+		return fmt.Errorf("config: uuid_key of table %s has unknown mode %q (expected uuidv5 or random)", tableName, k.Mode)
+	}
+	if k.Namespace != "" {
+		if _, err := parseUUID(k.Namespace); err != nil {
+			return fmt.Errorf("config: uuid_key namespace of table %s: %w", tableName, err)
+		}
+	}
+	for _, ref := range k.References {
+		if _, _, ok := splitColumnKey(ref); !ok {
+			return fmt.Errorf("config: uuid_key reference %q of table %s must be table.column", ref, tableName)
+		}
+	}
+	return nil
+}
+
+// uuidKeyConflict returns why the uuid_key of t cannot be applied, or "".
+// Every column holding its ids must be converted with it, including those
+// of foreign keys to it, or the destination could not compare them.
+func uuidKeyConflict(t Table, k *UUIDKeyConfig, c *Config, tables []Table) string {
+	if len(t.PrimaryKey) != 1 {
+		return "its primary key must be a single column"
+	}
+	key, _ := t.column(t.PrimaryKey[0])
+	if !isCharacterType(key.DataType) {
+		return fmt.Sprintf("primary key %s is %s, not text", key.Name, key.DataType)
+	}
+	converted := map[string]bool{t.Name + "." + key.Name: true}
+	for _, ref := range k.References {
+		tableName, colName := resolveColumnKey(ref, tables)
+		i := slices.IndexFunc(tables, func(o Table) bool { return o.Name == tableName })
+		if i < 0 {
+			return fmt.Sprintf("reference %s names an unknown table", ref)
+		}
+		col, ok := tables[i].column(colName)
+		switch {
+		case !ok:
+			return fmt.Sprintf("reference %s names an unknown column", ref)
+		case !isCharacterType(col.DataType):
+			return fmt.Sprintf("reference %s is %s, not text", ref, col.DataType)
+		case c.table(tableName).Columns[colName].Encrypt != "":
+			return fmt.Sprintf("reference %s is encrypted", ref)
+		case converted[ref]:
+			return fmt.Sprintf("reference %s is listed twice", ref)
+		}
+		converted[ref] = true
+	}
+	for _, other := range tables {
+		for _, fk := range other.ForeignKeys {
+			if fk.RefTable != t.Name {
+				continue
+			}
+			for i, col := range fk.Columns {
+				if fk.RefColumns[i] == key.Name && !converted[other.Name+"."+col] {
+					return fmt.Sprintf("foreign key %s on %s references it from %s, which is not among its references", fk.Name, other.Name, col)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// applyUUIDKeys turns the key column of every table with uuid_key, and the
+// columns referencing it, into uuid columns translated by a shared uuidKey,
+// and records each change in the report. The key column gets
+// gen_random_uuid() as its default, for rows added on the destination.
+func applyUUIDKeys(tables []Table, cfg *Config, report *Report) {
+	keys := map[string]*uuidKey{}
+	for _, t := range tables {
+		kc := cfg.table(t.Name).UUIDKey
+		if kc == nil {
+			continue
+		}
+		k := &uuidKey{table: t.Name, mode: kc.Mode, persist: kc.Persist}
+		ns := kc.Namespace
+		if ns == "" {
+			ns = defaultUUIDNamespace
+		}
+		// Validated with the config
+		k.namespace, _ = parseUUID(ns)
+		keys[t.Name+"."+t.PrimaryKey[0]] = k
+		for _, ref := range kc.References {
+			keys[ref] = k
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	for i := range tables {
+		t := &tables[i]
+		for j := range t.Columns {
+			c := &t.Columns[j]
+			k, ok := keys[t.Name+"."+c.Name]
+			if !ok {
+				continue
+			}
+			report.SchemaChanges = append(report.SchemaChanges, SchemaChange{Table: t.Name, Column: c.Name, DataType: c.DataType, Change: schemaChangeUUID})
+			c.UUIDKey = k
+			c.DataType = "uuid"
+			c.Default, c.Collation = nil, ""
+			if k.table == t.Name && slices.Equal(t.PrimaryKey, []string{c.Name}) {
+				def := "gen_random_uuid()"
+				c.Default = &def
+			}
+		}
+	}
+}
+
+// uuidMapTable is the destination table holding the translation of the
+// random key of table.
+func uuidMapTable(table string) string {
+	return sqlutil.QualifiedIdent(stateSchema, physicalName(uuidMapPrefix+table))
+}
+
+// randomUUIDKeys returns the random-mode keys of tables, each once.
+func randomUUIDKeys(tables []Table) []*uuidKey {
+	var keys []*uuidKey
+	for _, t := range tables {
+		for _, c := range t.Columns {
+			if c.UUIDKey != nil && c.UUIDKey.mode == uuidKeyRandom && !slices.Contains(keys, c.UUIDKey) {
+				keys = append(keys, c.UUIDKey)
+			}
+		}
+	}
+	return keys
+}
+
+// prepareUUIDKeys completes the translation of every random key before any
+// row is copied. The translation table on the destination is read first,
+// so ids translated by an earlier or interrupted run keep their UUIDs; then
+// every id the source has, in the key column or in a reference, that it
+// lacks gets a new UUID, added in one transaction. Ids of dangling
+// references are translated too, and left to --on-fk-violation. tables
+// are all the introspected ones, so a run limited by --only translates the
+// ids of tables outside it alike.
+func prepareUUIDKeys(ctx context.Context, source Querier, dest CopyConn, tables []Table) error {
+	for _, k := range randomUUIDKeys(tables) {
+		fmt.Printf("Preparing the UUID translation of %s...\n", k.table)
+		table := uuidMapTable(k.table)
+		for _, stmt := range []string{
+			"CREATE SCHEMA IF NOT EXISTS " + sqlutil.QuoteIdent(stateSchema),
+			"CREATE TABLE IF NOT EXISTS " + table + " (record_id text PRIMARY KEY, id uuid NOT NULL UNIQUE)",
+		} {
+			if _, err := dest.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to prepare the UUID translation of %s: %w", k.table, err)
+			}
+		}
+		rows, err := dest.Query(ctx, "SELECT record_id, id FROM "+table)
+		if err != nil {
+			return fmt.Errorf("failed to read the UUID translation of %s: %w", k.table, err)
+		}
+		k.ids = map[string][16]byte{}
+		var recordID string
+		var id pgtype.UUID
+		if _, err := pgx.ForEachRow(rows, []any{&recordID, &id}, func() error {
+			k.ids[recordID] = id.Bytes
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to read the UUID translation of %s: %w", k.table, err)
+		}
+		known := len(k.ids)
+
+		var selects []string
+		for _, t := range tables {
+			for _, c := range t.Columns {
+				if c.UUIDKey == k {
+					selects = append(selects, "SELECT "+sqlutil.QuoteIdent(c.Name)+"::text FROM "+schemaIdent(t.Schema, t.Name)+" WHERE "+sqlutil.QuoteIdent(c.Name)+" IS NOT NULL")
+				}
+			}
+		}
+		rows, err = source.Query(ctx, strings.Join(selects, " UNION "))
+		if err != nil {
+			return fmt.Errorf("failed to read the record ids of %s: %w", k.table, err)
+		}
+		var added [][]any
+		if _, err := pgx.ForEachRow(rows, []any{&recordID}, func() error {
+			if _, ok := k.ids[recordID]; ok {
+				return nil
+			}
+			u, err := randomUUID()
+			if err != nil {
+				return err
+			}
+			k.ids[recordID] = u
+			added = append(added, []any{recordID, pgtype.UUID{Bytes: u, Valid: true}})
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to read the record ids of %s: %w", k.table, err)
+		}
+
+		if len(added) > 0 {
+			tx, err := dest.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			into := pgx.Identifier{stateSchema, physicalName(uuidMapPrefix + k.table)}
+			if _, err := tx.CopyFrom(ctx, into, []string{"record_id", "id"}, pgx.CopyFromRows(added)); err != nil {
+				tx.Rollback(ctx)
+				return fmt.Errorf("failed to store the UUID translation of %s: %w", k.table, err)
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return fmt.Errorf("failed to store the UUID translation of %s: %w", k.table, err)
+			}
+		}
+		fmt.Printf("  %d record id(s), %d translated by an earlier run\n", len(k.ids), known)
+	}
+	return nil
+}
+
+// dropUUIDMaps drops the translation tables not kept with persist, once
+// every table is copied.
+func dropUUIDMaps(ctx context.Context, dest Querier, tables []Table) error {
+	for _, k := range randomUUIDKeys(tables) {
+		if k.persist {
+			continue
+		}
+		if _, err := dest.Exec(ctx, sqlutil.DropTable(uuidMapTable(k.table), false)); err != nil {
+			return fmt.Errorf("failed to drop the UUID translation of %s: %w", k.table, err)
+		}
+	}
+	return nil
+}
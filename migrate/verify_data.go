@@ -0,0 +1,394 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	verifyStatusMatch            = "match"
+	verifyStatusMissing          = "missing"
+	verifyStatusCountMismatch    = "count_mismatch"
+	verifyStatusChecksumMismatch = "checksum_mismatch"
+)
+
+// VerifyOptions configures Verify. The embedded Options select and name the
+// tables exactly as a migration with the same options would (Config, Only,
+// FlattenInheritance, KeepXataMetadata, FoldIdentifiers, CollisionSuffix);
+// a non-empty SchemaSnapshotPath also checks the destination schema
+// against that snapshot.
+type VerifyOptions struct {
+	Options
+	// Source should be read-only, e.g. from ConnectSource
+	Source, Dest Querier
+	// Checksums compares a checksum of every table's rows besides counts
+	Checksums bool
+	// MaxSourceDrift is the WAL in bytes the source may have written since
+	// the position recorded in the schema snapshot before a warning
+	MaxSourceDrift int64
+
+	// sourceVersion is read for the checksums of json-normalize columns
+	sourceVersion int
+}
+
+// VerifyResult is the outcome of Verify. Match is false when any table or
+// the schema differs.
+type VerifyResult struct {
+	Match     bool                `json:"match"`
+	CheckedAt time.Time           `json:"checked_at"`
+	Tables    []TableVerification `json:"tables"`
+	// SchemaDifferences against the schema snapshot, if one was given
+	SchemaDifferences []SchemaDifference `json:"schema_differences,omitempty"`
+	// SourceDrift compares the source with the position recorded in the
+	// schema snapshot, if it has one; it does not clear Match
+	SourceDrift *SourceDrift `json:"source_drift,omitempty"`
+	// Summary compares object counts and sizes of both sides; its
+	// mismatches do not clear Match
+	Summary *DatabaseSummary `json:"summary"`
+	// References counts the orphaned rows of relationships whose constraint
+	// is not validated on the destination; orphans do not clear Match
+	References []ReferenceCheck `json:"references,omitempty"`
+}
+
+// TableVerification compares one source table with its destination table.
+type TableVerification struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Status      string `json:"status"`
+
+	SourceRows      int64 `json:"source_rows"`
+	DestinationRows int64 `json:"destination_rows"`
+	// Checksums are set with VerifyOptions.Checksums
+	SourceChecksum      string `json:"source_checksum,omitempty"`
+	DestinationChecksum string `json:"destination_checksum,omitempty"`
+	// UncheckedColumns are left out of the checksum: normalized on the way
+	// in, converted to uuid, or not present on the destination
+	UncheckedColumns []string `json:"unchecked_columns,omitempty"`
+	// EncryptedColumns are left out of the checksum too, and compared
+	// decrypted when the key is set
+	EncryptedColumns []EncryptedColumnVerification `json:"encrypted_columns,omitempty"`
+}
+
+// Verify compares row counts, and optionally checksums, of every selected
+// source table with its destination table, without writing to either side.
+// Both sides are read while they may still change, so a mismatch on a live
+// source can be legitimate.
+func Verify(ctx context.Context, opts VerifyOptions) (*VerifyResult, error) {
+	tables, all, err := verificationTables(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	result := &VerifyResult{Match: true, CheckedAt: utcNow(), Tables: []TableVerification{}}
+	matviews, err := recreatedMatViews(ctx, opts.Source, opts.Dest, opts.Schemas.sourceSchemas())
+	if err != nil {
+		return nil, err
+	}
+	if result.Summary, err = summarizeDatabases(ctx, opts.Source, opts.Dest, tables, all, nil, matviews); err != nil {
+		return nil, err
+	}
+	if result.References, err = checkReferences(ctx, opts.Dest, tables, all, opts.Options); err != nil {
+		return nil, err
+	}
+
+	if opts.SchemaSnapshotPath != "" {
+		snap, err := loadSchemaSnapshot(opts.SchemaSnapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := introspectSchemas(ctx, opts.Dest, tableSchemas(snap.Tables))
+		if err != nil {
+			return nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+		}
+		result.SchemaDifferences = diffSchemas(snap.Tables, actual)
+		if len(result.SchemaDifferences) > 0 {
+			result.Match = false
+		}
+		if snap.SourcePosition != nil {
+			if result.SourceDrift, err = checkSourceDrift(ctx, opts.Source, snap.SourcePosition.latest(), opts.MaxSourceDrift); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	destTables, err := introspectSchemas(ctx, opts.Dest, tableSchemas(destinationTables(tables)))
+	if err != nil {
+		return nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect destination schema: %w", err))
+	}
+	byName := make(map[string]Table, len(destTables))
+	for _, t := range destTables {
+		byName[t.qualifiedName()] = t
+	}
+
+	if opts.Checksums {
+		if opts.sourceVersion, err = sourceVersion(ctx, opts, tables); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range tables {
+		tv, err := verifyTable(ctx, opts, t, byName)
+		if err != nil {
+			return nil, err
+		}
+		if tv.Status != verifyStatusMatch {
+			result.Match = false
+		}
+		result.Tables = append(result.Tables, tv)
+	}
+	return result, nil
+}
+
+// verificationTables introspects the source and applies the same filters
+// and names as the introspect and plan phases. It returns the selected
+// tables and all migrated ones.
+func verificationTables(ctx context.Context, opts VerifyOptions) (selected, all []Table, err error) {
+	tables, err := introspectSource(ctx, opts.Source, opts.Schemas.sourceSchemas(), nil)
+	if err != nil {
+		return nil, nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	if err := introspectIndexes(ctx, opts.Source, tables); err != nil {
+		return nil, nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	if err := introspectChecks(ctx, opts.Source, tables); err != nil {
+		return nil, nil, withSentinel(ErrIntrospection, fmt.Errorf("failed to introspect schema: %w", err))
+	}
+	if opts.FlattenInheritance {
+		flattenInheritance(tables)
+	}
+	handleXataMetadata(tables, opts.KeepXataMetadata, &Report{})
+	if err := opts.Config.validate(tables); err != nil {
+		return nil, nil, &SchemaError{Err: err}
+	}
+	applyEncryption(tables, opts.Config, &Report{})
+	applyTransforms(tables, opts.Config, &Report{})
+	applyUUIDKeys(tables, opts.Config, &Report{})
+	applyNames(tables, opts.Config, opts.SchemaMap, opts.FoldIdentifiers)
+	// A run without --skip-xata-checks failed on such checks
+	applyChecks(tables, true, &Report{})
+	if err := checkNameCollisions(tables, opts.Options, &Report{}); err != nil {
+		return nil, nil, &SchemaError{Err: err}
+	}
+	// Tables skipped for a reserved destination table were never copied
+	reserved, err := findReservedTables(ctx, opts.Dest, tables)
+	if err != nil {
+		return nil, nil, err
+	}
+	skip := map[string]bool{}
+	for name := range reserved {
+		if opts.Config.table(name).OnExisting == onExistingSkip {
+			skip[name] = true
+		}
+	}
+	tables = withoutTables(tables, skip)
+	if len(opts.Exclude) > 0 {
+		if tables, err = excludeTables(tables, opts.Exclude); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(opts.Only) > 0 {
+		selected, err := selectTables(tables, opts.Only)
+		return selected, tables, err
+	}
+	return tables, tables, nil
+}
+
+func verifyTable(ctx context.Context, opts VerifyOptions, t Table, destTables map[string]Table) (TableVerification, error) {
+	tv := TableVerification{Name: t.Name, Destination: t.qualifiedDestName()}
+	dt, ok := destTables[t.qualifiedDestName()]
+	if !ok {
+		tv.Status = verifyStatusMissing
+		return tv, nil
+	}
+
+	if !opts.Checksums {
+		if err := opts.Source.QueryRow(ctx, sqlutil.CountRows(fromClause(t))).Scan(&tv.SourceRows); err != nil {
+			return tv, fmt.Errorf("failed to count rows of %s on the source: %w", t.Name, err)
+		}
+		if err := opts.Dest.QueryRow(ctx, sqlutil.CountRows(destFromClause(t))).Scan(&tv.DestinationRows); err != nil {
+			return tv, fmt.Errorf("failed to count rows of %s on the destination: %w", tv.Destination, err)
+		}
+		tv.Status = verifyStatusMatch
+		if tv.SourceRows != tv.DestinationRows {
+			tv.Status = verifyStatusCountMismatch
+		}
+		return tv, nil
+	}
+
+	checked, unchecked, encrypted := comparedColumns(opts, t, dt)
+	tv.UncheckedColumns = unchecked
+	destExprs := destColumnExprs(checked)
+	err := opts.Source.QueryRow(ctx, checksumQuery(sourceColumns(checked), fromClause(t))).Scan(&tv.SourceRows, &tv.SourceChecksum)
+	if err != nil {
+		return tv, fmt.Errorf("failed to checksum %s on the source: %w", t.Name, err)
+	}
+	err = opts.Dest.QueryRow(ctx, checksumQuery(destExprs, destFromClause(t))).Scan(&tv.DestinationRows, &tv.DestinationChecksum)
+	if err != nil {
+		return tv, fmt.Errorf("failed to checksum %s on the destination: %w", tv.Destination, err)
+	}
+	switch {
+	case tv.SourceRows != tv.DestinationRows:
+		tv.Status = verifyStatusCountMismatch
+	case tv.SourceChecksum != tv.DestinationChecksum:
+		tv.Status = verifyStatusChecksumMismatch
+	default:
+		tv.Status = verifyStatusMatch
+	}
+	for _, c := range encrypted {
+		ev, err := verifyEncryptedColumn(ctx, opts, t, c)
+		if err != nil {
+			return tv, err
+		}
+		if ev.Status == encryptStatusMismatch && tv.Status == verifyStatusMatch {
+			tv.Status = verifyStatusChecksumMismatch
+		}
+		tv.EncryptedColumns = append(tv.EncryptedColumns, ev)
+	}
+	return tv, nil
+}
+
+// comparedColumns returns t with only the columns whose values can be
+// compared with the destination table dt. Normalized and uuid columns
+// differ by design, and columns the destination lacks cannot be compared;
+// they are returned as unchecked. Encrypted columns are returned apart.
+func comparedColumns(opts VerifyOptions, t, dt Table) (checked Table, unchecked []string, encrypted []Column) {
+	checked = t
+	checked.Columns = nil
+	for _, c := range t.Columns {
+		_, onDest := dt.column(c.destName())
+		if onDest && c.Encrypt != "" {
+			encrypted = append(encrypted, c)
+			continue
+		}
+		cc := opts.Config.table(t.Name).Columns[c.Name]
+		if !onDest || c.UUIDKey != nil || cc.normalizes() {
+			unchecked = append(unchecked, c.Name)
+			continue
+		}
+		if cc.Transform == transformJSONNormalize {
+			c.SourceExpr = jsonVerifyExpr(c, opts.sourceVersion)
+		}
+		checked.Columns = append(checked.Columns, c)
+	}
+	return checked, unchecked, encrypted
+}
+
+// destColumnExprs returns the destination columns of checked, quoted, in
+// the order of its source columns.
+func destColumnExprs(checked Table) []string {
+	exprs := make([]string, len(checked.Columns))
+	for i, name := range copyColumns(checked) {
+		exprs[i] = sqlutil.QuoteIdent(name)
+	}
+	return exprs
+}
+
+// checksumQuery counts the rows of from and sums the first 64 bits of the
+// md5 of each row's text representation. The sum does not depend on row
+// order, and the text of a value is the same on both sides as long as the
+// column types are.
+func checksumQuery(exprs []string, from string) string {
+	row := "ROW(" + strings.Join(exprs, ", ") + ")::text"
+	if len(exprs) == 0 {
+		row = "''"
+	}
+	return "SELECT count(*), coalesce(sum(('x' || left(md5(" + row + "), 16))::bit(64)::bigint), 0)::text FROM " + from
+}
+
+// runVerify implements the verify subcommand, a wrapper around Verify. It
+// prints the result as JSON on stdout and returns the process exit code: 0
+// when everything matches, 1 when it doesn't and 2 when the check itself
+// could not run.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var opts VerifyOptions
+	var env envSettings
+	env.register(fs)
+	fs.StringVar(&opts.ConfigPath, "config", "", "Config file of the migration, for renames, schema routes and normalizations")
+	fs.Var(&opts.Only, "only", "Verify only this table (repeatable)")
+	fs.Var(&opts.Exclude, "exclude", "Leave this table out, as excluded from the migration with --exclude (repeatable)")
+	fs.Var(&opts.Schemas, "schemas", "Comma-separated source schemas, as migrated with --schemas (default public)")
+	fs.Var(&opts.SchemaMap, "schema-map", "Destination schema of a source schema, as migrated with --schema-map (repeatable)")
+	fs.StringVar(&opts.SchemaSnapshotPath, "schema-snapshot", "", "Also check the destination schema against this snapshot")
+	fs.BoolVar(&opts.Checksums, "checksums", false, "Compare a checksum of every table's rows besides the row counts")
+	fs.Int64Var(&opts.MaxSourceDrift, "max-source-drift", defaultMaxSourceDrift, "Warn when the source has written more than this many bytes of WAL since the position in the schema snapshot")
+	fs.BoolVar(&opts.FlattenInheritance, "flatten-inheritance", false, "Verify as migrated with --flatten-inheritance")
+	fs.BoolVar(&opts.KeepXataMetadata, "keep-xata-metadata", false, "Verify as migrated with --keep-xata-metadata")
+	fs.BoolVar(&opts.FoldIdentifiers, "fold-identifiers", false, "Verify as migrated with --fold-identifiers")
+	fs.BoolVar(&opts.CollisionSuffix, "collision-suffix", false, "Verify as migrated with --collision-suffix")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(opts.ConfigPath)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	opts.Config = cfg
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	sourceURL, err := env.get(sourceURLVar)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if sourceURL == "" {
+		log.Printf("%s is not set", env.varName(sourceURLVar))
+		return 2
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 2
+	}
+
+	ctx := context.Background()
+	sourceConn, err := ConnectSource(ctx, sourceURL)
+	if err != nil {
+		log.Printf("Unable to connect to source database: %v", err)
+		return 2
+	}
+	defer sourceConn.Close(ctx)
+	destConn, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 2
+	}
+	defer destConn.Close(ctx)
+	opts.Source, opts.Dest = sourceConn, destConn
+	if opts.Config.encrypts() {
+		if opts.EncryptionKey, err = env.get(encryptionKeyVar); err != nil {
+			log.Print(err)
+			return 2
+		}
+	}
+
+	result, err := Verify(ctx, opts)
+	if err != nil {
+		log.Printf("Verification failed: %v", err)
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Printf("Failed to write result: %v", err)
+		return 2
+	}
+	if !result.Match {
+		return 1
+	}
+	return 0
+}
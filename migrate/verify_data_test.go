@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTable(t *testing.T) {
+	users := Table{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}, {Name: "email", DataType: "text"}}}
+	onDest := map[string]Table{"public.users": users}
+
+	tests := []struct {
+		name         string
+		checksums    bool
+		source, dest []fakeResult
+		destTables   map[string]Table
+		want         TableVerification
+	}{
+		{
+			name:   "counts match",
+			source: []fakeResult{{match: "count(*)", rows: [][]any{{int64(3)}}}},
+			dest:   []fakeResult{{match: "count(*)", rows: [][]any{{int64(3)}}}},
+			want:   TableVerification{Status: verifyStatusMatch, SourceRows: 3, DestinationRows: 3},
+		},
+		{
+			name:   "count mismatch",
+			source: []fakeResult{{match: "count(*)", rows: [][]any{{int64(3)}}}},
+			dest:   []fakeResult{{match: "count(*)", rows: [][]any{{int64(2)}}}},
+			want:   TableVerification{Status: verifyStatusCountMismatch, SourceRows: 3, DestinationRows: 2},
+		},
+		{
+			name:      "checksums match",
+			checksums: true,
+			source:    []fakeResult{{match: "md5(", rows: [][]any{{int64(3), "42"}}}},
+			dest:      []fakeResult{{match: "md5(", rows: [][]any{{int64(3), "42"}}}},
+			want: TableVerification{Status: verifyStatusMatch, SourceRows: 3, DestinationRows: 3,
+				SourceChecksum: "42", DestinationChecksum: "42"},
+		},
+		{
+			name:      "checksum mismatch",
+			checksums: true,
+			source:    []fakeResult{{match: "md5(", rows: [][]any{{int64(3), "42"}}}},
+			dest:      []fakeResult{{match: "md5(", rows: [][]any{{int64(3), "-7"}}}},
+			want: TableVerification{Status: verifyStatusChecksumMismatch, SourceRows: 3, DestinationRows: 3,
+				SourceChecksum: "42", DestinationChecksum: "-7"},
+		},
+		{
+			name:      "count mismatch wins over checksum",
+			checksums: true,
+			source:    []fakeResult{{match: "md5(", rows: [][]any{{int64(3), "42"}}}},
+			dest:      []fakeResult{{match: "md5(", rows: [][]any{{int64(4), "-7"}}}},
+			want: TableVerification{Status: verifyStatusCountMismatch, SourceRows: 3, DestinationRows: 4,
+				SourceChecksum: "42", DestinationChecksum: "-7"},
+		},
+		{
+			name:       "missing on the destination",
+			destTables: map[string]Table{},
+			want:       TableVerification{Status: verifyStatusMissing},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := VerifyOptions{Source: &fakeConn{results: tt.source}, Dest: &fakeConn{results: tt.dest}, Checksums: tt.checksums}
+			destTables := tt.destTables
+			if destTables == nil {
+				destTables = onDest
+			}
+			got, err := verifyTable(context.Background(), opts, users, destTables)
+			if err != nil {
+				t.Fatalf("verifyTable: %v", err)
+			}
+			tt.want.Name, tt.want.Destination = "users", "public.users"
+			if got.Status != tt.want.Status || got.SourceRows != tt.want.SourceRows || got.DestinationRows != tt.want.DestinationRows ||
+				got.SourceChecksum != tt.want.SourceChecksum || got.DestinationChecksum != tt.want.DestinationChecksum ||
+				got.Name != tt.want.Name || got.Destination != tt.want.Destination {
+				t.Errorf("verifyTable = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTableUncheckedColumns(t *testing.T) {
+	source := Table{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}, {Name: "legacy", DataType: "text"}}}
+	dest := Table{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}}}
+	src := &fakeConn{results: []fakeResult{{match: "md5(", rows: [][]any{{int64(1), "5"}}}}}
+	opts := VerifyOptions{Source: src, Dest: &fakeConn{results: src.results}, Checksums: true}
+
+	got, err := verifyTable(context.Background(), opts, source, map[string]Table{"public.users": dest})
+	if err != nil {
+		t.Fatalf("verifyTable: %v", err)
+	}
+	if got.Status != verifyStatusMatch || len(got.UncheckedColumns) != 1 || got.UncheckedColumns[0] != "legacy" {
+		t.Errorf("verifyTable = %+v, want a match with legacy unchecked", got)
+	}
+	if src.ran(`"legacy"`) {
+		t.Error("the checksum read a column the destination does not have")
+	}
+}
+
+func TestVerifyTableError(t *testing.T) {
+	users := Table{Name: "users", Columns: []Column{{Name: "id", DataType: "bigint"}}}
+	opts := VerifyOptions{
+		Source: &fakeConn{results: []fakeResult{{match: "count(*)", err: errors.New("connection reset")}}},
+		Dest:   &fakeConn{},
+	}
+	_, err := verifyTable(context.Background(), opts, users, map[string]Table{"public.users": users})
+	if err == nil || !strings.Contains(err.Error(), "on the source: connection reset") {
+		t.Errorf("verifyTable error = %v, want the source failure", err)
+	}
+}
+
+func TestVerifyResultJSON(t *testing.T) {
+	result := VerifyResult{Tables: []TableVerification{
+		{Name: "users", Destination: "public.users", Status: verifyStatusCountMismatch, SourceRows: 3, DestinationRows: 2},
+	}}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var back VerifyResult
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if back.Match || len(back.Tables) != 1 || back.Tables[0].Status != verifyStatusCountMismatch {
+		t.Errorf("round trip = %+v", back)
+	}
+	for _, key := range []string{`"match":false`, `"status":"count_mismatch"`, `"source_rows":3`, `"destination_rows":2`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("JSON %s lacks %s", data, key)
+		}
+	}
+}
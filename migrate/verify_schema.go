@@ -0,0 +1,241 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultSchemaSnapshotPath = ".farewall-schema.json"
+
+// SchemaSnapshot is the schema as it was created on the destination by the
+// last migration, written with --schema-snapshot.
+type SchemaSnapshot struct {
+	// Format is schemaSnapshotFormat; see formats.go
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+	Tables    []Table   `json:"tables"`
+	// SourcePosition is added once the copy phase has run
+	SourcePosition *SourceReadPositions `json:"source_position,omitempty"`
+}
+
+func writeSchemaSnapshot(path string, tables []Table) error {
+	return saveSchemaSnapshot(path, &SchemaSnapshot{Format: schemaSnapshotFormat, CreatedAt: utcNow(), Tables: tables})
+}
+
+func saveSchemaSnapshot(path string, snap *SchemaSnapshot) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schema snapshot: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write schema snapshot %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadSchemaSnapshot(path string) (*SchemaSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema snapshot %s: %w", path, err)
+	}
+	format, err := fileFormat(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema snapshot %s: %w", path, err)
+	}
+	if format > schemaSnapshotFormat {
+		return nil, &FormatError{Kind: "schema snapshot", Path: path, Format: format, Max: schemaSnapshotFormat,
+			Advice: "verify with the version that wrote it, or run the migration again to write a new one"}
+	}
+	var snap SchemaSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse schema snapshot %s: %w", path, err)
+	}
+	migrateSchemaSnapshot(&snap, format)
+	return &snap, nil
+}
+
+const (
+	diffMissingTable  = "missing_table"
+	diffMissingColumn = "missing_column"
+	diffExtraColumn   = "extra_column"
+	diffTypeMismatch  = "type_mismatch"
+	diffNullability   = "nullability_mismatch"
+	diffCollation     = "collation_mismatch"
+	diffPrimaryKey    = "primary_key_mismatch"
+)
+
+type SchemaDifference struct {
+	Kind     string `json:"kind"`
+	Table    string `json:"table"`
+	Column   string `json:"column,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+type SchemaDiff struct {
+	Match         bool               `json:"match"`
+	Against       string             `json:"against"`
+	TablesChecked int                `json:"tables_checked"`
+	Differences   []SchemaDifference `json:"differences"`
+}
+
+// diffSchemas compares the expected tables against the actual destination,
+// matching them by schema-qualified name.
+// Tables that exist only on the destination are not reported, so the check
+// keeps working in databases shared with other applications.
+func diffSchemas(expected, actual []Table) []SchemaDifference {
+	actualByName := make(map[string]Table, len(actual))
+	for _, t := range actual {
+		actualByName[t.qualifiedName()] = t
+	}
+
+	diffs := []SchemaDifference{}
+	for _, want := range expected {
+		name := want.qualifiedName()
+		got, ok := actualByName[name]
+		if !ok {
+			diffs = append(diffs, SchemaDifference{Kind: diffMissingTable, Table: name})
+			continue
+		}
+
+		for _, wc := range want.Columns {
+			gc, ok := got.column(wc.Name)
+			if !ok {
+				diffs = append(diffs, SchemaDifference{Kind: diffMissingColumn, Table: name, Column: wc.Name, Expected: wc.DataType})
+				continue
+			}
+			if !strings.EqualFold(wc.DataType, gc.DataType) {
+				diffs = append(diffs, SchemaDifference{Kind: diffTypeMismatch, Table: name, Column: wc.Name, Expected: wc.DataType, Actual: gc.DataType})
+			}
+			if wc.IsNullable != gc.IsNullable {
+				diffs = append(diffs, SchemaDifference{Kind: diffNullability, Table: name, Column: wc.Name, Expected: wc.IsNullable, Actual: gc.IsNullable})
+			}
+			if wc.Collation != gc.Collation {
+				diffs = append(diffs, SchemaDifference{Kind: diffCollation, Table: name, Column: wc.Name, Expected: wc.Collation, Actual: gc.Collation})
+			}
+		}
+		for _, gc := range got.Columns {
+			if _, ok := want.column(gc.Name); !ok {
+				diffs = append(diffs, SchemaDifference{Kind: diffExtraColumn, Table: name, Column: gc.Name, Actual: gc.DataType})
+			}
+		}
+
+		wantPK := strings.Join(want.PrimaryKey, ",")
+		gotPK := strings.Join(got.PrimaryKey, ",")
+		if wantPK != gotPK {
+			diffs = append(diffs, SchemaDifference{Kind: diffPrimaryKey, Table: name, Expected: wantPK, Actual: gotPK})
+		}
+	}
+	return diffs
+}
+
+// runVerifySchema implements the verify-schema subcommand. It prints a JSON
+// diff on stdout and returns the process exit code: 0 when the destination
+// matches, 1 when it doesn't and 2 when the check itself could not run.
+func runVerifySchema(args []string) int {
+	fs := flag.NewFlagSet("verify-schema", flag.ExitOnError)
+	snapshotPath := fs.String("snapshot", defaultSchemaSnapshotPath, "Schema snapshot written by a previous migration")
+	againstSource := fs.Bool("against-source", false, "Compare against the live source schema instead of a snapshot")
+	keepXataMetadata := fs.Bool("keep-xata-metadata", false, "With --against-source, expect Xata metadata columns as jsonb as the migration does with this flag")
+	foldIdentifiers := fs.Bool("fold-identifiers", false, "With --against-source, expect lower-case names as the migration creates with this flag")
+	var schemas schemaList
+	fs.Var(&schemas, "schemas", "With --against-source, the comma-separated source schemas, as migrated with --schemas (default public)")
+	var mapped schemaMap
+	fs.Var(&mapped, "schema-map", "With --against-source, the destination schema of a source schema, as migrated with --schema-map (repeatable)")
+	var env envSettings
+	env.register(fs)
+	fs.Parse(args)
+
+	if err := env.load(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	ctx := context.Background()
+
+	var expected []Table
+	var against string
+	if *againstSource {
+		sourceURL, err := env.get(sourceURLVar)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		if sourceURL == "" {
+			log.Printf("%s is not set", env.varName(sourceURLVar))
+			return 2
+		}
+		sourceConn, err := ConnectSource(ctx, sourceURL)
+		if err != nil {
+			log.Printf("Unable to connect to source database: %v", err)
+			return 2
+		}
+		defer sourceConn.Close(ctx)
+		expected, err = introspectSource(ctx, sourceConn, schemas.sourceSchemas(), nil)
+		if err != nil {
+			log.Printf("Failed to introspect source schema: %v", err)
+			return 2
+		}
+		handleXataMetadata(expected, *keepXataMetadata, &Report{})
+		if *foldIdentifiers || len(mapped) > 0 {
+			applyNames(expected, &Config{}, mapped, *foldIdentifiers)
+			expected = destinationTables(expected)
+		}
+		against = "source"
+	} else {
+		snap, err := loadSchemaSnapshot(*snapshotPath)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		expected = snap.Tables
+		against = "snapshot:" + *snapshotPath
+	}
+
+	destURL, err := env.get(destURLVar)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if destURL == "" {
+		log.Printf("%s is not set", env.varName(destURLVar))
+		return 2
+	}
+	destConn, err := pgx.Connect(ctx, destURL)
+	if err != nil {
+		log.Printf("Unable to connect to destination database: %v", err)
+		return 2
+	}
+	defer destConn.Close(ctx)
+
+	actual, err := introspectSchemas(ctx, destConn, tableSchemas(expected))
+	if err != nil {
+		log.Printf("Failed to introspect destination schema: %v", err)
+		return 2
+	}
+
+	diff := SchemaDiff{
+		Against:       against,
+		TablesChecked: len(expected),
+		Differences:   diffSchemas(expected, actual),
+	}
+	diff.Match = len(diff.Differences) == 0
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(diff); err != nil {
+		log.Printf("Failed to write diff: %v", err)
+		return 2
+	}
+	if !diff.Match {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,271 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/schollz/progressbar/v3"
+)
+
+// walSampleInterval is how often the destination WAL position is read.
+const walSampleInterval = time.Second
+
+// WALReport summarizes the WAL the destination generated during the copy.
+// The WAL position is server wide, so the figures include whatever else the
+// destination was doing at the time.
+type WALReport struct {
+	Bytes int64 `json:"bytes"`
+	// Rates are in bytes per second
+	AverageRate int64 `json:"average_rate"`
+	PeakRate    int64 `json:"peak_rate"`
+	MaxRate     int64 `json:"max_rate,omitempty"`
+	// ThrottledSeconds is the time the copy was paused by --max-wal-rate
+	ThrottledSeconds float64 `json:"throttled_seconds,omitempty"`
+}
+
+// walMonitor samples pg_current_wal_lsn on a connection of its own, since
+// the copy keeps the destination connection busy. With a maximum rate it
+// keeps a leaky bucket of the WAL written beyond that rate, and throttle
+// pauses the copy until the bucket has drained. A nil *walMonitor monitors
+// nothing, so callers need not check.
+type walMonitor struct {
+	conn    *pgx.Conn
+	maxRate int64
+	start   time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
+	report  *Report
+
+	// Written by the sampler, read by the copy
+	rate       atomic.Int64
+	total      atomic.Int64
+	pauseUntil atomic.Int64
+	seq        atomic.Int64
+	// shown is the sample last shown on a progress bar
+	shown atomic.Int64
+	// throttled sums the pauses, in nanoseconds
+	throttled atomic.Int64
+
+	// ctx ends the pauses of throttle with the copy
+	ctx context.Context
+
+	mu   sync.Mutex
+	peak int64
+	// stopErr is the sampling failure that stopped monitoring
+	stopErr error
+	// bar is the progress bar showing the rate, label its own description
+	bar   *progressbar.ProgressBar
+	label string
+}
+
+// startWALMonitor starts sampling the WAL position of dest. When the
+// position cannot be read, for lack of permission, on a standby or because
+// the extra connection is refused, monitoring is off for the run: a warning
+// is recorded and nil returned.
+func startWALMonitor(ctx context.Context, dest CopyConn, maxRate int64, report *Report) *walMonitor {
+	unavailable := func(err error) *walMonitor {
+		if maxRate > 0 {
+			report.warn(warnWALMonitor, "destination WAL monitoring is unavailable (%v); --max-wal-rate is not enforced", err)
+		} else {
+			fmt.Printf("  Destination WAL monitoring is unavailable: %v\n", err)
+		}
+		return nil
+	}
+	if dest.Config() == nil {
+		return unavailable(fmt.Errorf("the destination connection cannot be dialled again"))
+	}
+	conn, err := pgx.ConnectConfig(ctx, dest.Config())
+	if err != nil {
+		return unavailable(fmt.Errorf("failed to open the monitoring connection: %w", err))
+	}
+	lsn, err := walPosition(ctx, conn)
+	if err != nil {
+		conn.Close(context.Background())
+		return unavailable(err)
+	}
+
+	sctx, cancel := context.WithCancel(ctx)
+	w := &walMonitor{
+		conn:    conn,
+		maxRate: maxRate,
+		start:   time.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		report:  report,
+		ctx:     ctx,
+	}
+	go w.sample(sctx, lsn)
+	if maxRate > 0 {
+		fmt.Printf("  Throttling the copy to %s/s of destination WAL\n", formatBytes(maxRate))
+	}
+	return w
+}
+
+// walPosition returns the current WAL position of conn in bytes.
+func walPosition(ctx context.Context, conn *pgx.Conn) (int64, error) {
+	var lsn int64
+	err := conn.QueryRow(ctx, "SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), '0/0')::bigint").Scan(&lsn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the destination WAL position: %w", err)
+	}
+	return lsn, nil
+}
+
+func (w *walMonitor) sample(ctx context.Context, last int64) {
+	defer close(w.done)
+	ticker := time.NewTicker(walSampleInterval)
+	defer ticker.Stop()
+
+	lastAt := time.Now()
+	var debt float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lsn, err := walPosition(ctx, w.conn)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.mu.Lock()
+				w.stopErr = err
+				w.mu.Unlock()
+			}
+			// Never leave the copy paused on a stale sample
+			w.pauseUntil.Store(0)
+			return
+		}
+		now := time.Now()
+		elapsed := now.Sub(lastAt).Seconds()
+		delta := lsn - last
+		last, lastAt = lsn, now
+
+		rate := int64(float64(delta) / elapsed)
+		w.rate.Store(rate)
+		w.total.Add(delta)
+		w.mu.Lock()
+		w.peak = max(w.peak, rate)
+		w.mu.Unlock()
+
+		if w.maxRate > 0 {
+			debt = max(0, debt+float64(delta)-float64(w.maxRate)*elapsed)
+			var until int64
+			if debt > 0 {
+				until = now.Add(time.Duration(debt / float64(w.maxRate) * float64(time.Second))).UnixNano()
+			}
+			w.pauseUntil.Store(until)
+		}
+		w.seq.Add(1)
+	}
+}
+
+// throttle is called by the copy for every row or buffer it sends, from
+// several goroutines for parallel ranges. It pauses while the WAL written
+// beyond --max-wal-rate drains, and shows the current rate next to the
+// description of bar, if any.
+func (w *walMonitor) throttle(bar *progressbar.ProgressBar) {
+	if w == nil {
+		return
+	}
+	if until := w.pauseUntil.Load(); until > 0 {
+		if d := time.Until(time.Unix(0, until)); d > 0 {
+			start := time.Now()
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+			}
+			w.throttled.Add(int64(time.Since(start)))
+		}
+	}
+
+	// A new bar picks the rate up with the next sample
+	seq := w.seq.Load()
+	if bar == nil || seq == w.shown.Load() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.shown.Load() == seq {
+		return
+	}
+	w.shown.Store(seq)
+	if bar != w.bar {
+		w.bar, w.label = bar, bar.State().Description
+	}
+	bar.Describe(fmt.Sprintf("%s (WAL %s/s)", w.label, formatBytes(w.rate.Load())))
+}
+
+// reader returns r throttled before every read.
+func (w *walMonitor) reader(r io.Reader, bar *progressbar.ProgressBar) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &throttledReader{r: r, wal: w, bar: bar}
+}
+
+type throttledReader struct {
+	r   io.Reader
+	wal *walMonitor
+	bar *progressbar.ProgressBar
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	t.wal.throttle(t.bar)
+	return t.r.Read(p)
+}
+
+// status is appended to the overall progress line.
+func (w *walMonitor) status() string {
+	if w == nil {
+		return ""
+	}
+	total := w.total.Load()
+	return fmt.Sprintf(", WAL %s (%s/s)", formatBytes(total), formatBytes(w.averageRate(total)))
+}
+
+func (w *walMonitor) averageRate(total int64) int64 {
+	elapsed := time.Since(w.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(total) / elapsed)
+}
+
+// stop ends monitoring, closes its connection and returns the summary for
+// the report.
+func (w *walMonitor) stop() *WALReport {
+	if w == nil {
+		return nil
+	}
+	w.cancel()
+	<-w.done
+	w.conn.Close(context.Background())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopErr != nil {
+		w.report.warn(warnWALMonitor, "destination WAL monitoring stopped during the copy: %v", w.stopErr)
+	}
+	total := w.total.Load()
+	throttled := time.Duration(w.throttled.Load())
+	wr := &WALReport{
+		Bytes:            total,
+		AverageRate:      w.averageRate(total),
+		PeakRate:         w.peak,
+		MaxRate:          w.maxRate,
+		ThrottledSeconds: throttled.Seconds(),
+	}
+	fmt.Printf("Destination WAL: %s generated, %s/s on average, %s/s peak", formatBytes(wr.Bytes), formatBytes(wr.AverageRate), formatBytes(wr.PeakRate))
+	if throttled > 0 {
+		fmt.Printf(", copy paused for %s", throttled.Round(time.Second))
+	}
+	fmt.Println()
+	return wr
+}
@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// warningCode identifies a category of warnings. Codes are stable across
+// releases, so a config can suppress them (see Suppression); a new category
+// gets the next free code, and the codes of removed ones are not reused.
+type warningCode string
+
+const (
+	warnStrippedDefault    warningCode = "W001"
+	warnNoPrimaryKey       warningCode = "W002"
+	warnCheckSkipped       warningCode = "W003"
+	warnIndexSkipped       warningCode = "W004"
+	warnForeignKeySkipped  warningCode = "W005"
+	warnForeignKeyNotValid warningCode = "W006"
+	warnOrphansDeleted     warningCode = "W007"
+	warnChunkMismatch      warningCode = "W008"
+	warnRetries            warningCode = "W009"
+	warnTableSkipped       warningCode = "W010"
+	warnTempLeftovers      warningCode = "W011"
+	warnReadLimit          warningCode = "W012"
+	warnSummaryMismatch    warningCode = "W013"
+	warnSchemaCheck        warningCode = "W014"
+	warnPartitionOutliers  warningCode = "W015"
+	warnLocale             warningCode = "W016"
+	warnEncoding           warningCode = "W017"
+	warnForeignTables      warningCode = "W018"
+	warnIgnoredColumns     warningCode = "W019"
+	warnReplicaFallback    warningCode = "W020"
+	warnStatisticsSkipped  warningCode = "W021"
+	warnAnalyzeFailed      warningCode = "W022"
+	warnLoadHooks          warningCode = "W023"
+	warnWALMonitor         warningCode = "W024"
+	warnPooler             warningCode = "W025"
+	warnMatViewSkipped     warningCode = "W026"
+	warnSequenceGrant      warningCode = "W027"
+	warnEnumOrder          warningCode = "W028"
+	warnDomainMismatch     warningCode = "W029"
+	warnDomainFlattened    warningCode = "W030"
+	warnExtensionFailed    warningCode = "W031"
+	warnFunctionSkipped    warningCode = "W032"
+	warnTriggerSkipped     warningCode = "W033"
+	warnCompositeMismatch  warningCode = "W034"
+	warnExclusionFailed    warningCode = "W035"
+	warnJSONQuarantined    warningCode = "W036"
+	warnTableGrant         warningCode = "W037"
+	warnPolicyRoles        warningCode = "W038"
+	warnPolicySkipped      warningCode = "W039"
+	warnCollationMissing   warningCode = "W040"
+	warnOrphanedReferences warningCode = "W041"
+	warnCascadeDrop        warningCode = "W042"
+	warnBloat              warningCode = "W043"
+	warnIncrementalFull    warningCode = "W044"
+	warnSnapshotPartial    warningCode = "W045"
+)
+
+// warningNames are the short names of the codes, as listed in the README.
+var warningNames = map[warningCode]string{
+	warnStrippedDefault:    "stripped-default",
+	warnNoPrimaryKey:       "no-pk",
+	warnCheckSkipped:       "check-skipped",
+	warnIndexSkipped:       "index-skipped",
+	warnForeignKeySkipped:  "fk-skipped",
+	warnForeignKeyNotValid: "fk-not-valid",
+	warnOrphansDeleted:     "orphans-deleted",
+	warnChunkMismatch:      "chunk-mismatch",
+	warnRetries:            "retries",
+	warnTableSkipped:       "table-skipped",
+	warnTempLeftovers:      "temp-leftovers",
+	warnReadLimit:          "read-limit",
+	warnSummaryMismatch:    "summary-mismatch",
+	warnSchemaCheck:        "schema-check",
+	warnPartitionOutliers:  "partition-outliers",
+	warnLocale:             "locale",
+	warnEncoding:           "encoding",
+	warnForeignTables:      "foreign-tables",
+	warnIgnoredColumns:     "ignored-columns",
+	warnReplicaFallback:    "replica-fallback",
+	warnStatisticsSkipped:  "statistics-skipped",
+	warnAnalyzeFailed:      "analyze-failed",
+	warnLoadHooks:          "load-hooks",
+	warnWALMonitor:         "wal-monitor",
+	warnPooler:             "pooler",
+	warnMatViewSkipped:     "matview-skipped",
+	warnSequenceGrant:      "sequence-grant",
+	warnEnumOrder:          "enum-order",
+	warnDomainMismatch:     "domain-mismatch",
+	warnDomainFlattened:    "domain-flattened",
+	warnExtensionFailed:    "extension-failed",
+	warnFunctionSkipped:    "function-skipped",
+	warnTriggerSkipped:     "trigger-skipped",
+	warnCompositeMismatch:  "composite-mismatch",
+	warnExclusionFailed:    "exclusion-failed",
+	warnJSONQuarantined:    "json-quarantined",
+	warnTableGrant:         "table-grant",
+	warnPolicyRoles:        "policy-roles",
+	warnPolicySkipped:      "policy-skipped",
+	warnCollationMissing:   "collation-missing",
+	warnOrphanedReferences: "orphaned-references",
+	warnCascadeDrop:        "cascade-drop",
+	warnBloat:              "bloat",
+	warnIncrementalFull:    "incremental-full",
+	warnSnapshotPartial:    "snapshot-partial",
+}
+
+// Suppression hides the warnings of Code, only those about tables matching
+// one of Tables when it is set. Suppressed warnings are still counted in the
+// report.
+type Suppression struct {
+	Code warningCode `json:"code"`
+	// Tables are path.Match patterns of source table names
+	Tables []string `json:"tables"`
+}
+
+func validateSuppressions(suppressions []Suppression) error {
+	for _, s := range suppressions {
+		if _, ok := warningNames[s.Code]; !ok {
+			return fmt.Errorf("config: suppression of unknown warning code %q", s.Code)
+		}
+		for _, p := range s.Tables {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("config: suppression of %s: table pattern %q: %w", s.Code, p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) suppressions() []Suppression {
+	if c == nil {
+		return nil
+	}
+	return c.Suppressions
+}
+
+// suppressed reports whether a warning of code about table ("" when it is
+// about no table in particular) is hidden by one of suppressions.
+func suppressed(suppressions []Suppression, code warningCode, table string) bool {
+	return slices.ContainsFunc(suppressions, func(s Suppression) bool {
+		if s.Code != code {
+			return false
+		}
+		if len(s.Tables) == 0 {
+			return true
+		}
+		return table != "" && slices.ContainsFunc(s.Tables, func(p string) bool {
+			ok, _ := path.Match(p, table)
+			return ok
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"migration-tool/internal/sqlutil"
+)
+
+const (
+	schemaChangeExcluded = "excluded"
+	schemaChangeJSONB    = "converted_to_jsonb"
+)
+
+// SchemaChange records a deliberate difference between a source column and
+// what is created on the destination.
+type SchemaChange struct {
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	Change   string `json:"change"`
+	DataType string `json:"source_data_type"`
+	// SourceDefault and Default are set for default_rewrites
+	SourceDefault string `json:"source_default,omitempty"`
+	Default       string `json:"default,omitempty"`
+}
+
+// isXataMetadata reports whether c is one of the non-scalar metadata columns
+// Xata exposes through its Postgres endpoint, such as the "xata" object
+// column. The scalar xata_id, xata_version, ... columns are regular data.
+func isXataMetadata(c Column) bool {
+	if c.Name != "xata" && !strings.HasPrefix(c.Name, "xata_") && !strings.HasPrefix(c.Name, "xata.") {
+		return false
+	}
+	dataType := strings.ToLower(c.DataType)
+	return c.Composite || dataType == "json" || dataType == "jsonb" || strings.Contains(dataType, "xata")
+}
+
+// handleXataMetadata leaves Xata metadata columns out of every table, or with
+// keep converts them to jsonb, and records each decision in the report.
+// Primary key columns are never touched.
+func handleXataMetadata(tables []Table, keep bool, report *Report) {
+	for i := range tables {
+		t := &tables[i]
+		var columns []Column
+		for _, c := range t.Columns {
+			if !isXataMetadata(c) || slices.Contains(t.PrimaryKey, c.Name) {
+				columns = append(columns, c)
+				continue
+			}
+			change := SchemaChange{Table: t.Name, Column: c.Name, DataType: c.DataType, Change: schemaChangeExcluded}
+			if keep {
+				change.Change = schemaChangeJSONB
+				c.SourceExpr = "to_jsonb(" + sqlutil.QuoteIdent(c.Name) + ")"
+				c.DataType = "jsonb"
+				c.Composite = false
+				c.Default, c.StrippedDefault = nil, ""
+				columns = append(columns, c)
+				fmt.Printf("  %s.%s: Xata metadata column (%s) copied as jsonb\n", t.Name, c.Name, change.DataType)
+			} else {
+				fmt.Printf("  %s.%s: Xata metadata column (%s) left out (see --keep-xata-metadata)\n", t.Name, c.Name, change.DataType)
+			}
+			report.SchemaChanges = append(report.SchemaChanges, change)
+		}
+		t.Columns = columns
+	}
+}
+
+func hasSourceExprs(t Table) bool {
+	for _, c := range t.Columns {
+		if c.SourceExpr != "" {
+			return true
+		}
+	}
+	return false
+}